@@ -0,0 +1,230 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// alignSearch is the max offset, in pixels, searched exhaustively
+// at the coarsest level of Align.
+const alignSearch = 4
+
+// Align returns the offset of the content of b relative to a, so that
+// pixel x, y of a shows the same as pixel x+dx, y+dy of b, with dx and dy
+// between -maxOffset and maxOffset. It maximizes the normalized cross-
+// correlation of luminance of the overlapping parts of the images,
+// first exhaustively on downsampled images, then refining the offset
+// at each finer level, up to the images themselves.
+//
+// Offsets are only found if the overlap keeps most of the content.
+// Images of uniform luminance are at offset 0, 0, as are those
+// whose correlation is the same at all offsets.
+func Align(a, b image.Image, maxOffset int) (dx, dy int) {
+	if maxOffset <= 0 {
+		return 0, 0
+	}
+	la := lumaLevel{luma(a), a.Bounds().Dx(), a.Bounds().Dy()}
+	lb := lumaLevel{luma(b), b.Bounds().Dx(), b.Bounds().Dy()}
+	levels := [][2]lumaLevel{{la, lb}}
+	for f := 1; maxOffset/f > alignSearch; f *= 2 {
+		la, lb = la.halve(), lb.halve()
+		if la.w < 2*alignSearch || la.h < 2*alignSearch || lb.w < 2*alignSearch || lb.h < 2*alignSearch {
+			break
+		}
+		levels = append(levels, [2]lumaLevel{la, lb})
+	}
+	top := len(levels) - 1
+	r := (maxOffset + 1<<uint(top) - 1) >> uint(top)
+	for i := top; i >= 0; i-- {
+		la, lb := levels[i][0], levels[i][1]
+		// at each finer level, the offset is twice that
+		// of the coarser one, plus or minus a pixel
+		cx, cy := 2*dx, 2*dy
+		if i == top {
+			cx, cy = 0, 0
+		} else {
+			r = 1
+		}
+		max := maxOffset >> uint(i)
+		best, bx, by := math.Inf(-1), cx, cy
+		for oy := cy - r; oy <= cy+r; oy++ {
+			for ox := cx - r; ox <= cx+r; ox++ {
+				if ox < -max || ox > max || oy < -max || oy > max {
+					continue
+				}
+				// ties go to the smallest offset
+				s := ncc(la, lb, ox, oy)
+				if s > best || s == best && abs(int64(ox))+abs(int64(oy)) < abs(int64(bx))+abs(int64(by)) {
+					best, bx, by = s, ox, oy
+				}
+			}
+		}
+		if i == top && best <= 0 {
+			// no correlation at any offset
+			return 0, 0
+		}
+		dx, dy = bx, by
+	}
+	return dx, dy
+}
+
+// lumaLevel is luminance of a w x h image, y*w+x indexed.
+type lumaLevel struct {
+	l    []float64
+	w, h int
+}
+
+// halve returns l downsampled by 2, with every pixel the mean
+// of the up to 2 x 2 pixels of l it covers.
+func (l lumaLevel) halve() lumaLevel {
+	return lumaLevel{halveLuma(l.l, l.w, l.h), (l.w + 1) / 2, (l.h + 1) / 2}
+}
+
+// halveLuma returns w x h luminance l downsampled by 2,
+// (w+1)/2 x (h+1)/2 pixels. Every pixel is the mean of the up
+// to 2 x 2 pixels of l it covers.
+func halveLuma(l []float64, w, h int) []float64 {
+	hw, hh := (w+1)/2, (h+1)/2
+	m := make([]float64, hw*hh)
+	for y := 0; y < hh; y++ {
+		for x := 0; x < hw; x++ {
+			var sum, n float64
+			for sy := 2 * y; sy < 2*y+2 && sy < h; sy++ {
+				for sx := 2 * x; sx < 2*x+2 && sx < w; sx++ {
+					sum += l[sy*w+sx]
+					n++
+				}
+			}
+			m[y*hw+x] = sum / n
+		}
+	}
+	return m
+}
+
+// overlap returns the rectangle of pixels of a w x h image a which
+// are within wb x hb image b, when b is at offset dx, dy, see Align.
+func overlap(w, h, wb, hb, dx, dy int) image.Rectangle {
+	return image.Rect(0, 0, w, h).Intersect(image.Rect(-dx, -dy, wb-dx, hb-dy))
+}
+
+// ncc returns the normalized cross-correlation of a and b at offset
+// dx, dy over their overlap, or -Inf if they overlap by less than
+// half of either of them. It is 0 if either part is uniform.
+func ncc(a, b lumaLevel, dx, dy int) float64 {
+	r := overlap(a.w, a.h, b.w, b.h, dx, dy)
+	n := r.Dx() * r.Dy()
+	if 2*n < a.w*a.h || 2*n < b.w*b.h {
+		return math.Inf(-1)
+	}
+	var sa, sb float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		ra, rb := a.l[y*a.w:], b.l[(y+dy)*b.w:]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			sa += ra[x]
+			sb += rb[x+dx]
+		}
+	}
+	ma, mb := sa/float64(n), sb/float64(n)
+	var cov, va, vb float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		ra, rb := a.l[y*a.w:], b.l[(y+dy)*b.w:]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			pa, pb := ra[x]-ma, rb[x+dx]-mb
+			cov += pa * pb
+			va += pa * pa
+			vb += pb * pb
+		}
+	}
+	if va == 0 || vb == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(va*vb)
+}
+
+type aligned struct {
+	inner     Differ
+	maxOffset int
+}
+
+// NewAligned creates a new Differ which finds the offset of the content
+// of the compared images with Align, within maxOffset pixels, e.g. for
+// screenshots of which one has an extra row at the top, and compares
+// their overlapping parts with inner.
+//
+// The difference image has the size of the compared images, as with the
+// other Differs, and pixel x, y of it is the result of comparing pixel
+// x, y of the first image with the matching pixel of the second one.
+// Pixels of the first image outside of the overlap are not compared
+// and are left black, as pixels which are not different. CompareResult
+// sets the offset in Result.Stats, along with stats of inner, if any.
+func NewAligned(inner Differ, maxOffset int) Differ {
+	return &aligned{inner: inner, maxOffset: maxOffset}
+}
+
+// Compare compares a and b with the inner Differ, after aligning them.
+func (d *aligned) Compare(a, b image.Image) (image.Image, int, error) {
+	return d.compareStats(a, b, new(PhaseTimings), new(ErrorStats))
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *aligned) CompareInto(diff *image.NRGBA, a, b image.Image) (int, error) {
+	m, n, err := d.Compare(a, b)
+	if err != nil {
+		return -1, err
+	}
+	r := m.Bounds()
+	resize(diff, r.Dx(), r.Dy())
+	draw.Draw(diff, diff.Rect, m, r.Min, draw.Src)
+	return n, nil
+}
+
+func (d *aligned) compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error) {
+	return d.compareStats(a, b, t, new(ErrorStats))
+}
+
+func (d *aligned) compareStats(a, b image.Image, t *PhaseTimings, s *ErrorStats) (image.Image, int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return nil, -1, ErrSize
+	}
+	dx, dy := Align(a, b, d.maxOffset)
+	r := overlap(w, h, w, h, dx, dy)
+	ca, cb := crop(a, r.Add(ab.Min)), crop(b, r.Add(bb.Min).Add(image.Pt(dx, dy)))
+	var m image.Image
+	var n int
+	var err error
+	switch inner := d.inner.(type) {
+	case statsDiffer:
+		m, n, err = inner.compareStats(ca, cb, t, s)
+	case timedDiffer:
+		m, n, err = inner.compareTimed(ca, cb, t)
+	default:
+		m, n, err = inner.Compare(ca, cb)
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+	diff := image.NewNRGBA(image.Rect(0, 0, w, h))
+	if r != diff.Rect {
+		fillPass(diff)
+	}
+	draw.Draw(diff, r, m, m.Bounds().Min, draw.Src)
+	s.Shift = image.Pt(dx, dy)
+	return diff, n, nil
+}
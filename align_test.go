@@ -0,0 +1,93 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestAlign(t *testing.T) {
+	a := blocks(120, 90)
+	tests := []struct {
+		dx, dy, max int
+	}{
+		{0, 0, 8},
+		{0, 2, 8},
+		{3, -1, 8},
+		{-7, 5, 8},
+		{1, 1, 1},
+		{12, 0, 16},
+		{-13, -9, 20},
+	}
+	for i, test := range tests {
+		b := translate(a, test.dx, test.dy)
+		if dx, dy := Align(a, b, test.max); dx != test.dx || dy != test.dy {
+			t.Errorf("(%d) Align = %d, %d; want %d, %d", i, dx, dy, test.dx, test.dy)
+		}
+		// the other way around
+		if dx, dy := Align(b, a, test.max); dx != -test.dx || dy != -test.dy {
+			t.Errorf("(%d) reverse Align = %d, %d; want %d, %d", i, dx, dy, -test.dx, -test.dy)
+		}
+	}
+
+	// offsets beyond maxOffset are not found
+	if dx, dy := Align(a, translate(a, 0, 5), 2); dy == 5 || dx < -2 || dx > 2 || dy < -2 || dy > 2 {
+		t.Errorf("Align out of range = %d, %d", dx, dy)
+	}
+	gray := image.NewUniform(color.Gray{0x80})
+	m := image.NewGray(image.Rect(0, 0, 50, 40))
+	draw.Draw(m, m.Rect, gray, image.ZP, draw.Src)
+	if dx, dy := Align(m, m, 8); dx != 0 || dy != 0 {
+		t.Errorf("uniform Align = %d, %d; want 0, 0", dx, dy)
+	}
+}
+
+func TestAligned(t *testing.T) {
+	a := blocks(60, 45)
+	b := translate(a, 0, 2)
+	if _, n, err := NewBinary().Compare(a, b); err != nil || n == 0 {
+		t.Fatalf("unaligned: n = %d, err = %v; want > 0", n, err)
+	}
+	res, err := CompareResult(NewAligned(NewBinary(), 8), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.N != 0 || res.Stats == nil || res.Stats.Shift != image.Pt(0, 2) {
+		t.Errorf("aligned: n = %d, stats = %+v; want 0, shift 0, 2", res.N, res.Stats)
+	}
+	if r := res.Diff.Bounds(); r != a.Rect || !res.DiffBounds.Empty() {
+		t.Errorf("diff bounds = %v, marked %v; want %v, none", r, res.DiffBounds, a.Rect)
+	}
+
+	// differences are at their position in a
+	draw.Draw(b, image.Rect(10, 22, 15, 27), image.NewUniform(color.White), image.ZP, draw.Src)
+	diff, n, err := NewAligned(NewBinary(), 8).Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 25 {
+		t.Errorf("n = %d; want 25", n)
+	}
+	if !marked(diff.At(10, 20)) || !marked(diff.At(14, 24)) || marked(diff.At(14, 25)) {
+		t.Error("square not marked at 10, 20 - 15, 25")
+	}
+
+	if _, _, err := NewAligned(NewBinary(), 8).Compare(a, blocks(60, 44)); err != ErrSize {
+		t.Errorf("err = %v; want ErrSize", err)
+	}
+}
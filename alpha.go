@@ -0,0 +1,139 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// AlphaMode is how the binary and perceptual algorithms treat
+// the alpha channel of compared images, see WithAlphaMode.
+type AlphaMode int
+
+// Alpha modes.
+const (
+	// CompareAlpha compares alpha-premultiplied colors, so that pixels
+	// differ if their alpha does. Colors of fully transparent pixels
+	// don't matter. The perceptual algorithm sees colors composited
+	// over black.
+	CompareAlpha AlphaMode = iota
+	// IgnoreAlpha compares colors as if all pixels were opaque,
+	// un-premultiplying them if needed. Fully transparent pixels
+	// of images with premultiplied color models, such as RGBA,
+	// are black.
+	IgnoreAlpha
+	// PremultiplyFirst composites both images over the background
+	// color set by WithBackground, white by default, and compares
+	// the results, so that pixels differ only if they look different
+	// over that background.
+	PremultiplyFirst
+)
+
+func (m AlphaMode) String() string {
+	switch m {
+	case CompareAlpha:
+		return "compare"
+	case IgnoreAlpha:
+		return "ignore"
+	case PremultiplyFirst:
+		return "premultiply"
+	}
+	return fmt.Sprintf("AlphaMode(%d)", int(m))
+}
+
+// validAlphaMode returns an error if m is not one of the AlphaMode values.
+func validAlphaMode(m AlphaMode) error {
+	if m < CompareAlpha || m > PremultiplyFirst {
+		return fmt.Errorf("imgdiff: unknown alpha mode %v", m)
+	}
+	return nil
+}
+
+// alphaView returns m as seen with the alpha mode of o: an opaque
+// image of the same bounds and color model, or m itself if the mode
+// is CompareAlpha or m is grayscale or a FloatImage.
+func (o options) alphaView(m image.Image) image.Image {
+	if o.alphaMode == CompareAlpha || isGray(m) {
+		return m
+	}
+	if _, ok := m.(FloatImage); ok {
+		return m
+	}
+	v := &alphaImage{Image: m, mode: o.alphaMode}
+	r, g, b, _ := opaque(o.background()).RGBA()
+	v.bg = [3]uint32{r, g, b}
+	return v
+}
+
+// background returns the color of WithBackground, white by default.
+// It may not be opaque.
+func (o options) background() color.Color {
+	if o.bg == nil {
+		return color.White
+	}
+	return o.bg
+}
+
+// alphaImage is an opaque view of Image in alpha mode IgnoreAlpha
+// or PremultiplyFirst. Its color model is that of Image, so that
+// binary compares it with as many bits as the original.
+type alphaImage struct {
+	image.Image
+	mode AlphaMode
+	// 16-bit premultiplied background of PremultiplyFirst
+	bg [3]uint32
+}
+
+func (m *alphaImage) At(x, y int) color.Color {
+	c := m.Image.At(x, y)
+	if m.mode == IgnoreAlpha {
+		return opaque(c)
+	}
+	r, g, b, a := c.RGBA()
+	return color.RGBA64{
+		uint16(r + m.bg[0]*(0xffff-a)/0xffff),
+		uint16(g + m.bg[1]*(0xffff-a)/0xffff),
+		uint16(b + m.bg[2]*(0xffff-a)/0xffff),
+		0xffff,
+	}
+}
+
+// opaque returns c with full alpha and its non-premultiplied color.
+// Colors which store it, such as NRGBA, are read as is, without
+// the rounding errors of un-premultiplying.
+func opaque(c color.Color) color.Color {
+	switch c := c.(type) {
+	case color.NRGBA:
+		c.A = 0xff
+		return c
+	case color.NRGBA64:
+		c.A = 0xffff
+		return c
+	case color.NYCbCrA:
+		return c.YCbCr
+	}
+	r, g, b, a := c.RGBA()
+	if a == 0 {
+		return color.Black
+	}
+	return color.RGBA64{
+		uint16(r * 0xffff / a),
+		uint16(g * 0xffff / a),
+		uint16(b * 0xffff / a),
+		0xffff,
+	}
+}
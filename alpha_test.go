@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestAlphaMode(t *testing.T) {
+	black := color.RGBA{0, 0, 0, 0xff}
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	tests := []struct {
+		// a is NRGBA, b is RGBA
+		a, b color.Color
+		// whether they differ with CompareAlpha, IgnoreAlpha and
+		// PremultiplyFirst over white and black; perceptual sees
+		// CompareAlpha as PremultiplyFirst over black
+		differ [4]bool
+	}{
+		// transparent colors
+		{color.NRGBA{0xff, 0, 0, 0}, color.NRGBA{0, 0xff, 0, 0}, [4]bool{false, true, false, false}},
+		// half transparent and opaque red
+		{color.NRGBA{0xff, 0, 0, 0x80}, red, [4]bool{true, false, true, true}},
+		// transparent and opaque white
+		{color.NRGBA{0xff, 0xff, 0xff, 0}, color.White, [4]bool{true, false, false, true}},
+		// transparent and opaque black
+		{color.NRGBA{0, 0, 0, 0}, black, [4]bool{true, false, true, false}},
+		// half transparent red as NRGBA and RGBA
+		{color.NRGBA{0xff, 0, 0, 0x80}, color.RGBA{0x80, 0, 0, 0x80}, [4]bool{false, false, false, false}},
+	}
+	opts := [][]Option{
+		{WithAlphaMode(CompareAlpha)},
+		{WithAlphaMode(IgnoreAlpha)},
+		{WithAlphaMode(PremultiplyFirst)},
+		{WithAlphaMode(PremultiplyFirst), WithBackground(color.Black)},
+	}
+	r := image.Rect(0, 0, 32, 32)
+	for i, test := range tests {
+		a, b := image.NewNRGBA(r), image.NewRGBA(r)
+		for y := 0; y < r.Dy(); y++ {
+			for x := 0; x < r.Dx(); x++ {
+				a.Set(x, y, test.a)
+				b.Set(x, y, test.b)
+			}
+		}
+		for j, o := range opts {
+			for k, d := range []Differ{NewBinary(o...), NewDefaultPerceptual(o...)} {
+				_, n, err := d.Compare(a, b)
+				if err != nil {
+					t.Fatalf("(%d) %T %v: %v", i, d, o, err)
+				}
+				want := test.differ[j]
+				if k == 1 && j == 0 {
+					want = test.differ[3]
+				}
+				if (n > 0) != want {
+					t.Errorf("(%d) %T %v: n = %d; want differ %v", i, d, AlphaMode(j%3), n, want)
+				}
+			}
+		}
+	}
+
+	a, b := image.NewNRGBA(r), image.NewNRGBA(r)
+	for _, d := range []Differ{NewBinary(WithAlphaMode(3)), NewDefaultPerceptual(WithAlphaMode(-1))} {
+		if _, _, err := d.Compare(a, b); err == nil {
+			t.Errorf("%T: unknown alpha mode: no error", d)
+		}
+	}
+}
+
+func TestAlphaModeString(t *testing.T) {
+	for m, want := range map[AlphaMode]string{
+		CompareAlpha:     "compare",
+		IgnoreAlpha:      "ignore",
+		PremultiplyFirst: "premultiply",
+		AlphaMode(3):     "AlphaMode(3)",
+	} {
+		if s := m.String(); s != want {
+			t.Errorf("%d: String = %q; want %q", int(m), s, want)
+		}
+	}
+}
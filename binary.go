@@ -15,52 +15,771 @@
 package imgdiff
 
 import (
+	"bytes"
+	"fmt"
 	"image"
 	"image/color"
+	"io"
+	"math"
+	"reflect"
+	"sort"
 )
 
-type binary struct{}
+type binary struct {
+	opts options
+	// max color distance of NewBinaryFuzz, in percent; 0 means none
+	fuzz float64
+	// invalid fuzz or options, returned by Compare
+	err error
+}
 
 // NewBinary creates a new Differ based on simple binary algorithm.
-func NewBinary() Differ {
-	return &binary{}
+//
+// Pixels are compared by their alpha-premultiplied colors, that is by
+// how they look composited over any background. In particular, colors
+// of fully transparent pixels don't matter. See WithAlphaMode for
+// other treatments of alpha. Colors are compared with 8 bits per
+// channel if either image has 8-bit color model, such as RGBA, NRGBA
+// or Gray, so that e.g. an NRGBA image and its conversion to RGBA
+// are equal. Images with 16-bit color models are compared
+// with 16 bits per channel. Translucent pixels of an image whose colors
+// are premultiplied by alpha, such as RGBA, and one whose colors aren't,
+// such as NRGBA, are equal if their premultiplied red, green and blue
+// differ by at most 1, which rounding of premultiplication may cause,
+// and their alpha is the same. Samples are compared as stored,
+// gamma-encoded, unless WithLinearLight is set.
+func NewBinary(opts ...Option) Differ {
+	d := &binary{opts: newOptions(opts)}
+	d.err = d.validOptions()
+	return d
+}
+
+// NewBinaryFuzz creates a new Differ based on the binary algorithm
+// which counts pixels as equal if their colors are close, within
+// fuzzPercent of the max distance, as ImageMagick does with -fuzz.
+//
+// Pixels are equal if the squared difference of their alpha is at
+// most fuzz², and the sum of three times that and the squared
+// differences of red, green and blue is at most 3 fuzz², fuzz being
+// fuzzPercent of the max sample value, but at least √½ of that of 16-bit
+// samples, as with 16-bit ImageMagick builds. That is, opaque pixels are
+// equal if their Euclidean RGB distance is at most fuzzPercent of
+// the distance of black and white. Unlike ImageMagick, which scales
+// color differences by alpha, colors are compared premultiplied
+// by alpha, as with NewBinary, which is the same as NewBinaryFuzz(0).
+//
+// Pixels which differ within the fuzz are drawn dim gray in the
+// difference image, as with WithChannelTolerance, along with which
+// it applies: pixels within either are not counted.
+// Compare returns an error if fuzzPercent is negative or NaN.
+// FloatImage inputs are compared with WithFloatEpsilon.
+func NewBinaryFuzz(fuzzPercent float64, opts ...Option) Differ {
+	d := &binary{opts: newOptions(opts), fuzz: fuzzPercent}
+	d.err = d.validOptions()
+	if !(fuzzPercent >= 0) {
+		d.err = fmt.Errorf("imgdiff: invalid fuzz %g%%", fuzzPercent)
+	}
+	return d
+}
+
+// validOptions returns an error if options of d are invalid.
+func (d *binary) validOptions() error {
+	if err := validAlphaMode(d.opts.alphaMode); err != nil {
+		return err
+	}
+	if err := d.opts.validOverlay(); err != nil {
+		return err
+	}
+	if err := d.opts.validMaxDiff(); err != nil {
+		return err
+	}
+	if err := d.opts.validShiftTolerance(); err != nil {
+		return err
+	}
+	return validLinearGamma(d.opts.linearGamma)
 }
 
 // Compare compares a and b using binary comparison.
+// If either a or b is a TiledImage, it is compared one tile at a time.
 func (d *binary) Compare(a, b image.Image) (image.Image, int, error) {
+	return d.compareTimed(a, b, new(PhaseTimings))
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *binary) CompareInto(dst *image.NRGBA, a, b image.Image) (int, error) {
+	return d.compareInto(dst, a, b, new(PhaseTimings))
+}
+
+// CompareCount is Compare returning the number of different pixels only.
+// No difference image is allocated, unless WithShiftTolerance or
+// WithAntiAliasing is set, which look at marks of nearby pixels.
+func (d *binary) CompareCount(a, b image.Image) (int, error) {
+	return d.compareInto(nil, a, b, new(PhaseTimings))
+}
+
+// CompareResult is Compare returning a Result, see CompareResult.
+func (d *binary) CompareResult(a, b image.Image) (*Result, error) {
+	return compareResult(d, a, b)
+}
+
+func (d *binary) compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error) {
+	diff := new(image.NRGBA)
+	n, err := d.compareInto(diff, a, b, t)
+	if err != nil {
+		return nil, n, err
+	}
+	return diff, n, nil
+}
+
+func (d *binary) compareInto(dst *image.NRGBA, a, b image.Image, t *PhaseTimings) (int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return -1, ErrSize
+	}
+	if d.err != nil {
+		return -1, d.err
+	}
+	if err := d.opts.checkSize(ab); err != nil {
+		return -1, err
+	}
+	if dst == nil && (d.opts.shiftTolerance > 0 || d.opts.antiAliasing) {
+		dst = new(image.NRGBA)
+	}
+	// with no dst, only the number of different pixels is returned
+	count := dst == nil
+	if count {
+		dst = rowImage(w, h)
+	} else {
+		resize(dst, w, h)
+	}
+	prog := d.opts.newProgress(h)
+	if sameImage(a, b) {
+		if !count {
+			d.opts.fillSame(dst, a, b)
+		}
+		prog.finish()
+		return 0, nil
+	}
+	base := d.opts.base(a, b)
+	a, b = d.opts.linearView(d.opts.alphaView(a)), d.opts.linearView(d.opts.alphaView(b))
+	budget := d.opts.budget()
+	var n int
+	var err error
+	newPhases("binary", ab, t).run("compare", &t.Compare, func() {
+		n, err = d.compare(dst, a, b, budget, prog)
+		if err != nil || budget.exceeded() {
+			return
+		}
+		if n > 0 && d.opts.shiftTolerance > 0 {
+			n -= d.tolerateShift(dst, a, b)
+		}
+		if n > 0 && d.opts.antiAliasing {
+			n -= d.tolerateAA(dst, a, b, dst.Rect)
+		}
+		switch {
+		case count:
+		case d.opts.hasOverlay:
+			paintOverlay(dst, base, d.opts.overlayDim, dst.Rect)
+		case d.opts.heatmap:
+			paintHeat(dst, a, b, dst.Rect)
+		case n > 0 && d.opts.deltaColors:
+			paintDeltas(dst, a, b, dst.Rect)
+		}
+	})
+	if err != nil {
+		return -1, err
+	}
+	if budget.exceeded() {
+		return n, ErrMaxDiff
+	}
+	prog.finish()
+	return n, nil
+}
+
+// compare writes differences of a and b to diff of their size.
+// It stops once budget, if not nil, is exceeded, and reports rows
+// compared to prog.
+func (d *binary) compare(diff *image.NRGBA, a, b image.Image, budget *diffBudget, prog *progress) (int, error) {
+	w, h := diff.Rect.Dx(), diff.Rect.Dy()
+	if fa, ok := a.(FloatImage); ok {
+		if fb, ok := b.(FloatImage); ok {
+			return budget.forStrips(h, prog, func(y0, y1 int) int {
+				return compareFloat(diff, fa, fb, image.Rect(0, y0, w, y1), d.opts.floatEpsilon)
+			}), nil
+		}
+	}
+	shift := sampleShift(a.ColorModel(), b.ColorModel())
+	tol := d.tolerance(shift, roundsApart(a.ColorModel(), b.ColorModel()))
+	if _, ok := a.(TiledImage); !ok {
+		if _, ok := b.(TiledImage); !ok {
+			ab, bb := a.Bounds(), b.Bounds()
+			return budget.forStrips(h, prog, func(y0, y1 int) int {
+				r := image.Rect(ab.Min.X, ab.Min.Y+y0, ab.Max.X, ab.Min.Y+y1)
+				return compareRect(diff, image.Pt(0, y0), a, r, b, bb.Min.Add(image.Pt(0, y0)), shift, tol)
+			}), nil
+		}
+		// diffPixel is symmetric
+		a, b = b, a
+	}
+	return compareTiles(diff, a.(TiledImage), b, shift, tol, budget, prog)
+}
+
+// tolerance is how much pixels can differ without being counted,
+// in samples shifted right by some bits, see sampleShift.
+type tolerance struct {
+	// max differences of samples, see WithChannelTolerance,
+	// or nil if there are none
+	channel *[4]int64
+	// max squared color distance, see NewBinaryFuzz, or 0 if there is none
+	fuzz float64
+	// compare lumas, see WithLuminanceOnly, differing by up to luma
+	lumaOnly bool
+	luma     int64
+	// pixels may differ by premultiplication rounding, see roundsApart
+	premul bool
+}
+
+// tolerance returns the tolerance of samples shifted right by shift bits,
+// or nil if pixels only match if they are equal. premul is whether
+// colors of the compared images are premultiplied by alpha differently,
+// see roundsApart.
+func (d *binary) tolerance(shift uint, premul bool) *tolerance {
+	tol := tolerance{premul: premul}
+	if d.opts.channelTolerance != [4]uint16{} {
+		tol.channel = new([4]int64)
+		for i, t := range d.opts.channelTolerance {
+			tol.channel[i] = int64(t) >> shift
+		}
+	}
+	if d.fuzz > 0 {
+		// as in 16-bit ImageMagick builds, scaled to samples
+		f := math.Max(d.fuzz*0xffff/100, math.Sqrt2/2) * float64(uint32(0xffff)>>shift) / 0xffff
+		tol.fuzz = f * f
+	}
+	if d.opts.lumaOnly {
+		tol.lumaOnly = true
+		for _, t := range d.opts.channelTolerance[:3] {
+			if v := int64(t) >> shift; v > tol.luma {
+				tol.luma = v
+			}
+		}
+		return &tol
+	}
+	if tol.channel == nil && tol.fuzz == 0 && !tol.premul {
+		return nil
+	}
+	return &tol
+}
+
+// lumaTolerated reports whether lumas which differ by d, with
+// WithLuminanceOnly, are within tol.
+func (tol *tolerance) lumaTolerated(d int64) bool {
+	return d <= tol.luma || float64(d*d) <= tol.fuzz
+}
+
+// tolerateShift unmarks pixels of diff, the result of compare, which
+// equal a pixel within WithShiftTolerance of them in the other image,
+// both ways, and returns their number.
+func (d *binary) tolerateShift(diff *image.NRGBA, a, b image.Image) int {
+	r := d.opts.shiftTolerance
+	w, h := diff.Rect.Dx(), diff.Rect.Dy()
+	ab, bb := a.Bounds(), b.Bounds()
+	if fa, ok := a.(FloatImage); ok {
+		if fb, ok := b.(FloatImage); ok {
+			eps := d.opts.floatEpsilon
+			return forBands(d.opts.workers(), h, func(y0, y1 int) int {
+				return tolerateShift(diff, y0, y1, func(x, y int) bool {
+					return matchesNear(x, y, r, w, h, func(x, y, qx, qy int, fromA bool) bool {
+						if fromA {
+							return floatPixelEqual(fa, fb, ab.Min.Add(image.Pt(x, y)), bb.Min.Add(image.Pt(qx, qy)), eps)
+						}
+						return floatPixelEqual(fb, fa, bb.Min.Add(image.Pt(x, y)), ab.Min.Add(image.Pt(qx, qy)), eps)
+					})
+				})
+			})
+		}
+	}
+	shift := sampleShift(a.ColorModel(), b.ColorModel())
+	tol := d.tolerance(shift, roundsApart(a.ColorModel(), b.ColorModel()))
+	workers := d.opts.workers()
+	_, tiledA := a.(TiledImage)
+	_, tiledB := b.(TiledImage)
+	if tiledA || tiledB {
+		// tiles are decoded on demand, not concurrently
+		workers = 1
+	}
+	return forBands(workers, h, func(y0, y1 int) int {
+		wa, wb := newRowWindow(a, r), newRowWindow(b, r)
+		return tolerateShift(diff, y0, y1, func(x, y int) bool {
+			return matchesNear(x, y, r, w, h, func(x, y, qx, qy int, fromA bool) bool {
+				if fromA {
+					return tolerated(wa.row(y)[x], wb.row(qy)[qx], shift, tol)
+				}
+				return tolerated(wb.row(y)[x], wa.row(qy)[qx], shift, tol)
+			})
+		})
+	})
+}
+
+// tolerateAA marks pixels of diff within the zero-based rectangle r,
+// the result of compare, which differ because of anti-aliasing,
+// see WithAntiAliasing, as aaPixel and returns their number.
+func (d *binary) tolerateAA(diff *image.NRGBA, a, b image.Image, r image.Rectangle) int {
+	var pa, pb pixelPlane
+	parallel(d.opts.workers(), func(int) {
+		pa = newPixelPlane(a)
+	}, func(int) {
+		pb = newPixelPlane(b)
+	})
+	return forBands(d.opts.workers(), r.Dy(), func(y0, y1 int) int {
+		n := 0
+		for y := r.Min.Y + y0; y < r.Min.Y+y1; y++ {
+			out := diff.Pix[diff.PixOffset(0, y):]
+			for x := r.Min.X; x < r.Max.X; x++ {
+				p := out[4*x : 4*x+4]
+				if !isCounted(p) {
+					continue
+				}
+				if pa.antialiased(pb, x, y) || pb.antialiased(pa, x, y) {
+					copy(p, aaPixel[:])
+					n++
+				}
+			}
+		}
+		return n
+	})
+}
+
+// floatPixelEqual reports whether samples of pixel p of a and q of b
+// are equal within relative tolerance eps.
+func floatPixelEqual(a, b FloatImage, p, q image.Point, eps float64) bool {
+	r1, g1, b1, a1 := a.FloatAt(p.X, p.Y)
+	r2, g2, b2, a2 := b.FloatAt(q.X, q.Y)
+	return floatEqual(r1, r2, eps) && floatEqual(g1, g2, eps) &&
+		floatEqual(b1, b2, eps) && floatEqual(a1, a2, eps)
+}
+
+// CompareStream compares images read row by row using the binary
+// algorithm, with the same semantics as the Differ returned by NewBinary.
+// If diff is not nil, rows of the difference image are written to it
+// as soon as they are compared. Only a single row of each image is held
+// in memory, so that images of any size can be compared: MaxPixels
+// doesn't apply.
+//
+// It returns ErrSize if images have their width or height do not match.
+func CompareStream(a, b RowReader, diff RowWriter) (int, error) {
 	ab, bb := a.Bounds(), b.Bounds()
 	w, h := ab.Dx(), ab.Dy()
 	if w != bb.Dx() || h != bb.Dy() {
-		return nil, -1, ErrSize
+		return -1, ErrSize
 	}
-	diff := image.NewNRGBA(image.Rect(0, 0, w, h))
+	shift := sampleShift(a.ColorModel(), b.ColorModel())
+	var tol *tolerance
+	if roundsApart(a.ColorModel(), b.ColorModel()) {
+		tol = &tolerance{premul: true}
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, w, 1))
+	arow, brow := make([]pixel, w), make([]pixel, w)
 	n := 0
 	for y := 0; y < h; y++ {
+		ra, err := nextRow(a)
+		if err != nil {
+			return -1, err
+		}
+		rb, err := nextRow(b)
+		if err != nil {
+			return -1, err
+		}
+		readRow(arow, ra, ab.Min.X, ab.Min.Y+y)
+		readRow(brow, rb, bb.Min.X, bb.Min.Y+y)
+		n += diffRow(out.Pix, arow, brow, shift, tol)
+		if diff == nil {
+			continue
+		}
+		out.Rect = image.Rect(0, y, w, y+1)
+		if err := diff.WriteRow(out); err != nil {
+			return -1, err
+		}
+	}
+	return n, nil
+}
+
+// nextRow reads the next row of r, which must not be past its last row.
+func nextRow(r RowReader) (image.Image, error) {
+	m, err := r.ReadRow()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return m, err
+}
+
+// compareTiles compares a with b tile by tile. If b is also a TiledImage
+// with the same tiling, both images are decoded one tile at a time.
+// With a different tiling, each tile of a is compared with the tiles
+// of b it overlaps, see tileBand.
+// It stops once budget, if not nil, is exceeded, and reports rows
+// compared to prog.
+func compareTiles(diff *image.NRGBA, a TiledImage, b image.Image, shift uint, tol *tolerance, budget *diffBudget, prog *progress) (int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	tiles := a.Tiles()
+	tb, ok := b.(TiledImage)
+	var band *tileBand
+	if ok {
+		btiles := tb.Tiles()
+		ok = len(btiles) == len(tiles)
+		for i := 0; ok && i < len(tiles); i++ {
+			ok = tiles[i].Sub(ab.Min) == btiles[i].Sub(bb.Min)
+		}
+		if !ok {
+			band = newTileBand(tb, btiles)
+		}
+	}
+	// tiles are reported as the rows of pixels they add up to
+	n, pixels, rows := 0, 0, 0
+	for i, r := range tiles {
+		if budget.exceeded() {
+			break
+		}
+		ta, err := a.Tile(i)
+		if err != nil {
+			return -1, err
+		}
+		k := 0
+		switch {
+		case ok:
+			bt, err := tb.Tile(i)
+			if err != nil {
+				return -1, err
+			}
+			off := r.Min.Sub(ab.Min)
+			k = compareRect(diff, off, ta, r, bt, bb.Min.Add(off), shift, tol)
+		case band != nil:
+			// r in the coordinates of b
+			rb := r.Add(bb.Min.Sub(ab.Min))
+			err := band.overlapping(rb, func(bt image.Image, s image.Rectangle) {
+				off := s.Min.Sub(bb.Min)
+				k += compareRect(diff, off, ta, s.Add(ab.Min.Sub(bb.Min)), bt, s.Min, shift, tol)
+			})
+			if err != nil {
+				return -1, err
+			}
+		default:
+			off := r.Min.Sub(ab.Min)
+			k = compareRect(diff, off, ta, r, b, bb.Min.Add(off), shift, tol)
+		}
+		budget.add(k)
+		n += k
+		pixels += r.Dx() * r.Dy()
+		prog.add(pixels/ab.Dx() - rows)
+		rows = pixels / ab.Dx()
+	}
+	return n, nil
+}
+
+// tileBand decodes tiles of a TiledImage overlapping rectangles of
+// another tiling. Decoded tiles are kept until a rectangle below them
+// is requested, so that walking the other tiling in rows decodes each
+// tile once, holding at most a band of tiles across the image.
+type tileBand struct {
+	m     TiledImage
+	tiles []image.Rectangle
+	// indices of tiles, by their top
+	byTop []int
+	// max tile height
+	maxDy   int
+	decoded map[int]image.Image
+}
+
+func newTileBand(m TiledImage, tiles []image.Rectangle) *tileBand {
+	t := &tileBand{m: m, tiles: tiles, byTop: make([]int, len(tiles)), decoded: make(map[int]image.Image)}
+	for i, r := range tiles {
+		t.byTop[i] = i
+		if r.Dy() > t.maxDy {
+			t.maxDy = r.Dy()
+		}
+	}
+	sort.Slice(t.byTop, func(i, j int) bool {
+		return tiles[t.byTop[i]].Min.Y < tiles[t.byTop[j]].Min.Y
+	})
+	return t
+}
+
+// overlapping calls f with each tile overlapping r and its
+// intersection with r.
+func (t *tileBand) overlapping(r image.Rectangle, f func(m image.Image, s image.Rectangle)) error {
+	for i := range t.decoded {
+		if t.tiles[i].Max.Y <= r.Min.Y {
+			delete(t.decoded, i)
+		}
+	}
+	// tiles starting more than maxDy above r end above it
+	k := sort.Search(len(t.byTop), func(k int) bool {
+		return t.tiles[t.byTop[k]].Min.Y > r.Min.Y-t.maxDy
+	})
+	for ; k < len(t.byTop) && t.tiles[t.byTop[k]].Min.Y < r.Max.Y; k++ {
+		i := t.byTop[k]
+		s := t.tiles[i].Intersect(r)
+		if s.Empty() {
+			continue
+		}
+		m, ok := t.decoded[i]
+		if !ok {
+			var err error
+			if m, err = t.m.Tile(i); err != nil {
+				return err
+			}
+			t.decoded[i] = m
+		}
+		f(m, s)
+	}
+	return nil
+}
+
+// compareRect compares pixels of a within r with the same-sized area of b
+// starting at bmin, writing results to diff starting at dp.
+// Samples are shifted right by shift bits before comparison, and differ
+// if by more than tol, unless it's nil. It returns the number of different
+// pixels.
+func compareRect(diff *image.NRGBA, dp image.Point, a image.Image, r image.Rectangle, b image.Image, bmin image.Point, shift uint, tol *tolerance) int {
+	if tol != nil && tol.lumaOnly {
+		return compareLuma(diff, dp, a, r, b, bmin, shift, tol)
+	}
+	if tol == nil && reflect.TypeOf(a) == reflect.TypeOf(b) {
+		if pa, _, _ := pixLayout(a); pa != nil {
+			return compareSame(diff, dp, a, r, b, bmin, shift)
+		}
+	}
+	n := 0
+	arow, brow := make([]pixel, r.Dx()), make([]pixel, r.Dx())
+	for y := 0; y < r.Dy(); y++ {
+		readRow(arow, a, r.Min.X, r.Min.Y+y)
+		readRow(brow, b, bmin.X, bmin.Y+y)
+		n += diffRow(diff.Pix[diff.PixOffset(dp.X, dp.Y+y):], arow, brow, shift, tol)
+	}
+	return n
+}
+
+// compareSame is compareRect for a and b of the same standard type,
+// see pixLayout, without tolerance. Pixels with equal Pix bytes are
+// equal, so that rows of equal bytes are not compared pixel by pixel.
+// Pixels of other types than NRGBA and NRGBA64 are equal if and only if
+// their bytes are, since both images have the same sample size and
+// premultiplied colors: only non-premultiplied pixels with different
+// bytes are compared by their colors.
+func compareSame(diff *image.NRGBA, dp image.Point, a image.Image, r image.Rectangle, b image.Image, bmin image.Point, shift uint) int {
+	pa, sa, bpp := pixLayout(a)
+	pb, sb, _ := pixLayout(b)
+	var colorOf func([]uint8) pixel
+	switch a.(type) {
+	case *image.NRGBA:
+		colorOf = nrgbaPixel
+	case *image.NRGBA64:
+		colorOf = nrgba64Pixel
+	}
+	// offsets of r and bmin within the images
+	ra, rb := r.Min.Sub(a.Bounds().Min), bmin.Sub(b.Bounds().Min)
+	w := r.Dx()
+	n := 0
+	for y := 0; y < r.Dy(); y++ {
+		rowA := pa[(ra.Y+y)*sa+ra.X*bpp:][:w*bpp]
+		rowB := pb[(rb.Y+y)*sb+rb.X*bpp:][:w*bpp]
+		out := diff.Pix[diff.PixOffset(dp.X, dp.Y+y):][:4*w]
+		if bytes.Equal(rowA, rowB) {
+			for x := 0; x < w; x++ {
+				copy(out[4*x:], passPixel[:])
+			}
+			continue
+		}
 		for x := 0; x < w; x++ {
-			d := diffColor(a.At(ab.Min.X+x, ab.Min.Y+y), b.At(bb.Min.X+x, bb.Min.Y+y))
-			c := color.RGBA{0, 0, 0, 0xff}
-			if d > 0 {
-				c.R = 0xff
-				//c.A = uint8(100 + d*0xff/0xffff)
+			pxA, pxB := rowA[x*bpp:(x+1)*bpp], rowB[x*bpp:(x+1)*bpp]
+			c := passPixel
+			if !bytes.Equal(pxA, pxB) && (colorOf == nil || diffPixel(colorOf(pxA), colorOf(pxB), shift) != 0) {
+				c = failPixel
 				n++
 			}
-			diff.Set(x, y, c)
+			copy(out[4*x:], c[:])
 		}
 	}
-	return diff, n, nil
+	return n
+}
+
+// diffRow compares pixels of arow and brow, writing NRGBA results to out.
+// Pixels which differ within tol, if not nil, are tolerPixel and not
+// counted. It returns the number of different pixels.
+func diffRow(out []uint8, arow, brow []pixel, shift uint, tol *tolerance) int {
+	n := 0
+	for x := range arow {
+		d := diffPixel(arow[x], brow[x], shift)
+		c := passPixel
+		switch {
+		case d == 0:
+		case tol != nil && tol.premul && premulRounded(arow[x], brow[x], shift):
+		case tolerated(arow[x], brow[x], shift, tol):
+			c = tolerPixel
+		default:
+			c = failPixel
+			n++
+		}
+		copy(out[4*x:], c[:])
+	}
+	return n
+}
+
+// tolerPixel marks pixels which differ within WithChannelTolerance.
+var tolerPixel = [4]uint8{0x40, 0x40, 0x40, 0xff}
+
+// isTolerPixel reports whether NRGBA pixel p is tolerPixel.
+func isTolerPixel(p []uint8) bool {
+	return p[0] == tolerPixel[0] && p[1] == tolerPixel[1] && p[2] == tolerPixel[2] && p[3] == tolerPixel[3]
 }
 
-func diffColor(c1, c2 color.Color) int64 {
-	r1, g1, b1, a1 := c1.RGBA()
-	r2, g2, b2, a2 := c2.RGBA()
+// isFailPixel reports whether NRGBA pixel p is failPixel.
+func isFailPixel(p []uint8) bool {
+	return p[0] == failPixel[0] && p[1] == failPixel[1] && p[2] == failPixel[2] && p[3] == failPixel[3]
+}
+
+// isCounted reports whether NRGBA pixel p marks a difference which
+// is counted, as opposed to passPixel, clearPixel, tolerPixel or aaPixel.
+func isCounted(p []uint8) bool {
+	return isMarked(p) && !isTolerPixel(p) && !isAAPixel(p)
+}
+
+// isAAPixel reports whether NRGBA pixel p is aaPixel.
+func isAAPixel(p []uint8) bool {
+	return p[0] == aaPixel[0] && p[1] == aaPixel[1] && p[2] == aaPixel[2] && p[3] == aaPixel[3]
+}
+
+// tolerated reports whether p1 and p2, with samples shifted right by
+// shift bits, differ within tol, or are equal if tol is nil.
+func tolerated(p1, p2 pixel, shift uint, tol *tolerance) bool {
+	if tol != nil && tol.lumaOnly {
+		return tol.lumaTolerated(abs(int64(luma709(p1)>>shift) - int64(luma709(p2)>>shift)))
+	}
+	var d [4]int64
+	for i := range p1 {
+		d[i] = abs(int64(p1[i]>>shift) - int64(p2[i]>>shift))
+	}
+	if tol == nil || d == [4]int64{} {
+		return d == [4]int64{}
+	}
+	if tol.premul && premulRounded(p1, p2, shift) {
+		return true
+	}
+	if c := tol.channel; c != nil && d[0] <= c[0] && d[1] <= c[1] && d[2] <= c[2] && d[3] <= c[3] {
+		return true
+	}
+	if tol.fuzz == 0 {
+		return false
+	}
+	// as ImageMagick's IsFuzzyEquivalencePixel
+	da := float64(d[3] * d[3])
+	if da > tol.fuzz {
+		return false
+	}
+	dist := 3*da + float64(d[0]*d[0]+d[1]*d[1]+d[2]*d[2])
+	return dist <= 3*tol.fuzz
+}
+
+// roundsApart reports whether colors of models ma and mb are
+// premultiplied by alpha differently: those of one of them, such as
+// NRGBA, are not, and Compare premultiplies them, while those of
+// the other one, such as RGBA, were premultiplied, possibly with
+// different rounding, when they were stored.
+func roundsApart(ma, mb color.Model) bool {
+	return premultiplied(ma) != premultiplied(mb)
+}
+
+// premultiplied reports whether colors of model m are stored
+// premultiplied by alpha, or are opaque.
+func premultiplied(m color.Model) bool {
+	switch m {
+	case color.NRGBAModel, color.NRGBA64Model, color.NYCbCrAModel:
+		return false
+	}
+	return true
+}
+
+// premulRounded reports whether p1 and p2, with samples shifted right
+// by shift bits, may be the same color premultiplied by alpha with
+// different rounding: their alpha is equal but not opaque, and their
+// red, green and blue samples differ by at most 1.
+func premulRounded(p1, p2 pixel, shift uint) bool {
+	a := p1[3] >> shift
+	if a != p2[3]>>shift || a == 0xffff>>shift {
+		return false
+	}
+	for i := 0; i < 3; i++ {
+		if abs(int64(p1[i]>>shift)-int64(p2[i]>>shift)) > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// compareFloat compares samples of a and b with relative tolerance eps,
+// within the zero-based rectangle r of diff.
+func compareFloat(diff *image.NRGBA, a, b FloatImage, r image.Rectangle, eps float64) int {
+	ab, bb := a.Bounds(), b.Bounds()
+	n := 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		out := diff.Pix[diff.PixOffset(0, y):]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := passPixel
+			if !floatPixelEqual(a, b, ab.Min.Add(image.Pt(x, y)), bb.Min.Add(image.Pt(x, y)), eps) {
+				c = failPixel
+				n++
+			}
+			copy(out[4*x:], c[:])
+		}
+	}
+	return n
+}
+
+// floatEqual reports whether a and b are equal within relative tolerance eps.
+// NaNs are equal to each other, infinities are equal if their signs match.
+func floatEqual(a, b float32, eps float64) bool {
+	x, y := float64(a), float64(b)
+	switch {
+	case x == y:
+		return true
+	case math.IsNaN(x) || math.IsNaN(y):
+		return math.IsNaN(x) && math.IsNaN(y)
+	case math.IsInf(x, 0) || math.IsInf(y, 0):
+		return false
+	}
+	return math.Abs(x-y) <= eps*math.Max(math.Abs(x), math.Abs(y))
+}
+
+func diffPixel(p1, p2 pixel, shift uint) int64 {
 	var diff int64
-	diff += abs(int64(r1) - int64(r2))
-	diff += abs(int64(g1) - int64(g2))
-	diff += abs(int64(b1) - int64(b2))
-	diff += abs(int64(a1) - int64(a2))
+	for i := range p1 {
+		diff += abs(int64(p1[i]>>shift) - int64(p2[i]>>shift))
+	}
 	return diff
 }
 
+// sampleShift returns the number of low bits of 16-bit samples ignored
+// when comparing images with color models ma and mb: 8 if either model
+// has 8 bits per channel, 0 otherwise.
+func sampleShift(ma, mb color.Model) uint {
+	if is8bit(ma) || is8bit(mb) {
+		return 8
+	}
+	return 0
+}
+
+// is8bit reports whether colors of model m have 8 bits per channel.
+func is8bit(m color.Model) bool {
+	switch m {
+	case color.RGBAModel, color.NRGBAModel, color.GrayModel, color.AlphaModel,
+		color.YCbCrModel, color.NYCbCrAModel, color.CMYKModel:
+		return true
+	}
+	_, ok := m.(color.Palette)
+	return ok
+}
+
 func abs(x int64) int64 {
 	if x < 0 {
 		return -x
@@ -0,0 +1,650 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// tiled is a TiledImage backed by an in-memory image.
+type tiled struct {
+	*image.NRGBA
+	size image.Point
+}
+
+func (t *tiled) Tiles() []image.Rectangle {
+	var r []image.Rectangle
+	b := t.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y += t.size.Y {
+		for x := b.Min.X; x < b.Max.X; x += t.size.X {
+			r = append(r, image.Rect(x, y, x+t.size.X, y+t.size.Y).Intersect(b))
+		}
+	}
+	return r
+}
+
+func (t *tiled) Tile(i int) (image.Image, error) {
+	b := t.Bounds()
+	cols := (b.Dx() + t.size.X - 1) / t.size.X
+	p := b.Min.Add(image.Pt(i%cols*t.size.X, i/cols*t.size.Y))
+	return t.SubImage(image.Rectangle{Min: p, Max: p.Add(t.size)}.Intersect(b)), nil
+}
+
+// lazyTiled is a TiledImage which only has pixels in its tiles,
+// counting how many were decoded.
+type lazyTiled struct {
+	t       *tiled
+	decodes int
+}
+
+func (l *lazyTiled) ColorModel() color.Model  { return l.t.ColorModel() }
+func (l *lazyTiled) Bounds() image.Rectangle  { return l.t.Bounds() }
+func (l *lazyTiled) At(x, y int) color.Color  { panic("lazyTiled: At outside tiles") }
+func (l *lazyTiled) Tiles() []image.Rectangle { return l.t.Tiles() }
+func (l *lazyTiled) Tile(i int) (image.Image, error) {
+	l.decodes++
+	return l.t.Tile(i)
+}
+
+func TestBinaryTiled(t *testing.T) {
+	a, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewBinary()
+	want, wantN, err := d.Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ta := &tiled{toNRGBA(a), image.Pt(64, 48)}
+	tb := &tiled{toNRGBA(b), image.Pt(64, 48)}
+	tc := &tiled{toNRGBA(b), image.Pt(100, 30)}
+	tests := []struct {
+		name string
+		a, b image.Image
+	}{
+		{"a tiled", ta, b},
+		{"b tiled", a, tb},
+		{"both tiled", ta, tb},
+		{"different tiling", ta, tc},
+	}
+	for _, test := range tests {
+		diff, n, err := d.Compare(test.a, test.b)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if n != wantN {
+			t.Errorf("%s: n = %d; want %d", test.name, n, wantN)
+		}
+		if !bytes.Equal(diff.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+			t.Errorf("%s: diff images differ", test.name)
+		}
+	}
+}
+
+func TestBinaryTiledCount(t *testing.T) {
+	r := image.Rect(0, 0, 1024, 1024)
+	a, b := image.NewNRGBA(r), image.NewNRGBA(r)
+	b.Pix[len(b.Pix)-1] = 1
+	ta, tb := &tiled{a, image.Pt(64, 64)}, &tiled{b, image.Pt(64, 64)}
+	d := NewBinary()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	n, err := CompareCount(d, ta, tb)
+	runtime.ReadMemStats(&after)
+	if err != nil || n != 1 {
+		t.Fatalf("n = %d, err = %v; want 1", n, err)
+	}
+	// tiles share pixels with a and b, no w x h diff is allocated
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > uint64(len(a.Pix)/4) {
+		t.Errorf("allocated %d bytes; want at most %d", alloc, len(a.Pix)/4)
+	}
+}
+
+func TestBinaryDifferentTiling(t *testing.T) {
+	a, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewBinary()
+	want, wantN, err := d.Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	na, nb := toNRGBA(a), toNRGBA(b)
+	for _, sizes := range [][2]image.Point{
+		{image.Pt(64, 48), image.Pt(100, 30)},
+		{image.Pt(100, 30), image.Pt(64, 48)},
+		{image.Pt(16, 16), image.Pt(1<<12, 64)},
+		{image.Pt(1<<12, 7), image.Pt(32, 32)},
+	} {
+		ta := &lazyTiled{t: &tiled{na, sizes[0]}}
+		tb := &lazyTiled{t: &tiled{nb, sizes[1]}}
+		diff, n, err := d.Compare(ta, tb)
+		if err != nil {
+			t.Errorf("%v: %v", sizes, err)
+			continue
+		}
+		if n != wantN {
+			t.Errorf("%v: n = %d; want %d", sizes, n, wantN)
+		}
+		if !bytes.Equal(diff.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+			t.Errorf("%v: diff images differ", sizes)
+		}
+		// tiles of both images are decoded once
+		if na, nb := len(ta.Tiles()), len(tb.Tiles()); ta.decodes != na || tb.decodes != nb {
+			t.Errorf("%v: decoded %d and %d tiles; want %d and %d", sizes, ta.decodes, tb.decodes, na, nb)
+		}
+	}
+}
+
+func toNRGBA(m image.Image) *image.NRGBA {
+	b := m.Bounds()
+	n := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			n.Set(x, y, m.At(x, y))
+		}
+	}
+	return n
+}
+
+func TestBinaryAlpha(t *testing.T) {
+	// NRGBA colors, including translucent and fully transparent
+	colors := []color.NRGBA{
+		{0x12, 0x34, 0x56, 0xff},
+		{0xc8, 0x64, 0x21, 0x80},
+		{0xc9, 0x64, 0x21, 0x80},
+		{0xff, 0xff, 0xff, 0x01},
+		{0x10, 0x20, 0x30, 0x00},
+		{0xff, 0x00, 0x00, 0x00},
+	}
+	r := image.Rect(0, 0, len(colors), 1)
+	nrgba := image.NewNRGBA(r)
+	for i, c := range colors {
+		nrgba.SetNRGBA(i, 0, c)
+	}
+	// same appearance as RGBA, rounded by conversion
+	rgba := image.NewRGBA(r)
+	draw.Draw(rgba, r, nrgba, image.ZP, draw.Src)
+	// the same colors with different color under zero alpha
+	hidden := image.NewNRGBA(r)
+	copy(hidden.Pix, nrgba.Pix)
+	hidden.SetNRGBA(4, 0, color.NRGBA{0xff, 0xff, 0xff, 0})
+	hiddenRGBA := image.NewRGBA(r)
+	draw.Draw(hiddenRGBA, r, hidden, image.ZP, draw.Src)
+	// a visible change of a translucent pixel
+	changed := image.NewNRGBA(r)
+	copy(changed.Pix, nrgba.Pix)
+	changed.SetNRGBA(1, 0, color.NRGBA{0x00, 0x64, 0x21, 0x80})
+	changedRGBA := image.NewRGBA(r)
+	draw.Draw(changedRGBA, r, changed, image.ZP, draw.Src)
+
+	// 16-bit images are compared at full precision
+	nrgba64 := image.NewNRGBA64(r)
+	draw.Draw(nrgba64, r, nrgba, image.ZP, draw.Src)
+	rgba64 := image.NewRGBA64(r)
+	draw.Draw(rgba64, r, nrgba64, image.ZP, draw.Src)
+	nrgba64b := image.NewNRGBA64(r)
+	copy(nrgba64b.Pix, nrgba64.Pix)
+	nrgba64b.SetNRGBA64(0, 0, color.NRGBA64{0x1201, 0x3434, 0x5656, 0xffff})
+
+	tests := []struct {
+		a, b image.Image
+		n    int
+	}{
+		{nrgba, nrgba, 0},
+		{nrgba, rgba, 0},
+		{rgba, nrgba, 0},
+		{nrgba, hidden, 0},
+		{rgba, hidden, 0},
+		{nrgba, hiddenRGBA, 0},
+		{hiddenRGBA, rgba, 0},
+		{nrgba, changed, 1},
+		{nrgba, changedRGBA, 1},
+		{rgba, changed, 1},
+		{rgba, changedRGBA, 1},
+		{nrgba64, rgba64, 0},
+		{nrgba64, nrgba, 0},
+		{nrgba64, nrgba64b, 1},
+		// 0x1201 and 0x1212 are the same with 8 bits
+		{nrgba64b, nrgba, 0},
+	}
+	for i, test := range tests {
+		_, n, err := NewBinary().Compare(test.a, test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != test.n {
+			t.Errorf("(%d) %T vs %T: n = %d; want %d", i, test.a, test.b, n, test.n)
+		}
+	}
+}
+
+func TestBinaryPremultiplied(t *testing.T) {
+	// every color and alpha of NRGBA pixels, and the same colors
+	// premultiplied by alpha with rounding to nearest, as e.g. image
+	// editors do, rather than down, as Compare does
+	r := image.Rect(0, 0, 256, 256)
+	nrgba, rgba := image.NewNRGBA(r), image.NewRGBA(r)
+	for a := 0; a < 256; a++ {
+		for v := 0; v < 256; v++ {
+			nrgba.SetNRGBA(v, a, color.NRGBA{uint8(v), uint8(255 - v), uint8(v / 2), uint8(a)})
+			pm := func(v int) uint8 { return uint8((v*a + 127) / 255) }
+			rgba.SetRGBA(v, a, color.RGBA{pm(v), pm(255 - v), pm(v / 2), uint8(a)})
+		}
+	}
+	// a visible change of translucent pixels, and a rounding
+	// difference between two premultiplied images
+	changed, rounded := image.NewRGBA(r), image.NewRGBA(r)
+	copy(changed.Pix, rgba.Pix)
+	copy(rounded.Pix, rgba.Pix)
+	changed.SetRGBA(10, 0x80, color.RGBA{0x0a, 0x40, 0x0a, 0x80})
+	rounded.SetRGBA(10, 0x80, color.RGBA{0x06, 0x7b, 0x03, 0x80})
+	if c := rgba.RGBAAt(10, 0x80); c != (color.RGBA{0x05, 0x7b, 0x03, 0x80}) {
+		t.Fatalf("rgba(10, 0x80) = %v", c)
+	}
+	nrgba64 := image.NewNRGBA64(r)
+	draw.Draw(nrgba64, r, nrgba, image.ZP, draw.Src)
+
+	tests := []struct {
+		a, b image.Image
+		n    int
+	}{
+		{nrgba, rgba, 0},
+		{rgba, nrgba, 0},
+		{generic{nrgba}, generic{rgba}, 0},
+		{nrgba, changed, 1},
+		{rgba, rounded, 1},
+		{nrgba64, rgba, 0},
+	}
+	for i, test := range tests {
+		_, n, err := NewBinary().Compare(test.a, test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != test.n {
+			t.Errorf("(%d) %T vs %T: n = %d; want %d", i, test.a, test.b, n, test.n)
+		}
+	}
+}
+
+func TestBinaryChannelTolerance(t *testing.T) {
+	gray := func(v uint8) image.Image {
+		m := image.NewGray(image.Rect(0, 0, 1, 1))
+		m.Pix[0] = v
+		return m
+	}
+	nrgba := func(c color.NRGBA) image.Image {
+		m := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+		m.SetNRGBA(0, 0, c)
+		return m
+	}
+	nrgba64 := func(c color.NRGBA64) image.Image {
+		m := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+		m.SetNRGBA64(0, 0, c)
+		return m
+	}
+	base := color.NRGBA{100, 100, 100, 0xff}
+	tests := []struct {
+		tol  [4]uint8
+		a, b image.Image
+		n    int
+	}{
+		{[4]uint8{3, 3, 3, 0}, nrgba(base), nrgba(color.NRGBA{103, 100, 100, 0xff}), 0},
+		{[4]uint8{3, 3, 3, 0}, nrgba(base), nrgba(color.NRGBA{104, 100, 100, 0xff}), 1},
+		{[4]uint8{3, 3, 3, 0}, nrgba(base), nrgba(color.NRGBA{97, 100, 100, 0xff}), 0},
+		{[4]uint8{3, 3, 3, 0}, nrgba(base), nrgba(color.NRGBA{96, 100, 100, 0xff}), 1},
+		{[4]uint8{3, 3, 3, 0}, nrgba(base), nrgba(color.NRGBA{100, 103, 100, 0xff}), 0},
+		{[4]uint8{3, 3, 3, 0}, nrgba(base), nrgba(color.NRGBA{100, 104, 100, 0xff}), 1},
+		{[4]uint8{3, 3, 3, 0}, nrgba(base), nrgba(color.NRGBA{100, 100, 103, 0xff}), 0},
+		{[4]uint8{3, 3, 3, 0}, nrgba(base), nrgba(color.NRGBA{100, 100, 104, 0xff}), 1},
+		{[4]uint8{3, 3, 3, 0}, nrgba(base), nrgba(color.NRGBA{103, 103, 103, 0xff}), 0},
+		// tolerances are per channel
+		{[4]uint8{0, 3, 3, 0}, nrgba(base), nrgba(color.NRGBA{101, 100, 100, 0xff}), 1},
+		{[4]uint8{3, 0, 3, 0}, nrgba(base), nrgba(color.NRGBA{100, 101, 100, 0xff}), 1},
+		{[4]uint8{3, 3, 0, 0}, nrgba(base), nrgba(color.NRGBA{100, 100, 101, 0xff}), 1},
+		// colors of black pixels stay 0 when premultiplied
+		{[4]uint8{3, 3, 3, 0}, nrgba(color.NRGBA{0, 0, 0, 200}), nrgba(color.NRGBA{0, 0, 0, 201}), 1},
+		{[4]uint8{0, 0, 0, 2}, nrgba(color.NRGBA{0, 0, 0, 200}), nrgba(color.NRGBA{0, 0, 0, 202}), 0},
+		{[4]uint8{0, 0, 0, 2}, nrgba(color.NRGBA{0, 0, 0, 200}), nrgba(color.NRGBA{0, 0, 0, 203}), 1},
+		{[4]uint8{3, 3, 3, 0}, gray(100), gray(103), 0},
+		{[4]uint8{3, 3, 3, 0}, gray(100), gray(104), 1},
+		// scaled by 0x101 for 16-bit images
+		{[4]uint8{3, 3, 3, 0}, nrgba64(color.NRGBA64{0x6464, 0x6464, 0x6464, 0xffff}), nrgba64(color.NRGBA64{0x6464 + 3*0x101, 0x6464, 0x6464, 0xffff}), 0},
+		{[4]uint8{3, 3, 3, 0}, nrgba64(color.NRGBA64{0x6464, 0x6464, 0x6464, 0xffff}), nrgba64(color.NRGBA64{0x6464 + 3*0x101 + 1, 0x6464, 0x6464, 0xffff}), 1},
+		{[4]uint8{}, nrgba(base), nrgba(color.NRGBA{101, 100, 100, 0xff}), 1},
+	}
+	for i, test := range tests {
+		tol := test.tol
+		diff, n, err := NewBinary(WithChannelTolerance(tol[0], tol[1], tol[2], tol[3])).Compare(test.a, test.b)
+		if err != nil {
+			t.Fatalf("(%d) %v", i, err)
+		}
+		want := failPixel
+		if test.n == 0 {
+			want = tolerPixel
+		}
+		p := diff.(*image.NRGBA).Pix
+		if c := [4]uint8{p[0], p[1], p[2], p[3]}; n != test.n || c != want {
+			t.Errorf("(%d) n = %d, pixel %v; want %d, %v", i, n, c, test.n, want)
+		}
+	}
+}
+
+func TestBinaryFuzz(t *testing.T) {
+	nrgba := func(c color.NRGBA) image.Image {
+		m := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+		m.SetNRGBA(0, 0, c)
+		return m
+	}
+	nrgba64 := func(c color.NRGBA64) image.Image {
+		m := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+		m.SetNRGBA64(0, 0, c)
+		return m
+	}
+	base := color.NRGBA{100, 100, 100, 0xff}
+	tests := []struct {
+		fuzz float64
+		a, b image.Image
+		n    int
+	}{
+		// 20% of 255 is 51, at most that much in all channels,
+		// or sqrt(3) * 51 = 88.3 in a single one
+		{20, nrgba(base), nrgba(color.NRGBA{151, 151, 151, 0xff}), 0},
+		{20, nrgba(base), nrgba(color.NRGBA{152, 151, 151, 0xff}), 1},
+		{20, nrgba(base), nrgba(color.NRGBA{49, 49, 49, 0xff}), 0},
+		{20, nrgba(base), nrgba(color.NRGBA{188, 100, 100, 0xff}), 0},
+		{20, nrgba(base), nrgba(color.NRGBA{189, 100, 100, 0xff}), 1},
+		{20, nrgba(base), nrgba(color.NRGBA{100, 12, 100, 0xff}), 0},
+		{20, nrgba(base), nrgba(color.NRGBA{100, 11, 100, 0xff}), 1},
+		// alpha counts three times
+		{20, nrgba(color.NRGBA{0, 0, 0, 200}), nrgba(color.NRGBA{0, 0, 0, 251}), 0},
+		{20, nrgba(color.NRGBA{0, 0, 0, 200}), nrgba(color.NRGBA{0, 0, 0, 252}), 1},
+		// 2% is 5.1
+		{2, nrgba(base), nrgba(color.NRGBA{105, 105, 105, 0xff}), 0},
+		{2, nrgba(base), nrgba(color.NRGBA{106, 105, 105, 0xff}), 1},
+		{2, nrgba(base), nrgba(color.NRGBA{108, 100, 100, 0xff}), 0},
+		{2, nrgba(base), nrgba(color.NRGBA{109, 100, 100, 0xff}), 1},
+		// samples differing by 1 differ without fuzz
+		{0, nrgba(base), nrgba(color.NRGBA{101, 100, 100, 0xff}), 1},
+		{0.1, nrgba(base), nrgba(color.NRGBA{101, 100, 100, 0xff}), 1},
+		{0.3, nrgba(base), nrgba(color.NRGBA{101, 100, 100, 0xff}), 0},
+		// 20% of 0xffff is 13107
+		{20, nrgba64(color.NRGBA64{0x6464, 0x6464, 0x6464, 0xffff}), nrgba64(color.NRGBA64{0x6464 + 13107, 0x6464 + 13107, 0x6464 + 13107, 0xffff}), 0},
+		{20, nrgba64(color.NRGBA64{0x6464, 0x6464, 0x6464, 0xffff}), nrgba64(color.NRGBA64{0x6464 + 13108, 0x6464 + 13107, 0x6464 + 13107, 0xffff}), 1},
+	}
+	for i, test := range tests {
+		diff, n, err := NewBinaryFuzz(test.fuzz).Compare(test.a, test.b)
+		if err != nil {
+			t.Fatalf("(%d) %v", i, err)
+		}
+		want := failPixel
+		if test.n == 0 {
+			want = tolerPixel
+		}
+		p := diff.(*image.NRGBA).Pix
+		if c := [4]uint8{p[0], p[1], p[2], p[3]}; n != test.n || c != want {
+			t.Errorf("(%d) n = %d, pixel %v; want %d, %v", i, n, c, test.n, want)
+		}
+	}
+
+	// no fuzz is NewBinary
+	for _, files := range [][2]string{
+		{"fish1.png", "fish2.png"},
+		{"aqsis_vase.png", "aqsis_vase_ref.png"},
+		{"bug1102605.tif", "bug1102605_ref.tif"},
+		{"cam_mb.tif", "cam_mb_ref.tif"},
+	} {
+		a, b := files[0], files[1]
+		ma, err := readTestImage(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mb, err := readTestImage(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, wantN, err := NewBinary().Compare(ma, mb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diff, n, err := NewBinaryFuzz(0).Compare(ma, mb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != wantN || !bytes.Equal(diff.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+			t.Errorf("%s: n = %d; want %d and the same difference image", a, n, wantN)
+		}
+	}
+
+	for _, fuzz := range []float64{-1, math.NaN()} {
+		if _, _, err := NewBinaryFuzz(fuzz).Compare(nrgba(base), nrgba(base)); err == nil {
+			t.Errorf("fuzz %g: no error", fuzz)
+		}
+	}
+}
+
+func TestBinaryPixAccess(t *testing.T) {
+	r := image.Rect(-2, 3, 40, 30)
+	rnd := rand.New(rand.NewSource(1))
+	// equal images, of which those of bs are changed below
+	as := randomImages(r, rand.New(rand.NewSource(2)))
+	bs := randomImages(r, rand.New(rand.NewSource(2)))
+	for i, a := range as {
+		b := bs[i]
+		pb, _, bpp := pixLayout(b)
+		for k := 0; k < 10; k++ {
+			pb[rnd.Intn(len(pb))] ^= uint8(1 + rnd.Intn(0xff))
+		}
+		if _, ok := a.(*image.NRGBA); ok {
+			// transparent pixels of different colors
+			pa, _, _ := pixLayout(a)
+			for k := 0; k < 10; k++ {
+				p := bpp * rnd.Intn(len(pa)/bpp)
+				pa[p+3], pb[p+3] = 0, 0
+				pb[p] = ^pa[p]
+			}
+		}
+		sub := image.Rect(3, 5, 31, 22)
+		pairs := [][2]image.Image{
+			{a, b},
+			{a.(interface {
+				SubImage(image.Rectangle) image.Image
+			}).SubImage(sub), b.(interface {
+				SubImage(image.Rectangle) image.Image
+			}).SubImage(sub.Add(image.Pt(2, 1)))},
+		}
+		for _, ab := range pairs {
+			want, wantN, err := NewBinary().Compare(generic{ab[0]}, generic{ab[1]})
+			if err != nil {
+				t.Fatal(err)
+			}
+			diff, n, err := NewBinary().Compare(ab[0], ab[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != wantN || !bytes.Equal(diff.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+				t.Errorf("%T %v: n = %d; want %d and the same difference image", ab[0], ab[0].Bounds(), n, wantN)
+			}
+		}
+	}
+}
+
+func TestBinaryAntiAliasing(t *testing.T) {
+	// a black square on white, whose right edge is smoothed differently
+	r := image.Rect(0, 0, 32, 32)
+	edge := image.Rect(20, 8, 21, 24)
+	a, b := image.NewNRGBA(r), image.NewNRGBA(r)
+	for _, m := range []*image.NRGBA{a, b} {
+		draw.Draw(m, r, image.White, image.ZP, draw.Src)
+		draw.Draw(m, image.Rect(8, 8, 20, 24), image.Black, image.ZP, draw.Src)
+	}
+	draw.Draw(a, edge, image.NewUniform(color.Gray{0xa0}), image.ZP, draw.Src)
+	draw.Draw(b, edge, image.NewUniform(color.Gray{0x60}), image.ZP, draw.Src)
+
+	_, n, err := NewBinary().Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := edge.Dx() * edge.Dy(); n != want {
+		t.Errorf("without anti-aliasing: n = %d; want %d", n, want)
+	}
+	diff, n, err := NewBinary(WithAntiAliasing()).Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("n = %d; want 0", n)
+	}
+	m := diff.(*image.NRGBA)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			want := passPixel
+			if image.Pt(x, y).In(edge) {
+				want = aaPixel
+			}
+			if p := m.Pix[m.PixOffset(x, y):]; !bytes.Equal(p[:4], want[:]) {
+				t.Fatalf("(%d, %d) = %v; want %v", x, y, p[:4], want)
+			}
+		}
+	}
+
+	// a changed pixel in a flat area is still counted
+	b.Set(2, 2, color.Black)
+	if _, n, err = NewBinary(WithAntiAliasing()).Compare(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("with a changed pixel: n = %d; want 1", n)
+	}
+}
+
+// benchmarkBinary compares a Full HD NRGBA screenshot with a copy of it,
+// which differs in a single pixel if changed. If wrap is set, images
+// are compared via At.
+func benchmarkBinary(b *testing.B, changed, wrap bool) {
+	r := image.Rect(0, 0, 1920, 1080)
+	m1, m2 := image.NewNRGBA(r), image.NewNRGBA(r)
+	rand.New(rand.NewSource(1)).Read(m1.Pix)
+	copy(m2.Pix, m1.Pix)
+	if changed {
+		m2.Pix[len(m2.Pix)/2] ^= 0xff
+	}
+	ma, mb := image.Image(m1), image.Image(m2)
+	if wrap {
+		ma, mb = generic{m1}, generic{m2}
+	}
+	d, dst := NewBinary().(*binary), new(image.NRGBA)
+	b.SetBytes(int64(len(m1.Pix)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := d.CompareInto(dst, ma, mb); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBinarySame(b *testing.B)            { benchmarkBinary(b, false, false) }
+func BenchmarkBinarySameGeneric(b *testing.B)     { benchmarkBinary(b, false, true) }
+func BenchmarkBinaryOnePixel(b *testing.B)        { benchmarkBinary(b, true, false) }
+func BenchmarkBinaryOnePixelGeneric(b *testing.B) { benchmarkBinary(b, true, true) }
+
+func TestBinaryCompareCount(t *testing.T) {
+	a, err := readTestImage("bug1102605_ref.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("bug1102605.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		d    Differ
+		a, b image.Image
+	}{
+		{"default", NewBinary(), a, b},
+		{"generic", NewBinary(), generic{a}, generic{b}},
+		{"same", NewBinary(), a, a},
+		{"fuzz", NewBinaryFuzz(5), a, b},
+		{"channel", NewBinary(WithChannelTolerance(8, 8, 8, 8)), a, b},
+		{"luma", NewBinary(WithLuminanceOnly(), WithChannelTolerance(4, 4, 4, 0)), a, b},
+		{"shift", NewBinary(WithShiftTolerance(1)), a, b},
+		{"aa", NewBinary(WithAntiAliasing()), a, b},
+		{"heatmap", NewBinary(WithHeatmap()), a, b},
+		// not a CountDiffer
+		{"composite", NewComposite(CompositeAnd, NewBinary(), NewBinaryFuzz(5)), a, b},
+	}
+	for _, test := range tests {
+		_, want, err := test.d.Compare(test.a, test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := CompareCount(test.d, test.a, test.b)
+		if err != nil || n != want {
+			t.Errorf("%s: CompareCount = %d, %v; want %d", test.name, n, err, want)
+		}
+	}
+	if _, err := CompareCount(NewBinary(), a, image.NewNRGBA(image.Rect(0, 0, 1, 1))); err != ErrSize {
+		t.Errorf("CompareCount of different sizes: err = %v; want ErrSize", err)
+	}
+}
+
+func TestBinary16(t *testing.T) {
+	a, b := readRGBA64Pair(t)
+	n8 := image.NewNRGBA(a.Bounds())
+	draw.Draw(n8, n8.Rect, b, image.Point{}, draw.Src)
+	tests := []struct {
+		d    Differ
+		b    image.Image
+		want int
+	}{
+		// all low bytes are compared
+		{NewBinary(), b, patch16.Dx() * patch16.Dy()},
+		{NewBinary(WithChannelTolerance16(0xff, 0, 0, 0)), b, 0},
+		{NewBinary(WithChannelTolerance(1, 0, 0, 0)), b, 0},
+		{NewBinary(WithChannelTolerance16(0xfe, 0, 0, 0)), b, patch16.Dx() * patch16.Dy()},
+		// the last tolerance option applies
+		{NewBinary(WithChannelTolerance16(0xfe, 0, 0, 0), WithChannelTolerance(1, 0, 0, 0)), b, 0},
+		// 16-bit tolerances are shifted for 8-bit comparisons
+		{NewBinary(WithChannelTolerance16(0x1ff, 0, 0, 0)), n8, 0},
+		// 8-bit images are compared with 8 bits
+		{NewBinary(), n8, 0},
+	}
+	for i, test := range tests {
+		_, n, err := test.d.Compare(a, test.b)
+		if err != nil || n != test.want {
+			t.Errorf("(%d) n = %d, %v; want %d", i, n, err, test.want)
+		}
+	}
+}
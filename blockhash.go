@@ -0,0 +1,130 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// NewBlockhash creates a new Differ comparing blockhashes of images,
+// of 64, 144 or 256 bits, see Blockhash. Like the Differ returned by
+// NewPHash, it returns the Hamming distance of the hashes and draws
+// their differing bits in the difference image.
+//
+// Compare returns an error if bits is not 64, 144 or 256.
+func NewBlockhash(bits int, opts ...Option) Differ {
+	n := blockhashSize(bits)
+	d := newHashDiffer("blockhash", n, func(m image.Image) []byte {
+		return blockhash(m, n)
+	}, 0, opts)
+	if n == 0 {
+		d.err = fmt.Errorf("imgdiff: invalid blockhash size %d", bits)
+	}
+	return d
+}
+
+// Blockhash returns the blockhash of m, as described at blockhash.io,
+// of 64, 144 or 256 bits, or nil for any other number of bits.
+// Its hex encoding is the same as of the reference implementations.
+//
+// The image is split into a 8 x 8, 12 x 12 or 16 x 16 grid of blocks,
+// pixels on the edges of blocks contributing to them proportionally
+// if the image size isn't a multiple of the grid size. A bit is set
+// for every block brighter than the median of the blocks in the same
+// quarter of the grid rows. Transparent pixels are white.
+// Blockhashes are more robust to recompression than average hashes.
+func Blockhash(m image.Image, bits int) []byte {
+	n := blockhashSize(bits)
+	if n == 0 {
+		return nil
+	}
+	return blockhash(m, n)
+}
+
+// blockhashSize returns the grid size of a blockhash of bits,
+// or 0 if it isn't supported.
+func blockhashSize(bits int) int {
+	switch bits {
+	case 64:
+		return 8
+	case 144:
+		return 12
+	case 256:
+		return 16
+	}
+	return 0
+}
+
+// blockhash returns the blockhash of m for a n x n grid of blocks.
+func blockhash(m image.Image, n int) []byte {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	blocks := make([]float64, n*n)
+	bw, bh := float64(w)/float64(n), float64(h)/float64(n)
+	row := make([]pixel, w)
+	for y := 0; y < h; y++ {
+		top, bottom, wtop, wbottom := blockSpan(y, h, n, bh)
+		readRow(row, m, b.Min.X, b.Min.Y+y)
+		for x, p := range row {
+			// sum of 8-bit components, not premultiplied
+			v := 765.0
+			if p[3] != 0 {
+				v = float64(p[0]+p[1]+p[2]) * 0xff / float64(p[3])
+			}
+			left, right, wleft, wright := blockSpan(x, w, n, bw)
+			blocks[top*n+left] += v * wtop * wleft
+			blocks[top*n+right] += v * wtop * wright
+			blocks[bottom*n+left] += v * wbottom * wleft
+			blocks[bottom*n+right] += v * wbottom * wright
+		}
+	}
+
+	// blocks dominated by black or white may all be equal to the median,
+	// and are set if it is in the upper half of values
+	half := bw * bh * 256 * 3 / 2
+	hash := make([]byte, n*n/8)
+	band := n * n / 4
+	for i := 0; i < len(blocks); i += band {
+		m := median(blocks[i : i+band])
+		for j, v := range blocks[i : i+band] {
+			if v > m || math.Abs(v-m) < 1 && m > half {
+				hash[(i+j)/8] |= 0x80 >> uint((i+j)%8)
+			}
+		}
+	}
+	return hash
+}
+
+// blockSpan returns the blocks lo and hi, of size bs, which pixel i of
+// a row or column of size pixels split into n blocks belongs to, and
+// its weights in them.
+func blockSpan(i, size, n int, bs float64) (lo, hi int, wlo, whi float64) {
+	if size%n == 0 {
+		lo = i * n / size
+		return lo, lo, 1, 0
+	}
+	mod := math.Mod(float64(i+1), bs)
+	frac := mod - math.Floor(mod)
+	lo = int(math.Floor(float64(i) / bs))
+	hi = lo
+	// the fraction of the pixel in the next block, unless it ends
+	// on a block boundary or the image border
+	if mod-frac == 0 && i+1 != size {
+		hi = int(math.Ceil(float64(i) / bs))
+	}
+	return lo, hi, 1 - frac, frac
+}
@@ -0,0 +1,125 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBlockhash(t *testing.T) {
+	f, err := os.Open("testdata/blockhash.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	n := 0
+	for i := 1; s.Scan(); i++ {
+		line := s.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var name, want string
+		var w, h, bits int
+		if _, err := fmt.Sscan(line, &name, &w, &h, &bits, &want); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		m, err := readTestImage(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m = m.(interface {
+			SubImage(image.Rectangle) image.Image
+		}).SubImage(image.Rect(0, 0, w, h).Add(m.Bounds().Min))
+		if got := hex.EncodeToString(Blockhash(m, bits)); got != want {
+			t.Errorf("line %d: %s %dx%d: Blockhash(%d) = %s; want %s", i, name, w, h, bits, got, want)
+		}
+		n++
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Error("no test cases")
+	}
+}
+
+func TestBlockhashTransparent(t *testing.T) {
+	tests := []struct {
+		r image.Rectangle
+		// whether grids of all sizes divide r evenly
+		even bool
+	}{
+		{image.Rect(0, 0, 48, 48), true},
+		{image.Rect(0, 0, 21, 13), false},
+	}
+	for _, test := range tests {
+		r := test.r
+		m := image.NewNRGBA(r)
+		white := image.NewNRGBA(r)
+		for y := 0; y < r.Dy(); y++ {
+			for x := 0; x < r.Dx(); x++ {
+				// half transparent black on the left
+				if x < r.Dx()/2 {
+					m.SetNRGBA(x, y, color.NRGBA{0, 0, 0, 0})
+				}
+				white.SetNRGBA(x, y, color.NRGBA{0xff, 0xff, 0xff, 0xff})
+			}
+		}
+		for _, bits := range []int{64, 144, 256} {
+			got, want := Blockhash(m, bits), Blockhash(white, bits)
+			if string(got) != string(want) {
+				t.Errorf("%v %d: Blockhash = %x; want %x of white", r, bits, got, want)
+			}
+			// equal blocks are all equal to the median of white
+			// blocks, so they are set
+			if all := strings.Repeat("f", bits/4); test.even && hex.EncodeToString(got) != all {
+				t.Errorf("%v %d: Blockhash = %x; want %s", r, bits, got, all)
+			}
+		}
+	}
+}
+
+func TestBlockhashDiffer(t *testing.T) {
+	fish1, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fish2, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// see testdata/blockhash.txt
+	for bits, want := range map[int]int{64: 2, 144: 2, 256: 2} {
+		if _, n, err := NewBlockhash(bits).Compare(fish1, fish2); err != nil || n != want {
+			t.Errorf("%d bits: n = %d, err = %v; want %d", bits, n, err, want)
+		}
+	}
+	for _, bits := range []int{0, 63, 128} {
+		if _, _, err := NewBlockhash(bits).Compare(fish1, fish2); err == nil {
+			t.Errorf("%d bits: no error", bits)
+		}
+		if h := Blockhash(fish1, bits); h != nil {
+			t.Errorf("Blockhash(%d) = %x; want nil", bits, h)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"runtime"
+)
+
+type blurred struct {
+	inner Differ
+	sigma float64
+	// invalid sigma, returned by Compare
+	err error
+}
+
+// NewBlurred creates a new Differ which compares images with inner
+// after blurring them with a Gaussian of standard deviation sigma,
+// in pixels, so that noise such as differences of font hinting and
+// anti-aliasing is ignored. Images are mirrored at the borders,
+// as when the perceptual algorithm builds its pyramids, and blurred
+// in 16-bit alpha-premultiplied colors.
+//
+// The difference image and count are those of inner.
+// Compare returns an error if sigma is not positive. The kernel
+// doesn't reach further than the larger side of the images, so
+// a huge sigma blurs them into their mean color.
+func NewBlurred(inner Differ, sigma float64) Differ {
+	d := &blurred{inner: inner, sigma: sigma}
+	if !(sigma > 0) || math.IsInf(sigma, 1) {
+		d.err = fmt.Errorf("imgdiff: invalid blur sigma %g", sigma)
+	}
+	return d
+}
+
+// gaussianKernel returns a 1D Gaussian kernel of standard deviation
+// sigma, cut off at 3 sigma or maxR pixels, whichever is less,
+// and normalized to sum to 1.
+func gaussianKernel(sigma float64, maxR int) []float64 {
+	r := maxR
+	// compared as floats, so that a huge sigma doesn't overflow r
+	if c := math.Ceil(3 * sigma); c < float64(maxR) {
+		r = int(c)
+	}
+	k := make([]float64, 2*r+1)
+	var sum float64
+	for i := range k {
+		x := float64(i - r)
+		k[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += k[i]
+	}
+	for i := range k {
+		k[i] /= sum
+	}
+	return k
+}
+
+// Compare compares a and b with the inner Differ, after blurring them.
+func (d *blurred) Compare(a, b image.Image) (image.Image, int, error) {
+	diff := new(image.NRGBA)
+	n, err := d.CompareInto(diff, a, b)
+	if err != nil {
+		return nil, -1, err
+	}
+	return diff, n, nil
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *blurred) CompareInto(diff *image.NRGBA, a, b image.Image) (int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return -1, ErrSize
+	}
+	if d.err != nil {
+		return -1, d.err
+	}
+	k := gaussianKernel(d.sigma, max(w, h))
+	var blurA, blurB image.Image
+	parallel(runtime.GOMAXPROCS(0), func(n int) {
+		blurA = blur(a, k, n)
+	}, func(n int) {
+		blurB = blur(b, k, n)
+	})
+	if id, ok := d.inner.(IntoDiffer); ok {
+		return id.CompareInto(diff, blurA, blurB)
+	}
+	m, n, err := d.inner.Compare(blurA, blurB)
+	if err != nil {
+		return -1, err
+	}
+	resize(diff, w, h)
+	draw.Draw(diff, diff.Rect, m, m.Bounds().Min, draw.Src)
+	return n, nil
+}
+
+// blur returns m convolved with kernel k in both directions, mirrored
+// at the borders, using up to n goroutines. Its bounds are zero-based.
+func blur(m image.Image, k []float64, n int) *image.RGBA64 {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := image.NewRGBA64(image.Rect(0, 0, w, h))
+	if w == 0 || h == 0 {
+		return out
+	}
+	// planes of R, G, B and A samples
+	var src, dst [4][][]float64
+	for i := range src {
+		src[i] = newRows(w, h)
+		dst[i] = newRows(w, h)
+	}
+	row := make([]pixel, w)
+	for y := 0; y < h; y++ {
+		readRow(row, m, b.Min.X, b.Min.Y+y)
+		for x, p := range row {
+			for i, v := range p {
+				src[i][y][x] = float64(v)
+			}
+		}
+	}
+	c := newConvolution(k, w, h, 0)
+	forBands(n, h, func(y0, y1 int) int {
+		buf := c.newRow()
+		for i := range src {
+			c.convolve(dst[i], src[i], y0, y1, buf)
+		}
+		for y := y0; y < y1; y++ {
+			pix := out.Pix[out.PixOffset(0, y):]
+			for x := 0; x < w; x++ {
+				for i := range dst {
+					v := uint16(clamp16(dst[i][y][x]))
+					pix[8*x+2*i] = uint8(v >> 8)
+					pix[8*x+2*i+1] = uint8(v)
+				}
+			}
+		}
+		return 0
+	})
+	return out
+}
+
+// clamp16 rounds v to the nearest integer in [0, 0xffff].
+func clamp16(v float64) float64 {
+	switch {
+	case v < 0:
+		return 0
+	case v > 0xffff:
+		return 0xffff
+	}
+	return math.Floor(v + 0.5)
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+func TestGaussianKernel(t *testing.T) {
+	for _, sigma := range []float64{0.3, 1, 1.5, 4} {
+		k := gaussianKernel(sigma, 100)
+		if r := int(math.Ceil(3 * sigma)); len(k) != 2*r+1 {
+			t.Errorf("%g: len = %d; want %d", sigma, len(k), 2*r+1)
+		}
+		if err := validKernel(k); err != nil {
+			t.Errorf("%g: %v", sigma, err)
+		}
+		for i := 0; i < len(k)/2; i++ {
+			if k[i] != k[len(k)-1-i] || k[i] > k[i+1] {
+				t.Errorf("%g: not a symmetric bell: %v", sigma, k)
+				break
+			}
+		}
+	}
+	// cut off at maxR
+	for _, sigma := range []float64{5, 1e9, 1e300, math.MaxFloat64} {
+		if k := gaussianKernel(sigma, 4); len(k) != 9 {
+			t.Errorf("%g: len = %d; want 9", sigma, len(k))
+		} else if err := validKernel(k); err != nil {
+			t.Errorf("%g: %v", sigma, err)
+		}
+	}
+}
+
+func TestBlurred(t *testing.T) {
+	r := image.Rect(0, 0, 12, 9)
+	a := image.NewRGBA(r)
+	draw.Draw(a, r, image.NewUniform(color.White), image.ZP, draw.Src)
+	b := image.NewRGBA(r)
+	copy(b.Pix, a.Pix)
+	b.SetRGBA(5, 4, color.RGBA{0xe0, 0xe0, 0xe0, 0xff})
+
+	// uniform images stay uniform, borders included
+	m := blur(a, gaussianKernel(1.5, 12), 2)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			if c := m.RGBA64At(x, y); c != (color.RGBA64{0xffff, 0xffff, 0xffff, 0xffff}) {
+				t.Fatalf("blurred white at %d, %d = %v", x, y, c)
+			}
+		}
+	}
+
+	if _, n, err := NewDeltaE(2.3).Compare(a, b); err != nil || n != 1 {
+		t.Fatalf("unblurred: n = %d, err = %v; want 1", n, err)
+	}
+	diff, n, err := NewBlurred(NewDeltaE(2.3), 1.5).Compare(a, b)
+	if err != nil || n != 0 {
+		t.Errorf("blurred: n = %d, err = %v; want 0", n, err)
+	}
+	if err == nil && diff.Bounds() != r {
+		t.Errorf("diff bounds = %v; want %v", diff.Bounds(), r)
+	}
+	// a larger difference is still found
+	draw.Draw(b, image.Rect(3, 3, 9, 7), image.NewUniform(color.Black), image.ZP, draw.Src)
+	if _, n, err := NewBlurred(NewDeltaE(2.3), 1.5).Compare(a, b); err != nil || n == 0 {
+		t.Errorf("blurred square: n = %d, err = %v; want > 0", n, err)
+	}
+	// a huge sigma blurs both into about their mean colors
+	if _, n, err := NewBlurred(NewBinary(), 1e9).Compare(a, a); err != nil || n != 0 {
+		t.Errorf("sigma 1e9: n = %d, err = %v; want 0", n, err)
+	}
+}
+
+func TestBlurredErrors(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for _, sigma := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		if _, _, err := NewBlurred(NewBinary(), sigma).Compare(a, a); err == nil {
+			t.Errorf("sigma %g: err = nil", sigma)
+		}
+	}
+	b := image.NewRGBA(image.Rect(0, 0, 4, 5))
+	if _, _, err := NewBlurred(NewBinary(), 1).Compare(a, b); err != ErrSize {
+		t.Errorf("err = %v; want ErrSize", err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import "math"
+
+// NewCIEDE2000 creates a new Differ based on the CIEDE2000 color
+// difference formula, as described by Sharma et al. in "The CIEDE2000
+// color-difference formula: implementation notes, supplementary test
+// data, and mathematical observations", Color Research & Application 2005.
+//
+// Colors are converted to LAB as by NewDeltaE. Pixels whose ΔE00
+// is above tolerance are counted as different and marked red in the
+// difference image. A ΔE00 of about 1 is the smallest difference
+// noticeable side by side.
+func NewCIEDE2000(tolerance float64, opts ...Option) Differ {
+	return newLabDiffer("ciede2000", deltaE00, tolerance, opts)
+}
+
+// deltaE00 returns the CIEDE2000 difference of LAB colors c1 and c2,
+// with parametric factors kL, kC and kH of 1.
+//
+// The hue of neutral colors, with chroma 0, is undefined. It is taken
+// to be 0, and the hue difference of a pair with a neutral color is 0,
+// as recommended by Sharma et al.
+func deltaE00(c1, c2 [3]float64) float64 {
+	l1, a1, b1 := c1[0], c1[1], c1[2]
+	l2, a2, b2 := c2[0], c2[1], c2[2]
+
+	cab := (math.Hypot(a1, b1) + math.Hypot(a2, b2)) / 2
+	cab7 := math.Pow(cab, 7)
+	g := 0.5 * (1 - math.Sqrt(cab7/(cab7+pow25to7)))
+	a1p, a2p := (1+g)*a1, (1+g)*a2
+	c1p, c2p := math.Hypot(a1p, b1), math.Hypot(a2p, b2)
+	h1p, h2p := hueAngle(b1, a1p), hueAngle(b2, a2p)
+
+	dl := l2 - l1
+	dc := c2p - c1p
+	var dh float64
+	if c1p*c2p != 0 {
+		dh = h2p - h1p
+		if dh > 180 {
+			dh -= 360
+		} else if dh < -180 {
+			dh += 360
+		}
+	}
+	dH := 2 * math.Sqrt(c1p*c2p) * math.Sin(rad(dh/2))
+
+	lp := (l1 + l2) / 2
+	cp := (c1p + c2p) / 2
+	hp := h1p + h2p
+	if c1p*c2p != 0 {
+		switch {
+		case math.Abs(h1p-h2p) <= 180:
+			hp /= 2
+		case hp < 360:
+			hp = (hp + 360) / 2
+		default:
+			hp = (hp - 360) / 2
+		}
+	}
+	t := 1 - 0.17*math.Cos(rad(hp-30)) + 0.24*math.Cos(rad(2*hp)) +
+		0.32*math.Cos(rad(3*hp+6)) - 0.20*math.Cos(rad(4*hp-63))
+	dTheta := 30 * math.Exp(-((hp-275)/25)*((hp-275)/25))
+	cp7 := math.Pow(cp, 7)
+	rc := 2 * math.Sqrt(cp7/(cp7+pow25to7))
+	l50 := (lp - 50) * (lp - 50)
+	sl := 1 + 0.015*l50/math.Sqrt(20+l50)
+	sc := 1 + 0.045*cp
+	sh := 1 + 0.015*cp*t
+	rt := -math.Sin(rad(2*dTheta)) * rc
+
+	dl, dc, dH = dl/sl, dc/sc, dH/sh
+	return math.Sqrt(dl*dl + dc*dc + dH*dH + rt*dc*dH)
+}
+
+// 25^7 of the chroma terms of deltaE00
+const pow25to7 = 6103515625
+
+// hueAngle returns the hue angle of a LAB color in degrees, in [0, 360).
+// It is 0 for neutral colors, where a and b are 0.
+func hueAngle(b, a float64) float64 {
+	if a == 0 && b == 0 {
+		return 0
+	}
+	h := math.Atan2(b, a) * 180 / math.Pi
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+// rad converts degrees to radians.
+func rad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
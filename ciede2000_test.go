@@ -0,0 +1,123 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDeltaE00(t *testing.T) {
+	f, err := os.Open("testdata/ciede2000.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	n := 0
+	for i := 1; s.Scan(); i++ {
+		line := s.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var c1, c2 [3]float64
+		var want float64
+		if _, err := fmt.Sscan(line, &c1[0], &c1[1], &c1[2], &c2[0], &c2[1], &c2[2], &want); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		// the formula is symmetric
+		for _, de := range []float64{deltaE00(c1, c2), deltaE00(c2, c1)} {
+			if math.Abs(de-want) > 5e-5 {
+				t.Errorf("line %d: deltaE00(%v, %v) = %.4f; want %.4f", i, c1, c2, de, want)
+			}
+		}
+		n++
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 34 {
+		t.Errorf("read %d test pairs; want 34", n)
+	}
+}
+
+func TestDeltaE00Neutral(t *testing.T) {
+	tests := []struct {
+		c1, c2 [3]float64
+		want   float64
+	}{
+		{[3]float64{50, 0, 0}, [3]float64{50, 0, 0}, 0},
+		{[3]float64{0, 0, 0}, [3]float64{0, 0, 0}, 0},
+		{[3]float64{50, 0, 0}, [3]float64{60, 0, 0}, -1},
+		{[3]float64{0, 0, 0}, [3]float64{100, 0, 0}, 100},
+		{[3]float64{50, 0, 0}, [3]float64{50, 1e-12, 0}, -1},
+		{[3]float64{50, 0, 0}, [3]float64{50, 0, -1e-300}, -1},
+	}
+	for i, test := range tests {
+		de := deltaE00(test.c1, test.c2)
+		if math.IsNaN(de) || math.IsInf(de, 0) || de < 0 {
+			t.Errorf("(%d) deltaE00 = %v", i, de)
+		} else if test.want >= 0 && math.Abs(de-test.want) > 1e-9 {
+			t.Errorf("(%d) deltaE00 = %v; want %v", i, de, test.want)
+		}
+	}
+}
+
+func TestCIEDE2000(t *testing.T) {
+	r := image.Rect(1, 2, 5, 3)
+	a := image.NewRGBA(r)
+	b := image.NewRGBA(r)
+	colors := [][2]color.RGBA{
+		{{0x80, 0x80, 0x80, 0xff}, {0x80, 0x80, 0x80, 0xff}},
+		// gray off by one level
+		{{0x80, 0x80, 0x80, 0xff}, {0x81, 0x81, 0x81, 0xff}},
+		// a hue-only change of a saturated color
+		{{0xe0, 0x20, 0x40, 0xff}, {0xe0, 0x20, 0x20, 0xff}},
+		{{0xff, 0xff, 0xff, 0xff}, {0, 0, 0, 0xff}},
+	}
+	for i, c := range colors {
+		a.SetRGBA(r.Min.X+i, r.Min.Y, c[0])
+		b.SetRGBA(r.Min.X+i, r.Min.Y, c[1])
+	}
+	tests := []struct {
+		tolerance float64
+		n         int
+	}{
+		{0, 3},
+		{2.3, 2},
+		{100, 0},
+	}
+	for i, test := range tests {
+		diff, n, err := NewCIEDE2000(test.tolerance).Compare(a, b)
+		if err != nil {
+			t.Fatalf("(%d) %v", i, err)
+		}
+		if n != test.n {
+			t.Errorf("(%d) n = %d; want %d", i, n, test.n)
+		}
+		if c := diff.At(0, 0); c != (color.NRGBA{0, 0, 0, 0xff}) {
+			t.Errorf("(%d) diff at 0, 0 = %v; want black", i, c)
+		}
+	}
+	if _, _, err := NewCIEDE2000(1).Compare(a, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != ErrSize {
+		t.Errorf("err = %v; want ErrSize", err)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/crhym3/imgdiff"
+)
+
+// Algorithms of -a which package imgdiff doesn't register. Their
+// factories are configured by flags, ignoring their options.
+func init() {
+	algorithms := map[string]func(opts []imgdiff.Option) imgdiff.Differ{
+		"ssim": func(opts []imgdiff.Option) imgdiff.Differ {
+			return imgdiff.NewSSIM(*ssimWindow, 0.01, 0.03, append(opts, imgdiff.WithSSIMThreshold(*ssimThreshold))...)
+		},
+		"msssim": func(opts []imgdiff.Option) imgdiff.Differ {
+			return imgdiff.NewMSSSIM(*msssimScales, append(opts, imgdiff.WithSSIMThreshold(*ssimThreshold))...)
+		},
+		"mse": func(opts []imgdiff.Option) imgdiff.Differ {
+			return imgdiff.NewMSE(*mseThreshold, opts...)
+		},
+		"deltae": func(opts []imgdiff.Option) imgdiff.Differ {
+			return imgdiff.NewDeltaE(*deltaE, opts...)
+		},
+		"ciede2000": func(opts []imgdiff.Option) imgdiff.Differ {
+			return imgdiff.NewCIEDE2000(*deltaE, opts...)
+		},
+		"pixelmatch": func(opts []imgdiff.Option) imgdiff.Differ {
+			return imgdiff.NewPixelmatch(*pmThreshold, *includeAA, opts...)
+		},
+		"phash": func(opts []imgdiff.Option) imgdiff.Differ {
+			return imgdiff.NewPHash(*phashSize, 0, opts...)
+		},
+		"ahash": func(opts []imgdiff.Option) imgdiff.Differ {
+			return imgdiff.NewAHash(0, opts...)
+		},
+		"dhash": func(opts []imgdiff.Option) imgdiff.Differ {
+			return imgdiff.NewDHash(0, opts...)
+		},
+		"blockhash": func(opts []imgdiff.Option) imgdiff.Differ {
+			return imgdiff.NewBlockhash(*blockhashBits, opts...)
+		},
+		"edge": func(opts []imgdiff.Option) imgdiff.Differ {
+			return imgdiff.NewEdge(*edgeThreshold, opts...)
+		},
+		"gmsd": func(opts []imgdiff.Option) imgdiff.Differ {
+			return imgdiff.NewGMSD(append(opts, imgdiff.WithGMSThreshold(*gmsThreshold))...)
+		},
+		"histogram": func(opts []imgdiff.Option) imgdiff.Differ {
+			for _, m := range []imgdiff.HistMethod{imgdiff.HistChiSquare, imgdiff.HistCorrelation, imgdiff.HistBhattacharyya} {
+				if m.String() == *histMethod {
+					return imgdiff.NewHistogram(*histBins, m, opts...)
+				}
+			}
+			log.Fatalf("unsupported histogram method: %s", *histMethod)
+			return nil
+		},
+	}
+	for name, f := range algorithms {
+		f := f
+		err := imgdiff.Register(name, func(map[string]string) (imgdiff.Differ, error) {
+			return f(commonOptions()), nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// newAlgorithm returns the registered Differ of algorithm name,
+// configured by flags.
+func newAlgorithm(name string) imgdiff.Differ {
+	f := func(opts map[string]string) (imgdiff.Differ, error) {
+		return imgdiff.New(name, opts)
+	}
+	var extra []imgdiff.Option
+	if *progress && isTerminal(os.Stderr) {
+		extra = append(extra, imgdiff.WithProgress(printProgress()))
+	}
+	switch {
+	case name == "perceptual" && *debugDir != "":
+		f = imgdiff.PerceptualFactory(append(extra, imgdiff.WithDebug(debugPlanes(*debugDir)))...)
+	case name == "perceptual" && len(extra) > 0:
+		f = imgdiff.PerceptualFactory(extra...)
+	case name == "binary" && len(extra) > 0:
+		f = imgdiff.BinaryFactory(extra...)
+	}
+	d, err := f(algorithmOptions(name))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return d
+}
+
+// commonOptions returns the Options of flags which apply
+// to all algorithms.
+func commonOptions() []imgdiff.Option {
+	opts := []imgdiff.Option{imgdiff.WithMaxWorkers(*workers), imgdiff.WithShiftTolerance(*shift)}
+	if *unlimited {
+		opts = append(opts, imgdiff.WithUnlimited())
+	}
+	return opts
+}
+
+// algorithmOptions returns the string options of flags for the
+// algorithms package imgdiff registers, see imgdiff.Register,
+// or nil for the others.
+func algorithmOptions(name string) map[string]string {
+	opts := map[string]string{
+		"workers":   strconv.Itoa(*workers),
+		"shift":     strconv.Itoa(*shift),
+		"unlimited": strconv.FormatBool(*unlimited),
+	}
+	if name == "binary" || name == "perceptual" {
+		opts["alpha"] = *alphaMode
+		opts["bg"] = compareBg.String()
+		opts["delta"] = strconv.FormatBool(*deltas)
+		if n := maxDiff(); n >= 0 {
+			opts["maxdiff"] = strconv.Itoa(n)
+		}
+		switch *style {
+		case "mark", "sidebyside":
+		case "heatmap":
+			opts["heatmap"] = "true"
+		case "overlay":
+			opts["overlay"] = imgdiff.BaseA.String()
+			opts["dim"] = fmtFloat(*dim)
+		default:
+			log.Fatalf("unsupported style: %s", *style)
+		}
+	}
+	switch name {
+	case "binary":
+		opts["eps"] = fmtFloat(*epsilon)
+		if *tol != "" {
+			opts["tol"] = *tol
+		}
+		if *fuzz != "" {
+			opts["fuzz"] = *fuzz
+		}
+		if *linear {
+			opts["linear"] = "srgb"
+		}
+		opts["gray"] = strconv.FormatBool(*luma)
+	case "perceptual":
+		opts["gamma"] = fmtFloat(*gamma)
+		opts["lum"] = fmtFloat(*lum)
+		opts["fov"] = fmtFloat(*fov)
+		opts["cf"] = fmtFloat(*cf)
+		opts["nocolor"] = strconv.FormatBool(*nocolor)
+		opts["cvd"] = *cvd
+		opts["levels"] = strconv.Itoa(*levels)
+		opts["transfer"] = *transfer
+		opts["csf"] = *csfModel
+	default:
+		return nil
+	}
+	return opts
+}
+
+// fmtFloat formats v so that it parses back exactly.
+func fmtFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// algorithmList returns registered algorithm names as a sentence,
+// wrapped at 72 columns.
+func algorithmList() string {
+	names := imgdiff.Names()
+	for i, name := range names {
+		names[i] = "'" + name + "'"
+	}
+	n := len(names)
+	list := names[n-1]
+	if n > 1 {
+		list = strings.Join(names[:n-1], ", ") + " and " + list
+	}
+	s := "Currently supported comparison algorithms are " + list
+	var lines []string
+	line := ""
+	for _, w := range strings.Fields(s + ".") {
+		if line != "" && len(line)+1+len(w) > 72 {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += w
+	}
+	return strings.Join(append(lines, line), "\n")
+}
@@ -0,0 +1,48 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/crhym3/imgdiff"
+)
+
+// debugPlanes is an imgdiff.DebugSink writing planes to PNG images
+// of a directory, see -debug-dir. Planes of each comparison overwrite
+// those of the previous one.
+type debugPlanes string
+
+func (dir debugPlanes) Plane(name string, p *imgdiff.DebugPlane) {
+	if err := os.MkdirAll(string(dir), 0755); err != nil {
+		log.Fatal(err)
+	}
+	lo, hi := p.Range()
+	if name == "reason" {
+		// pixels passing with -shift are as black as passing ones
+		for i, v := range p.Pix {
+			if v == imgdiff.ReasonShift {
+				p.Pix[i] = imgdiff.ReasonPass
+			}
+		}
+		lo, hi = imgdiff.ReasonPass, imgdiff.ReasonColor
+	}
+	dst := filepath.Join(string(dir), name+".png")
+	writeImage(dst, "png", p.Gray(lo, hi))
+	fmt.Fprintf(os.Stderr, "%s: %g to %g\n", dst, lo, hi)
+}
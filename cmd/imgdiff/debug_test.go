@@ -0,0 +1,53 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestDebugDir(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+	dir := filepath.Join(t.TempDir(), "planes")
+	srgb, p3 := filepath.Join("testdata", "icc_srgb.png"), filepath.Join("testdata", "icc_p3.png")
+	cmd := exec.Command(os.Args[0], "-test.run=TestDebugDir", "-ignore-icc", "-t", "0", "-debug-dir", dir, srgb, p3)
+	cmd.Env = append(os.Environ(), "RUNME=1")
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Fatalf("no difference\n%s", out)
+	}
+	for _, name := range []string{"adaptation", "contrast", "factor", "luminance", "threshold", "chroma", "reason"} {
+		f, err := os.Open(filepath.Join(dir, name+".png"))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		m, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if r, want := m.Bounds(), readImage(srgb).Bounds(); r != want {
+			t.Errorf("%s: bounds %v; want %v", name, r, want)
+		}
+	}
+}
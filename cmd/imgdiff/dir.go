@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/crhym3/imgdiff"
+)
+
+// imageExts are file extensions considered in directory mode.
+var imageExts = map[string]bool{
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".gif":  true,
+	".tif":  true,
+	".tiff": true,
+	".bmp":  true,
+	".webp": true,
+	".exr":  true,
+	".ff":   true,
+	".jxl":  true,
+}
+
+func isDir(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && fi.IsDir()
+}
+
+// listImages returns paths of all images under root, relative to root.
+func listImages(root string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !imageExts[strings.ToLower(filepath.Ext(p))] {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// runDir compares every image in dir1 with its counterpart in dir2.
+// Only one pair of images is held in memory at a time.
+func runDir(dir1, dir2 string) {
+	if *output != "" {
+		log.Fatal("-o is not supported when comparing directories")
+	}
+	if *deltaOut != "" {
+		log.Fatal("-o-delta is not supported when comparing directories")
+	}
+	files, err := listImages(dir1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var sheet *contactSheet
+	if *sheetPath != "" {
+		sheet = newContactSheet(*sheetCols, *sheetSize)
+	}
+	d := newDiffer()
+	nfail := 0
+	for _, rel := range files {
+		p2 := filepath.Join(dir2, rel)
+		if _, err := os.Stat(p2); err != nil {
+			fmt.Printf("%s: missing in %s\n", rel, dir2)
+			nfail++
+			continue
+		}
+		img1, img2, err := loadImages(filepath.Join(dir1, rel), p2)
+		if err != nil {
+			fmt.Printf("%s: %v\n", rel, err)
+			nfail++
+			continue
+		}
+		res, n, err := compare(d, img1, img2, rel+": ")
+		total := img1.Bounds().Dx() * img1.Bounds().Dy()
+		closeImage(img1)
+		closeImage(img2)
+		truncated := err == imgdiff.ErrMaxDiff
+		if err != nil && !truncated {
+			fmt.Printf("%s: %v\n", rel, err)
+			nfail++
+			continue
+		}
+		failed := truncated || exceeded(n, total)
+		if reported(failed) {
+			fmt.Printf("%s: %s\n", rel, difference(n, total, truncated))
+		}
+		if failed {
+			nfail++
+			if *preview {
+				printPreview(res)
+			}
+		}
+		if sheet != nil && (failed || *sheetAll) {
+			sheet.add(res, sheetCaption(filepath.ToSlash(rel), n, res))
+		}
+	}
+	if sheet != nil && len(sheet.tiles) > 0 {
+		writeImage(*sheetPath, "", sheet.render())
+	}
+	if nfail > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"log"
+
+	"github.com/crhym3/imgdiff"
+)
+
+// maxProfileHead is how many bytes of an image file are searched
+// for an embedded ICC profile, which comes before the pixel data.
+const maxProfileHead = 16 << 20
+
+// readImages reads the images at p1 and p2. Unless -ignore-icc is set,
+// if they are tagged with different ICC profiles, both are converted
+// to sRGB, untagged images being sRGB already, so that they are
+// compared by the colors they look like.
+func readImages(p1, p2 string) (image.Image, image.Image) {
+	m1, m2, err := loadImages(p1, p2)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return m1, m2
+}
+
+// loadImages is readImages returning errors rather than exiting.
+// Neither image is left open if it fails.
+func loadImages(p1, p2 string) (image.Image, image.Image, error) {
+	m1, prof1, err := readImageProfile(p1)
+	if err != nil {
+		return nil, nil, err
+	}
+	m2, prof2, err := readImageProfile(p2)
+	if err != nil {
+		closeImage(m1)
+		return nil, nil, err
+	}
+	if bytes.Equal(prof1, prof2) {
+		return m1, m2, nil
+	}
+	s1, err := toSRGB(p1, m1, prof1)
+	if err == nil {
+		m2, err = toSRGB(p2, m2, prof2)
+	}
+	if err != nil {
+		closeImage(m1)
+		closeImage(m2)
+		return nil, nil, err
+	}
+	return s1, m2, nil
+}
+
+// readImageProfile is decodeImage also returning the ICC profile embedded
+// in the image, or nil if there is none or -ignore-icc is set.
+func readImageProfile(p string) (image.Image, []byte, error) {
+	if *ignoreICC {
+		m, err := decodeImage(p)
+		return m, nil, err
+	}
+	if m := openTiled(p); m != nil {
+		return m, nil, nil
+	}
+	r, err := openFile(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	head := &headBuffer{max: maxProfileHead}
+	img, _, err := image.Decode(io.TeeReader(r, head))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return img, embeddedProfile(head.b), nil
+}
+
+// toSRGB converts m, read from p, from ICC profile prof to sRGB.
+func toSRGB(p string, m image.Image, prof []byte) (image.Image, error) {
+	if prof == nil {
+		return m, nil
+	}
+	icc, err := imgdiff.ParseICCProfile(prof)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v; use -ignore-icc to compare it as sRGB", p, err)
+	}
+	return icc.ToSRGB(m), nil
+}
+
+// headBuffer keeps the first max bytes written to it.
+type headBuffer struct {
+	b   []byte
+	max int
+}
+
+func (h *headBuffer) Write(p []byte) (int, error) {
+	n := h.max - len(h.b)
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > 0 {
+		h.b = append(h.b, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// embeddedProfile returns the ICC profile embedded in the PNG or JPEG
+// file starting with b, or nil if there is none.
+func embeddedProfile(b []byte) []byte {
+	switch {
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		return pngProfile(b[8:])
+	case bytes.HasPrefix(b, []byte{0xff, 0xd8}):
+		return jpegProfile(b[2:])
+	}
+	return nil
+}
+
+// pngProfile returns the profile of the iCCP chunk among PNG chunks b.
+func pngProfile(b []byte) []byte {
+	for len(b) >= 12 {
+		n := binary.BigEndian.Uint32(b)
+		typ := string(b[4:8])
+		if typ == "IDAT" || uint64(n)+12 > uint64(len(b)) {
+			return nil
+		}
+		if typ == "iCCP" {
+			data := b[8 : 8+n]
+			// profile name, null separator and compression method 0
+			i := bytes.IndexByte(data, 0)
+			if i < 0 || i+1 >= len(data) || data[i+1] != 0 {
+				return nil
+			}
+			r, err := zlib.NewReader(bytes.NewReader(data[i+2:]))
+			if err != nil {
+				return nil
+			}
+			prof, err := io.ReadAll(r)
+			if err != nil {
+				return nil
+			}
+			return prof
+		}
+		b = b[12+n:]
+	}
+	return nil
+}
+
+// jpegProfile returns the profile of the APP2 ICC_PROFILE segments
+// among JPEG segments b, in which it may be split.
+func jpegProfile(b []byte) []byte {
+	var chunks [][]byte
+	for len(b) >= 4 && b[0] == 0xff {
+		marker := b[1]
+		switch {
+		case marker == 0xff:
+			// fill byte
+			b = b[1:]
+			continue
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7:
+			// no length
+			b = b[2:]
+			continue
+		case marker == 0xda || marker == 0xd9:
+			// start of scan or end of image
+			b = nil
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if n < 2 || 2+n > len(b) {
+			break
+		}
+		seg := b[4 : 2+n]
+		if marker == 0xe2 && len(seg) >= 14 && string(seg[:12]) == "ICC_PROFILE\x00" {
+			seq, count := int(seg[12]), int(seg[13])
+			if chunks == nil {
+				chunks = make([][]byte, count)
+			}
+			if seq < 1 || seq > len(chunks) {
+				return nil
+			}
+			chunks[seq-1] = seg[14:]
+		}
+		b = b[2+n:]
+	}
+	var prof []byte
+	for _, c := range chunks {
+		if c == nil {
+			return nil
+		}
+		prof = append(prof, c...)
+	}
+	return prof
+}
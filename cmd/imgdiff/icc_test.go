@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/crhym3/imgdiff"
+)
+
+// testdata/icc_p3.png has the colors of testdata/icc_srgb.png
+// encoded in Display P3, with the profile in its iCCP chunk.
+func TestICCProfiles(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+	srgb, p3 := filepath.Join("testdata", "icc_srgb.png"), filepath.Join("testdata", "icc_p3.png")
+	for _, test := range []struct {
+		opts []string
+		fail bool
+	}{
+		{[]string{"-t", "0"}, false},
+		{[]string{"-t", "0", "-a", "binary", "-tol", "1,1,1,0"}, true},
+		{[]string{"-t", "0", "-a", "binary", "-tol", "2,2,2,0"}, false},
+		{[]string{"-t", "0", "-ignore-icc"}, true},
+	} {
+		args := append([]string{"-test.run=TestICCProfiles"}, test.opts...)
+		cmd := exec.Command(os.Args[0], append(args, srgb, p3)...)
+		cmd.Env = append(os.Environ(), "RUNME=1")
+		out, err := cmd.CombinedOutput()
+		if failed := err != nil; failed != test.fail {
+			t.Errorf("%v: err = %v\n%s", test.opts, err, out)
+		}
+	}
+}
+
+func TestPNGProfile(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "icc_p3.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := embeddedProfile(b)
+	if _, err := imgdiff.ParseICCProfile(prof); err != nil {
+		t.Errorf("icc_p3.png: %v", err)
+	}
+	b, err = os.ReadFile(filepath.Join("testdata", "icc_srgb.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prof := embeddedProfile(b); prof != nil {
+		t.Errorf("icc_srgb.png: profile of %d bytes; want none", len(prof))
+	}
+}
+
+func TestJPEGProfile(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if prof := embeddedProfile(buf.Bytes()); prof != nil {
+		t.Errorf("untagged: profile of %d bytes; want none", len(prof))
+	}
+	// a profile split in two APP2 segments, out of order
+	app2 := func(seq int, data string) []byte {
+		seg := append([]byte("ICC_PROFILE\x00"), uint8(seq), 2)
+		seg = append(seg, data...)
+		n := len(seg) + 2
+		return append([]byte{0xff, 0xe2, uint8(n >> 8), uint8(n)}, seg...)
+	}
+	jpg := buf.Bytes()
+	tagged := append([]byte(nil), jpg[:2]...)
+	tagged = append(tagged, app2(2, "world")...)
+	tagged = append(tagged, app2(1, "hello, ")...)
+	tagged = append(tagged, jpg[2:]...)
+	if prof := embeddedProfile(tagged); string(prof) != "hello, world" {
+		t.Errorf("profile = %q; want %q", prof, "hello, world")
+	}
+	// a missing segment
+	tagged = append(append(append([]byte(nil), jpg[:2]...), app2(1, "hello, ")...), jpg[2:]...)
+	if prof := embeddedProfile(tagged); prof != nil {
+		t.Errorf("incomplete: profile = %q; want none", prof)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(tagged)); err != nil {
+		t.Errorf("tagged JPEG: %v", err)
+	}
+}
@@ -15,7 +15,12 @@
 package main
 
 import (
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
@@ -26,38 +31,110 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/crhym3/imgdiff"
+	"github.com/crhym3/imgdiff/cmd/imgdiff/termimg"
+	"github.com/crhym3/imgdiff/farbfeld"
+	"github.com/crhym3/imgdiff/tifftile"
 	"golang.org/x/image/bmp"
 	"golang.org/x/image/tiff"
 	_ "golang.org/x/image/webp"
 )
 
 func open(p string) io.ReadCloser {
+	r, err := openFile(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return r
+}
+
+// openFile is open returning errors rather than exiting.
+func openFile(p string) (io.ReadCloser, error) {
 	if strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://") {
 		res, err := http.Get(p)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		return res.Body
+		return res.Body, nil
 	}
-	f, err := os.Open(p)
+	return os.Open(p)
+}
+
+func readImage(p string) image.Image {
+	m, err := decodeImage(p)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return f
+	return m
 }
 
-func readImage(p string) image.Image {
-	r := open(p)
+// decodeImage is readImage returning errors rather than exiting.
+func decodeImage(p string) (image.Image, error) {
+	if m := openTiled(p); m != nil {
+		return m, nil
+	}
+	r, err := openFile(p)
+	if err != nil {
+		return nil, err
+	}
 	defer r.Close()
 	img, _, err := image.Decode(r)
 	if err != nil {
-		log.Fatalf("%s: %v", p, err)
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return img, nil
+}
+
+// tiledFile is a lazily decoded tiled TIFF backed by an open file.
+type tiledFile struct {
+	*tifftile.Image
+	f *os.File
+}
+
+func (t *tiledFile) Close() error {
+	return t.f.Close()
+}
+
+// openTiled opens a local tiled TIFF for lazy decoding.
+// It returns nil if p is not one or the algorithm in use can't walk tiles,
+// in which case the image should be decoded as usual.
+func openTiled(p string) *tiledFile {
+	if *algorithm != "binary" || *blurSigma > 0 || *shift > 0 || *align > 0 || *gridSize != "" || *find {
+		return nil
+	}
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".tif", ".tiff":
+	default:
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	m, err := tifftile.Open(f)
+	if err != nil {
+		f.Close()
+		return nil
+	}
+	return &tiledFile{m, f}
+}
+
+// closeImage releases resources held by m, if any.
+func closeImage(m image.Image) {
+	if c, ok := m.(io.Closer); ok {
+		c.Close()
 	}
-	return img
 }
 
 func writeImage(dst string, mf string, m image.Image) {
-	var err error
+	if strings.HasPrefix(dst, "term:") {
+		writeTerm(dst[len("term:"):], m)
+		return
+	}
+	mf, err := outputFormat(dst, mf)
+	if err != nil {
+		log.Fatal(err)
+	}
 	w := os.Stdout
 	if dst != "-" {
 		w, err = os.Create(dst)
@@ -65,22 +142,166 @@ func writeImage(dst string, mf string, m image.Image) {
 			log.Fatal(err)
 		}
 	}
-	if ext := filepath.Ext(dst); mf == "" && ext != "" {
-		mf = ext[1:]
-	}
 	switch mf {
-	default:
+	case "png":
 		err = png.Encode(w, m)
-	case "jpg", "jpeg":
-		err = jpeg.Encode(w, m, nil)
+	case "jpeg":
+		err = jpeg.Encode(w, flatten(m, color.NRGBA(background)), nil)
 	case "gif":
-		err = gif.Encode(w, m, nil)
-	case "tif", "tiff":
+		err = gif.Encode(w, flatten(m, color.NRGBA(background)), nil)
+	case "tiff":
 		err = tiff.Encode(w, m, nil)
 	case "bmp":
-		err = bmp.Encode(w, m)
+		err = bmp.Encode(w, flatten(m, color.NRGBA(background)))
+	case "farbfeld":
+		err = farbfeld.Encode(w, m)
 	}
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// outputFormats maps names of supported output formats,
+// as given with -of or as file extensions, to their canonical names.
+var outputFormats = map[string]string{
+	"png":      "png",
+	"jpg":      "jpeg",
+	"jpeg":     "jpeg",
+	"gif":      "gif",
+	"tif":      "tiff",
+	"tiff":     "tiff",
+	"bmp":      "bmp",
+	"ff":       "farbfeld",
+	"farbfeld": "farbfeld",
+}
+
+// outputFormat returns the canonical name of the format of image
+// output dst. Format mf wins if not empty. Otherwise, it is inferred
+// from the extension of dst, ignoring case, or png if there is none.
+// Unknown formats are an error.
+func outputFormat(dst, mf string) (string, error) {
+	name := mf
+	if name == "" {
+		name = strings.TrimPrefix(filepath.Ext(dst), ".")
+		if name == "" {
+			return "png", nil
+		}
+	}
+	if f, ok := outputFormats[strings.ToLower(name)]; ok {
+		return f, nil
+	}
+	if mf != "" {
+		return "", fmt.Errorf("unsupported output format %q; use one of png, jpg, gif, tiff, bmp or ff", mf)
+	}
+	return "", fmt.Errorf("%s: unsupported output format %q; use one of png, jpg, gif, tiff, bmp or ff extensions, or choose a format with -of", dst, name)
+}
+
+// checkOutputs exits if an image output has an unsupported format,
+// so that it is reported before images are compared.
+func checkOutputs() {
+	outs := [][2]string{{*output, *outputFmt}, {*sheetPath, ""}, {*deltaOut, ""}}
+	if strings.ToLower(filepath.Ext(*maskOut)) != ".rle" {
+		outs = append(outs, [2]string{*maskOut, ""})
+	}
+	for _, o := range outs {
+		if o[0] == "" || strings.HasPrefix(o[0], "term:") {
+			continue
+		}
+		if _, err := outputFormat(o[0], o[1]); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// flatten returns m composited over bg, for formats without alpha,
+// or m itself if it is opaque. Masks are returned as is: they are
+// encoded with marked pixels white and others black.
+func flatten(m image.Image, bg color.Color) image.Image {
+	if _, ok := m.(*image.Alpha); ok {
+		return m
+	}
+	if o, ok := m.(interface {
+		Opaque() bool
+	}); ok && o.Opaque() {
+		return m
+	}
+	r := m.Bounds()
+	dst := image.NewRGBA(r)
+	draw.Draw(dst, r, image.NewUniform(bg), image.ZP, draw.Src)
+	draw.Draw(dst, r, m, r.Min, draw.Over)
+	return dst
+}
+
+// hexColor is an opaque color flag value in rrggbb hex notation,
+// optionally prefixed with #.
+type hexColor color.NRGBA
+
+func (c *hexColor) String() string {
+	return hex.EncodeToString([]byte{c.R, c.G, c.B})
+}
+
+func (c *hexColor) Set(s string) error {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "#"))
+	if err != nil || len(b) != 3 {
+		return errors.New("want rrggbb hex color")
+	}
+	*c = hexColor{b[0], b[1], b[2], 0xff}
+	return nil
+}
+
+// writeTerm displays m inline in the terminal on stdout,
+// using protocol proto or the one detected from environment if empty.
+func writeTerm(proto string, m image.Image) {
+	p := termimg.Detect(os.Getenv)
+	if proto != "" {
+		var err error
+		if p, err = termimg.ParseProtocol(proto); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if p == termimg.None {
+		log.Print("terminal doesn't seem to support inline images; use -o term:iterm, term:kitty or term:sixel to force one")
+		return
+	}
+	if b := m.Bounds(); b.Dx() > *termWidth {
+		// downscale limits the larger side
+		max := *termWidth
+		if b.Dy() > b.Dx() {
+			max = b.Dy() * *termWidth / b.Dx()
+		}
+		m = downscale(m, max)
+	}
+	if err := termimg.Encode(os.Stdout, m, p); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeDelta writes the imgdiff.DeltaMap of a and b to dst.
+func writeDelta(dst string, a, b image.Image) {
+	m, err := imgdiff.DeltaMap(a, b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeImage(dst, "", m)
+}
+
+// writeMask writes a binary mask of the pixels marked in diff image m to dst.
+// The mask is RLE encoded if dst has .rle extension, otherwise it is written
+// as an image the same way writeImage does.
+func writeMask(dst string, m image.Image) {
+	mask := imgdiff.DiffMask(m)
+	if strings.ToLower(filepath.Ext(dst)) != ".rle" {
+		writeImage(dst, "", mask)
+		return
+	}
+	w, err := os.Create(dst)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := imgdiff.EncodeMaskRLE(mask, w); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// transparentDiff returns a diff image with transparent passing pixels
+// and failing ones in the left half.
+func transparentDiff() *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{0xff, 0, 0, 0xff})
+		}
+	}
+	return m
+}
+
+func TestWriteImageAlpha(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imgdiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(bg hexColor) { background = bg }(background)
+
+	// failing pixels must stay red, the others must look like the background
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	tests := []struct {
+		format string
+		bg     hexColor
+		pass   color.RGBA
+	}{
+		{"png", hexColor{0xff, 0xff, 0xff, 0xff}, color.RGBA{}},
+		{"tiff", hexColor{0xff, 0xff, 0xff, 0xff}, color.RGBA{}},
+		{"ff", hexColor{0xff, 0xff, 0xff, 0xff}, color.RGBA{}},
+		{"jpg", hexColor{0xff, 0xff, 0xff, 0xff}, white},
+		{"gif", hexColor{0xff, 0xff, 0xff, 0xff}, white},
+		{"bmp", hexColor{0xff, 0xff, 0xff, 0xff}, white},
+		{"bmp", hexColor{0, 0, 0xff, 0xff}, blue},
+		{"jpg", hexColor{0, 0, 0xff, 0xff}, blue},
+	}
+	for i, test := range tests {
+		background = test.bg
+		p := filepath.Join(dir, "diff."+test.format)
+		writeImage(p, "", transparentDiff())
+		m := readImage(p)
+		if m.Bounds() != image.Rect(0, 0, 16, 8) {
+			t.Errorf("(%d) %s: bounds = %v", i, test.format, m.Bounds())
+			continue
+		}
+		// away from the edge, where jpeg blurs colors
+		fail := color.RGBAModel.Convert(m.At(2, 4)).(color.RGBA)
+		if fail.R < 0xe0 || fail.G > 0x20 || fail.B > 0x20 || fail.A != 0xff {
+			t.Errorf("(%d) %s: failing pixel = %v; want red", i, test.format, fail)
+		}
+		pass := color.RGBAModel.Convert(m.At(13, 4)).(color.RGBA)
+		if !near(pass, test.pass) {
+			t.Errorf("(%d) %s: passing pixel = %v; want %v", i, test.format, pass, test.pass)
+		}
+	}
+
+	// masks keep marked pixels white and others black
+	background = hexColor{0xff, 0xff, 0xff, 0xff}
+	p := filepath.Join(dir, "mask.bmp")
+	writeImage(p, "", image.NewAlpha(image.Rect(0, 0, 4, 4)))
+	if c := color.RGBAModel.Convert(readImage(p).At(1, 1)); c != (color.RGBA{0, 0, 0, 0xff}) {
+		t.Errorf("mask: unmarked pixel = %v; want black", c)
+	}
+}
+
+// near reports whether channels of a and b differ by at most 16.
+func near(a, b color.RGBA) bool {
+	d := func(x, y uint8) bool {
+		return x-y <= 16 || y-x <= 16
+	}
+	return d(a.R, b.R) && d(a.G, b.G) && d(a.B, b.B) && d(a.A, b.A)
+}
+
+func TestHexColor(t *testing.T) {
+	tests := []struct {
+		in  string
+		out hexColor
+		ok  bool
+	}{
+		{"ffffff", hexColor{0xff, 0xff, 0xff, 0xff}, true},
+		{"#00ff80", hexColor{0, 0xff, 0x80, 0xff}, true},
+		{"102030", hexColor{0x10, 0x20, 0x30, 0xff}, true},
+		{"fff", hexColor{}, false},
+		{"gggggg", hexColor{}, false},
+		{"ffffffff", hexColor{}, false},
+	}
+	for i, test := range tests {
+		var c hexColor
+		err := c.Set(test.in)
+		if (err == nil) != test.ok || c != test.out {
+			t.Errorf("(%d) Set(%q) = %v, %v; want %v, ok = %v", i, test.in, c, err, test.out, test.ok)
+		}
+		if test.ok && c.String() != test.in[len(test.in)-6:] {
+			t.Errorf("(%d) String() = %q", i, c.String())
+		}
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	tests := []struct {
+		dst, of string
+		format  string
+	}{
+		{"-", "", "png"},
+		{"-", "jpg", "jpeg"},
+		{"-", "FF", "farbfeld"},
+		{"diff", "", "png"},
+		{"build.v2/diff", "", "png"},
+		{"diff.png", "", "png"},
+		{"diff.JPG", "", "jpeg"},
+		{"diff.Jpeg", "", "jpeg"},
+		{"diff.gif", "", "gif"},
+		{"diff.tif", "", "tiff"},
+		{"diff.TIFF", "", "tiff"},
+		{"diff.bmp", "", "bmp"},
+		{"diff.ff", "", "farbfeld"},
+		{"diff.farbfeld", "", "farbfeld"},
+		// -of wins
+		{"diff.png", "bmp", "bmp"},
+		{"diff.heic", "png", "png"},
+		{"diff", "tiff", "tiff"},
+		// errors
+		{"diff.heic", "", ""},
+		{"-", "heic", ""},
+		{"diff.png", "webp", ""},
+	}
+	for i, test := range tests {
+		f, err := outputFormat(test.dst, test.of)
+		if test.format == "" {
+			if err == nil {
+				t.Errorf("(%d) outputFormat(%q, %q) = %q; want an error", i, test.dst, test.of, f)
+			}
+			continue
+		}
+		if err != nil || f != test.format {
+			t.Errorf("(%d) outputFormat(%q, %q) = %q, %v; want %q", i, test.dst, test.of, f, err, test.format)
+		}
+	}
+}
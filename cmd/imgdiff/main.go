@@ -17,29 +17,175 @@ package main
 import (
 	"flag"
 	"fmt"
+	"image"
 	"log"
+	"math"
 	"os"
-	"runtime"
-	"strconv"
+	"path/filepath"
+	"strings"
 
 	"github.com/crhym3/imgdiff"
+	_ "github.com/crhym3/imgdiff/exr"
+	_ "github.com/crhym3/imgdiff/jxl"
 )
 
 const usageText = `Compare two images and optionally output resulting diff image.
-Supported image formats: png, jpeg, gif, tiff, bmp and webp.
+Supported image formats: png, jpeg, gif, tiff, bmp, webp, exr and farbfeld,
+as well as jxl when built with -tags jxl.
 
 Exit code will be non-zero if the difference is above specified threshold.
-Threshold value can also be a percentage, e.g. 0.5%.
+Threshold value can also be a percentage of all pixels, e.g. 0.5%,
+or both, e.g. 200,0.5%, in which case both limits must be exceeded.
+With a number of pixels only and no diff output, the binary and
+perceptual algorithms stop once it is exceeded, and the difference
+is reported as more than it, unless -report is always.
+The number of different pixels is only printed in this case, unless
+changed with -report always or -report never.
 
-Currently supported comparison algorithms are 'binary' and 'perceptual'.
-Binary algorithm simply compares the two images' pixels as is.
+$ALGORITHMS
+Binary algorithm simply compares the two images' pixels as is, or within
+-tol, e.g. -tol 3,3,3,0, or -fuzz, e.g. -fuzz 2%, a max color distance
+as with ImageMagick, drawing pixels which differ within them dim gray.
+With -linear, samples are decoded to linear light first, so that
+differences of dark colors weigh less, and -tol and -fuzz are linear too.
+With -gray, only lumas are compared, e.g. for scans with subsampled
+chroma, and different pixels are drawn as bright as their difference.
+SSIM counts pixels whose structural similarity of luminance within
+a window around them is below -ssim-threshold. MS-SSIM does the same
+with similarity combined over -msssim-scales scales.
+MSE counts pixels whose mean squared error is above -mse-threshold,
+and prints MSE and PSNR of the whole images to stderr. Delta E and
+CIEDE2000 count pixels whose CIE76 or CIEDE2000 color difference is
+above -de. Delta E is much faster than perceptual and less strict than
+binary. Pixelmatch compares YIQ colors of pixels and ignores differences
+due to anti-aliasing, drawing them yellow, unless -aa is set.
+PHash, AHash, DHash and Blockhash compare perceptual, average, difference
+and block hashes of images. With them, -t is the max number of hash bits
+which differ, 0 by default, or a percentage of all 64 bits, -phash-size
+squared for phash or -blockhash-bits for blockhash.
+Histogram compares color distributions of images, regardless of where
+colors are, with -hist-method chisq, correlation or bhattacharyya.
+The distance, from 0 to 1, is scaled by the number of pixels, so that
+e.g. -t 5% fails if it is above 0.05. The output image is a chart of
+differences of the red, green and blue histograms.
+Edge counts pixels which are edges, with Sobel gradient magnitude of
+luminance above -edge-threshold, in only one of the images, to detect
+layout changes. Removed edges are red and added ones green.
+GMSD counts pixels whose gradient magnitude similarity is below
+-gms-threshold, and prints the gradient magnitude similarity deviation
+of the whole images to stderr. It is much faster than perceptual.
+Multiple algorithms joined with +, e.g. -a binary+perceptual, are combined
+according to -composite-mode: pixels different according to all of them
+with 'and', according to any of them with 'or', or the largest or smallest
+count with 'max' and 'min'. Hash and histogram algorithms are combined
+by their counts only. Different pixels of the first, second and third
+algorithm are in the red, green and blue channels of the output image.
+To ignore noise such as differences of font hinting, images can be blurred
+before comparing them with any algorithm, e.g. -blur 1.5. Similarly,
+-normalize matches the mean and standard deviation of luminance of image2
+to those of image1, e.g. for screenshots of displays of different gamma,
+and prints the gain and offset of 8-bit luminance to stderr.
+PNG and JPEG images tagged with different ICC profiles, e.g. Display P3
+and sRGB, are converted to sRGB before comparing them, untagged images
+being sRGB already. Only RGB display profiles are supported; with
+-ignore-icc, images are compared as sRGB whatever their profiles.
+Binary and perceptual algorithms can tolerate content shifted by a few
+pixels, e.g. -shift 1, so that a pixel is only different if no pixel within
+that offset of it in the other image matches it.
+With -align, e.g. -align 8, the content of image2 is first aligned with
+image1, up to that many pixels in each direction, and only the overlapping
+parts of the images are compared. The detected offset is printed to stderr.
+Option -cvd, e.g. -cvd deuteranopia, makes the perceptual algorithm see
+colors as people with that color vision deficiency do, so that only
+differences they can tell apart are counted.
+Option -levels sets the depth of its pyramids, e.g. -levels 4 to compare
+small images faster, ignoring the coarsest details.
+Option -transfer srgb makes it decode samples with the sRGB transfer
+function, which is brighter near black than the -g gamma, e.g. for
+differences of dark colors in PNG images and screenshots.
+With -csf mannos, it weighs differences by spatial frequency with the
+contrast sensitivity function of Mannos and Sakrison rather than Barten,
+which makes it less sensitive to gradual changes of large areas and more
+to those of fine details such as text.
+With -debug-dir, e.g. -debug-dir /tmp/planes, it writes planes of values
+it computes for each pixel to PNG images of that directory: adaptation
+luminance, contrast, factor, luminance and chroma differences, threshold
+of the luminance difference, and reason, why pixels fail, gray if for
+luminance and white if for color. Planes are scaled from their min to
+max value, printed to stderr.
+Binary and perceptual algorithms compare alpha along with colors, so that
+e.g. colors of fully transparent pixels don't matter. With -alpha ignore,
+they compare colors as if all pixels were opaque, and with -alpha premultiply
+they compare how the images look composited over -bg, e.g. -bg '#000000',
+white by default.
+With -delta-colors, they draw different pixels in the absolute differences
+of their red, green and blue samples, and alpha 255 less that of alpha,
+so that e.g. rounding errors look almost black.
+With -style heatmap, they draw different pixels in colors of how much they
+differ, from dark purple to yellow, and equal pixels transparent, so that
+the diff image can be laid over either image. With -style overlay, they
+draw different pixels red over image1 at -dim brightness, 30% by default,
+e.g. for bug reports; -o-mask and -preview don't work with it.
+With -style sidebyside, -o is image1, image2 and the diff image side by
+side, or one above the other if they are wider than tall.
+With -grid, e.g. -grid 12x8, images are split into that many columns
+and rows of cells, compared independently, and the cells which changed
+are printed to stderr as (column,row), starting at (0,0) at the top left.
+In the diff image, the changed cells are tinted blue.
+With -detect-shift, when the images differ but the content of image2
+appears to be that of image1 shifted, e.g. a scrolled page, the offset
+is printed to stderr too.
+Floating point exr images are compared using a relative tolerance, see -eps.
 Default is perceptual. Change using -a option.
 
+With -find, image1 is searched for within image2, e.g. a button within
+a screenshot, and the area of image2 which matches it best is printed
+along with the number of pixels which differ there, according to -a.
+The exit code is non-zero if more than -find-tolerance, a fraction of
+pixels of image1, differ.
+
 Images can either be local file paths or URLs.
+If both arguments are directories, every image in the first directory
+is compared with the file at the same relative path in the second one.
 
 Output is usually a file path. Specify '-' to write to stdout instead.
-Resulting image format is inferred from the output file extension
-or -of argument otherwise. It defaults to png.
+Resulting image format is the -of argument if given, otherwise it is
+inferred from the output file extension, ignoring case, or png for outputs
+without one, such as '-'. Unknown extensions are an error.
+Use -of ff for lossless 16-bit farbfeld output.
+Formats without alpha, jpeg, gif and bmp, get transparent pixels
+composited over -background, white by default.
+Output 'term:' displays the diff inline in terminals supporting iTerm2,
+Kitty or Sixel graphics, detected from environment. A protocol can be
+forced with term:iterm, term:kitty or term:sixel.
+
+Option -preview prints where the differences are as text art, handy
+in plain CI logs. It is colored unless NO_COLOR is set or stdout
+is not a terminal.
+
+A binary mask of differing pixels can be written with -o-mask.
+Masks with .rle extension use a compact run-length encoding,
+documented in the imgdiff package.
+
+Option -o-delta writes the largest difference of the 16-bit samples
+of each pixel as a 16-bit grayscale image, which keeps differences
+of 16-bit images smaller than an 8-bit step; use a png or tiff file.
+
+Option -timings prints how long each phase of the comparison took,
+such as building the perceptual pyramids, to stderr.
+
+Option -progress shows how much of a comparison is done, as
+a percentage, while the binary and perceptual algorithms compare
+images, if stderr is a terminal. The line is erased once done.
+
+Option -v prints the smallest rectangle containing all different
+pixels, e.g. to crop screenshots of failures, and the similarity
+score, the fraction of pixels which don't differ, to stderr:
+
+  bounds: (20,10)-(25,14), score: 0.983333
+
+Images larger than 250 megapixels are refused, since comparing them
+may need tens of gigabytes of memory. Use -unlimited to compare them anyway.
 
 Examples:
   # compare two local PNG images using perceptual algorithm
@@ -52,32 +198,128 @@ Examples:
   # use binary comparison algorithm
   imgdiff -a binary -o bdiff.png image1.gif image2.gif
 
+  # show the diff right in the terminal
+  imgdiff -o term: image1.png image2.png
+
   # use threshold of 0.1%
   imgdiff -t 0.1% image1.tiff image2.tiff
+
+  # fail only if more than 200 pixels and more than 0.5% of them differ
+  imgdiff -t 200,0.5% image1.png image2.png
+
+  # fail only if both binary and perceptual algorithms find differences
+  imgdiff -a binary+perceptual image1.png image2.png
+
+  # check that a button is anywhere in a screenshot
+  imgdiff -find -a binary button.png screenshot.png
+
+  # tell which cells of a 12 x 8 grid of a page layout changed
+  imgdiff -a binary -grid 12x8 -o grid.png page1.png page2.png
+
+  # compare two directories and tile the failures into one image
+  imgdiff -contact-sheet sheet.png golden/ actual/
 `
 
+// shiftConfidence is the min confidence of DetectTranslation
+// for a failed comparison to report the images shifted.
+const shiftConfidence = 0.5
+
+// sideBySideGap is the spacing between images of -style sidebyside,
+// in pixels.
+const sideBySideGap = 4
+
 var (
 	version string // set by linker -X
 
 	// cmd line arguments
-	threshold = thresholdVar{value: 100}
+	threshold = imgdiff.Threshold{Pixels: 100, Percent: -1}
 	algorithm = flag.String("a", "perceptual", "diff algorithm")
 	output    = flag.String("o", "", "diff output")
 	outputFmt = flag.String("of", "", "output image format when -o -")
+	deltaOut  = flag.String("o-delta", "", "16-bit grayscale map of the largest sample difference of each pixel, e.g. delta.png")
+	termWidth = flag.Int("term-max-width", 800, "max width in pixels of -o term: output")
+	workers   = flag.Int("workers", 0, "max goroutines per comparison; 0 means all CPUs")
+	unlimited = flag.Bool("unlimited", false, "compare images larger than 250 megapixels")
+	timings   = flag.Bool("timings", false, "print wall times of comparison phases to stderr")
+	verbose   = flag.Bool("v", false, "print the bounding box of different pixels and the similarity score to stderr")
+	progress  = flag.Bool("progress", false, "print the percentage of the comparison done to stderr, if it is a terminal; binary and perceptual only")
+	blurSigma = flag.Float64("blur", 0, "blur images with a Gaussian of this sigma, in pixels, before comparing them")
+	normalize = flag.Bool("normalize", false, "match brightness and contrast of image2 to image1 before comparing them")
+	ignoreICC = flag.Bool("ignore-icc", false, "compare images as sRGB, ignoring their embedded ICC profiles")
+	shift     = flag.Int("shift", 0, "max offset in pixels of matching pixels; binary and perceptual only")
+	alphaMode = flag.String("alpha", "compare", "treatment of alpha: compare, ignore or premultiply over -bg; binary and perceptual only")
+	deltas    = flag.Bool("delta-colors", false, "draw different pixels in colors of their differences rather than red; binary and perceptual only")
+	style     = flag.String("style", "mark", "diff image style: mark, different pixels red over black, heatmap or overlay, binary and perceptual only, or sidebyside with both images")
+	dim       = flag.Float64("dim", 0.3, "brightness of image1 under different pixels of -style overlay, 0 to 1")
+	align     = flag.Int("align", 0, "align images, up to this offset in pixels, before comparing them")
+	find      = flag.Bool("find", false, "find image1 within image2, see -find-tolerance")
+	findTol   = flag.Float64("find-tolerance", 0, "max fraction of different pixels of a match of -find, e.g. 0.01")
+	gridSize  = flag.String("grid", "", "compare images cell by cell in a grid of this many columns x rows, e.g. 12x8")
+	report    = flag.String("report", "fail", "when to print the number of different pixels: always, fail or never")
+	// off by default, as it reads both images once more
+	detectShift = flag.Bool("detect-shift", false, "print the offset of the content of image2 if the images differ and appear shifted")
+	// -background of output formats without alpha
+	background = hexColor{0xff, 0xff, 0xff, 0xff}
+	// -bg images are composited over with -alpha premultiply
+	compareBg = hexColor{0xff, 0xff, 0xff, 0xff}
+	// text preview args
+	preview      = flag.Bool("preview", false, "print a text preview of the differences to stdout")
+	previewWidth = flag.Int("preview-width", 80, "width in columns of -preview output")
+	// binary args
+	epsilon = flag.Float64("eps", 0, "relative tolerance for floating point images; binary only")
+	tol     = flag.String("tol", "", "max differences of 8-bit r,g,b,a samples of passing pixels, e.g. 3,3,3,0; binary only")
+	fuzz    = flag.String("fuzz", "", "max color distance of passing pixels as a percentage, e.g. 2%, as ImageMagick's -fuzz; binary only")
+	linear  = flag.Bool("linear", false, "compare sRGB-decoded linear samples, with -tol and -fuzz in linear units; binary only")
+	luma    = flag.Bool("gray", false, "compare Rec. 709 lumas only, within the largest r,g,b -tol; binary only")
+	maskOut = flag.String("o-mask", "", "binary diff mask output; RLE encoded if the file has .rle extension")
 	// perceptual args
-	gamma   = flag.Float64("g", 2.2, "gamma adjustment; perceptual only")
-	lum     = flag.Float64("lum", 100.0, "luminance factor; perceptual only")
-	fov     = flag.Float64("fov", 45.0, "field of view; perceptual only")
-	cf      = flag.Float64("cf", 1.0, "color factor; perceptual only")
-	nocolor = flag.Bool("nocolor", false, "don't use color during comparison; perceptual only")
+	gamma    = flag.Float64("g", 2.2, "gamma adjustment; perceptual only")
+	lum      = flag.Float64("lum", 100.0, "luminance factor; perceptual only")
+	fov      = flag.Float64("fov", 45.0, "field of view; perceptual only")
+	cf       = flag.Float64("cf", 1.0, "color factor; perceptual only")
+	nocolor  = flag.Bool("nocolor", false, "don't use color during comparison; perceptual only")
+	cvd      = flag.String("cvd", "normal", "see colors as with normal, protanopia, deuteranopia or tritanopia vision; perceptual only")
+	levels   = flag.Int("levels", 8, "number of pyramid levels, 2 to 16; perceptual only")
+	transfer = flag.String("transfer", "gamma", "decode samples with the -g gamma, or with the sRGB transfer function if srgb; perceptual only")
+	csfModel = flag.String("csf", "barten", "contrast sensitivity function: barten or mannos, for Mannos-Sakrison; perceptual only")
+	debugDir = flag.String("debug-dir", "", "directory to write intermediate planes to, as PNG images; perceptual only")
+	// ssim args
+	ssimWindow    = flag.Int("ssim-window", 8, "width and height of the window around each pixel; ssim only")
+	ssimThreshold = flag.Float64("ssim-threshold", imgdiff.DefaultSSIMThreshold, "min similarity of passing pixels, up to 1; ssim and msssim only")
+	msssimScales  = flag.Int("msssim-scales", 5, "number of scales, 1 to 5; msssim only")
+	// mse args
+	mseThreshold = flag.Float64("mse-threshold", 0, "max squared error of passing pixels, from 0 to 1; mse only")
+	// pixelmatch args
+	pmThreshold = flag.Float64("pixelmatch-threshold", imgdiff.DefaultPixelmatchThreshold, "color distance threshold, from 0 to 1; pixelmatch only")
+	includeAA   = flag.Bool("aa", false, "count anti-aliased pixels as different; pixelmatch only")
+	// phash args
+	phashSize     = flag.Int("phash-size", 8, "width and height of the hash in bits, 1 to 8; phash only")
+	blockhashBits = flag.Int("blockhash-bits", 256, "hash size in bits: 64, 144 or 256; blockhash only")
+	// histogram args
+	histMethod = flag.String("hist-method", "chisq", "histogram distance: chisq, correlation or bhattacharyya; histogram only")
+	histBins   = flag.Int("hist-bins", 64, "number of bins of each color component, 1 to 65536; histogram only")
+	// edge args
+	edgeThreshold = flag.Float64("edge-threshold", 0.5, "min gradient magnitude of edges, up to 5.66; edge only")
+	// composite args
+	compositeMode = flag.String("composite-mode", "and", "how to combine results of -a a+b: and, or, max or min")
+	// gmsd args
+	gmsThreshold = flag.Float64("gms-threshold", imgdiff.DefaultGMSThreshold, "min similarity of passing pixels, up to 1; gmsd only")
+	// deltae and ciede2000 args
+	deltaE = flag.Float64("de", 2.3, "max color difference of passing pixels; deltae and ciede2000 only")
+	// batch args
+	sheetPath = flag.String("contact-sheet", "", "write failing pairs' diffs tiled into this image")
+	sheetAll  = flag.Bool("contact-sheet-all", false, "include passing pairs in the contact sheet")
+	sheetCols = flag.Int("contact-sheet-cols", 4, "number of contact sheet columns")
+	sheetSize = flag.Int("contact-sheet-tile", 256, "max contact sheet tile width and height")
 )
 
 func init() {
-	flag.Var(&threshold, "t", "threshold value")
+	flag.Var(&threshold, "t", "max different pixels: N, P% or both as N,P%")
+	flag.Var(&background, "background", "rrggbb color transparent pixels are composited over in formats without alpha")
+	flag.Var(&compareBg, "bg", "rrggbb color images are composited over with -alpha premultiply")
 }
 
 func main() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
 	log.SetFlags(0)
 	flag.Usage = usage
 	run()
@@ -92,69 +334,313 @@ func run() {
 	if flag.NArg() != 2 {
 		log.Fatal("invalid number of positional arguments")
 	}
+	switch *report {
+	case "always", "fail", "never":
+	default:
+		log.Fatalf("invalid -report value: %s", *report)
+	}
+	checkOutputs()
+	if *style == "overlay" && (*maskOut != "" || *preview) {
+		log.Fatal("-o-mask and -preview don't work with -style overlay")
+	}
+	if hashBits() > 0 && !isFlagSet("t") {
+		threshold = imgdiff.Threshold{Pixels: 0, Percent: -1}
+	}
 
-	img1 := readImage(flag.Arg(0))
-	img2 := readImage(flag.Arg(1))
-	res, n, err := newDiffer().Compare(img1, img2)
-	if err != nil {
+	if *find {
+		runFind(flag.Arg(0), flag.Arg(1))
+		return
+	}
+	if isDir(flag.Arg(0)) && isDir(flag.Arg(1)) {
+		runDir(flag.Arg(0), flag.Arg(1))
+		return
+	}
+
+	img1, img2 := readImages(flag.Arg(0), flag.Arg(1))
+	res, n, err := compare(newDiffer(), img1, img2, "")
+	truncated := err == imgdiff.ErrMaxDiff
+	if err != nil && !truncated {
 		log.Fatal(err)
 	}
-	np := float64(n) / float64(res.Bounds().Dx()*res.Bounds().Dy())
-	if threshold.percent && !(np > threshold.value) || !(float64(n) > threshold.value) {
+	total := img1.Bounds().Dx() * img1.Bounds().Dy()
+	failed := truncated || exceeded(n, total)
+	if *sheetPath != "" && (failed || *sheetAll) {
+		sheet := newContactSheet(*sheetCols, *sheetSize)
+		sheet.add(res, sheetCaption(filepath.Base(flag.Arg(1)), n, res))
+		writeImage(*sheetPath, "", sheet.render())
+	}
+	if reported(failed) {
+		fmt.Println(difference(n, total, truncated))
+	}
+	if !failed {
 		return
 	}
-	fmt.Printf("difference: %d pixel(s), %f%%\n", n, np)
 	defer os.Exit(1)
+	if *detectShift {
+		if dx, dy, c := imgdiff.DetectTranslation(img1, img2); c >= shiftConfidence && (dx != 0 || dy != 0) {
+			fmt.Fprintf(os.Stderr, "images appear shifted by (%d, %d)\n", dx, dy)
+		}
+	}
+	if *preview {
+		printPreview(res)
+	}
+	if *maskOut != "" {
+		writeMask(*maskOut, res)
+	}
+	if *deltaOut != "" {
+		writeDelta(*deltaOut, img1, img2)
+	}
 	if *output == "" {
 		return
 	}
+	if *style == "sidebyside" {
+		res = imgdiff.RenderSideBySide(img1, img2, res, sideBySideGap, true)
+	}
 	writeImage(*output, *outputFmt, res)
 }
 
-func usage() {
-	fmt.Fprintf(os.Stderr, "%s\nUsage: imgdiff [options] image1 image2\n", usageText)
-	flag.PrintDefaults()
+// runFind locates the needle image within haystack, printing the area
+// it is found in, and exits with 1 if it is not found.
+func runFind(needle, haystack string) {
+	m := readImage(needle)
+	r, n, err := imgdiff.FindSubimage(readImage(haystack), m, newDiffer(), *findTol)
+	switch {
+	case err == imgdiff.ErrNotFound && n < 0:
+		log.Fatalf("%s is larger than %s", needle, haystack)
+	case err == imgdiff.ErrNotFound:
+		fmt.Printf("not found, closest at %v, %s\n", r, difference(n, r.Dx()*r.Dy(), false))
+		os.Exit(1)
+	case err != nil:
+		log.Fatal(err)
+	}
+	fmt.Printf("found at %v, %s\n", r, difference(n, r.Dx()*r.Dy(), false))
 }
 
-func newDiffer() imgdiff.Differ {
+// exceeded reports whether n, the result of comparing images of total
+// pixels, is above -t. For hash algorithms, n is the distance of the
+// hashes, and percentages are of their bits.
+func exceeded(n, total int) bool {
+	if b := hashBits(); b > 0 {
+		return threshold.Exceeded(n, b)
+	}
+	return threshold.Exceeded(n, total)
+}
+
+// difference describes n, the result of comparing images of total pixels,
+// or the maxDiff it exceeded if comparison stopped there.
+func difference(n, total int, truncated bool) string {
+	switch {
+	case hashBits() > 0:
+		return fmt.Sprintf("hash distance: %d", n)
+	case truncated:
+		return fmt.Sprintf("difference: more than %d pixel(s)", maxDiff())
+	}
+	return fmt.Sprintf("difference: %d pixel(s), %f%%", n, percentage(n, total))
+}
+
+// maxDiff returns the number of different pixels above which -a may stop
+// comparing, see imgdiff.WithMaxDiff, or -1 if it compares all of them:
+// if -t has a percentage, which depends on image size, the number is
+// always reported, or the difference image or values other options,
+// such as -find, compute from all pixels are used.
+func maxDiff() int {
+	if threshold.Percent >= 0 || !(threshold.Pixels >= 0 && threshold.Pixels < math.MaxInt32) || *report == "always" {
+		return -1
+	}
+	if *find || diffNeeded() || *timings || *verbose || *normalize || *align > 0 || *gridSize != "" || *debugDir != "" || strings.Contains(*algorithm, "+") {
+		return -1
+	}
+	return int(threshold.Pixels)
+}
+
+// hashBits returns the number of bits of hashes compared by -a,
+// or 0 if it doesn't compare hashes.
+func hashBits() int {
 	switch *algorithm {
-	case "binary":
-		return imgdiff.NewBinary()
-	case "perceptual":
-		return imgdiff.NewPerceptual(*gamma, *lum, *fov, *cf, *nocolor)
+	case "phash":
+		return *phashSize * *phashSize
+	case "ahash", "dhash":
+		return 64
+	case "blockhash":
+		return *blockhashBits
 	}
-	log.Fatalf("unsupported diff algorithm: %s", *algorithm)
-	return nil
+	return 0
 }
 
-type thresholdVar struct {
-	value   float64
-	percent bool
+// isFlagSet reports whether flag name is given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
-func (v *thresholdVar) String() string {
-	unit := ""
-	if v.percent {
-		unit = "%"
+// reported reports whether the number of different pixels
+// of a comparison is printed, see -report.
+func reported(failed bool) bool {
+	switch *report {
+	case "always":
+		return true
+	case "never":
+		return false
 	}
-	return fmt.Sprintf("%g%s", v.value, unit)
+	return failed
 }
 
-func (v *thresholdVar) Set(t string) error {
-	if len(t) == 0 {
-		v.value = 0
-		return nil
+// percentage returns n as a percentage of total pixels compared.
+func percentage(n, total int) float64 {
+	if total == 0 {
+		return 0
 	}
-	percent := false
-	if t[len(t)-1] == '%' {
-		percent = true
-		t = t[:len(t)-1]
+	return 100 * float64(n) / float64(total)
+}
+
+// compare compares a and b with d. If -timings is set, it prints wall
+// times of the comparison phases and throughput to stderr, and with -v
+// the bounding box of different pixels and the score, after label.
+// MSE and PSNR, GMSD, the gain and offset of -normalize, the offset
+// found by -align, or the changed cells of -grid are printed to stderr
+// as well, if d computes them. Otherwise, if the difference image isn't
+// used, see diffNeeded, pixels are only counted and it returns nil.
+func compare(d imgdiff.Differ, a, b image.Image, label string) (image.Image, int, error) {
+	defer clearProgress()
+	if !*timings && !*verbose && !*normalize && *align <= 0 && *gridSize == "" && *algorithm != "mse" && *algorithm != "gmsd" {
+		if !diffNeeded() {
+			n, err := imgdiff.CompareCount(d, a, b)
+			return nil, n, err
+		}
+		return d.Compare(a, b)
 	}
-	val, err := strconv.ParseFloat(t, 64)
+	res, err := imgdiff.CompareResult(d, a, b)
 	if err != nil {
-		return err
+		return nil, -1, err
+	}
+	if s := res.Stats; s != nil {
+		switch {
+		case *gridSize != "":
+			// stats of -a would be those of single cells, and aren't set
+		case *algorithm == "mse":
+			fmt.Fprintf(os.Stderr, "mse: %g, psnr: %.2f dB\n", s.MSE, s.PSNR)
+		case *algorithm == "gmsd":
+			fmt.Fprintf(os.Stderr, "gmsd: %g\n", s.GMSD)
+		}
+		if *normalize {
+			fmt.Fprintf(os.Stderr, "gain: %.3f, offset: %.2f\n", s.Gain, s.Offset)
+		}
+		if *align > 0 {
+			fmt.Fprintf(os.Stderr, "align: %d, %d\n", s.Shift.X, s.Shift.Y)
+		}
+		if len(s.Cells) > 0 {
+			fmt.Fprintln(os.Stderr, changedCells(s.Cells))
+		}
+	}
+	if *timings {
+		r := res.Diff.Bounds()
+		fmt.Fprintf(os.Stderr, "%stimings: %v, %.1f megapixels/s\n", label, res.Timings, res.Timings.PixelsPerSecond(r.Dx(), r.Dy())/1e6)
+	}
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "%sbounds: %v, score: %f\n", label, res.DiffBounds, res.Score)
+	}
+	return res.Diff, res.N, nil
+}
+
+// progressPercent is the percentage done last printed by printProgress,
+// or -1 if its line was erased.
+var progressPercent = -1
+
+// printProgress returns the imgdiff.WithProgress callback of -progress,
+// printing the percentage done to stderr whenever it changes, on a line
+// which clearProgress erases.
+func printProgress() func(done, total int) {
+	return func(done, total int) {
+		p := 100
+		if total > 0 {
+			p = 100 * done / total
+		}
+		if p != progressPercent {
+			progressPercent = p
+			fmt.Fprintf(os.Stderr, "\rcomparing: %d%%", p)
+		}
+	}
+}
+
+// clearProgress erases the line of printProgress, if any.
+func clearProgress() {
+	if progressPercent >= 0 {
+		fmt.Fprint(os.Stderr, "\r\x1b[K")
+		progressPercent = -1
+	}
+}
+
+// diffNeeded reports whether the difference image is written or shown,
+// with -o, -o-mask, -preview or -contact-sheet.
+func diffNeeded() bool {
+	return *output != "" || *maskOut != "" || *preview || *sheetPath != ""
+}
+
+func usage() {
+	text := strings.Replace(usageText, "$ALGORITHMS", algorithmList(), 1)
+	fmt.Fprintf(os.Stderr, "%s\nUsage: imgdiff [options] image1 image2\n", text)
+	flag.PrintDefaults()
+}
+
+func newDiffer() imgdiff.Differ {
+	d := newComposite()
+	if *blurSigma > 0 {
+		d = imgdiff.NewBlurred(d, *blurSigma)
+	}
+	if *normalize {
+		d = imgdiff.NewNormalized(d)
+	}
+	if *align > 0 {
+		d = imgdiff.NewAligned(d, *align)
+	}
+	if *gridSize != "" {
+		var cols, rows int
+		if _, err := fmt.Sscanf(*gridSize, "%dx%d", &cols, &rows); err != nil || cols < 1 || rows < 1 {
+			log.Fatalf("invalid -grid value: %s", *gridSize)
+		}
+		d = imgdiff.NewGrid(d, cols, rows)
+	}
+	return d
+}
+
+// changedCells returns a line listing cells of -grid,
+// e.g. "cells (3,2) and (3,3) changed".
+func changedCells(cells []imgdiff.GridCell) string {
+	if len(cells) == 1 {
+		return fmt.Sprintf("cell (%d,%d) changed", cells[0].Col, cells[0].Row)
+	}
+	list := make([]string, len(cells))
+	for i, c := range cells {
+		list[i] = fmt.Sprintf("(%d,%d)", c.Col, c.Row)
+	}
+	last := len(list) - 1
+	return fmt.Sprintf("cells %s and %s changed", strings.Join(list[:last], ", "), list[last])
+}
+
+// newComposite returns the Differ of -a, combining multiple
+// algorithms if given.
+func newComposite() imgdiff.Differ {
+	names := strings.Split(*algorithm, "+")
+	if len(names) == 1 {
+		return newAlgorithm(*algorithm)
+	}
+	var mode imgdiff.CompositeMode
+	for mode = imgdiff.CompositeAnd; mode <= imgdiff.CompositeMin; mode++ {
+		if mode.String() == *compositeMode {
+			break
+		}
+	}
+	if mode > imgdiff.CompositeMin {
+		log.Fatalf("unsupported composite mode: %s", *compositeMode)
+	}
+	differs := make([]imgdiff.Differ, len(names))
+	for i, name := range names {
+		differs[i] = newAlgorithm(name)
 	}
-	v.percent = percent
-	v.value = val
-	return nil
+	return imgdiff.NewComposite(mode, differs...)
 }
@@ -15,14 +15,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"image/png"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -51,11 +56,59 @@ func TestExitCode(t *testing.T) {
 	tests := []struct {
 		opts string
 		exit int
+		// whether the difference line is printed
+		stats bool
 	}{
-		{"-t 0 -a perceptual", 1},
-		{"-t 0 -a binary", 1},
-		{"-t 1 -a perceptual", 0},
-		{"-t 1 -a binary", 0},
+		{"-t 0 -a perceptual", 1, true},
+		{"-t 0 -a binary", 1, true},
+		{"-t 1 -a perceptual", 0, false},
+		{"-t 1 -a binary", 0, false},
+		{"-t 1 -a binary -report always", 0, true},
+		{"-t 0 -a binary -report always", 1, true},
+		{"-t 1 -a binary -report fail", 0, false},
+		{"-t 0 -a binary -report fail", 1, true},
+		{"-t 1 -a binary -report never", 0, false},
+		{"-t 0 -a binary -report never", 1, false},
+		// -t is the max hash distance
+		{"-t 64 -a phash", 0, false},
+		{"-t 100% -a ahash", 0, false},
+		{"-t 64 -a dhash -report always", 0, false},
+		{"-t 256 -a blockhash", 0, false},
+		{"-t 0 -a histogram -hist-method bhattacharyya -report never", 1, false},
+		{"-t 1% -a histogram -hist-method correlation", 0, false},
+		{"-t 100% -a gmsd", 0, false},
+		{"-t 0 -a binary+perceptual", 1, true},
+		{"-t 1 -a binary+perceptual -composite-mode or", 0, false},
+		{"-t 0 -a binary -blur 1.5 -report never", 1, false},
+		// the white pixel is within -tol of transparent black
+		// only in all channels
+		{"-t 0 -a binary -tol 255,255,255,255", 0, false},
+		{"-t 0 -a binary -tol 255,255,255,254", 1, true},
+		{"-t 0 -a binary -tol 254,255,255,255", 1, true},
+		// premultiplied, they are sqrt(2) times the max fuzz apart
+		{"-t 0 -a binary -fuzz 142%", 0, false},
+		{"-t 0 -a binary -fuzz 141%", 1, true},
+		{"-t 0 -a binary -fuzz 0%", 1, true},
+		// white stays white in linear light
+		{"-t 0 -a binary -linear", 1, true},
+		{"-t 0 -a binary -linear -tol 254,254,254,255", 1, true},
+		// the luma of white differs by 255
+		{"-t 0 -a binary -gray -tol 254,0,0,0", 1, true},
+		{"-t 0 -a binary -gray -tol 0,255,0,0", 0, false},
+		// transparent black looks white over the default -bg
+		{"-t 0 -a binary -alpha premultiply", 0, false},
+		{"-t 0 -a perceptual -alpha premultiply -bg #ffffff", 0, false},
+		{"-t 0 -a binary -alpha premultiply -bg 000000", 1, true},
+		{"-t 0 -a binary -alpha ignore", 1, true},
+		{"-t 0 -a perceptual -alpha ignore", 1, true},
+		{"-t 0 -a perceptual -levels 2", 1, true},
+		{"-t 1 -a perceptual -levels 16", 0, false},
+		{"-t 0 -a perceptual -transfer srgb", 1, true},
+		{"-t 0 -a perceptual -csf mannos", 1, true},
+		{"-t 0 -a binary -style overlay -dim 0.5", 1, true},
+		{"-t 0 -a perceptual -style heatmap", 1, true},
+		{"-t 0 -a binary -style overlay -preview", 1, false},
+		{"-t 0 -a binary -style sketch", 1, false},
 	}
 	for i, test := range tests {
 		args := append([]string{"-test.run=TestExitCode"}, strings.Split(test.opts, " ")...)
@@ -68,6 +121,12 @@ func TestExitCode(t *testing.T) {
 			t.Errorf("%d: %v", i, err)
 			continue
 		}
+		// -t 0 stops at the different pixel, unless it is always reported
+		stats := strings.Contains(string(out), "difference: 1 pixel(s), 0.010000%") ||
+			strings.Contains(string(out), "difference: more than 0 pixel(s)")
+		if stats != test.stats {
+			t.Errorf("%d: difference printed = %v; want %v\n%s", i, stats, test.stats, out)
+		}
 		if test.exit == 0 && e == nil || test.exit != 0 && e != nil && !e.Success() {
 			continue
 		}
@@ -76,6 +135,89 @@ func TestExitCode(t *testing.T) {
 	}
 }
 
+func TestThresholdFlag(t *testing.T) {
+	if s := threshold.String(); s != "100" {
+		t.Errorf("default -t = %q; want 100", s)
+	}
+	if p := percentage(5, 1000); p != 0.5 {
+		t.Errorf("percentage(5, 1000) = %v; want 0.5", p)
+	}
+	if p := percentage(0, 0); p != 0 {
+		t.Errorf("percentage(0, 0) = %v; want 0", p)
+	}
+}
+
+func TestInvalidPerceptual(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	for _, test := range []struct {
+		flag, value, want string
+	}{
+		{"-lum", "0", "luminance must be > 0"},
+		{"-fov", "0", "field of view must be > 0"},
+		{"-g", "-1", "gamma must be > 0"},
+	} {
+		args := []string{"-test.run=TestInvalidPerceptual", test.flag, test.value, "../../testdata/fish1.png", "../../testdata/fish2.png"}
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Env = append(os.Environ(), "RUNME=1")
+		b, err := cmd.CombinedOutput()
+		if err == nil || !strings.Contains(string(b), test.want) || strings.Contains(string(b), "difference") {
+			t.Errorf("%s %s: %v\n%s", test.flag, test.value, err, b)
+		}
+	}
+}
+
+func TestMaxDiff(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	m := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	img1, err := writeTempImage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	draw.Draw(m, image.Rect(0, 0, 100, 50), image.White, image.Point{}, draw.Src)
+	img2, err := writeTempImage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "diff.png")
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	exact := "difference: 5000 pixel(s), 50.000000%\n"
+	tests := []struct {
+		opts string
+		want string
+	}{
+		{"-t 10 -a binary", "difference: more than 10 pixel(s)\n"},
+		{"-t 10 -a perceptual", "difference: more than 10 pixel(s)\n"},
+		{"-t 10 -a binary -report always", exact},
+		{"-t 10,1% -a binary", exact},
+		{"-t 10 -a binary -o " + out, exact},
+		{"-t 10 -a binary+perceptual", exact},
+	}
+	for _, test := range tests {
+		args := append([]string{"-test.run=TestMaxDiff"}, strings.Split(test.opts, " ")...)
+		cmd := exec.Command(os.Args[0], append(args, img1, img2)...)
+		cmd.Env = append(os.Environ(), "RUNME=1")
+		stdout, err := cmd.Output()
+		if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 1 {
+			t.Errorf("%s: err = %v; want exit code 1", test.opts, err)
+		}
+		if string(stdout) != test.want {
+			t.Errorf("%s: stdout = %q; want %q", test.opts, stdout, test.want)
+		}
+	}
+}
+
 func TestOpenURL(t *testing.T) {
 	if os.Getenv("RUNME") == "1" {
 		run()
@@ -110,14 +252,921 @@ func TestOpenURL(t *testing.T) {
 	}
 }
 
-func writeTempImage(m image.Image) (string, error) {
-	f, err := ioutil.TempFile("", "img")
+func TestOpenURLJXL(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jxl")
+		w.Write([]byte("\xff\x0a\x00"))
+	}))
+	defer ts.Close()
+
+	args := []string{"-test.run=TestOpenURLJXL", ts.URL, ts.URL}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RUNME=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatal("invalid JPEG XL image was decoded")
+	}
+	if !strings.Contains(string(out), "jxl:") {
+		t.Errorf("output doesn't mention jxl decoder:\n%s", out)
+	}
+}
+
+func TestDirContactSheet(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	dir1, err := ioutil.TempDir("", "imgdiff")
 	if err != nil {
-		return "", err
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir1)
+	dir2, err := ioutil.TempDir("", "imgdiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir2)
+
+	m := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for _, name := range []string{"same.png", "diff.png"} {
+		if err := writeImageFile(filepath.Join(dir1, name), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeImageFile(filepath.Join(dir2, "same.png"), m); err != nil {
+		t.Fatal(err)
+	}
+	m.Set(0, 0, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	if err := writeImageFile(filepath.Join(dir2, "diff.png"), m); err != nil {
+		t.Fatal(err)
+	}
+	// a corrupt file fails its pair only
+	if err := writeImageFile(filepath.Join(dir1, "corrupt.png"), m); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir2, "corrupt.png"), []byte("not a png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sheet := filepath.Join(dir1, "sheet.png")
+	args := []string{"-test.run=TestDirContactSheet", "-a", "binary", "-t", "0", "-contact-sheet", sheet, dir1, dir2}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RUNME=1")
+	out, err := cmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Errorf("err = %v; want exit error", err)
+	}
+	if !strings.Contains(string(out), "diff.png: difference") || !strings.Contains(string(out), "corrupt.png: ") || strings.Contains(string(out), "same.png") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	f, err := os.Open(sheet)
+	if err != nil {
+		t.Fatal(err)
 	}
 	defer f.Close()
-	if err := png.Encode(f, m); err != nil {
-		return "", err
+	if _, err := png.Decode(f); err != nil {
+		t.Errorf("contact sheet: %v", err)
+	}
+}
+
+func TestTermOutput(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	m := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	img1, err := writeTempImage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Set(0, 0, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	img2, err := writeTempImage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	// clean environment, so that no terminal is detected
+	env := []string{"RUNME=1", "TERM=dumb"}
+	args := []string{"-test.run=TestTermOutput", "-a", "binary", "-t", "0", "-o", "term:", img1, img2}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = env
+	out, _ := cmd.CombinedOutput()
+	if !strings.Contains(string(out), "doesn't seem to support inline images") {
+		t.Errorf("term: unexpected output:\n%q", out)
+	}
+
+	args = []string{"-test.run=TestTermOutput", "-a", "binary", "-o", "term:kitty", "-term-max-width", "10", "-t", "0", img1, img2}
+	cmd = exec.Command(os.Args[0], args...)
+	cmd.Env = env
+	out, _ = cmd.Output()
+	s := strings.TrimSuffix(string(out), "\x1b\\\n")
+	const prefix = "\x1b_Ga=T,f=100,m=0;"
+	i := strings.Index(s, prefix)
+	if i < 0 {
+		t.Fatalf("term:kitty: unexpected output:\n%q", out)
+	}
+	data, err := base64.StdEncoding.DecodeString(s[i+len(prefix):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 10 || cfg.Height != 5 {
+		t.Errorf("term:kitty: image size = %dx%d; want 10x5", cfg.Width, cfg.Height)
+	}
+}
+
+func TestTimings(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	m := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	img1, err := writeTempImage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Set(0, 0, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	img2, err := writeTempImage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	args := []string{"-test.run=TestTimings", "-timings", img1, img2}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RUNME=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v\n%s", err, stderr.Bytes())
+	}
+	out := stderr.String()
+	for _, s := range []string{"timings: convert ", ", pyramid ", ", compare ", ", bounds ", ", total ", " megapixels/s\n"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("no %q in output:\n%s", s, out)
+		}
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	m := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	img1, err := writeTempImage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 20; x < 30; x++ {
+		m.Set(x, 7, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	}
+	img2, err := writeTempImage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	args := []string{"-test.run=TestVerbose", "-a", "binary", "-t", "0", "-v", img1, img2}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RUNME=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil {
+		t.Errorf("exit code 0; want 1")
+	}
+	if out, want := stderr.String(), "bounds: (20,7)-(30,8), score: 0.998000\n"; out != want {
+		t.Errorf("stderr %q; want %q", out, want)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	// stderr is not a terminal
+	args := []string{"-test.run=TestProgress", "-progress", "../../testdata/fish1.png", "../../testdata/fish1.png"}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RUNME=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil || stderr.Len() > 0 {
+		t.Errorf("%v, stderr %q; want no progress", err, stderr.Bytes())
+	}
+
+	f, err := ioutil.TempFile("", "imgdiff-progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	stderrFile := os.Stderr
+	os.Stderr = f
+	report := printProgress()
+	for _, done := range []int{1, 2, 50, 100, 200} {
+		report(done, 200)
+	}
+	clearProgress()
+	clearProgress()
+	os.Stderr = stderrFile
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\rcomparing: 0%\rcomparing: 1%\rcomparing: 25%\rcomparing: 50%\rcomparing: 100%\r\x1b[K"; string(b) != want {
+		t.Errorf("output %q; want %q", b, want)
+	}
+}
+
+func TestMSE(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	m := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	img1, err := writeTempImage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Set(0, 0, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	img2, err := writeTempImage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	args := []string{"-test.run=TestMSE", "-a", "mse", "-report", "always", img1, img2}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RUNME=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v\n%s", err, stderr.Bytes())
+	}
+	// all samples of 1 of 5000 transparent pixels differ by 1
+	if out, want := stderr.String(), "mse: 0.0002, psnr: 36.99 dB\n"; out != want {
+		t.Errorf("stderr = %q; want %q", out, want)
+	}
+	if out := stdout.String(); !strings.HasPrefix(out, "difference: 1 pixel(s)") {
+		t.Errorf("stdout = %q; want 1 pixel", out)
+	}
+}
+
+func TestGMSD(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	m := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	img1, err := writeTempImage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Set(0, 0, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	img2, err := writeTempImage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	args := []string{"-test.run=TestGMSD", "-a", "gmsd", "-t", "100%", img1, img2}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RUNME=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v\n%s", err, stderr.Bytes())
+	}
+	var gmsd float64
+	if _, err := fmt.Sscanf(stderr.String(), "gmsd: %g\n", &gmsd); err != nil || gmsd <= 0 {
+		t.Errorf("stderr = %q; want gmsd > 0", stderr.String())
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	// the same ramp of lower contrast and higher brightness
+	r := image.Rect(0, 0, 100, 10)
+	m1, m2 := image.NewGray(r), image.NewGray(r)
+	for i := range m1.Pix {
+		x := i % r.Dx()
+		m1.Pix[i] = uint8(10 + 2*x)
+		m2.Pix[i] = uint8(60 + x)
+	}
+	img1, err := writeTempImage(m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img2, err := writeTempImage(m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	args := []string{"-test.run=TestNormalize", "-a", "deltae", "-t", "0", "-normalize", img1, img2}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RUNME=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v\n%s", err, stderr.Bytes())
+	}
+	if out, want := stderr.String(), "gain: 2.000, offset: -110.00\n"; out != want {
+		t.Errorf("stderr = %q; want %q", out, want)
+	}
+}
+
+func TestShift(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	// stripes moved right by 1 pixel, with edge columns repeated
+	r := image.Rect(0, 0, 50, 20)
+	stripe := func(x int) uint8 {
+		if x < 0 {
+			x = 0
+		} else if x > r.Dx()-2 {
+			x = r.Dx() - 2
+		}
+		return uint8(x * 37)
+	}
+	m1, m2 := image.NewGray(r), image.NewGray(r)
+	for i := range m1.Pix {
+		x := i % r.Dx()
+		m1.Pix[i] = stripe(x)
+		m2.Pix[i] = stripe(x - 1)
+	}
+	img1, err := writeTempImage(m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img2, err := writeTempImage(m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	for _, alg := range []string{"binary", "perceptual"} {
+		for _, shift := range []string{"0", "1"} {
+			args := []string{"-test.run=TestShift", "-a", alg, "-t", "0", "-shift", shift, img1, img2}
+			cmd := exec.Command(os.Args[0], args...)
+			cmd.Env = append(os.Environ(), "RUNME=1")
+			out, err := cmd.CombinedOutput()
+			if failed := err != nil; failed != (shift == "0") {
+				t.Errorf("%s -shift %s: err = %v\n%s", alg, shift, err, out)
+			}
+		}
+	}
+}
+
+func TestAlign(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	// a checkerboard moved down by 2 pixels
+	r := image.Rect(0, 0, 60, 40)
+	m1, m2 := image.NewGray(r), image.NewGray(r)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			v := uint8((x/5+y/3)%2*0xff) ^ uint8(x*y)
+			m1.SetGray(x, y, color.Gray{v})
+			if y+2 < r.Dy() {
+				m2.SetGray(x, y+2, color.Gray{v})
+			}
+		}
+	}
+	img1, err := writeTempImage(m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img2, err := writeTempImage(m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	args := []string{"-test.run=TestAlign", "-a", "binary", "-t", "0", "-align", "8", img1, img2}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RUNME=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v\n%s", err, stderr.Bytes())
+	}
+	if out, want := stderr.String(), "align: 0, 2\n"; out != want {
+		t.Errorf("stderr = %q; want %q", out, want)
+	}
+}
+
+func TestFind(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	r := image.Rect(0, 0, 80, 60)
+	haystack := image.NewGray(r)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			haystack.SetGray(x, y, color.Gray{uint8(x*x*7 + y*y*3 + x*y)})
+		}
+	}
+	needle := haystack.SubImage(image.Rect(21, 13, 45, 31))
+	other := image.NewGray(image.Rect(0, 0, 24, 18))
+	img1, err := writeTempImage(haystack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img2, err := writeTempImage(needle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img3, err := writeTempImage(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+		os.Remove(img3)
+	}()
+
+	tests := []struct {
+		needle string
+		found  bool
+		out    string
+	}{
+		{img2, true, "found at (21,13)-(45,31), difference: 0 pixel(s), 0.000000%\n"},
+		{img3, false, "not found, closest at "},
+	}
+	for i, test := range tests {
+		args := []string{"-test.run=TestFind", "-find", "-a", "binary", test.needle, img1}
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Env = append(os.Environ(), "RUNME=1")
+		out, err := cmd.Output()
+		if (err == nil) != test.found {
+			t.Errorf("(%d) err = %v; want found %v", i, err, test.found)
+		}
+		if !strings.HasPrefix(string(out), test.out) {
+			t.Errorf("(%d) stdout = %q; want %q", i, out, test.out)
+		}
+	}
+}
+
+func TestHashThreshold(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	m := image.NewGray(image.Rect(0, 0, 64, 64))
+	img1, err := writeTempImage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the left half white, the left 4 bits of every row of average hash
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 32; x++ {
+			m.SetGray(x, y, color.Gray{0xff})
+		}
+	}
+	img2, err := writeTempImage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	tests := []struct {
+		opts string
+		fail bool
+	}{
+		// -t is 0 by default for hashes
+		{"-a ahash", true},
+		{"-a ahash -t 31", true},
+		{"-a ahash -t 32", false},
+		{"-a ahash -t 50%", false},
+	}
+	for i, test := range tests {
+		args := append([]string{"-test.run=TestHashThreshold", "-report", "always"}, strings.Split(test.opts, " ")...)
+		args = append(args, img1, img2)
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Env = append(os.Environ(), "RUNME=1")
+		out, err := cmd.CombinedOutput()
+		e, ok := err.(*exec.ExitError)
+		if !ok && err != nil {
+			t.Fatalf("(%d) %v", i, err)
+		}
+		if fail := e != nil && !e.Success(); fail != test.fail {
+			t.Errorf("(%d) %s: failed = %v; want %v\n%s", i, test.opts, fail, test.fail, out)
+		}
+		if !strings.Contains(string(out), "hash distance: 32\n") {
+			t.Errorf("(%d) %s: no hash distance in output:\n%s", i, test.opts, out)
+		}
+	}
+}
+
+func writeImageFile(p string, m image.Image) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return png.Encode(f, m)
+}
+
+func writeTempImage(m image.Image) (string, error) {
+	f, err := ioutil.TempFile("", "img")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := png.Encode(f, m); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func TestTranslation(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	// a page scrolled by 24 pixels
+	r := image.Rect(0, 0, 80, 120)
+	m1, m2 := image.NewGray(r), image.NewGray(r)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			v := uint8((x/5+y/3)%2*0xff) ^ uint8(x*y)
+			m1.SetGray(x, y, color.Gray{v})
+			if y+24 < r.Dy() {
+				m2.SetGray(x, y+24, color.Gray{v})
+			}
+		}
+	}
+	img1, err := writeTempImage(m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img2, err := writeTempImage(m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	tests := []struct {
+		flag, img2, want string
+	}{
+		{"-detect-shift", img2, "images appear shifted by (0, 24)\n"},
+		// passing comparisons aren't checked
+		{"-detect-shift", img1, ""},
+		// nor any without -detect-shift
+		{"-detect-shift=false", img2, ""},
+	}
+	for i, test := range tests {
+		args := []string{"-test.run=TestTranslation", "-a", "binary", "-t", "0", "-report", "never", test.flag, img1, test.img2}
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Env = append(os.Environ(), "RUNME=1")
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		cmd.Run()
+		if out := stderr.String(); out != test.want {
+			t.Errorf("(%d) stderr = %q; want %q", i, out, test.want)
+		}
+	}
+}
+
+func TestGrid(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	// 20 x 10 pixel cells, two of which differ
+	r := image.Rect(0, 0, 80, 40)
+	m1, m2 := image.NewGray(r), image.NewGray(r)
+	m2.SetGray(65, 5, color.Gray{0xff})
+	m2.SetGray(65, 15, color.Gray{0xff})
+	img1, err := writeTempImage(m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img2, err := writeTempImage(m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	tests := []struct {
+		grid, want string
+	}{
+		{"4x4", "cells (3,0) and (3,1) changed\n"},
+		{"2x1", "cell (1,0) changed\n"},
+		{"4x0", "invalid -grid value: 4x0\n"},
+	}
+	for i, test := range tests {
+		args := []string{"-test.run=TestGrid", "-a", "binary", "-t", "0", "-report", "never", "-grid", test.grid, img1, img2}
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Env = append(os.Environ(), "RUNME=1")
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err == nil {
+			t.Errorf("(%d) exit code 0; want 1", i)
+		}
+		if out := stderr.String(); !strings.HasSuffix(out, test.want) {
+			t.Errorf("(%d) stderr = %q; want %q", i, out, test.want)
+		}
+	}
+}
+
+func TestColorVision(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	// a green square turned red, alike to deuteranopes
+	r := image.Rect(0, 0, 64, 64)
+	m1, m2 := image.NewNRGBA(r), image.NewNRGBA(r)
+	draw.Draw(m1, r, image.NewUniform(color.Gray{0x80}), image.ZP, draw.Src)
+	draw.Draw(m2, r, image.NewUniform(color.Gray{0x80}), image.ZP, draw.Src)
+	draw.Draw(m1, image.Rect(16, 16, 48, 48), image.NewUniform(color.NRGBA{108, 158, 123, 0xff}), image.ZP, draw.Src)
+	draw.Draw(m2, image.Rect(16, 16, 48, 48), image.NewUniform(color.NRGBA{158, 140, 124, 0xff}), image.ZP, draw.Src)
+	img1, err := writeTempImage(m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img2, err := writeTempImage(m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	for _, cvd := range []string{"normal", "protanopia", "deuteranopia", "tritanopia"} {
+		args := []string{"-test.run=TestColorVision", "-t", "0", "-cvd", cvd, img1, img2}
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Env = append(os.Environ(), "RUNME=1")
+		out, err := cmd.CombinedOutput()
+		if failed := err != nil; failed != (cvd != "deuteranopia") {
+			t.Errorf("-cvd %s: err = %v\n%s", cvd, err, out)
+		}
+	}
+}
+
+func TestDeltaColors(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	r := image.Rect(0, 0, 4, 4)
+	m1, m2 := image.NewNRGBA(r), image.NewNRGBA(r)
+	m1.SetNRGBA(1, 1, color.NRGBA{0x10, 0x80, 0xff, 0xff})
+	m2.SetNRGBA(1, 1, color.NRGBA{0x30, 0x70, 0xff, 0xff})
+	img1, err := writeTempImage(m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img2, err := writeTempImage(m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.TempFile("", "imgdiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+		os.Remove(out.Name())
+	}()
+
+	args := []string{"-test.run=TestDeltaColors", "-a", "binary", "-t", "0", "-of", "png", "-delta-colors", "-o", out.Name(), img1, img2}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RUNME=1")
+	if b, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("exit code 0; want 1\n%s", b)
+	}
+	f, err := os.Open(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := color.NRGBA{0x20, 0x10, 0, 0xff}
+	if c := color.NRGBAModel.Convert(m.At(1, 1)); c != want {
+		t.Errorf("diff pixel = %v; want %v", c, want)
+	}
+}
+
+func TestHeatmapStyle(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	r := image.Rect(0, 0, 4, 4)
+	m1, m2 := image.NewNRGBA(r), image.NewNRGBA(r)
+	m2.SetNRGBA(1, 1, color.NRGBA{0xff, 0xff, 0xff, 0xff})
+	img1, err := writeTempImage(m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img2, err := writeTempImage(m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "diff.png")
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	args := []string{"-test.run=TestHeatmapStyle", "-a", "binary", "-t", "0", "-style", "heatmap", "-o", out, img1, img2}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RUNME=1")
+	if b, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("exit code 0; want 1\n%s", b)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, want := color.NRGBAModel.Convert(m.At(1, 1)), (color.NRGBA{0xfd, 0xe7, 0x25, 0xff}); c != want {
+		t.Errorf("diff pixel = %v; want %v", c, want)
+	}
+	if c := color.NRGBAModel.Convert(m.At(0, 0)); c != (color.NRGBA{}) {
+		t.Errorf("equal pixel = %v; want transparent", c)
+	}
+}
+
+func TestSideBySideStyle(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	m1, m2 := image.NewNRGBA(image.Rect(0, 0, 4, 6)), image.NewNRGBA(image.Rect(0, 0, 4, 6))
+	m2.SetNRGBA(1, 1, color.NRGBA{0xff, 0xff, 0xff, 0xff})
+	img1, err := writeTempImage(m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img2, err := writeTempImage(m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "diff.png")
+	defer func() {
+		os.Remove(img1)
+		os.Remove(img2)
+	}()
+
+	args := []string{"-test.run=TestSideBySideStyle", "-t", "0", "-style", "sidebyside", "-o", out, img1, img2}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RUNME=1")
+	if b, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("exit code 0; want 1\n%s", b)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// three 4x6 images in a row, below labels
+	if got, want := m.Bounds(), image.Rect(0, 0, 3*4+2*sideBySideGap, 16+6); got != want {
+		t.Errorf("bounds %v; want %v", got, want)
+	}
+}
+
+func TestAlgorithmList(t *testing.T) {
+	s := algorithmList()
+	for _, name := range []string{"'binary'", "'perceptual'", "'ssim'."} {
+		if !strings.Contains(s, name) {
+			t.Errorf("algorithm list doesn't contain %s:\n%s", name, s)
+		}
+	}
+	for _, line := range strings.Split(s, "\n") {
+		if len(line) > 72 {
+			t.Errorf("line longer than 72 columns: %q", line)
+		}
+	}
+}
+
+func TestDeltaOutput(t *testing.T) {
+	if os.Getenv("RUNME") == "1" {
+		run()
+		return
+	}
+
+	out := filepath.Join(t.TempDir(), "delta.png")
+	args := []string{"-test.run=TestDeltaOutput", "-a", "binary", "-t", "0", "-o-delta", out, "../../testdata/rgba64_ref.png", "../../testdata/rgba64.png"}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RUNME=1")
+	if b, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("exit code 0; want 1\n%s", b)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, ok := m.(*image.Gray16)
+	if !ok {
+		t.Fatalf("decoded %T; want *image.Gray16", m)
+	}
+	// the images differ in the low bytes of red samples of this area
+	patch := image.Rect(8, 16, 24, 24)
+	for y := g.Rect.Min.Y; y < g.Rect.Max.Y; y++ {
+		for x := g.Rect.Min.X; x < g.Rect.Max.X; x++ {
+			want := uint16(0)
+			if image.Pt(x, y).In(patch) {
+				want = 0xff
+			}
+			if v := g.Gray16At(x, y).Y; v != want {
+				t.Fatalf("delta at %d, %d = %#x; want %#x", x, y, v, want)
+			}
+		}
 	}
-	return f.Name(), nil
 }
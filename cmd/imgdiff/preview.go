@@ -0,0 +1,138 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"image"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/crhym3/imgdiff"
+)
+
+const (
+	ansiMarked = "\x1b[31m" // red
+	ansiReset  = "\x1b[0m"
+)
+
+// colorOutput reports whether stdout should be colored:
+// it is a terminal and NO_COLOR is not set.
+func colorOutput() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return isTerminal(os.Stdout)
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// previewGrid downscales mask to cols columns and as many rows as needed
+// to keep the aspect ratio. A cell is marked if any of the mask pixels
+// it covers are, so that thin differences remain visible.
+func previewGrid(mask *image.Alpha, cols int) [][]bool {
+	b := mask.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return nil
+	}
+	if cols > w {
+		cols = w
+	}
+	rows := (h*cols + w/2) / w
+	if rows < 1 {
+		rows = 1
+	}
+	grid := make([][]bool, rows)
+	for r := range grid {
+		grid[r] = make([]bool, cols)
+		y0, y1 := r*h/rows, (r+1)*h/rows
+		for y := y0; y < y1; y++ {
+			row := mask.Pix[mask.PixOffset(b.Min.X, b.Min.Y+y):]
+			for c := range grid[r] {
+				if grid[r][c] {
+					continue
+				}
+				for x := c * w / cols; x < (c+1)*w/cols; x++ {
+					if row[x] != 0 {
+						grid[r][c] = true
+						break
+					}
+				}
+			}
+		}
+	}
+	return grid
+}
+
+// writePreview prints mask downscaled to cols columns, framed, using half
+// block characters so that every character covers two rows of the grid.
+// Marked cells are highlighted with ANSI colors if color is true.
+func writePreview(w io.Writer, mask *image.Alpha, cols int, color bool) error {
+	grid := previewGrid(mask, cols)
+	if len(grid) == 0 {
+		return nil
+	}
+	bw := bufio.NewWriter(w)
+	border := strings.Repeat("─", len(grid[0]))
+	bw.WriteString("┌" + border + "┐\n")
+	for r := 0; r < len(grid); r += 2 {
+		top := grid[r]
+		bottom := make([]bool, len(top))
+		if r+1 < len(grid) {
+			bottom = grid[r+1]
+		}
+		bw.WriteString("│")
+		inColor := false
+		for c := range top {
+			marked := top[c] || bottom[c]
+			if color && marked != inColor {
+				if marked {
+					bw.WriteString(ansiMarked)
+				} else {
+					bw.WriteString(ansiReset)
+				}
+				inColor = marked
+			}
+			switch {
+			case top[c] && bottom[c]:
+				bw.WriteString("█")
+			case top[c]:
+				bw.WriteString("▀")
+			case bottom[c]:
+				bw.WriteString("▄")
+			default:
+				bw.WriteByte(' ')
+			}
+		}
+		if inColor {
+			bw.WriteString(ansiReset)
+		}
+		bw.WriteString("│\n")
+	}
+	bw.WriteString("└" + border + "┘\n")
+	return bw.Flush()
+}
+
+// printPreview prints a preview of the pixels marked in diff image m
+// to stdout, as requested by -preview.
+func printPreview(m image.Image) {
+	writePreview(os.Stdout, imgdiff.DiffMask(m), *previewWidth, colorOutput())
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestPreviewGrid(t *testing.T) {
+	// a single pixel wide vertical line at x = 150
+	mask := image.NewAlpha(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		mask.SetAlpha(150, y, color.Alpha{0xff})
+	}
+	grid := previewGrid(mask, 20)
+	if len(grid) != 10 {
+		t.Fatalf("%d rows; want 10", len(grid))
+	}
+	for r, row := range grid {
+		if len(row) != 20 {
+			t.Fatalf("row %d: %d columns; want 20", r, len(row))
+		}
+		for c, marked := range row {
+			if marked != (c == 15) {
+				t.Errorf("(%d, %d) marked = %v", r, c, marked)
+			}
+		}
+	}
+
+	// images narrower than the preview are not upscaled
+	if grid := previewGrid(image.NewAlpha(image.Rect(0, 0, 3, 1)), 80); len(grid) != 1 || len(grid[0]) != 3 {
+		t.Errorf("3x1 grid: %d rows", len(grid))
+	}
+}
+
+func TestWritePreview(t *testing.T) {
+	mask := image.NewAlpha(image.Rect(0, 0, 4, 3))
+	mask.SetAlpha(0, 0, color.Alpha{0xff})
+	mask.SetAlpha(0, 1, color.Alpha{0xff})
+	mask.SetAlpha(1, 0, color.Alpha{0xff})
+	mask.SetAlpha(2, 1, color.Alpha{0xff})
+	mask.SetAlpha(3, 2, color.Alpha{0xff})
+
+	tests := []struct {
+		color bool
+		want  []string
+	}{
+		{false, []string{
+			"┌────┐",
+			"│█▀▄ │",
+			"│   ▀│",
+			"└────┘",
+		}},
+		{true, []string{
+			"┌────┐",
+			"│\x1b[31m█▀▄\x1b[0m │",
+			"│   \x1b[31m▀\x1b[0m│",
+			"└────┘",
+		}},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		if err := writePreview(&buf, mask, 80, test.color); err != nil {
+			t.Fatal(err)
+		}
+		want := strings.Join(test.want, "\n") + "\n"
+		if s := buf.String(); s != want {
+			t.Errorf("(%d) preview:\n%s\nwant:\n%s", i, s, want)
+		}
+	}
+}
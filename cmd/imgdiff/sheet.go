@@ -0,0 +1,197 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// sheetGap is the spacing between contact sheet cells, in pixels.
+	sheetGap = 4
+	// captionHeight is the height of a caption strip under each tile.
+	captionHeight = 16
+)
+
+var (
+	sheetBackground = color.NRGBA{0x30, 0x30, 0x30, 0xff}
+	captionColor    = color.NRGBA{0xee, 0xee, 0xee, 0xff}
+)
+
+// contactSheet accumulates downscaled tiles of compared pairs
+// and renders them into a single grid image.
+// Tiles are downscaled as they are added so that full size images
+// need not be kept around until the sheet is rendered.
+type contactSheet struct {
+	cols    int
+	maxTile int
+	tiles   []sheetTile
+}
+
+type sheetTile struct {
+	img     *image.NRGBA
+	caption string
+}
+
+func newContactSheet(cols, maxTile int) *contactSheet {
+	if cols < 1 {
+		cols = 1
+	}
+	if maxTile < 1 {
+		maxTile = 1
+	}
+	return &contactSheet{cols: cols, maxTile: maxTile}
+}
+
+// add downscales m to fit the sheet's max tile size and appends it
+// to the sheet, captioned with caption.
+func (s *contactSheet) add(m image.Image, caption string) {
+	s.tiles = append(s.tiles, sheetTile{downscale(m, s.maxTile), caption})
+}
+
+// sheetCaption formats a tile caption from a file name
+// and the number of different pixels n in the diff image m.
+func sheetCaption(name string, n int, m image.Image) string {
+	p := percentage(n, m.Bounds().Dx()*m.Bounds().Dy())
+	return fmt.Sprintf("%s %.2f%%", name, p)
+}
+
+// sheetLayout describes a contact sheet grid.
+type sheetLayout struct {
+	cols, rows   int // grid size
+	cellW, cellH int // cell size, including the caption strip
+}
+
+// layout computes grid dimensions large enough to fit all tiles.
+func (s *contactSheet) layout() sheetLayout {
+	var l sheetLayout
+	n := len(s.tiles)
+	if n == 0 {
+		return l
+	}
+	l.cols = s.cols
+	if n < l.cols {
+		l.cols = n
+	}
+	l.rows = (n + l.cols - 1) / l.cols
+	for _, t := range s.tiles {
+		b := t.img.Bounds()
+		if b.Dx() > l.cellW {
+			l.cellW = b.Dx()
+		}
+		if b.Dy() > l.cellH {
+			l.cellH = b.Dy()
+		}
+	}
+	l.cellH += captionHeight
+	return l
+}
+
+// size returns the total sheet dimensions.
+func (l sheetLayout) size() (w, h int) {
+	w = l.cols*l.cellW + (l.cols+1)*sheetGap
+	h = l.rows*l.cellH + (l.rows+1)*sheetGap
+	return w, h
+}
+
+// cell returns the rectangle of i-th cell, in row-major order.
+func (l sheetLayout) cell(i int) image.Rectangle {
+	x := sheetGap + (i%l.cols)*(l.cellW+sheetGap)
+	y := sheetGap + (i/l.cols)*(l.cellH+sheetGap)
+	return image.Rect(x, y, x+l.cellW, y+l.cellH)
+}
+
+// render draws all tiles in a grid, each with a caption strip below it.
+func (s *contactSheet) render() *image.NRGBA {
+	l := s.layout()
+	w, h := l.size()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(sheetBackground), image.ZP, draw.Src)
+	fd := &font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(captionColor),
+		Face: basicfont.Face7x13,
+	}
+	for i, t := range s.tiles {
+		c := l.cell(i)
+		b := t.img.Bounds()
+		r := image.Rect(0, 0, b.Dx(), b.Dy()).Add(image.Pt(c.Min.X+(l.cellW-b.Dx())/2, c.Min.Y))
+		draw.Draw(dst, r, t.img, b.Min, draw.Src)
+		fd.Dot = fixed.P(c.Min.X, c.Max.Y-captionHeight+basicfont.Face7x13.Ascent+1)
+		fd.DrawString(fitCaption(t.caption, l.cellW/basicfont.Face7x13.Advance))
+	}
+	return dst
+}
+
+// fitCaption shortens s to at most n characters, keeping its tail
+// which is usually the most distinctive part of a path.
+func fitCaption(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	if n <= 3 {
+		return string(r[len(r)-n:])
+	}
+	return "..." + string(r[len(r)-n+3:])
+}
+
+// downscale shrinks m with a box filter so that neither side exceeds max,
+// preserving the aspect ratio. Smaller images are copied as is.
+func downscale(m image.Image, max int) *image.NRGBA {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if w > max || h > max {
+		if w >= h {
+			tw, th = max, h*max/w
+		} else {
+			tw, th = w*max/h, max
+		}
+		if tw < 1 {
+			tw = 1
+		}
+		if th < 1 {
+			th = 1
+		}
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, tw, th))
+	for ty := 0; ty < th; ty++ {
+		y0, y1 := ty*h/th, (ty+1)*h/th
+		for tx := 0; tx < tw; tx++ {
+			x0, x1 := tx*w/tw, (tx+1)*w/tw
+			var r, g, bl, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					cr, cg, cb, ca := m.At(b.Min.X+x, b.Min.Y+y).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.Set(tx, ty, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
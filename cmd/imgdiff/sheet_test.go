@@ -0,0 +1,126 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+func TestSheetLayout(t *testing.T) {
+	tests := []struct {
+		ntiles, cols, tw, th int
+		w, h                 int
+	}{
+		{1, 4, 10, 10, 18, 34},
+		{3, 2, 10, 20, 32, 2*36 + 3*sheetGap},
+		{4, 4, 7, 5, 4*7 + 5*sheetGap, 29},
+		{5, 2, 8, 8, 2*8 + 3*sheetGap, 3*24 + 4*sheetGap},
+	}
+	for i, test := range tests {
+		s := newContactSheet(test.cols, 100)
+		for j := 0; j < test.ntiles; j++ {
+			s.add(image.NewNRGBA(image.Rect(0, 0, test.tw, test.th)), "")
+		}
+		w, h := s.layout().size()
+		if w != test.w || h != test.h {
+			t.Errorf("%d: size = %dx%d; want %dx%d", i, w, h, test.w, test.h)
+		}
+	}
+}
+
+func TestDownscale(t *testing.T) {
+	tests := []struct {
+		w, h, max int
+		tw, th    int
+	}{
+		{100, 50, 20, 20, 10},
+		{50, 100, 20, 10, 20},
+		{10, 10, 20, 10, 10},
+		{1000, 1, 10, 10, 1},
+	}
+	for i, test := range tests {
+		m := downscale(image.NewGray(image.Rect(0, 0, test.w, test.h)), test.max)
+		if b := m.Bounds(); b.Dx() != test.tw || b.Dy() != test.th {
+			t.Errorf("%d: size = %dx%d; want %dx%d", i, b.Dx(), b.Dy(), test.tw, test.th)
+		}
+	}
+}
+
+func TestContactSheetGolden(t *testing.T) {
+	s := newContactSheet(2, 64)
+	for i, size := range []image.Point{{96, 48}, {20, 40}, {32, 32}} {
+		m := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+		for y := 0; y < size.Y; y++ {
+			for x := 0; x < size.X; x++ {
+				c := color.NRGBA{0, 0, 0, 0xff}
+				if (x+y+i)%5 == 0 {
+					c.R = 0xff
+				}
+				m.SetNRGBA(x, y, c)
+			}
+		}
+		s.add(m, sheetCaption(filepath.Join("dir", string('a'+rune(i))+".png"), size.X, m))
+	}
+	m := s.render()
+	golden := filepath.Join("testdata", "contact_sheet.png")
+	if *update {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pixels, rather than bytes, which depend on the PNG encoder
+	if !samePixels(m, want) {
+		t.Errorf("contact sheet differs from %s; run go test -update to regenerate", golden)
+	}
+}
+
+// samePixels reports whether a and b have the same bounds and colors.
+func samePixels(a, b image.Image) bool {
+	r := a.Bounds()
+	if r != b.Bounds() {
+		return false
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if color.NRGBA64Model.Convert(a.At(x, y)) != color.NRGBA64Model.Convert(b.At(x, y)) {
+				return false
+			}
+		}
+	}
+	return true
+}
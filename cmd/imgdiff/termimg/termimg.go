@@ -0,0 +1,223 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package termimg encodes images as escape sequences of terminal
+// inline image protocols: iTerm2, Kitty graphics and Sixel.
+package termimg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// Protocol is a terminal inline image protocol.
+type Protocol int
+
+const (
+	// None means no inline image protocol is supported.
+	None Protocol = iota
+	// ITerm2 is the iTerm2 inline images protocol (OSC 1337).
+	ITerm2
+	// Kitty is the Kitty terminal graphics protocol.
+	Kitty
+	// Sixel is the DEC Sixel graphics format.
+	Sixel
+)
+
+var names = []string{"none", "iterm", "kitty", "sixel"}
+
+func (p Protocol) String() string {
+	if int(p) < len(names) {
+		return names[p]
+	}
+	return fmt.Sprintf("Protocol(%d)", int(p))
+}
+
+// ParseProtocol returns the protocol named s, one of "iterm", "kitty"
+// or "sixel".
+func ParseProtocol(s string) (Protocol, error) {
+	for i, n := range names[1:] {
+		if s == n {
+			return Protocol(i + 1), nil
+		}
+	}
+	return None, fmt.Errorf("termimg: unknown protocol %q", s)
+}
+
+// Detect guesses the inline image protocol supported by the terminal
+// from environment variables, looked up with getenv.
+// It returns None if there are no signs of any supported protocol.
+func Detect(getenv func(string) string) Protocol {
+	term, prog := getenv("TERM"), getenv("TERM_PROGRAM")
+	switch {
+	case term == "xterm-kitty" || getenv("KITTY_WINDOW_ID") != "" || prog == "ghostty":
+		return Kitty
+	// LC_TERMINAL is forwarded by ssh by default
+	case prog == "iTerm.app" || getenv("LC_TERMINAL") == "iTerm2" || prog == "WezTerm":
+		return ITerm2
+	}
+	// terminfo entries of terminals with sixel support
+	for _, t := range []string{"sixel", "mlterm", "foot", "yaft", "contour"} {
+		if strings.Contains(term, t) {
+			return Sixel
+		}
+	}
+	return None
+}
+
+// Encode writes m to w as escape sequences of protocol p.
+func Encode(w io.Writer, m image.Image, p Protocol) error {
+	switch p {
+	case ITerm2:
+		return EncodeITerm2(w, m)
+	case Kitty:
+		return EncodeKitty(w, m)
+	case Sixel:
+		return EncodeSixel(w, m)
+	}
+	return fmt.Errorf("termimg: unsupported protocol %v", p)
+}
+
+// EncodeITerm2 writes m as a PNG file transferred inline with OSC 1337.
+func EncodeITerm2(w io.Writer, m image.Image) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m); err != nil {
+		return err
+	}
+	b := m.Bounds()
+	_, err := fmt.Fprintf(w, "\x1b]1337;File=inline=1;size=%d;width=%dpx;height=%dpx;preserveAspectRatio=1:%s\a\n",
+		buf.Len(), b.Dx(), b.Dy(), base64.StdEncoding.EncodeToString(buf.Bytes()))
+	return err
+}
+
+// kittyChunk is the max size of base64 payload in a single Kitty escape code.
+const kittyChunk = 4096
+
+// EncodeKitty writes m as a PNG transmitted and displayed with the Kitty
+// graphics protocol, split into chunks as the protocol requires.
+func EncodeKitty(w io.Writer, m image.Image) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m); err != nil {
+		return err
+	}
+	data := base64.StdEncoding.EncodeToString(buf.Bytes())
+	bw := bufio.NewWriter(w)
+	for first := true; first || len(data) > 0; first = false {
+		n := len(data)
+		if n > kittyChunk {
+			n = kittyChunk
+		}
+		more := 0
+		if n < len(data) {
+			more = 1
+		}
+		if first {
+			fmt.Fprintf(bw, "\x1b_Ga=T,f=100,m=%d;%s\x1b\\", more, data[:n])
+		} else {
+			fmt.Fprintf(bw, "\x1b_Gm=%d;%s\x1b\\", more, data[:n])
+		}
+		data = data[n:]
+	}
+	bw.WriteString("\n")
+	return bw.Flush()
+}
+
+// EncodeSixel writes m in Sixel format. Colors are quantized to a 6x6x6
+// color cube and translucent pixels are composited over black.
+func EncodeSixel(w io.Writer, m image.Image) error {
+	b := m.Bounds()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "\x1bPq\"1;1;%d;%d", b.Dx(), b.Dy())
+
+	// palette index of every pixel and which of them are used
+	idx := make([]uint8, b.Dx()*b.Dy())
+	var used [216]bool
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r, g, bl, _ := m.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			i := cubeIndex(r)*36 + cubeIndex(g)*6 + cubeIndex(bl)
+			idx[y*b.Dx()+x] = uint8(i)
+			used[i] = true
+		}
+	}
+	for i, u := range used {
+		if u {
+			// sixel color components are percentages
+			fmt.Fprintf(bw, "#%d;2;%d;%d;%d", i, i/36*20, i/6%6*20, i%6*20)
+		}
+	}
+
+	row := make([]byte, b.Dx())
+	for y0 := 0; y0 < b.Dy(); y0 += 6 {
+		first := true
+		for c := range used {
+			if !used[c] {
+				continue
+			}
+			any := false
+			for x := 0; x < b.Dx(); x++ {
+				var bits byte
+				for k := 0; k < 6 && y0+k < b.Dy(); k++ {
+					if int(idx[(y0+k)*b.Dx()+x]) == c {
+						bits |= 1 << uint(k)
+					}
+				}
+				row[x] = '?' + bits
+				any = any || bits != 0
+			}
+			if !any {
+				continue
+			}
+			if !first {
+				bw.WriteByte('$') // carriage return within the band
+			}
+			first = false
+			fmt.Fprintf(bw, "#%d", c)
+			writeSixelRLE(bw, row)
+		}
+		bw.WriteByte('-') // next band
+	}
+	bw.WriteString("\x1b\\\n")
+	return bw.Flush()
+}
+
+// cubeIndex maps a 16-bit color component to one of 6 color cube levels.
+func cubeIndex(v uint32) int {
+	return int((v*5 + 0x7fff) / 0xffff)
+}
+
+// writeSixelRLE writes sixel characters of row, using repeat introducers
+// for runs longer than 3.
+func writeSixelRLE(w *bufio.Writer, row []byte) {
+	for i := 0; i < len(row); {
+		j := i + 1
+		for j < len(row) && row[j] == row[i] {
+			j++
+		}
+		if n := j - i; n > 3 {
+			fmt.Fprintf(w, "!%d%c", n, row[i])
+		} else {
+			for k := i; k < j; k++ {
+				w.WriteByte(row[k])
+			}
+		}
+		i = j
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package termimg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		env map[string]string
+		p   Protocol
+	}{
+		{map[string]string{}, None},
+		{map[string]string{"TERM": "xterm-256color"}, None},
+		{map[string]string{"TERM": "xterm-kitty"}, Kitty},
+		{map[string]string{"TERM": "xterm-256color", "KITTY_WINDOW_ID": "1"}, Kitty},
+		{map[string]string{"TERM_PROGRAM": "iTerm.app"}, ITerm2},
+		{map[string]string{"TERM": "screen", "LC_TERMINAL": "iTerm2"}, ITerm2},
+		{map[string]string{"TERM": "xterm-sixel"}, Sixel},
+		{map[string]string{"TERM": "foot"}, Sixel},
+	}
+	for i, test := range tests {
+		getenv := func(k string) string { return test.env[k] }
+		if p := Detect(getenv); p != test.p {
+			t.Errorf("(%d) Detect(%v) = %v; want %v", i, test.env, p, test.p)
+		}
+	}
+}
+
+func TestParseProtocol(t *testing.T) {
+	for _, p := range []Protocol{ITerm2, Kitty, Sixel} {
+		if q, err := ParseProtocol(p.String()); q != p || err != nil {
+			t.Errorf("ParseProtocol(%q) = %v, %v; want %v", p.String(), q, err, p)
+		}
+	}
+	for _, s := range []string{"", "none", "vt100"} {
+		if _, err := ParseProtocol(s); err == nil {
+			t.Errorf("ParseProtocol(%q): no error", s)
+		}
+	}
+}
+
+func TestITerm2(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	m.Set(1, 1, color.NRGBA{255, 0, 0, 255})
+	var buf bytes.Buffer
+	if err := EncodeITerm2(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	re := regexp.MustCompile("^\x1b]1337;File=inline=1;size=([0-9]+);width=3px;height=2px;preserveAspectRatio=1:([A-Za-z0-9+/=]+)\a\n$")
+	s := re.FindStringSubmatch(buf.String())
+	if s == nil {
+		t.Fatalf("unexpected stream %q", buf.String())
+	}
+	data, err := base64.StdEncoding.DecodeString(s[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s[1] != strconv.Itoa(len(data)) {
+		t.Errorf("size = %s; want %d", s[1], len(data))
+	}
+	checkPNG(t, data, m)
+}
+
+func TestKitty(t *testing.T) {
+	// random pixels don't compress, so the payload spans several chunks
+	m := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	rand.New(rand.NewSource(1)).Read(m.Pix)
+	var buf bytes.Buffer
+	if err := EncodeKitty(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	s := buf.String()
+	if !strings.HasSuffix(s, "\x1b\\\n") {
+		t.Fatalf("stream doesn't end with ST and newline: %q", s[len(s)-8:])
+	}
+	chunks := strings.Split(strings.TrimSuffix(s, "\x1b\\\n"), "\x1b\\")
+	if len(chunks) < 3 {
+		t.Fatalf("%d chunks; want at least 3", len(chunks))
+	}
+	var payload string
+	for i, c := range chunks {
+		prefix := "\x1b_Gm=1;"
+		switch i {
+		case 0:
+			prefix = "\x1b_Ga=T,f=100,m=1;"
+		case len(chunks) - 1:
+			prefix = "\x1b_Gm=0;"
+		}
+		if !strings.HasPrefix(c, prefix) {
+			t.Errorf("chunk %d starts with %q; want %q", i, c[:len(prefix)], prefix)
+			continue
+		}
+		c = c[len(prefix):]
+		if len(c) > kittyChunk || i < len(chunks)-1 && len(c) != kittyChunk {
+			t.Errorf("chunk %d payload is %d bytes", i, len(c))
+		}
+		payload += c
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPNG(t, data, m)
+
+	// small images fit into a single escape code
+	buf.Reset()
+	if err := EncodeKitty(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	if s := buf.String(); !strings.HasPrefix(s, "\x1b_Ga=T,f=100,m=0;") || strings.Count(s, "\x1b_G") != 1 {
+		t.Errorf("1x1 image stream = %q", s)
+	}
+}
+
+func TestSixel(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	m := image.NewRGBA(image.Rect(10, 10, 13, 12))
+	m.Set(10, 10, red)
+	m.Set(11, 10, red)
+	m.Set(12, 10, blue)
+	m.Set(10, 11, red)
+	m.Set(11, 11, blue)
+	m.Set(12, 11, blue)
+
+	long := image.NewGray(image.Rect(0, 0, 10, 1))
+	tests := []struct {
+		m    image.Image
+		want string
+	}{
+		{m, "\x1bPq\"1;1;3;2#5;2;0;0;100#180;2;100;0;0#5?AB$#180B@?-\x1b\\\n"},
+		{long, "\x1bPq\"1;1;10;1#0;2;0;0;0#0!10@-\x1b\\\n"},
+		{long.SubImage(image.Rect(0, 0, 3, 1)), "\x1bPq\"1;1;3;1#0;2;0;0;0#0@@@-\x1b\\\n"},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		if err := EncodeSixel(&buf, test.m); err != nil {
+			t.Fatal(err)
+		}
+		if s := buf.String(); s != test.want {
+			t.Errorf("(%d) stream = %q; want %q", i, s, test.want)
+		}
+	}
+}
+
+func checkPNG(t *testing.T, data []byte, want *image.NRGBA) {
+	m, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := want.Bounds()
+	if m.Bounds() != b {
+		t.Fatalf("bounds = %v; want %v", m.Bounds(), b)
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if c := color.NRGBAModel.Convert(m.At(x, y)); c != want.At(x, y) {
+				t.Fatalf("(%d, %d) = %v; want %v", x, y, c, want.At(x, y))
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"math"
+)
+
+// ColorMatrix converts linear RGB to CIE XYZ: row i holds the weights
+// of red, green and blue in X, Y and Z respectively, see WithColorMatrix.
+// LAB colors are relative to the XYZ of white, the sum of each row.
+type ColorMatrix [3][3]float64
+
+// RGB to XYZ matrices of common color spaces, all with D65 white.
+var (
+	// DefaultColorMatrix is that of the original pdiff, close to
+	// AdobeRGBMatrix.
+	DefaultColorMatrix = ColorMatrix{
+		{0.576700, 0.185556, 0.188212},
+		{0.297361, 0.627355, 0.0752847},
+		{0.0270328, 0.0706879, 0.991248},
+	}
+	// SRGBMatrix is that of sRGB, IEC 61966-2-1.
+	SRGBMatrix = ColorMatrix{
+		{0.4124564, 0.3575761, 0.1804375},
+		{0.2126729, 0.7151522, 0.0721750},
+		{0.0193339, 0.1191920, 0.9503041},
+	}
+	// AdobeRGBMatrix is that of Adobe RGB (1998).
+	AdobeRGBMatrix = ColorMatrix{
+		{0.5767309, 0.1855540, 0.1881852},
+		{0.2973769, 0.6273491, 0.0752741},
+		{0.0270343, 0.0706872, 0.9911085},
+	}
+	// DisplayP3Matrix is that of Display P3.
+	DisplayP3Matrix = ColorMatrix{
+		{0.4865709, 0.2656677, 0.1982173},
+		{0.2289746, 0.6917385, 0.0792869},
+		{0.0000000, 0.0451134, 1.0439444},
+	}
+)
+
+// colorSpace converts linear RGB to XYZ with a ColorMatrix,
+// and XYZ to LAB relative to its white.
+type colorSpace struct {
+	m ColorMatrix
+	// XYZ of white, linear RGB (1, 1, 1)
+	white [3]float64
+}
+
+// defaultColorSpace is the colorSpace of DefaultColorMatrix.
+var defaultColorSpace = newColorSpace(DefaultColorMatrix)
+
+func newColorSpace(m ColorMatrix) *colorSpace {
+	s := &colorSpace{m: m}
+	s.white[0], s.white[1], s.white[2] = s.xyz(1, 1, 1)
+	return s
+}
+
+// validColorMatrix returns an error if m maps white to XYZ
+// with a component which isn't positive, as LAB is relative to it.
+func validColorMatrix(m ColorMatrix) error {
+	for _, v := range newColorSpace(m).white {
+		if !(v > 0) || math.IsInf(v, 1) {
+			return fmt.Errorf("imgdiff: invalid color matrix %v", m)
+		}
+	}
+	return nil
+}
+
+// xyz converts linear RGB to XYZ colorspace.
+func (s *colorSpace) xyz(r, g, b float64) (x, y, z float64) {
+	m := &s.m
+	x = m[0][0]*r + m[0][1]*g + m[0][2]*b
+	y = m[1][0]*r + m[1][1]*g + m[1][2]*b
+	z = m[2][0]*r + m[2][1]*g + m[2][2]*b
+	return x, y, z
+}
+
+// lab converts XYZ to LAB colorspace, relative to the white of s.
+func (s *colorSpace) lab(x, y, z float64) (l, a, b float64) {
+	r := [3]float64{x / s.white[0], y / s.white[1], z / s.white[2]}
+	var f [3]float64
+	for i := 0; i < 3; i++ {
+		if r[i] > epsilon {
+			f[i] = math.Cbrt(r[i])
+			continue
+		}
+		f[i] = (kappa*r[i] + 16.0) / 116.0
+	}
+	return 116.0*f[1] - 16.0, 500.0 * (f[0] - f[1]), 200.0 * (f[1] - f[2])
+}
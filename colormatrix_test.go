@@ -0,0 +1,86 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestColorMatrixLAB(t *testing.T) {
+	s := newColorSpace(SRGBMatrix)
+	// linear sRGB and LAB, D65, from Bruce Lindbloom's color calculator
+	for _, test := range []struct {
+		rgb, lab [3]float64
+	}{
+		{[3]float64{1, 1, 1}, [3]float64{100, 0, 0}},
+		{[3]float64{0, 0, 0}, [3]float64{0, 0, 0}},
+		{[3]float64{1, 0, 0}, [3]float64{53.2408, 80.0925, 67.2032}},
+		{[3]float64{0, 1, 0}, [3]float64{87.7347, -86.1827, 83.1793}},
+		{[3]float64{0, 0, 1}, [3]float64{32.2970, 79.1875, -107.8602}},
+		// 8-bit sRGB gray 128
+		{[3]float64{0.2158605, 0.2158605, 0.2158605}, [3]float64{53.5850, 0, 0}},
+	} {
+		l, a, b := s.lab(s.xyz(test.rgb[0], test.rgb[1], test.rgb[2]))
+		got := [3]float64{l, a, b}
+		for i := range got {
+			if math.Abs(got[i]-test.lab[i]) > 0.01 {
+				t.Errorf("%v: lab = %.4f; want %.4f", test.rgb, got, test.lab)
+				break
+			}
+		}
+	}
+}
+
+func TestWithColorMatrix(t *testing.T) {
+	r := image.Rect(0, 0, 4, 4)
+	red, green := image.NewRGBA(r), image.NewRGBA(r)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			red.Set(x, y, color.RGBA{0xff, 0, 0, 0xff})
+			green.Set(x, y, color.RGBA{0, 0xff, 0, 0xff})
+		}
+	}
+	// ΔE of sRGB red and green is 170.57
+	for _, test := range []struct {
+		d    Differ
+		want int
+	}{
+		{NewDeltaE(170.5, WithColorMatrix(SRGBMatrix)), 16},
+		{NewDeltaE(170.6, WithColorMatrix(SRGBMatrix)), 0},
+		{NewDeltaE(170.6), 16},
+	} {
+		_, n, err := test.d.Compare(red, green)
+		if err != nil || n != test.want {
+			t.Errorf("%v: n = %d, err = %v; want %d", test.d.(*labDiffer).opts.colorMatrix, n, err, test.want)
+		}
+	}
+	for _, d := range []Differ{
+		NewDefaultPerceptual(WithColorMatrix(ColorMatrix{})),
+		NewDeltaE(2.3, WithColorMatrix(ColorMatrix{{1, 0, 0}, {0, math.NaN(), 0}, {0, 0, 1}})),
+		NewCIEDE2000(2.3, WithColorMatrix(ColorMatrix{{1, 0, 0}, {0, 1, 0}, {0, 0, -1}})),
+	} {
+		if _, _, err := d.Compare(red, green); err == nil {
+			t.Errorf("%T: no error", d)
+		}
+	}
+	// the default is DefaultColorMatrix
+	_, want, _ := NewDefaultPerceptual().Compare(red, green)
+	if _, n, _ := NewDefaultPerceptual(WithColorMatrix(DefaultColorMatrix)).Compare(red, green); n != want {
+		t.Errorf("DefaultColorMatrix: n = %d; want %d", n, want)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"runtime"
+	"sync"
+)
+
+// CompositeMode is how a composite Differ combines the results
+// of its Differs, see NewComposite.
+type CompositeMode int
+
+// Composite modes.
+const (
+	// CompositeAnd counts pixels which all the Differs find different.
+	CompositeAnd CompositeMode = iota
+	// CompositeOr counts pixels which any of the Differs finds different.
+	CompositeOr
+	// CompositeMax is the largest count of the Differs.
+	CompositeMax
+	// CompositeMin is the smallest count of the Differs.
+	CompositeMin
+)
+
+func (m CompositeMode) String() string {
+	switch m {
+	case CompositeAnd:
+		return "and"
+	case CompositeOr:
+		return "or"
+	case CompositeMax:
+		return "max"
+	case CompositeMin:
+		return "min"
+	}
+	return fmt.Sprintf("CompositeMode(%d)", int(m))
+}
+
+type composite struct {
+	mode    CompositeMode
+	differs []Differ
+	// invalid arguments, returned by Compare
+	err error
+}
+
+// NewComposite creates a new Differ combining the results of differs,
+// which compare the images concurrently, according to mode.
+//
+// If all the differs mark different pixels in their difference images,
+// CompositeAnd and CompositeOr combine these per pixel. Otherwise, i.e.
+// if any of them compares hashes or histograms, whose counts are not of
+// pixels, they fall back to the smallest and the largest count, and the
+// difference image is the one of the Differ with that count, as it is
+// with CompositeMax and CompositeMin.
+//
+// Combined difference images have the different pixels marked by the
+// first, second and third differs in the red, green and blue channels,
+// and so on, so that e.g. a yellow pixel is different according to
+// the first two. With CompositeAnd, pixels not counted as different
+// are black.
+//
+// Compare returns an error if differs is empty, mode is unknown,
+// or any of the differs fails.
+func NewComposite(mode CompositeMode, differs ...Differ) Differ {
+	d := &composite{mode: mode, differs: differs}
+	switch {
+	case len(differs) == 0:
+		d.err = errors.New("imgdiff: composite of no differs")
+	case mode < CompositeAnd || mode > CompositeMin:
+		d.err = fmt.Errorf("imgdiff: unknown composite mode %v", mode)
+	}
+	return d
+}
+
+// Compare compares a and b with all the differs.
+func (d *composite) Compare(a, b image.Image) (image.Image, int, error) {
+	diff := new(image.NRGBA)
+	n, err := d.CompareInto(diff, a, b)
+	if err != nil {
+		return nil, -1, err
+	}
+	return diff, n, nil
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *composite) CompareInto(diff *image.NRGBA, a, b image.Image) (int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return -1, ErrSize
+	}
+	if d.err != nil {
+		return -1, d.err
+	}
+	diffs := make([]image.Image, len(d.differs))
+	ns := make([]int, len(d.differs))
+	errs := make([]error, len(d.differs))
+	var wg sync.WaitGroup
+	wg.Add(len(d.differs))
+	for i, c := range d.differs {
+		go func(i int, c Differ) {
+			diffs[i], ns[i], errs[i] = c.Compare(a, b)
+			wg.Done()
+		}(i, c)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	resize(diff, w, h)
+	if d.mode == CompositeMax || d.mode == CompositeMin || !pixelAligned(d) {
+		i := d.pick(ns)
+		m := diffs[i]
+		draw.Draw(diff, diff.Rect, m, m.Bounds().Min, draw.Src)
+		return ns[i], nil
+	}
+	return forBands(runtime.GOMAXPROCS(0), h, func(y0, y1 int) int {
+		return d.mergeRows(diff, diffs, y0, y1)
+	}), nil
+}
+
+// pick returns the index of the largest count of ns for CompositeOr
+// and CompositeMax, and of the smallest one otherwise.
+func (d *composite) pick(ns []int) int {
+	max := d.mode == CompositeOr || d.mode == CompositeMax
+	p := 0
+	for i, n := range ns {
+		if max && n > ns[p] || !max && n < ns[p] {
+			p = i
+		}
+	}
+	return p
+}
+
+// mergeRows writes rows [y0, y1) of diff combined out of diffs
+// and returns the number of different pixels.
+func (d *composite) mergeRows(diff *image.NRGBA, diffs []image.Image, y0, y1 int) int {
+	npix := 0
+	for y := y0; y < y1; y++ {
+		out := diff.Pix[diff.PixOffset(0, y):]
+		for x := 0; x < diff.Rect.Dx(); x++ {
+			c := passPixel
+			hits := 0
+			for i, m := range diffs {
+				if markedAt(m, x, y) {
+					c[i%3] = 0xff
+					hits++
+				}
+			}
+			if hits == len(diffs) || hits > 0 && d.mode == CompositeOr {
+				npix++
+			} else {
+				c = passPixel
+			}
+			copy(out[4*x:], c[:])
+		}
+	}
+	return npix
+}
+
+// markedAt reports whether pixel x, y of zero-based diff image m
+// is marked as different, see DiffMask.
+func markedAt(m image.Image, x, y int) bool {
+	if nm, ok := m.(*image.NRGBA); ok {
+		return isMarked(nm.Pix[nm.PixOffset(nm.Rect.Min.X+x, nm.Rect.Min.Y+y):])
+	}
+	b := m.Bounds()
+	return marked(m.At(b.Min.X+x, b.Min.Y+y))
+}
+
+// pixelAligned reports whether d counts pixels which it marks
+// in its difference images. Differs which are not created by
+// this package are assumed to.
+func pixelAligned(d Differ) bool {
+	if overlaid(d) {
+		// other pixels are those of an image
+		return false
+	}
+	switch d := d.(type) {
+	case *hashDiffer, *histogram, *grid:
+		// grids tint pixels of changed cells
+		return false
+	case *downsampled:
+		return pixelAligned(d.inner)
+	case *blurred:
+		return pixelAligned(d.inner)
+	case *normalized:
+		return pixelAligned(d.inner)
+	case *aligned:
+		return pixelAligned(d.inner)
+	case *composite:
+		if d.mode == CompositeMax || d.mode == CompositeMin {
+			return false
+		}
+		for _, c := range d.differs {
+			if !pixelAligned(c) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestComposite(t *testing.T) {
+	r := image.Rect(0, 0, 3, 1)
+	a := image.NewRGBA(r)
+	b := image.NewRGBA(r)
+	a.SetRGBA(0, 0, color.RGBA{0x80, 0x80, 0x80, 0xff})
+	b.SetRGBA(0, 0, color.RGBA{0x80, 0x80, 0x80, 0xff})
+	a.SetRGBA(1, 0, color.RGBA{0x80, 0x80, 0x80, 0xff})
+	b.SetRGBA(1, 0, color.RGBA{0x82, 0x80, 0x80, 0xff})
+	a.SetRGBA(2, 0, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	b.SetRGBA(2, 0, color.RGBA{0, 0, 0, 0xff})
+	// binary finds pixels 1 and 2 different, delta E only pixel 2
+	black := color.NRGBA{0, 0, 0, 0xff}
+	red := color.NRGBA{0xff, 0, 0, 0xff}
+	yellow := color.NRGBA{0xff, 0xff, 0, 0xff}
+	tests := []struct {
+		mode CompositeMode
+		n    int
+		pix  [3]color.NRGBA
+	}{
+		{CompositeAnd, 1, [3]color.NRGBA{black, black, yellow}},
+		{CompositeOr, 2, [3]color.NRGBA{black, red, yellow}},
+		{CompositeMax, 2, [3]color.NRGBA{black, red, red}},
+		{CompositeMin, 1, [3]color.NRGBA{black, black, red}},
+	}
+	for i, test := range tests {
+		diff, n, err := NewComposite(test.mode, NewBinary(), NewDeltaE(2.3)).Compare(a, b)
+		if err != nil {
+			t.Fatalf("(%d) %v", i, err)
+		}
+		if n != test.n {
+			t.Errorf("(%d) %v: n = %d; want %d", i, test.mode, n, test.n)
+		}
+		m := diff.(*image.NRGBA)
+		for x, want := range test.pix {
+			if c := m.NRGBAAt(x, 0); c != want {
+				t.Errorf("(%d) %v: diff at %d, 0 = %v; want %v", i, test.mode, x, c, want)
+			}
+		}
+	}
+}
+
+func TestCompositeCounts(t *testing.T) {
+	a, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nb, err := NewBinary().Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := NewAHash(0)
+	_, nh, err := hash.Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hash distances are not pixel counts, so And and Or fall back
+	// to the smallest and largest count
+	tests := []struct {
+		mode CompositeMode
+		n    int
+	}{
+		{CompositeAnd, nh},
+		{CompositeOr, nb},
+		{CompositeMax, nb},
+		{CompositeMin, nh},
+	}
+	for i, test := range tests {
+		_, n, err := NewComposite(test.mode, NewBinary(), hash).Compare(a, b)
+		if err != nil {
+			t.Fatalf("(%d) %v", i, err)
+		}
+		if n != test.n {
+			t.Errorf("(%d) %v: n = %d; want %d", i, test.mode, n, test.n)
+		}
+	}
+}
+
+func TestCompositeErrors(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	tests := []Differ{
+		NewComposite(CompositeAnd),
+		NewComposite(CompositeMode(-1), NewBinary()),
+		NewComposite(CompositeOr, NewBinary(), NewSSIM(0, 0.01, 0.03)),
+	}
+	for i, d := range tests {
+		if _, _, err := d.Compare(m, m); err == nil {
+			t.Errorf("(%d) err = nil", i)
+		}
+	}
+	n := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	if _, _, err := NewComposite(CompositeAnd, NewBinary()).Compare(m, n); err != ErrSize {
+		t.Errorf("err = %v; want ErrSize", err)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestCSFCache(t *testing.T) {
+	cpd := []float64{0.01, 0.3, 1, 3.248, 10, 40, 200}
+	c := newCSFCache(Barten, cpd, false)
+	var maxErr float64
+	for e := -5.5; e < 5.5; e += 1e-4 {
+		adapt := math.Pow(10, e)
+		k, f := c.pos(adapt)
+		for i := range cpd {
+			want := csf(cpd[i], adapt)
+			got := c.at(i, k, f, adapt)
+			if err := math.Abs(got-want) / math.Max(want, 1); err > maxErr {
+				maxErr = err
+			}
+		}
+	}
+	if maxErr > 1e-4 {
+		t.Errorf("max error = %g; want <= 1e-4", maxErr)
+	}
+}
+
+func TestCSFCacheCounts(t *testing.T) {
+	pairs := [][2]string{
+		{"aqsis_vase_ref.png", "aqsis_vase.png"},
+		{"bug1102605_ref.tif", "bug1102605.tif"},
+		{"bug1471457_ref.tif", "bug1471457.tif"},
+		{"cam_mb_ref.tif", "cam_mb.tif"},
+		{"fish1.png", "fish2.png"},
+	}
+	exact := NewDefaultPerceptual(WithExactCSF())
+	cached := NewDefaultPerceptual()
+	for _, pair := range pairs {
+		a, err := readTestImage(pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := readTestImage(pair[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, want, err := exact.Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, n, err := cached.Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("%s: n = %d; exact csf n = %d", pair[0], n, want)
+		}
+	}
+}
+
+func BenchmarkCSFCache(b *testing.B) {
+	c := newCSFCache(Barten, []float64{1.5}, false)
+	for i := 0; i < b.N; i++ {
+		k, f := c.pos(100)
+		c.at(0, k, f, 100)
+	}
+}
+
+func TestCSFModels(t *testing.T) {
+	if v := MannosSakrison.at(7.8909, 1); math.Abs(v-bartenPeak) > 1e-9 {
+		t.Errorf("MannosSakrison peak = %v; want %v as Barten at 100 cd/m²", v, bartenPeak)
+	}
+	// less sensitive at low frequencies, more at high ones
+	for _, test := range []struct {
+		cpd  float64
+		less bool
+	}{
+		{0.5, true},
+		{1, true},
+		{8, false},
+		{16, false},
+	} {
+		b, m := Barten.at(test.cpd, 100), MannosSakrison.at(test.cpd, 100)
+		if (m < b) != test.less {
+			t.Errorf("%v cpd: MannosSakrison = %v, Barten = %v", test.cpd, m, b)
+		}
+	}
+	if m := MannosSakrison.at(2, 1); m != MannosSakrison.at(2, 1000) {
+		t.Error("MannosSakrison depends on luminance")
+	}
+	a, b := image.NewGray(image.Rect(0, 0, 1, 1)), image.NewGray(image.Rect(0, 0, 1, 1))
+	b.Pix[0] = 0xff
+	if _, _, err := NewDefaultPerceptual(WithCSF(CSFModel(2))).Compare(a, b); err == nil {
+		t.Error("CSFModel(2): no error")
+	}
+}
+
+func TestNonFiniteLuminance(t *testing.T) {
+	for _, lum := range []float64{math.NaN(), 0, -1} {
+		if v, want := csf(4, lum), csf(4, 1e-5); v != want || math.IsNaN(v) {
+			t.Errorf("csf(4, %g) = %g; want %g", lum, v, want)
+		}
+		if v, want := tvi(lum), tvi(0); v != want || math.IsNaN(v) {
+			t.Errorf("tvi(%g) = %g; want %g", lum, v, want)
+		}
+	}
+}
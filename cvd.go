@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import "fmt"
+
+// ColorVision is a type of color vision the perceptual algorithm
+// can simulate, see WithColorVision.
+type ColorVision int
+
+// Color vision types. Deficiencies are simulated at full severity,
+// with the matrices of Machado, Oliveira and Fernandes, "A Physiologically-
+// based Model for Simulation of Color Vision Deficiency", 2009.
+const (
+	// NormalVision sees colors as they are.
+	NormalVision ColorVision = iota
+	// Protanopia is the lack of long wavelength (red) cones.
+	Protanopia
+	// Deuteranopia is the lack of medium wavelength (green) cones.
+	Deuteranopia
+	// Tritanopia is the lack of short wavelength (blue) cones.
+	Tritanopia
+)
+
+func (v ColorVision) String() string {
+	switch v {
+	case NormalVision:
+		return "normal"
+	case Protanopia:
+		return "protanopia"
+	case Deuteranopia:
+		return "deuteranopia"
+	case Tritanopia:
+		return "tritanopia"
+	}
+	return fmt.Sprintf("ColorVision(%d)", int(v))
+}
+
+// cvdMatrices transform linear RGB into RGB of the same
+// appearance to each ColorVision but NormalVision.
+var cvdMatrices = map[ColorVision]*[3][3]float64{
+	Protanopia: {
+		{0.152286, 1.052583, -0.204868},
+		{0.114503, 0.786281, 0.099216},
+		{-0.003882, -0.048116, 1.051998},
+	},
+	Deuteranopia: {
+		{0.367322, 0.860646, -0.227968},
+		{0.280085, 0.672501, 0.047413},
+		{-0.011820, 0.042940, 0.968881},
+	},
+	Tritanopia: {
+		{1.255528, -0.076749, -0.178779},
+		{-0.078411, 0.930809, 0.147602},
+		{0.004733, 0.691367, 0.303900},
+	},
+}
+
+// validColorVision returns an error if v is not one of the ColorVision types.
+func validColorVision(v ColorVision) error {
+	if _, ok := cvdMatrices[v]; !ok && v != NormalVision {
+		return fmt.Errorf("imgdiff: unknown color vision %v", v)
+	}
+	return nil
+}
+
+// simulate returns linear RGB r, g, b as seen with color vision
+// matrix m, or as is if m is nil. Out of gamut colors
+// are clamped to black.
+func simulate(m *[3][3]float64, r, g, b float64) (float64, float64, float64) {
+	if m == nil {
+		return r, g, b
+	}
+	var c [3]float64
+	for i, row := range m {
+		c[i] = row[0]*r + row[1]*g + row[2]*b
+		if c[i] < 0 {
+			c[i] = 0
+		}
+	}
+	return c[0], c[1], c[2]
+}
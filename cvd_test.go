@@ -0,0 +1,61 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestColorVision(t *testing.T) {
+	// green and red which only differ along the deuteranopic
+	// confusion line
+	green := color.NRGBA{108, 158, 123, 0xff}
+	red := color.NRGBA{158, 140, 124, 0xff}
+	a := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(a, a.Rect, image.NewUniform(color.Gray{0x80}), image.ZP, draw.Src)
+	b := image.NewNRGBA(a.Rect)
+	copy(b.Pix, a.Pix)
+	draw.Draw(a, image.Rect(16, 16, 48, 48), image.NewUniform(green), image.ZP, draw.Src)
+	draw.Draw(b, image.Rect(16, 16, 48, 48), image.NewUniform(red), image.ZP, draw.Src)
+
+	tests := []struct {
+		opts []Option
+		n    int
+	}{
+		{nil, 1024},
+		{[]Option{WithColorVision(NormalVision)}, 1024},
+		{[]Option{WithColorVision(Protanopia)}, 1024},
+		{[]Option{WithColorVision(Tritanopia)}, 1024},
+		{[]Option{WithColorVision(Deuteranopia)}, 0},
+		{[]Option{WithColorVision(Deuteranopia), WithLowMemory()}, 0},
+		{[]Option{WithColorVision(Deuteranopia), WithFloat32()}, 0},
+	}
+	for i, test := range tests {
+		_, n, err := NewDefaultPerceptual(test.opts...).Compare(a, b)
+		if err != nil {
+			t.Fatalf("(%d) %v", i, err)
+		}
+		if n != test.n {
+			t.Errorf("(%d) n = %d; want %d", i, n, test.n)
+		}
+	}
+
+	if _, _, err := NewDefaultPerceptual(WithColorVision(ColorVision(7))).Compare(a, b); err == nil {
+		t.Error("unknown color vision: no error")
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"math"
+)
+
+// DebugSink receives intermediate values of the perceptual algorithm,
+// see WithDebug. Once a comparison is done, Plane is called with each
+// of these planes, in this order, from the goroutine calling Compare:
+//
+//	adaptation  luminance the pixel is adapted to, in cd/m²
+//	contrast    sum of contrasts of the pyramid levels
+//	factor      elevation of the luminance threshold by masking, 1 to 10
+//	luminance   absolute difference of luminances, in cd/m²
+//	threshold   luminance difference the pixel fails above
+//	chroma      squared difference of the a and b LAB components,
+//	            the color test fails if it exceeds factor/cf, where cf
+//	            is the color factor; 0 if there's no color test
+//	reason      why the pixel passes or fails, ReasonPass and others
+//
+// Planes are not used by the Differ afterwards, so Plane may keep them.
+type DebugSink interface {
+	Plane(name string, p *DebugPlane)
+}
+
+// Values of the reason plane of a DebugSink.
+const (
+	// ReasonPass is a pixel passing all tests.
+	ReasonPass = iota
+	// ReasonLuminance is a pixel failing the luminance test.
+	ReasonLuminance
+	// ReasonColor is a pixel passing the luminance test
+	// and failing the color test.
+	ReasonColor
+	// ReasonShift is a pixel failing a test which passes with
+	// a pixel nearby, see WithShiftTolerance.
+	ReasonShift
+)
+
+// DebugPlane holds a value of each pixel of compared images.
+type DebugPlane struct {
+	Width, Height int
+	// Pix holds the value of pixel x, y at index y*Width+x.
+	Pix []float64
+}
+
+// At returns the value of pixel x, y.
+func (p *DebugPlane) At(x, y int) float64 {
+	return p.Pix[y*p.Width+x]
+}
+
+// Range returns the min and max values of p.
+func (p *DebugPlane) Range() (lo, hi float64) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, v := range p.Pix {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	return lo, hi
+}
+
+// Gray renders p as a grayscale image, mapping values from lo to hi
+// linearly to black to white. Values outside of the range are clamped,
+// and all pixels are black if hi isn't greater than lo.
+func (p *DebugPlane) Gray(lo, hi float64) *image.Gray {
+	m := image.NewGray(image.Rect(0, 0, p.Width, p.Height))
+	if !(hi > lo) {
+		return m
+	}
+	scale := 255 / (hi - lo)
+	for i, v := range p.Pix {
+		g := (v - lo) * scale
+		if g <= 0 {
+			continue
+		}
+		if g > 255 {
+			g = 255
+		}
+		m.Pix[i] = uint8(g + 0.5)
+	}
+	return m
+}
+
+// debugPlaneNames are names of the planes of debugPlanes,
+// see DebugSink.
+var debugPlaneNames = [...]string{
+	"adaptation",
+	"contrast",
+	"factor",
+	"luminance",
+	"threshold",
+	"chroma",
+	"reason",
+}
+
+// Indices of planes of debugPlanes and debugRow.
+const (
+	debugAdaptation = iota
+	debugContrast
+	debugFactor
+	debugLuminance
+	debugThreshold
+	debugChroma
+	debugReason
+)
+
+// debugPlanes are the planes of a Compare call passed to a DebugSink,
+// and painted by WithHeatmap.
+type debugPlanes [len(debugPlaneNames)]DebugPlane
+
+// newDebugPlanes returns planes of w x h pixels.
+func newDebugPlanes(w, h int) *debugPlanes {
+	p := new(debugPlanes)
+	for i := range p {
+		p[i] = DebugPlane{Width: w, Height: h, Pix: make([]float64, w*h)}
+	}
+	return p
+}
+
+// row returns n values of each plane from pixel x, y on, or an empty
+// debugRow if p is nil.
+func (p *debugPlanes) row(x, y, n int) debugRow {
+	var r debugRow
+	if p == nil {
+		return r
+	}
+	i := y*p[0].Width + x
+	for k := range r {
+		r[k] = p[k].Pix[i : i+n]
+	}
+	return r
+}
+
+// tolerateShift sets the reason of pixels failing a test but
+// passing in diff to ReasonShift.
+func (p *debugPlanes) tolerateShift(diff *image.NRGBA) {
+	reason := p[debugReason].Pix
+	for i, v := range reason {
+		if v != ReasonPass && !isFailPixel(diff.Pix[4*i:]) {
+			reason[i] = ReasonShift
+		}
+	}
+}
+
+// send passes the planes to sink.
+func (p *debugPlanes) send(sink DebugSink) {
+	for i := range p {
+		sink.Plane(debugPlaneNames[i], &p[i])
+	}
+}
+
+// debugRow holds values of a row of pixels of each plane of
+// debugPlanes, written by compareRow unless it is empty.
+type debugRow [len(debugPlaneNames)][]float64
@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+// debugRecorder is a DebugSink recording planes in the order received.
+type debugRecorder struct {
+	names  []string
+	planes map[string]*DebugPlane
+}
+
+func (r *debugRecorder) Plane(name string, p *DebugPlane) {
+	if r.planes == nil {
+		r.planes = make(map[string]*DebugPlane)
+	}
+	r.names = append(r.names, name)
+	r.planes[name] = p
+}
+
+func TestDebug(t *testing.T) {
+	a, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, h := a.Bounds().Dx(), a.Bounds().Dy()
+	names := []string{"adaptation", "contrast", "factor", "luminance", "threshold", "chroma", "reason"}
+	for _, test := range []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"lowmem", []Option{WithLowMemory()}},
+		{"float32", []Option{WithFloat32()}},
+		{"shift", []Option{WithShiftTolerance(1)}},
+	} {
+		var r debugRecorder
+		_, n, err := NewDefaultPerceptual(append(test.opts, WithDebug(&r))...).Compare(a, b)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(r.names, names) {
+			t.Fatalf("%s: planes %v; want %v", test.name, r.names, names)
+		}
+		for _, p := range r.planes {
+			if p.Width != w || p.Height != h || len(p.Pix) != w*h {
+				t.Fatalf("%s: plane of %dx%d, %d values; want %dx%d", test.name, p.Width, p.Height, len(p.Pix), w, h)
+			}
+		}
+		reason := r.planes["reason"]
+		var fail, shifted int
+		for i, v := range reason.Pix {
+			switch v {
+			case ReasonLuminance, ReasonColor:
+				fail++
+			case ReasonShift:
+				shifted++
+			}
+			lum := r.planes["luminance"].Pix[i] > r.planes["threshold"].Pix[i]
+			if lum != (v == ReasonLuminance) && v != ReasonShift {
+				t.Fatalf("%s: pixel %d: reason %g, luminance %g, threshold %g", test.name, i, v, r.planes["luminance"].Pix[i], r.planes["threshold"].Pix[i])
+			}
+		}
+		if fail != n {
+			t.Errorf("%s: %d failing pixels; want %d", test.name, fail, n)
+		}
+		if shift := test.name == "shift"; shift != (shifted > 0) {
+			t.Errorf("%s: %d shifted pixels", test.name, shifted)
+		}
+	}
+}
+
+// TestDebug16 checks that perceptual comparisons see differences of
+// 16-bit images smaller than an 8-bit step.
+func TestDebug16(t *testing.T) {
+	a, b := readRGBA64Pair(t)
+	var r debugRecorder
+	if _, _, err := NewDefaultPerceptual(WithDebug(&r)).Compare(a, b); err != nil {
+		t.Fatal(err)
+	}
+	lum := r.planes["luminance"]
+	for y := 0; y < lum.Height; y++ {
+		for x := 0; x < lum.Width; x++ {
+			if d := lum.At(x, y); (d > 0) != image.Pt(x, y).In(patch16) {
+				t.Fatalf("luminance difference at %d, %d = %g", x, y, d)
+			}
+		}
+	}
+}
+
+func TestDebugPlaneGray(t *testing.T) {
+	p := &DebugPlane{Width: 4, Height: 1, Pix: []float64{-1, 0, 0.5, 2}}
+	if lo, hi := p.Range(); lo != -1 || hi != 2 {
+		t.Errorf("Range() = %g, %g; want -1, 2", lo, hi)
+	}
+	if got, want := p.Gray(0, 1).Pix, []uint8{0, 0, 128, 255}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Gray(0, 1) = %v; want %v", got, want)
+	}
+	if got, want := p.Gray(1, 1).Pix, []uint8{0, 0, 0, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Gray(1, 1) = %v; want %v", got, want)
+	}
+}
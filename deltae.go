@@ -0,0 +1,159 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"math"
+)
+
+// labDiffer is a Differ counting pixels whose LAB colors
+// are farther apart than a tolerance.
+type labDiffer struct {
+	// algorithm name, see algorithmName
+	name string
+	// color difference of two LAB colors
+	delta     func(c1, c2 [3]float64) float64
+	tolerance float64
+	// gamma decoding table
+	lut *gammaLUT
+	// invalid options, returned by Compare
+	err  error
+	opts options
+}
+
+func newLabDiffer(name string, delta func(c1, c2 [3]float64) float64, tolerance float64, opts []Option) *labDiffer {
+	d := &labDiffer{
+		name:      name,
+		delta:     delta,
+		tolerance: tolerance,
+		lut:       newGammaLUT(2.2),
+		opts:      newOptions(opts),
+	}
+	if d.opts.hasColorMatrix {
+		d.lut.space = newColorSpace(d.opts.colorMatrix)
+		d.err = validColorMatrix(d.opts.colorMatrix)
+	}
+	return d
+}
+
+// NewDeltaE creates a new Differ based on the CIE76 color difference,
+// the Euclidean distance of LAB colors. Pixels whose ΔE is above
+// maxDeltaE are counted as different and marked red in the difference
+// image. Unlike the perceptual algorithm, it compares each pixel on
+// its own, without building pyramids, which makes it much faster.
+// A ΔE of about 2.3 is the smallest difference noticeable side by side.
+//
+// Colors are converted to LAB the same way as by the perceptual
+// algorithm with the default gamma of 2.2, with alpha-premultiplied
+// colors composited over black. FloatImage inputs are linear already,
+// so gamma is not applied to them.
+func NewDeltaE(maxDeltaE float64, opts ...Option) Differ {
+	return newLabDiffer("deltae", deltaE76, maxDeltaE, opts)
+}
+
+// Compare compares a and b by color differences of their pixels.
+func (d *labDiffer) Compare(a, b image.Image) (image.Image, int, error) {
+	return d.compareTimed(a, b, new(PhaseTimings))
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *labDiffer) CompareInto(dst *image.NRGBA, a, b image.Image) (int, error) {
+	return d.compareInto(dst, a, b, new(PhaseTimings))
+}
+
+func (d *labDiffer) compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error) {
+	diff := new(image.NRGBA)
+	n, err := d.compareInto(diff, a, b, t)
+	if err != nil {
+		return nil, -1, err
+	}
+	return diff, n, nil
+}
+
+func (d *labDiffer) compareInto(diff *image.NRGBA, a, b image.Image, t *PhaseTimings) (int, error) {
+	if d.err != nil {
+		return -1, d.err
+	}
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return -1, ErrSize
+	}
+	if err := d.opts.checkSize(ab); err != nil {
+		return -1, err
+	}
+	resize(diff, w, h)
+	if sameImage(a, b) {
+		fillPass(diff)
+		return 0, nil
+	}
+
+	var npix int
+	newPhases(d.name, ab, t).run("compare", &t.Compare, func() {
+		npix = forBands(d.opts.workers(), h, func(y0, y1 int) int {
+			return d.compareRows(diff, a, b, y0, y1)
+		})
+	})
+	return npix, nil
+}
+
+// compareRows compares rows [y0, y1) of a and b, writing them to diff,
+// and returns the number of different pixels.
+func (d *labDiffer) compareRows(diff *image.NRGBA, a, b image.Image, y0, y1 int) int {
+	w := diff.Rect.Dx()
+	la, lb := make([][3]float64, w), make([][3]float64, w)
+	row := make([]pixel, w)
+	npix := 0
+	for y := y0; y < y1; y++ {
+		d.labRow(la, row, a, y)
+		d.labRow(lb, row, b, y)
+		out := diff.Pix[diff.PixOffset(0, y):]
+		for x, ca := range la {
+			c := passPixel
+			if d.delta(ca, lb[x]) > d.tolerance {
+				c = failPixel
+				npix++
+			}
+			copy(out[4*x:], c[:])
+		}
+	}
+	return npix
+}
+
+// labRow sets dst to LAB colors of row y of m, relative to its bounds,
+// using row as a buffer.
+func (d *labDiffer) labRow(dst [][3]float64, row []pixel, m image.Image, y int) {
+	min := m.Bounds().Min
+	if fm, ok := m.(FloatImage); ok {
+		for x := range dst {
+			r, g, b, _ := fm.FloatAt(min.X+x, min.Y+y)
+			l, ca, cb := d.lut.space.lab(d.lut.space.xyz(linearSample(r), linearSample(g), linearSample(b)))
+			dst[x] = [3]float64{l, ca, cb}
+		}
+		return
+	}
+	readRow(row, m, min.X, min.Y+y)
+	for x, p := range row {
+		l, ca, cb := d.lut.space.lab(d.lut.space.xyz(d.lut.at(p[0]), d.lut.at(p[1]), d.lut.at(p[2])))
+		dst[x] = [3]float64{l, ca, cb}
+	}
+}
+
+// deltaE76 returns the CIE76 difference of LAB colors c1 and c2.
+func deltaE76(c1, c2 [3]float64) float64 {
+	dl, da, db := c1[0]-c2[0], c1[1]-c2[1], c1[2]-c2[2]
+	return math.Sqrt(dl*dl + da*da + db*db)
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDeltaE(t *testing.T) {
+	r := image.Rect(0, 0, 3, 1)
+	a := image.NewRGBA(r)
+	b := image.NewRGBA(r)
+	a.SetRGBA(0, 0, color.RGBA{0x80, 0x80, 0x80, 0xff})
+	b.SetRGBA(0, 0, color.RGBA{0x80, 0x80, 0x80, 0xff})
+	a.SetRGBA(1, 0, color.RGBA{0x80, 0x80, 0x80, 0xff})
+	b.SetRGBA(1, 0, color.RGBA{0x82, 0x80, 0x80, 0xff})
+	a.SetRGBA(2, 0, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	b.SetRGBA(2, 0, color.RGBA{0, 0, 0, 0xff})
+	tests := []struct {
+		maxDeltaE float64
+		n         int
+	}{
+		{0, 2},
+		{2.3, 1},
+		{100, 0},
+	}
+	for i, test := range tests {
+		diff, n, err := NewDeltaE(test.maxDeltaE).Compare(a, b)
+		if err != nil {
+			t.Fatalf("(%d) %v", i, err)
+		}
+		if n != test.n {
+			t.Errorf("(%d) n = %d; want %d", i, n, test.n)
+		}
+		m := diff.(*image.NRGBA)
+		if c := m.NRGBAAt(0, 0); c != (color.NRGBA{0, 0, 0, 0xff}) {
+			t.Errorf("(%d) diff at 0, 0 = %v; want black", i, c)
+		}
+		if c := m.NRGBAAt(2, 0); n > 0 && c != (color.NRGBA{0xff, 0, 0, 0xff}) {
+			t.Errorf("(%d) diff at 2, 0 = %v; want red", i, c)
+		}
+	}
+	if de := deltaE76([3]float64{50, 1, 2}, [3]float64{47, 5, 2}); de != 5 {
+		t.Errorf("deltaE76 = %v; want 5", de)
+	}
+}
+
+// TestDeltaEFish checks that the delta E algorithm is less strict
+// than binary, but stricter than perceptual.
+func TestDeltaEFish(t *testing.T) {
+	a, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n [3]int
+	for i, d := range []Differ{NewBinary(), NewDeltaE(2.3), NewDefaultPerceptual()} {
+		if _, n[i], err = d.Compare(a, b); err != nil {
+			t.Fatalf("%T: %v", d, err)
+		}
+	}
+	if !(n[0] > n[1] && n[1] > n[2]) {
+		t.Errorf("binary, delta E and perceptual counts = %v; want decreasing", n)
+	}
+}
+
+func BenchmarkDeltaE(b *testing.B) {
+	m1 := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	m2 := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	m2.Set(0, 0, color.White)
+	d := NewDeltaE(2.3)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			d.Compare(m1, m2)
+		}
+	})
+}
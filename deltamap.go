@@ -0,0 +1,59 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import "image"
+
+// DeltaMap returns the largest difference of the 16-bit alpha-premultiplied
+// red, green, blue and alpha samples of each pixel of a and b, as a
+// zero-based Gray16 image, e.g. to inspect differences of 16-bit images,
+// which difference images, of 8 bits per channel, don't show. Pixel x, y
+// corresponds to a.Bounds().Min+(x, y) and b.Bounds().Min+(x, y).
+//
+// It returns ErrSize if images have their width or height do not match.
+func DeltaMap(a, b image.Image) (*image.Gray16, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return nil, ErrSize
+	}
+	m := image.NewGray16(image.Rect(0, 0, w, h))
+	arow, brow := make([]pixel, w), make([]pixel, w)
+	for y := 0; y < h; y++ {
+		readRow(arow, a, ab.Min.X, ab.Min.Y+y)
+		readRow(brow, b, bb.Min.X, bb.Min.Y+y)
+		out := m.Pix[m.PixOffset(0, y):]
+		for x := range arow {
+			d := maxDelta(arow[x], brow[x])
+			out[2*x], out[2*x+1] = uint8(d>>8), uint8(d)
+		}
+	}
+	return m, nil
+}
+
+// maxDelta returns the largest difference of samples of p1 and p2.
+func maxDelta(p1, p2 pixel) uint32 {
+	var max uint32
+	for i := range p1 {
+		d := p1[i] - p2[i]
+		if p1[i] < p2[i] {
+			d = p2[i] - p1[i]
+		}
+		if d > max {
+			max = d
+		}
+	}
+	return max
+}
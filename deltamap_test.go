@@ -0,0 +1,76 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"testing"
+)
+
+// readRGBA64Pair reads 16-bit testdata images, which differ in the low
+// bytes of red samples of a 16 x 8 patch only, see patch16.
+func readRGBA64Pair(t *testing.T) (a, b image.Image) {
+	a, err := readTestImage("rgba64_ref.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = readTestImage("rgba64.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.(*image.RGBA64); !ok {
+		t.Fatalf("testdata decoded as %T; want *image.RGBA64", a)
+	}
+	return a, b
+}
+
+// patch16 is the area where the images of readRGBA64Pair differ.
+var patch16 = image.Rect(8, 16, 24, 24)
+
+func TestDeltaMap(t *testing.T) {
+	a, b := readRGBA64Pair(t)
+	m, err := DeltaMap(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Rect != a.Bounds() {
+		t.Fatalf("bounds = %v; want %v", m.Rect, a.Bounds())
+	}
+	for y := m.Rect.Min.Y; y < m.Rect.Max.Y; y++ {
+		for x := m.Rect.Min.X; x < m.Rect.Max.X; x++ {
+			ra, _, _, _ := a.At(x, y).RGBA()
+			rb, _, _, _ := b.At(x, y).RGBA()
+			want := ra - rb
+			if ra < rb {
+				want = rb - ra
+			}
+			got := uint32(m.Gray16At(x, y).Y)
+			if got != want || (got != 0) != image.Pt(x, y).In(patch16) {
+				t.Fatalf("delta at %d, %d = %#x; want %#x", x, y, got, want)
+			}
+		}
+	}
+	// the largest delta of all samples, here alpha
+	r := image.Rect(0, 0, 1, 1)
+	p, q := image.NewNRGBA64(r), image.NewNRGBA64(r)
+	p.Pix[6], p.Pix[7] = 0xff, 0xff
+	q.Pix[6], q.Pix[7] = 0x12, 0x34
+	if m, err := DeltaMap(p, q); err != nil || m.Gray16At(0, 0).Y != 0xffff-0x1234 {
+		t.Errorf("alpha delta = %v, %v; want %#x", m.Gray16At(0, 0), err, 0xffff-0x1234)
+	}
+	if _, err := DeltaMap(a, image.NewRGBA64(image.Rect(0, 0, 1, 1))); err != ErrSize {
+		t.Errorf("DeltaMap of different sizes: err = %v; want ErrSize", err)
+	}
+}
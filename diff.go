@@ -18,20 +18,150 @@ package imgdiff
 
 import (
 	"errors"
+	"fmt"
 	"image"
+	"image/color"
 )
 
 // ErrSize is used when the two images under comparison have different sizes.
 var ErrSize = errors.New("images have different sizes")
 
+// ErrMaxDiff is returned by Compare once more pixels differ than
+// allowed by WithMaxDiff.
+var ErrMaxDiff = errors.New("imgdiff: more pixels differ than allowed")
+
+// MaxPixels is the default limit of the number of pixels of each
+// compared image, see WithUnlimited.
+const MaxPixels = 250 * 1000 * 1000
+
+// ErrTooLarge is matched by errors.Is for all TooLargeErrors.
+var ErrTooLarge = errors.New("imgdiff: image too large")
+
+// TooLargeError is returned by Compare when the images have more
+// than Limit pixels, before anything is allocated for them.
+type TooLargeError struct {
+	// Pixels is the number of pixels of each image.
+	Pixels int64
+	// Limit is the max number of pixels, MaxPixels.
+	Limit int64
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("imgdiff: images of %d pixels exceed the limit of %d", e.Pixels, e.Limit)
+}
+
+// Is reports whether target is ErrTooLarge.
+func (e *TooLargeError) Is(target error) bool {
+	return target == ErrTooLarge
+}
+
 // Differ is the image comparison interface.
 // All supported algorithms implement it.
+//
+// Differs returned by this package are safe for concurrent use:
+// a single Differ may compare different images in many goroutines
+// at once, with the same results as sequential calls.
 type Differ interface {
 	// Compare compares images a and b, returning the resulting
 	// difference image and the number of pixels that are different
 	// according to an algorithm.
 	//
+	// The difference image bounds are zero-based, regardless of bounds
+	// of a and b: its pixel (x, y) corresponds to a.Bounds().Min+(x, y)
+	// and b.Bounds().Min+(x, y). See also CompareResult.
+	//
+	// Results are deterministic: the same images produce bit for bit
+	// identical difference images and counts, regardless of GOMAXPROCS
+	// and WithMaxWorkers. Concurrent parts only split work by rows and
+	// never reorder floating point operations of a pixel.
+	//
 	// It returns ErrSize if images have their width or height
-	// do not match.
+	// do not match, and a *TooLargeError if they have more than
+	// MaxPixels pixels, unless created with WithUnlimited.
 	Compare(a, b image.Image) (image.Image, int, error)
 }
+
+// IntoDiffer is a Differ which can write difference images to
+// a buffer provided by the caller, so that it can be reused across
+// comparisons. Differs returned by this package implement it.
+type IntoDiffer interface {
+	Differ
+	// CompareInto is Compare writing the difference image to dst
+	// and returning the number of different pixels only.
+	//
+	// If bounds of dst are not those of the difference image, dst
+	// is resized to them, reusing its Pix if it is large enough.
+	// All pixels of dst within the bounds are overwritten.
+	CompareInto(dst *image.NRGBA, a, b image.Image) (int, error)
+}
+
+// CountDiffer is a Differ which can count different pixels without
+// building a difference image, for callers which only need the count.
+// Differs of NewBinary, NewBinaryFuzz and NewPerceptual implement it.
+type CountDiffer interface {
+	Differ
+	// CompareCount is Compare returning the number of different
+	// pixels only. Options which only affect the difference image,
+	// such as WithHeatmap, are ignored.
+	CompareCount(a, b image.Image) (int, error)
+}
+
+// CompareCount returns the number of pixels of a and b which differ
+// according to d, with CompareCount if d is a CountDiffer, and Compare
+// otherwise.
+func CompareCount(d Differ, a, b image.Image) (int, error) {
+	if cd, ok := d.(CountDiffer); ok {
+		return cd.CompareCount(a, b)
+	}
+	_, n, err := d.Compare(a, b)
+	return n, err
+}
+
+// TiledImage is an image which can be decoded lazily, one tile at a time,
+// such as a tiled TIFF opened with package tifftile.
+// The binary Differ walks such images tile by tile, so that only a couple
+// of tiles need to be decoded at a time. Its CompareCount then holds two
+// tiles and a row of marks, whereas Compare still returns, and so holds,
+// a difference image of the whole size.
+type TiledImage interface {
+	image.Image
+	// Tiles returns rectangles of all tiles, clipped to Bounds.
+	Tiles() []image.Rectangle
+	// Tile decodes the i-th tile. Its bounds are Tiles()[i].
+	Tile(i int) (image.Image, error)
+}
+
+// FloatImage is an image holding linear-light floating point samples,
+// such as a decoded OpenEXR file. Sample values are not limited to [0, 1].
+//
+// The perceptual Differ reads such samples directly, bypassing gamma
+// adjustment since they are linear already. The binary Differ compares
+// samples of two FloatImages using a relative tolerance,
+// see WithFloatEpsilon.
+type FloatImage interface {
+	image.Image
+	// FloatAt returns linear, alpha-premultiplied samples at (x, y).
+	FloatAt(x, y int) (r, g, b, a float32)
+}
+
+// RowReader is an image decoded sequentially, one row at a time,
+// such as a PNG or a strip-organized TIFF read with package stream.
+// See CompareStream.
+type RowReader interface {
+	// Bounds returns the image bounds.
+	Bounds() image.Rectangle
+	// ColorModel returns the color model of decoded rows.
+	ColorModel() color.Model
+	// ReadRow decodes the next row, from top to bottom. The returned
+	// image bounds are those of the row within Bounds, and it is only
+	// valid until the next call. ReadRow returns io.EOF after the last row.
+	ReadRow() (image.Image, error)
+}
+
+// RowWriter receives rows of a difference image as they are compared.
+// See CompareStream.
+type RowWriter interface {
+	// WriteRow writes the next row of the difference image.
+	// The row is only valid during the call.
+	WriteRow(row *image.NRGBA) error
+}
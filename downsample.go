@@ -0,0 +1,185 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"runtime"
+)
+
+type downsampled struct {
+	inner  Differ
+	maxDim int
+	// invalid maxDim, returned by Compare
+	err error
+}
+
+// NewDownsampled creates a new Differ which compares images with inner
+// after shrinking them by an integer factor, so that neither side is
+// longer than maxDim pixels. Each pixel of the shrunk images is the mean
+// of the alpha-premultiplied colors of the up to factor x factor pixels
+// it covers. Images which are small enough are compared as they are.
+//
+// The difference image of inner is scaled back up to the size of the
+// compared images, repeating each pixel, so that it overlays them.
+// The number of different pixels is scaled by the same area ratio.
+//
+// This makes e.g. the perceptual algorithm practical for renders of
+// tens of megapixels, at the cost of missing differences smaller than
+// the factor. Compare returns ErrSize if the compared images, rather
+// than the shrunk ones, have different sizes, and an error if maxDim
+// is less than 1.
+func NewDownsampled(inner Differ, maxDim int) Differ {
+	d := &downsampled{inner: inner, maxDim: maxDim}
+	if maxDim < 1 {
+		d.err = fmt.Errorf("imgdiff: invalid max downsampled size %d", maxDim)
+	}
+	return d
+}
+
+// Compare compares a and b with the inner Differ, after shrinking them.
+func (d *downsampled) Compare(a, b image.Image) (image.Image, int, error) {
+	diff := new(image.NRGBA)
+	n, err := d.CompareInto(diff, a, b)
+	if err != nil {
+		return nil, -1, err
+	}
+	return diff, n, nil
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *downsampled) CompareInto(diff *image.NRGBA, a, b image.Image) (int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return -1, ErrSize
+	}
+	if d.err != nil {
+		return -1, d.err
+	}
+	if w == 0 || h == 0 {
+		// nothing to shrink, nor to scale the count by
+		resize(diff, w, h)
+		return 0, nil
+	}
+	f := d.factor(w, h)
+	if f == 1 {
+		if id, ok := d.inner.(IntoDiffer); ok {
+			return id.CompareInto(diff, a, b)
+		}
+	}
+	var sa, sb image.Image
+	parallel(runtime.GOMAXPROCS(0), func(int) {
+		sa = shrink(a, f)
+	}, func(int) {
+		sb = shrink(b, f)
+	})
+	m, n, err := d.inner.Compare(sa, sb)
+	if err != nil {
+		return -1, err
+	}
+	resize(diff, w, h)
+	forBands(runtime.GOMAXPROCS(0), h, func(y0, y1 int) int {
+		enlargeRows(diff, m, f, y0, y1)
+		return 0
+	})
+	sw, sh := (w+f-1)/f, (h+f-1)/f
+	area, sarea := int64(w)*int64(h), int64(sw)*int64(sh)
+	return int((int64(n)*area + sarea/2) / sarea), nil
+}
+
+// factor returns the smallest factor which shrinks w x h images
+// to at most maxDim pixels on each side.
+func (d *downsampled) factor(w, h int) int {
+	l := w
+	if h > l {
+		l = h
+	}
+	if l <= d.maxDim {
+		return 1
+	}
+	return (l + d.maxDim - 1) / d.maxDim
+}
+
+// shrink returns zero-based m shrunk by factor f, see NewDownsampled.
+// It returns m if f is 1.
+func shrink(m image.Image, f int) image.Image {
+	if f == 1 {
+		return m
+	}
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	sw, sh := (w+f-1)/f, (h+f-1)/f
+	s := image.NewRGBA64(image.Rect(0, 0, sw, sh))
+	forBands(runtime.GOMAXPROCS(0), sh, func(y0, y1 int) int {
+		row := make([]pixel, w)
+		// uint64, so that sums of large factors don't overflow
+		sums := make([][4]uint64, sw)
+		for sy := y0; sy < y1; sy++ {
+			for x := range sums {
+				sums[x] = [4]uint64{}
+			}
+			ys := f
+			if sy*f+f > h {
+				ys = h - sy*f
+			}
+			for y := sy * f; y < sy*f+ys; y++ {
+				readRow(row, m, b.Min.X, b.Min.Y+y)
+				for x, p := range row {
+					sum := &sums[x/f]
+					for i, v := range p {
+						sum[i] += uint64(v)
+					}
+				}
+			}
+			for sx, sum := range sums {
+				xs := f
+				if sx*f+f > w {
+					xs = w - sx*f
+				}
+				n := uint64(xs * ys)
+				s.SetRGBA64(sx, sy, color.RGBA64{
+					uint16((sum[0] + n/2) / n),
+					uint16((sum[1] + n/2) / n),
+					uint16((sum[2] + n/2) / n),
+					uint16((sum[3] + n/2) / n),
+				})
+			}
+		}
+		return 0
+	})
+	return s
+}
+
+// enlargeRows writes rows [y0, y1) of diff out of difference image m
+// of images shrunk by factor f, repeating each of its pixels f x f times.
+func enlargeRows(diff *image.NRGBA, m image.Image, f, y0, y1 int) {
+	b := m.Bounds()
+	nm, isNRGBA := m.(*image.NRGBA)
+	for y := y0; y < y1; y++ {
+		out := diff.Pix[diff.PixOffset(0, y):]
+		for x := 0; x < diff.Rect.Dx(); x++ {
+			sx, sy := b.Min.X+x/f, b.Min.Y+y/f
+			if isNRGBA {
+				copy(out[4*x:4*x+4], nm.Pix[nm.PixOffset(sx, sy):])
+				continue
+			}
+			c := color.NRGBAModel.Convert(m.At(sx, sy)).(color.NRGBA)
+			copy(out[4*x:], []uint8{c.R, c.G, c.B, c.A})
+		}
+	}
+}
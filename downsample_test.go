@@ -0,0 +1,118 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestDownsampled(t *testing.T) {
+	r := image.Rect(0, 0, 8, 6)
+	a := image.NewRGBA(r)
+	draw.Draw(a, r, image.NewUniform(color.White), image.ZP, draw.Src)
+	b := image.NewRGBA(r)
+	copy(b.Pix, a.Pix)
+	draw.Draw(b, image.Rect(2, 2, 4, 4), image.NewUniform(color.Black), image.ZP, draw.Src)
+
+	// shrunk by 2 to 4 x 3, where only pixel 1, 1 differs
+	diff, n, err := NewDownsampled(NewBinary(), 4).Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("n = %d; want 4", n)
+	}
+	if diff.Bounds() != r {
+		t.Fatalf("diff bounds = %v; want %v", diff.Bounds(), r)
+	}
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			want := image.Pt(x, y).In(image.Rect(2, 2, 4, 4))
+			if got := marked(diff.At(x, y)); got != want {
+				t.Errorf("%d, %d: marked = %v; want %v", x, y, got, want)
+			}
+		}
+	}
+
+	// small enough images are compared as they are
+	_, n, err = NewDownsampled(NewBinary(), 8).Compare(a, b)
+	if err != nil || n != 4 {
+		t.Errorf("unscaled: n = %d, err = %v; want 4", n, err)
+	}
+
+	// a difference within a shrunk pixel is averaged out
+	c := image.NewRGBA(r)
+	copy(c.Pix, a.Pix)
+	c.Set(0, 0, color.RGBA{0xfe, 0xfe, 0xfe, 0xff})
+	_, n, err = NewDownsampled(NewDefaultPerceptual(), 4).Compare(a, c)
+	if err != nil || n != 0 {
+		t.Errorf("averaged: n = %d, err = %v; want 0", n, err)
+	}
+}
+
+func TestDownsampledErrors(t *testing.T) {
+	// both shrink to 5 x 5
+	a := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	b := image.NewRGBA(image.Rect(0, 0, 9, 10))
+	if _, _, err := NewDownsampled(NewBinary(), 5).Compare(a, b); err != ErrSize {
+		t.Errorf("err = %v; want ErrSize", err)
+	}
+	if _, _, err := NewDownsampled(NewBinary(), 0).Compare(a, a); err == nil {
+		t.Error("maxDim 0: err = nil")
+	}
+}
+
+func TestDownsampledEmpty(t *testing.T) {
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 0, 5), image.Rect(0, 0, 5, 0), image.Rect(0, 0, 0, 0)} {
+		m := image.NewRGBA(r)
+		diff, n, err := NewDownsampled(NewBinary(), 4).Compare(m, m)
+		if err != nil || n != 0 {
+			t.Errorf("%v: n = %d, err = %v; want 0", r, n, err)
+			continue
+		}
+		if diff.Bounds() != r {
+			t.Errorf("%v: diff bounds = %v", r, diff.Bounds())
+		}
+	}
+}
+
+func TestShrink(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	m.SetRGBA(0, 0, color.RGBA{0xff, 0, 0, 0xff})
+	m.SetRGBA(1, 0, color.RGBA{0, 0, 0, 0})
+	m.SetRGBA(2, 0, color.RGBA{0, 0x80, 0, 0x80})
+	s := shrink(m, 2)
+	if b := s.Bounds(); b != image.Rect(0, 0, 2, 1) {
+		t.Fatalf("bounds = %v", b)
+	}
+	want := []color.RGBA64{{0x8000, 0, 0, 0x8000}, {0, 0x8080, 0, 0x8080}}
+	for x, c := range want {
+		if got := s.At(x, 0); got != c {
+			t.Errorf("%d: %v; want %v", x, got, c)
+		}
+	}
+
+	// large factors
+	w := image.NewGray(image.Rect(0, 0, 600, 300))
+	for i := range w.Pix {
+		w.Pix[i] = 0xff
+	}
+	if c := shrink(w, 600).At(0, 0); c != (color.RGBA64{0xffff, 0xffff, 0xffff, 0xffff}) {
+		t.Errorf("factor 600: %v; want white", c)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"math"
+)
+
+// NRGBA bytes of edges only in the second image in edge diff images.
+var addedEdgePixel = [4]uint8{0, 0xff, 0, 0xff}
+
+type edge struct {
+	threshold float64
+	// gamma decoding table
+	lut  *gammaLUT
+	opts options
+}
+
+// NewEdge creates a new Differ comparing edges of images, ignoring
+// changes of colors and textures which don't move them. Edges are
+// found with the Sobel operator on luminance, computed as by the
+// perceptual algorithm with the default gamma of 2.2 and scaled
+// to [0, 1]. Pixels with gradient magnitude above threshold are edges.
+// Magnitudes are at most 4√2, and 4 next to sharp black and white
+// edges.
+//
+// Pixels which are edges in only one of the images are counted
+// as different. In the difference image, edges removed from the
+// first image are red and edges added in the second one are green.
+func NewEdge(threshold float64, opts ...Option) Differ {
+	return &edge{threshold: threshold, lut: newGammaLUT(2.2), opts: newOptions(opts)}
+}
+
+// Compare compares edges of a and b.
+func (d *edge) Compare(a, b image.Image) (image.Image, int, error) {
+	return d.compareTimed(a, b, new(PhaseTimings))
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *edge) CompareInto(dst *image.NRGBA, a, b image.Image) (int, error) {
+	return d.compareInto(dst, a, b, new(PhaseTimings))
+}
+
+func (d *edge) compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error) {
+	diff := new(image.NRGBA)
+	n, err := d.compareInto(diff, a, b, t)
+	if err != nil {
+		return nil, -1, err
+	}
+	return diff, n, nil
+}
+
+func (d *edge) compareInto(diff *image.NRGBA, a, b image.Image, t *PhaseTimings) (int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return -1, ErrSize
+	}
+	if err := d.opts.checkSize(ab); err != nil {
+		return -1, err
+	}
+	resize(diff, w, h)
+	if sameImage(a, b) {
+		fillPass(diff)
+		return 0, nil
+	}
+
+	p := newPhases("edge", ab, t)
+	la, lb := newRows(w, h), newRows(w, h)
+	p.run("convert", &t.Convert, func() {
+		parallel(d.opts.workers(), func(int) {
+			labRowsInto(la, labImage{}, a, d.lut, 1, 0)
+		}, func(int) {
+			labRowsInto(lb, labImage{}, b, d.lut, 1, 0)
+		})
+	})
+	var npix int
+	p.run("compare", &t.Compare, func() {
+		xs := make([]int, w+2)
+		mirrorTable(xs, w, 1)
+		npix = forBands(d.opts.workers(), h, func(y0, y1 int) int {
+			return d.compareRows(diff, la, lb, xs, y0, y1)
+		})
+	})
+	return npix, nil
+}
+
+// compareRows compares edges of rows [y0, y1) of luminance la and lb,
+// writing them to diff, and returns the number of different pixels.
+// xs maps x+1 to mirror(x, w) for x in [-1, w].
+func (d *edge) compareRows(diff *image.NRGBA, la, lb [][]float64, xs []int, y0, y1 int) int {
+	h := len(la)
+	npix := 0
+	for y := y0; y < y1; y++ {
+		up, down := mirror(y-1, h), mirror(y+1, h)
+		out := diff.Pix[diff.PixOffset(0, y):]
+		for x := range la[y] {
+			ea := sobel(la[up], la[y], la[down], xs, x) > d.threshold
+			eb := sobel(lb[up], lb[y], lb[down], xs, x) > d.threshold
+			c := passPixel
+			switch {
+			case ea && !eb:
+				c = failPixel
+				npix++
+			case eb && !ea:
+				c = addedEdgePixel
+				npix++
+			}
+			copy(out[4*x:], c[:])
+		}
+	}
+	return npix
+}
+
+// sobel returns the gradient magnitude of pixel x of row r,
+// given the rows above and below it, see compareRows for xs.
+func sobel(above, r, below []float64, xs []int, x int) float64 {
+	l, c, rt := xs[x], xs[x+1], xs[x+2]
+	gx := above[rt] + 2*r[rt] + below[rt] - above[l] - 2*r[l] - below[l]
+	gy := below[l] + 2*below[c] + below[rt] - above[l] - 2*above[c] - above[rt]
+	return math.Sqrt(gx*gx + gy*gy)
+}
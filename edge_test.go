@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// square returns a w x h image of color bg with a 5 x 5 square
+// of color fg at x, y.
+func square(w, h, x, y int, bg, fg color.Color) *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(m, m.Rect, image.NewUniform(bg), image.ZP, draw.Src)
+	draw.Draw(m, image.Rect(x, y, x+5, y+5), image.NewUniform(fg), image.ZP, draw.Src)
+	return m
+}
+
+func TestEdge(t *testing.T) {
+	black := color.RGBA{0, 0, 0, 0xff}
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	a := square(20, 16, 4, 4, white, black)
+
+	// the same layout in other colors
+	b := square(20, 16, 4, 4, color.RGBA{0xe0, 0xe0, 0xe0, 0xff}, color.RGBA{0x10, 0x10, 0x60, 0xff})
+	if _, n, err := NewEdge(0.5).Compare(a, b); err != nil || n != 0 {
+		t.Errorf("recolored: n = %d, err = %v; want 0", n, err)
+	}
+
+	// moved to the right
+	b = square(20, 16, 10, 4, white, black)
+	diff, n, err := NewEdge(0.5).Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Error("moved: n = 0")
+	}
+	m := diff.(*image.NRGBA)
+	var red, green int
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 20; x++ {
+			switch m.NRGBAAt(x, y) {
+			case color.NRGBA{0xff, 0, 0, 0xff}:
+				red++
+				if x > 10 {
+					t.Errorf("removed edge at %d, %d", x, y)
+				}
+			case color.NRGBA{0, 0xff, 0, 0xff}:
+				green++
+				if x < 8 {
+					t.Errorf("added edge at %d, %d", x, y)
+				}
+			}
+		}
+	}
+	if red == 0 || green == 0 || red+green != n {
+		t.Errorf("moved: %d red and %d green pixels, n = %d", red, green, n)
+	}
+}
+
+func TestEdgeBorders(t *testing.T) {
+	// the left column black, mirrored at the border, so that
+	// only the column right of it is an edge
+	r := image.Rect(0, 0, 6, 3)
+	a := image.NewGray(r)
+	for i := range a.Pix {
+		a.Pix[i] = 0xff
+	}
+	b := image.NewGray(r)
+	copy(b.Pix, a.Pix)
+	for y := 0; y < r.Dy(); y++ {
+		b.SetGray(0, y, color.Gray{0})
+	}
+	diff, n, err := NewEdge(3.9).Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != r.Dy() {
+		t.Errorf("n = %d; want %d", n, r.Dy())
+	}
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			if got, want := marked(diff.At(x, y)), x == 1; got != want {
+				t.Errorf("%d, %d: marked = %v; want %v", x, y, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,401 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package exr implements a decoder for a subset of OpenEXR images.
+//
+// Supported are single-part scanline images, uncompressed or ZIP
+// compressed, with R, G, B, A or Y channels of half, float or uint
+// pixel type and no subsampling. Decoded images are *RGBA, holding
+// linear-light float32 samples.
+//
+// Importing this package registers the "exr" format with image.Decode.
+package exr
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+const (
+	magic = "\x76\x2f\x31\x01"
+	// maxPixels bounds image size accepted by Decode
+	// to avoid huge allocations from corrupt headers.
+	maxPixels = 1 << 26
+)
+
+// ErrFormat is returned when the input is not a valid OpenEXR image.
+var ErrFormat = errors.New("exr: invalid format")
+
+// UnsupportedError is returned for valid OpenEXR images
+// using features this package does not implement.
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string {
+	return "exr: unsupported " + string(e)
+}
+
+func init() {
+	image.RegisterFormat("exr", magic, Decode, DecodeConfig)
+}
+
+// Pixel types.
+const (
+	ptUint  = 0
+	ptHalf  = 1
+	ptFloat = 2
+)
+
+// Compression methods.
+const (
+	compNone = 0
+	compZIPS = 2 // zlib, one scanline per block
+	compZIP  = 3 // zlib, 16 scanlines per block
+)
+
+// Version field flags.
+const (
+	flagTiled     = 0x200
+	flagDeep      = 0x800
+	flagMultipart = 0x1000
+)
+
+type channel struct {
+	name      string
+	pixelType int32
+}
+
+// size returns the number of bytes a single sample occupies.
+func (c channel) size() int {
+	if c.pixelType == ptHalf {
+		return 2
+	}
+	return 4
+}
+
+type header struct {
+	channels    []channel
+	compression byte
+	dataWindow  image.Rectangle
+}
+
+// linesPerBlock returns the number of scanlines stored in a single chunk.
+func (h *header) linesPerBlock() int {
+	if h.compression == compZIP {
+		return 16
+	}
+	return 1
+}
+
+func readHeader(r *bufio.Reader) (*header, error) {
+	var pre [8]byte
+	if _, err := io.ReadFull(r, pre[:]); err != nil || string(pre[:4]) != magic {
+		return nil, ErrFormat
+	}
+	version := binary.LittleEndian.Uint32(pre[4:])
+	if version&0xff != 2 {
+		return nil, UnsupportedError(fmt.Sprintf("version %d", version&0xff))
+	}
+	if version&(flagTiled|flagDeep|flagMultipart) != 0 {
+		return nil, UnsupportedError("tiled, deep or multi-part image")
+	}
+
+	h := &header{}
+	var haveChannels, haveCompression, haveWindow bool
+	for {
+		name, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			break
+		}
+		typ, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		var size int32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil || size < 0 || size > 1<<24 {
+			return nil, ErrFormat
+		}
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, ErrFormat
+		}
+		switch {
+		case name == "channels" && typ == "chlist":
+			if h.channels, err = parseChannels(value); err != nil {
+				return nil, err
+			}
+			haveChannels = true
+		case name == "compression" && typ == "compression" && size == 1:
+			h.compression = value[0]
+			haveCompression = true
+		case name == "dataWindow" && typ == "box2i" && size == 16:
+			var b [4]int32
+			for i := range b {
+				b[i] = int32(binary.LittleEndian.Uint32(value[4*i:]))
+			}
+			dx, dy := int64(b[2])-int64(b[0])+1, int64(b[3])-int64(b[1])+1
+			// Max is exclusive, so must fit in an int32 as well
+			if dx < 1 || dy < 1 || dx*dy > maxPixels || b[2] == math.MaxInt32 || b[3] == math.MaxInt32 {
+				return nil, ErrFormat
+			}
+			h.dataWindow = image.Rect(int(b[0]), int(b[1]), int(b[2])+1, int(b[3])+1)
+			haveWindow = true
+		}
+	}
+	if !haveChannels || !haveCompression || !haveWindow {
+		return nil, ErrFormat
+	}
+	switch h.compression {
+	case compNone, compZIPS, compZIP:
+	default:
+		return nil, UnsupportedError(fmt.Sprintf("compression %d", h.compression))
+	}
+	return h, nil
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	s, err := r.ReadString(0)
+	if err != nil || len(s) > 256 {
+		return "", ErrFormat
+	}
+	return s[:len(s)-1], nil
+}
+
+func parseChannels(b []byte) ([]channel, error) {
+	var chans []channel
+	for len(b) > 0 && b[0] != 0 {
+		i := bytes.IndexByte(b, 0)
+		if i < 0 || len(b) < i+1+16 {
+			return nil, ErrFormat
+		}
+		c := channel{
+			name:      string(b[:i]),
+			pixelType: int32(binary.LittleEndian.Uint32(b[i+1:])),
+		}
+		xs := binary.LittleEndian.Uint32(b[i+9:])
+		ys := binary.LittleEndian.Uint32(b[i+13:])
+		if c.pixelType < ptUint || c.pixelType > ptFloat {
+			return nil, ErrFormat
+		}
+		if xs != 1 || ys != 1 {
+			return nil, UnsupportedError("channel subsampling")
+		}
+		chans = append(chans, c)
+		b = b[i+17:]
+	}
+	if len(chans) == 0 {
+		return nil, ErrFormat
+	}
+	return chans, nil
+}
+
+// DecodeConfig returns the color model and dimensions of an OpenEXR image
+// without decoding the entire image.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	h, err := readHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{
+		ColorModel: color.RGBA64Model,
+		Width:      h.dataWindow.Dx(),
+		Height:     h.dataWindow.Dy(),
+	}, nil
+}
+
+// Decode reads an OpenEXR image from r and returns it as *RGBA.
+// Missing color channels are zero, except for images with only
+// a Y channel which are decoded as gray. Missing alpha is 1.
+func Decode(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	h, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	rect := h.dataWindow
+	w := rect.Dx()
+	lpb := h.linesPerBlock()
+	nchunks := (rect.Dy() + lpb - 1) / lpb
+	if nchunks < 1 || nchunks > maxPixels {
+		return nil, ErrFormat
+	}
+	// chunks are read sequentially, assuming increasing line order,
+	// so the offset table is only skipped; reading it in full before
+	// allocating the image rejects truncated input early
+	if _, err := br.Discard(8 * nchunks); err != nil {
+		return nil, ErrFormat
+	}
+
+	// images with a Y channel and no color channels are gray
+	var hasY, hasRGB bool
+	for _, c := range h.channels {
+		switch c.name {
+		case "Y":
+			hasY = true
+		case "R", "G", "B":
+			hasRGB = true
+		}
+	}
+	gray := hasY && !hasRGB
+	// channel index in RGBA order for each stored channel, -1 if ignored
+	dst := make([]int, len(h.channels))
+	lineSize := 0
+	for i, c := range h.channels {
+		dst[i] = -1
+		switch c.name {
+		case "R":
+			dst[i] = 0
+		case "G":
+			dst[i] = 1
+		case "B":
+			dst[i] = 2
+		case "A":
+			dst[i] = 3
+		case "Y":
+			if gray {
+				dst[i] = 0
+			}
+		}
+		lineSize += w * c.size()
+	}
+
+	m := NewRGBA(rect)
+	for i := 3; i < len(m.Pix); i += 4 {
+		m.Pix[i] = 1
+	}
+	done := make([]bool, nchunks)
+	for n := 0; n < nchunks; n++ {
+		var ch [8]byte
+		if _, err := io.ReadFull(br, ch[:]); err != nil {
+			return nil, ErrFormat
+		}
+		y0 := int(int32(binary.LittleEndian.Uint32(ch[:])))
+		size := int32(binary.LittleEndian.Uint32(ch[4:]))
+		k := (y0 - rect.Min.Y) / lpb
+		if y0 < rect.Min.Y || y0 >= rect.Max.Y || (y0-rect.Min.Y)%lpb != 0 || done[k] || size < 0 {
+			return nil, ErrFormat
+		}
+		done[k] = true
+		nlines := lpb
+		if y0+nlines > rect.Max.Y {
+			nlines = rect.Max.Y - y0
+		}
+		want := nlines * lineSize
+		if int(size) > want+want/2+1024 {
+			return nil, ErrFormat
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, ErrFormat
+		}
+		// data which didn't compress well is stored as is
+		if h.compression != compNone && int(size) < want {
+			if data, err = unzip(data, want); err != nil {
+				return nil, err
+			}
+		}
+		if len(data) != want {
+			return nil, ErrFormat
+		}
+		for l := 0; l < nlines; l++ {
+			row := m.Pix[m.PixOffset(rect.Min.X, y0+l):]
+			for i, c := range h.channels {
+				for x := 0; x < w; x++ {
+					v := sample(data, c.pixelType)
+					data = data[c.size():]
+					if dst[i] >= 0 {
+						row[4*x+dst[i]] = v
+					}
+				}
+			}
+			if gray {
+				for x := 0; x < w; x++ {
+					row[4*x+1], row[4*x+2] = row[4*x], row[4*x]
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// sample decodes a single little-endian sample of pixel type t from b.
+func sample(b []byte, t int32) float32 {
+	switch t {
+	case ptHalf:
+		return halfToFloat(binary.LittleEndian.Uint16(b))
+	case ptFloat:
+		return math.Float32frombits(binary.LittleEndian.Uint32(b))
+	}
+	return float32(binary.LittleEndian.Uint32(b))
+}
+
+// unzip inflates ZIP compressed chunk data of the uncompressed size n,
+// and reverses the predictor and byte reordering applied by the encoder.
+func unzip(data []byte, n int) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrFormat
+	}
+	t, err := ioutil.ReadAll(io.LimitReader(zr, int64(n)+1))
+	zr.Close()
+	if err != nil || len(t) != n {
+		return nil, ErrFormat
+	}
+	for i := 1; i < n; i++ {
+		t[i] = byte(int(t[i-1]) + int(t[i]) - 128)
+	}
+	out := make([]byte, n)
+	half := (n + 1) / 2
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			out[i] = t[i/2]
+		} else {
+			out[i] = t[half+i/2]
+		}
+	}
+	return out, nil
+}
+
+// halfToFloat converts an IEEE 754 half precision number to float32.
+func halfToFloat(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h) & 0x3ff
+	switch {
+	case exp == 0 && mant == 0:
+		return math.Float32frombits(sign)
+	case exp == 0:
+		// subnormal: normalize the mantissa
+		e := uint32(127 - 15 + 1)
+		for mant&0x400 == 0 {
+			mant <<= 1
+			e--
+		}
+		return math.Float32frombits(sign | e<<23 | (mant&0x3ff)<<13)
+	case exp == 0x1f:
+		return math.Float32frombits(sign | 0xff<<23 | mant<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+}
@@ -0,0 +1,230 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/crhym3/imgdiff"
+)
+
+// ramp is the function used to generate testdata fixtures,
+// except for ramp.exr and ramp_spot.exr.
+func ramp(x, y, c int) float32 {
+	v := [4]float32{0.25, 0.5, 1, 1}[c]
+	if c == 3 {
+		return 1
+	}
+	return v * float32((x+1)*(y+1)) / 4
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		file string
+		w, h int
+		gray bool
+	}{
+		{"rgb_half.exr", 3, 2, false},
+		{"rgba_float_zip.exr", 5, 20, false},
+		{"y_half_zips.exr", 4, 3, true},
+	}
+	for _, test := range tests {
+		m, err := readTestImage(test.file)
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+			continue
+		}
+		p, ok := m.(*RGBA)
+		if !ok {
+			t.Errorf("%s: decoded %T; want *RGBA", test.file, m)
+			continue
+		}
+		if p.Bounds() != image.Rect(0, 0, test.w, test.h) {
+			t.Errorf("%s: bounds = %v", test.file, p.Bounds())
+			continue
+		}
+		for y := 0; y < test.h; y++ {
+			for x := 0; x < test.w; x++ {
+				var got [4]float32
+				got[0], got[1], got[2], got[3] = p.FloatAt(x, y)
+				for c := 0; c < 4; c++ {
+					want := ramp(x, y, c)
+					if test.gray && c < 3 {
+						want = ramp(x, y, 1)
+					}
+					// half precision has 10 bits of mantissa
+					if math.Abs(float64(got[c]-want)) > 1e-3*float64(want) {
+						t.Errorf("%s: (%d, %d)[%d] = %g; want %g", test.file, x, y, c, got[c], want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "rgba_float_zip.exr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 4, 8, 50, len(data) / 2, len(data) - 1} {
+		if _, err := Decode(bytes.NewReader(data[:n])); err == nil {
+			t.Errorf("Decode(data[:%d]) succeeded; want error", n)
+		}
+	}
+}
+
+// testHeader returns an OpenEXR header of an uncompressed image
+// with a single R channel and the data window (x0, y0)-(x1, y1).
+func testHeader(x0, y0, x1, y1 int32) []byte {
+	attr := func(name, typ string, value []byte) []byte {
+		b := append([]byte(name+"\x00"+typ+"\x00"), 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(value)))
+		return append(b, value...)
+	}
+	chlist := append([]byte("R\x00"), make([]byte, 16)...)
+	chlist[2] = ptHalf
+	chlist[10], chlist[14] = 1, 1
+	chlist = append(chlist, 0)
+	window := make([]byte, 16)
+	for i, v := range []int32{x0, y0, x1, y1} {
+		binary.LittleEndian.PutUint32(window[4*i:], uint32(v))
+	}
+	b := []byte(magic + "\x02\x00\x00\x00")
+	b = append(b, attr("channels", "chlist", chlist)...)
+	b = append(b, attr("compression", "compression", []byte{compNone})...)
+	b = append(b, attr("dataWindow", "box2i", window)...)
+	return append(b, 0)
+}
+
+func TestDecodeHostileHeader(t *testing.T) {
+	tests := []struct {
+		x0, y0, x1, y1 int32
+	}{
+		{0, 0, 1<<24 - 2, 1<<24 - 2},
+		{0, 0, 1<<13 - 1, 1 << 13},
+		{-1 << 31, 0, 1<<31 - 1, 0},
+		{0, 0, 1<<31 - 1, 0},
+		{0, 1<<31 - 1, 0, 1<<31 - 1},
+		{1, 0, 0, 0},
+	}
+	for _, test := range tests {
+		data := testHeader(test.x0, test.y0, test.x1, test.y1)
+		if _, err := DecodeConfig(bytes.NewReader(data)); err != ErrFormat {
+			t.Errorf("DecodeConfig(%v) err = %v; want ErrFormat", test, err)
+		}
+		if _, err := Decode(bytes.NewReader(data)); err != ErrFormat {
+			t.Errorf("Decode(%v) err = %v; want ErrFormat", test, err)
+		}
+	}
+	// a window within bounds with a missing offset table
+	// fails before allocating the image
+	data := testHeader(0, 0, 1<<13-1, 1<<13-1)
+	if _, err := DecodeConfig(bytes.NewReader(data)); err != nil {
+		t.Fatalf("DecodeConfig: %v", err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := Decode(bytes.NewReader(data)); err != ErrFormat {
+		t.Errorf("Decode: err = %v; want ErrFormat", err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("Decode allocated %d bytes", n)
+	}
+}
+
+func TestHalfToFloat(t *testing.T) {
+	tests := []struct {
+		h uint16
+		f float32
+	}{
+		{0x0000, 0},
+		{0x3c00, 1},
+		{0xc000, -2},
+		{0x3555, 0.333251953125},
+		{0x7bff, 65504},
+		{0x0001, 5.960464477539063e-08},
+		{0x03ff, 6.097555160522461e-05},
+	}
+	for _, test := range tests {
+		if f := halfToFloat(test.h); f != test.f {
+			t.Errorf("halfToFloat(%#04x) = %g; want %g", test.h, f, test.f)
+		}
+	}
+	if f := halfToFloat(0x7c00); !math.IsInf(float64(f), 1) {
+		t.Errorf("halfToFloat(0x7c00) = %g; want +Inf", f)
+	}
+	if f := halfToFloat(0x7e00); !math.IsNaN(float64(f)) {
+		t.Errorf("halfToFloat(0x7e00) = %g; want NaN", f)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	a, err := readTestImage("ramp.exr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("ramp_spot.exr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		d    imgdiff.Differ
+		a, b image.Image
+		n    int
+	}{
+		{imgdiff.NewBinary(), a, a, 0},
+		{imgdiff.NewBinary(), a, b, 1},
+		{imgdiff.NewBinary(imgdiff.WithFloatEpsilon(1)), a, b, 0},
+		{imgdiff.NewDefaultPerceptual(), a, a, 0},
+	}
+	for i, test := range tests {
+		_, n, err := test.d.Compare(test.a, test.b)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		if n != test.n {
+			t.Errorf("%d: n = %d; want %d", i, n, test.n)
+		}
+	}
+	// values above 1 are only distinguishable without clamping
+	_, n, err := imgdiff.NewDefaultPerceptual().Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Error("perceptual: n = 0; want > 0")
+	}
+}
+
+func readTestImage(name string) (image.Image, error) {
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, _, err := image.Decode(f)
+	return m, err
+}
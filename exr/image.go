@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exr
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// displayGamma is used to encode linear samples returned by RGBA.At.
+const displayGamma = 2.2
+
+// RGBA is an in-memory image of linear-light, alpha-premultiplied float32
+// samples. Unlike the color types of package image, samples are not
+// limited to [0, 1].
+type RGBA struct {
+	// Pix holds the image's samples, in R, G, B, A order.
+	// The pixel at (x, y) starts at Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)*4].
+	Pix []float32
+	// Stride is the Pix stride (in samples) between vertically adjacent pixels.
+	Stride int
+	// Rect is the image's bounds.
+	Rect image.Rectangle
+}
+
+// NewRGBA returns a new RGBA image with the given bounds.
+func NewRGBA(r image.Rectangle) *RGBA {
+	return &RGBA{
+		Pix:    make([]float32, 4*r.Dx()*r.Dy()),
+		Stride: 4 * r.Dx(),
+		Rect:   r,
+	}
+}
+
+// ColorModel returns color.RGBA64Model, the model of colors returned by At.
+func (p *RGBA) ColorModel() color.Model {
+	return color.RGBA64Model
+}
+
+// Bounds returns the image bounds.
+func (p *RGBA) Bounds() image.Rectangle {
+	return p.Rect
+}
+
+// PixOffset returns the index of the first element of Pix
+// that corresponds to the pixel at (x, y).
+func (p *RGBA) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x-p.Rect.Min.X)*4
+}
+
+// FloatAt returns linear, alpha-premultiplied samples at (x, y).
+func (p *RGBA) FloatAt(x, y int) (r, g, b, a float32) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return 0, 0, 0, 0
+	}
+	i := p.PixOffset(x, y)
+	s := p.Pix[i : i+4 : i+4]
+	return s[0], s[1], s[2], s[3]
+}
+
+// At returns the color at (x, y), clamped to [0, 1] and gamma-encoded
+// for display with gamma of 2.2.
+func (p *RGBA) At(x, y int) color.Color {
+	r, g, b, a := p.FloatAt(x, y)
+	alpha := clamp(float64(a))
+	if alpha == 0 {
+		return color.RGBA64{}
+	}
+	enc := func(v float32) uint16 {
+		// un-premultiply, encode and premultiply again
+		c := math.Pow(clamp(float64(v)/alpha), 1/displayGamma)
+		return uint16(c*alpha*0xffff + 0.5)
+	}
+	return color.RGBA64{enc(r), enc(g), enc(b), uint16(alpha*0xffff + 0.5)}
+}
+
+func clamp(v float64) float64 {
+	switch {
+	case v > 1:
+		return 1
+	case v > 0:
+		return v
+	}
+	// negative or NaN
+	return 0
+}
@@ -0,0 +1,74 @@
+# Generates the OpenEXR fixtures in this directory.
+# Run from this directory: python3 mkexr.py
+import struct, zlib
+
+def attr(name, typ, value):
+    return name.encode()+b'\0'+typ.encode()+b'\0'+struct.pack('<i', len(value))+value
+
+def chlist(chans):
+    b = b''
+    for name, pt in chans:
+        b += name.encode()+b'\0'+struct.pack('<iB3xii', pt, 0, 1, 1)
+    return b+b'\0'
+
+def sample(v, pt):
+    return struct.pack('<e', v) if pt == 1 else struct.pack('<f', v) if pt == 2 else struct.pack('<I', int(v))
+
+def zipc(raw):
+    n = len(raw)
+    t = bytearray(n)
+    half = (n+1)//2
+    t[:half] = raw[0::2]
+    t[half:] = raw[1::2]
+    out = bytearray(t)
+    for i in range(1, n):
+        d = t[i] - t[i-1] + 128 + 256
+        out[i] = d & 0xff
+    return zlib.compress(bytes(out))
+
+def write(path, w, h, chans, comp, pixel):
+    """pixel(x, y, name) -> float"""
+    chans = sorted(chans)
+    hdr = b'\x76\x2f\x31\x01' + struct.pack('<I', 2)
+    hdr += attr('channels', 'chlist', chlist(chans))
+    hdr += attr('compression', 'compression', bytes([comp]))
+    hdr += attr('dataWindow', 'box2i', struct.pack('<4i', 0, 0, w-1, h-1))
+    hdr += attr('displayWindow', 'box2i', struct.pack('<4i', 0, 0, w-1, h-1))
+    hdr += attr('lineOrder', 'lineOrder', b'\0')
+    hdr += attr('pixelAspectRatio', 'float', struct.pack('<f', 1))
+    hdr += attr('screenWindowCenter', 'v2f', struct.pack('<2f', 0, 0))
+    hdr += attr('screenWindowWidth', 'float', struct.pack('<f', 1))
+    hdr += b'\0'
+    lpb = 16 if comp == 3 else 1
+    chunks = []
+    for y0 in range(0, h, lpb):
+        raw = b''
+        for y in range(y0, min(h, y0+lpb)):
+            for name, pt in chans:
+                for x in range(w):
+                    raw += sample(pixel(x, y, name), pt)
+        data = raw
+        if comp != 0:
+            z = zipc(raw)
+            if len(z) < len(raw):
+                data = z
+        chunks.append(struct.pack('<ii', y0, len(data)) + data)
+    off = len(hdr) + 8*len(chunks)
+    table = b''
+    for c in chunks:
+        table += struct.pack('<Q', off)
+        off += len(c)
+    open(path, 'wb').write(hdr + table + b''.join(chunks))
+
+def ramp(x, y, name):
+    v = {'R': 0.25, 'G': 0.5, 'B': 1.0, 'A': 1.0, 'Y': 0.5}[name]
+    if name == 'A':
+        return 1.0
+    return v * (x + 1) * (y + 1) / 4
+
+write('rgb_half.exr', 3, 2, [('R',1),('G',1),('B',1)], 0, ramp)
+write('rgba_float_zip.exr', 5, 20, [('R',2),('G',2),('B',2),('A',2)], 3, ramp)
+write('y_half_zips.exr', 4, 3, [('Y',1)], 2, ramp)
+# comparison pair: HDR ramp and the same with one brightened pixel
+write('ramp.exr', 32, 32, [('R',1),('G',1),('B',1)], 3, lambda x,y,n: (x+y)/8.0)
+write('ramp_spot.exr', 32, 32, [('R',1),('G',1),('B',1)], 3, lambda x,y,n: (x+y)/8.0 + (4.0 if (x,y)==(10,10) else 0))
@@ -0,0 +1,124 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package farbfeld implements a decoder and encoder for farbfeld images.
+//
+// Farbfeld is a lossless image format of 16-bit non-premultiplied RGBA
+// samples: an 8-byte "farbfeld" magic, big-endian uint32 width and height,
+// followed by big-endian uint16 R, G, B, A samples in row-major order.
+// See https://tools.suckless.org/farbfeld/.
+//
+// Importing this package registers the "farbfeld" format with image.Decode.
+package farbfeld
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+const (
+	magic     = "farbfeld"
+	headerLen = len(magic) + 8
+	// maxPixels bounds image size accepted by Decode
+	// to avoid huge allocations from corrupt headers.
+	maxPixels = 1 << 28
+)
+
+// ErrFormat is returned when the input is not a valid farbfeld image.
+var ErrFormat = errors.New("farbfeld: invalid format")
+
+func init() {
+	image.RegisterFormat("farbfeld", magic, Decode, DecodeConfig)
+}
+
+func readHeader(r io.Reader) (w, h int, err error) {
+	var hdr [headerLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, ErrFormat
+	}
+	if string(hdr[:len(magic)]) != magic {
+		return 0, 0, ErrFormat
+	}
+	w64 := uint64(binary.BigEndian.Uint32(hdr[8:]))
+	h64 := uint64(binary.BigEndian.Uint32(hdr[12:]))
+	if w64*h64 > maxPixels {
+		return 0, 0, ErrFormat
+	}
+	return int(w64), int(h64), nil
+}
+
+// DecodeConfig returns the color model and dimensions of a farbfeld image
+// without decoding the entire image.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	w, h, err := readHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.NRGBA64Model, Width: w, Height: h}, nil
+}
+
+// Decode reads a farbfeld image from r and returns it as *image.NRGBA64.
+func Decode(r io.Reader) (image.Image, error) {
+	w, h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	m := image.NewNRGBA64(image.Rect(0, 0, w, h))
+	// NRGBA64 shares the farbfeld sample layout
+	if _, err := io.ReadFull(r, m.Pix); err != nil {
+		return nil, ErrFormat
+	}
+	return m, nil
+}
+
+// Encode writes m to w in farbfeld format.
+// Colors are converted to 16-bit non-premultiplied RGBA.
+func Encode(w io.Writer, m image.Image) error {
+	b := m.Bounds()
+	bw := bufio.NewWriter(w)
+	var hdr [headerLen]byte
+	copy(hdr[:], magic)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(hdr[12:], uint32(b.Dy()))
+	if _, err := bw.Write(hdr[:]); err != nil {
+		return err
+	}
+	if n, ok := m.(*image.NRGBA64); ok {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i := n.PixOffset(b.Min.X, y)
+			if _, err := bw.Write(n.Pix[i : i+8*b.Dx()]); err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	}
+	var px [8]byte
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(m.At(x, y)).(color.NRGBA64)
+			binary.BigEndian.PutUint16(px[0:], c.R)
+			binary.BigEndian.PutUint16(px[2:], c.G)
+			binary.BigEndian.PutUint16(px[4:], c.B)
+			binary.BigEndian.PutUint16(px[6:], c.A)
+			if _, err := bw.Write(px[:]); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
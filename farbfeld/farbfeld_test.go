@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package farbfeld
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	sizes := []image.Point{{0, 0}, {1, 1}, {0, 5}, {5, 0}, {1, 17}, {17, 1}, {13, 7}}
+	for _, size := range sizes {
+		r := image.Rect(0, 0, size.X, size.Y)
+		nrgba64 := image.NewNRGBA64(r)
+		rnd.Read(nrgba64.Pix)
+		rgba := image.NewRGBA(r)
+		rnd.Read(rgba.Pix)
+		gray16 := image.NewGray16(r)
+		rnd.Read(gray16.Pix)
+		// sub-image with non-zero origin
+		sub := image.NewNRGBA64(r.Inset(-3))
+		rnd.Read(sub.Pix)
+
+		for _, m := range []image.Image{nrgba64, rgba, gray16, sub.SubImage(r)} {
+			var buf bytes.Buffer
+			if err := Encode(&buf, m); err != nil {
+				t.Fatal(err)
+			}
+			mb := m.Bounds()
+			if n := buf.Len(); n != headerLen+8*mb.Dx()*mb.Dy() {
+				t.Errorf("%T %v: encoded %d bytes", m, size, n)
+			}
+			got, name, err := image.Decode(&buf)
+			if err != nil {
+				t.Errorf("%T %v: %v", m, size, err)
+				continue
+			}
+			if name != "farbfeld" {
+				t.Errorf("format = %q; want farbfeld", name)
+			}
+			if got.Bounds() != image.Rect(0, 0, mb.Dx(), mb.Dy()) {
+				t.Errorf("%T %v: bounds = %v", m, size, got.Bounds())
+				continue
+			}
+			for y := 0; y < mb.Dy(); y++ {
+				for x := 0; x < mb.Dx(); x++ {
+					want := color.NRGBA64Model.Convert(m.At(mb.Min.X+x, mb.Min.Y+y))
+					if c := got.At(x, y); c != want {
+						t.Errorf("%T %v: (%d, %d) = %v; want %v", m, size, x, y, c, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPrecision(t *testing.T) {
+	m := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+	m.SetNRGBA64(0, 0, color.NRGBA64{0x1234, 0x5678, 0x9abc, 0xdef1})
+	var buf bytes.Buffer
+	if err := Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("farbfeld\x00\x00\x00\x01\x00\x00\x00\x01\x12\x34\x56\x78\x9a\xbc\xde\xf1")
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("encoded %q; want %q", buf.Bytes(), want)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	m := image.NewNRGBA64(image.Rect(0, 0, 3, 2))
+	var buf bytes.Buffer
+	if err := Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for n := 0; n < len(data); n++ {
+		if _, err := Decode(bytes.NewReader(data[:n])); err != ErrFormat {
+			t.Errorf("Decode(data[:%d]) err = %v; want ErrFormat", n, err)
+		}
+	}
+	if _, err := DecodeConfig(bytes.NewReader(data[:headerLen-1])); err != ErrFormat {
+		t.Errorf("DecodeConfig err = %v; want ErrFormat", err)
+	}
+	bad := append([]byte("farbfelt"), data[8:]...)
+	if _, err := Decode(bytes.NewReader(bad)); err != ErrFormat {
+		t.Errorf("bad magic: err = %v; want ErrFormat", err)
+	}
+	huge := []byte("farbfeld\xff\xff\xff\xff\xff\xff\xff\xff")
+	if _, err := Decode(bytes.NewReader(huge)); err != ErrFormat {
+		t.Errorf("huge: err = %v; want ErrFormat", err)
+	}
+}
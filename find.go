@@ -0,0 +1,180 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"errors"
+	"image"
+	"math"
+	"sort"
+)
+
+// ErrNotFound is returned by FindSubimage when no part of the haystack
+// matches the needle within the tolerance.
+var ErrNotFound = errors.New("imgdiff: subimage not found")
+
+// findCandidates is the number of locations FindSubimage keeps
+// at each level, and compares with the Differ at the end.
+const findCandidates = 4
+
+// FindSubimage returns the rectangle of haystack which matches needle
+// best, along with the number of pixels d finds different there.
+// The rectangle has the size of needle and is in haystack coordinates.
+//
+// Locations are searched exhaustively on downsampled luminance of the
+// images, by the sum of squared differences, and the best ones are
+// refined at each finer level, up to the images themselves. The few
+// best locations are compared with d, and the one with the fewest
+// different pixels is returned.
+//
+// tolerance is the max fraction of pixels of needle which may be
+// different, e.g. 0.01 for 1%. If more are, FindSubimage returns the
+// best location found, its count and ErrNotFound. It also returns
+// ErrNotFound, with an empty rectangle and -1, if needle is larger
+// than haystack in either dimension. Other errors are those of d.
+func FindSubimage(haystack, needle image.Image, d Differ, tolerance float64) (image.Rectangle, int, error) {
+	hb, nb := haystack.Bounds(), needle.Bounds()
+	if nb.Dx() > hb.Dx() || nb.Dy() > hb.Dy() || nb.Empty() {
+		return image.Rectangle{}, -1, ErrNotFound
+	}
+	hl := lumaLevel{luma(haystack), hb.Dx(), hb.Dy()}
+	nl := lumaLevel{luma(needle), nb.Dx(), nb.Dy()}
+	levels := [][2]lumaLevel{{hl, nl}}
+	for nl.w >= 16 && nl.h >= 16 {
+		hl, nl = hl.halve(), nl.halve()
+		levels = append(levels, [2]lumaLevel{hl, nl})
+	}
+
+	top := levels[len(levels)-1]
+	cands := bestLocations(top[0], top[1])
+	for i := len(levels) - 2; i >= 0; i-- {
+		hl, nl := levels[i][0], levels[i][1]
+		for j, c := range cands {
+			// the location is twice that of the coarser
+			// level, plus or minus a pixel
+			best := math.Inf(1)
+			for y := 2*c.Y - 1; y <= 2*c.Y+1; y++ {
+				for x := 2*c.X - 1; x <= 2*c.X+1; x++ {
+					if x < 0 || y < 0 || x+nl.w > hl.w || y+nl.h > hl.h {
+						continue
+					}
+					if s := ssd(hl, nl, x, y, best); s < best {
+						best, cands[j] = s, image.Pt(x, y)
+					}
+				}
+			}
+		}
+	}
+
+	var r image.Rectangle
+	n := -1
+	seen := make(map[image.Point]bool)
+	for _, c := range cands {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		cr := nb.Sub(nb.Min).Add(hb.Min).Add(c)
+		_, cn, err := d.Compare(crop(haystack, cr), needle)
+		if err != nil {
+			return image.Rectangle{}, -1, err
+		}
+		if n < 0 || cn < n {
+			r, n = cr, cn
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if float64(n) > tolerance*float64(nb.Dx()*nb.Dy()) {
+		return r, n, ErrNotFound
+	}
+	return r, n, nil
+}
+
+// bestLocations returns up to findCandidates locations of needle n
+// in haystack h with the smallest sums of squared differences,
+// best first, more than 2 pixels apart in either direction.
+func bestLocations(h, n lumaLevel) []image.Point {
+	var best []image.Point
+	var scores []float64
+	for y := 0; y+n.h <= h.h; y++ {
+		for x := 0; x+n.w <= h.w; x++ {
+			limit := math.Inf(1)
+			if len(best) == findCandidates {
+				limit = scores[len(scores)-1]
+			}
+			s := ssd(h, n, x, y, limit)
+			if s >= limit {
+				continue
+			}
+			// drop worse locations near this one, unless
+			// a better one is near it already
+			p := image.Pt(x, y)
+			near := func(b image.Point) bool {
+				return abs(int64(b.X-x)) <= 2 && abs(int64(b.Y-y)) <= 2
+			}
+			keep := true
+			for i, b := range best {
+				if near(b) && scores[i] <= s {
+					keep = false
+					break
+				}
+			}
+			if !keep {
+				continue
+			}
+			k := 0
+			for i, b := range best {
+				if !near(b) {
+					best[k], scores[k] = b, scores[i]
+					k++
+				}
+			}
+			best, scores = best[:k], scores[:k]
+			i := sort.SearchFloat64s(scores, s)
+			for i < len(scores) && scores[i] == s {
+				i++
+			}
+			best = append(best, image.Point{})
+			scores = append(scores, 0)
+			copy(best[i+1:], best[i:])
+			copy(scores[i+1:], scores[i:])
+			best[i], scores[i] = p, s
+			if len(best) > findCandidates {
+				best, scores = best[:findCandidates], scores[:findCandidates]
+			}
+		}
+	}
+	return best
+}
+
+// ssd returns the sum of squared differences of needle n and the part
+// of haystack h at x, y. It stops summing as soon as the sum exceeds
+// limit, returning a partial sum above it.
+func ssd(h, n lumaLevel, x, y int, limit float64) float64 {
+	var sum float64
+	for ny := 0; ny < n.h; ny++ {
+		hr := h.l[(y+ny)*h.w+x:]
+		for nx, v := range n.l[ny*n.w : (ny+1)*n.w] {
+			d := hr[nx] - v
+			sum += d * d
+		}
+		if sum > limit {
+			break
+		}
+	}
+	return sum
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+)
+
+// subimage returns a copy of part r of m, with zero-based bounds.
+func subimage(m image.Image, r image.Rectangle) *image.NRGBA {
+	c := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(c, c.Rect, m, r.Min, draw.Src)
+	return c
+}
+
+func TestFindSubimage(t *testing.T) {
+	haystack := blocks(200, 150)
+	tests := []image.Rectangle{
+		image.Rect(0, 0, 40, 30),
+		image.Rect(57, 31, 97, 61),
+		image.Rect(121, 88, 138, 111),
+		image.Rect(192, 142, 200, 150),
+		image.Rect(13, 101, 77, 149),
+		image.Rect(0, 0, 200, 150),
+	}
+	for i, r := range tests {
+		got, n, err := FindSubimage(haystack, subimage(haystack, r), NewBinary(), 0)
+		if err != nil || got != r || n != 0 {
+			t.Errorf("(%d) FindSubimage = %v, %d, %v; want %v, 0", i, got, n, err, r)
+		}
+	}
+
+	// haystack bounds which don't start at 0, 0
+	sub := haystack.SubImage(image.Rect(50, 20, 180, 140))
+	r := image.Rect(103, 77, 135, 101)
+	if got, n, err := FindSubimage(sub, subimage(haystack, r), NewBinary(), 0); err != nil || got != r || n != 0 {
+		t.Errorf("sub: FindSubimage = %v, %d, %v; want %v, 0", got, n, err, r)
+	}
+}
+
+func TestFindSubimageTolerance(t *testing.T) {
+	haystack := blocks(200, 150)
+	r := image.Rect(71, 40, 111, 70)
+	needle := subimage(haystack, r)
+	for x := 0; x < 12; x++ {
+		needle.Set(x, 5, color.White)
+	}
+	if got, n, err := FindSubimage(haystack, needle, NewBinary(), 0.01); err != nil || got != r || n != 12 {
+		t.Errorf("FindSubimage = %v, %d, %v; want %v, 12", got, n, err, r)
+	}
+	if got, n, err := FindSubimage(haystack, needle, NewBinary(), 0.001); err != ErrNotFound || got != r || n != 12 {
+		t.Errorf("low tolerance: FindSubimage = %v, %d, %v; want %v, 12, ErrNotFound", got, n, err, r)
+	}
+
+	// random pixels, which are nowhere in haystack
+	rnd := rand.New(rand.NewSource(2))
+	other := image.NewNRGBA(image.Rect(0, 0, 30, 20))
+	rnd.Read(other.Pix)
+	for i := 3; i < len(other.Pix); i += 4 {
+		other.Pix[i] = 0xff
+	}
+	if _, n, err := FindSubimage(haystack, other, NewBinary(), 0.1); err != ErrNotFound || n <= 60 {
+		t.Errorf("other: n = %d, err = %v; want > 60, ErrNotFound", n, err)
+	}
+
+	large := blocks(201, 10)
+	if got, n, err := FindSubimage(haystack, large, NewBinary(), 1); err != ErrNotFound || !got.Empty() || n != -1 {
+		t.Errorf("large: FindSubimage = %v, %d, %v; want empty, -1, ErrNotFound", got, n, err)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"sync"
+)
+
+// labChunkRows is the number of rows converted to LAB at once
+// by imageScratch32.labLap.
+const labChunkRows = 32
+
+// imageScratch32 is imageScratch storing float32 samples, see WithFloat32.
+type imageScratch32 struct {
+	// colors of the last image, in buf or empty if it's grayscale
+	lab labImage32
+	// allocated by the first labLap of an image which isn't grayscale
+	buf labImage32
+	// lap[0] is luminance
+	lap [][][]float32
+}
+
+// labImage32 is labImage storing float32 samples.
+type labImage32 struct {
+	a, b []float32
+}
+
+func newImageScratch32(w, h, levels int) *imageScratch32 {
+	s := &imageScratch32{lap: make([][][]float32, levels)}
+	n, nrows := pyramidSize(w, h, levels)
+	plane := make([]float32, n)
+	rows := make([][]float32, nrows)
+	for l := range s.lap {
+		lw, lh := levelSize(w, l), levelSize(h, l)
+		s.lap[l], rows = rows[:lh:lh], rows[lh:]
+		for y := range s.lap[l] {
+			s.lap[l][y], plane = plane[:lw:lw], plane[lw:]
+		}
+	}
+	return s
+}
+
+// labLap fills s with LAB colors and the pyramid of m made with kernel k,
+// using up to n goroutines.
+func (s *imageScratch32) labLap(m image.Image, lut *gammaLUT, lum float64, k []float64, n int) {
+	s.convert(m, lut, lum)
+	fillPyramid32(s.lap, k, 0, n, nil)
+}
+
+// convert fills s with LAB colors and luminance of m, the first level
+// of its pyramid. Colors are computed in float64, a chunk of rows
+// at a time.
+func (s *imageScratch32) convert(m image.Image, lut *gammaLUT, lum float64) {
+	h, w := len(s.lap[0]), len(s.lap[0][0])
+	rows := labChunkRows
+	if rows > h {
+		rows = h
+	}
+	lumRows := newRows(w, rows)
+	var lab labImage
+	s.lab = labImage32{}
+	if !isGray(m) {
+		if s.buf.a == nil {
+			ab := make([]float32, 2*w*h)
+			s.buf = labImage32{a: ab[: w*h : w*h], b: ab[w*h:]}
+		}
+		s.lab = s.buf
+		lab = newLabImage(rows * w)
+	}
+	for y0 := 0; y0 < h; y0 += rows {
+		if h-y0 < rows {
+			rows = h - y0
+		}
+		labRowsInto(lumRows[:rows], lab, m, lut, lum, y0)
+		for y := 0; y < rows; y++ {
+			narrow(s.lap[0][y0+y], lumRows[y])
+		}
+		if s.lab.a != nil {
+			narrow(s.lab.a[y0*w:], lab.a[:rows*w])
+			narrow(s.lab.b[y0*w:], lab.b[:rows*w])
+		}
+	}
+}
+
+// rows widens columns [x0, x1) of rows y of all pyramid levels,
+// expanded to full resolution, into buf and sets rows to them, see
+// rowScratch.setLevels. It widens LAB colors of the columns into lab
+// and returns them, or an empty labImage if the image is grayscale.
+func (s *imageScratch32) rows(y, x0, x1 int, rows, buf [][]float64, tmp []float64, lab labImage) labImage {
+	rows[0] = buf[0][:x1-x0]
+	widen(rows[0], s.lap[0][y][x0:x1])
+	for l := 1; l < len(rows); l++ {
+		rows[l] = buf[l][:x1-x0]
+		expandRow32(rows[l], s.lap[l], l, y, x0, tmp)
+	}
+	if s.lab.a == nil {
+		return labImage{}
+	}
+	i := y * len(s.lap[0][0])
+	lab = lab.cols(0, x1-x0)
+	widen(lab.a, s.lab.a[i+x0:i+x1])
+	widen(lab.b, s.lab.b[i+x0:i+x1])
+	return lab
+}
+
+// compare32 is Compare using float32 scratch buffers of s.
+func (d *perceptual) compare32(diff *image.NRGBA, a, b image.Image, s *compareScratch, p phases, dbg *debugPlanes, budget *diffBudget, prog *progress) int {
+	p.run("convert", &p.t.Convert, func() {
+		parallel(d.opts.workers(), func(int) {
+			s.a32.convert(a, d.lut, d.lum)
+		}, func(int) {
+			s.b32.convert(b, d.lut, d.lum)
+		})
+	})
+	tile := d.opts.tileSize(s.w)
+	p.run("pyramid", &p.t.Pyramid, func() {
+		parallel(d.opts.workers(), func(n int) {
+			fillPyramid32(s.a32.lap, d.lap.kernel, tile, n, prog)
+		}, func(n int) {
+			fillPyramid32(s.b32.lap, d.lap.kernel, tile, n, prog)
+		})
+	})
+	npix := 0
+	p.run("compare", &p.t.Compare, func() {
+		npix = forBands(d.opts.workers(), s.h, func(y0, y1 int) int {
+			r := s.rows.get(d, s.w)
+			defer s.rows.put(r)
+			if r.aLAB.a == nil {
+				r.aLAB, r.bLAB = newLabImage(s.w), newLabImage(s.w)
+			}
+			n := 0
+			forTiles(s.w, y0, y1, tile, func(x0, x1, y int) {
+				if budget.exceeded() {
+					return
+				}
+				aLAB := s.a32.rows(y, x0, x1, r.aRows, r.aBuf, r.tmp, r.aLAB)
+				bLAB := s.b32.rows(y, x0, x1, r.bRows, r.bBuf, r.tmp, r.bLAB)
+				k := d.compareRow(r.diffRow(diff, x0, y), r, aLAB, bLAB, dbg.row(x0, y, x1-x0))
+				budget.add(k)
+				n += k
+				if x1 == s.w {
+					prog.add(1)
+				}
+			})
+			return n
+		})
+	})
+	return npix
+}
+
+// fillPyramid32 is fillPyramid for float32 pyramids,
+// reporting levels built to prog.
+func fillPyramid32(p [][][]float32, k []float64, tile, n int, prog *progress) {
+	h, w := len(p[0]), len(p[0][0])
+	n = bands(levelSize(h, 1), n)
+	c := newConvolution(k, w, h, tile)
+	rows := c.newRows(n)
+	for l := 1; l < len(p); l++ {
+		c.resize(len(p[l-1][0]), len(p[l-1]))
+		h := len(p[l])
+		n := bands(h, n)
+		if n == 1 {
+			c.reduce32(p[l], p[l-1], 0, h, rows[0])
+			prog.add(1)
+			continue
+		}
+		var wg sync.WaitGroup
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			go func(l, i int) {
+				c.reduce32(p[l], p[l-1], i*h/n, (i+1)*h/n, rows[i])
+				wg.Done()
+			}(l, i)
+		}
+		wg.Wait()
+		prog.add(1)
+	}
+}
+
+// reduce32 is reduce for float32 rows, which must not be nil.
+// Sums are accumulated in float64.
+func (c *convolution) reduce32(dst, src [][]float32, y0, y1 int, row []float64) {
+	forTiles(levelSize(len(c.xs)-2*c.r, 1), y0, y1, c.tile, func(x0, x1, y int) {
+		sx0, sx1 := 2*x0, 2*x1-1
+		sum, lo, hi := c.vertical(row, sx0, sx1)
+		for j, kj := range c.k {
+			s := src[c.ys[2*y+j]][lo:hi]
+			sum = sum[:len(s)]
+			for x, v := range s {
+				sum[x] += kj * float64(v)
+			}
+		}
+		row := c.pad(row, sx0, sx1)
+		d := dst[y][x0:x1]
+		for x := range d {
+			s := row[2*x : 2*x+len(c.k)]
+			var v float64
+			for i, ki := range c.k {
+				v += ki * s[i]
+			}
+			d[x] = float32(v)
+		}
+	})
+}
+
+// expandRow32 is expandRow for float32 levels.
+func expandRow32(dst []float64, p [][]float32, l, y, x0 int, tmp []float64) {
+	scale := 1 / float64(int(1)<<l)
+	mask := 1<<l - 1
+	i := y >> l
+	fy := float64(y&mask) * scale
+	r0, r1 := p[i], p[next(i, len(p))]
+	w := len(r0)
+	j0 := x0 >> l
+	tmp = tmp[:next((x0+len(dst)-1)>>l, w)+1-j0]
+	for j := range tmp {
+		v := float64(r0[j0+j])
+		tmp[j] = v + fy*(float64(r1[j0+j])-v)
+	}
+	expandCols(dst, tmp, x0&mask, l, w-1-j0)
+}
+
+// narrow converts src to float32 samples of dst.
+func narrow(dst []float32, src []float64) {
+	for i, v := range src {
+		dst[i] = float32(v)
+	}
+}
+
+// widen converts src to float64 samples of dst.
+func widen(dst []float64, src []float32) {
+	for i, v := range src {
+		dst[i] = float64(v)
+	}
+}
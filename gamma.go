@@ -0,0 +1,121 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Transfer is a function decoding gamma-encoded samples to linear
+// light, see WithTransfer.
+type Transfer float64
+
+// SRGB is the sRGB transfer function, a power curve with exponent 2.4
+// and a linear segment near black. It is Gamma(0).
+const SRGB Transfer = 0
+
+// Gamma returns the transfer function decoding samples v in [0, 1]
+// as math.Pow(v, g). The exponent must be positive.
+func Gamma(g float64) Transfer {
+	return Transfer(g)
+}
+
+func (t Transfer) String() string {
+	if t == SRGB {
+		return "srgb"
+	}
+	return fmt.Sprintf("gamma %g", float64(t))
+}
+
+// validTransfer returns an error if t is not a valid Transfer.
+func validTransfer(t Transfer) error {
+	if t < 0 || math.IsNaN(float64(t)) {
+		return fmt.Errorf("imgdiff: invalid transfer %v", t)
+	}
+	return nil
+}
+
+// srgbDecode decodes v in [0, 1] with the sRGB transfer function.
+func srgbDecode(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// gammaLUT is a lookup table of 16-bit samples decoded with gamma,
+// or with the sRGB transfer function, replacing a math.Pow call
+// per sample.
+// Samples of 8-bit sources, multiples of 0x101, use a small table.
+// The full 16-bit table is only built when other samples show up.
+// It is safe for concurrent use.
+type gammaLUT struct {
+	gamma float64
+	// decode with srgbDecode instead of gamma
+	srgb bool
+	// color vision simulated on decoded linear RGB, see
+	// WithColorVision; nil means normal vision
+	cvd *[3][3]float64
+	// converts decoded linear RGB to XYZ and LAB,
+	// see WithColorMatrix
+	space  *colorSpace
+	once8  sync.Once
+	lut8   []float64
+	once16 sync.Once
+	lut16  []float64
+}
+
+func newGammaLUT(gamma float64) *gammaLUT {
+	return &gammaLUT{gamma: gamma, space: defaultColorSpace}
+}
+
+// newTransferLUT returns a gammaLUT decoding samples with t.
+func newTransferLUT(t Transfer) *gammaLUT {
+	return &gammaLUT{gamma: float64(t), srgb: t == SRGB, space: defaultColorSpace}
+}
+
+// at returns l.decode(float64(v)/0xffff).
+func (l *gammaLUT) at(v uint32) float64 {
+	if v%0x101 == 0 {
+		l.once8.Do(l.build8)
+		return l.lut8[v/0x101]
+	}
+	l.once16.Do(l.build16)
+	return l.lut16[v]
+}
+
+func (l *gammaLUT) build8() {
+	l.lut8 = make([]float64, 256)
+	for i := range l.lut8 {
+		l.lut8[i] = l.decode(float64(i*0x101) / 0xffff)
+	}
+}
+
+func (l *gammaLUT) build16() {
+	l.lut16 = make([]float64, 1<<16)
+	for i := range l.lut16 {
+		l.lut16[i] = l.decode(float64(i) / 0xffff)
+	}
+}
+
+// decode decodes v in [0, 1] to linear light.
+func (l *gammaLUT) decode(v float64) float64 {
+	if l.srgb {
+		return srgbDecode(v)
+	}
+	return math.Pow(v, l.gamma)
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestGammaLUT(t *testing.T) {
+	for _, gamma := range []float64{1, 1.8, 2.2, 2.4} {
+		lut := newGammaLUT(gamma)
+		for v := uint32(0); v <= 0xffff; v++ {
+			want := math.Pow(float64(v)/0xffff, gamma)
+			if got := lut.at(v); got != want {
+				t.Fatalf("gamma %v: at(%#x) = %v; want %v", gamma, v, got, want)
+			}
+		}
+	}
+}
+
+func TestGammaLUTConcurrent(t *testing.T) {
+	lut := newGammaLUT(2.2)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// mix 8-bit and 16-bit samples
+			for v := uint32(i); v <= 0xffff; v += 0x101 + 1 {
+				if got, want := lut.at(v), math.Pow(float64(v)/0xffff, 2.2); got != want {
+					t.Errorf("at(%#x) = %v; want %v", v, got, want)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestTransferLUT(t *testing.T) {
+	lut := newTransferLUT(SRGB)
+	for v := uint32(0); v <= 0xffff; v += 0x101 {
+		if got, want := lut.at(v), srgbDecode(float64(v)/0xffff); got != want {
+			t.Fatalf("SRGB: at(%#x) = %v; want %v", v, got, want)
+		}
+	}
+	// the linear segment near black
+	if got, want := lut.at(0x101), 1.0/0xff/12.92; math.Abs(got-want) > 1e-12 {
+		t.Errorf("SRGB: at(0x101) = %v; want %v", got, want)
+	}
+	if got, want := newTransferLUT(Gamma(2.2)).at(0x8080), newGammaLUT(2.2).at(0x8080); got != want {
+		t.Errorf("Gamma(2.2): at(0x8080) = %v; want %v", got, want)
+	}
+}
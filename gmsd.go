@@ -0,0 +1,186 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"math"
+)
+
+// DefaultGMSThreshold is the default min gradient magnitude similarity
+// of pixels which are not counted as different, see WithGMSThreshold.
+const DefaultGMSThreshold = 0.9
+
+// gmsC is the stabilizing constant of gradient magnitude similarity,
+// for luminance in [0, 255].
+const gmsC = 170
+
+type gmsd struct {
+	opts options
+}
+
+// NewGMSD creates a new Differ based on gradient magnitude similarity
+// deviation (GMSD), as described by Xue et al. in "Gradient magnitude
+// similarity deviation: a highly efficient perceptual image quality
+// index", IEEE TIP 2014. It is much faster than the perceptual algorithm.
+//
+// As in the reference implementation, luminance of the images is
+// downsampled by 2 and its gradient magnitudes are computed with Prewitt
+// filters, mirrored at the borders. Pixels whose gradient magnitude
+// similarity is below WithGMSThreshold are counted as different.
+// CompareResult sets the GMSD score, the standard deviation of the
+// similarities, in Result.Stats.
+//
+// In the difference image, pixels which are not different are black as
+// with the other algorithms, and different ones are red, the darker the
+// lower their similarity.
+func NewGMSD(opts ...Option) Differ {
+	return &gmsd{opts: newOptions(opts)}
+}
+
+// Compare compares a and b using gradient magnitude similarity.
+func (d *gmsd) Compare(a, b image.Image) (image.Image, int, error) {
+	return d.compareStats(a, b, new(PhaseTimings), new(ErrorStats))
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *gmsd) CompareInto(dst *image.NRGBA, a, b image.Image) (int, error) {
+	return d.compareInto(dst, a, b, new(PhaseTimings), new(ErrorStats))
+}
+
+func (d *gmsd) compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error) {
+	return d.compareStats(a, b, t, new(ErrorStats))
+}
+
+func (d *gmsd) compareStats(a, b image.Image, t *PhaseTimings, s *ErrorStats) (image.Image, int, error) {
+	diff := new(image.NRGBA)
+	n, err := d.compareInto(diff, a, b, t, s)
+	if err != nil {
+		return nil, -1, err
+	}
+	return diff, n, nil
+}
+
+func (d *gmsd) compareInto(diff *image.NRGBA, a, b image.Image, t *PhaseTimings, s *ErrorStats) (int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return -1, ErrSize
+	}
+	if err := d.opts.checkSize(ab); err != nil {
+		return -1, err
+	}
+	resize(diff, w, h)
+	*s = ErrorStats{}
+	if sameImage(a, b) {
+		fillPass(diff)
+		return 0, nil
+	}
+
+	p := newPhases("gmsd", ab, t)
+	var la, lb []float64
+	p.run("convert", &t.Convert, func() {
+		parallel(d.opts.workers(), func(int) {
+			la = halve(luma(a), w, h)
+		}, func(int) {
+			lb = halve(luma(b), w, h)
+		})
+	})
+	var npix int
+	p.run("compare", &t.Compare, func() {
+		hw, hh := (w+1)/2, (h+1)/2
+		gms := make([]float64, hw*hh)
+		xs := make([]int, hw+2)
+		mirrorTable(xs, hw, 1)
+		forBands(d.opts.workers(), hh, func(y0, y1 int) int {
+			gmsRows(gms, la, lb, xs, hw, hh, y0, y1)
+			return 0
+		})
+		s.GMSD = stdDev(gms)
+		npix = forBands(d.opts.workers(), h, func(y0, y1 int) int {
+			return d.drawRows(diff, gms, hw, y0, y1)
+		})
+	})
+	return npix, nil
+}
+
+// halve returns w x h luminance l, scaled to [0, 255] and downsampled
+// by 2, see halveLuma.
+func halve(l []float64, w, h int) []float64 {
+	m := halveLuma(l, w, h)
+	for i := range m {
+		m[i] *= 255
+	}
+	return m
+}
+
+// gmsRows sets rows [y0, y1) of gms, a w x h map of gradient magnitude
+// similarity of luminance la and lb. xs maps x+1 to mirror(x, w)
+// for x in [-1, w].
+func gmsRows(gms, la, lb []float64, xs []int, w, h, y0, y1 int) {
+	for y := y0; y < y1; y++ {
+		up, down := mirror(y-1, h)*w, mirror(y+1, h)*w
+		for x := 0; x < w; x++ {
+			ma := prewitt(la, up, y*w, down, xs, x)
+			mb := prewitt(lb, up, y*w, down, xs, x)
+			gms[y*w+x] = (2*ma*mb + gmsC) / (ma*ma + mb*mb + gmsC)
+		}
+	}
+}
+
+// prewitt returns the Prewitt gradient magnitude of pixel x of the row
+// of l at offset r, given offsets of the rows above and below it.
+func prewitt(l []float64, above, r, below int, xs []int, x int) float64 {
+	lf, c, rt := xs[x], xs[x+1], xs[x+2]
+	gx := (l[above+lf] + l[r+lf] + l[below+lf] - l[above+rt] - l[r+rt] - l[below+rt]) / 3
+	gy := (l[above+lf] + l[above+c] + l[above+rt] - l[below+lf] - l[below+c] - l[below+rt]) / 3
+	return math.Sqrt(gx*gx + gy*gy)
+}
+
+// stdDev returns the standard deviation of v.
+func stdDev(v []float64) float64 {
+	if len(v) == 0 {
+		return 0
+	}
+	var mean float64
+	for _, x := range v {
+		mean += x
+	}
+	mean /= float64(len(v))
+	var sum float64
+	for _, x := range v {
+		sum += (x - mean) * (x - mean)
+	}
+	return math.Sqrt(sum / float64(len(v)))
+}
+
+// drawRows writes rows [y0, y1) of diff out of w pixels wide
+// downsampled gms map and returns the number of different pixels.
+func (d *gmsd) drawRows(diff *image.NRGBA, gms []float64, w, y0, y1 int) int {
+	npix := 0
+	for y := y0; y < y1; y++ {
+		row := gms[y/2*w:]
+		out := diff.Pix[diff.PixOffset(0, y):]
+		for x := 0; x < diff.Rect.Dx(); x++ {
+			c := passPixel
+			if v := row[x/2]; v < d.opts.gmsThreshold {
+				c = ssimPixel(v, d.opts.gmsThreshold)
+				npix++
+			}
+			copy(out[4*x:], c[:])
+		}
+	}
+	return npix
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestGMSD(t *testing.T) {
+	black := color.RGBA{0, 0, 0, 0xff}
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	a := square(20, 16, 4, 4, white, black)
+	b := square(20, 16, 10, 4, white, black)
+
+	res, err := CompareResult(NewGMSD(), a, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.N != 0 || res.Stats == nil || res.Stats.GMSD != 0 {
+		t.Errorf("same image: n = %d, stats = %+v; want 0, 0 GMSD", res.N, res.Stats)
+	}
+
+	tests := []struct {
+		threshold float64
+		zero      bool
+	}{
+		{0, true},
+		{0.5, false},
+		{DefaultGMSThreshold, false},
+		{1, false},
+	}
+	prev := -1
+	for i, test := range tests {
+		res, err := CompareResult(NewGMSD(WithGMSThreshold(test.threshold)), a, b)
+		if err != nil {
+			t.Fatalf("(%d) %v", i, err)
+		}
+		if res.Stats == nil || res.Stats.GMSD <= 0 {
+			t.Errorf("(%d) stats = %+v; want GMSD > 0", i, res.Stats)
+		}
+		if (res.N == 0) != test.zero {
+			t.Errorf("(%d) n = %d; want zero %v", i, res.N, test.zero)
+		}
+		if res.N < prev {
+			t.Errorf("(%d) n = %d; want >= %d of a lower threshold", i, res.N, prev)
+		}
+		prev = res.N
+		marks := 0
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 20; x++ {
+				if marked(res.Diff.At(x, y)) {
+					marks++
+				}
+			}
+		}
+		if marks != res.N {
+			t.Errorf("(%d) %d marked pixels; want n = %d", i, marks, res.N)
+		}
+	}
+}
+
+func TestGMSDOddSize(t *testing.T) {
+	// odd sizes leave a half covered row and column in the
+	// downsampled maps, and images 1 pixel wide mirror
+	// the only column at both borders
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 7, 5), image.Rect(0, 0, 1, 9), image.Rect(0, 0, 1, 1)} {
+		a, b := image.NewGray(r), image.NewGray(r)
+		b.SetGray(r.Dx()-1, r.Dy()-1, color.Gray{0xff})
+		diff, n, err := NewGMSD().Compare(a, b)
+		if err != nil {
+			t.Fatalf("%v: %v", r, err)
+		}
+		if diff.Bounds() != r {
+			t.Errorf("%v: diff bounds = %v", r, diff.Bounds())
+		}
+		if r.Dx() > 1 && !marked(diff.At(r.Dx()-1, r.Dy()-1)) {
+			t.Errorf("%v: changed pixel not marked, n = %d", r, n)
+		}
+	}
+}
+
+func benchmarkFish(b *testing.B, d Differ) {
+	m1, err := readTestImage("fish1.png")
+	if err != nil {
+		b.Fatal(err)
+	}
+	m2, err := readTestImage("fish2.png")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Compare(m1, m2)
+	}
+}
+
+func BenchmarkGMSDFish(b *testing.B) {
+	benchmarkFish(b, NewGMSD())
+}
+
+func BenchmarkPerceptualFish(b *testing.B) {
+	benchmarkFish(b, NewDefaultPerceptual())
+}
@@ -0,0 +1,160 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+)
+
+// gridTint is the color of pixels which are not different
+// in the changed cells of the difference images of NewGrid.
+var gridTint = [4]uint8{0, 0, 0x60, 0xff}
+
+// GridCell is a cell of the grid of NewGrid in which the images differ,
+// see ErrorStats.Cells.
+type GridCell struct {
+	// Col and Row are zero-based indices of the cell in the grid.
+	Col, Row int
+	// Bounds are the bounds of the cell in the comparison frame.
+	Bounds image.Rectangle
+	// N is the number of different pixels of the cell.
+	N int
+}
+
+type grid struct {
+	inner      Differ
+	cols, rows int
+	// invalid grid size, returned by Compare
+	err error
+}
+
+// NewGrid creates a new Differ which splits images into a grid of cols
+// x rows cells and compares each cell independently with inner, e.g. to
+// tell which blocks of a page layout changed. Cells are w/cols x h/rows
+// pixels of w x h images, those at the right and bottom edges taking
+// the remaining pixels, and there are at most as many columns and rows
+// as there are pixels.
+//
+// The difference image is made of the difference images of inner for
+// each cell, with pixels which are not different tinted dark blue in
+// cells which changed, and the count is the total of the cells.
+// CompareResult sets the changed cells in Result.Stats.
+// Compare returns an error if cols or rows are not positive.
+func NewGrid(inner Differ, cols, rows int) Differ {
+	d := &grid{inner: inner, cols: cols, rows: rows}
+	if cols < 1 || rows < 1 {
+		d.err = fmt.Errorf("imgdiff: invalid grid size %dx%d", cols, rows)
+	}
+	return d
+}
+
+// Compare compares a and b with the inner Differ, cell by cell.
+func (d *grid) Compare(a, b image.Image) (image.Image, int, error) {
+	return d.compareStats(a, b, new(PhaseTimings), new(ErrorStats))
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *grid) CompareInto(diff *image.NRGBA, a, b image.Image) (int, error) {
+	m, n, err := d.Compare(a, b)
+	if err != nil {
+		return -1, err
+	}
+	r := m.Bounds()
+	resize(diff, r.Dx(), r.Dy())
+	draw.Draw(diff, diff.Rect, m, r.Min, draw.Src)
+	return n, nil
+}
+
+func (d *grid) compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error) {
+	return d.compareStats(a, b, t, new(ErrorStats))
+}
+
+func (d *grid) compareStats(a, b image.Image, t *PhaseTimings, s *ErrorStats) (image.Image, int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return nil, -1, ErrSize
+	}
+	if d.err != nil {
+		return nil, -1, d.err
+	}
+	cols, rows := min2(d.cols, w), min2(d.rows, h)
+	diff := image.NewNRGBA(image.Rect(0, 0, w, h))
+	var cells []GridCell
+	total := 0
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			r := gridCell(w, h, cols, rows, col, row)
+			ca, cb := crop(a, r.Add(ab.Min)), crop(b, r.Add(bb.Min))
+			// timings of the cells add up
+			var ct PhaseTimings
+			var m image.Image
+			var n int
+			var err error
+			switch inner := d.inner.(type) {
+			case statsDiffer:
+				// stats of single cells are not set
+				m, n, err = inner.compareStats(ca, cb, &ct, new(ErrorStats))
+			case timedDiffer:
+				m, n, err = inner.compareTimed(ca, cb, &ct)
+			default:
+				m, n, err = inner.Compare(ca, cb)
+			}
+			if err != nil {
+				return nil, -1, err
+			}
+			t.Convert += ct.Convert
+			t.Pyramid += ct.Pyramid
+			t.Compare += ct.Compare
+			draw.Draw(diff, r, m, m.Bounds().Min, draw.Src)
+			if n > 0 {
+				tint(diff, r)
+				cells = append(cells, GridCell{Col: col, Row: row, Bounds: r, N: n})
+				total += n
+			}
+		}
+	}
+	s.Cells = cells
+	return diff, total, nil
+}
+
+// gridCell returns the bounds of cell col, row of a grid of cols x rows
+// cells over a w x h image. Cells at the right and bottom edges take
+// the pixels remaining after dividing w and h.
+func gridCell(w, h, cols, rows, col, row int) image.Rectangle {
+	cw, ch := w/cols, h/rows
+	r := image.Rect(col*cw, row*ch, (col+1)*cw, (row+1)*ch)
+	if col == cols-1 {
+		r.Max.X = w
+	}
+	if row == rows-1 {
+		r.Max.Y = h
+	}
+	return r
+}
+
+// tint sets pixels of m within r which are passPixel to gridTint.
+func tint(m *image.NRGBA, r image.Rectangle) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := m.Pix[m.PixOffset(r.Min.X, y):m.PixOffset(r.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			if row[i] == passPixel[0] && row[i+1] == passPixel[1] && row[i+2] == passPixel[2] && row[i+3] == passPixel[3] {
+				copy(row[i:], gridTint[:])
+			}
+		}
+	}
+}
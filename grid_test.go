@@ -0,0 +1,114 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"reflect"
+	"testing"
+)
+
+func TestGrid(t *testing.T) {
+	// cells of 8 x 8 pixels, 12 x 14 at the bottom right
+	a := blocks(100, 70)
+	b := image.NewNRGBA(a.Rect)
+	copy(b.Pix, a.Pix)
+	white := image.NewUniform(color.White)
+	draw.Draw(b, image.Rect(26, 20, 30, 28), white, image.ZP, draw.Src)
+	draw.Draw(b, image.Rect(99, 69, 100, 70), white, image.ZP, draw.Src)
+	res, err := CompareResult(NewGrid(NewBinary(), 12, 5), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []GridCell{
+		{3, 1, image.Rect(24, 14, 32, 28), 32},
+		{11, 4, image.Rect(88, 56, 100, 70), 1},
+	}
+	if res.N != 33 || res.Stats == nil || !reflect.DeepEqual(res.Stats.Cells, want) {
+		t.Fatalf("n = %d, stats = %+v; want 33, cells %v", res.N, res.Stats, want)
+	}
+	diff := res.Diff.(*image.NRGBA)
+	tests := []struct {
+		x, y int
+		c    [4]uint8
+	}{
+		{26, 20, failPixel},
+		{99, 69, failPixel},
+		// not different pixels of changed cells
+		{24, 14, gridTint},
+		{88, 56, gridTint},
+		// unchanged cells
+		{23, 14, passPixel},
+		{24, 13, passPixel},
+		{87, 69, passPixel},
+	}
+	for i, test := range tests {
+		p := diff.Pix[diff.PixOffset(test.x, test.y):]
+		if c := [4]uint8{p[0], p[1], p[2], p[3]}; c != test.c {
+			t.Errorf("(%d) pixel %d, %d = %v; want %v", i, test.x, test.y, c, test.c)
+		}
+	}
+
+	// unchanged
+	res, err = CompareResult(NewGrid(NewBinary(), 12, 5), a, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.N != 0 || len(res.Stats.Cells) != 0 || !res.DiffBounds.Empty() {
+		t.Errorf("same images: n = %d, cells %v, diff bounds %v; want none", res.N, res.Stats.Cells, res.DiffBounds)
+	}
+
+	if _, _, err := NewGrid(NewBinary(), 0, 3).Compare(a, a); err == nil {
+		t.Error("0 columns: no error")
+	}
+	if _, _, err := NewGrid(NewBinary(), 3, 3).Compare(a, blocks(100, 71)); err != ErrSize {
+		t.Errorf("err = %v; want ErrSize", err)
+	}
+}
+
+func TestGridCell(t *testing.T) {
+	tests := []struct {
+		w, h, cols, rows int
+	}{
+		{100, 70, 12, 5},
+		{12, 8, 12, 8},
+		{13, 9, 4, 2},
+		{7, 5, 1, 1},
+	}
+	for i, test := range tests {
+		covered := make([]int, test.w*test.h)
+		for row := 0; row < test.rows; row++ {
+			for col := 0; col < test.cols; col++ {
+				r := gridCell(test.w, test.h, test.cols, test.rows, col, row)
+				if r.Empty() {
+					t.Errorf("(%d) cell %d, %d is empty", i, col, row)
+				}
+				for y := r.Min.Y; y < r.Max.Y; y++ {
+					for x := r.Min.X; x < r.Max.X; x++ {
+						covered[y*test.w+x]++
+					}
+				}
+			}
+		}
+		for p, n := range covered {
+			if n != 1 {
+				t.Errorf("(%d) pixel %d, %d is in %d cells; want 1", i, p%test.w, p/test.w, n)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"math/bits"
+)
+
+// hashDiffer is a Differ comparing hashes of images, of size x size
+// bits. Bit y*size+x of a hash is the most significant bit first in its
+// byte, as in hex encoded hashes, see hashBytes.
+type hashDiffer struct {
+	// algorithm name, see algorithmName
+	name string
+	size int
+	hash func(m image.Image) []byte
+	// max distance of passing images
+	maxDistance int
+	// invalid options, returned by Compare
+	err  error
+	opts options
+}
+
+func newHashDiffer(name string, size int, hash func(image.Image) []byte, maxDistance int, opts []Option) *hashDiffer {
+	return &hashDiffer{
+		name:        name,
+		size:        size,
+		hash:        hash,
+		maxDistance: maxDistance,
+		opts:        newOptions(opts),
+	}
+}
+
+// NewAHash creates a new Differ comparing average hashes of images,
+// see AHash. Like the Differ returned by NewPHash, it returns
+// the Hamming distance of the hashes, or 0 if it is at most maxDistance,
+// and draws their differing bits in the difference image.
+// Average hashes are the fastest to compute, but the least robust.
+func NewAHash(maxDistance int, opts ...Option) Differ {
+	return newHashDiffer("ahash", 8, func(m image.Image) []byte {
+		return hashBytes(AHash(m), 64)
+	}, maxDistance, opts)
+}
+
+// NewDHash creates a new Differ comparing difference hashes of images,
+// see DHash, like NewAHash.
+func NewDHash(maxDistance int, opts ...Option) Differ {
+	return newHashDiffer("dhash", 8, func(m image.Image) []byte {
+		return hashBytes(DHash(m), 64)
+	}, maxDistance, opts)
+}
+
+// AHash returns the 64-bit average hash of m. Its luminance is downsized
+// to 8 x 8 pixels, regardless of its aspect ratio, and bit y*8+x is set
+// if pixel x, y is brighter than their mean. See also PHash.
+func AHash(m image.Image) uint64 {
+	f := downsizeLuma(m, 8, 8)
+	var mean float64
+	for _, v := range f {
+		mean += v
+	}
+	mean /= float64(len(f))
+	var h uint64
+	for i, v := range f {
+		if v > mean {
+			h |= 1 << uint(i)
+		}
+	}
+	return h
+}
+
+// DHash returns the 64-bit difference hash of m. Its luminance is
+// downsized to 9 x 8 pixels, regardless of its aspect ratio, and bit
+// y*8+x is set if pixel x, y is brighter than pixel x+1, y.
+// See also PHash.
+func DHash(m image.Image) uint64 {
+	f := downsizeLuma(m, 9, 8)
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if f[y*9+x] > f[y*9+x+1] {
+				h |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return h
+}
+
+// HashDistance returns the Hamming distance of hashes h1 and h2
+// returned by PHash, AHash or DHash, the number of bits which differ.
+// Hashes are only comparable if they are returned by the same function.
+func HashDistance(h1, h2 uint64) int {
+	return bits.OnesCount64(h1 ^ h2)
+}
+
+// hashBytes returns the n low bits of h, bit i of h being bit i
+// of the result, see hashDiffer.
+func hashBytes(h uint64, n int) []byte {
+	b := make([]byte, (n+7)/8)
+	for i := 0; i < n; i++ {
+		if h&(1<<uint(i)) != 0 {
+			b[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return b
+}
+
+// downsizeLuma returns luminance of m resized to nw x nh pixels,
+// y*nw+x indexed. Every pixel is the mean of the pixels of m it covers,
+// or the nearest one if m is smaller.
+func downsizeLuma(m image.Image, nw, nh int) []float64 {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	l := luma(m)
+	f := make([]float64, nw*nh)
+	if w == 0 || h == 0 {
+		return f
+	}
+	for cy := 0; cy < nh; cy++ {
+		y0, y1 := cy*h/nh, (cy+1)*h/nh
+		if y1 == y0 {
+			y1++
+		}
+		for cx := 0; cx < nw; cx++ {
+			x0, x1 := cx*w/nw, (cx+1)*w/nw
+			if x1 == x0 {
+				x1++
+			}
+			var s float64
+			for y := y0; y < y1; y++ {
+				for _, v := range l[y*w+x0 : y*w+x1] {
+					s += v
+				}
+			}
+			f[cy*nw+cx] = s / float64((x1-x0)*(y1-y0))
+		}
+	}
+	return f
+}
+
+// Compare compares hashes of a and b and returns their Hamming distance.
+func (d *hashDiffer) Compare(a, b image.Image) (image.Image, int, error) {
+	return d.compareTimed(a, b, new(PhaseTimings))
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *hashDiffer) CompareInto(dst *image.NRGBA, a, b image.Image) (int, error) {
+	return d.compareInto(dst, a, b, new(PhaseTimings))
+}
+
+func (d *hashDiffer) compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error) {
+	diff := new(image.NRGBA)
+	n, err := d.compareInto(diff, a, b, t)
+	if err != nil {
+		return nil, -1, err
+	}
+	return diff, n, nil
+}
+
+func (d *hashDiffer) compareInto(diff *image.NRGBA, a, b image.Image, t *PhaseTimings) (int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return -1, ErrSize
+	}
+	if d.err != nil {
+		return -1, d.err
+	}
+	if err := d.opts.checkSize(ab); err != nil {
+		return -1, err
+	}
+	resize(diff, w, h)
+	if sameImage(a, b) {
+		fillPass(diff)
+		return 0, nil
+	}
+
+	p := newPhases(d.name, ab, t)
+	var ha, hb []byte
+	p.run("convert", &t.Convert, func() {
+		parallel(d.opts.workers(), func(int) {
+			ha = d.hash(a)
+		}, func(int) {
+			hb = d.hash(b)
+		})
+	})
+	x := make([]byte, len(ha))
+	dist := 0
+	for i := range x {
+		x[i] = ha[i] ^ hb[i]
+		dist += bits.OnesCount8(x[i])
+	}
+	if dist <= d.maxDistance {
+		fillPass(diff)
+		return 0, nil
+	}
+	p.run("compare", &t.Compare, func() {
+		for y := 0; y < h; y++ {
+			out := diff.Pix[diff.PixOffset(0, y):]
+			v := y * d.size / h
+			for px := 0; px < w; px++ {
+				c := passPixel
+				if i := v*d.size + px*d.size/w; x[i/8]&(0x80>>uint(i%8)) != 0 {
+					c = failPixel
+				}
+				copy(out[4*px:], c[:])
+			}
+		}
+	})
+	return dist, nil
+}
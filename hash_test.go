@@ -0,0 +1,80 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestAHashDHash(t *testing.T) {
+	// a horizontal gradient, brighter to the right
+	r := image.Rect(0, 0, 64, 32)
+	m := image.NewGray(r)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			m.SetGray(x, y, color.Gray{uint8(x * 4)})
+		}
+	}
+	// right half of every row
+	if h, want := AHash(m), uint64(0xf0f0f0f0f0f0f0f0); h != want {
+		t.Errorf("AHash = %016x; want %016x", h, want)
+	}
+	// no pixel is brighter than the next one
+	if h := DHash(m); h != 0 {
+		t.Errorf("DHash = %016x; want 0", h)
+	}
+	inv := image.NewGray(r)
+	for i, v := range m.Pix {
+		inv.Pix[i] = 0xff - v
+	}
+	if d := HashDistance(AHash(m), AHash(inv)); d != 64 {
+		t.Errorf("AHash distance of inverted images = %d; want 64", d)
+	}
+	if h := DHash(inv); h != 1<<64-1 {
+		t.Errorf("DHash of inverted image = %016x; want all bits set", h)
+	}
+}
+
+func TestHashDiffers(t *testing.T) {
+	fish1, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fish2, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		hash func(image.Image) uint64
+		new  func(maxDistance int, opts ...Option) Differ
+	}{
+		{AHash, NewAHash},
+		{DHash, NewDHash},
+	}
+	for i, test := range tests {
+		dist := HashDistance(test.hash(fish1), test.hash(fish2))
+		if dist > 10 {
+			t.Errorf("(%d) fish distance = %d; want small", i, dist)
+		}
+		if _, n, err := test.new(0).Compare(fish1, fish2); err != nil || n != dist {
+			t.Errorf("(%d) Compare: n = %d, err = %v; want %d", i, n, err, dist)
+		}
+		if _, n, err := test.new(dist).Compare(fish1, fish2); err != nil || n != 0 {
+			t.Errorf("(%d) Compare with maxDistance %d: n = %d, err = %v; want 0", i, dist, n, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"math"
+)
+
+// viridis holds colors of the viridis color map at evenly spaced
+// positions, from dark purple to yellow. It is perceptually uniform
+// and tells magnitudes apart with color vision deficiencies too.
+var viridis = [...][3]uint8{
+	{0x44, 0x01, 0x54},
+	{0x47, 0x2d, 0x7b},
+	{0x3b, 0x52, 0x8b},
+	{0x2c, 0x72, 0x8e},
+	{0x21, 0x90, 0x8c},
+	{0x27, 0xad, 0x81},
+	{0x5d, 0xc8, 0x63},
+	{0xaa, 0xdc, 0x32},
+	{0xfd, 0xe7, 0x25},
+}
+
+// heatPixel returns the NRGBA bytes of magnitude t, from 0 to 1, on
+// the viridis ramp. Magnitudes outside of that range are clamped.
+func heatPixel(t float64) [4]uint8 {
+	if !(t > 0) {
+		t = 0
+	} else if t > 1 {
+		t = 1
+	}
+	t *= float64(len(viridis) - 1)
+	i := int(t)
+	if i == len(viridis)-1 {
+		i--
+	}
+	f := t - float64(i)
+	var c [4]uint8
+	for k := range viridis[i] {
+		lo, hi := float64(viridis[i][k]), float64(viridis[i+1][k])
+		c[k] = uint8(lo + (hi-lo)*f + 0.5)
+	}
+	c[3] = 0xff
+	return c
+}
+
+// fillSame sets m to the difference image of identical images a
+// and b: the base image with WithOverlay, all clearPixel with
+// WithHeatmap, and passPixel otherwise.
+func (o options) fillSame(m *image.NRGBA, a, b image.Image) {
+	switch {
+	case o.hasOverlay:
+		paintOverlay(m, o.base(a, b), o.overlayDim, m.Rect)
+	case o.heatmap:
+		fillClear(m)
+	default:
+		fillPass(m)
+	}
+}
+
+// fillClear sets all pixels of m to clearPixel.
+func fillClear(m *image.NRGBA) {
+	r := m.Rect
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := m.Pix[m.PixOffset(r.Min.X, y):m.PixOffset(r.Max.X, y)]
+		for i := range row {
+			row[i] = 0
+		}
+	}
+}
+
+// paintHeat replaces failPixel pixels of diff within the zero-based
+// rectangle r, the result of comparing a and b, with heatPixel of
+// the largest difference of their samples, and passPixel pixels with
+// clearPixel, see WithHeatmap.
+func paintHeat(diff *image.NRGBA, a, b image.Image, r image.Rectangle) {
+	ab, bb := a.Bounds(), b.Bounds()
+	arow, brow := make([]pixel, r.Dx()), make([]pixel, r.Dx())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		readRow(arow, a, ab.Min.X+r.Min.X, ab.Min.Y+y)
+		readRow(brow, b, bb.Min.X+r.Min.X, bb.Min.Y+y)
+		out := diff.Pix[diff.PixOffset(r.Min.X, y):]
+		for x := range arow {
+			p := out[4*x : 4*x+4]
+			if !isFailPixel(p) {
+				clearPassing(p)
+				continue
+			}
+			c := heatPixel(float64(maxDelta(arow[x], brow[x])) / 0xffff)
+			copy(p, c[:])
+		}
+	}
+}
+
+// paintHeat replaces failPixel pixels of diff within r, whose top left
+// pixel is pixel 0, 0 of p, with heatPixel of the error of the pixel
+// relative to the threshold it failed, and passPixel pixels with
+// clearPixel, see WithHeatmap. The error is the larger of the ratios
+// of the luminance difference to its threshold and of the color
+// difference, weighed by color factor cf, to its threshold. Errors
+// from 1 to 10 are mapped logarithmically onto the ramp.
+func (p *debugPlanes) paintHeat(diff *image.NRGBA, r image.Rectangle, cf float64) {
+	lum, threshold := p[debugLuminance].Pix, p[debugThreshold].Pix
+	chroma, factor := p[debugChroma].Pix, p[debugFactor].Pix
+	w := p[0].Width
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		out := diff.Pix[diff.PixOffset(r.Min.X, y):]
+		i := (y - r.Min.Y) * w
+		for x := 0; x < r.Dx(); x++ {
+			px := out[4*x : 4*x+4]
+			if !isFailPixel(px) {
+				clearPassing(px)
+				continue
+			}
+			e := math.Max(lum[i+x]/threshold[i+x], chroma[i+x]*cf/factor[i+x])
+			c := heatPixel(math.Log10(e))
+			copy(px, c[:])
+		}
+	}
+}
+
+// clearPassing sets NRGBA pixel p to clearPixel if it is passPixel.
+// Pixels within WithChannelTolerance or anti-aliased are left as is.
+func clearPassing(p []uint8) {
+	if p[0]|p[1]|p[2] == 0 && p[3] == 0xff {
+		copy(p, clearPixel[:])
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+func TestHeatPixel(t *testing.T) {
+	for _, test := range []struct {
+		t    float64
+		want [4]uint8
+	}{
+		{0, [4]uint8{0x44, 0x01, 0x54, 0xff}},
+		{-1, [4]uint8{0x44, 0x01, 0x54, 0xff}},
+		{math.NaN(), [4]uint8{0x44, 0x01, 0x54, 0xff}},
+		{0.5, [4]uint8{0x21, 0x90, 0x8c, 0xff}},
+		{1, [4]uint8{0xfd, 0xe7, 0x25, 0xff}},
+		{2, [4]uint8{0xfd, 0xe7, 0x25, 0xff}},
+	} {
+		if c := heatPixel(test.t); c != test.want {
+			t.Errorf("heatPixel(%g) = %v; want %v", test.t, c, test.want)
+		}
+	}
+}
+
+// heatmapImages returns images whose heatmaps span the whole ramp:
+// the first row of b is a gradient from the black of a to white,
+// and the second one is a gradient of a single channel.
+func heatmapImages() (a, b *image.NRGBA) {
+	r := image.Rect(0, 0, 18, 2)
+	a, b = image.NewNRGBA(r), image.NewNRGBA(r)
+	for x := 0; x < r.Dx(); x++ {
+		v := uint8(x * 15)
+		a.SetNRGBA(x, 0, color.NRGBA{0, 0, 0, 0xff})
+		b.SetNRGBA(x, 0, color.NRGBA{v, v, v, 0xff})
+		a.SetNRGBA(x, 1, color.NRGBA{0x80, 0x80, 0x80, 0xff})
+		b.SetNRGBA(x, 1, color.NRGBA{0x80, 0x80, 0x80 + v/2, 0xff})
+	}
+	return a, b
+}
+
+// bumps returns a gray image, and the image with squares of
+// increasingly lighter gray on it, up to white, whose errors
+// relative to the thresholds of perceptual span the ramp.
+func bumps() (a, b *image.NRGBA) {
+	r := image.Rect(0, 0, 256, 64)
+	a, b = image.NewNRGBA(r), image.NewNRGBA(r)
+	draw.Draw(a, r, image.NewUniform(color.Gray{0x10}), image.Point{}, draw.Src)
+	draw.Draw(b, r, a, image.Point{}, draw.Src)
+	for i, d := range []uint8{8, 16, 27, 40, 60, 90, 120, 0xef} {
+		sq := image.Rect(32*i+8, 24, 32*i+24, 40)
+		draw.Draw(b, sq, image.NewUniform(color.Gray{0x10 + d}), image.Point{}, draw.Src)
+	}
+	return a, b
+}
+
+func TestHeatmap(t *testing.T) {
+	a, b := heatmapImages()
+	diff, n, err := NewBinary(WithHeatmap()).Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := diff.(*image.NRGBA)
+	for _, test := range []struct {
+		x, y int
+		want color.NRGBA
+	}{
+		{0, 0, color.NRGBA{}},
+		{17, 0, color.NRGBA{0xfd, 0xe7, 0x25, 0xff}},
+		{0, 1, color.NRGBA{}},
+	} {
+		if c := m.NRGBAAt(test.x, test.y); c != test.want {
+			t.Errorf("pixel %d,%d = %v; want %v", test.x, test.y, c, test.want)
+		}
+	}
+	if n != 34 || countMarked(m, m.Rect) != n {
+		t.Errorf("n = %d, %d marked; want 34", n, countMarked(m, m.Rect))
+	}
+	if r := diffBounds(m, false); r != image.Rect(1, 0, 18, 2) {
+		t.Errorf("diffBounds = %v; want (1,0)-(18,2)", r)
+	}
+
+	// identical images are all transparent
+	diff, _, err = NewDefaultPerceptual(WithHeatmap()).Compare(a, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := diff.(*image.NRGBA); !bytes.Equal(m.Pix, make([]uint8, len(m.Pix))) {
+		t.Error("identical images: pixels not transparent")
+	}
+}
+
+func TestPaintHeatPlanes(t *testing.T) {
+	p := newDebugPlanes(5, 1)
+	copy(p[debugLuminance].Pix, []float64{0, 1, 10, 100, 0})
+	copy(p[debugChroma].Pix, []float64{0, 0, 0, 0, 20})
+	for i := range p[0].Pix {
+		p[debugThreshold].Pix[i] = 1
+		p[debugFactor].Pix[i] = 2
+	}
+	diff := image.NewNRGBA(image.Rect(0, 0, 5, 1))
+	for _, x := range []int{1, 2, 3, 4} {
+		copy(diff.Pix[4*x:], failPixel[:])
+	}
+	copy(diff.Pix, passPixel[:])
+	p.paintHeat(diff, diff.Rect, 1)
+	start, end := color.NRGBA{0x44, 0x01, 0x54, 0xff}, color.NRGBA{0xfd, 0xe7, 0x25, 0xff}
+	for x, want := range []color.NRGBA{{}, start, end, end, end} {
+		if c := diff.NRGBAAt(x, 0); c != want {
+			t.Errorf("pixel %d = %v; want %v", x, c, want)
+		}
+	}
+}
+
+func TestHeatmapGolden(t *testing.T) {
+	a, b := heatmapImages()
+	pa, pb := bumps()
+	for _, test := range []struct {
+		name string
+		d    Differ
+		a, b image.Image
+	}{
+		{"binary", NewBinary(WithHeatmap()), a, b},
+		{"perceptual", NewDefaultPerceptual(WithHeatmap()), pa, pb},
+	} {
+		diff, _, err := test.d.Compare(test.a, test.b)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, diff); err != nil {
+			t.Fatal(err)
+		}
+		golden := filepath.Join("testdata", "heatmap_"+test.name+".png")
+		if *update {
+			if err := os.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%s heatmap differs from %s; run go test -update to regenerate", test.name, golden)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// HistMethod is a distance of color histograms, see NewHistogram.
+type HistMethod int
+
+// Histogram distances, all of them from 0 for equal histograms to 1.
+const (
+	// HistChiSquare is the symmetric chi-square distance, the sum of
+	// (h1-h2)²/(h1+h2) over bins, halved.
+	HistChiSquare HistMethod = iota
+	// HistCorrelation is (1-r)/2, where r is the Pearson correlation
+	// of the histograms.
+	HistCorrelation
+	// HistBhattacharyya is the Hellinger distance, sqrt(1-BC), where
+	// BC is the Bhattacharyya coefficient of the histograms.
+	HistBhattacharyya
+)
+
+func (m HistMethod) String() string {
+	switch m {
+	case HistChiSquare:
+		return "chisq"
+	case HistCorrelation:
+		return "correlation"
+	case HistBhattacharyya:
+		return "bhattacharyya"
+	}
+	return fmt.Sprintf("HistMethod(%d)", int(m))
+}
+
+type histogram struct {
+	bins   int
+	method HistMethod
+	// invalid options, returned by Compare
+	err  error
+	opts options
+}
+
+// NewHistogram creates a new Differ comparing color distributions
+// of images, regardless of where colors are. It builds histograms
+// of red, green and blue components of alpha-premultiplied colors
+// with bins bins each, and measures their distance with method,
+// averaged over the components, see HistogramDistance.
+//
+// Since no pixel differs on its own, Compare returns the distance
+// scaled by the number of pixels, rounded, so that a Threshold
+// percentage limits the distance, e.g. 5% is 0.05. The difference
+// image is a chart of the absolute differences of the histograms,
+// red, green and blue from the top, bins from the left, with bars
+// scaled to the largest difference.
+//
+// Compare returns an error if bins is not between 1 and 65536,
+// or method is unknown.
+func NewHistogram(bins int, method HistMethod, opts ...Option) Differ {
+	return &histogram{bins: bins, method: method, err: checkHistogram(bins, method), opts: newOptions(opts)}
+}
+
+func checkHistogram(bins int, method HistMethod) error {
+	if bins < 1 || bins > 1<<16 {
+		return fmt.Errorf("imgdiff: invalid number of histogram bins %d", bins)
+	}
+	if method < HistChiSquare || method > HistBhattacharyya {
+		return fmt.Errorf("imgdiff: unknown histogram method %v", method)
+	}
+	return nil
+}
+
+// HistogramDistance returns the distance of color histograms of a and b,
+// between 0 and 1, see NewHistogram. Unlike Compare, it accepts images
+// of different sizes.
+func HistogramDistance(a, b image.Image, bins int, method HistMethod) (float64, error) {
+	if err := checkHistogram(bins, method); err != nil {
+		return 0, err
+	}
+	return histDistance(colorHistogram(a, bins), colorHistogram(b, bins), method), nil
+}
+
+// colorHistogram returns histograms of red, green and blue components
+// of m, normalized to sum to 1, or all 0 for empty images.
+func colorHistogram(m image.Image, bins int) [3][]float64 {
+	var hist [3][]float64
+	for i := range hist {
+		hist[i] = make([]float64, bins)
+	}
+	b := m.Bounds()
+	row := make([]pixel, b.Dx())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		readRow(row, m, b.Min.X, y)
+		for _, p := range row {
+			for i := range hist {
+				hist[i][int(p[i])*bins>>16]++
+			}
+		}
+	}
+	if n := float64(b.Dx() * b.Dy()); n > 0 {
+		for i := range hist {
+			for j := range hist[i] {
+				hist[i][j] /= n
+			}
+		}
+	}
+	return hist
+}
+
+// histDistance returns the distance of histograms h1 and h2 with method,
+// averaged over the components.
+func histDistance(h1, h2 [3][]float64, method HistMethod) float64 {
+	var sum float64
+	for i := range h1 {
+		switch method {
+		case HistChiSquare:
+			sum += chiSquare(h1[i], h2[i])
+		case HistCorrelation:
+			sum += (1 - correlation(h1[i], h2[i])) / 2
+		case HistBhattacharyya:
+			sum += hellinger(h1[i], h2[i])
+		}
+	}
+	return sum / float64(len(h1))
+}
+
+func chiSquare(h1, h2 []float64) float64 {
+	var d float64
+	for i, v := range h1 {
+		if s := v + h2[i]; s > 0 {
+			d += (v - h2[i]) * (v - h2[i]) / s
+		}
+	}
+	return d / 2
+}
+
+// correlation returns the Pearson correlation of h1 and h2. It is 1
+// for equal histograms, even if they are constant, and 0 if only
+// one of them is.
+func correlation(h1, h2 []float64) float64 {
+	var m1, m2 float64
+	for i, v := range h1 {
+		m1 += v
+		m2 += h2[i]
+	}
+	m1 /= float64(len(h1))
+	m2 /= float64(len(h2))
+	var cov, v1, v2 float64
+	for i, v := range h1 {
+		d1, d2 := v-m1, h2[i]-m2
+		cov += d1 * d2
+		v1 += d1 * d1
+		v2 += d2 * d2
+	}
+	if v1 == 0 || v2 == 0 {
+		if v1 == v2 && m1 == m2 {
+			return 1
+		}
+		return 0
+	}
+	return cov / math.Sqrt(v1*v2)
+}
+
+// hellinger returns sqrt(1-BC) of normalized histograms h1 and h2,
+// computed as the equal sqrt(sum((sqrt(h1)-sqrt(h2))²)/2), which is
+// exactly 0 for equal histograms.
+func hellinger(h1, h2 []float64) float64 {
+	var d float64
+	for i, v := range h1 {
+		s := math.Sqrt(v) - math.Sqrt(h2[i])
+		d += s * s
+	}
+	return math.Sqrt(d / 2)
+}
+
+// Compare compares color histograms of a and b
+// and returns their scaled distance.
+func (d *histogram) Compare(a, b image.Image) (image.Image, int, error) {
+	return d.compareTimed(a, b, new(PhaseTimings))
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *histogram) CompareInto(dst *image.NRGBA, a, b image.Image) (int, error) {
+	return d.compareInto(dst, a, b, new(PhaseTimings))
+}
+
+func (d *histogram) compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error) {
+	diff := new(image.NRGBA)
+	n, err := d.compareInto(diff, a, b, t)
+	if err != nil {
+		return nil, -1, err
+	}
+	return diff, n, nil
+}
+
+func (d *histogram) compareInto(diff *image.NRGBA, a, b image.Image, t *PhaseTimings) (int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return -1, ErrSize
+	}
+	if d.err != nil {
+		return -1, d.err
+	}
+	if err := d.opts.checkSize(ab); err != nil {
+		return -1, err
+	}
+	resize(diff, w, h)
+	if sameImage(a, b) {
+		fillPass(diff)
+		return 0, nil
+	}
+
+	p := newPhases("histogram", ab, t)
+	var ha, hb [3][]float64
+	p.run("convert", &t.Convert, func() {
+		parallel(d.opts.workers(), func(int) {
+			ha = colorHistogram(a, d.bins)
+		}, func(int) {
+			hb = colorHistogram(b, d.bins)
+		})
+	})
+	var n int
+	p.run("compare", &t.Compare, func() {
+		n = int(math.Floor(histDistance(ha, hb, d.method)*float64(w*h) + 0.5))
+		drawHistDiff(diff, ha, hb)
+	})
+	return n, nil
+}
+
+// drawHistDiff draws a chart of absolute differences of histograms
+// h1 and h2 to m, see NewHistogram.
+func drawHistDiff(m *image.NRGBA, h1, h2 [3][]float64) {
+	fillPass(m)
+	var diffs [3][]float64
+	var max float64
+	for i := range diffs {
+		diffs[i] = make([]float64, len(h1[i]))
+		for j, v := range h1[i] {
+			diffs[i][j] = math.Abs(v - h2[i][j])
+			max = math.Max(max, diffs[i][j])
+		}
+	}
+	if max == 0 {
+		return
+	}
+	w, h := m.Rect.Dx(), m.Rect.Dy()
+	for i, d := range diffs {
+		var c [4]uint8
+		c[i], c[3] = 0xff, 0xff
+		// rows [y0, y1) of the component's chart
+		y0, y1 := i*h/len(diffs), (i+1)*h/len(diffs)
+		for x := 0; x < w; x++ {
+			top := y1 - int(math.Ceil(d[x*len(d)/w]/max*float64(y1-y0)))
+			for y := top; y < y1; y++ {
+				copy(m.Pix[m.PixOffset(x, y):], c[:])
+			}
+		}
+	}
+}
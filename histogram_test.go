@@ -0,0 +1,115 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+var histMethods = []HistMethod{HistChiSquare, HistCorrelation, HistBhattacharyya}
+
+func TestHistogramDistance(t *testing.T) {
+	fish1, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fish2, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fish1 twice as dark
+	dark := image.NewNRGBA(fish1.Bounds())
+	for y := dark.Rect.Min.Y; y < dark.Rect.Max.Y; y++ {
+		for x := dark.Rect.Min.X; x < dark.Rect.Max.X; x++ {
+			r, g, b, a := fish1.At(x, y).RGBA()
+			dark.Set(x, y, color.RGBA64{uint16(r / 2), uint16(g / 2), uint16(b / 2), uint16(a)})
+		}
+	}
+	black := image.NewGray(image.Rect(0, 0, 3, 5))
+	white := image.NewGray(image.Rect(0, 0, 7, 2))
+	for i := range white.Pix {
+		white.Pix[i] = 0xff
+	}
+
+	for _, method := range histMethods {
+		d, err := HistogramDistance(fish1, fish1, 64, method)
+		if err != nil || d != 0 {
+			t.Errorf("%v: distance to self = %v, %v; want 0", method, d, err)
+		}
+		// of any size
+		if d, _ := HistogramDistance(black, white, 2, method); math.Abs(d-1) > 1e-12 {
+			t.Errorf("%v: black and white distance = %v; want 1", method, d)
+		}
+		fish, _ := HistogramDistance(fish1, fish2, 64, method)
+		shift, _ := HistogramDistance(fish1, dark, 64, method)
+		if !(fish < shift) {
+			t.Errorf("%v: fish distance = %v, darkened fish distance = %v; want less", method, fish, shift)
+		}
+		if d, _ := HistogramDistance(dark, fish1, 64, method); math.Abs(d-shift) > 1e-12 {
+			t.Errorf("%v: distance from darkened fish = %v; want %v", method, d, shift)
+		}
+
+		_, n, err := NewHistogram(64, method).Compare(fish1, dark)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := fish1.Bounds()
+		if want := int(math.Floor(shift*float64(r.Dx()*r.Dy()) + 0.5)); n != want {
+			t.Errorf("%v: n = %d; want %d", method, n, want)
+		}
+	}
+
+	for _, test := range []struct {
+		bins   int
+		method HistMethod
+	}{{0, HistChiSquare}, {1<<16 + 1, HistChiSquare}, {64, HistBhattacharyya + 1}, {64, -1}} {
+		if _, err := HistogramDistance(black, white, test.bins, test.method); err == nil {
+			t.Errorf("%d bins, %v: no error", test.bins, test.method)
+		}
+		if _, _, err := NewHistogram(test.bins, test.method).Compare(black, black); err == nil {
+			t.Errorf("Compare: %d bins, %v: no error", test.bins, test.method)
+		}
+	}
+}
+
+func TestHistogramChart(t *testing.T) {
+	r := image.Rect(0, 0, 10, 9)
+	black := image.NewGray(r)
+	white := image.NewGray(r)
+	for i := range white.Pix {
+		white.Pix[i] = 0xff
+	}
+	diff, n, err := NewHistogram(2, HistBhattacharyya).Compare(black, white)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != r.Dx()*r.Dy() {
+		t.Errorf("n = %d; want %d", n, r.Dx()*r.Dy())
+	}
+	// both bins of every component differ by 1, full bars
+	m := diff.(*image.NRGBA)
+	for y := 0; y < r.Dy(); y++ {
+		var want [4]uint8
+		want[y/3], want[3] = 0xff, 0xff
+		for x := 0; x < r.Dx(); x++ {
+			if c := m.NRGBAAt(x, y); c != (color.NRGBA{want[0], want[1], want[2], want[3]}) {
+				t.Errorf("diff at %d, %d = %v; want %v", x, y, c, want)
+			}
+		}
+	}
+}
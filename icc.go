@@ -0,0 +1,309 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+)
+
+// ICCProfile is a parsed ICC color profile of the matrix/TRC class,
+// the kind of RGB display profiles such as sRGB, Display P3 and
+// Adobe RGB (1998). It converts images tagged with it to sRGB, so that
+// images of different profiles can be compared, see CompareWithProfiles.
+type ICCProfile struct {
+	// tone reproduction curves of red, green and blue,
+	// decoding samples to linear light
+	trc [3]iccCurve
+	// converts linear RGB of the profile to linear sRGB
+	m [3][3]float64
+}
+
+// srgbD50 converts linear sRGB to the D50 XYZ of ICC profiles.
+var srgbD50 = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// ParseICCProfile parses an ICC profile, e.g. embedded in a PNG iCCP chunk
+// or JPEG APP2 segments. Only RGB profiles with rXYZ, gXYZ, bXYZ colorants
+// and rTRC, gTRC, bTRC curves are supported; profiles made of lookup
+// tables only, such as those of printers, result in an error.
+func ParseICCProfile(b []byte) (*ICCProfile, error) {
+	if len(b) < 132 || string(b[36:40]) != "acsp" {
+		return nil, errors.New("imgdiff: invalid ICC profile")
+	}
+	if s := string(b[16:20]); s != "RGB " {
+		return nil, fmt.Errorf("imgdiff: unsupported ICC profile color space %q", s)
+	}
+	tags := make(map[string][]byte)
+	n := int(be32(b[128:]))
+	for i := 0; i < n; i++ {
+		if 132+12*(i+1) > len(b) {
+			return nil, errors.New("imgdiff: invalid ICC profile tag table")
+		}
+		e := b[132+12*i:]
+		off, size := be32(e[4:]), be32(e[8:])
+		if uint64(off)+uint64(size) > uint64(len(b)) {
+			return nil, fmt.Errorf("imgdiff: invalid ICC profile tag %q", e[:4])
+		}
+		tags[string(e[:4])] = b[off : off+size]
+	}
+	p := new(ICCProfile)
+	var m [3][3]float64 // profile RGB to XYZ
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		t := tags[sig]
+		if len(t) < 20 || string(t[:4]) != "XYZ " {
+			return nil, fmt.Errorf("imgdiff: unsupported ICC profile without %s", sig)
+		}
+		for j := 0; j < 3; j++ {
+			m[j][i] = s15Fixed16(t[8+4*j:])
+		}
+	}
+	for i, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		c, err := parseICCCurve(tags[sig])
+		if err != nil {
+			return nil, fmt.Errorf("imgdiff: unsupported ICC profile %s: %v", sig, err)
+		}
+		p.trc[i] = c
+	}
+	inv, ok := invert3(srgbD50)
+	if !ok {
+		panic("imgdiff: singular sRGB matrix")
+	}
+	p.m = mul3(inv, m)
+	return p, nil
+}
+
+// be16 and be32 read big-endian integers, as all of ICC profiles are.
+func be16(b []byte) uint16 {
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+func be32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(be32(b))) / 0x10000
+}
+
+// iccCurve decodes a sample in [0, 1] to linear light.
+type iccCurve func(v float64) float64
+
+// parseICCCurve parses a curveType or parametricCurveType tag.
+func parseICCCurve(t []byte) (iccCurve, error) {
+	if len(t) < 12 {
+		return nil, errors.New("missing curve")
+	}
+	switch string(t[:4]) {
+	case "curv":
+		n := int(be32(t[8:]))
+		if len(t) < 12+2*n {
+			return nil, errors.New("truncated curve")
+		}
+		switch n {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			g := float64(be16(t[12:])) / 0x100
+			return func(v float64) float64 { return math.Pow(v, g) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(be16(t[12+2*i:])) / 0xffff
+		}
+		return func(v float64) float64 {
+			f := v * float64(n-1)
+			i := int(f)
+			if i >= n-1 {
+				return table[n-1]
+			}
+			return table[i] + (f-float64(i))*(table[i+1]-table[i])
+		}, nil
+	case "para":
+		// number of parameters of each function type
+		counts := [...]int{1, 3, 4, 5, 7}
+		typ := int(be16(t[8:]))
+		if typ >= len(counts) || len(t) < 12+4*counts[typ] {
+			return nil, fmt.Errorf("invalid parametric curve type %d", typ)
+		}
+		// g, a, b, c, d, e, f as in the ICC specification,
+		// set so that every type is a special case of type 4
+		p := [7]float64{1, 1, 0, 0, 0, 0, 0}
+		for i := 0; i < counts[typ]; i++ {
+			p[i] = s15Fixed16(t[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		switch typ {
+		case 1:
+			// (aX+b)^g for X >= -b/a, else 0
+			d = -b / a
+		case 2:
+			// (aX+b)^g + c for X >= -b/a, else c
+			d, e, f = -b/a, c, c
+			c = 0
+		}
+		return func(v float64) float64 {
+			if v >= d {
+				return math.Pow(math.Max(a*v+b, 0), g) + e
+			}
+			return c*v + f
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported curve type %q", t[:4])
+}
+
+// ToSRGB returns m converted from the profile to sRGB. Colors out of
+// the sRGB gamut are clipped. The result has 8 bits per channel if m
+// does, 16 otherwise. FloatImage inputs are linear already and
+// returned as is.
+func (p *ICCProfile) ToSRGB(m image.Image) image.Image {
+	if _, ok := m.(FloatImage); ok {
+		return m
+	}
+	// decoding tables of 8-bit samples
+	var lut [3][256]float64
+	for i := range lut {
+		for v := range lut[i] {
+			lut[i][v] = p.trc[i](float64(v) / 0xff)
+		}
+	}
+	r := m.Bounds()
+	w, h := r.Dx(), r.Dy()
+	var dst8 *image.NRGBA
+	var dst16 *image.NRGBA64
+	if is8bit(m.ColorModel()) {
+		dst8 = image.NewNRGBA(image.Rect(0, 0, w, h))
+	} else {
+		dst16 = image.NewNRGBA64(image.Rect(0, 0, w, h))
+	}
+	row := make([]pixel, w)
+	for y := 0; y < h; y++ {
+		readRow(row, m, r.Min.X, r.Min.Y+y)
+		for x, px := range row {
+			var out [4]float64
+			if a := float64(px[3]); a > 0 {
+				var lin [3]float64
+				for i := range lin {
+					if px[3] == 0xffff && px[i]%0x101 == 0 {
+						lin[i] = lut[i][px[i]/0x101]
+						continue
+					}
+					lin[i] = p.trc[i](math.Min(float64(px[i])/a, 1))
+				}
+				for i := range lin {
+					v := p.m[i][0]*lin[0] + p.m[i][1]*lin[1] + p.m[i][2]*lin[2]
+					out[i] = srgbEncode(math.Min(math.Max(v, 0), 1))
+				}
+				out[3] = a / 0xffff
+			}
+			if dst8 != nil {
+				s := dst8.Pix[y*dst8.Stride+4*x:]
+				for i, v := range out {
+					s[i] = uint8(math.Round(v * 0xff))
+				}
+				continue
+			}
+			s := dst16.Pix[y*dst16.Stride+8*x:]
+			for i, v := range out {
+				u := uint16(math.Round(v * 0xffff))
+				s[2*i], s[2*i+1] = uint8(u>>8), uint8(u)
+			}
+		}
+	}
+	if dst8 != nil {
+		return dst8
+	}
+	return dst16
+}
+
+// srgbEncode encodes linear v in [0, 1] with the sRGB transfer function,
+// the inverse of srgbDecode.
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// CompareWithProfiles compares a and b with d after converting them to
+// sRGB from the ICC profiles they are tagged with, see ICCProfile.
+// Empty profiles are taken to be sRGB, as untagged images usually are.
+// If both profiles are the same, the images are compared as they are.
+func CompareWithProfiles(d Differ, a, b image.Image, aProfile, bProfile []byte) (image.Image, int, error) {
+	if !bytes.Equal(aProfile, bProfile) {
+		var err error
+		if a, err = toSRGB(a, aProfile); err != nil {
+			return nil, -1, err
+		}
+		if b, err = toSRGB(b, bProfile); err != nil {
+			return nil, -1, err
+		}
+	}
+	return d.Compare(a, b)
+}
+
+// toSRGB is ICCProfile.ToSRGB of the parsed profile,
+// or m itself if the profile is empty.
+func toSRGB(m image.Image, profile []byte) (image.Image, error) {
+	if len(profile) == 0 {
+		return m, nil
+	}
+	p, err := ParseICCProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	return p.ToSRGB(m), nil
+}
+
+// mul3 returns the product of 3x3 matrices a and b.
+func mul3(a, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for i := range m {
+		for j := range m[i] {
+			m[i][j] = a[i][0]*b[0][j] + a[i][1]*b[1][j] + a[i][2]*b[2][j]
+		}
+	}
+	return m
+}
+
+// invert3 returns the inverse of the 3x3 matrix m,
+// and false if it is singular.
+func invert3(m [3][3]float64) ([3][3]float64, bool) {
+	var inv [3][3]float64
+	for i := range inv {
+		for j := range inv[i] {
+			// cofactor of m[j][i], the transpose of m's
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			inv[i][j] = m[a][c]*m[b][d] - m[a][d]*m[b][c]
+		}
+	}
+	det := m[0][0]*inv[0][0] + m[0][1]*inv[1][0] + m[0][2]*inv[2][0]
+	if det == 0 || math.IsNaN(det) {
+		return inv, false
+	}
+	for i := range inv {
+		for j := range inv[i] {
+			inv[i][j] /= det
+		}
+	}
+	return inv, true
+}
@@ -0,0 +1,263 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// displayP3D50 converts linear Display P3 to the D50 XYZ of ICC profiles.
+var displayP3D50 = [3][3]float64{
+	{0.5151215, 0.2919769, 0.1570806},
+	{0.2411957, 0.6922455, 0.0665588},
+	{-0.0010529, 0.0418854, 0.7840729},
+}
+
+// srgbPara is the sRGB transfer function as an ICC parametric curve.
+var srgbPara = iccPara(3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045)
+
+// iccProfile returns an RGB matrix/TRC ICC profile of colorants m,
+// converting linear RGB to D50 XYZ, and the curve tag trc.
+func iccProfile(m [3][3]float64, trc []byte) []byte {
+	tags := [][]byte{}
+	for i := 0; i < 3; i++ {
+		tags = append(tags, iccXYZ(m[0][i], m[1][i], m[2][i]))
+	}
+	tags = append(tags, trc, trc, trc)
+	sigs := []string{"rXYZ", "gXYZ", "bXYZ", "rTRC", "gTRC", "bTRC"}
+	b := make([]byte, 132+12*len(tags))
+	copy(b[16:], "RGB XYZ ")
+	copy(b[36:], "acsp")
+	putBE32(b[128:], uint32(len(tags)))
+	for i, t := range tags {
+		e := b[132+12*i:]
+		copy(e, sigs[i])
+		putBE32(e[4:], uint32(len(b)))
+		putBE32(e[8:], uint32(len(t)))
+		b = append(b, t...)
+	}
+	putBE32(b, uint32(len(b)))
+	return b
+}
+
+func putBE32(b []byte, v uint32) {
+	b[0], b[1], b[2], b[3] = uint8(v>>24), uint8(v>>16), uint8(v>>8), uint8(v)
+}
+
+func putS15Fixed16(b []byte, v float64) {
+	putBE32(b, uint32(int32(math.Round(v*0x10000))))
+}
+
+func iccXYZ(x, y, z float64) []byte {
+	t := make([]byte, 20)
+	copy(t, "XYZ ")
+	putS15Fixed16(t[8:], x)
+	putS15Fixed16(t[12:], y)
+	putS15Fixed16(t[16:], z)
+	return t
+}
+
+func iccPara(typ int, params ...float64) []byte {
+	t := make([]byte, 12+4*len(params))
+	copy(t, "para")
+	t[9] = uint8(typ)
+	for i, v := range params {
+		putS15Fixed16(t[12+4*i:], v)
+	}
+	return t
+}
+
+func iccCurv(values ...uint16) []byte {
+	t := make([]byte, 12+2*len(values))
+	copy(t, "curv")
+	putBE32(t[8:], uint32(len(values)))
+	for i, v := range values {
+		t[12+2*i], t[13+2*i] = uint8(v>>8), uint8(v)
+	}
+	return t
+}
+
+func TestParseICCProfile(t *testing.T) {
+	p, err := ParseICCProfile(iccProfile(srgbD50, srgbPara))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sRGB to sRGB is the identity, up to rounding of s15Fixed16
+	for i := range p.m {
+		for j, v := range p.m[i] {
+			want := 0.0
+			if i == j {
+				want = 1
+			}
+			if math.Abs(v-want) > 1e-4 {
+				t.Errorf("m[%d][%d] = %v; want %v", i, j, v, want)
+			}
+		}
+	}
+	for _, v := range []float64{0, 0.01, 0.04045, 0.5, 1} {
+		if got, want := p.trc[0](v), srgbDecode(v); math.Abs(got-want) > 1e-4 {
+			t.Errorf("trc(%v) = %v; want %v", v, got, want)
+		}
+	}
+}
+
+func TestICCCurves(t *testing.T) {
+	for _, test := range []struct {
+		tag  []byte
+		v    float64
+		want float64
+	}{
+		{iccCurv(), 0.3, 0.3},
+		{iccCurv(0x0233), 0.5, math.Pow(0.5, 0x233/256.0)},
+		{iccCurv(0, 0x4000, 0xffff), 0.25, 0.125},
+		{iccCurv(0, 0x4000, 0xffff), 1, 1},
+		{iccPara(0, 2), 0.5, 0.25},
+		{iccPara(1, 2, 2, -0.5), 0.2, 0},
+		{iccPara(1, 2, 2, -0.5), 0.5, 0.25},
+		{iccPara(2, 2, 2, -0.5, 0.25), 0.2, 0.25},
+		{iccPara(2, 2, 2, -0.5, 0.25), 0.5, 0.5},
+		{iccPara(3, 2, 1, 0, 0.5, 0.5), 0.25, 0.125},
+		{iccPara(4, 2, 1, 0, 0.5, 0.5, 0.125, 0.25), 0.25, 0.375},
+		{iccPara(4, 2, 1, 0, 0.5, 0.5, 0.125, 0.25), 0.5, 0.375},
+	} {
+		c, err := parseICCCurve(test.tag)
+		if err != nil {
+			t.Errorf("%q: %v", test.tag[:4], err)
+			continue
+		}
+		if got := c(test.v); math.Abs(got-test.want) > 1e-4 {
+			t.Errorf("%x: c(%v) = %v; want %v", test.tag, test.v, got, test.want)
+		}
+	}
+	for _, tag := range [][]byte{nil, iccPara(5, 1), iccPara(3, 1), []byte("mft2\x00\x00\x00\x00\x00\x00\x00\x00")} {
+		if _, err := parseICCCurve(tag); err == nil {
+			t.Errorf("%q: no error", tag)
+		}
+	}
+}
+
+func TestParseICCProfileErrors(t *testing.T) {
+	valid := iccProfile(srgbD50, srgbPara)
+	gray := append([]byte(nil), valid...)
+	copy(gray[16:], "GRAY")
+	noTRC := append([]byte(nil), valid...)
+	copy(noTRC[132+12*5:], "kTRC")
+	for name, b := range map[string][]byte{
+		"empty":     nil,
+		"truncated": valid[:140],
+		"magic":     append([]byte("x"), valid[1:36]...),
+		"gray":      gray,
+		"no bTRC":   noTRC,
+		"tag table": append(append([]byte(nil), valid[:128]...), 0, 0, 0, 9, 0, 0, 0, 0),
+	} {
+		if _, err := ParseICCProfile(b); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+// p3Image returns m, of sRGB colors, with colors encoded in Display P3.
+func p3Image(m *image.NRGBA) *image.NRGBA {
+	inv, _ := invert3(displayP3D50)
+	toP3 := mul3(inv, srgbD50)
+	p := image.NewNRGBA(m.Bounds())
+	for i := 0; i < len(m.Pix); i += 4 {
+		var lin [3]float64
+		for c := range lin {
+			lin[c] = srgbDecode(float64(m.Pix[i+c]) / 0xff)
+		}
+		for c := 0; c < 3; c++ {
+			v := toP3[c][0]*lin[0] + toP3[c][1]*lin[1] + toP3[c][2]*lin[2]
+			p.Pix[i+c] = uint8(math.Round(srgbEncode(math.Min(math.Max(v, 0), 1)) * 0xff))
+		}
+		p.Pix[i+3] = m.Pix[i+3]
+	}
+	return p
+}
+
+// saturated returns an image of saturated sRGB colors. They are not
+// on the edge of the sRGB gamut, where rounding errors of samples
+// converted from other color spaces are largest.
+func saturated(w, h int) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g := 32+x*191/(w-1), 32+y*191/(h-1)
+			m.SetNRGBA(x, y, color.NRGBA{uint8(r), uint8(g), uint8(255 - r), 0xff})
+		}
+	}
+	return m
+}
+
+func TestCompareWithProfiles(t *testing.T) {
+	srgb := saturated(32, 32)
+	p3 := p3Image(srgb)
+	p3Profile := iccProfile(displayP3D50, srgbPara)
+	d := NewDefaultPerceptual()
+	if _, n, _ := d.Compare(srgb, p3); n == 0 {
+		t.Fatal("Compare: no different pixels of P3 colors compared as sRGB")
+	}
+	for _, test := range []struct {
+		a, b         image.Image
+		aProf, bProf []byte
+	}{
+		{srgb, p3, nil, p3Profile},
+		{p3, srgb, p3Profile, nil},
+		{p3, srgb, p3Profile, iccProfile(srgbD50, srgbPara)},
+		{p3, p3, p3Profile, p3Profile},
+	} {
+		_, n, err := CompareWithProfiles(d, test.a, test.b, test.aProf, test.bProf)
+		if err != nil || n != 0 {
+			t.Errorf("n = %d, err = %v; want 0", n, err)
+		}
+	}
+	if _, _, err := CompareWithProfiles(d, srgb, p3, nil, []byte("icc")); err == nil {
+		t.Error("invalid profile: no error")
+	}
+}
+
+func TestToSRGB(t *testing.T) {
+	p, err := ParseICCProfile(iccProfile(displayP3D50, srgbPara))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srgb := saturated(8, 8)
+	got := p.ToSRGB(p3Image(srgb)).(*image.NRGBA)
+	for i := range got.Pix {
+		// both conversions round to 8 bits, which is coarse
+		// for dark samples in linear light
+		if d := int(got.Pix[i]) - int(srgb.Pix[i]); d < -2 || d > 2 {
+			t.Fatalf("Pix[%d] = %d; want %d", i, got.Pix[i], srgb.Pix[i])
+		}
+	}
+	m16 := image.NewNRGBA64(image.Rect(0, 0, 2, 2))
+	if _, ok := p.ToSRGB(m16).(*image.NRGBA64); !ok {
+		t.Error("16-bit image: not converted to NRGBA64")
+	}
+	// P3 red is out of the sRGB gamut and clipped
+	red := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	red.SetNRGBA(0, 0, color.NRGBA{0xff, 0, 0, 0xff})
+	if c := p.ToSRGB(red).(*image.NRGBA).NRGBAAt(0, 0); c != (color.NRGBA{0xff, 0, 0, 0xff}) {
+		t.Errorf("P3 red: %v; want sRGB red", c)
+	}
+	// transparent pixels stay so
+	red.SetNRGBA(0, 0, color.NRGBA{})
+	if c := p.ToSRGB(red).(*image.NRGBA).NRGBAAt(0, 0); c != (color.NRGBA{}) {
+		t.Errorf("transparent: %v; want transparent black", c)
+	}
+}
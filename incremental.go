@@ -0,0 +1,276 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"time"
+)
+
+// regionDiffer is implemented by Differs which can recompute
+// a part of a difference image, see CompareIncremental.
+type regionDiffer interface {
+	// margin returns how far, in pixels, a change of an input pixel
+	// can affect pixels of the difference image.
+	margin() int
+	// compareRegion recomputes pixels of diff within r, given the
+	// zero-based images a and b of the size of diff. It returns
+	// the number of different pixels within r.
+	compareRegion(diff *image.NRGBA, a, b image.Image, r image.Rectangle) (int, error)
+}
+
+// CompareIncremental updates prev, a result of CompareResult, for images
+// a and b which differ from the previously compared ones only within
+// changed rectangles. The rectangles are in the comparison frame.
+//
+// Only parts of the difference image which the changes may affect are
+// recomputed, using the same Differ, so that the result is the same
+// as that of CompareResult(d, a, b). The perceptual algorithm needs
+// pixels up to 3*(2^(levels-1)-1) = 381 pixels around the changed
+// rectangles to do so, more with a wider kernel or more levels, see
+// WithKernel and WithPyramidLevels. Differs which don't support partial comparison
+// compare a and b in full, as do Differs with WithShiftTolerance or
+// WithOverlay, and all Differs if the image sizes changed.
+//
+// prev is not modified.
+func CompareIncremental(prev *Result, a, b image.Image, changed []image.Rectangle) (*Result, error) {
+	if prev.differ == nil {
+		return nil, errors.New("imgdiff: incremental comparison of a result not returned by CompareResult")
+	}
+	rd, ok := prev.differ.(regionDiffer)
+	// marks of overlaid pixels aren't counted by countMarked, and
+	// shifted pixels may match ones anywhere within the tolerance
+	ok = ok && !overlaid(prev.differ) && !shiftTolerant(prev.differ)
+	pd, isNRGBA := prev.Diff.(*image.NRGBA)
+	frame := prev.Diff.Bounds()
+	if !ok || !isNRGBA || a.Bounds().Size() != frame.Size() || b.Bounds().Size() != frame.Size() {
+		return CompareResult(prev.differ, a, b)
+	}
+	start := time.Now()
+
+	diff := image.NewNRGBA(frame)
+	for y := frame.Min.Y; y < frame.Max.Y; y++ {
+		copy(diff.Pix[diff.PixOffset(frame.Min.X, y):], pd.Pix[pd.PixOffset(frame.Min.X, y):pd.PixOffset(frame.Max.X, y)])
+	}
+	res := &Result{
+		Diff:    diff,
+		N:       prev.N,
+		OffsetA: a.Bounds().Min,
+		OffsetB: b.Bounds().Min,
+		differ:  prev.differ,
+	}
+	na, nb := normalize(a), normalize(b)
+	var err error
+	t := &res.Timings
+	// regions aren't split into phases
+	newPhases(algorithmName(res.differ), frame, t).run("compare", &t.Compare, func() {
+		for _, r := range changed {
+			r = r.Inset(-rd.margin()).Intersect(frame)
+			if r.Empty() {
+				continue
+			}
+			// overlapping rectangles are recomputed to the same pixels,
+			// so the count stays right if they are processed in turn
+			res.N -= countMarked(diff, r)
+			var n int
+			if n, err = rd.compareRegion(diff, na, nb, r); err != nil {
+				return
+			}
+			res.N += n
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.finish(start)
+	return res, nil
+}
+
+// shiftTolerant reports whether d was created WithShiftTolerance.
+func shiftTolerant(d Differ) bool {
+	switch d := d.(type) {
+	case *binary:
+		return d.opts.shiftTolerance > 0
+	case *perceptual:
+		return d.opts.shiftTolerance > 0
+	}
+	return false
+}
+
+// countMarked returns the number of pixels of m within r marked
+// as different, other than those within WithChannelTolerance
+// or anti-aliased, see WithAntiAliasing.
+func countMarked(m *image.NRGBA, r image.Rectangle) int {
+	n := 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			p := m.Pix[m.PixOffset(x, y):]
+			if isCounted(p) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// margin is 0, or 2 with WithAntiAliasing: whether a pixel is
+// anti-aliased depends on the neighbors of its neighbors.
+func (d *binary) margin() int {
+	if d.opts.antiAliasing {
+		return 2
+	}
+	return 0
+}
+
+func (d *binary) compareRegion(diff *image.NRGBA, a, b image.Image, r image.Rectangle) (int, error) {
+	a, b = d.opts.linearView(d.opts.alphaView(a)), d.opts.linearView(d.opts.alphaView(b))
+	n := d.compareWithin(diff, a, b, r)
+	if n > 0 && d.opts.antiAliasing {
+		n -= d.tolerateAA(diff, a, b, r)
+	}
+	if d.opts.heatmap {
+		paintHeat(diff, a, b, r)
+	} else if n > 0 && d.opts.deltaColors {
+		paintDeltas(diff, a, b, r)
+	}
+	return n, nil
+}
+
+// compareWithin is compareRegion without anti-aliasing detection
+// and WithDeltaColors.
+func (d *binary) compareWithin(diff *image.NRGBA, a, b image.Image, r image.Rectangle) int {
+	if fa, ok := a.(FloatImage); ok {
+		if fb, ok := b.(FloatImage); ok {
+			return compareFloat(diff, fa, fb, r, d.opts.floatEpsilon)
+		}
+	}
+	// TiledImages keep their offsets, see normalize
+	ra, bmin := r.Add(a.Bounds().Min), r.Min.Add(b.Bounds().Min)
+	shift := sampleShift(a.ColorModel(), b.ColorModel())
+	tol := d.tolerance(shift, roundsApart(a.ColorModel(), b.ColorModel()))
+	return compareRect(diff, r.Min, a, ra, b, bmin, shift, tol)
+}
+
+// margin is the reach of the Laplacian pyramid filter: pixels of level
+// l are reduced from pixels of level 0 up to kernel radius times 2^l-1
+// pixels away, and pixels up to 2^l-1 pixels away are interpolated
+// from them.
+func (d *perceptual) margin() int {
+	return (d.lap.radius() + 1) * (1<<(d.lap.levels-1) - 1)
+}
+
+// compareRegion builds the pyramids of the parts of a and b within
+// r extended by the margin, which is enough for exact pyramid values
+// within r. The parts start at multiples of the size of pixels of the
+// last level, so that their levels are subsampled at the same pixels
+// as those of the whole images. Frequencies of the pyramid levels
+// depend on the image width, so they are those of the whole images.
+func (d *perceptual) compareRegion(diff *image.NRGBA, a, b image.Image, r image.Rectangle) (int, error) {
+	a, b = d.opts.alphaView(a), d.opts.alphaView(b)
+	c := r.Inset(-d.margin())
+	n := 1 << (d.lap.levels - 1)
+	c.Min = c.Min.Sub(diff.Rect.Min).Div(n).Mul(n).Add(diff.Rect.Min)
+	c = c.Intersect(diff.Rect)
+	ca, cb := crop(a, c.Add(a.Bounds().Min)), crop(b, c.Add(b.Bounds().Min))
+	w, h := c.Dx(), c.Dy()
+	s := d.newRowScratch(diff.Rect.Dx())
+
+	// rows sets pyramid rows of s to columns [x0, x1) of rows y
+	// of the crops and returns their LAB colors
+	var rows func(y, x0, x1 int) (labImage, labImage)
+	if d.opts.float32 {
+		sa, sb := newImageScratch32(w, h, d.lap.levels), newImageScratch32(w, h, d.lap.levels)
+		parallel(d.opts.workers(), func(n int) {
+			sa.labLap(ca, d.lut, d.lum, d.lap.kernel, n)
+		}, func(n int) {
+			sb.labLap(cb, d.lut, d.lum, d.lap.kernel, n)
+		})
+		aLAB, bLAB := newLabImage(w), newLabImage(w)
+		rows = func(y, x0, x1 int) (labImage, labImage) {
+			return sa.rows(y, x0, x1, s.aRows, s.aBuf, s.tmp, aLAB), sb.rows(y, x0, x1, s.bRows, s.bBuf, s.tmp, bLAB)
+		}
+	} else {
+		sa, sb := newImageScratch(w, h, d.lap.levels), newImageScratch(w, h, d.lap.levels)
+		parallel(d.opts.workers(), func(n int) {
+			sa.labLap(ca, d.lut, d.lum, d.lap.kernel, n)
+		}, func(n int) {
+			sb.labLap(cb, d.lut, d.lum, d.lap.kernel, n)
+		})
+		rows = func(y, x0, x1 int) (labImage, labImage) {
+			s.setRows(sa.lap, sb.lap, y, x0, x1)
+			return sa.lab.rows(y, y+1, w).cols(x0, x1), sb.lab.rows(y, y+1, w).cols(x0, x1)
+		}
+	}
+
+	var dbg *debugPlanes
+	if d.opts.heatmap {
+		dbg = newDebugPlanes(r.Dx(), r.Dy())
+	}
+	x0, x1 := r.Min.X-c.Min.X, r.Max.X-c.Min.X
+	npix := 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		aLAB, bLAB := rows(y-c.Min.Y, x0, x1)
+		npix += d.compareRow(diff.Pix[diff.PixOffset(r.Min.X, y):], s, aLAB, bLAB, dbg.row(0, y-r.Min.Y, r.Dx()))
+	}
+	if d.opts.heatmap {
+		dbg.paintHeat(diff, r, d.cf)
+	} else if npix > 0 && d.opts.deltaColors {
+		paintDeltas(diff, a, b, r)
+	}
+	return npix, nil
+}
+
+// crop returns the part r of m, sharing pixels with it.
+func crop(m image.Image, r image.Rectangle) image.Image {
+	if f, ok := m.(FloatImage); ok {
+		return &croppedFloat{cropped{m, r}, f}
+	}
+	if s, ok := m.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return s.SubImage(r)
+	}
+	return &cropped{m, r}
+}
+
+// cropped is an image with bounds limited to r.
+type cropped struct {
+	m image.Image
+	r image.Rectangle
+}
+
+func (c *cropped) ColorModel() color.Model {
+	return c.m.ColorModel()
+}
+
+func (c *cropped) Bounds() image.Rectangle {
+	return c.r
+}
+
+func (c *cropped) At(x, y int) color.Color {
+	return c.m.At(x, y)
+}
+
+// croppedFloat is a cropped FloatImage.
+type croppedFloat struct {
+	cropped
+	f FloatImage
+}
+
+func (c *croppedFloat) FloatAt(x, y int) (r, g, b, a float32) {
+	return c.f.FloatAt(x, y)
+}
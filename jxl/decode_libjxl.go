@@ -0,0 +1,161 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build jxl && cgo
+// +build jxl,cgo
+
+package jxl
+
+/*
+#cgo pkg-config: libjxl
+#include <stdlib.h>
+#include <jxl/decode.h>
+#include <jxl/version.h>
+
+// dataProfile returns the encoded color profile of pixels returned
+// by dec, the argument list of which changed in libjxl 0.9.
+static JxlDecoderStatus dataProfile(const JxlDecoder* dec, JxlColorEncoding* enc) {
+#if JPEGXL_MAJOR_VERSION == 0 && JPEGXL_MINOR_VERSION < 9
+	return JxlDecoderGetColorAsEncodedProfile(dec, NULL, JXL_COLOR_PROFILE_TARGET_DATA, enc);
+#else
+	return JxlDecoderGetColorAsEncodedProfile(dec, JXL_COLOR_PROFILE_TARGET_DATA, enc);
+#endif
+}
+*/
+import "C"
+
+import (
+	"image"
+	"image/color"
+	"unsafe"
+)
+
+// HasDecoder reports whether the package is built with libjxl.
+const HasDecoder = true
+
+// decode runs libjxl decoder over data. Pixels are requested as big-endian
+// 16-bit non-premultiplied RGBA, which is the memory layout of image.NRGBA64.
+// The output buffer is allocated in C memory since libjxl retains it
+// across calls.
+func decode(data []byte, configOnly bool) (image.Image, image.Config, error) {
+	var cfg image.Config
+	if len(data) == 0 {
+		return nil, cfg, ErrFormat
+	}
+	dec := C.JxlDecoderCreate(nil)
+	if dec == nil {
+		return nil, cfg, ErrFormat
+	}
+	defer C.JxlDecoderDestroy(dec)
+
+	events := C.JXL_DEC_BASIC_INFO | C.JXL_DEC_COLOR_ENCODING | C.JXL_DEC_FULL_IMAGE
+	if C.JxlDecoderSubscribeEvents(dec, C.int(events)) != C.JXL_DEC_SUCCESS {
+		return nil, cfg, ErrFormat
+	}
+	C.JxlDecoderSetUnpremultiplyAlpha(dec, C.JXL_TRUE)
+	in := C.CBytes(data)
+	defer C.free(in)
+	if C.JxlDecoderSetInput(dec, (*C.uint8_t)(in), C.size_t(len(data))) != C.JXL_DEC_SUCCESS {
+		return nil, cfg, ErrFormat
+	}
+	C.JxlDecoderCloseInput(dec)
+
+	format := C.JxlPixelFormat{
+		num_channels: 4,
+		data_type:    C.JXL_TYPE_UINT16,
+		endianness:   C.JXL_BIG_ENDIAN,
+	}
+	var (
+		info C.JxlBasicInfo
+		out  unsafe.Pointer
+		size C.size_t
+	)
+	defer func() {
+		if out != nil {
+			C.free(out)
+		}
+	}()
+	for {
+		switch C.JxlDecoderProcessInput(dec) {
+		case C.JXL_DEC_BASIC_INFO:
+			if C.JxlDecoderGetBasicInfo(dec, &info) != C.JXL_DEC_SUCCESS {
+				return nil, cfg, ErrFormat
+			}
+			cfg = image.Config{
+				ColorModel: color.NRGBA64Model,
+				Width:      int(info.xsize),
+				Height:     int(info.ysize),
+			}
+			if configOnly {
+				return nil, cfg, nil
+			}
+		case C.JXL_DEC_COLOR_ENCODING:
+			// have libjxl convert wide-gamut and HDR content to sRGB,
+			// which it can't do without a CMS for images not encoded
+			// in XYB, so the resulting profile is checked
+			gray := C.JXL_BOOL(C.JXL_FALSE)
+			if info.num_color_channels == 1 {
+				gray = C.JXL_TRUE
+			}
+			var enc C.JxlColorEncoding
+			C.JxlColorEncodingSetToSRGB(&enc, gray)
+			C.JxlDecoderSetPreferredColorProfile(dec, &enc)
+			if !isSRGB(dec) {
+				return nil, cfg, ErrColorProfile
+			}
+		case C.JXL_DEC_NEED_IMAGE_OUT_BUFFER:
+			if C.JxlDecoderImageOutBufferSize(dec, &format, &size) != C.JXL_DEC_SUCCESS {
+				return nil, cfg, ErrFormat
+			}
+			if out = C.malloc(size); out == nil {
+				return nil, cfg, ErrFormat
+			}
+			if C.JxlDecoderSetImageOutBuffer(dec, &format, out, size) != C.JXL_DEC_SUCCESS {
+				return nil, cfg, ErrFormat
+			}
+		case C.JXL_DEC_FULL_IMAGE:
+			// only the first frame is returned
+			m := image.NewNRGBA64(image.Rect(0, 0, cfg.Width, cfg.Height))
+			if out == nil || int(size) != len(m.Pix) {
+				return nil, cfg, ErrFormat
+			}
+			copy(m.Pix, C.GoBytes(out, C.int(size)))
+			return m, cfg, nil
+		case C.JXL_DEC_SUCCESS:
+			return nil, cfg, ErrFormat
+		default:
+			// JXL_DEC_ERROR or JXL_DEC_NEED_MORE_INPUT with all input given
+			return nil, cfg, ErrFormat
+		}
+	}
+}
+
+// isSRGB reports whether pixels returned by dec are sRGB or sRGB gray.
+func isSRGB(dec *C.JxlDecoder) bool {
+	var enc C.JxlColorEncoding
+	// images with an ICC profile have no encoded profile
+	if C.dataProfile(dec, &enc) != C.JXL_DEC_SUCCESS {
+		return false
+	}
+	switch enc.color_space {
+	case C.JXL_COLOR_SPACE_RGB:
+		if enc.primaries != C.JXL_PRIMARIES_SRGB {
+			return false
+		}
+	case C.JXL_COLOR_SPACE_GRAY:
+	default:
+		return false
+	}
+	return enc.white_point == C.JXL_WHITE_POINT_D65 && enc.transfer_function == C.JXL_TRANSFER_FUNCTION_SRGB
+}
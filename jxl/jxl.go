@@ -0,0 +1,77 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jxl registers a JPEG XL decoder with image.Decode.
+//
+// Both the bare codestream and the ISO-BMFF container forms are recognized.
+// Decoding is done by libjxl and requires building with the jxl tag:
+//
+//	go build -tags jxl
+//
+// Otherwise Decode and DecodeConfig return ErrNoDecoder, so that JPEG XL
+// inputs fail with a clear message rather than an unknown format error.
+// Images are decoded to *image.NRGBA64. Those encoded in XYB are
+// converted to sRGB by libjxl, others must be sRGB already, or
+// ErrColorProfile is returned.
+package jxl
+
+import (
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// codestream signature
+	magicCodestream = "\xff\x0a"
+	// ISO-BMFF container signature box
+	magicContainer = "\x00\x00\x00\x0cJXL \x0d\x0a\x87\x0a"
+)
+
+var (
+	// ErrNoDecoder is returned when the package is built without libjxl.
+	ErrNoDecoder = errors.New("jxl: decoding requires building with -tags jxl and libjxl installed")
+	// ErrFormat is returned when the input is not a valid JPEG XL image.
+	ErrFormat = errors.New("jxl: invalid format")
+	// ErrColorProfile is returned for images which libjxl can't
+	// convert to sRGB.
+	ErrColorProfile = errors.New("jxl: unsupported color profile, want sRGB")
+)
+
+func init() {
+	image.RegisterFormat("jxl", magicCodestream, Decode, DecodeConfig)
+	image.RegisterFormat("jxl", magicContainer, Decode, DecodeConfig)
+}
+
+// Decode reads a JPEG XL image from r.
+func Decode(r io.Reader) (image.Image, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m, _, err := decode(data, false)
+	return m, err
+}
+
+// DecodeConfig returns the color model and dimensions of a JPEG XL image
+// without decoding the entire image.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	_, cfg, err := decode(data, true)
+	return cfg, err
+}
@@ -0,0 +1,88 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jxl
+
+import (
+	"image"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSniff(t *testing.T) {
+	for _, data := range []string{magicCodestream + "\x00garbage", magicContainer + "garbage"} {
+		_, name, err := image.DecodeConfig(strings.NewReader(data))
+		if name != "jxl" {
+			t.Errorf("%q: format = %q; want jxl", data, name)
+		}
+		if !HasDecoder && err != ErrNoDecoder {
+			t.Errorf("%q: err = %v; want ErrNoDecoder", data, err)
+		}
+		if HasDecoder && err == nil {
+			t.Errorf("%q: decoded garbage", data)
+		}
+	}
+}
+
+// TestDecodeFixtures decodes JPEG XL files in testdata and compares them
+// with PNG files of the same name, which must be lossless encodings
+// of the same image. Fixtures are generated by testdata/mkjxl.sh.
+func TestDecodeFixtures(t *testing.T) {
+	if !HasDecoder {
+		t.Skip("built without libjxl")
+	}
+	files, _ := filepath.Glob(filepath.Join("testdata", "*.jxl"))
+	if len(files) == 0 {
+		t.Fatal("no fixtures in testdata, run mkjxl.sh")
+	}
+	for _, f := range files {
+		m, err := decodeFile(f)
+		if err != nil {
+			t.Errorf("%s: %v", f, err)
+			continue
+		}
+		want, err := decodeFile(strings.TrimSuffix(f, ".jxl") + ".png")
+		if err != nil {
+			t.Errorf("%s: %v", f, err)
+			continue
+		}
+		if m.Bounds() != want.Bounds() {
+			t.Errorf("%s: bounds = %v; want %v", f, m.Bounds(), want.Bounds())
+			continue
+		}
+		b := m.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r1, g1, b1, a1 := m.At(x, y).RGBA()
+				r2, g2, b2, a2 := want.At(x, y).RGBA()
+				if r1>>8 != r2>>8 || g1>>8 != g2>>8 || b1>>8 != b2>>8 || a1>>8 != a2>>8 {
+					t.Errorf("%s: (%d, %d) differs", f, x, y)
+				}
+			}
+		}
+	}
+}
+
+func decodeFile(p string) (image.Image, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, _, err := image.Decode(f)
+	return m, err
+}
@@ -0,0 +1,8 @@
+#!/bin/sh
+# Generates the JPEG XL fixtures in this directory, lossless encodings
+# of the PNG files of the same name. Requires cjxl from libjxl.
+# Run from this directory: sh mkjxl.sh
+set -e
+for f in *.png; do
+	cjxl -d 0 "$f" "${f%.png}.jxl"
+done
@@ -0,0 +1,98 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sync"
+)
+
+// linearLUT maps the high byte of 16-bit gamma-encoded samples
+// to 16-bit linear ones, see WithLinearLight.
+type linearLUT [256]uint16
+
+var (
+	srgbOnce sync.Once
+	srgbLUT  *linearLUT
+)
+
+// newLinearLUT returns the linearLUT of gamma, or of the sRGB
+// transfer function if gamma is 0.
+func newLinearLUT(gamma float64) *linearLUT {
+	if gamma == 0 {
+		srgbOnce.Do(func() {
+			srgbLUT = buildLinearLUT(srgbDecode)
+		})
+		return srgbLUT
+	}
+	return buildLinearLUT(func(v float64) float64 {
+		return math.Pow(v, gamma)
+	})
+}
+
+func buildLinearLUT(decode func(float64) float64) *linearLUT {
+	l := new(linearLUT)
+	for i := range l {
+		l[i] = uint16(math.Round(decode(float64(i)/0xff) * 0xffff))
+	}
+	return l
+}
+
+// validLinearGamma returns an error if gamma of WithLinearLight
+// is negative or NaN.
+func validLinearGamma(gamma float64) error {
+	if !(gamma >= 0) {
+		return fmt.Errorf("imgdiff: invalid gamma %g", gamma)
+	}
+	return nil
+}
+
+// linearView returns m with linear samples if WithLinearLight is set
+// and m is not a FloatImage, whose samples are linear already.
+// Otherwise it returns m itself.
+func (o options) linearView(m image.Image) image.Image {
+	if !o.linear {
+		return m
+	}
+	if _, ok := m.(FloatImage); ok {
+		return m
+	}
+	return &linearImage{Image: m, lut: newLinearLUT(o.linearGamma)}
+}
+
+// linearImage is a view of Image with linear alpha-premultiplied
+// red, green and blue samples. Its color model is that of Image,
+// so that binary compares it with as many bits as the original.
+type linearImage struct {
+	image.Image
+	lut *linearLUT
+}
+
+func (m *linearImage) At(x, y int) color.Color {
+	r, g, b, a := m.Image.At(x, y).RGBA()
+	p := pixel{r, g, b, a}
+	m.linearize(&p)
+	return color.RGBA64{uint16(p[0]), uint16(p[1]), uint16(p[2]), uint16(p[3])}
+}
+
+// linearize replaces red, green and blue samples of p with linear ones.
+func (m *linearImage) linearize(p *pixel) {
+	for i := 0; i < 3; i++ {
+		p[i] = uint32(m.lut[p[i]>>8])
+	}
+}
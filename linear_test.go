@@ -0,0 +1,89 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLinearLight(t *testing.T) {
+	// gray levels 0 to 63, brightened by 3
+	a, err := readTestImage("dark_gradient.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("dark_gradient_ref.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := a.Bounds().Dx() * a.Bounds().Dy()
+	count := func(d Differ) int {
+		_, n, err := d.Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if n := count(NewBinary()); n != all {
+		t.Errorf("gamma-encoded: n = %d; want %d", n, all)
+	}
+	if n := count(NewBinary(WithChannelTolerance(2, 2, 2, 0))); n != all {
+		t.Errorf("gamma-encoded within 2: n = %d; want %d", n, all)
+	}
+	// levels up to 13 are 0 as linear 8-bit samples
+	linear := count(NewBinary(WithLinearLight(0)))
+	if linear >= all || linear == 0 {
+		t.Errorf("linear: n = %d; want between 0 and %d", linear, all)
+	}
+	if n := count(NewBinary(WithLinearLight(0), WithChannelTolerance(2, 2, 2, 0))); n != 0 {
+		t.Errorf("linear within 2: n = %d; want 0", n)
+	}
+	if n := count(NewBinary(WithLinearLight(2.2))); n >= all {
+		t.Errorf("gamma 2.2: n = %d; want less than %d", n, all)
+	}
+	// the same with generic images
+	if _, n, err := NewBinary(WithLinearLight(0)).Compare(generic{a}, generic{b}); err != nil || n != linear {
+		t.Errorf("generic linear: n = %d, err = %v; want %d", n, err, linear)
+	}
+
+	for _, gamma := range []float64{-1, math.NaN()} {
+		if _, _, err := NewBinary(WithLinearLight(gamma)).Compare(a, b); err == nil {
+			t.Errorf("gamma %g: no error", gamma)
+		}
+	}
+}
+
+func TestLinearLUT(t *testing.T) {
+	srgb := newLinearLUT(0)
+	if srgb != newLinearLUT(0) {
+		t.Error("sRGB table is built again")
+	}
+	for _, l := range []*linearLUT{srgb, newLinearLUT(2.2)} {
+		if l[0] != 0 || l[0xff] != 0xffff {
+			t.Errorf("ends: %d, %d; want 0, 65535", l[0], l[0xff])
+		}
+		for i := 1; i < len(l); i++ {
+			if l[i] < l[i-1] {
+				t.Fatalf("decreasing at %d: %d, %d", i, l[i-1], l[i])
+			}
+		}
+	}
+	// sRGB 50% gray is about 21.4% linear
+	if v := float64(srgb[0x80]) / 0xffff; math.Abs(v-0.2159) > 0.001 {
+		t.Errorf("sRGB 0x80 = %.4f; want 0.2159", v)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import "image"
+
+// lowMemBandRows is the number of diff rows computed at once
+// by compareBands.
+const lowMemBandRows = 128
+
+// compareBands does the same as Compare but builds and consumes pyramids
+// in horizontal bands of rows, so that only a window of rows of each
+// level, those a band and the next levels depend on, is held in memory
+// at a time. Windows move down with the bands, so that every row is
+// computed once. Once budget, if not nil, is exceeded, no more bands
+// are compared. Rows compared are reported to prog.
+func (d *perceptual) compareBands(diff *image.NRGBA, a, b image.Image, p phases, dbg *debugPlanes, budget *diffBudget, prog *progress) int {
+	w, h := a.Bounds().Dx(), a.Bounds().Dy()
+	var rows rowScratches
+	levels := d.lap.levels
+	aLap, bLap := newSlidingPyramid(w, h, levels), newSlidingPyramid(w, h, levels)
+	lo, hi := make([]int, levels), make([]int, levels)
+	tile := d.opts.tileSize(w)
+	// convolutions are resized to every level, one for each image
+	ac, bc := newConvolution(d.lap.kernel, w, h, tile), newConvolution(d.lap.kernel, w, h, tile)
+	aRow, bRow := ac.newRow(), bc.newRow()
+	npix := 0
+	for y0 := 0; y0 < h && !budget.exceeded(); y0 += lowMemBandRows {
+		y1 := y0 + lowMemBandRows
+		if y1 > h {
+			y1 = h
+		}
+		d.bandRows(y0, y1, h, lo, hi)
+		var aLAB, bLAB labImage
+		p.run("convert", &p.t.Convert, func() {
+			parallel(d.opts.workers(), func(int) {
+				aLAB = d.bandLum(a, aLap, lo[0], hi[0], y0, y1)
+			}, func(int) {
+				bLAB = d.bandLum(b, bLap, lo[0], hi[0], y0, y1)
+			})
+		})
+		p.run("pyramid", &p.t.Pyramid, func() {
+			parallel(d.opts.workers(), func(int) {
+				aLap.reduce(ac, lo, hi, aRow)
+			}, func(int) {
+				bLap.reduce(bc, lo, hi, bRow)
+			})
+		})
+		p.run("compare", &p.t.Compare, func() {
+			npix += forBands(d.opts.workers(), y1-y0, func(b0, b1 int) int {
+				s := rows.get(d, w)
+				defer rows.put(s)
+				n := 0
+				forTiles(w, y0+b0, y0+b1, tile, func(x0, x1, y int) {
+					if budget.exceeded() {
+						return
+					}
+					i := y - y0
+					s.setRows(aLap.p, bLap.p, y, x0, x1)
+					aRow, bRow := aLAB.rows(i, i+1, w).cols(x0, x1), bLAB.rows(i, i+1, w).cols(x0, x1)
+					k := d.compareRow(s.diffRow(diff, x0, y), s, aRow, bRow, dbg.row(x0, y, x1-x0))
+					budget.add(k)
+					n += k
+					if x1 == w {
+						prog.add(1)
+					}
+				})
+				return n
+			})
+		})
+	}
+	return npix
+}
+
+// bandRows sets rows [lo[l], hi[l]) of each level l to those comparing
+// rows [y0, y1) of h depends on: the rows they are interpolated from,
+// see expandRow, and those the rows of the next level are reduced from,
+// up to kernel radius rows around twice their indices.
+func (d *perceptual) bandRows(y0, y1, h int, lo, hi []int) {
+	r := d.lap.radius()
+	for l := len(lo) - 1; l >= 0; l-- {
+		n := levelSize(h, l)
+		lo[l], hi[l] = y0>>l, next((y1-1)>>l, n)+1
+		if l+1 < len(lo) {
+			if v := 2*lo[l+1] - r; v < lo[l] {
+				lo[l] = v
+			}
+			if v := 2*(hi[l+1]-1) + r + 1; v > hi[l] {
+				hi[l] = v
+			}
+		}
+		lo[l], hi[l] = clampRows(lo[l], hi[l], n)
+	}
+}
+
+// bandLum computes luminance of rows [lo, hi) of m into the first level
+// of its pyramid p, other than those p already holds. It returns LAB
+// colors of rows [y0, y1), indexed from y0.
+func (d *perceptual) bandLum(m image.Image, p *slidingPyramid, lo, hi, y0, y1 int) labImage {
+	from, to := p.slide(0, lo, hi)
+	labRowsInto(p.p[0][from:to], labImage{}, m, d.lut, d.lum, from)
+	_, lab := labRows(m, d.lut, d.lum, y0, y1)
+	return lab
+}
+
+// slidingPyramid is a pyramid of which only a window of rows of each
+// level is held, the other rows being nil. Windows only move down,
+// buffers of rows leaving them are reused by rows entering them.
+type slidingPyramid struct {
+	p [][][]float64
+	// width of level 0
+	w int
+	// rows [lo[l], hi[l]) of level l are held
+	lo, hi []int
+	// unused row buffers of each level
+	free [][][]float64
+}
+
+func newSlidingPyramid(w, h, levels int) *slidingPyramid {
+	s := &slidingPyramid{
+		p:    make([][][]float64, levels),
+		w:    w,
+		lo:   make([]int, levels),
+		hi:   make([]int, levels),
+		free: make([][][]float64, levels),
+	}
+	for l := range s.p {
+		s.p[l] = make([][]float64, levelSize(h, l))
+	}
+	return s
+}
+
+// slide moves the window of level l to rows [lo, hi), which must not
+// start or end above the current one, and returns the rows entering
+// it, [from, hi), which are allocated but not computed.
+func (s *slidingPyramid) slide(l, lo, hi int) (from, to int) {
+	rows := s.p[l]
+	for y := s.lo[l]; y < lo && y < s.hi[l]; y++ {
+		s.free[l] = append(s.free[l], rows[y])
+		rows[y] = nil
+	}
+	from = s.hi[l]
+	if from < lo {
+		from = lo
+	}
+	for y := from; y < hi; y++ {
+		if n := len(s.free[l]); n > 0 {
+			rows[y], s.free[l] = s.free[l][n-1], s.free[l][:n-1]
+			continue
+		}
+		rows[y] = make([]float64, levelSize(s.w, l))
+	}
+	s.lo[l], s.hi[l] = lo, hi
+	return from, hi
+}
+
+// reduce slides the windows of levels 1 and up to rows [lo[l], hi[l])
+// and computes the rows entering them, out of the previous levels,
+// using c and its row buffer row. The window of level 0 must be in
+// place, with all of its rows computed.
+func (s *slidingPyramid) reduce(c *convolution, lo, hi []int, row []float64) {
+	for l := 1; l < len(s.p); l++ {
+		from, to := s.slide(l, lo[l], hi[l])
+		c.resize(levelSize(s.w, l-1), len(s.p[l-1]))
+		c.reduce(s.p[l], s.p[l-1], from, to, row)
+	}
+}
+
+// clampRows clamps rows range [y0, y1) to [0, h).
+func clampRows(y0, y1, h int) (int, int) {
+	if y0 < 0 {
+		y0 = 0
+	}
+	if y1 > h {
+		y1 = h
+	}
+	return y0, y1
+}
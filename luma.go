@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import "image"
+
+// luma709 returns the 16-bit Rec. 709 luma of the alpha-premultiplied
+// samples of p, that is of p composited over black.
+func luma709(p pixel) uint32 {
+	// weights 0.2126, 0.7152 and 0.0722 scaled to 1<<16
+	return (13933*p[0] + 46871*p[1] + 4732*p[2] + 1<<15) >> 16
+}
+
+// readLuma reads 16-bit lumas of len(dst) pixels of m starting at (x0, y),
+// using buf, of the same length, for pixels of images other than Gray,
+// Gray16 and YCbCr. Lumas of those are read from Pix or the Y plane,
+// as is, without color conversion.
+func readLuma(dst []uint32, buf []pixel, m image.Image, x0, y int) {
+	switch m := m.(type) {
+	case *image.Gray:
+		pix := m.Pix[m.PixOffset(x0, y):]
+		for x := range dst {
+			dst[x] = uint32(pix[x]) * 0x101
+		}
+	case *image.Gray16:
+		pix := m.Pix[m.PixOffset(x0, y):]
+		for x := range dst {
+			dst[x] = uint32(pix[2*x])<<8 | uint32(pix[2*x+1])
+		}
+	case *image.YCbCr:
+		pix := m.Y[m.YOffset(x0, y):]
+		for x := range dst {
+			dst[x] = uint32(pix[x]) * 0x101
+		}
+	default:
+		readRow(buf, m, x0, y)
+		for x := range dst {
+			dst[x] = luma709(buf[x])
+		}
+	}
+}
+
+// compareLuma is compareRect with WithLuminanceOnly: it compares lumas
+// of pixels, shifted right by shift bits, drawing pixels which differ
+// gray, as bright as the difference of their 8-bit lumas.
+func compareLuma(diff *image.NRGBA, dp image.Point, a image.Image, r image.Rectangle, b image.Image, bmin image.Point, shift uint, tol *tolerance) int {
+	w := r.Dx()
+	la, lb := make([]uint32, w), make([]uint32, w)
+	buf := make([]pixel, w)
+	n := 0
+	for y := 0; y < r.Dy(); y++ {
+		readLuma(la, buf, a, r.Min.X, r.Min.Y+y)
+		readLuma(lb, buf, b, bmin.X, bmin.Y+y)
+		out := diff.Pix[diff.PixOffset(dp.X, dp.Y+y):]
+		for x := range la {
+			d := abs(int64(la[x]>>shift) - int64(lb[x]>>shift))
+			c := passPixel
+			switch {
+			case d == 0:
+			case tol.lumaTolerated(d):
+				c = tolerPixel
+			default:
+				c = lumaPixel(d << shift >> 8)
+				n++
+			}
+			copy(out[4*x:], c[:])
+		}
+	}
+	return n
+}
+
+// lumaPixel returns the NRGBA bytes of a counted pixel whose 8-bit
+// lumas differ by d: gray of that brightness, but at least 1, so that
+// it is not passPixel, and not tolerPixel.
+func lumaPixel(d int64) [4]uint8 {
+	v := uint8(d)
+	if v == 0 {
+		v = 1
+	}
+	if v == tolerPixel[0] {
+		v++
+	}
+	return [4]uint8{v, v, v, 0xff}
+}
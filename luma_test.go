@@ -0,0 +1,120 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func TestLuminanceOnly(t *testing.T) {
+	r := image.Rect(0, 0, 16, 16)
+	// the same lumas, different chroma
+	a := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+	b := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+	for i := range a.Y {
+		a.Y[i], b.Y[i] = uint8(i), uint8(i)
+	}
+	for i := range a.Cb {
+		a.Cb[i], a.Cr[i] = 0x80, 0x80
+		b.Cb[i], b.Cr[i] = 0x70, 0x90
+	}
+	if _, n, _ := NewBinary().Compare(a, b); n == 0 {
+		t.Error("chroma: n = 0 without WithLuminanceOnly")
+	}
+	if _, n, _ := NewBinary(WithLuminanceOnly()).Compare(a, b); n != 0 {
+		t.Errorf("chroma: n = %d; want 0", n)
+	}
+
+	// gray differences of 1, 3 and 0x40
+	g1, g2 := image.NewGray(r), image.NewGray(r)
+	g2.SetGray(1, 1, color.Gray{1})
+	g2.SetGray(2, 2, color.Gray{3})
+	g2.SetGray(3, 3, color.Gray{0x40})
+	tests := []struct {
+		d    Differ
+		n    int
+		want map[image.Point][4]uint8
+	}{
+		{NewBinary(WithLuminanceOnly()), 3, map[image.Point][4]uint8{
+			{1, 1}: {1, 1, 1, 0xff},
+			{2, 2}: {3, 3, 3, 0xff},
+			{3, 3}: {0x41, 0x41, 0x41, 0xff},
+			{4, 4}: passPixel,
+		}},
+		{NewBinary(WithLuminanceOnly(), WithChannelTolerance(3, 0, 0, 0)), 1, map[image.Point][4]uint8{
+			{1, 1}: tolerPixel,
+			{2, 2}: tolerPixel,
+			{3, 3}: {0x41, 0x41, 0x41, 0xff},
+		}},
+	}
+	for i, test := range tests {
+		diff, n, err := test.d.Compare(g1, g2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != test.n {
+			t.Errorf("(%d) n = %d; want %d", i, n, test.n)
+		}
+		m := diff.(*image.NRGBA)
+		for p, want := range test.want {
+			if c := m.Pix[m.PixOffset(p.X, p.Y):][:4]; !bytes.Equal(c, want[:]) {
+				t.Errorf("(%d) %v = %v; want %v", i, p, c, want)
+			}
+		}
+	}
+}
+
+func TestReadLuma(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r := image.Rect(-3, 5, 20, 17)
+	ycbcr := image.NewYCbCr(r, image.YCbCrSubsampleRatio422)
+	rnd.Read(ycbcr.Y)
+	ims := append(randomImages(r, rnd), ycbcr)
+	for _, m := range ims {
+		for _, d := range []Differ{NewBinary(WithLuminanceOnly()), NewBinary(WithLuminanceOnly(), WithChannelTolerance(5, 5, 5, 0))} {
+			b := image.NewGray(r)
+			rnd.Read(b.Pix)
+			want, wantN, err := d.Compare(generic{gray{m}}, generic{b})
+			if err != nil {
+				t.Fatal(err)
+			}
+			diff, n, err := d.Compare(m, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != wantN || !bytes.Equal(diff.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+				t.Errorf("%T: n = %d; want %d and the same difference image", m, n, wantN)
+			}
+		}
+	}
+}
+
+// gray is an image whose colors are the lumas of Image.
+type gray struct {
+	image.Image
+}
+
+func (m gray) At(x, y int) color.Color {
+	switch m := m.Image.(type) {
+	case *image.YCbCr:
+		return color.Gray{m.YCbCrAt(x, y).Y}
+	}
+	r, g, b, a := m.Image.At(x, y).RGBA()
+	return color.Gray16{uint16(luma709(pixel{r, g, b, a}))}
+}
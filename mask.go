@@ -0,0 +1,164 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bufio"
+	bin "encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// The RLE mask format is a compact encoding of a binary mask,
+// such as the set of pixels that differ between two images.
+// All multi-byte integers are big-endian.
+//
+//	magic   [4]byte  "IDRL"
+//	version uint8    currently 1
+//	width   uint32
+//	height  uint32
+//	runs    uvarint...
+//
+// Runs are unsigned varints, as in encoding/binary, holding lengths of
+// alternating runs of unset and set pixels in row-major order, starting
+// with unset pixels. A zero-length run is only valid as the first one,
+// for masks which start with a set pixel. Runs must add up to exactly
+// width*height pixels.
+const (
+	rleMagic   = "IDRL"
+	rleVersion = 1
+	// rleMaxPixels bounds the mask size accepted by DecodeMaskRLE
+	// to avoid huge allocations from corrupt headers.
+	rleMaxPixels = MaxPixels
+)
+
+// ErrMaskFormat is returned by DecodeMaskRLE when the input
+// is not a valid RLE mask.
+var ErrMaskFormat = errors.New("imgdiff: invalid RLE mask")
+
+// EncodeMaskRLE writes mask to w in the RLE mask format.
+// A pixel is considered set if its alpha value is non-zero.
+func EncodeMaskRLE(mask *image.Alpha, w io.Writer) error {
+	b := mask.Bounds()
+	bw := bufio.NewWriter(w)
+	var hdr [13]byte
+	copy(hdr[:], rleMagic)
+	hdr[4] = rleVersion
+	bin.BigEndian.PutUint32(hdr[5:], uint32(b.Dx()))
+	bin.BigEndian.PutUint32(hdr[9:], uint32(b.Dy()))
+	if _, err := bw.Write(hdr[:]); err != nil {
+		return err
+	}
+	var (
+		buf [bin.MaxVarintLen64]byte
+		run uint64
+		set bool
+	)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := mask.Pix[mask.PixOffset(b.Min.X, y):]
+		for x := 0; x < b.Dx(); x++ {
+			if (row[x] != 0) != set {
+				n := bin.PutUvarint(buf[:], run)
+				if _, err := bw.Write(buf[:n]); err != nil {
+					return err
+				}
+				run, set = 0, !set
+			}
+			run++
+		}
+	}
+	if run > 0 {
+		n := bin.PutUvarint(buf[:], run)
+		if _, err := bw.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// DecodeMaskRLE reads a mask in the RLE mask format from r.
+// Set pixels have alpha value of 0xff, unset pixels are zero.
+// Masks of more than MaxPixels pixels are rejected.
+func DecodeMaskRLE(r io.Reader) (*image.Alpha, error) {
+	br := bufio.NewReader(r)
+	var hdr [13]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, ErrMaskFormat
+	}
+	if string(hdr[:4]) != rleMagic || hdr[4] != rleVersion {
+		return nil, ErrMaskFormat
+	}
+	w := uint64(bin.BigEndian.Uint32(hdr[5:]))
+	h := uint64(bin.BigEndian.Uint32(hdr[9:]))
+	total := w * h
+	if total > rleMaxPixels {
+		return nil, ErrMaskFormat
+	}
+	// runs are read before the mask is allocated, so that truncated
+	// input fails early; each of them takes at least a byte of it
+	var (
+		runs []uint64
+		pos  uint64
+	)
+	for pos < total {
+		run, err := bin.ReadUvarint(br)
+		if err != nil || run > total-pos || run == 0 && len(runs) > 0 {
+			return nil, ErrMaskFormat
+		}
+		runs = append(runs, run)
+		pos += run
+	}
+	mask := image.NewAlpha(image.Rect(0, 0, int(w), int(h)))
+	pos = 0
+	for i, run := range runs {
+		if i%2 == 1 {
+			pix := mask.Pix[pos : pos+run]
+			for j := range pix {
+				pix[j] = 0xff
+			}
+		}
+		pos += run
+	}
+	return mask, nil
+}
+
+// DiffMask returns a binary mask of the pixels marked as different
+// in the diff image m, as produced by the Differs of this package.
+// A pixel is considered different unless it is opaque black, or fully
+// transparent as passing pixels are with WithHeatmap.
+// The mask has a zero-based rectangle of the same size as m.
+func DiffMask(m image.Image) *image.Alpha {
+	b := m.Bounds()
+	mask := image.NewAlpha(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			if marked(m.At(b.Min.X+x, b.Min.Y+y)) {
+				mask.SetAlpha(x, y, color.Alpha{0xff})
+			}
+		}
+	}
+	return mask
+}
+
+// marked reports whether c, a pixel of a diff image, marks a difference.
+func marked(c color.Color) bool {
+	if c, ok := c.(color.NRGBA); ok {
+		return isMarked([]uint8{c.R, c.G, c.B, c.A})
+	}
+	r, g, b, a := c.RGBA()
+	return r|g|b != 0 || a != 0xffff && a != 0
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math/rand"
+	"testing"
+)
+
+func TestMaskRLERoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	sizes := []image.Point{{0, 0}, {1, 1}, {1, 300}, {300, 1}, {17, 13}, {64, 64}}
+	for _, size := range sizes {
+		for _, density := range []float64{0, 0.01, 0.5, 1} {
+			m := image.NewAlpha(image.Rect(0, 0, size.X, size.Y))
+			for i := range m.Pix {
+				if rnd.Float64() < density {
+					m.Pix[i] = 0xff
+				}
+			}
+			testMaskRoundTrip(t, m)
+		}
+	}
+}
+
+func TestMaskRLEFish(t *testing.T) {
+	a, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, _, err := NewDefaultPerceptual().Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask := DiffMask(diff)
+	rle := testMaskRoundTrip(t, mask)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, mask); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("fish mask: RLE %d bytes, PNG %d bytes", rle, buf.Len())
+}
+
+func TestMaskRLESubImage(t *testing.T) {
+	m := image.NewAlpha(image.Rect(0, 0, 10, 10))
+	m.Pix[m.PixOffset(3, 4)] = 0xff
+	sub := m.SubImage(image.Rect(2, 3, 6, 8)).(*image.Alpha)
+	var buf bytes.Buffer
+	if err := EncodeMaskRLE(sub, &buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeMaskRLE(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bounds() != image.Rect(0, 0, 4, 5) {
+		t.Fatalf("bounds = %v", got.Bounds())
+	}
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 4; x++ {
+			want := uint8(0)
+			if x == 1 && y == 1 {
+				want = 0xff
+			}
+			if a := got.AlphaAt(x, y).A; a != want {
+				t.Errorf("(%d, %d) = %d; want %d", x, y, a, want)
+			}
+		}
+	}
+}
+
+func TestMaskRLEInvalid(t *testing.T) {
+	m := image.NewAlpha(image.Rect(0, 0, 8, 8))
+	m.Pix[10] = 0xff
+	var buf bytes.Buffer
+	if err := EncodeMaskRLE(m, &buf); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+	tests := map[string][]byte{
+		"empty":     nil,
+		"magic":     append([]byte("XXXX"), valid[4:]...),
+		"version":   append(append([]byte{}, valid[:4]...), append([]byte{2}, valid[5:]...)...),
+		"truncated": valid[:len(valid)-1],
+		"header":    valid[:8],
+		"overflow":  append(append([]byte{}, valid[:len(valid)-1]...), 100),
+		"zero run":  append(append([]byte{}, valid[:14]...), 0, 53),
+		// 65535 x 65535, over MaxPixels
+		"huge": append(append([]byte{}, valid[:5]...), 0, 0, 0xff, 0xff, 0, 0, 0xff, 0xff, 1),
+		// 15000 x 15000, with a single run
+		"huge truncated": append(append([]byte{}, valid[:5]...), 0, 0, 0x3a, 0x98, 0, 0, 0x3a, 0x98, 1),
+	}
+	for name, data := range tests {
+		if _, err := DecodeMaskRLE(bytes.NewReader(data)); err != ErrMaskFormat {
+			t.Errorf("%s: err = %v; want ErrMaskFormat", name, err)
+		}
+	}
+}
+
+// testMaskRoundTrip encodes and decodes m, reporting any mismatch.
+// It returns the encoded size.
+func testMaskRoundTrip(t *testing.T, m *image.Alpha) int {
+	var buf bytes.Buffer
+	if err := EncodeMaskRLE(m, &buf); err != nil {
+		t.Fatal(err)
+	}
+	n := buf.Len()
+	got, err := DecodeMaskRLE(&buf)
+	if err != nil {
+		t.Errorf("%v: %v", m.Bounds(), err)
+		return n
+	}
+	if got.Bounds() != m.Bounds() {
+		t.Errorf("bounds = %v; want %v", got.Bounds(), m.Bounds())
+		return n
+	}
+	if !bytes.Equal(got.Pix, m.Pix) {
+		t.Errorf("%v: decoded pixels differ", m.Bounds())
+	}
+	return n
+}
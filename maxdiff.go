@@ -0,0 +1,89 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// maxDiffRows is the number of rows binary compares at a time
+// with WithMaxDiff, between which it checks the budget.
+const maxDiffRows = 16
+
+// validMaxDiff returns an error if the limit of WithMaxDiff is invalid.
+func (o options) validMaxDiff() error {
+	if o.hasMaxDiff && o.maxDiff < 0 {
+		return fmt.Errorf("imgdiff: invalid max diff %d", o.maxDiff)
+	}
+	return nil
+}
+
+// budget returns the diffBudget of a Compare call with WithMaxDiff,
+// or nil if all pixels are compared.
+func (o options) budget() *diffBudget {
+	if !o.hasMaxDiff || o.shiftTolerance > 0 || o.antiAliasing {
+		return nil
+	}
+	return &diffBudget{max: int64(o.maxDiff)}
+}
+
+// diffBudget counts different pixels of a Compare call with WithMaxDiff.
+// It is shared by goroutines comparing bands of rows, which stop once
+// it's exceeded. A nil *diffBudget is never exceeded.
+type diffBudget struct {
+	max int64
+	// accessed atomically
+	n int64
+}
+
+// add counts n more different pixels.
+func (b *diffBudget) add(n int) {
+	if b != nil && n > 0 {
+		atomic.AddInt64(&b.n, int64(n))
+	}
+}
+
+// exceeded reports whether more than max pixels differ.
+func (b *diffBudget) exceeded() bool {
+	return b != nil && atomic.LoadInt64(&b.n) > b.max
+}
+
+// forStrips calls f with bounds [y0, y1) of strips of h rows, one after
+// another, until b is exceeded, and returns the sum of the results,
+// which are counted by b. Rows are reported to p as they are done,
+// one strip per row if p is not nil. If both b and p are nil, f is
+// called once with all rows.
+func (b *diffBudget) forStrips(h int, p *progress, f func(y0, y1 int) int) int {
+	if b == nil && p == nil {
+		return f(0, h)
+	}
+	rows := maxDiffRows
+	if p != nil {
+		rows = 1
+	}
+	n := 0
+	for y0 := 0; y0 < h && !b.exceeded(); y0 += rows {
+		y1 := y0 + rows
+		if y1 > h {
+			y1 = h
+		}
+		k := f(y0, y1)
+		b.add(k)
+		p.add(y1 - y0)
+		n += k
+	}
+	return n
+}
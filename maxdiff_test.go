@@ -0,0 +1,121 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"testing"
+)
+
+func TestMaxDiff(t *testing.T) {
+	a, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta := &tiled{toNRGBA(a), image.Pt(64, 48)}
+	tb := &tiled{toNRGBA(b), image.Pt(64, 48)}
+	tests := []struct {
+		name string
+		new  func(...Option) Differ
+		a, b image.Image
+	}{
+		{"binary", func(o ...Option) Differ { return NewBinary(o...) }, a, b},
+		{"binary/generic", func(o ...Option) Differ { return NewBinary(o...) }, generic{a}, generic{b}},
+		{"binary/tiled", func(o ...Option) Differ { return NewBinary(o...) }, ta, tb},
+		{"perceptual", func(o ...Option) Differ { return NewDefaultPerceptual(o...) }, a, b},
+		{"perceptual/tiled", func(o ...Option) Differ { return NewDefaultPerceptual(append(o, WithTiling(64))...) }, a, b},
+		{"perceptual/lowmem", func(o ...Option) Differ { return NewDefaultPerceptual(append(o, WithLowMemory())...) }, a, b},
+		{"perceptual/float32", func(o ...Option) Differ { return NewDefaultPerceptual(append(o, WithFloat32())...) }, a, b},
+	}
+	for _, test := range tests {
+		_, total, err := test.new().Compare(test.a, test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total < 100 {
+			t.Fatalf("%s: %d different pixels; want more to stop early", test.name, total)
+		}
+		maxes := []int{0, 99, total - 1}
+		if testing.Short() {
+			// stopping at the last pixel takes about a full comparison
+			maxes = maxes[:2]
+		}
+		for _, max := range maxes {
+			d := test.new(WithMaxDiff(max), WithMaxWorkers(4))
+			m, n, err := d.Compare(test.a, test.b)
+			if err != ErrMaxDiff || m != nil || n <= max || n > total {
+				t.Errorf("%s: WithMaxDiff(%d): Compare = %v, %d, %v; want nil, %d < n <= %d, ErrMaxDiff", test.name, max, m, n, err, max, total)
+			}
+			n, err = CompareCount(d, test.a, test.b)
+			if err != ErrMaxDiff || n <= max || n > total {
+				t.Errorf("%s: WithMaxDiff(%d): CompareCount = %d, %v; want %d < n <= %d, ErrMaxDiff", test.name, max, n, err, max, total)
+			}
+		}
+		m, n, err := test.new(WithMaxDiff(total)).Compare(test.a, test.b)
+		if err != nil || m == nil || n != total {
+			t.Errorf("%s: WithMaxDiff(%d): Compare = %v, %d, %v; want an image, %d, nil", test.name, total, m, n, err, total)
+		}
+	}
+}
+
+func TestMaxDiffIgnored(t *testing.T) {
+	a, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pixels counted first may be unmarked by these later
+	for _, d := range []Differ{
+		NewBinary(WithMaxDiff(0), WithShiftTolerance(1)),
+		NewBinary(WithMaxDiff(0), WithAntiAliasing()),
+		NewDefaultPerceptual(WithMaxDiff(0), WithShiftTolerance(1)),
+	} {
+		if _, _, err := d.Compare(a, b); err != nil {
+			t.Errorf("%T: Compare: %v", d, err)
+		}
+	}
+	for _, d := range []Differ{NewBinary(WithMaxDiff(-1)), NewDefaultPerceptual(WithMaxDiff(-1))} {
+		if _, _, err := d.Compare(a, b); err == nil || err == ErrMaxDiff {
+			t.Errorf("%T: WithMaxDiff(-1): err = %v; want invalid max diff", d, err)
+		}
+	}
+}
+
+func TestDiffBudgetForStrips(t *testing.T) {
+	var calls [][2]int
+	f := func(y0, y1 int) int {
+		calls = append(calls, [2]int{y0, y1})
+		return 3
+	}
+	var nilBudget *diffBudget
+	if n := nilBudget.forStrips(100, nil, f); n != 3 || len(calls) != 1 || calls[0] != [2]int{0, 100} {
+		t.Errorf("nil budget: n = %d, calls %v; want 3, [[0 100]]", n, calls)
+	}
+	calls = nil
+	b := &diffBudget{max: 7}
+	if n := b.forStrips(100, nil, f); n != 9 || len(calls) != 3 || calls[2] != [2]int{2 * maxDiffRows, 3 * maxDiffRows} {
+		t.Errorf("budget of 7: n = %d, calls %v; want 9 in 3 strips", n, calls)
+	}
+	if !b.exceeded() {
+		t.Error("budget of 7 is not exceeded after 9 pixels")
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"math"
+)
+
+// ErrorStats are aggregate errors of two compared images,
+// see Result.Stats. Differs only set the fields of their metrics,
+// the others are 0.
+type ErrorStats struct {
+	// MSE is the mean squared error of alpha-premultiplied RGBA samples
+	// scaled to [0, 1], over all pixels. Set by NewMSE's Differ.
+	MSE float64
+	// PSNR is the peak signal-to-noise ratio in decibels, for the peak
+	// sample value of 1. It is +Inf for images without errors.
+	// Set by NewMSE's Differ.
+	PSNR float64
+	// GMSD is the gradient magnitude similarity deviation, 0 for images
+	// which look the same and larger the more they differ.
+	// Set by NewGMSD's Differ.
+	GMSD float64
+	// Gain and Offset remap 8-bit luminance v of the second image
+	// to v*Gain+Offset, matching the first one, see NewNormalized.
+	// Set by NewNormalized's Differ, along with the stats of the
+	// Differ it wraps.
+	Gain, Offset float64
+	// Shift is the offset of the content of the second image relative
+	// to the first one, see Align. Set by NewAligned's Differ, along
+	// with the stats of the Differ it wraps.
+	Shift image.Point
+	// Cells are the cells of the grid in which the images differ, row
+	// by row, see NewGrid. Set by NewGrid's Differ, but not the stats
+	// of the Differ it wraps, which would be those of single cells.
+	Cells []GridCell
+}
+
+// statsDiffer is implemented by Differs which compute ErrorStats.
+type statsDiffer interface {
+	// compareStats is compareTimed setting s as well.
+	compareStats(a, b image.Image, t *PhaseTimings, s *ErrorStats) (image.Image, int, error)
+}
+
+type mse struct {
+	threshold float64
+	opts      options
+}
+
+// NewMSE creates a new Differ based on mean squared error. The squared
+// error of a pixel is the mean of squared differences of its alpha-
+// premultiplied RGBA samples, scaled to [0, 1]. Pixels with errors
+// above threshold are counted as different.
+//
+// In the difference image, pixels which are not different are black as
+// with the other algorithms, and different ones are gray, the brighter
+// the larger their root mean square error.
+//
+// MSE and PSNR of the whole images are set in Result.Stats by
+// CompareResult.
+func NewMSE(threshold float64, opts ...Option) Differ {
+	return &mse{threshold: threshold, opts: newOptions(opts)}
+}
+
+// Compare compares a and b by squared errors of their pixels.
+func (d *mse) Compare(a, b image.Image) (image.Image, int, error) {
+	return d.compareStats(a, b, new(PhaseTimings), new(ErrorStats))
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *mse) CompareInto(dst *image.NRGBA, a, b image.Image) (int, error) {
+	return d.compareInto(dst, a, b, new(PhaseTimings), new(ErrorStats))
+}
+
+func (d *mse) compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error) {
+	return d.compareStats(a, b, t, new(ErrorStats))
+}
+
+func (d *mse) compareStats(a, b image.Image, t *PhaseTimings, s *ErrorStats) (image.Image, int, error) {
+	diff := new(image.NRGBA)
+	n, err := d.compareInto(diff, a, b, t, s)
+	if err != nil {
+		return nil, -1, err
+	}
+	return diff, n, nil
+}
+
+func (d *mse) compareInto(diff *image.NRGBA, a, b image.Image, t *PhaseTimings, s *ErrorStats) (int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return -1, ErrSize
+	}
+	if err := d.opts.checkSize(ab); err != nil {
+		return -1, err
+	}
+	resize(diff, w, h)
+	if sameImage(a, b) {
+		fillPass(diff)
+		*s = ErrorStats{PSNR: math.Inf(1)}
+		return 0, nil
+	}
+
+	// sums of squared errors of rows, added up in order,
+	// so that MSE doesn't depend on the number of workers
+	rows := make([]float64, h)
+	var npix int
+	newPhases("mse", ab, t).run("compare", &t.Compare, func() {
+		npix = forBands(d.opts.workers(), h, func(y0, y1 int) int {
+			return d.compareRows(diff, a, b, rows, y0, y1)
+		})
+	})
+	var sum float64
+	for _, v := range rows {
+		sum += v
+	}
+	*s = ErrorStats{PSNR: math.Inf(1)}
+	if w*h > 0 {
+		s.MSE = sum / float64(w*h)
+	}
+	if s.MSE > 0 {
+		s.PSNR = -10 * math.Log10(s.MSE)
+	}
+	return npix, nil
+}
+
+// compareRows compares rows [y0, y1) of a and b, writing diff and sums
+// of squared errors of the rows to rows[y]. It returns the number of
+// different pixels.
+func (d *mse) compareRows(diff *image.NRGBA, a, b image.Image, rows []float64, y0, y1 int) int {
+	ab, bb := a.Bounds(), b.Bounds()
+	w := ab.Dx()
+	arow, brow := make([]pixel, w), make([]pixel, w)
+	npix := 0
+	for y := y0; y < y1; y++ {
+		readRow(arow, a, ab.Min.X, ab.Min.Y+y)
+		readRow(brow, b, bb.Min.X, bb.Min.Y+y)
+		out := diff.Pix[diff.PixOffset(0, y):]
+		var sum float64
+		for x, pa := range arow {
+			pb := brow[x]
+			var e float64
+			for i := range pa {
+				v := (float64(pa[i]) - float64(pb[i])) / 0xffff
+				e += v * v
+			}
+			e /= 4
+			sum += e
+			c := passPixel
+			if e > d.threshold {
+				// at least 1, so that the pixel stays marked
+				v := uint8(1 + 0xfe*math.Sqrt(e))
+				c = [4]uint8{v, v, v, 0xff}
+				npix++
+			}
+			copy(out[4*x:], c[:])
+		}
+		rows[y] = sum
+	}
+	return npix
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestMSE(t *testing.T) {
+	r := image.Rect(2, 3, 6, 5)
+	a := image.NewNRGBA(r)
+	b := image.NewNRGBA(r)
+	for i := range a.Pix {
+		a.Pix[i], b.Pix[i] = 0xff, 0xff
+	}
+	// all channels off by 1, squared error 1
+	b.Set(2, 3, color.NRGBA{0, 0, 0, 0})
+	// one channel off by about 0.5, squared error about 1/16
+	b.Set(5, 4, color.NRGBA{0xff, 0xff, 0x7f, 0xff})
+
+	tests := []struct {
+		threshold float64
+		n         int
+	}{
+		{0, 2},
+		{0.05, 2},
+		{0.1, 1},
+		{1, 0},
+	}
+	for i, test := range tests {
+		res, err := CompareResult(NewMSE(test.threshold), a, b)
+		if err != nil {
+			t.Fatalf("(%d) %v", i, err)
+		}
+		if res.N != test.n {
+			t.Errorf("(%d) n = %d; want %d", i, res.N, test.n)
+		}
+		e := float64(0x80) / 0xff
+		mse := (1 + e*e/4) / 8
+		if res.Stats == nil || math.Abs(res.Stats.MSE-mse) > 1e-9 {
+			t.Errorf("(%d) stats = %+v; want MSE %g", i, res.Stats, mse)
+			continue
+		}
+		if psnr := -10 * math.Log10(mse); math.Abs(res.Stats.PSNR-psnr) > 1e-9 {
+			t.Errorf("(%d) PSNR = %g; want %g", i, res.Stats.PSNR, psnr)
+		}
+		diff := res.Diff.(*image.NRGBA)
+		if c := diff.NRGBAAt(0, 0); res.N > 0 && c != (color.NRGBA{0xff, 0xff, 0xff, 0xff}) {
+			t.Errorf("(%d) diff at 0, 0 = %v; want white", i, c)
+		}
+		if c := diff.NRGBAAt(1, 0); c != (color.NRGBA{0, 0, 0, 0xff}) {
+			t.Errorf("(%d) diff at 1, 0 = %v; want black", i, c)
+		}
+	}
+
+	res, err := CompareResult(NewMSE(0), a, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.N != 0 || res.Stats == nil || res.Stats.MSE != 0 || !math.IsInf(res.Stats.PSNR, 1) {
+		t.Errorf("same image: n = %d, stats = %+v; want 0, +Inf PSNR", res.N, res.Stats)
+	}
+	if _, _, err := NewMSE(0).Compare(a, image.NewNRGBA(image.Rect(0, 0, 1, 1))); err != ErrSize {
+		t.Errorf("err = %v; want ErrSize", err)
+	}
+	res, err = CompareResult(NewBinary(), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Stats != nil {
+		t.Errorf("binary stats = %+v; want nil", res.Stats)
+	}
+}
+
+func TestMSERamp(t *testing.T) {
+	r := image.Rect(0, 0, 256, 1)
+	a := image.NewGray(r)
+	b := image.NewGray(r)
+	for x := 0; x < 256; x++ {
+		b.Pix[x] = uint8(x)
+	}
+	diff, n, err := NewMSE(0).Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 255 {
+		t.Errorf("n = %d; want 255", n)
+	}
+	m := diff.(*image.NRGBA)
+	prev := uint8(0)
+	for x := 1; x < 256; x++ {
+		c := m.NRGBAAt(x, 0)
+		if c.R == 0 || c.R != c.G || c.R != c.B || c.A != 0xff {
+			t.Fatalf("diff at %d = %v; want gray", x, c)
+		}
+		if c.R < prev {
+			t.Errorf("diff at %d = %d, less than %d", x, c.R, prev)
+		}
+		prev = c.R
+	}
+	// opaque pixels differ in 3 of 4 samples at most
+	if want := uint8(1 + 0xfe*math.Sqrt(0.75)); prev != want {
+		t.Errorf("diff at 255 = %d; want %d", prev, want)
+	}
+}
+
+func TestMSEWorkers(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	m := randomImages(image.Rect(0, 0, 70, 300), rnd)
+	want, err := CompareResult(NewMSE(0.01, WithMaxWorkers(1)), m[0], m[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{2, 3, 8} {
+		res, err := CompareResult(NewMSE(0.01, WithMaxWorkers(n)), m[0], m[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.N != want.N || !reflect.DeepEqual(res.Stats, want.Stats) {
+			t.Errorf("%d workers: n = %d, stats = %+v; want %d, %+v", n, res.N, *res.Stats, want.N, *want.Stats)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// msssimWeights are exponents of the contrast-structure terms of scales
+// of MS-SSIM, and of the luminance term of the last one, from Wang et al.
+var msssimWeights = [...]float64{0.0448, 0.2856, 0.3001, 0.2363, 0.1333}
+
+type msssim struct {
+	// SSIM of a single scale
+	ssim
+	scales int
+}
+
+// NewMSSSIM creates a new Differ based on multi-scale structural
+// similarity (MS-SSIM) of luminance, as described by Wang et al. in
+// "Multiscale structural similarity for image quality assessment",
+// Asilomar 2003. It is less sensitive to viewing distance than SSIM.
+//
+// Images are low-pass filtered with the kernel of the perceptual pyramid
+// and downsampled by 2, scales-1 times. Local SSIM of every scale is
+// computed as by the Differ returned by NewDefaultSSIM, and the terms
+// of all scales are combined with the standard weights, normalized
+// to the number of scales. Negative terms are taken as 0. Pixels are
+// compared at the original resolution, using the terms of the pixels
+// they are downsampled to. Those with combined similarity below
+// WithSSIMThreshold are counted as different, and drawn in the difference
+// image as SSIM draws them.
+//
+// Images smaller than 2^scales pixels in either dimension are compared
+// at fewer scales. Compare returns an error if scales is not between
+// 1 and 5, the number of standard weights.
+func NewMSSSIM(scales int, opts ...Option) Differ {
+	d := &msssim{
+		ssim:   *NewDefaultSSIM(opts...).(*ssim),
+		scales: scales,
+	}
+	if scales < 1 || scales > len(msssimWeights) {
+		d.err = fmt.Errorf("imgdiff: MS-SSIM scales must be between 1 and %d: %d", len(msssimWeights), scales)
+	}
+	return d
+}
+
+// Compare compares a and b using multi-scale structural similarity.
+func (d *msssim) Compare(a, b image.Image) (image.Image, int, error) {
+	return d.compareTimed(a, b, new(PhaseTimings))
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *msssim) CompareInto(dst *image.NRGBA, a, b image.Image) (int, error) {
+	return d.compareInto(dst, a, b, new(PhaseTimings))
+}
+
+func (d *msssim) compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error) {
+	diff := new(image.NRGBA)
+	n, err := d.compareInto(diff, a, b, t)
+	if err != nil {
+		return nil, -1, err
+	}
+	return diff, n, nil
+}
+
+// msssimScale holds luminance planes of a scale and its weighted
+// local SSIM terms.
+type msssimScale struct {
+	w, h   int
+	la, lb []float64
+	// contrast-structure terms to the power of their weight,
+	// times the luminance ones for the last scale
+	cs []float64
+}
+
+func (d *msssim) compareInto(diff *image.NRGBA, a, b image.Image, t *PhaseTimings) (int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return -1, ErrSize
+	}
+	if d.err != nil {
+		return -1, d.err
+	}
+	if err := d.opts.checkSize(ab); err != nil {
+		return -1, err
+	}
+	resize(diff, w, h)
+	if sameImage(a, b) {
+		fillPass(diff)
+		return 0, nil
+	}
+
+	p := newPhases("msssim", ab, t)
+	scales := []*msssimScale{{w: w, h: h}}
+	p.run("convert", &t.Convert, func() {
+		parallel(d.opts.workers(), func(int) {
+			scales[0].la = luma(a)
+		}, func(int) {
+			scales[0].lb = luma(b)
+		})
+	})
+	p.run("pyramid", &t.Pyramid, func() {
+		for len(scales) < d.scales && 1<<uint(len(scales)+1) <= min2(w, h) {
+			s := scales[len(scales)-1]
+			next := &msssimScale{w: (s.w + 1) / 2, h: (s.h + 1) / 2}
+			parallel(d.opts.workers(), func(int) {
+				next.la = downsample(s.la, s.w, s.h)
+			}, func(int) {
+				next.lb = downsample(s.lb, s.w, s.h)
+			})
+			scales = append(scales, next)
+		}
+	})
+
+	weights := msssimWeights[:len(scales)]
+	var sum float64
+	for _, v := range weights {
+		sum += v
+	}
+	var npix int
+	p.run("compare", &t.Compare, func() {
+		for i, s := range scales {
+			s.cs = make([]float64, s.w*s.h)
+			last := i == len(scales)-1
+			e := weights[i] / sum
+			forBands(d.opts.workers(), s.h, func(y0, y1 int) int {
+				rows := newSSIMRows(s.w)
+				l := make([]float64, s.w)
+				for y := y0; y < y1; y++ {
+					cs := s.cs[y*s.w : (y+1)*s.w]
+					d.terms(rows, s.la, s.lb, s.w, s.h, y, l, cs)
+					// weighted once here, rather than for every pixel
+					// of the original resolution
+					for x := range cs {
+						cs[x] = pow0(cs[x], e)
+						if last {
+							cs[x] *= pow0(l[x], e)
+						}
+					}
+				}
+				return 0
+			})
+		}
+		npix = forBands(d.opts.workers(), h, func(y0, y1 int) int {
+			n := 0
+			for y := y0; y < y1; y++ {
+				out := diff.Pix[diff.PixOffset(0, y):]
+				for x := 0; x < w; x++ {
+					v := 1.0
+					for i, s := range scales {
+						v *= s.cs[(y>>uint(i))*s.w+x>>uint(i)]
+					}
+					c := passPixel
+					if v < d.opts.ssimThreshold {
+						c = ssimPixel(v, d.opts.ssimThreshold)
+						n++
+					}
+					copy(out[4*x:], c[:])
+				}
+			}
+			return n
+		})
+	})
+	return npix, nil
+}
+
+// pow0 returns v**e, or 0 if v is negative.
+func pow0(v, e float64) float64 {
+	if v <= 0 {
+		return 0
+	}
+	return math.Pow(v, e)
+}
+
+// min2 returns the smaller of a and b.
+func min2(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// downsample returns the w x h plane m, y*w+x indexed, convolved with
+// the kernel of the perceptual pyramid and downsampled by 2.
+func downsample(m []float64, w, h int) []float64 {
+	src, dst := make([][]float64, h), newRows(w, h)
+	for y := range src {
+		src[y] = m[y*w : (y+1)*w]
+	}
+	c := newConvolution(defaultLapFilter.kernel, w, h, 0)
+	c.convolve(dst, src, 0, h, c.newRow())
+	w2, h2 := (w+1)/2, (h+1)/2
+	out := make([]float64, w2*h2)
+	for y := 0; y < h2; y++ {
+		for x := 0; x < w2; x++ {
+			out[y*w2+x] = dst[2*y][2*x]
+		}
+	}
+	return out
+}
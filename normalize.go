@@ -0,0 +1,147 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+type normalized struct {
+	inner Differ
+}
+
+// NewNormalized creates a new Differ which compares images with inner
+// after matching brightness and contrast of the second image to the
+// first one, e.g. for screenshots taken on displays with different
+// gamma. The color samples of the second image are remapped linearly,
+// so that the mean and standard deviation of its luminance equal those
+// of the first image, and clamped to the valid range.
+//
+// The difference image and count are those of inner. CompareResult
+// sets the gain and offset of the remapping in Result.Stats.
+func NewNormalized(inner Differ) Differ {
+	return &normalized{inner: inner}
+}
+
+// Compare compares a and b with the inner Differ, after remapping b.
+func (d *normalized) Compare(a, b image.Image) (image.Image, int, error) {
+	return d.compareStats(a, b, new(PhaseTimings), new(ErrorStats))
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *normalized) CompareInto(diff *image.NRGBA, a, b image.Image) (int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return -1, ErrSize
+	}
+	gain, offset := matchLuma(a, b)
+	nb := remap(b, gain, offset)
+	if id, ok := d.inner.(IntoDiffer); ok {
+		return id.CompareInto(diff, a, nb)
+	}
+	m, n, err := d.inner.Compare(a, nb)
+	if err != nil {
+		return -1, err
+	}
+	resize(diff, w, h)
+	draw.Draw(diff, diff.Rect, m, m.Bounds().Min, draw.Src)
+	return n, nil
+}
+
+func (d *normalized) compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error) {
+	return d.compareStats(a, b, t, new(ErrorStats))
+}
+
+func (d *normalized) compareStats(a, b image.Image, t *PhaseTimings, s *ErrorStats) (image.Image, int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Dx() != bb.Dx() || ab.Dy() != bb.Dy() {
+		return nil, -1, ErrSize
+	}
+	gain, offset := matchLuma(a, b)
+	nb := remap(b, gain, offset)
+	var diff image.Image
+	var n int
+	var err error
+	switch inner := d.inner.(type) {
+	case statsDiffer:
+		diff, n, err = inner.compareStats(a, nb, t, s)
+	case timedDiffer:
+		diff, n, err = inner.compareTimed(a, nb, t)
+	default:
+		diff, n, err = inner.Compare(a, nb)
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+	s.Gain, s.Offset = gain, offset
+	return diff, n, nil
+}
+
+// matchLuma returns the gain and offset which remap 8-bit luminance
+// of b to the mean and standard deviation of luminance of a.
+// The gain is 1 if b has uniform luminance.
+func matchLuma(a, b image.Image) (gain, offset float64) {
+	ma, sa := meanStdDev(luma(a))
+	mb, sb := meanStdDev(luma(b))
+	gain = 1
+	if sb > 0 {
+		gain = sa / sb
+	}
+	return gain, 255 * (ma - gain*mb)
+}
+
+// meanStdDev returns the mean and standard deviation of v.
+func meanStdDev(v []float64) (mean, std float64) {
+	if len(v) == 0 {
+		return 0, 0
+	}
+	for _, x := range v {
+		mean += x
+	}
+	mean /= float64(len(v))
+	return mean, stdDev(v)
+}
+
+// remap returns zero-based m with its alpha-premultiplied color samples
+// v, scaled to [0, 255], mapped to v*gain+offset*alpha, clamped to
+// [0, alpha]. It returns m if the mapping is the identity.
+func remap(m image.Image, gain, offset float64) image.Image {
+	if gain == 1 && offset == 0 {
+		return m
+	}
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := image.NewRGBA64(image.Rect(0, 0, w, h))
+	off := offset * 0x101
+	row := make([]pixel, w)
+	for y := 0; y < h; y++ {
+		readRow(row, m, b.Min.X, b.Min.Y+y)
+		pix := out.Pix[out.PixOffset(0, y):]
+		for x, p := range row {
+			alpha := float64(p[3])
+			s := pix[8*x : 8*x+8 : 8*x+8]
+			for i := 0; i < 3; i++ {
+				v := float64(p[i])*gain + off*alpha/0xffff
+				u := uint16(math.Max(0, math.Min(alpha, math.Floor(v+0.5))))
+				s[2*i], s[2*i+1] = uint8(u>>8), uint8(u)
+			}
+			s[6], s[7] = uint8(p[3]>>8), uint8(p[3])
+		}
+	}
+	return out
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// gradient returns a w x 1 gray ramp, with pixel x of value
+// x*gain+offset, clamped.
+func gradient(w int, gain, offset float64) *image.Gray {
+	m := image.NewGray(image.Rect(0, 0, w, 1))
+	for x := range m.Pix {
+		m.Pix[x] = uint8(math.Max(0, math.Min(255, float64(x)*gain+offset+0.5)))
+	}
+	return m
+}
+
+func TestNormalized(t *testing.T) {
+	a := gradient(200, 1, 20)
+	b := gradient(200, 0.8, 50)
+	if _, n, err := NewBinary().Compare(a, b); err != nil || n == 0 {
+		t.Fatalf("binary: n = %d, err = %v; want > 0", n, err)
+	}
+	res, err := CompareResult(NewNormalized(NewDeltaE(1)), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.N != 0 {
+		t.Errorf("normalized: n = %d; want 0", res.N)
+	}
+	if s := res.Stats; s == nil || math.Abs(s.Gain-1.25) > 0.01 || math.Abs(s.Offset+42.5) > 1 {
+		t.Errorf("stats = %+v; want gain 1.25, offset -42.5", s)
+	}
+
+	// stats of the wrapped Differ are kept
+	res, err = CompareResult(NewNormalized(NewMSE(0)), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := res.Stats; s.Gain == 1 || s.MSE == 0 || s.MSE > 1e-4 {
+		t.Errorf("mse stats = %+v; want small MSE and gain", s)
+	}
+
+	// same images are not remapped
+	res, err = CompareResult(NewNormalized(NewBinary()), a, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.N != 0 || res.Stats.Gain != 1 || res.Stats.Offset != 0 {
+		t.Errorf("same image: n = %d, stats = %+v; want 0, gain 1", res.N, res.Stats)
+	}
+}
+
+func TestRemap(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	m.SetNRGBA(0, 0, color.NRGBA{0x10, 0x80, 0xf0, 0xff})
+	m.SetNRGBA(1, 0, color.NRGBA{0x80, 0x80, 0x80, 0x80})
+	m.SetNRGBA(2, 0, color.NRGBA{0xff, 0xff, 0xff, 0})
+	r := remap(m, 2, -0x40)
+	want := []color.RGBA64{
+		{0, 0xc0c0, 0xffff, 0xffff},
+		// premultiplied 0x4080, remapped to 2*0x4080-0x4040*0x80/0xff
+		{0x60c0, 0x60c0, 0x60c0, 0x8080},
+		{0, 0, 0, 0},
+	}
+	for x, c := range want {
+		if got := r.At(x, 0); got != c {
+			t.Errorf("%d: %v; want %v", x, got, c)
+		}
+	}
+}
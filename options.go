@@ -0,0 +1,560 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"runtime"
+)
+
+// Option configures a Differ created by one of the constructors
+// of this package. Options which don't apply to an algorithm
+// are ignored by it.
+type Option func(*options)
+
+type options struct {
+	// relative tolerance for FloatImage samples
+	floatEpsilon float64
+	// build pyramids in bands
+	lowMemory bool
+	// don't interpolate csf values
+	exactCSF bool
+	// contrast sensitivity function of perceptual
+	csfModel CSFModel
+	// receives intermediate planes of perceptual; nil if none
+	debug DebugSink
+	// max goroutines of a Compare call; 0 means GOMAXPROCS
+	maxWorkers int
+	// store planes and pyramids as float32
+	float32 bool
+	// Laplacian pyramid kernel; nil means the default
+	kernel []float64
+	// number of Laplacian pyramid levels; 0 means the default
+	pyramidLevels int
+	// perceptual decodes samples with transfer instead of its gamma
+	hasTransfer bool
+	transfer    Transfer
+	// converts linear RGB to XYZ instead of DefaultColorMatrix
+	hasColorMatrix bool
+	colorMatrix    ColorMatrix
+	// adaptation luminances between which the color test of
+	// perceptual ramps up from none to full
+	hasScotopic            bool
+	scotopicLo, scotopicHi float64
+	// tile size; 0 means automatic, negative disables tiling
+	tiling int
+	// no MaxPixels limit
+	unlimited bool
+	// min local SSIM of passing pixels
+	ssimThreshold float64
+	// min gradient magnitude similarity of passing pixels
+	gmsThreshold float64
+	// radius within which shifted pixels match; 0 disables it
+	shiftTolerance int
+	// color vision simulated by the perceptual algorithm
+	colorVision ColorVision
+	// max differences of 16-bit red, green, blue and alpha
+	// of pixels which aren't counted by binary
+	channelTolerance [4]uint16
+	// treatment of alpha by binary and perceptual
+	alphaMode AlphaMode
+	// background of PremultiplyFirst; nil means white
+	bg color.Color
+	// binary doesn't count anti-aliased pixels
+	antiAliasing bool
+	// different pixels are drawn in colors of their differences
+	deltaColors bool
+	// different pixels are drawn in colors of their magnitudes,
+	// passing ones transparent
+	heatmap bool
+	// different pixels are drawn over a compared image, dimmed
+	hasOverlay  bool
+	overlayBase BaseImage
+	overlayDim  float64
+	// binary compares linear samples, decoded with linearGamma,
+	// or the sRGB transfer function if it is 0
+	linear      bool
+	linearGamma float64
+	// binary compares Rec. 709 luma only
+	lumaOnly bool
+	// comparison stops once more than maxDiff pixels differ
+	hasMaxDiff bool
+	maxDiff    int
+	// callback of WithProgress
+	progress func(done, total int)
+}
+
+func newOptions(opts []Option) options {
+	o := options{ssimThreshold: DefaultSSIMThreshold, gmsThreshold: DefaultGMSThreshold}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// workers returns the number of goroutines a Compare call may run at a time.
+func (o options) workers() int {
+	if o.maxWorkers > 0 {
+		return o.maxWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// checkSize returns a *TooLargeError if images of size r
+// have more pixels than allowed.
+func (o options) checkSize(r image.Rectangle) error {
+	n := int64(r.Dx()) * int64(r.Dy())
+	if !o.unlimited && n > MaxPixels {
+		return &TooLargeError{Pixels: n, Limit: MaxPixels}
+	}
+	return nil
+}
+
+// tileSize returns the size of tiles Compare traverses w pixels wide
+// images in, or 0 for whole rows.
+func (o options) tileSize(w int) int {
+	switch {
+	case o.tiling > 0:
+		return o.tiling
+	case o.tiling == 0 && w > autoTileWidth:
+		return defaultTileSize
+	}
+	return 0
+}
+
+// WithFloatEpsilon sets the relative tolerance used when both images
+// are FloatImage. Two samples a and b are considered equal if
+// |a-b| <= eps*max(|a|, |b|). The default is 0, which requires exact
+// equality. Binary only.
+func WithFloatEpsilon(eps float64) Option {
+	return func(o *options) {
+		o.floatEpsilon = eps
+	}
+}
+
+// WithLowMemory makes Compare build the Laplacian pyramids and compare them
+// in horizontal bands of rows, instead of whole images at once.
+// This cuts peak memory use to rows of a band, and the few hundred
+// rows around it the coarsest pyramid levels depend on, at the cost
+// of computing luminance of the band twice.
+// Results are the same. Perceptual only.
+func WithLowMemory() Option {
+	return func(o *options) {
+		o.lowMemory = true
+	}
+}
+
+// WithTransfer makes Compare decode samples to linear light with t,
+// e.g. SRGB for PNG images and screenshots, instead of the gamma
+// passed to NewPerceptual. This matters mostly for dark colors,
+// where the pure power curve of that gamma and the sRGB transfer
+// function differ the most. Compare returns an error if t is invalid.
+// Perceptual only.
+func WithTransfer(t Transfer) Option {
+	return func(o *options) {
+		o.hasTransfer = true
+		o.transfer = t
+	}
+}
+
+// WithColorMatrix makes Compare convert linear RGB to XYZ with m,
+// e.g. SRGBMatrix, instead of DefaultColorMatrix, and LAB relative
+// to the white of m, so that LAB colors and ΔE match those of tools
+// using the same color space. Compare returns an error if any
+// component of that white isn't positive.
+// Perceptual, deltae and ciede2000 only.
+func WithColorMatrix(m ColorMatrix) Option {
+	return func(o *options) {
+		o.hasColorMatrix = true
+		o.colorMatrix = m
+	}
+}
+
+// WithScotopicCutoff sets the adaptation luminance, in candelas per
+// square meter, below which Compare skips the color test, as colors
+// are hard to tell apart in scotopic, dark adapted vision. Lower it,
+// e.g. to 1, to catch color changes in dark images such as
+// screenshots of dark themes. The default is 10.
+// Compare returns an error if cdm2 is negative or NaN.
+// Perceptual only.
+func WithScotopicCutoff(cdm2 float64) Option {
+	return WithScotopicRamp(cdm2, cdm2)
+}
+
+// WithScotopicRamp is WithScotopicCutoff with a gradual transition:
+// the color test is skipped below adaptation luminance lo, and its
+// color factor scaled linearly from 0 at lo to full at hi.
+// Compare returns an error unless 0 <= lo <= hi.
+// Perceptual only.
+func WithScotopicRamp(lo, hi float64) Option {
+	return func(o *options) {
+		o.hasScotopic = true
+		o.scotopicLo, o.scotopicHi = lo, hi
+	}
+}
+
+// WithCSF sets the model of the contrast sensitivity function Compare
+// weighs differences of each spatial frequency, that is pyramid level,
+// and masks them with. The default is Barten.
+// Perceptual only.
+func WithCSF(model CSFModel) Option {
+	return func(o *options) {
+		o.csfModel = model
+	}
+}
+
+// WithExactCSF makes Compare compute the contrast sensitivity function
+// for every pixel, instead of interpolating it between values
+// precomputed at 1024 adaptation luminances. Interpolation doesn't
+// change pixel counts on the test images, but this is slower.
+// Perceptual only.
+func WithExactCSF() Option {
+	return func(o *options) {
+		o.exactCSF = true
+	}
+}
+
+// WithDebug makes Compare pass intermediate values of each pixel
+// to sink once done, e.g. to tell whether a pixel failed the luminance
+// or the color test, see DebugSink. Unless given this or WithHeatmap,
+// Compare doesn't compute them.
+// Planes aren't passed for identical images, nor by incremental
+// comparisons. Perceptual only.
+func WithDebug(sink DebugSink) Option {
+	return func(o *options) {
+		o.debug = sink
+	}
+}
+
+// WithMaxWorkers limits the number of goroutines a single Compare call
+// runs at a time to n, so that e.g. a service comparing images for
+// multiple requests can cap CPU usage of each one. Results don't depend
+// on n. The default, or n <= 0, is runtime.GOMAXPROCS(0).
+func WithMaxWorkers(n int) Option {
+	return func(o *options) {
+		o.maxWorkers = n
+	}
+}
+
+// WithFloat32 makes Compare store luminance, colors and pyramids as
+// float32 instead of float64, halving memory use of its largest buffers.
+// Arithmetic is still done in float64, so results barely differ.
+// It has no effect along with WithLowMemory. Perceptual only.
+func WithFloat32() Option {
+	return func(o *options) {
+		o.float32 = true
+	}
+}
+
+// WithKernel sets the 1D kernel used to build each Laplacian pyramid
+// level out of the previous one, in both directions, before it is
+// subsampled by 2. It must have
+// an odd length and sum to 1, or Compare returns an error.
+// The default is {0.05, 0.25, 0.4, 0.25, 0.05}. Perceptual only.
+func WithKernel(k []float64) Option {
+	return func(o *options) {
+		o.kernel = k
+	}
+}
+
+// WithPyramidLevels sets the number of levels of the Laplacian
+// pyramids, from 2 to 16, the first one being the image itself.
+// Compare returns an error for other values. The default is 8.
+// Each level halves the spatial frequencies of the previous one,
+// starting at half the pixels per degree of the field of view,
+// so that fewer levels suffice for small images and more may help
+// for very wide ones. Luminance adaptation is taken from a level
+// which depends on the field of view, or the last one with fewer
+// levels, so that a wider field of view needs more levels.
+// Fewer levels use less time. Perceptual only.
+func WithPyramidLevels(n int) Option {
+	return func(o *options) {
+		o.pyramidLevels = n
+	}
+}
+
+// WithTiling makes Compare build the pyramids and compare them
+// in size x size tiles instead of whole rows, so that the data
+// it works on fits in CPU caches even for very wide images.
+// Results are the same. By default, images wider than 8192 pixels
+// are traversed in 256 x 256 tiles. A size <= 0 disables tiling.
+// Perceptual only.
+func WithTiling(size int) Option {
+	return func(o *options) {
+		o.tiling = size
+		if size <= 0 {
+			o.tiling = -1
+		}
+	}
+}
+
+// WithSSIMThreshold sets the min local structural similarity,
+// between -1 and 1, of pixels which are not counted as different.
+// The default is DefaultSSIMThreshold. SSIM and MS-SSIM only.
+func WithSSIMThreshold(t float64) Option {
+	return func(o *options) {
+		o.ssimThreshold = t
+	}
+}
+
+// WithGMSThreshold sets the min gradient magnitude similarity,
+// between 0 and 1, of pixels which are not counted as different.
+// The default is DefaultGMSThreshold. GMSD only.
+func WithGMSThreshold(t float64) Option {
+	return func(o *options) {
+		o.gmsThreshold = t
+	}
+}
+
+// WithShiftTolerance makes Compare count a pixel as different only if
+// it doesn't match any pixel within n pixels of it, horizontally and
+// vertically, in the other image, both ways, so that content shifted
+// by up to n pixels, e.g. in screenshots, isn't reported. Windows
+// are clipped at image borders. Pixels which differ at the same
+// position are the only ones looked at again, so the cost depends on
+// their number. The default, or n <= 0, disables it. Compare returns
+// an error if n is larger than MaxShiftTolerance.
+//
+// Binary and perceptual only. The perceptual algorithm builds whole
+// pyramids with it, ignoring WithLowMemory and WithFloat32.
+func WithShiftTolerance(n int) Option {
+	return func(o *options) {
+		o.shiftTolerance = n
+		if n < 0 {
+			o.shiftTolerance = 0
+		}
+	}
+}
+
+// WithChannelTolerance makes Compare count a pixel as different only if
+// any of its red, green, blue or alpha samples differs by more than r, g,
+// b or a, e.g. to forgive off by one differences of JPEG recompression.
+// Tolerances are of 8-bit alpha-premultiplied samples, and are scaled
+// by 0x101 for images compared with 16 bits per channel. Pixels which
+// differ within the tolerances are drawn dim gray in the difference
+// image, rather than red. Note that DiffMask and Result.DiffBounds still
+// include them. The default is 0 for all channels.
+//
+// Binary only. FloatImage inputs are compared with WithFloatEpsilon.
+func WithChannelTolerance(r, g, b, a uint8) Option {
+	return func(o *options) {
+		o.channelTolerance = [4]uint16{uint16(r) * 0x101, uint16(g) * 0x101, uint16(b) * 0x101, uint16(a) * 0x101}
+	}
+}
+
+// WithChannelTolerance16 is WithChannelTolerance with tolerances of
+// 16-bit samples, for images compared with 16 bits per channel, such
+// as two RGBA64 images, whose samples may differ in their low bytes
+// only. Tolerances are shifted right by 8 bits for images compared
+// with 8 bits per channel. Of the two options, the last one given
+// applies.
+//
+// Binary only.
+func WithChannelTolerance16(r, g, b, a uint16) Option {
+	return func(o *options) {
+		o.channelTolerance = [4]uint16{r, g, b, a}
+	}
+}
+
+// WithAntiAliasing makes Compare tell apart pixels which differ only
+// because of anti-aliasing, such as along edges of text rendered on
+// different machines, as pixelmatch does, see NewPixelmatch. They are
+// not counted, but drawn yellow in the difference image. Note that
+// DiffMask and Result.DiffBounds still include them. A pixel is
+// anti-aliased if it lies on an edge, with both darker and brighter
+// neighbors and few of the same brightness, next to a flat area
+// of both images.
+//
+// Binary only.
+func WithAntiAliasing() Option {
+	return func(o *options) {
+		o.antiAliasing = true
+	}
+}
+
+// WithDeltaColors makes Compare draw different pixels in the absolute
+// differences of their 8-bit alpha-premultiplied red, green and blue
+// samples, with alpha 255 less the difference of their alpha, rather
+// than red, so that e.g. rounding errors look almost black and distinct
+// colors bright. Pixels which differ only because of their neighbors,
+// as seen by the perceptual algorithm, stay red, as do those whose
+// differences would look like pixels within WithChannelTolerance
+// or anti-aliased ones, see WithAntiAliasing. Equal pixels are black.
+//
+// Binary and perceptual only.
+func WithDeltaColors() Option {
+	return func(o *options) {
+		o.deltaColors = true
+	}
+}
+
+// WithHeatmap makes Compare draw different pixels in colors of the
+// magnitudes of their differences, on the viridis ramp from dark purple
+// to yellow, and equal pixels fully transparent rather than black, so
+// that the difference image can be composited over either image.
+// Binary maps the largest difference of samples, from 0 to 1, onto
+// the ramp. Perceptual maps the error relative to the threshold the
+// pixel failed, the larger of that of the luminance and color tests,
+// from 1 to 10 times the threshold, on a logarithmic scale, and needs
+// memory for 7 float64 values per pixel to do so. Pixels within
+// WithChannelTolerance and anti-aliased ones keep their colors.
+// WithDeltaColors is ignored with it.
+//
+// Binary and perceptual only.
+func WithHeatmap() Option {
+	return func(o *options) {
+		o.heatmap = true
+	}
+}
+
+// WithOverlay makes Compare draw different pixels red over the compared
+// image base, composited over black and its samples scaled by dim, e.g.
+// 0.3 for 30% brightness, rather than over black, so that differences
+// are seen in context. Only the red pixels mark differences then, so
+// such difference images don't work with DiffMask, and CompareIncremental
+// and NewComposite handle them as those of other algorithms, by counts.
+// WithDeltaColors and WithHeatmap are ignored with it. Compare returns
+// an error unless base is BaseA or BaseB and 0 <= dim <= 1.
+//
+// Binary and perceptual only.
+func WithOverlay(base BaseImage, dim float64) Option {
+	return func(o *options) {
+		o.hasOverlay = true
+		o.overlayBase, o.overlayDim = base, dim
+	}
+}
+
+// WithMaxDiff makes Compare stop once more than n pixels differ, e.g.
+// 0 to only tell whether images differ at all, and return a nil image,
+// the number of different pixels found so far and ErrMaxDiff. The number
+// is more than n, but otherwise depends on where comparison stopped,
+// which may vary between calls as rows are compared concurrently.
+// CompareInto leaves dst partly written then. The perceptual algorithm
+// stops in its last phase, once images are converted and their pyramids
+// are built, or between bands of rows with WithLowMemory. It is ignored
+// with WithShiftTolerance and WithAntiAliasing, which unmark pixels once
+// all are compared. Compare returns an error if n is negative.
+//
+// Binary and perceptual only.
+func WithMaxDiff(n int) Option {
+	return func(o *options) {
+		o.hasMaxDiff = true
+		o.maxDiff = n
+	}
+}
+
+// WithProgress makes Compare call fn as it makes progress, so that
+// callers comparing large images can show how far it got. Done and
+// total count units of work: rows of pixels compared, and with the
+// perceptual algorithm, unless WithLowMemory is set, pyramid levels
+// built of each image too. Binary calls fn after each row, perceptual
+// after each row and pyramid level. Done increases with every call,
+// and once Compare succeeds, the last call has done equal to total.
+//
+// Calls are made from the goroutines doing the work, but never
+// concurrently, in order, so fn doesn't need to synchronize; it should
+// return quickly, as it blocks the others. Comparisons of identical
+// images, which are skipped, report all work done at once.
+// CompareIncremental doesn't report progress.
+//
+// Binary and perceptual only.
+func WithProgress(fn func(done, total int)) Option {
+	return func(o *options) {
+		o.progress = fn
+	}
+}
+
+// WithLinearLight makes Compare decode samples to linear light before
+// comparing them, so that differences of dark colors, which look
+// smaller than those of bright ones, weigh less. Samples are decoded
+// with gamma, e.g. 2.2, or the sRGB transfer function if gamma is 0.
+// Decoding uses a table of 8-bit samples, so that 16-bit images are
+// compared with the high byte of their samples. Tolerances, such as
+// of WithChannelTolerance or NewBinaryFuzz, are of linear samples.
+// Compare returns an error if gamma is negative or NaN. FloatImage
+// inputs are linear already and compared as is.
+//
+// Binary only.
+func WithLinearLight(gamma float64) Option {
+	return func(o *options) {
+		o.linear = true
+		o.linearGamma = gamma
+	}
+}
+
+// WithLuminanceOnly makes Compare count pixels as different only if
+// their Rec. 709 lumas do, ignoring chroma, e.g. for document scans
+// with subsampled chroma. Lumas are of colors composited over black.
+// Those of Gray and Gray16 images are their samples, and those of
+// YCbCr images their Y samples, as is. Different pixels are drawn
+// gray, as bright as the difference of their 8-bit lumas, at least 1.
+// The largest of the red, green and blue tolerances of
+// WithChannelTolerance, or the fuzz of NewBinaryFuzz, is the max
+// difference of lumas of equal pixels.
+//
+// Binary only. FloatImage inputs are compared with WithFloatEpsilon.
+func WithLuminanceOnly() Option {
+	return func(o *options) {
+		o.lumaOnly = true
+	}
+}
+
+// WithColorVision makes Compare see colors as people with color vision v
+// do, e.g. Deuteranopia, so that differences they can't distinguish
+// aren't counted, for accessibility testing. Both images are transformed
+// in linear RGB before conversion to LAB colors and luminance.
+// Grayscale images look the same with every type of color vision.
+// The default is NormalVision. Compare returns an error for unknown types.
+//
+// Perceptual only.
+func WithColorVision(v ColorVision) Option {
+	return func(o *options) {
+		o.colorVision = v
+	}
+}
+
+// WithAlphaMode sets how Compare treats the alpha channel, e.g.
+// IgnoreAlpha to compare screenshots whose transparency differs
+// only by how they were captured. The default is CompareAlpha.
+// Compare returns an error for unknown modes. FloatImage inputs
+// are compared as is.
+//
+// Binary and perceptual only.
+func WithAlphaMode(m AlphaMode) Option {
+	return func(o *options) {
+		o.alphaMode = m
+	}
+}
+
+// WithBackground sets the color both images are composited over
+// with alpha mode PremultiplyFirst. Its alpha is ignored. The default
+// is white. Binary and perceptual only.
+func WithBackground(c color.Color) Option {
+	return func(o *options) {
+		o.bg = c
+	}
+}
+
+// WithUnlimited lifts the MaxPixels limit, so that Compare accepts
+// images of any size. Comparing e.g. 500 megapixel images takes
+// several minutes and tens of gigabytes of memory with the perceptual
+// algorithm, so programs comparing images from untrusted sources
+// should rather keep the limit.
+func WithUnlimited() Option {
+	return func(o *options) {
+		o.unlimited = true
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"image"
+)
+
+// BaseImage is which of the compared images WithOverlay draws
+// differences over.
+type BaseImage int
+
+// Base images.
+const (
+	// BaseA is the first image passed to Compare.
+	BaseA BaseImage = iota
+	// BaseB is the second one.
+	BaseB
+)
+
+func (b BaseImage) String() string {
+	switch b {
+	case BaseA:
+		return "a"
+	case BaseB:
+		return "b"
+	}
+	return fmt.Sprintf("BaseImage(%d)", int(b))
+}
+
+// validOverlay returns an error if options of WithOverlay are invalid.
+func (o options) validOverlay() error {
+	if !o.hasOverlay {
+		return nil
+	}
+	if o.overlayBase != BaseA && o.overlayBase != BaseB {
+		return fmt.Errorf("imgdiff: invalid base image %v", o.overlayBase)
+	}
+	if !(0 <= o.overlayDim && o.overlayDim <= 1) {
+		return fmt.Errorf("imgdiff: invalid overlay dim %g", o.overlayDim)
+	}
+	return nil
+}
+
+// base returns the image of a and b differences are drawn over,
+// see WithOverlay.
+func (o options) base(a, b image.Image) image.Image {
+	if o.overlayBase == BaseB {
+		return b
+	}
+	return a
+}
+
+// overlaid reports whether difference images of d are drawn over
+// one of the compared images, so that only failPixel pixels mark
+// differences.
+func overlaid(d Differ) bool {
+	switch d := d.(type) {
+	case *binary:
+		return d.opts.hasOverlay
+	case *perceptual:
+		return d.opts.hasOverlay
+	}
+	return false
+}
+
+// paintOverlay replaces pixels of diff within the zero-based rectangle
+// r, but failPixel ones, with those of m composited over black and
+// dimmed by dim. Pixels which would look like failPixel are made
+// a shade darker.
+func paintOverlay(diff *image.NRGBA, m image.Image, dim float64, r image.Rectangle) {
+	mb := m.Bounds()
+	row := make([]pixel, r.Dx())
+	scale := dim / 0x101
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		readRow(row, m, mb.Min.X+r.Min.X, mb.Min.Y+y)
+		out := diff.Pix[diff.PixOffset(r.Min.X, y):]
+		for x, px := range row {
+			p := out[4*x : 4*x+4]
+			if isFailPixel(p) {
+				continue
+			}
+			c := [4]uint8{0, 0, 0, 0xff}
+			for i := range c[:3] {
+				c[i] = uint8(float64(px[i])*scale + 0.5)
+			}
+			if c == failPixel {
+				c[0]--
+			}
+			copy(p, c[:])
+		}
+	}
+}
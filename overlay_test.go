@@ -0,0 +1,129 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// overlayImages returns a paletted image, as decoded from GIF, of
+// colored stripes, and an NRGBA copy of it with a white square.
+func overlayImages() (*image.Paletted, *image.NRGBA) {
+	r := image.Rect(0, 0, 48, 32)
+	a := image.NewPaletted(r, palette.Plan9)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			a.SetColorIndex(x, y, uint8((x/4)*20+y/8))
+		}
+	}
+	b := image.NewNRGBA(r)
+	draw.Draw(b, r, a, image.Point{}, draw.Src)
+	draw.Draw(b, image.Rect(20, 12, 28, 20), image.White, image.Point{}, draw.Src)
+	return a, b
+}
+
+func TestOverlay(t *testing.T) {
+	a, b := overlayImages()
+	dim := func(c color.Color, f float64) color.NRGBA {
+		r, g, b, _ := c.RGBA()
+		return color.NRGBA{uint8(float64(r)*f/0x101 + 0.5), uint8(float64(g)*f/0x101 + 0.5), uint8(float64(b)*f/0x101 + 0.5), 0xff}
+	}
+	for _, d := range []Differ{NewBinary(WithOverlay(BaseA, 0.3)), NewDefaultPerceptual(WithOverlay(BaseA, 0.3))} {
+		res, err := CompareResult(d, a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := res.Diff.(*image.NRGBA)
+		if c, want := m.NRGBAAt(2, 2), dim(a.At(2, 2), 0.3); c != want {
+			t.Errorf("%s: pixel 2,2 = %v; want %v", algorithmName(d), c, want)
+		}
+		if c := m.NRGBAAt(24, 16); c != (color.NRGBA{0xff, 0, 0, 0xff}) {
+			t.Errorf("%s: pixel 24,16 = %v; want red", algorithmName(d), c)
+		}
+		if res.N == 0 || !res.DiffBounds.In(image.Rect(16, 8, 32, 24)) {
+			t.Errorf("%s: n = %d, bounds %v", algorithmName(d), res.N, res.DiffBounds)
+		}
+	}
+
+	// identical images are dimmed, and so is the second one with BaseB
+	diff, _, err := NewBinary(WithOverlay(BaseA, 0.5)).Compare(a, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, want := diff.(*image.NRGBA).NRGBAAt(30, 30), dim(a.At(30, 30), 0.5); c != want {
+		t.Errorf("identical: pixel 30,30 = %v; want %v", c, want)
+	}
+	diff, _, err = NewBinary(WithChannelTolerance(0xff, 0xff, 0xff, 0), WithOverlay(BaseB, 1)).Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, want := diff.(*image.NRGBA).NRGBAAt(24, 16), dim(b.At(24, 16), 1); c != want {
+		t.Errorf("BaseB: pixel 24,16 = %v; want %v", c, want)
+	}
+
+	// red pixels of the base don't look like differences
+	red := image.NewUniform(color.NRGBA{0xff, 0, 0, 0xff})
+	m := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(m, m.Rect, red, image.Point{}, draw.Src)
+	res, err := CompareResult(NewBinary(WithOverlay(BaseA, 1)), m, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := res.Diff.(*image.NRGBA).NRGBAAt(0, 0); c != (color.NRGBA{0xfe, 0, 0, 0xff}) {
+		t.Errorf("red base: pixel = %v; want 0xfe red", c)
+	}
+
+	for _, opt := range []Option{WithOverlay(BaseA, 1.5), WithOverlay(BaseA, -0.1), WithOverlay(BaseB+1, 0.3)} {
+		if _, _, err := NewBinary(opt).Compare(a, b); err == nil {
+			t.Error("binary: invalid overlay: no error")
+		}
+		if _, _, err := NewDefaultPerceptual(opt).Compare(a, b); err == nil {
+			t.Error("perceptual: invalid overlay: no error")
+		}
+	}
+}
+
+func TestOverlayGolden(t *testing.T) {
+	a, b := overlayImages()
+	diff, _, err := NewDefaultPerceptual(WithOverlay(BaseA, 0.3)).Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, diff); err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", "overlay.png")
+	if *update {
+		if err := os.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("overlay differs from %s; run go test -update to regenerate", golden)
+	}
+}
@@ -15,27 +15,24 @@
 package imgdiff
 
 import (
+	"fmt"
 	"image"
 	"image/color"
 	"math"
+	"runtime"
 	"sync"
 )
 
-var (
-	// white values of XYZ colorspace
-	whiteX, whiteY, whiteZ float64
-)
-
 const (
 	// LAB colorspace
 	epsilon = 216.0 / 24389.0
 	kappa   = 24389.0 / 27.0
 )
 
-func init() {
-	whiteX, whiteY, whiteZ = xyz(color.RGBA{0xff, 0xff, 0xff, 0xff}, 1)
-}
-
+// perceptual is the pdiff Differ. Its fields are read-only after
+// NewPerceptual, so that Compare is safe for concurrent use: state of
+// a call lives in its compareScratch, and tables shared by calls are
+// built under sync.Once, see gammaLUT.
 type perceptual struct {
 	gamma float64
 	// luminance
@@ -46,14 +43,37 @@ type perceptual struct {
 	fov float64
 	// color factor
 	cf float64
+	// adaptation luminances of no and full color test
+	scotopicLo, scotopicHi float64
 	// num one degree pixels
 	odp float64
 	// adaptation level index, starting from 0
 	ai int
+	// Laplacian pyramid configuration
+	lap lapFilter
+	// invalid options, returned by Compare
+	err error
+	// gamma decoding table
+	lut *gammaLUT
+	// *compareScratch of recent Compare calls
+	scratch sync.Pool
+	// LAB colors and pyramid of image a, if prepared, see Prepared
+	ref *imageScratch
+	// constructor options
+	opts options
 }
 
 // NewPerceptual creates a new Differ based on perceptual diff algorithm.
-func NewPerceptual(gamma, luminance, fov, cf float64, nocolor bool) Differ {
+//
+// Semi-transparent pixels are seen composited over black, unless
+// WithAlphaMode says otherwise.
+// FloatImage inputs are linear already, so gamma is not applied to them.
+//
+// Gamma, luminance and fov must be greater than 0, fov less than 180
+// degrees, and cf must not be negative. Compare returns an error if
+// they are invalid, as it does for invalid options; NewPerceptualE
+// returns it right away.
+func NewPerceptual(gamma, luminance, fov, cf float64, nocolor bool, opts ...Option) Differ {
 	d := &perceptual{
 		gamma:   gamma,
 		lum:     luminance,
@@ -61,233 +81,1091 @@ func NewPerceptual(gamma, luminance, fov, cf float64, nocolor bool) Differ {
 		cf:      cf,
 		nocolor: nocolor,
 		odp:     2 * math.Tan(fov*0.5*math.Pi/180) * 180 / math.Pi,
+		lut:     newGammaLUT(gamma),
+		opts:    newOptions(opts),
+		lap:     defaultLapFilter,
+		err:     validPerceptual(gamma, luminance, fov, cf),
 	}
-	for n := 1.0; !(n > d.odp); n *= 2 {
-		d.ai++
-		if d.ai == lapLevels-1 {
-			break
+	if k := d.opts.kernel; k != nil {
+		d.lap.kernel = append([]float64(nil), k...)
+		if d.err == nil {
+			d.err = validKernel(k)
 		}
 	}
+	if d.err == nil {
+		d.err = validColorVision(d.opts.colorVision)
+	}
+	if d.err == nil {
+		d.err = validAlphaMode(d.opts.alphaMode)
+	}
+	if d.err == nil {
+		d.err = validCSFModel(d.opts.csfModel)
+	}
+	if d.err == nil {
+		d.err = d.opts.validOverlay()
+	}
+	if d.err == nil {
+		d.err = d.opts.validMaxDiff()
+	}
+	if d.err == nil {
+		d.err = d.opts.validShiftTolerance()
+	}
+	if t := d.opts.transfer; d.opts.hasTransfer {
+		d.lut = newTransferLUT(t)
+		if d.err == nil {
+			d.err = validTransfer(t)
+		}
+	}
+	if d.opts.hasColorMatrix {
+		d.lut.space = newColorSpace(d.opts.colorMatrix)
+		if d.err == nil {
+			d.err = validColorMatrix(d.opts.colorMatrix)
+		}
+	}
+	// by default, the color test is off below 10 cd/m² and on above
+	d.scotopicLo, d.scotopicHi = 10, 10
+	if d.opts.hasScotopic {
+		d.scotopicLo, d.scotopicHi = d.opts.scotopicLo, d.opts.scotopicHi
+		if d.err == nil && !(0 <= d.scotopicLo && d.scotopicLo <= d.scotopicHi) {
+			d.err = fmt.Errorf("imgdiff: invalid scotopic ramp [%g, %g]", d.scotopicLo, d.scotopicHi)
+		}
+	}
+	if n := d.opts.pyramidLevels; n != 0 {
+		d.lap.levels = n
+		if d.err == nil && (n < 2 || n > 16) {
+			d.err = fmt.Errorf("imgdiff: invalid number of pyramid levels %d", n)
+		}
+	}
+	d.lut.cvd = cvdMatrices[d.opts.colorVision]
+	d.ai = adaptationLevel(d.odp, d.lap.levels)
 	return d
 }
 
+// NewPerceptualE is NewPerceptual returning an error if the arguments
+// or options are invalid, rather than returning it from Compare.
+func NewPerceptualE(gamma, luminance, fov, cf float64, nocolor bool, opts ...Option) (Differ, error) {
+	d := NewPerceptual(gamma, luminance, fov, cf, nocolor, opts...)
+	if err := d.(*perceptual).err; err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// validPerceptual returns an error if the arguments of NewPerceptual
+// would make thresholds NaN or infinite.
+func validPerceptual(gamma, luminance, fov, cf float64) error {
+	switch {
+	case !(gamma > 0) || math.IsInf(gamma, 1):
+		return fmt.Errorf("imgdiff: gamma must be > 0, not %g", gamma)
+	case !(luminance > 0) || math.IsInf(luminance, 1):
+		return fmt.Errorf("imgdiff: luminance must be > 0, not %g", luminance)
+	case !(fov > 0 && fov < 180):
+		return fmt.Errorf("imgdiff: field of view must be > 0 and < 180 degrees, not %g", fov)
+	case !(cf >= 0) || math.IsInf(cf, 1):
+		return fmt.Errorf("imgdiff: color factor must be >= 0, not %g", cf)
+	}
+	return nil
+}
+
+// adaptationLevel returns the index of the pyramid level luminance
+// adaptation is taken from, given the number of one degree pixels.
+// Pdiff takes it from level v, that of about 1 degree pixels, but its
+// levels are all at full resolution, level v being the image convolved
+// with the kernel v times. That is as blurred as level l of a subsampled
+// pyramid if v = (4^l-1)/3, so adaptation is taken from the first level
+// at least as blurred, to keep it to the same area, or the last one.
+func adaptationLevel(odp float64, levels int) int {
+	v := 0
+	for n := 1.0; !(n > odp) && v < levels-1; n *= 2 {
+		v++
+	}
+	l := 0
+	for (1<<(2*l)-1)/3 < v && l < levels-1 {
+		l++
+	}
+	return l
+}
+
 // NewDefaultPerceptual returns the result of calling NewPerceptual with:
-//   gamma = 2.2
-//   luminance = 100.0
-//   fov = 45.0
-//   cf = 1.0
-//   nocolor = false
-func NewDefaultPerceptual() Differ {
-	return NewPerceptual(2.2, 100.0, 45.0, 1.0, false)
+//
+//	gamma = 2.2
+//	luminance = 100.0
+//	fov = 45.0
+//	cf = 1.0
+//	nocolor = false
+func NewDefaultPerceptual(opts ...Option) Differ {
+	return NewPerceptual(2.2, 100.0, 45.0, 1.0, false, opts...)
 }
 
 // Compare compares a and b using pdiff algorithm.
 func (d *perceptual) Compare(a, b image.Image) (image.Image, int, error) {
+	return d.compareTimed(a, b, new(PhaseTimings))
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *perceptual) CompareInto(dst *image.NRGBA, a, b image.Image) (int, error) {
+	return d.compareInto(dst, a, b, new(PhaseTimings))
+}
+
+// CompareCount is Compare returning the number of different pixels only.
+// No difference image is allocated, unless WithShiftTolerance is set,
+// which unmarks pixels of it.
+func (d *perceptual) CompareCount(a, b image.Image) (int, error) {
+	return d.compareInto(nil, a, b, new(PhaseTimings))
+}
+
+// CompareResult is Compare returning a Result, see CompareResult.
+func (d *perceptual) CompareResult(a, b image.Image) (*Result, error) {
+	return compareResult(d, a, b)
+}
+
+func (d *perceptual) compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error) {
+	diff := new(image.NRGBA)
+	n, err := d.compareInto(diff, a, b, t)
+	if err != nil {
+		return nil, n, err
+	}
+	return diff, n, nil
+}
+
+func (d *perceptual) compareInto(diff *image.NRGBA, a, b image.Image, t *PhaseTimings) (int, error) {
 	ab, bb := a.Bounds(), b.Bounds()
 	w, h := ab.Dx(), ab.Dy()
 	if w != bb.Dx() || h != bb.Dy() {
-		return nil, -1, ErrSize
+		return -1, ErrSize
+	}
+	if d.err != nil {
+		return -1, d.err
+	}
+	if err := d.opts.checkSize(ab); err != nil {
+		return -1, err
+	}
+	if diff == nil && d.opts.shiftTolerance > 0 {
+		diff = new(image.NRGBA)
+	}
+	// with no diff, only the number of different pixels is returned
+	count := diff == nil
+	if !count {
+		resize(diff, w, h)
+	}
+	prog := d.opts.newProgress(d.progressTotal(h))
+	// no option makes identical images differ
+	if sameImage(a, b) {
+		if !count {
+			d.opts.fillSame(diff, a, b)
+		}
+		prog.finish()
+		return 0, nil
 	}
+	base := d.opts.base(a, b)
+	a, b = d.opts.alphaView(a), d.opts.alphaView(b)
+	heatmap := d.opts.heatmap && !d.opts.hasOverlay && !count
+	var dbg *debugPlanes
+	if d.opts.debug != nil || heatmap {
+		dbg = newDebugPlanes(w, h)
+	}
+	budget := d.opts.budget()
+	n := d.compareImages(diff, a, b, t, dbg, budget, prog)
+	if budget.exceeded() {
+		return n, ErrMaxDiff
+	}
+	if d.opts.debug != nil && d.opts.shiftTolerance > 0 {
+		dbg.tolerateShift(diff)
+	}
+	switch {
+	case count:
+	case d.opts.hasOverlay:
+		paintOverlay(diff, base, d.opts.overlayDim, diff.Rect)
+	case heatmap:
+		dbg.paintHeat(diff, diff.Rect, d.cf)
+	case n > 0 && d.opts.deltaColors:
+		paintDeltas(diff, a, b, diff.Rect)
+	}
+	if d.opts.debug != nil {
+		dbg.send(d.opts.debug)
+	}
+	prog.finish()
+	return n, nil
+}
 
-	diff := image.NewNRGBA(image.Rect(0, 0, w, h))
+// compareImages is compareInto of images of valid sizes, which aren't
+// the same, without WithDeltaColors, WithHeatmap and WithOverlay.
+// Intermediate values are written to dbg, if not nil. If diff is nil,
+// pixels are only counted, see rowScratch.diffRow. Rows are compared
+// until budget, if not nil, is exceeded. Pyramid levels built and rows
+// compared are reported to prog, see progressTotal.
+func (d *perceptual) compareImages(diff *image.NRGBA, a, b image.Image, t *PhaseTimings, dbg *debugPlanes, budget *diffBudget, prog *progress) int {
+	ab := a.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	p := newPhases("perceptual", ab, t)
+	shift := d.opts.shiftTolerance > 0
+	if d.banded() {
+		return d.compareBands(diff, a, b, p, dbg, budget, prog)
+	}
 
-	var (
-		wg         sync.WaitGroup
-		aLAB, bLAB [][]*labColor
-		aLap, bLap [][][]float64
-	)
+	s := d.getScratch(w, h)
+	defer d.scratch.Put(s)
+	if d.opts.float32 && !d.whole() {
+		return d.compare32(diff, a, b, s, p, dbg, budget, prog)
+	}
+	p.run("convert", &t.Convert, func() {
+		d.forImages(func(int) {
+			s.a.convert(a, d.lut, d.lum)
+		}, func(int) {
+			s.b.convert(b, d.lut, d.lum)
+		})
+	})
+	tile := d.opts.tileSize(w)
+	p.run("pyramid", &t.Pyramid, func() {
+		d.forImages(func(n int) {
+			s.a.fill(d.lap.kernel, tile, n, prog)
+		}, func(n int) {
+			s.b.fill(d.lap.kernel, tile, n, prog)
+		})
+	})
 
-	wg.Add(2)
-	go func() {
-		aLAB, aLap = labLap(a, d.gamma, d.lum)
-		wg.Done()
-	}()
-	go func() {
-		bLAB, bLap = labLap(b, d.gamma, d.lum)
-		wg.Done()
-	}()
+	var npix int // num of diff pixels
+	p.run("compare", &t.Compare, func() {
+		// bands write disjoint rows of diff
+		npix = forBands(d.opts.workers(), h, func(y0, y1 int) int {
+			rs := s.rows.get(d, w)
+			defer s.rows.put(rs)
+			n := 0
+			forTiles(w, y0, y1, tile, func(x0, x1, y int) {
+				if budget.exceeded() {
+					return
+				}
+				rs.setRows(s.a.lap, s.b.lap, y, x0, x1)
+				aLAB := s.a.lab.rows(y, y+1, w).cols(x0, x1)
+				bLAB := s.b.lab.rows(y, y+1, w).cols(x0, x1)
+				k := d.compareRow(rs.diffRow(diff, x0, y), rs, aLAB, bLAB, dbg.row(x0, y, x1-x0))
+				budget.add(k)
+				n += k
+				if x1 == w {
+					// the last tile of the row
+					prog.add(1)
+				}
+			})
+			return n
+		})
+		if npix > 0 && shift {
+			npix -= d.tolerateShift(diff, s)
+		}
+	})
+	return npix
+}
+
+// whole reports whether whole pyramids of the images are built, as
+// shifted pixels are looked up in them, and prepared ones are whole,
+// even with WithLowMemory and WithFloat32.
+func (d *perceptual) whole() bool {
+	return d.opts.shiftTolerance > 0 || d.ref != nil
+}
+
+// banded reports whether images are compared band by band,
+// with WithLowMemory, see compareBands.
+func (d *perceptual) banded() bool {
+	return d.opts.lowMemory && !d.whole()
+}
 
-	cpd := make([]float64, lapLevels) // cycles per degree
-	cpd[0] = 0.5 * float64(w) / d.odp // 0.5 * pixels per degree
-	for i := 1; i < lapLevels; i++ {
-		cpd[i] = 0.5 * cpd[i-1]
+// progressTotal returns the units of work of WithProgress of comparing
+// images of h rows: the rows, and the pyramid levels built of each
+// image, unless they are built band by band.
+func (d *perceptual) progressTotal(h int) int {
+	if d.banded() {
+		return h
 	}
-	csfMax := csf(3.248, 100.0)
-	freq := make([]float64, lapLevels-2)
-	for i := 0; i < lapLevels-2; i++ {
-		freq[i] = csfMax / csf(cpd[i], 100.0)
+	levels := d.lap.levels - 1
+	if d.ref == nil {
+		levels *= 2
 	}
+	return h + levels
+}
 
-	wg.Wait()
+// forImages runs fa and fb, which process images a and b with up to
+// n goroutines, in parallel, or fb only, with all of them, if a is
+// prepared.
+func (d *perceptual) forImages(fa, fb func(n int)) {
+	if d.ref != nil {
+		fb(d.opts.workers())
+		return
+	}
+	parallel(d.opts.workers(), fa, fb)
+}
 
-	var npix int // num of diff pixels
-	for y := 0; y < h; y++ {
-		for x := 0; x < w; x++ {
-			adapt := math.Max(0.5*(aLap[d.ai][y][x]+bLap[d.ai][y][x]), 1e-5)
-			mask := make([]float64, lapLevels-2)
-			contrast := make([]float64, lapLevels-2)
-			var contrastSum float64
-			for i := 0; i < lapLevels-2; i++ {
-				n1 := math.Abs(aLap[i][y][x] - aLap[i+1][y][x])
-				n2 := math.Abs(bLap[i][y][x] - bLap[i+1][y][x])
-				d1 := math.Abs(aLap[i+2][y][x])
-				d2 := math.Abs(bLap[i+2][y][x])
-				d := math.Max(d1, d2)
-				contrast[i] = math.Max(n1, n2) / math.Max(d, 1e-5)
-				mask[i] = vmask(contrast[i] * csf(cpd[i], adapt))
-				contrastSum += contrast[i]
-			}
-			if contrastSum < 1e-5 {
-				contrastSum = 1e-5
-			}
+// tolerateShift unmarks pixels of diff, the result of comparing images
+// held by s, which pass the perceptual test along with a pixel within
+// WithShiftTolerance of them in the other image, both ways, and returns
+// their number.
+func (d *perceptual) tolerateShift(diff *image.NRGBA, s *compareScratch) int {
+	r := d.opts.shiftTolerance
+	w, h := diff.Rect.Dx(), diff.Rect.Dy()
+	return forBands(d.opts.workers(), h, func(y0, y1 int) int {
+		rs := s.rows.get(d, w)
+		defer s.rows.put(rs)
+		var out [4]uint8
+		return tolerateShift(diff, y0, y1, func(x, y int) bool {
+			return matchesNear(x, y, r, w, h, func(x, y, qx, qy int, fromA bool) bool {
+				ax, ay, bx, by := x, y, qx, qy
+				if !fromA {
+					ax, ay, bx, by = qx, qy, x, y
+				}
+				rs.setLevels(rs.aRows, rs.aBuf, s.a.lap, ay, ax, ax+1)
+				rs.setLevels(rs.bRows, rs.bBuf, s.b.lap, by, bx, bx+1)
+				aLAB := s.a.lab.rows(ay, ay+1, w).cols(ax, ax+1)
+				bLAB := s.b.lab.rows(by, by+1, w).cols(bx, bx+1)
+				return d.compareRow(out[:], rs, aLAB, bLAB, debugRow{}) == 0
+			})
+		})
+	})
+}
 
-			var factor float64
-			for i := 0; i < lapLevels-2; i++ {
-				factor += contrast[i] * freq[i] * mask[i] / contrastSum
-			}
-			if factor < 1 {
-				factor = 1
-			} else if factor > 10 {
-				factor = 10
-			}
+// rowScratch holds values shared by compareRow calls for a band of rows
+// of a single Compare.
+type rowScratch struct {
+	// cycles per degree of each level
+	cpd []float64
+	// frequency factor of each level
+	freq []float64
+	// overwritten for every pixel
+	mask, contrast []float64
+	// pyramid rows at the current y, for each level
+	aRows, bRows [][]float64
+	// buffers of aRows and bRows of levels expanded to full
+	// resolution, and of all levels with WithFloat32
+	aBuf, bBuf [][]float64
+	// vertically interpolated samples of a level, see expandRow
+	tmp []float64
+	// buffers of LAB colors; float32 only
+	aLAB, bLAB labImage
+	// csf values at cpd
+	csf *csfCache
+	// pixels of a row of the difference image, see diffRow
+	out []uint8
+}
 
-			delta := math.Abs(aLap[0][y][x] - bLap[0][y][x])
-			pass := true
-			// pure luminance test
-			if delta > factor*tvi(adapt) {
-				pass = false
-			} else if !d.nocolor {
-				// CIE delta E test with modifications
-				cf := d.cf
-				// ramp down the color test in scotopic regions
-				if adapt < 10.0 {
-					// don't do color test at all
-					cf = 0.0
-				}
-				da := aLAB[y][x].a - bLAB[y][x].a
-				db := aLAB[y][x].b - bLAB[y][x].b
-				if (da*da+db*db)*cf > factor {
-					pass = false
+func (d *perceptual) newRowScratch(w int) *rowScratch {
+	n := d.lap.levels
+	v := make([]float64, n+3*(n-2))
+	rows := make([][]float64, 2*n)
+	buf := newRows(w, 2*n)
+	s := &rowScratch{
+		cpd:      v[:n:n],
+		freq:     v[n : 2*n-2 : 2*n-2],
+		mask:     v[2*n-2 : 3*n-4 : 3*n-4],
+		contrast: v[3*n-4:],
+		aRows:    rows[:n:n],
+		bRows:    rows[n:],
+		aBuf:     buf[:n:n],
+		bBuf:     buf[n:],
+		tmp:      make([]float64, w/2+2),
+		out:      make([]uint8, 4*w),
+	}
+	d.initRowScratch(s, w)
+	s.csf = newCSFCache(d.opts.csfModel, s.cpd[:n-2], d.opts.exactCSF)
+	return s
+}
+
+// diffRow returns pixels of diff from x, y on, which compareRow writes
+// to, or pixels of a row of s, which are overwritten by the next row,
+// if diff is nil and different pixels are only counted.
+func (s *rowScratch) diffRow(diff *image.NRGBA, x, y int) []uint8 {
+	if diff == nil {
+		return s.out[4*x:]
+	}
+	return diff.Pix[diff.PixOffset(x, y):]
+}
+
+// rowScratches is a free list of rowScratch for bands of rows compared
+// concurrently. It is safe for concurrent use.
+type rowScratches struct {
+	mu   sync.Mutex
+	free []*rowScratch
+}
+
+// get returns a rowScratch for comparing images of width w,
+// which is put back by put once the band is compared.
+func (p *rowScratches) get(d *perceptual, w int) *rowScratch {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := len(p.free); n > 0 {
+		s := p.free[n-1]
+		p.free = p.free[:n-1]
+		return s
+	}
+	return d.newRowScratch(w)
+}
+
+func (p *rowScratches) put(s *rowScratch) {
+	p.mu.Lock()
+	p.free = append(p.free, s)
+	p.mu.Unlock()
+}
+
+// initRowScratch computes values of s which depend on image width w.
+func (d *perceptual) initRowScratch(s *rowScratch, w int) {
+	s.cpd[0] = 0.5 * float64(w) / d.odp // 0.5 * pixels per degree
+	for i := 1; i < len(s.cpd); i++ {
+		s.cpd[i] = 0.5 * s.cpd[i-1]
+	}
+	// the peak of all models at 100 cd/m²
+	csfMax := bartenPeak
+	for i := range s.freq {
+		s.freq[i] = csfMax / d.opts.csfModel.at(s.cpd[i], 100.0)
+	}
+}
+
+// setRows sets pyramid rows of s to columns [x0, x1) of rows y
+// of aLap and bLap, see setLevels.
+func (s *rowScratch) setRows(aLap, bLap [][][]float64, y, x0, x1 int) {
+	s.setLevels(s.aRows, s.aBuf, aLap, y, x0, x1)
+	s.setLevels(s.bRows, s.bBuf, bLap, y, x0, x1)
+}
+
+// setLevels sets rows to columns [x0, x1) of row y of all levels
+// of the pyramid p, expanded to full resolution into buf. Levels
+// only need to hold the rows row y is interpolated from.
+func (s *rowScratch) setLevels(rows, buf [][]float64, p [][][]float64, y, x0, x1 int) {
+	rows[0] = p[0][y][x0:x1]
+	for l := 1; l < len(rows); l++ {
+		rows[l] = buf[l][:x1-x0]
+		expandRow(rows[l], p[l], l, y, x0, s.tmp)
+	}
+}
+
+// compareRow compares a row of two images, or a part of it, given
+// pyramid rows set in s and LAB colors of the row. Results are written
+// to out as NRGBA pixels, different pixels are marked and their number
+// is returned. Intermediate values are written to dbg, unless empty.
+func (d *perceptual) compareRow(out []uint8, s *rowScratch, aLAB, bLAB labImage, dbg debugRow) int {
+	aRows, bRows := s.aRows, s.bRows
+	freq, mask, contrast := s.freq, s.mask, s.contrast
+	// no color test for two grayscale images
+	colorTest := !d.nocolor && (aLAB.a != nil || bLAB.a != nil)
+	npix := 0
+	for x := range aRows[0] {
+		adapt := 0.5 * (aRows[d.ai][x] + bRows[d.ai][x])
+		if !(adapt >= 1e-5) {
+			adapt = 1e-5
+		}
+		k, f := s.csf.pos(adapt)
+		var contrastSum float64
+		for i := range contrast {
+			n1 := math.Abs(aRows[i][x] - aRows[i+1][x])
+			n2 := math.Abs(bRows[i][x] - bRows[i+1][x])
+			d1 := math.Abs(aRows[i+2][x])
+			d2 := math.Abs(bRows[i+2][x])
+			d := math.Max(d1, d2)
+			contrast[i] = math.Max(n1, n2) / math.Max(d, 1e-5)
+			mask[i] = vmask(contrast[i] * s.csf.at(i, k, f, adapt))
+			contrastSum += contrast[i]
+		}
+		if contrastSum < 1e-5 {
+			contrastSum = 1e-5
+		}
+
+		var factor float64
+		for i := range contrast {
+			factor += contrast[i] * freq[i] * mask[i] / contrastSum
+		}
+		if factor < 1 {
+			factor = 1
+		} else if factor > 10 {
+			factor = 10
+		}
+
+		delta := math.Abs(aRows[0][x] - bRows[0][x])
+		threshold := factor * tvi(adapt)
+		reason := ReasonPass
+		// pure luminance test
+		if delta > threshold {
+			reason = ReasonLuminance
+		} else if colorTest {
+			// CIE delta E test with modifications
+			cf := d.cf
+			// ramp down the color test in scotopic regions
+			if adapt < d.scotopicHi {
+				// don't do color test at all below scotopicLo
+				cf = 0.0
+				if adapt > d.scotopicLo {
+					cf = d.cf * (adapt - d.scotopicLo) / (d.scotopicHi - d.scotopicLo)
 				}
 			}
-
-			c := color.NRGBA{0, 0, 0, 0xff}
-			if !pass {
-				npix++
-				c.R = 0xff
-				//ar, ag, ab, _ := a.At(x, y).RGBA()
-				//br, bg, bb, _ := b.At(x, y).RGBA()
-				//c.R = uint8((math.Abs(float64(ar)-float64(br)) / 0xffff) * 0xff)
-				//c.G = uint8((math.Abs(float64(ag)-float64(bg)) / 0xffff) * 0xff)
-				//c.B = uint8((math.Abs(float64(ab)-float64(bb)) / 0xffff) * 0xff)
+			da, db := aLAB.delta(bLAB, x)
+			if (da*da+db*db)*cf > factor {
+				reason = ReasonColor
+			}
+		}
+		if dbg[0] != nil {
+			var chroma float64
+			if colorTest {
+				da, db := aLAB.delta(bLAB, x)
+				chroma = da*da + db*db
 			}
-			diff.Set(x, y, c)
+			dbg[debugAdaptation][x] = adapt
+			dbg[debugContrast][x] = contrastSum
+			dbg[debugFactor][x] = factor
+			dbg[debugLuminance][x] = delta
+			dbg[debugThreshold][x] = threshold
+			dbg[debugChroma][x] = chroma
+			dbg[debugReason][x] = float64(reason)
 		}
+
+		c := passPixel
+		if reason != ReasonPass {
+			npix++
+			c = failPixel
+		}
+		copy(out[4*x:], c[:])
 	}
+	return npix
+}
 
-	return diff, npix, nil
+// labImage holds the a and b components of LAB colors of an image,
+// indexed by y*w+x. Lightness is not used by Compare.
+// An empty labImage has all components 0.
+type labImage struct {
+	a, b []float64
 }
 
-type labColor struct {
-	l, a, b float64
+// newLabImage returns a labImage of n pixels backed by a single slice.
+func newLabImage(n int) labImage {
+	ab := make([]float64, 2*n)
+	return labImage{a: ab[:n:n], b: ab[n:]}
 }
 
-func lab(x, y, z float64) *labColor {
-	r := [3]float64{x / whiteX, y / whiteY, z / whiteZ}
-	var f [3]float64
-	for i := 0; i < 3; i++ {
-		if r[i] > epsilon {
-			f[i] = math.Pow(r[i], 1.0/3.0)
-			continue
-		}
-		f[i] = (kappa*r[i] + 16.0) / 116.0
+// newRows returns h rows of width w backed by a single slice.
+func newRows(w, h int) [][]float64 {
+	plane := make([]float64, w*h)
+	rows := make([][]float64, h)
+	for y := range rows {
+		rows[y] = plane[y*w : (y+1)*w : (y+1)*w]
+	}
+	return rows
+}
+
+// rows returns rows [y0, y1) of an image of width w.
+func (m labImage) rows(y0, y1, w int) labImage {
+	if m.a == nil {
+		return m
 	}
-	return &labColor{
-		l: 116.0*f[1] - 16.0,
-		a: 500.0 * (f[0] - f[1]),
-		b: 200.0 * (f[1] - f[2]),
+	return labImage{a: m.a[y0*w : y1*w], b: m.b[y0*w : y1*w]}
+}
+
+// cols returns columns [x0, x1) of a single row m.
+func (m labImage) cols(x0, x1 int) labImage {
+	if m.a == nil {
+		return m
 	}
+	return labImage{a: m.a[x0:x1], b: m.b[x0:x1]}
+}
+
+// delta returns differences of a and b components of pixels x of m and n.
+func (m labImage) delta(n labImage, x int) (da, db float64) {
+	if m.a != nil {
+		da, db = m.a[x], m.b[x]
+	}
+	if n.a != nil {
+		da -= n.a[x]
+		db -= n.b[x]
+	}
+	return da, db
+}
+
+// lab converts XYZ to LAB colorspace, see colorSpace.lab
+// of DefaultColorMatrix.
+func lab(x, y, z float64) (l, a, b float64) {
+	return defaultColorSpace.lab(x, y, z)
 }
 
 func xyz(c color.Color, gamma float64) (float64, float64, float64) {
 	r, g, b, _ := c.RGBA()
+	return xyz16(r, g, b, gamma)
+}
+
+// xyz16 converts 16-bit gamma-encoded RGB to XYZ colorspace.
+func xyz16(r, g, b uint32, gamma float64) (float64, float64, float64) {
 	rg := math.Pow(float64(r)/0xffff, gamma)
 	gg := math.Pow(float64(g)/0xffff, gamma)
 	bg := math.Pow(float64(b)/0xffff, gamma)
-	x := rg*0.576700 + gg*0.185556 + bg*0.188212
-	y := rg*0.297361 + gg*0.627355 + bg*0.0752847
-	z := rg*0.0270328 + gg*0.0706879 + bg*0.991248
-	return x, y, z
+	return linearXYZ(rg, gg, bg)
 }
 
-func labLap(m image.Image, gamma, lum float64) ([][]*labColor, [][][]float64) {
-	w, h := m.Bounds().Dx(), m.Bounds().Dy()
-	aLum, aLAB := make([][]float64, h), make([][]*labColor, h)
-	for y := 0; y < h; y++ {
-		aLum[y], aLAB[y] = make([]float64, w), make([]*labColor, w)
+// linearXYZ converts linear RGB to XYZ colorspace
+// with DefaultColorMatrix.
+func linearXYZ(rg, gg, bg float64) (float64, float64, float64) {
+	return defaultColorSpace.xyz(rg, gg, bg)
+}
+
+// labRows converts rows [y0, y1) of m, relative to its bounds,
+// to luminance scaled by lum and LAB colors. Both are indexed from y0.
+// Colors of grayscale images are not stored, see labRowsInto.
+func labRows(m image.Image, lut *gammaLUT, lum float64, y0, y1 int) ([][]float64, labImage) {
+	w, h := m.Bounds().Dx(), y1-y0
+	aLum := newRows(w, h)
+	var aLAB labImage
+	if !isGray(m) {
+		aLAB = newLabImage(w * h)
+	}
+	return aLum, labRowsInto(aLum, aLAB, m, lut, lum, y0)
+}
+
+// labRowsInto is labRows storing the results in len(aLum) rows
+// of aLum and aLAB, overwriting their contents. It returns aLAB,
+// or an empty labImage if m is grayscale. If aLAB is empty, only
+// luminance is computed.
+//
+// Gray colors have equal red, green and blue, so their a and b
+// components are 0 up to rounding errors, far below what the color
+// test of Compare can detect. For grayscale images, aLAB is left
+// untouched and only luminance is computed, which is exactly the
+// same as for their conversion to RGBA.
+func labRowsInto(aLum [][]float64, aLAB labImage, m image.Image, lut *gammaLUT, lum float64, y0 int) labImage {
+	return labRowsBuf(aLum, aLAB, m, lut, lum, y0, make([]pixel, m.Bounds().Dx()))
+}
+
+// labRowsBuf is labRowsInto reading pixels into row,
+// which is as wide as m.
+func labRowsBuf(aLum [][]float64, aLAB labImage, m image.Image, lut *gammaLUT, lum float64, y0 int, row []pixel) labImage {
+	w := m.Bounds().Dx()
+	fm, isFloat := m.(FloatImage)
+	min := m.Bounds().Min.Add(image.Pt(0, y0))
+	if isGray(m) {
+		for y := range aLum {
+			readRow(row, m, min.X, min.Y+y)
+			for x, p := range row {
+				v := lut.at(p[0])
+				_, cy, _ := lut.space.xyz(v, v, v)
+				aLum[y][x] = cy * lum
+			}
+		}
+		return labImage{}
+	}
+	for y := range aLum {
+		if !isFloat {
+			readRow(row, m, min.X, min.Y+y)
+		}
 		for x := 0; x < w; x++ {
-			cx, cy, cz := xyz(m.At(x, y), gamma)
-			aLAB[y][x] = lab(cx, cy, cz)
+			var cx, cy, cz float64
+			if isFloat {
+				r, g, b, _ := fm.FloatAt(min.X+x, min.Y+y)
+				cx, cy, cz = lut.space.xyz(simulate(lut.cvd, linearSample(r), linearSample(g), linearSample(b)))
+			} else {
+				p := row[x]
+				cx, cy, cz = lut.space.xyz(simulate(lut.cvd, lut.at(p[0]), lut.at(p[1]), lut.at(p[2])))
+			}
+			if aLAB.a != nil {
+				i := y*w + x
+				_, aLAB.a[i], aLAB.b[i] = lut.space.lab(cx, cy, cz)
+			}
 			aLum[y][x] = cy * lum
 		}
 	}
-	return aLAB, pyramid(aLum)
+	return aLAB
 }
 
-var (
-	// max levels
-	lapLevels = 8
-	// filter kernel
-	lapKernel = [5]float64{0.05, 0.25, 0.4, 0.25, 0.05}
-)
+// maxLinearSample is the largest FloatImage sample linearSample
+// returns, far brighter than any display, and small enough for sums
+// of pyramid levels, even of WithFloat32, to stay finite.
+const maxLinearSample = 1e6
+
+// linearSample sanitizes a FloatImage sample, mapping negative
+// and NaN values to 0, and larger ones, such as +Inf, to
+// maxLinearSample, so that a corrupt pixel only affects its area.
+func linearSample(v float32) float64 {
+	switch {
+	case !(v > 0):
+		return 0
+	case v > maxLinearSample:
+		return maxLinearSample
+	}
+	return float64(v)
+}
+
+// lapFilter configures the Laplacian pyramid of a perceptual differ.
+// Each level is half the width and height of the previous one,
+// rounded up, so that a pyramid holds about 4/3 of the samples
+// of the image.
+type lapFilter struct {
+	// number of levels, the first one being the image itself
+	levels int
+	// odd length kernel convolved with each level, in both directions,
+	// before it is subsampled by 2 to make the next one
+	kernel []float64
+}
+
+// defaultLapFilter is the pyramid configuration unless WithKernel is used.
+var defaultLapFilter = lapFilter{
+	levels: 8,
+	kernel: []float64{0.05, 0.25, 0.4, 0.25, 0.05},
+}
+
+// radius returns how far, in pixels, each level depends on the previous one.
+func (f lapFilter) radius() int {
+	return len(f.kernel) / 2
+}
+
+// validKernel returns an error if k can't be used as a pyramid kernel.
+func validKernel(k []float64) error {
+	var sum float64
+	for _, v := range k {
+		sum += v
+	}
+	if len(k)%2 == 0 || math.Abs(sum-1) > 1e-9 {
+		return fmt.Errorf("imgdiff: pyramid kernel must have odd length and sum to 1: %v", k)
+	}
+	return nil
+}
+
+// parallel calls fa and fb, concurrently if n > 1, splitting n workers
+// between them. Each one is passed the number of workers it may use.
+func parallel(n int, fa, fb func(n int)) {
+	if n <= 1 {
+		fa(1)
+		fb(1)
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		fa(n - n/2)
+		wg.Done()
+	}()
+	fb(n / 2)
+	wg.Wait()
+}
+
+// minBandRows is the min number of rows convolved by a single goroutine.
+const minBandRows = 32
+
+// bands returns the number of bands of rows, up to n, h rows
+// are split into, so that they have about minBandRows rows or more.
+func bands(h, n int) int {
+	if max := (h + minBandRows - 1) / minBandRows; n > max {
+		n = max
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// levelSize returns the width or height of level l
+// of a pyramid of an image n pixels wide or high.
+func levelSize(n, l int) int {
+	return (n + 1<<l - 1) >> l
+}
 
 // pyramid creates a Laplacian Pyramid out of the image m.
-// The result is [level][y][x] where level ranges from 0 to lapLevels.
-func pyramid(m [][]float64) [][][]float64 {
+// The result is [level][y][x] where level ranges from 0 to f.levels
+// and x and y range up to levelSize of the image width and height.
+func pyramid(m [][]float64, f lapFilter) [][][]float64 {
+	return pyramidN(m, f, runtime.GOMAXPROCS(0))
+}
+
+// pyramidN is pyramid with each level split into up to n bands of rows,
+// convolved concurrently. The result doesn't depend on n.
+func pyramidN(m [][]float64, f lapFilter, n int) [][][]float64 {
 	h, w := len(m), len(m[0])
-	p := make([][][]float64, lapLevels)
-	for l := 0; l < lapLevels; l++ {
-		p[l] = make([][]float64, h)
-		// first level is a copy
-		if l == 0 {
-			for y := 0; y < h; y++ {
-				p[l][y] = make([]float64, w)
-				copy(p[l][y], m[y])
-			}
+	// all levels share one plane, as in newImageScratch;
+	// the first level is a copy
+	p := newImageScratch(w, h, f.levels).lap
+	for y := 0; y < h; y++ {
+		copy(p[0][y], m[y])
+	}
+	fillPyramid(p, f.kernel, 0, n)
+	return p
+}
+
+// fillPyramid computes levels 1 and up of p from level 0
+// using kernel k, as pyramidN does, in tiles of the given size
+// (see forTiles). Existing rows of those levels are overwritten,
+// nil rows are allocated.
+func fillPyramid(p [][][]float64, k []float64, tile, n int) {
+	h, w := len(p[0]), len(p[0][0])
+	c := newConvolution(k, w, h, tile)
+	c.fill(p, c.newRows(bands(levelSize(h, 1), n)), nil)
+}
+
+// fill is fillPyramid with c, made for images the size of p[0],
+// and a row buffer for each of up to len(rows) concurrent bands.
+// Levels built are reported to prog.
+func (c *convolution) fill(p [][][]float64, rows [][]float64, prog *progress) {
+	n := len(rows)
+	// next levels are reductions of the previous one
+	for l := 1; l < len(p); l++ {
+		c.resize(len(p[l-1][0]), len(p[l-1]))
+		h := len(p[l])
+		n := bands(h, n)
+		if n == 1 {
+			c.reduce(p[l], p[l-1], 0, h, rows[0])
+			prog.add(1)
 			continue
 		}
-		// next levels are convolution of the previous one
-		for y := 0; y < h; y++ {
-			p[l][y] = make([]float64, w)
-			for x := 0; x < w; x++ {
-				for i := -2; i <= 2; i++ {
-					for j := -2; j <= 2; j++ {
-						ny := y + j
-						if ny < 0 {
-							ny = -ny
-						}
-						if ny >= h {
-							ny = 2*h - ny - 1
-						}
-						nx := x + i
-						if nx < 0 {
-							nx = -nx
-						}
-						if nx >= w {
-							nx = 2*w - nx - 1
-						}
-						p[l][y][x] += lapKernel[i+2] * lapKernel[j+2] * p[l-1][ny][nx]
-					}
-				}
-			}
+		var wg sync.WaitGroup
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			go func(l, i int) {
+				c.reduce(p[l], p[l-1], i*h/n, (i+1)*h/n, rows[i])
+				wg.Done()
+			}(l, i)
 		}
+		wg.Wait()
+		prog.add(1)
 	}
-	return p
+}
+
+// convolution convolves w x h images with a kernel, mirrored at the
+// borders. Mirrored indices are computed once, so that the inner loops
+// have no branches.
+type convolution struct {
+	k []float64
+	// kernel radius
+	r int
+	// xs[x+r] and ys[y+r] are mirror(x, w) and mirror(y, h)
+	// for x in [-r, w+r) and y in [-r, h+r)
+	xs, ys []int
+	// tile size, see forTiles
+	tile int
+}
+
+func newConvolution(k []float64, w, h, tile int) *convolution {
+	r := len(k) / 2
+	t := make([]int, w+h+4*r)
+	xs, ys := t[:w+2*r:w+2*r], t[w+2*r:]
+	mirrorTable(xs, w, r)
+	mirrorTable(ys, h, r)
+	return &convolution{k: k, r: r, xs: xs, ys: ys, tile: tile}
+}
+
+// resize makes c convolve w x h images, reusing its mirror tables,
+// which must be large enough, as they are for smaller images than
+// those c was made for.
+func (c *convolution) resize(w, h int) {
+	c.xs, c.ys = c.xs[:w+2*c.r], c.ys[:h+2*c.r]
+	mirrorTable(c.xs, w, c.r)
+	mirrorTable(c.ys, h, c.r)
+}
+
+// mirrorTable sets t[i] to mirror(i-r, n) for i in [0, n+2r).
+func mirrorTable(t []int, n, r int) {
+	for i := range t {
+		t[i] = mirror(i-r, n)
+	}
+}
+
+// newRow returns a row buffer for convolve.
+func (c *convolution) newRow() []float64 {
+	return make([]float64, len(c.xs))
+}
+
+// newRows returns n row buffers for convolve, backed by a single slice.
+func (c *convolution) newRows(n int) [][]float64 {
+	return newRows(len(c.xs), n)
+}
+
+// convolve computes rows [y0, y1) of dst as src convolved with the kernel,
+// tile by tile if c.tile > 0. Nil rows of dst are allocated.
+func (c *convolution) convolve(dst, src [][]float64, y0, y1 int, row []float64) {
+	forTiles(len(c.xs)-2*c.r, y0, y1, c.tile, func(x0, x1, y int) {
+		c.convolveRow(dst, src, x0, x1, y, row)
+	})
+}
+
+// convolveRow computes columns [x0, x1) of row y of dst.
+// The kernel is separable, so it is done in two 1D passes:
+// vertically into the row buffer, then horizontally out of it.
+func (c *convolution) convolveRow(dst, src [][]float64, x0, x1, y int, row []float64) {
+	sum, lo, hi := c.vertical(row, x0, x1)
+	for j, kj := range c.k {
+		s := src[c.ys[y+j]][lo:hi]
+		sum = sum[:len(s)]
+		for x, v := range s {
+			sum[x] += kj * v
+		}
+	}
+	row = c.pad(row, x0, x1)
+	d := dst[y]
+	if d == nil {
+		d = make([]float64, len(c.xs)-2*c.r)
+		dst[y] = d
+	}
+	d = d[x0:x1]
+	if len(c.k) == 5 {
+		k0, k1, k2, k3, k4 := c.k[0], c.k[1], c.k[2], c.k[3], c.k[4]
+		for x := range d {
+			s := row[x : x+5 : x+5]
+			d[x] = 0 + k0*s[0] + k1*s[1] + k2*s[2] + k3*s[3] + k4*s[4]
+		}
+		return
+	}
+	for x := range d {
+		s := row[x : x+len(c.k)]
+		var v float64
+		for i, ki := range c.k {
+			v += ki * s[i]
+		}
+		d[x] = v
+	}
+}
+
+// reduce computes rows [y0, y1) of dst, the next level of a pyramid,
+// as src convolved with the kernel and subsampled by 2: pixel (x, y)
+// of dst is the convolution at (2x, 2y) of src. It works tile by tile
+// of dst if c.tile > 0. Nil rows of dst are allocated.
+func (c *convolution) reduce(dst, src [][]float64, y0, y1 int, row []float64) {
+	w := levelSize(len(c.xs)-2*c.r, 1)
+	forTiles(w, y0, y1, c.tile, func(x0, x1, y int) {
+		c.reduceRow(dst, src, x0, x1, y, row)
+	})
+}
+
+// reduceRow computes columns [x0, x1) of row y of dst, in two 1D passes
+// as convolveRow does, but only at even rows and columns of src.
+func (c *convolution) reduceRow(dst, src [][]float64, x0, x1, y int, row []float64) {
+	// columns of src the passes are centered on
+	sx0, sx1 := 2*x0, 2*x1-1
+	sum, lo, hi := c.vertical(row, sx0, sx1)
+	for j, kj := range c.k {
+		s := src[c.ys[2*y+j]][lo:hi]
+		sum = sum[:len(s)]
+		for x, v := range s {
+			sum[x] += kj * v
+		}
+	}
+	row = c.pad(row, sx0, sx1)
+	d := dst[y]
+	if d == nil {
+		d = make([]float64, levelSize(len(c.xs)-2*c.r, 1))
+		dst[y] = d
+	}
+	d = d[x0:x1]
+	if len(c.k) == 5 {
+		k0, k1, k2, k3, k4 := c.k[0], c.k[1], c.k[2], c.k[3], c.k[4]
+		for x := range d {
+			s := row[2*x : 2*x+5 : 2*x+5]
+			d[x] = 0 + k0*s[0] + k1*s[1] + k2*s[2] + k3*s[3] + k4*s[4]
+		}
+		return
+	}
+	for x := range d {
+		s := row[2*x : 2*x+len(c.k)]
+		var v float64
+		for i, ki := range c.k {
+			v += ki * s[i]
+		}
+		d[x] = v
+	}
+}
+
+// expandRow sets dst to columns [x0, x0+len(dst)) of row y of level l
+// of a pyramid, p, upsampled to the resolution of level 0. Pixel
+// (x, y) of level l is at (x<<l, y<<l) of level 0, pixels in between
+// are bilinearly interpolated and those past the last ones get
+// their values. Samples are first interpolated vertically into tmp,
+// which must hold len(dst)>>l + 2 of them.
+func expandRow(dst []float64, p [][]float64, l, y, x0 int, tmp []float64) {
+	scale := 1 / float64(int(1)<<l)
+	mask := 1<<l - 1
+	i := y >> l
+	fy := float64(y&mask) * scale
+	r0, r1 := p[i], p[next(i, len(p))]
+	w := len(r0)
+	j0 := x0 >> l
+	tmp = tmp[:next((x0+len(dst)-1)>>l, w)+1-j0]
+	for j := range tmp {
+		v := r0[j0+j]
+		tmp[j] = v + fy*(r1[j0+j]-v)
+	}
+	expandCols(dst, tmp, x0&mask, l, w-1-j0)
+}
+
+// expandCols sets dst to samples of tmp upsampled by 2^l, linearly
+// interpolated, starting k pixels past the first one. Pixels past
+// tmp[last], the last sample of the level row, get its value.
+func expandCols(dst, tmp []float64, k, l, last int) {
+	scale := 1 / float64(int(1)<<l)
+	n := 1 << l
+	x := 0
+	for j := 0; x < len(dst); j++ {
+		v, dv := tmp[j], 0.0
+		if j < last {
+			dv = tmp[j+1] - v
+		}
+		for ; k < n && x < len(dst); k++ {
+			dst[x] = v + float64(k)*scale*dv
+			x++
+		}
+		k = 0
+	}
+}
+
+// next returns i+1, or i if it's the last of n indices.
+func next(i, n int) int {
+	if i+1 < n {
+		return i + 1
+	}
+	return i
+}
+
+// vertical zeroes the part of row the vertical pass of convolveRow sums
+// into and returns it, along with the image columns [lo, hi) it holds.
+// Row starts at column x0-r, columns outside of the image are filled
+// in by pad.
+func (c *convolution) vertical(row []float64, x0, x1 int) (sum []float64, lo, hi int) {
+	lo, hi = x0-c.r, x1+c.r
+	if lo < 0 {
+		lo = 0
+	}
+	if w := len(c.xs) - 2*c.r; hi > w {
+		hi = w
+	}
+	sum = row[lo-(x0-c.r) : hi-(x0-c.r)]
+	for x := range sum {
+		sum[x] = 0
+	}
+	return sum, lo, hi
+}
+
+// pad copies mirrored samples of row into its columns outside of
+// the image, so that the horizontal pass doesn't need to mirror indices.
+// It returns the part of row used for columns [x0, x1).
+func (c *convolution) pad(row []float64, x0, x1 int) []float64 {
+	row = row[:x1-x0+2*c.r]
+	// column of row[0]
+	off := x0 - c.r
+	w := len(c.xs) - 2*c.r
+	for i := 0; i < -off; i++ {
+		row[i] = row[c.xs[x0+i]-off]
+	}
+	for i := w - off; i < len(row); i++ {
+		row[i] = row[c.xs[x0+i]-off]
+	}
+	return row
+}
+
+// mirror maps index i, which may be outside of [0, n),
+// into the range by reflecting it at the borders.
+// Kernels wider than the image reflect more than once.
+func mirror(i, n int) int {
+	for i < 0 || i >= n {
+		if i < 0 {
+			i = -i
+		}
+		if i >= n {
+			i = 2*n - i - 1
+		}
+	}
+	return i
 }
 
 // csf computes the contrast sensitivity function (Barten SPIE 1989)
-// given the cycles per degree cpd and luminance lum.
+// given the cycles per degree cpd and luminance lum. Luminances
+// below 1e-5, and NaN, are taken as 1e-5, as adaptation is.
 func csf(cpd, lum float64) float64 {
+	if !(lum >= 1e-5) {
+		lum = 1e-5
+	}
 	a := 440.0 * math.Pow((1.0+0.7/lum), -0.2)
 	b := 0.3 * math.Pow((1.0+100.0/lum), 0.15)
 	return a * cpd * math.Exp(-b*cpd) * math.Sqrt(1.0+0.06*math.Exp(b*cpd))
@@ -302,9 +1180,13 @@ func vmask(c float64) float64 {
 
 // tvi, Threshold vs Intensity, computes the threshold of visibility
 // given the adaptation luminance al in candelas per square meter.
-// It is based on Ward Larson Siggraph 1997.
+// It is based on Ward Larson Siggraph 1997. NaN and negative
+// luminances have the threshold of black.
 func tvi(al float64) float64 {
 	var r float64
+	if !(al > 0) {
+		al = 0
+	}
 	al = math.Log10(al)
 	switch {
 	case al < -3.94:
@@ -15,12 +15,19 @@
 package imgdiff
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"image"
 	"image/color"
+	"image/draw"
 	_ "image/jpeg"
 	_ "image/png"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
 	"testing"
 
 	_ "golang.org/x/image/tiff"
@@ -29,21 +36,63 @@ import (
 func TestCompare(t *testing.T) {
 	pdiff := NewPerceptual(2.2, 100.0, 45.0, 1.0, false)
 	bdiff := NewBinary()
+	sdiff := NewDefaultSSIM()
+	msdiff := NewMSSSIM(5)
+	cdiff := NewCIEDE2000(2.3)
+	ediff := NewDeltaE(2.3)
+	pmdiff := NewPixelmatch(DefaultPixelmatchThreshold, false)
+	gdiff := NewGMSD()
+	mdiff := NewPerceptual(2.2, 100.0, 45.0, 1.0, false, WithCSF(MannosSakrison))
 	tests := []struct {
 		img1, img2 string
 		d          Differ
 		npix       int
 	}{
-		{"aqsis_vase_ref.png", "aqsis_vase.png", pdiff, 108},
+		{"aqsis_vase_ref.png", "aqsis_vase.png", pdiff, 102},
 		{"bug1102605_ref.tif", "bug1102605.tif", pdiff, 2198},
 		{"bug1471457_ref.tif", "bug1471457.tif", pdiff, 7},
 		{"cam_mb_ref.tif", "cam_mb.tif", pdiff, 0},
-		{"fish1.png", "fish2.png", pdiff, 27324},
+		{"fish1.png", "fish2.png", pdiff, 26060},
+		{"aqsis_vase_ref.png", "aqsis_vase.png", mdiff, 102},
+		{"bug1102605_ref.tif", "bug1102605.tif", mdiff, 2198},
+		{"bug1471457_ref.tif", "bug1471457.tif", mdiff, 7},
+		{"cam_mb_ref.tif", "cam_mb.tif", mdiff, 0},
+		{"fish1.png", "fish2.png", mdiff, 26013},
 		{"aqsis_vase_ref.png", "aqsis_vase.png", bdiff, 14796},
 		{"bug1102605_ref.tif", "bug1102605.tif", bdiff, 3207},
 		{"bug1471457_ref.tif", "bug1471457.tif", bdiff, 35},
 		{"cam_mb_ref.tif", "cam_mb.tif", bdiff, 7},
 		{"fish1.png", "fish2.png", bdiff, 137671},
+		{"aqsis_vase_ref.png", "aqsis_vase.png", sdiff, 243},
+		{"bug1102605_ref.tif", "bug1102605.tif", sdiff, 7314},
+		{"bug1471457_ref.tif", "bug1471457.tif", sdiff, 34},
+		{"cam_mb_ref.tif", "cam_mb.tif", sdiff, 0},
+		{"fish1.png", "fish2.png", sdiff, 33100},
+		{"aqsis_vase_ref.png", "aqsis_vase.png", msdiff, 0},
+		{"bug1102605_ref.tif", "bug1102605.tif", msdiff, 11592},
+		{"bug1471457_ref.tif", "bug1471457.tif", msdiff, 0},
+		{"cam_mb_ref.tif", "cam_mb.tif", msdiff, 0},
+		{"fish1.png", "fish2.png", msdiff, 0},
+		{"aqsis_vase_ref.png", "aqsis_vase.png", cdiff, 1458},
+		{"bug1102605_ref.tif", "bug1102605.tif", cdiff, 2184},
+		{"bug1471457_ref.tif", "bug1471457.tif", cdiff, 9},
+		{"cam_mb_ref.tif", "cam_mb.tif", cdiff, 2},
+		{"fish1.png", "fish2.png", cdiff, 99072},
+		{"aqsis_vase_ref.png", "aqsis_vase.png", ediff, 1850},
+		{"bug1102605_ref.tif", "bug1102605.tif", ediff, 2282},
+		{"bug1471457_ref.tif", "bug1471457.tif", ediff, 9},
+		{"cam_mb_ref.tif", "cam_mb.tif", ediff, 4},
+		{"fish1.png", "fish2.png", ediff, 126223},
+		{"aqsis_vase_ref.png", "aqsis_vase.png", pmdiff, 76},
+		{"bug1102605_ref.tif", "bug1102605.tif", pmdiff, 259},
+		{"bug1471457_ref.tif", "bug1471457.tif", pmdiff, 0},
+		{"cam_mb_ref.tif", "cam_mb.tif", pmdiff, 0},
+		{"fish1.png", "fish2.png", pmdiff, 2374},
+		{"aqsis_vase_ref.png", "aqsis_vase.png", gdiff, 80},
+		{"bug1102605_ref.tif", "bug1102605.tif", gdiff, 3664},
+		{"bug1471457_ref.tif", "bug1471457.tif", gdiff, 0},
+		{"cam_mb_ref.tif", "cam_mb.tif", gdiff, 0},
+		{"fish1.png", "fish2.png", gdiff, 1360},
 	}
 	for i, test := range tests {
 		a, err := readTestImage(test.img1)
@@ -61,16 +110,1136 @@ func TestCompare(t *testing.T) {
 			t.Errorf("(%d) %s: %v", i, test.img1, err)
 			continue
 		}
-		if n > test.npix {
-			t.Errorf("(%d) %s: n=%d; want n <= %d", i, test.img1, n, test.npix)
+		// exact, so that changes to the algorithms don't go unnoticed
+		if n != test.npix {
+			t.Errorf("(%d) %s: n=%d; want %d", i, test.img1, n, test.npix)
 		}
 	}
 }
 
+func TestLowMemory(t *testing.T) {
+	pairs := [][2]string{
+		{"aqsis_vase_ref.png", "aqsis_vase.png"},
+		{"bug1102605_ref.tif", "bug1102605.tif"},
+		{"bug1471457_ref.tif", "bug1471457.tif"},
+		{"cam_mb_ref.tif", "cam_mb.tif"},
+		{"fish1.png", "fish2.png"},
+	}
+	full, low := NewDefaultPerceptual(), NewDefaultPerceptual(WithLowMemory())
+	for _, pair := range pairs {
+		a, err := readTestImage(pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := readTestImage(pair[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, wantN, err := full.Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, n, err := low.Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != wantN {
+			t.Errorf("%s: n = %d; want %d", pair[0], n, wantN)
+		}
+		if !bytes.Equal(got.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+			t.Errorf("%s: diff images differ", pair[0])
+		}
+	}
+}
+
+func TestMaxWorkers(t *testing.T) {
+	pairs := [][2]string{
+		{"aqsis_vase_ref.png", "aqsis_vase.png"},
+		{"bug1102605_ref.tif", "bug1102605.tif"},
+		{"fish1.png", "fish2.png"},
+	}
+	for _, pair := range pairs {
+		a, err := readTestImage(pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := readTestImage(pair[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		variants := []struct {
+			name string
+			opts []Option
+		}{
+			{"full", nil},
+			{"low memory", []Option{WithLowMemory()}},
+			{"float32", []Option{WithFloat32()}},
+			{"tiled", []Option{WithTiling(64)}},
+		}
+		for _, v := range variants {
+			var want []byte
+			wantN := -1
+			for _, n := range []int{1, 2, 3, 8} {
+				diff, npix, err := NewDefaultPerceptual(append(v.opts, WithMaxWorkers(n))...).Compare(a, b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pix := diff.(*image.NRGBA).Pix
+				if wantN < 0 {
+					want, wantN = pix, npix
+					continue
+				}
+				if npix != wantN || !bytes.Equal(pix, want) {
+					t.Errorf("%s, %s: %d workers: n = %d; 1 worker: n = %d", pair[0], v.name, n, npix, wantN)
+				}
+			}
+		}
+	}
+}
+
+func TestFloat32(t *testing.T) {
+	pairs := [][2]string{
+		{"aqsis_vase_ref.png", "aqsis_vase.png"},
+		{"bug1102605_ref.tif", "bug1102605.tif"},
+		{"bug1471457_ref.tif", "bug1471457.tif"},
+		{"cam_mb_ref.tif", "cam_mb.tif"},
+		{"fish1.png", "fish2.png"},
+	}
+	full, f32 := NewDefaultPerceptual(), NewDefaultPerceptual(WithFloat32())
+	for _, pair := range pairs {
+		a, err := readTestImage(pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := readTestImage(pair[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, wantN, err := full.Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, n, err := f32.Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// float32 rounding is far below the perceptual thresholds,
+		// so testdata results are expected to be the same
+		if n != wantN {
+			t.Errorf("%s: n = %d; want %d", pair[0], n, wantN)
+		}
+		if !bytes.Equal(got.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+			t.Errorf("%s: diff images differ", pair[0])
+		}
+	}
+}
+
+func TestNewPerceptualE(t *testing.T) {
+	nan, inf := math.NaN(), math.Inf(1)
+	tests := []struct {
+		gamma, lum, fov, cf float64
+		valid               bool
+	}{
+		{2.2, 100, 45, 1, true},
+		{1, 0.01, 179, 0, true},
+		{0, 100, 45, 1, false},
+		{-2.2, 100, 45, 1, false},
+		{nan, 100, 45, 1, false},
+		{inf, 100, 45, 1, false},
+		{2.2, 0, 45, 1, false},
+		{2.2, -100, 45, 1, false},
+		{2.2, nan, 45, 1, false},
+		{2.2, inf, 45, 1, false},
+		{2.2, 100, 0, 1, false},
+		{2.2, 100, 180, 1, false},
+		{2.2, 100, nan, 1, false},
+		{2.2, 100, 45, -1, false},
+		{2.2, 100, 45, nan, false},
+		{2.2, 100, 45, inf, false},
+	}
+	a := blocks(30, 20)
+	for i, test := range tests {
+		d, err := NewPerceptualE(test.gamma, test.lum, test.fov, test.cf, false)
+		if (err == nil) != test.valid || (d != nil) != test.valid {
+			t.Errorf("(%d) NewPerceptualE(%g, %g, %g, %g) = %v, %v", i, test.gamma, test.lum, test.fov, test.cf, d, err)
+		}
+		_, _, cerr := NewPerceptual(test.gamma, test.lum, test.fov, test.cf, false).Compare(a, a)
+		if (cerr == nil) != test.valid {
+			t.Errorf("(%d) Compare error %v; want %v", i, cerr, err)
+		}
+	}
+	if _, err := NewPerceptualE(2.2, 100, 45, 1, false, WithPyramidLevels(1)); err == nil {
+		t.Error("invalid option: no error")
+	}
+}
+
+// corruptFloat is a FloatImage whose samples at some points are v.
+type corruptFloat struct {
+	floatImage
+	bad map[image.Point]float32
+}
+
+func (m corruptFloat) FloatAt(x, y int) (r, g, b, a float32) {
+	if v, ok := m.bad[image.Pt(x, y)]; ok {
+		return v, v, v, 1
+	}
+	return m.floatImage.FloatAt(x, y)
+}
+
+// TestCorruptPixels checks that NaN, infinite and huge samples only
+// affect the area around them.
+func TestCorruptPixels(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(m, m.Rect, image.NewUniform(color.NRGBA{0x80, 0x60, 0x40, 0xff}), image.Point{}, draw.Src)
+	a := floatImage{m}
+	for _, v := range []float32{float32(math.NaN()), float32(math.Inf(1)), float32(math.Inf(-1)), math.MaxFloat32} {
+		b := corruptFloat{a, map[image.Point]float32{{10, 12}: v, {50, 40}: v}}
+		for _, opts := range [][]Option{nil, {WithFloat32()}, {WithLowMemory()}} {
+			var r debugRecorder
+			_, n, err := NewDefaultPerceptual(append(opts, WithDebug(&r))...).Compare(a, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// only the corrupt pixels differ
+			if n != 2 {
+				t.Errorf("%g: n = %d; want 2", v, n)
+			}
+			for name, p := range r.planes {
+				for i, x := range p.Pix {
+					if math.IsNaN(x) || math.IsInf(x, 0) {
+						t.Fatalf("%g: %s at %d, %d = %g", v, name, i%p.Width, i/p.Width, x)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPerceptualCompareCount(t *testing.T) {
+	a, err := readTestImage("bug1102605_ref.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("bug1102605.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"lowmem", []Option{WithLowMemory()}},
+		{"float32", []Option{WithFloat32()}},
+		{"tiled", []Option{WithTiling(64)}},
+		{"shift", []Option{WithShiftTolerance(1)}},
+		{"heatmap", []Option{WithHeatmap(), WithDeltaColors()}},
+	}
+	for _, test := range tests {
+		d := NewDefaultPerceptual(test.opts...)
+		_, want, err := d.Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := d.(CountDiffer).CompareCount(a, b)
+		if err != nil || n != want {
+			t.Errorf("%s: CompareCount = %d, %v; want %d", test.name, n, err, want)
+		}
+	}
+	if n, err := CompareCount(NewDefaultPerceptual(), a, a); err != nil || n != 0 {
+		t.Errorf("CompareCount of the same image = %d, %v; want 0", n, err)
+	}
+	// planes are sent without the difference image too
+	rec := new(debugRecorder)
+	n, err := CompareCount(NewDefaultPerceptual(WithDebug(rec)), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := 0
+	for _, v := range rec.planes["reason"].Pix {
+		if v != ReasonPass {
+			failed++
+		}
+	}
+	if failed != n {
+		t.Errorf("debug: %d failing pixels; want %d", failed, n)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	a, err := readTestImage("bug1102605_ref.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("bug1102605.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a part with some differences, to keep the test fast
+	type subImager interface {
+		SubImage(image.Rectangle) image.Image
+	}
+	r := image.Rect(80, 60, 240, 180)
+	a, b = a.(subImager).SubImage(r), b.(subImager).SubImage(r)
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	procs := []int{1, 2, 3, runtime.NumCPU()}
+	var want [sha256.Size]byte
+	wantN := -1
+	for i := 0; i < 50; i++ {
+		runtime.GOMAXPROCS(procs[i%len(procs)])
+		opts := []Option{WithMaxWorkers(1 + i%7)}
+		if i%5 == 4 {
+			opts = append(opts, WithLowMemory())
+		}
+		diff, n, err := NewDefaultPerceptual(opts...).Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(diff.(*image.NRGBA).Pix)
+		if wantN < 0 {
+			want, wantN = sum, n
+			continue
+		}
+		if n != wantN || sum != want {
+			t.Errorf("(%d) GOMAXPROCS %d, %d workers: n = %d, sha256 %x; want n = %d, sha256 %x",
+				i, procs[i%len(procs)], 1+i%7, n, sum, wantN, want)
+		}
+	}
+}
+
+// TestSubImage compares crops of images, whose bounds don't start at
+// 0, 0, and standalone copies of the same crops.
+func TestSubImage(t *testing.T) {
+	a, err := readTestImage("bug1102605_ref.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("bug1102605.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type subImager interface {
+		SubImage(image.Rectangle) image.Image
+	}
+	r := image.Rect(100, 50, 260, 170)
+	crops := [2]image.Image{a.(subImager).SubImage(r), b.(subImager).SubImage(r)}
+	var copies, moved [2]image.Image
+	for i, m := range crops {
+		c := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+		draw.Draw(c, c.Rect, m, r.Min, draw.Src)
+		copies[i] = c
+		// the same crop at another origin, negative for a
+		at := c.Rect.Add(image.Pt(30-40*(1-i), 11-20*(1-i)))
+		big := image.NewNRGBA(at.Inset(-5))
+		draw.Draw(big, at, c, image.Point{}, draw.Src)
+		moved[i] = big.SubImage(at)
+	}
+
+	tests := []struct {
+		name string
+		d    Differ
+	}{
+		{"binary", NewBinary()},
+		{"binary tolerance", NewBinary(WithChannelTolerance(2, 2, 2, 0))},
+		{"binary shift", NewBinary(WithShiftTolerance(1))},
+		{"binary anti-aliasing", NewBinary(WithAntiAliasing())},
+		{"perceptual", NewDefaultPerceptual()},
+		{"lowmem", NewDefaultPerceptual(WithLowMemory())},
+		{"float32", NewDefaultPerceptual(WithFloat32())},
+		{"tiled", NewDefaultPerceptual(WithTiling(64))},
+		{"shift", NewDefaultPerceptual(WithShiftTolerance(1))},
+		{"heatmap", NewDefaultPerceptual(WithHeatmap())},
+	}
+	for _, test := range tests {
+		want, wantN, err := test.d.Compare(copies[0], copies[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ab := range [][2]image.Image{crops, moved} {
+			diff, n, err := test.d.Compare(ab[0], ab[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != wantN {
+				t.Errorf("%s %v: n = %d; want %d", test.name, ab[0].Bounds(), n, wantN)
+			}
+			if diff.Bounds() != want.Bounds() || !bytes.Equal(diff.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+				t.Errorf("%s %v: difference image of %v differs from the one of standalone images", test.name, ab[0].Bounds(), diff.Bounds())
+			}
+			if n, err := CompareCount(test.d, ab[0], ab[1]); err != nil || n != wantN {
+				t.Errorf("%s %v: CompareCount = %d, %v; want %d", test.name, ab[0].Bounds(), n, err, wantN)
+			}
+		}
+	}
+	_, want, err := NewDefaultPerceptual().Compare(copies[0], copies[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := PreparePerceptual(moved[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, n, err := p.Compare(crops[1]); err != nil || n != want {
+		t.Errorf("prepared: n = %d, %v; want %d", n, err, want)
+	}
+}
+
+// TestConcurrentCompare checks that a single Differ can be used by many
+// goroutines at once, with results matching sequential calls.
+// Run it with -race.
+func TestConcurrentCompare(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var pairs [][2]image.Image
+	// different sizes and color models, so that scratch buffers
+	// pooled by one call don't fit the next one
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 64, 48), image.Rect(0, 0, 33, 77), image.Rect(10, 5, 110, 35)} {
+		m := randomImages(r, rnd)
+		for i := range m {
+			pairs = append(pairs, [2]image.Image{m[i], m[(i+1)%len(m)]})
+		}
+		// grayscale on both sides
+		pairs = append(pairs, [2]image.Image{m[2], m[3]})
+	}
+	tests := []struct {
+		d Differ
+		// compared on the first pair only
+		slow bool
+	}{
+		{NewDefaultPerceptual(), false},
+		{NewBinary(), false},
+		{NewDefaultSSIM(), false},
+		{NewMSSSIM(3), false},
+		{NewMSE(0.01), false},
+		{NewCIEDE2000(1), false},
+		{NewDeltaE(1), false},
+		{NewPixelmatch(0.05, false), false},
+		{NewPHash(8, 0), false},
+		{NewAHash(0), false},
+		{NewDHash(0), false},
+		{NewBlockhash(144), false},
+		{NewHistogram(16, HistCorrelation), false},
+		{NewEdge(0.5), false},
+		{NewGMSD(), false},
+		{NewComposite(CompositeAnd, NewBinary(), NewDefaultSSIM()), false},
+		{NewDownsampled(NewDefaultPerceptual(), 64), true},
+		{NewBlurred(NewBinary(), 1.5), false},
+		{NewNormalized(NewDefaultSSIM()), false},
+		{NewBinary(WithShiftTolerance(1)), false},
+		{NewDefaultPerceptual(WithShiftTolerance(1)), true},
+		{NewAligned(NewBinary(), 4), false},
+		{NewGrid(NewBinary(), 3, 2), false},
+		{NewBinary(WithChannelTolerance(8, 8, 8, 0)), false},
+		{NewBinaryFuzz(2), false},
+	}
+	goroutines := 8
+	if testing.Short() {
+		goroutines = 3
+	}
+	for _, test := range tests {
+		d, pairs := test.d, pairs
+		if test.slow {
+			pairs = pairs[:1]
+		}
+		type result struct {
+			n   int
+			sum [sha256.Size]byte
+		}
+		compare := func(i int) (result, error) {
+			diff, n, err := d.Compare(pairs[i][0], pairs[i][1])
+			if err != nil {
+				return result{}, err
+			}
+			return result{n, sha256.Sum256(toNRGBA(diff).Pix)}, nil
+		}
+		want := make([]result, len(pairs))
+		for i := range pairs {
+			var err error
+			if want[i], err = compare(i); err != nil {
+				t.Fatalf("%T: (%d) %v", d, i, err)
+			}
+		}
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for k := 0; k < len(pairs); k++ {
+					i := (g + k) % len(pairs)
+					res, err := compare(i)
+					if err != nil {
+						t.Errorf("%T: (%d) goroutine %d: %v", d, i, g, err)
+						return
+					}
+					if res != want[i] {
+						t.Errorf("%T: (%d) goroutine %d: n = %d, sha256 %x; want n = %d, sha256 %x",
+							d, i, g, res.n, res.sum, want[i].n, want[i].sum)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+	}
+}
+
+func TestCompareInto(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r := image.Rect(3, 5, 43, 35)
+	m := randomImages(r, rnd)
+	a, b, c := m[0], m[1], m[4]
+	w, h := r.Dx(), r.Dy()
+	// an image of random pixels
+	stale := func() *image.NRGBA {
+		d := image.NewNRGBA(image.Rect(0, 0, w, h))
+		rnd.Read(d.Pix)
+		return d
+	}
+	differs := []Differ{
+		NewBinary(),
+		NewDefaultPerceptual(),
+		NewDefaultPerceptual(WithLowMemory()),
+		NewDefaultPerceptual(WithFloat32()),
+		NewDefaultSSIM(),
+		NewMSSSIM(3),
+		NewMSE(0.01),
+		NewCIEDE2000(1),
+		NewDeltaE(1),
+		NewPixelmatch(0.05, false),
+		NewPHash(8, 0),
+		NewAHash(0),
+		NewDHash(0),
+		NewBlockhash(144),
+		NewHistogram(16, HistCorrelation),
+		NewEdge(0.5),
+		NewGMSD(),
+		NewComposite(CompositeOr, NewBinary(), NewDeltaE(2.3)),
+		NewDownsampled(NewDefaultSSIM(), 64),
+		NewBlurred(NewDeltaE(2.3), 1),
+		NewNormalized(NewMSE(0.01)),
+		NewBinary(WithShiftTolerance(2)),
+		NewDefaultPerceptual(WithShiftTolerance(1)),
+		NewAligned(NewDefaultSSIM(), 4),
+		NewGrid(NewDefaultPerceptual(), 4, 3),
+	}
+	for _, d := range differs {
+		want, wantN, err := d.Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantPix := want.(*image.NRGBA).Pix
+		big := image.NewNRGBA(image.Rect(0, 0, w+7, h+2))
+		tests := []struct {
+			name string
+			dst  *image.NRGBA
+			// whether dst keeps its Pix
+			reuse bool
+		}{
+			{"zero", &image.NRGBA{}, false},
+			{"stale", stale(), true},
+			{"larger Pix", &image.NRGBA{Pix: make([]uint8, 4*w*h+100), Stride: 4 * w, Rect: image.Rect(0, 0, w, h)}, true},
+			{"other bounds", image.NewNRGBA(image.Rect(-1, -1, w, h+1)), true},
+			{"too small", image.NewNRGBA(image.Rect(0, 0, w, h-1)), false},
+			{"larger stride", big.SubImage(image.Rect(0, 0, w, h)).(*image.NRGBA), true},
+		}
+		for i, test := range tests {
+			dst, pix := test.dst, test.dst.Pix
+			// leave a stale diff of other images
+			if _, err := d.(IntoDiffer).CompareInto(dst, a, c); err != nil {
+				t.Fatal(err)
+			}
+			n, err := d.(IntoDiffer).CompareInto(dst, a, b)
+			if err != nil {
+				t.Errorf("(%d) %T %s: %v", i, d, test.name, err)
+				continue
+			}
+			if dst.Rect != want.Bounds() {
+				t.Errorf("(%d) %T %s: bounds = %v; want %v", i, d, test.name, dst.Rect, want.Bounds())
+				continue
+			}
+			if n != wantN || !bytes.Equal(toNRGBA(dst).Pix, wantPix) {
+				t.Errorf("(%d) %T %s: n = %d; want %d, pixels of Compare", i, d, test.name, n, wantN)
+			}
+			if reused := len(pix) > 0 && &dst.Pix[0] == &pix[0]; reused != test.reuse {
+				t.Errorf("(%d) %T %s: Pix reused = %v; want %v", i, d, test.name, reused, test.reuse)
+			}
+			// identical images overwrite stale pixels too
+			if n, err := d.(IntoDiffer).CompareInto(dst, a, a); err != nil || n != 0 {
+				t.Errorf("(%d) %T %s: CompareInto(a, a) = %d, %v; want 0", i, d, test.name, n, err)
+			}
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					if c := dst.NRGBAAt(x, y); c != (color.NRGBA{0, 0, 0, 0xff}) {
+						t.Fatalf("(%d) %T %s: pixel (%d, %d) = %v after CompareInto(a, a)", i, d, test.name, x, y, c)
+					}
+				}
+			}
+		}
+		// pixels next to the bounds of the larger stride test are untouched
+		for y := 0; y < h+2; y++ {
+			for x := w; x < w+7; x++ {
+				if c := big.NRGBAAt(x, y); c != (color.NRGBA{}) {
+					t.Fatalf("%T: pixel (%d, %d) outside dst = %v", d, x, y, c)
+				}
+			}
+		}
+		dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+		if _, err := d.(IntoDiffer).CompareInto(dst, a, image.NewNRGBA(image.Rect(0, 0, w, h+1))); err != ErrSize {
+			t.Errorf("%T: err = %v; want ErrSize", d, err)
+		}
+	}
+}
+
+// grayscale returns gray and gray16 conversions of m.
+func grayscale(m image.Image) (*image.Gray, *image.Gray16) {
+	g, g16 := image.NewGray(m.Bounds()), image.NewGray16(m.Bounds())
+	draw.Draw(g, g.Rect, m, m.Bounds().Min, draw.Src)
+	draw.Draw(g16, g16.Rect, m, m.Bounds().Min, draw.Src)
+	return g, g16
+}
+
+func TestGray(t *testing.T) {
+	pairs := [][2]string{
+		{"aqsis_vase_ref.png", "aqsis_vase.png"},
+		{"fish1.png", "fish2.png"},
+	}
+	differs := []Differ{
+		NewBinary(),
+		NewDefaultPerceptual(),
+		NewDefaultPerceptual(WithLowMemory()),
+		NewDefaultPerceptual(WithFloat32()),
+	}
+	for _, pair := range pairs {
+		a, err := readTestImage(pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := readTestImage(pair[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		ga, ga16 := grayscale(a)
+		gb, gb16 := grayscale(b)
+		tests := [][2]image.Image{{ga, gb}, {ga16, gb16}, {ga, generic{gb}}}
+		for i, d := range differs {
+			for _, test := range tests {
+				// generic images take the general path
+				want, wantN, err := d.Compare(generic{test[0]}, generic{test[1]})
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, n, err := d.Compare(test[0], test[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != wantN || !bytes.Equal(got.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+					t.Errorf("%s: (%d) %T, %T: n = %d; want %d", pair[0], i, test[0], test[1], n, wantN)
+				}
+			}
+		}
+	}
+}
+
+func TestTiling(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	sizes := []image.Point{{1, 1}, {2, 9}, {9, 2}, {37, 23}, {130, 61}, {257, 3}}
+	for _, size := range sizes {
+		a, b := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y)), image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+		rnd.Read(a.Pix)
+		copy(b.Pix, a.Pix)
+		for i := 0; i < len(b.Pix); i += 1 + rnd.Intn(40) {
+			b.Pix[i] = uint8(rnd.Intn(256))
+		}
+		for _, opts := range [][]Option{nil, {WithLowMemory()}, {WithFloat32()}} {
+			want, wantN, err := NewDefaultPerceptual(append(opts, WithTiling(0))...).Compare(a, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, tile := range []int{1, 3, 7, 16, 64} {
+				got, n, err := NewDefaultPerceptual(append(opts, WithTiling(tile))...).Compare(a, b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != wantN || !bytes.Equal(got.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+					t.Errorf("%v, %d options, tile %d: n = %d; want %d", size, len(opts), tile, n, wantN)
+				}
+			}
+		}
+	}
+}
+
+func TestKernel(t *testing.T) {
+	a, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	differs := []Differ{
+		NewDefaultPerceptual(),
+		NewDefaultPerceptual(WithKernel([]float64{0.25, 0.5, 0.25})),
+		NewDefaultPerceptual(WithKernel([]float64{0.25, 0.5, 0.25}), WithLowMemory()),
+	}
+	want := make([][]byte, len(differs))
+	wantN := make([]int, len(differs))
+	for i, d := range differs {
+		diff, n, err := d.Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[i], wantN[i] = diff.(*image.NRGBA).Pix, n
+	}
+	if wantN[0] == wantN[1] {
+		t.Errorf("kernel has no effect: n = %d", wantN[1])
+	}
+	if wantN[1] != wantN[2] || !bytes.Equal(want[1], want[2]) {
+		t.Errorf("low memory: n = %d; want %d", wantN[2], wantN[1])
+	}
+
+	// differently configured differs don't affect each other
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		for i, d := range differs {
+			wg.Add(1)
+			go func(i int, d Differ) {
+				defer wg.Done()
+				diff, n, err := d.Compare(a, b)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if n != wantN[i] || !bytes.Equal(diff.(*image.NRGBA).Pix, want[i]) {
+					t.Errorf("(%d) concurrent n = %d; want %d", i, n, wantN[i])
+				}
+			}(i, d)
+		}
+	}
+	wg.Wait()
+
+	for _, k := range [][]float64{nil, {}, {0.5, 0.5}, {0.25, 0.5, 0.5}} {
+		if _, _, err := NewDefaultPerceptual(WithKernel(k)).Compare(a, b); (err != nil) != (k != nil) {
+			t.Errorf("kernel %v: err = %v", k, err)
+		}
+	}
+}
+
+// TestTransfer compares a dark gradient with itself brightened in
+// a checkerboard. The sRGB transfer function decodes dark colors
+// brighter than gamma 2.2, so fewer pixels are visibly different.
+func TestTransfer(t *testing.T) {
+	r := image.Rect(0, 0, 64, 64)
+	a, b := image.NewGray(r), image.NewGray(r)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			v := uint8(x)
+			a.SetGray(x, y, color.Gray{v})
+			if (x/4+y/4)%2 == 0 {
+				v += 40
+			}
+			b.SetGray(x, y, color.Gray{v})
+		}
+	}
+	count := func(opts ...Option) int {
+		_, n, err := NewPerceptual(2.2, 100, 45, 1, false, opts...).Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	gamma := count()
+	if n := count(WithTransfer(Gamma(2.2))); n != gamma {
+		t.Errorf("Gamma(2.2): n = %d; want %d as without WithTransfer", n, gamma)
+	}
+	srgb := count(WithTransfer(SRGB))
+	if srgb == 0 || srgb >= gamma {
+		t.Errorf("SRGB: n = %d; want between 0 and %d of gamma 2.2", srgb, gamma)
+	}
+	for _, tr := range []Transfer{-1, Transfer(math.NaN())} {
+		if _, _, err := NewDefaultPerceptual(WithTransfer(tr)).Compare(a, b); err == nil {
+			t.Errorf("WithTransfer(%v): no error", tr)
+		}
+	}
+}
+
+// TestScotopicCutoff compares screenshots of a dark theme whose
+// dark red button turned dark green of about the same luminance.
+func TestScotopicCutoff(t *testing.T) {
+	r := image.Rect(0, 0, 64, 64)
+	button := image.Rect(16, 16, 48, 48)
+	a, b := image.NewNRGBA(r), image.NewNRGBA(r)
+	bg := image.NewUniform(color.NRGBA{30, 30, 34, 0xff})
+	draw.Draw(a, r, bg, image.Point{}, draw.Src)
+	draw.Draw(b, r, bg, image.Point{}, draw.Src)
+	draw.Draw(a, button, image.NewUniform(color.NRGBA{90, 40, 40, 0xff}), image.Point{}, draw.Src)
+	draw.Draw(b, button, image.NewUniform(color.NRGBA{40, 62, 40, 0xff}), image.Point{}, draw.Src)
+	for _, test := range []struct {
+		name string
+		opts []Option
+		want int
+	}{
+		// the button is darker than 10 cd/m², so it isn't color tested
+		{"default", nil, 0},
+		{"cutoff 10", []Option{WithScotopicCutoff(10)}, 0},
+		{"cutoff 1", []Option{WithScotopicCutoff(1)}, button.Dx() * button.Dy()},
+		{"ramp 1-10", []Option{WithScotopicRamp(1, 10)}, button.Dx() * button.Dy()},
+		// the color factor is scaled down too much for the button
+		{"ramp 1-10000", []Option{WithScotopicRamp(1, 1e4)}, 0},
+	} {
+		_, n, err := NewDefaultPerceptual(test.opts...).Compare(a, b)
+		if err != nil || n != test.want {
+			t.Errorf("%s: n = %d, err = %v; want %d", test.name, n, err, test.want)
+		}
+	}
+	for _, o := range []Option{WithScotopicCutoff(-1), WithScotopicCutoff(math.NaN()), WithScotopicRamp(5, 1)} {
+		if _, _, err := NewDefaultPerceptual(o).Compare(a, b); err == nil {
+			t.Error("invalid scotopic ramp: no error")
+		}
+	}
+}
+
+func TestPyramidLevels(t *testing.T) {
+	a, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, want, err := NewDefaultPerceptual().Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	depths := []int{2, 4, 8, 16}
+	counts := make(map[int]int)
+	for _, levels := range depths {
+		for _, opt := range []Option{WithPyramidLevels(levels), WithLowMemory()} {
+			d := NewDefaultPerceptual(WithPyramidLevels(levels), opt)
+			_, n, err := d.Compare(a, b)
+			if err != nil {
+				t.Fatalf("%d levels: %v", levels, err)
+			}
+			if c, ok := counts[levels]; ok && n != c {
+				t.Errorf("%d levels: n = %d; want %d", levels, n, c)
+			}
+			counts[levels] = n
+		}
+	}
+	if counts[8] != want {
+		t.Errorf("8 levels: n = %d; want default %d", counts[8], want)
+	}
+	// more levels mask more of the differences
+	for i := 1; i < len(depths); i++ {
+		if counts[depths[i]] >= counts[depths[i-1]] {
+			t.Errorf("counts = %v; want fewer with deeper pyramids", counts)
+			break
+		}
+	}
+	for _, levels := range []int{-1, 1, 17} {
+		if _, _, err := NewDefaultPerceptual(WithPyramidLevels(levels)).Compare(a, b); err == nil {
+			t.Errorf("%d levels: no error", levels)
+		}
+	}
+}
+
+// pyramid2D is the reference implementation of pyramid,
+// using the full 2D convolution at even pixels of each level.
+func pyramid2D(m [][]float64, f lapFilter) [][][]float64 {
+	r, k := f.radius(), f.kernel
+	p := make([][][]float64, f.levels)
+	p[0] = m
+	for l := 1; l < f.levels; l++ {
+		src := p[l-1]
+		h, w := len(src), len(src[0])
+		p[l] = make([][]float64, levelSize(h, 1))
+		for y := range p[l] {
+			p[l][y] = make([]float64, levelSize(w, 1))
+			for x := range p[l][y] {
+				for i := -r; i <= r; i++ {
+					for j := -r; j <= r; j++ {
+						p[l][y][x] += k[i+r] * k[j+r] * src[mirror(2*y+j, h)][mirror(2*x+i, w)]
+					}
+				}
+			}
+		}
+	}
+	return p
+}
+
+// convolveRef is convolve computing mirrored indices of every tap.
+func convolveRef(dst, src [][]float64, k []float64) {
+	h, w, r := len(src), len(src[0]), len(k)/2
+	row := make([]float64, w)
+	for y := range dst {
+		for x := range row {
+			row[x] = 0
+		}
+		for j := -r; j <= r; j++ {
+			kj, s := k[j+r], src[mirror(y+j, h)]
+			for x, v := range s {
+				row[x] += kj * v
+			}
+		}
+		dst[y] = make([]float64, w)
+		for x := range dst[y] {
+			var v float64
+			for i := -r; i <= r; i++ {
+				v += k[i+r] * row[mirror(x+i, w)]
+			}
+			dst[y][x] = v
+		}
+	}
+}
+
+func TestConvolve(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	kernels := [][]float64{
+		defaultLapFilter.kernel,
+		{0.25, 0.5, 0.25},
+		{0.1, 0.1, 0.1, 0.4, 0.1, 0.1, 0.1},
+	}
+	for _, k := range kernels {
+		for i := 0; i < 50; i++ {
+			w, h := 1+rnd.Intn(12), 1+rnd.Intn(12)
+			src := make([][]float64, h)
+			src32 := make([][]float32, h)
+			for y := range src {
+				src[y], src32[y] = make([]float64, w), make([]float32, w)
+				for x := range src[y] {
+					src32[y][x] = float32(rnd.Float64() * 100)
+					src[y][x] = float64(src32[y][x])
+				}
+			}
+			want := make([][]float64, h)
+			convolveRef(want, src, k)
+			for _, tile := range []int{0, 1, 2, 3, 5} {
+				c := newConvolution(k, w, h, tile)
+				got := make([][]float64, h)
+				c.convolve(got, src, 0, h, c.newRow())
+				for y := range want {
+					for x := range want[y] {
+						if got[y][x] != want[y][x] {
+							t.Fatalf("%v %dx%d, tile %d: (%d, %d) = %v; want %v",
+								k, w, h, tile, x, y, got[y][x], want[y][x])
+						}
+					}
+				}
+				// reduce computes the same at even pixels
+				rw, rh := levelSize(w, 1), levelSize(h, 1)
+				reduced := make([][]float64, rh)
+				c.reduce(reduced, src, 0, rh, c.newRow())
+				reduced32 := make([][]float32, rh)
+				for y := range reduced32 {
+					reduced32[y] = make([]float32, rw)
+				}
+				c.reduce32(reduced32, src32, 0, rh, c.newRow())
+				for y := range reduced {
+					for x := range reduced[y] {
+						v := want[2*y][2*x]
+						if reduced[y][x] != v || reduced32[y][x] != float32(v) {
+							t.Fatalf("%v %dx%d, tile %d: reduced (%d, %d) = %v, float32 %v; want %v",
+								k, w, h, tile, x, y, reduced[y][x], reduced32[y][x], v)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPyramidSeparable(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	sizes := []image.Point{{3, 3}, {3, 17}, {17, 3}, {64, 48}, {101, 7}}
+	filters := []lapFilter{
+		defaultLapFilter,
+		{levels: 4, kernel: []float64{0.25, 0.5, 0.25}},
+		{levels: 3, kernel: []float64{0.1, 0.1, 0.1, 0.4, 0.1, 0.1, 0.1}},
+	}
+	for _, f := range filters {
+		for _, size := range sizes {
+			m := make([][]float64, size.Y)
+			for y := range m {
+				m[y] = make([]float64, size.X)
+				for x := range m[y] {
+					m[y][x] = rnd.Float64() * 100
+				}
+			}
+			got, want := pyramid(m, f), pyramid2D(m, f)
+			for l := range want {
+				for y := range want[l] {
+					for x := range want[l][y] {
+						if d := math.Abs(got[l][y][x] - want[l][y][x]); d > 1e-12*math.Max(1, math.Abs(want[l][y][x])) {
+							t.Fatalf("%v %v: level %d (%d, %d) = %v; want %v", f.kernel, size, l, x, y, got[l][y][x], want[l][y][x])
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestExpandRow(t *testing.T) {
+	// level 2 of a 10 x 9 image
+	p := [][]float64{
+		{0, 4, 8},
+		{16, 20, 24},
+		{32, 36, 40},
+	}
+	p32 := make([][]float32, len(p))
+	for y := range p {
+		p32[y] = make([]float32, len(p[y]))
+		for x, v := range p[y] {
+			p32[y][x] = float32(v)
+		}
+	}
+	tests := []struct {
+		y, x0 int
+		want  []float64
+	}{
+		{0, 0, []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 8}},
+		{2, 0, []float64{8, 9, 10, 11, 12, 13, 14, 15, 16, 16}},
+		{8, 3, []float64{35, 36, 37}},
+		// past the last row and column
+		{10, 9, []float64{40}},
+	}
+	tmp := make([]float64, 10)
+	for _, test := range tests {
+		got, got32 := make([]float64, len(test.want)), make([]float64, len(test.want))
+		expandRow(got, p, 2, test.y, test.x0, tmp)
+		expandRow32(got32, p32, 2, test.y, test.x0, tmp)
+		for x, v := range test.want {
+			if got[x] != v || got32[x] != v {
+				t.Errorf("y %d: (%d) = %v, float32 %v; want %v", test.y, test.x0+x, got[x], got32[x], v)
+			}
+		}
+	}
+}
+
+func TestPyramidSize(t *testing.T) {
+	for _, size := range []image.Point{{1, 1}, {3, 17}, {3840, 2160}, {30000, 256}} {
+		w, h := size.X, size.Y
+		n, rows := pyramidSize(w, h, defaultLapFilter.levels)
+		// levels are a quarter of the previous one, rounded up
+		if want := 4*w*h/3 + 2*(w+h) + defaultLapFilter.levels; n > want {
+			t.Errorf("%v: %d samples; want <= %d", size, n, want)
+		}
+		if want := 2*h + defaultLapFilter.levels; rows > want {
+			t.Errorf("%v: %d rows; want <= %d", size, rows, want)
+		}
+	}
+}
+
+func TestPyramidParallel(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	m := make([][]float64, 200)
+	for y := range m {
+		m[y] = make([]float64, 150)
+		for x := range m[y] {
+			m[y][x] = rnd.Float64() * 100
+		}
+	}
+	want := pyramidN(m, defaultLapFilter, 1)
+	for _, n := range []int{2, 3, 7, 64} {
+		got := pyramidN(m, defaultLapFilter, n)
+		for l := range want {
+			for y := range want[l] {
+				for x := range want[l][y] {
+					if got[l][y][x] != want[l][y][x] {
+						t.Fatalf("n=%d: level %d (%d, %d) = %v; want %v", n, l, x, y, got[l][y][x], want[l][y][x])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCompareScratchReuse(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r := image.Rect(0, 0, 40, 30)
+	noise := image.NewNRGBA(r)
+	rnd.Read(noise.Pix)
+	black := image.NewNRGBA(r)
+	gray := image.NewGray(r)
+	for i := range gray.Pix {
+		gray.Pix[i] = 0x80
+	}
+	fish1, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fish2, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs := [][2]image.Image{
+		{noise, black},
+		{black, black},
+		{fish1, fish2},
+		{gray, noise},
+		{noise, noise},
+		{gray, black},
+	}
+	// expected counts come from a fresh differ for every pair
+	want := make([]int, len(pairs))
+	for i, p := range pairs {
+		_, n, err := NewDefaultPerceptual().Compare(p[0], p[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[i] = n
+	}
+	d := NewDefaultPerceptual()
+	for round := 0; round < 3; round++ {
+		for i, p := range pairs {
+			_, n, err := d.Compare(p[0], p[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != want[i] {
+				t.Errorf("round %d, pair %d: n = %d; want %d", round, i, n, want[i])
+			}
+		}
+	}
+}
+
+func TestLabLapAllocs(t *testing.T) {
+	const w, h = 32, 16
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	s := newImageScratch(w, h, defaultLapFilter.levels)
+	lut := newGammaLUT(2.2)
+	allocs := testing.AllocsPerRun(10, func() {
+		s.labLap(m, lut, 100, defaultLapFilter.kernel, 1)
+	})
+	// buffers of the first call are reused
+	if allocs != 0 {
+		t.Errorf("labLap: %v allocs; want 0", allocs)
+	}
+}
+
+func TestCompareAllocs(t *testing.T) {
+	const w, h = 64, 64
+	m1 := image.NewNRGBA(image.Rect(0, 0, w, h))
+	m2 := image.NewNRGBA(image.Rect(0, 0, w, h))
+	// not identical, so that Compare doesn't return early
+	m2.Set(0, 0, color.White)
+	d := NewDefaultPerceptual()
+	allocs := testing.AllocsPerRun(5, func() {
+		d.Compare(m1, m2)
+	})
+	// scratch buffers are a few slices, even if they aren't pooled,
+	// nothing is allocated per row or pixel
+	if max := float64(2 * h); allocs > max {
+		t.Errorf("Compare: %v allocs; want <= %v", allocs, max)
+	}
+}
+
 func BenchmarkPCompare(b *testing.B) {
 	m1 := image.NewNRGBA(image.Rect(0, 0, 100, 100))
 	m2 := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	m2.Set(0, 0, color.White)
 	d := NewDefaultPerceptual()
+	b.ReportAllocs()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
 			d.Compare(m1, m2)
@@ -78,6 +1247,87 @@ func BenchmarkPCompare(b *testing.B) {
 	})
 }
 
+// BenchmarkPCompareInto reuses the diff image as well as the differ,
+// so only a few small allocations per Compare are left.
+func BenchmarkPCompareInto(b *testing.B) {
+	r := image.Rect(0, 0, 100, 100)
+	m1, m2 := image.NewNRGBA(r), image.NewNRGBA(r)
+	m2.Set(0, 0, color.White)
+	d := NewDefaultPerceptual()
+	diff := image.NewNRGBA(r)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		d.(IntoDiffer).CompareInto(diff, m1, m2)
+	}
+}
+
+// BenchmarkPCompareCount is BenchmarkPCompare without
+// the difference image.
+func BenchmarkPCompareCount(b *testing.B) {
+	m1 := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	m2 := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	m2.Set(0, 0, color.White)
+	d := NewDefaultPerceptual().(CountDiffer)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			d.CompareCount(m1, m2)
+		}
+	})
+}
+
+func benchmarkPCompare4K(b *testing.B, opts ...Option) {
+	r := image.Rect(0, 0, 3840, 2160)
+	m1, m2 := image.NewNRGBA(r), image.NewNRGBA(r)
+	rnd := rand.New(rand.NewSource(1))
+	rnd.Read(m1.Pix)
+	copy(m2.Pix, m1.Pix)
+	for i := 0; i < len(m2.Pix); i += 997 {
+		m2.Pix[i] ^= 0x40
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// a new differ for each Compare, so that buffers aren't pooled
+		NewDefaultPerceptual(opts...).Compare(m1, m2)
+	}
+}
+
+func BenchmarkPCompare4K(b *testing.B) {
+	benchmarkPCompare4K(b)
+}
+
+func BenchmarkPCompare4KFloat32(b *testing.B) {
+	benchmarkPCompare4K(b, WithFloat32())
+}
+
+func BenchmarkPCompare4KOneWorker(b *testing.B) {
+	benchmarkPCompare4K(b, WithMaxWorkers(1))
+}
+
+func benchmarkPCompareWide(b *testing.B, tile int) {
+	r := image.Rect(0, 0, 30000, 256)
+	m1, m2 := image.NewNRGBA(r), image.NewNRGBA(r)
+	rnd := rand.New(rand.NewSource(1))
+	rnd.Read(m1.Pix)
+	copy(m2.Pix, m1.Pix)
+	m2.Pix[0]++
+	d := NewDefaultPerceptual(WithTiling(tile))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Compare(m1, m2)
+	}
+}
+
+func BenchmarkPCompareWide(b *testing.B) {
+	benchmarkPCompareWide(b, 0)
+}
+
+func BenchmarkPCompareWideUntiled(b *testing.B) {
+	benchmarkPCompareWide(b, -1)
+}
+
 func BenchmarkPyramid(b *testing.B) {
 	m := make([][]float64, 100)
 	for i := 0; i < len(m); i++ {
@@ -85,7 +1335,44 @@ func BenchmarkPyramid(b *testing.B) {
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		pyramid(m)
+		pyramid(m, defaultLapFilter)
+	}
+}
+
+func BenchmarkPyramidLarge(b *testing.B) {
+	m := make([][]float64, 2000)
+	for i := 0; i < len(m); i++ {
+		m[i] = make([]float64, 2000)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pyramid(m, defaultLapFilter)
+	}
+}
+
+// TestLabCbrt checks lab against its definition with math.Pow,
+// which it used to call for cube roots.
+func TestLabCbrt(t *testing.T) {
+	powLab := func(x, y, z float64) (l, a, b float64) {
+		w := defaultColorSpace.white
+		r := [3]float64{x / w[0], y / w[1], z / w[2]}
+		var f [3]float64
+		for i := range r {
+			f[i] = (kappa*r[i] + 16.0) / 116.0
+			if r[i] > epsilon {
+				f[i] = math.Pow(r[i], 1.0/3.0)
+			}
+		}
+		return 116.0*f[1] - 16.0, 500.0 * (f[0] - f[1]), 200.0 * (f[1] - f[2])
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		x, y, z := linearXYZ(rnd.Float64(), rnd.Float64(), rnd.Float64())
+		l, a, b := lab(x, y, z)
+		wl, wa, wb := powLab(x, y, z)
+		if math.Abs(l-wl) > 1e-9 || math.Abs(a-wa) > 1e-9 || math.Abs(b-wb) > 1e-9 {
+			t.Fatalf("lab(%v, %v, %v) = %v, %v, %v; want %v, %v, %v", x, y, z, l, a, b, wl, wa, wb)
+		}
 	}
 }
 
@@ -101,6 +1388,13 @@ func BenchmarkXYZ(b *testing.B) {
 	}
 }
 
+func BenchmarkXYZLUT(b *testing.B) {
+	lut := newGammaLUT(2.2)
+	for i := 0; i < b.N; i++ {
+		linearXYZ(lut.at(10*0x101), lut.at(20*0x101), lut.at(30*0x101))
+	}
+}
+
 func BenchmarkCSF(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		csf(1.5, 100.0)
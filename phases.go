@@ -0,0 +1,189 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math/rand"
+	"runtime/pprof"
+	"time"
+)
+
+// PhaseTimings holds wall times of the phases of a comparison,
+// see Result. Phases an algorithm doesn't have are zero.
+//
+// While running, each phase is also labeled for pprof with "algorithm",
+// "phase" and "size" labels, the latter being a rough bucket of image
+// size in megapixels, so that CPU profiles of programs comparing
+// different kinds of images can be broken down by these.
+type PhaseTimings struct {
+	// Convert is conversion of pixels to luminance and LAB colors.
+	Convert time.Duration
+	// Pyramid is building the Laplacian pyramids.
+	Pyramid time.Duration
+	// Compare is the per-pixel loop writing the difference image.
+	Compare time.Duration
+	// Bounds is finding Result.DiffBounds.
+	Bounds time.Duration
+	// Total is the wall time of the whole comparison,
+	// including work which isn't part of any phase.
+	Total time.Duration
+}
+
+// String returns timings of all phases and the total on a single line.
+func (t PhaseTimings) String() string {
+	return fmt.Sprintf("convert %v, pyramid %v, compare %v, bounds %v, total %v",
+		t.Convert, t.Pyramid, t.Compare, t.Bounds, t.Total)
+}
+
+// PixelsPerSecond returns the throughput of comparing w x h images
+// in t.Total, or 0 if t.Total is 0.
+func (t PhaseTimings) PixelsPerSecond(w, h int) float64 {
+	if t.Total <= 0 {
+		return 0
+	}
+	return float64(w) * float64(h) / t.Total.Seconds()
+}
+
+// Benchmark compares a pair of w x h images with d iterations times
+// and returns the average timings of a comparison, so that the time
+// comparing images of that size takes on the current machine can be
+// estimated. The images are random noise, one tenth of the pixels of
+// the second one are changed, so that no phase is skipped. The Compare
+// phase includes writing the difference image.
+//
+// It returns zero timings if d fails to compare the images,
+// e.g. if they have more than MaxPixels pixels.
+func Benchmark(d Differ, w, h int, iterations int) PhaseTimings {
+	if iterations < 1 {
+		iterations = 1
+	}
+	rnd := rand.New(rand.NewSource(1))
+	a := image.NewNRGBA(image.Rect(0, 0, w, h))
+	rnd.Read(a.Pix)
+	b := image.NewNRGBA(a.Rect)
+	copy(b.Pix, a.Pix)
+	for i := 0; i < len(b.Pix); i += 4 {
+		if rnd.Intn(10) == 0 {
+			b.Pix[i] ^= 0xff
+		}
+		// opaque, like most images compared
+		a.Pix[i+3], b.Pix[i+3] = 0xff, 0xff
+	}
+	var sum PhaseTimings
+	for i := 0; i < iterations; i++ {
+		res, err := CompareResult(d, a, b)
+		if err != nil {
+			return PhaseTimings{}
+		}
+		t := res.Timings
+		sum.Convert += t.Convert
+		sum.Pyramid += t.Pyramid
+		sum.Compare += t.Compare
+		sum.Bounds += t.Bounds
+		sum.Total += t.Total
+	}
+	n := time.Duration(iterations)
+	return PhaseTimings{
+		Convert: sum.Convert / n,
+		Pyramid: sum.Pyramid / n,
+		Compare: sum.Compare / n,
+		Bounds:  sum.Bounds / n,
+		Total:   sum.Total / n,
+	}
+}
+
+// timedDiffer is implemented by Differs which time their phases.
+type timedDiffer interface {
+	// compareTimed is Compare adding phase timings to t.
+	compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error)
+}
+
+// phases labels and times the phases of a single comparison.
+type phases struct {
+	labels pprof.LabelSet
+	t      *PhaseTimings
+}
+
+func newPhases(algorithm string, r image.Rectangle, t *PhaseTimings) phases {
+	return phases{pprof.Labels("algorithm", algorithm, "size", sizeBucket(r)), t}
+}
+
+// run calls f with the phase label set to name
+// and adds the time it took to *dst, one of the fields of p.t.
+func (p phases) run(name string, dst *time.Duration, f func()) {
+	start := time.Now()
+	ctx := pprof.WithLabels(context.Background(), p.labels)
+	pprof.Do(ctx, pprof.Labels("phase", name), func(context.Context) {
+		f()
+	})
+	*dst += time.Since(start)
+}
+
+// sizeBucket returns the "size" label of images of size r.
+func sizeBucket(r image.Rectangle) string {
+	switch n := r.Dx() * r.Dy(); {
+	case n < 1e6:
+		return "<1MP"
+	case n < 10e6:
+		return "1-10MP"
+	case n < 100e6:
+		return "10-100MP"
+	}
+	return ">=100MP"
+}
+
+// algorithmName returns the "algorithm" label of d.
+func algorithmName(d Differ) string {
+	switch d := d.(type) {
+	case *binary:
+		return "binary"
+	case *perceptual:
+		return "perceptual"
+	case *ssim:
+		return "ssim"
+	case *msssim:
+		return "msssim"
+	case *mse:
+		return "mse"
+	case *hashDiffer:
+		return d.name
+	case *edge:
+		return "edge"
+	case *gmsd:
+		return "gmsd"
+	case *histogram:
+		return "histogram"
+	case *pixelmatch:
+		return "pixelmatch"
+	case *labDiffer:
+		return d.name
+	case *composite:
+		return "composite"
+	case *downsampled:
+		return algorithmName(d.inner)
+	case *blurred:
+		return algorithmName(d.inner)
+	case *normalized:
+		return algorithmName(d.inner)
+	case *aligned:
+		return algorithmName(d.inner)
+	case *grid:
+		return algorithmName(d.inner)
+	}
+	return "other"
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+)
+
+// NewPHash creates a new Differ comparing DCT-based perceptual hashes
+// of images, of hashSize x hashSize bits, up to 8 x 8, see PHash.
+// Unlike the other algorithms, it doesn't count different pixels.
+// Compare returns the Hamming distance of the hashes instead, or 0 if
+// it is at most maxDistance, so that images which look alike pass.
+//
+// The difference image has a cell for each bit of the hashes,
+// scaled to the size of the images. Cells of bits which differ are
+// red, and all of them are black if the distance is at most maxDistance.
+//
+// Compare returns an error if hashSize is not between 1 and 8.
+func NewPHash(hashSize, maxDistance int, opts ...Option) Differ {
+	d := newHashDiffer("phash", hashSize, func(m image.Image) []byte {
+		return hashBytes(pHash(m, hashSize), hashSize*hashSize)
+	}, maxDistance, opts)
+	if hashSize < 1 || hashSize > 8 {
+		d.err = fmt.Errorf("imgdiff: invalid pHash size %d", hashSize)
+	}
+	return d
+}
+
+// PHash returns the 64-bit DCT-based perceptual hash of m, so that
+// callers can cache hashes of images and compare them later with
+// HashDistance. Similar looking images have hashes which differ
+// in few bits.
+//
+// The luminance of m is downsized to 32 x 32 pixels, regardless of its
+// aspect ratio, and bits are set for its lowest 8 x 8 DCT frequencies,
+// but the zero ones, above their median, as described by Zauner in
+// "Implementation and benchmarking of perceptual image hash functions",
+// 2010.
+func PHash(m image.Image) uint64 {
+	return pHash(m, 8)
+}
+
+// pHash returns the size x size bit perceptual hash of m, see PHash.
+// Bit v*size+u is set for the frequency u+1 horizontally and v+1
+// vertically.
+func pHash(m image.Image, size int) uint64 {
+	n := 4 * size
+	f := downsizeLuma(m, n, n)
+	// 2D DCT-II of the lowest size x size frequencies but 0, which
+	// only depends on mean luminance, rows first, then columns
+	cos := make([]float64, size*n)
+	for u := 0; u < size; u++ {
+		for x := 0; x < n; x++ {
+			cos[u*n+x] = math.Cos(float64((2*x+1)*(u+1)) * math.Pi / float64(2*n))
+		}
+	}
+	rows := make([]float64, n*size)
+	for y := 0; y < n; y++ {
+		for u := 0; u < size; u++ {
+			var s float64
+			for x := 0; x < n; x++ {
+				s += f[y*n+x] * cos[u*n+x]
+			}
+			rows[y*size+u] = s
+		}
+	}
+	dct := make([]float64, size*size)
+	for v := 0; v < size; v++ {
+		for u := 0; u < size; u++ {
+			var s float64
+			for y := 0; y < n; y++ {
+				s += rows[y*size+u] * cos[v*n+y]
+			}
+			dct[v*size+u] = s
+		}
+	}
+
+	median := median(dct)
+	var h uint64
+	for i, v := range dct {
+		if v > median {
+			h |= 1 << uint(i)
+		}
+	}
+	return h
+}
+
+// median returns the median of v, the mean of the middle two values
+// if len(v) is even.
+func median(v []float64) float64 {
+	sorted := append([]float64(nil), v...)
+	sort.Float64s(sorted)
+	m := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		m = (m + sorted[len(sorted)/2-1]) / 2
+	}
+	return m
+}
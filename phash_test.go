@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/draw"
+	"math/bits"
+	"testing"
+)
+
+func TestPHash(t *testing.T) {
+	fish1, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fish2, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := image.NewNRGBA(fish1.Bounds())
+	draw.Draw(cp, cp.Rect, fish1, fish1.Bounds().Min, draw.Src)
+
+	if h1, h2 := PHash(fish1), PHash(cp); h1 != h2 {
+		t.Errorf("PHash of a copy = %016x; want %016x", h2, h1)
+	}
+	dist := bits.OnesCount64(PHash(fish1) ^ PHash(fish2))
+	if dist == 0 || dist > 10 {
+		t.Errorf("fish distance = %d; want small, nonzero", dist)
+	}
+	vase, err := readTestImage("aqsis_vase.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dist := bits.OnesCount64(PHash(fish1) ^ PHash(vase)); dist < 20 {
+		t.Errorf("fish and vase distance = %d; want large", dist)
+	}
+	if h := PHash(fish1); bits.OnesCount64(h) < 24 || bits.OnesCount64(h) > 40 {
+		t.Errorf("PHash = %016x; want about half of the bits set", h)
+	}
+
+	d := NewPHash(8, 0)
+	if _, n, err := d.Compare(fish1, cp); err != nil || n != 0 {
+		t.Errorf("Compare(copy): n = %d, err = %v; want 0", n, err)
+	}
+	diff, n, err := d.Compare(fish1, fish2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != dist {
+		t.Errorf("Compare: n = %d; want %d", n, dist)
+	}
+	// every differing bit is a red cell with a corner at the top left
+	// of its share of the image
+	r := diff.Bounds()
+	red := 0
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			x, y := (u*r.Dx()+7)/8, (v*r.Dy()+7)/8
+			if _, g, _, _ := diff.At(x, y).RGBA(); g == 0 && marked(diff.At(x, y)) {
+				red++
+			}
+		}
+	}
+	if red != dist {
+		t.Errorf("%d red cells; want %d", red, dist)
+	}
+	if _, n, err := NewPHash(8, dist).Compare(fish1, fish2); err != nil || n != 0 {
+		t.Errorf("Compare with maxDistance %d: n = %d, err = %v; want 0", dist, n, err)
+	}
+}
+
+func TestPHashSizes(t *testing.T) {
+	a := image.NewGray(image.Rect(0, 0, 3, 2))
+	b := image.NewGray(a.Rect)
+	b.Pix[0] = 0xff
+	for size := 1; size <= 8; size++ {
+		if _, _, err := NewPHash(size, 0).Compare(a, b); err != nil {
+			t.Errorf("size %d: %v", size, err)
+		}
+	}
+	for _, size := range []int{-1, 0, 9} {
+		if _, _, err := NewPHash(size, 0).Compare(a, b); err == nil {
+			t.Errorf("size %d: no error", size)
+		}
+	}
+}
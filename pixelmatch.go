@@ -0,0 +1,267 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import "image"
+
+// DefaultPixelmatchThreshold is the pixelmatch threshold
+// recommended by its authors, see NewPixelmatch.
+const DefaultPixelmatchThreshold = 0.1
+
+// NRGBA bytes of anti-aliased pixels in pixelmatch diff images,
+// and binary ones with WithAntiAliasing.
+var aaPixel = [4]uint8{0xff, 0xff, 0, 0xff}
+
+type pixelmatch struct {
+	// max squared YIQ distance of equal pixels
+	maxDelta  float64
+	includeAA bool
+	opts      options
+}
+
+// NewPixelmatch creates a new Differ modeled on the pixelmatch library
+// by Mapbox. Pixels are compared by distance of their YIQ colors,
+// blended over white, weighted as described by Kotsarenko and Ramos in
+// "Measuring perceived color difference using YIQ NTSC transmission color
+// space in mobile applications", 2010. threshold is between 0 and 1,
+// the larger the more tolerant. See DefaultPixelmatchThreshold.
+//
+// Pixels which differ only because of anti-aliasing, such as along
+// edges of text rendered on different machines, are detected from their
+// neighbors. Unless includeAA is true, they are not counted as
+// different, but drawn yellow in the difference image. Note that
+// DiffMask and Result.DiffBounds still include them.
+func NewPixelmatch(threshold float64, includeAA bool, opts ...Option) Differ {
+	return &pixelmatch{
+		// 35215 is the max squared YIQ distance of 8-bit colors
+		maxDelta:  35215 * threshold * threshold,
+		includeAA: includeAA,
+		opts:      newOptions(opts),
+	}
+}
+
+// Compare compares a and b using pixelmatch algorithm.
+func (d *pixelmatch) Compare(a, b image.Image) (image.Image, int, error) {
+	return d.compareTimed(a, b, new(PhaseTimings))
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *pixelmatch) CompareInto(dst *image.NRGBA, a, b image.Image) (int, error) {
+	return d.compareInto(dst, a, b, new(PhaseTimings))
+}
+
+func (d *pixelmatch) compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error) {
+	diff := new(image.NRGBA)
+	n, err := d.compareInto(diff, a, b, t)
+	if err != nil {
+		return nil, -1, err
+	}
+	return diff, n, nil
+}
+
+func (d *pixelmatch) compareInto(diff *image.NRGBA, a, b image.Image, t *PhaseTimings) (int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return -1, ErrSize
+	}
+	if err := d.opts.checkSize(ab); err != nil {
+		return -1, err
+	}
+	resize(diff, w, h)
+	if sameImage(a, b) {
+		fillPass(diff)
+		return 0, nil
+	}
+
+	p := newPhases("pixelmatch", ab, t)
+	var pa, pb pixelPlane
+	p.run("convert", &t.Convert, func() {
+		parallel(d.opts.workers(), func(int) {
+			pa = newPixelPlane(a)
+		}, func(int) {
+			pb = newPixelPlane(b)
+		})
+	})
+	var npix int
+	p.run("compare", &t.Compare, func() {
+		npix = forBands(d.opts.workers(), h, func(y0, y1 int) int {
+			return d.compareRows(diff, pa, pb, y0, y1)
+		})
+	})
+	return npix, nil
+}
+
+// compareRows compares rows [y0, y1) of a and b, writing them to diff,
+// and returns the number of different pixels.
+func (d *pixelmatch) compareRows(diff *image.NRGBA, a, b pixelPlane, y0, y1 int) int {
+	npix := 0
+	for y := y0; y < y1; y++ {
+		out := diff.Pix[diff.PixOffset(0, y):]
+		for x := 0; x < a.w; x++ {
+			c := passPixel
+			if yiqDelta(a.at(x, y), b.at(x, y)) > d.maxDelta {
+				if !d.includeAA && (a.antialiased(b, x, y) || b.antialiased(a, x, y)) {
+					c = aaPixel
+				} else {
+					c = failPixel
+					npix++
+				}
+			}
+			copy(out[4*x:], c[:])
+		}
+	}
+	return npix
+}
+
+// pixelPlane holds alpha-premultiplied pixels of an image, y*w+x indexed.
+type pixelPlane struct {
+	pix  []pixel
+	w, h int
+}
+
+func newPixelPlane(m image.Image) pixelPlane {
+	b := m.Bounds()
+	p := pixelPlane{pix: make([]pixel, b.Dx()*b.Dy()), w: b.Dx(), h: b.Dy()}
+	for y := 0; y < p.h; y++ {
+		readRow(p.pix[y*p.w:(y+1)*p.w], m, b.Min.X, b.Min.Y+y)
+	}
+	return p
+}
+
+func (p pixelPlane) at(x, y int) pixel {
+	return p.pix[y*p.w+x]
+}
+
+// antialiased reports whether pixel x, y of p, which differs from
+// the same pixel of q, is likely anti-aliased. That is the case if
+// at most 2 of its 8 neighbors, counting those outside p as one, have
+// the same brightness, it has both darker and brighter neighbors, and
+// the darkest or the brightest one lies in a flat area of both p and q,
+// see hasManySiblings. The heuristic is described by Vysniauskas in
+// "Anti-aliased pixel and intensity slope detector", 2009.
+func (p pixelPlane) antialiased(q pixelPlane, x, y int) bool {
+	x0, y0, x1, y1 := neighborhood(x, y, p.w, p.h)
+	zeroes := 0
+	if x == x0 || x == x1 || y == y0 || y == y1 {
+		zeroes = 1
+	}
+	c := p.at(x, y)
+	var min, max float64
+	var minX, minY, maxX, maxY int
+	for ny := y0; ny <= y1; ny++ {
+		for nx := x0; nx <= x1; nx++ {
+			if nx == x && ny == y {
+				continue
+			}
+			delta := yDelta(c, p.at(nx, ny))
+			switch {
+			case delta == 0:
+				zeroes++
+				if zeroes > 2 {
+					return false
+				}
+			case delta < min:
+				min, minX, minY = delta, nx, ny
+			case delta > max:
+				max, maxX, maxY = delta, nx, ny
+			}
+		}
+	}
+	if min == 0 || max == 0 {
+		return false
+	}
+	return p.hasManySiblings(minX, minY) && q.hasManySiblings(minX, minY) ||
+		p.hasManySiblings(maxX, maxY) && q.hasManySiblings(maxX, maxY)
+}
+
+// hasManySiblings reports whether more than 2 pixels of the 3x3
+// neighborhood of pixel x, y of p are equal to it, counting those
+// outside p as one.
+func (p pixelPlane) hasManySiblings(x, y int) bool {
+	x0, y0, x1, y1 := neighborhood(x, y, p.w, p.h)
+	zeroes := 0
+	if x == x0 || x == x1 || y == y0 || y == y1 {
+		zeroes = 1
+	}
+	c := p.at(x, y)
+	for ny := y0; ny <= y1; ny++ {
+		for nx := x0; nx <= x1; nx++ {
+			if nx == x && ny == y {
+				continue
+			}
+			if p.at(nx, ny) == c {
+				zeroes++
+			}
+			if zeroes > 2 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// neighborhood returns the bounds, inclusive, of the 3x3 neighborhood
+// of pixel x, y clipped to a w x h image.
+func neighborhood(x, y, w, h int) (x0, y0, x1, y1 int) {
+	x0, y0, x1, y1 = x-1, y-1, x+1, y+1
+	if x0 < 0 {
+		x0 = 0
+	}
+	if y0 < 0 {
+		y0 = 0
+	}
+	if x1 > w-1 {
+		x1 = w - 1
+	}
+	if y1 > h-1 {
+		y1 = h - 1
+	}
+	return x0, y0, x1, y1
+}
+
+// blendWhite returns the RGB components of p blended over white,
+// scaled to [0, 255].
+func blendWhite(p pixel) (r, g, b float64) {
+	bg := float64(0xffff - p[3])
+	return (float64(p[0]) + bg) / 0x101, (float64(p[1]) + bg) / 0x101, (float64(p[2]) + bg) / 0x101
+}
+
+// yiqDelta returns the weighted squared YIQ distance of p1 and p2.
+func yiqDelta(p1, p2 pixel) float64 {
+	if p1 == p2 {
+		return 0
+	}
+	r1, g1, b1 := blendWhite(p1)
+	r2, g2, b2 := blendWhite(p2)
+	y := rgb2y(r1, g1, b1) - rgb2y(r2, g2, b2)
+	i := rgb2i(r1, g1, b1) - rgb2i(r2, g2, b2)
+	q := rgb2q(r1, g1, b1) - rgb2q(r2, g2, b2)
+	return 0.5053*y*y + 0.299*i*i + 0.1957*q*q
+}
+
+// yDelta returns the difference of Y components of p1 and p2.
+func yDelta(p1, p2 pixel) float64 {
+	if p1 == p2 {
+		return 0
+	}
+	r1, g1, b1 := blendWhite(p1)
+	r2, g2, b2 := blendWhite(p2)
+	return rgb2y(r1, g1, b1) - rgb2y(r2, g2, b2)
+}
+
+func rgb2y(r, g, b float64) float64 { return r*0.29889531 + g*0.58662247 + b*0.11448223 }
+func rgb2i(r, g, b float64) float64 { return r*0.59597799 - g*0.27417610 - b*0.32180189 }
+func rgb2q(r, g, b float64) float64 { return r*0.21147017 - g*0.52261711 + b*0.31114694 }
@@ -0,0 +1,97 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestPixelmatch(t *testing.T) {
+	// a black and white edge at x = 5, anti-aliased in b
+	r := image.Rect(0, 0, 10, 8)
+	a := image.NewRGBA(r)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			c := color.RGBA{0, 0, 0, 0xff}
+			if x >= 5 {
+				c = color.RGBA{0xff, 0xff, 0xff, 0xff}
+			}
+			a.SetRGBA(x, y, c)
+		}
+	}
+	b := image.NewRGBA(r)
+	copy(b.Pix, a.Pix)
+	for y := 0; y < r.Dy(); y++ {
+		b.SetRGBA(5, y, color.RGBA{0x80, 0x80, 0x80, 0xff})
+	}
+	// a real difference in the white area
+	b.SetRGBA(8, 3, color.RGBA{0, 0, 0, 0xff})
+	// a barely visible one
+	b.SetRGBA(8, 6, color.RGBA{0xfe, 0xff, 0xff, 0xff})
+
+	tests := []struct {
+		includeAA bool
+		n         int
+		aa        color.NRGBA
+	}{
+		{false, 1, color.NRGBA{0xff, 0xff, 0, 0xff}},
+		{true, 1 + r.Dy(), color.NRGBA{0xff, 0, 0, 0xff}},
+	}
+	for i, test := range tests {
+		diff, n, err := NewPixelmatch(DefaultPixelmatchThreshold, test.includeAA).Compare(a, b)
+		if err != nil {
+			t.Fatalf("(%d) %v", i, err)
+		}
+		if n != test.n {
+			t.Errorf("(%d) n = %d; want %d", i, n, test.n)
+		}
+		m := diff.(*image.NRGBA)
+		for y := 0; y < r.Dy(); y++ {
+			if c := m.NRGBAAt(5, y); c != test.aa {
+				t.Errorf("(%d) diff at 5, %d = %v; want %v", i, y, c, test.aa)
+			}
+		}
+		if c := m.NRGBAAt(8, 3); c != (color.NRGBA{0xff, 0, 0, 0xff}) {
+			t.Errorf("(%d) diff at 8, 3 = %v; want red", i, c)
+		}
+		if c := m.NRGBAAt(8, 6); c != (color.NRGBA{0, 0, 0, 0xff}) {
+			t.Errorf("(%d) diff at 8, 6 = %v; want black", i, c)
+		}
+	}
+
+	// any difference fails with threshold 0
+	if _, n, err := NewPixelmatch(0, true).Compare(a, b); err != nil || n != 2+r.Dy() {
+		t.Errorf("threshold 0: n = %d, err = %v; want %d", n, err, 2+r.Dy())
+	}
+	if _, _, err := NewPixelmatch(0.1, false).Compare(a, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != ErrSize {
+		t.Errorf("err = %v; want ErrSize", err)
+	}
+}
+
+func TestYIQDelta(t *testing.T) {
+	black := pixel{0, 0, 0, 0xffff}
+	white := pixel{0xffff, 0xffff, 0xffff, 0xffff}
+	// only Y differs
+	if d, want := yiqDelta(black, white), 0.5053*255*255; math.Abs(d-want) > 1 {
+		t.Errorf("yiqDelta(black, white) = %v; want about %v", d, want)
+	}
+	// transparent pixels are blended over white
+	if d := yiqDelta(pixel{}, white); d != 0 {
+		t.Errorf("yiqDelta(transparent, white) = %v; want 0", d)
+	}
+}
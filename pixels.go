@@ -0,0 +1,244 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bytes"
+	"image"
+	"reflect"
+)
+
+// pixel holds 16-bit alpha-premultiplied R, G, B, A samples,
+// as returned by color.Color.RGBA.
+type pixel [4]uint32
+
+// readRow reads len(dst) pixels of m starting at (x0, y).
+// Pix of common image types is read directly, avoiding an allocation
+// and dynamic dispatch per pixel of m.At. Either way the result is the same.
+func readRow(dst []pixel, m image.Image, x0, y int) {
+	switch m := m.(type) {
+	case *image.NRGBA:
+		pix := m.Pix[m.PixOffset(x0, y):]
+		for x := range dst {
+			dst[x] = nrgbaPixel(pix[4*x : 4*x+4 : 4*x+4])
+		}
+	case *image.RGBA:
+		pix := m.Pix[m.PixOffset(x0, y):]
+		for x := range dst {
+			s := pix[4*x : 4*x+4 : 4*x+4]
+			dst[x] = pixel{uint32(s[0]) * 0x101, uint32(s[1]) * 0x101, uint32(s[2]) * 0x101, uint32(s[3]) * 0x101}
+		}
+	case *image.Gray:
+		pix := m.Pix[m.PixOffset(x0, y):]
+		for x := range dst {
+			v := uint32(pix[x]) * 0x101
+			dst[x] = pixel{v, v, v, 0xffff}
+		}
+	case *image.RGBA64:
+		pix := m.Pix[m.PixOffset(x0, y):]
+		for x := range dst {
+			s := pix[8*x : 8*x+8 : 8*x+8]
+			dst[x] = pixel{
+				uint32(s[0])<<8 | uint32(s[1]),
+				uint32(s[2])<<8 | uint32(s[3]),
+				uint32(s[4])<<8 | uint32(s[5]),
+				uint32(s[6])<<8 | uint32(s[7]),
+			}
+		}
+	case *image.Gray16:
+		pix := m.Pix[m.PixOffset(x0, y):]
+		for x := range dst {
+			v := uint32(pix[2*x])<<8 | uint32(pix[2*x+1])
+			dst[x] = pixel{v, v, v, 0xffff}
+		}
+	case *linearImage:
+		readRow(dst, m.Image, x0, y)
+		for x := range dst {
+			m.linearize(&dst[x])
+		}
+	default:
+		for x := range dst {
+			r, g, b, a := m.At(x0+x, y).RGBA()
+			dst[x] = pixel{r, g, b, a}
+		}
+	}
+}
+
+// nrgbaPixel returns the pixel of NRGBA samples s,
+// the same as color.NRGBA.RGBA.
+func nrgbaPixel(s []uint8) pixel {
+	a := uint32(s[3])
+	r := uint32(s[0]) * 0x101 * a / 0xff
+	g := uint32(s[1]) * 0x101 * a / 0xff
+	b := uint32(s[2]) * 0x101 * a / 0xff
+	return pixel{r, g, b, a * 0x101}
+}
+
+// nrgba64Pixel returns the pixel of NRGBA64 samples s,
+// the same as color.NRGBA64.RGBA.
+func nrgba64Pixel(s []uint8) pixel {
+	a := uint32(s[6])<<8 | uint32(s[7])
+	r := (uint32(s[0])<<8 | uint32(s[1])) * a / 0xffff
+	g := (uint32(s[2])<<8 | uint32(s[3])) * a / 0xffff
+	b := (uint32(s[4])<<8 | uint32(s[5])) * a / 0xffff
+	return pixel{r, g, b, a}
+}
+
+// NRGBA bytes of pixels in diff images produced by the Differs.
+var (
+	passPixel = [4]uint8{0, 0, 0, 0xff}
+	failPixel = [4]uint8{0xff, 0, 0, 0xff}
+	// passPixel of WithHeatmap
+	clearPixel = [4]uint8{}
+)
+
+// isMarked reports whether NRGBA pixel p of a diff image marks
+// a difference, that is it is neither passPixel nor clearPixel.
+func isMarked(p []uint8) bool {
+	return (p[0]|p[1]|p[2] != 0 || p[3] != 0xff) && p[0]|p[1]|p[2]|p[3] != 0
+}
+
+// paintDeltas replaces failPixel pixels of diff within the zero-based
+// rectangle r, the result of comparing a and b, with the differences
+// of their colors, see WithDeltaColors.
+func paintDeltas(diff *image.NRGBA, a, b image.Image, r image.Rectangle) {
+	ab, bb := a.Bounds(), b.Bounds()
+	arow, brow := make([]pixel, r.Dx()), make([]pixel, r.Dx())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		readRow(arow, a, ab.Min.X+r.Min.X, ab.Min.Y+y)
+		readRow(brow, b, bb.Min.X+r.Min.X, bb.Min.Y+y)
+		out := diff.Pix[diff.PixOffset(r.Min.X, y):]
+		for x := range arow {
+			p := out[4*x : 4*x+4]
+			if !isFailPixel(p) {
+				continue
+			}
+			var c [4]uint8
+			for i := range c {
+				d := arow[x][i] - brow[x][i]
+				if arow[x][i] < brow[x][i] {
+					d = brow[x][i] - arow[x][i]
+				}
+				c[i] = uint8(d >> 8)
+				if d > 0 && c[i] == 0 {
+					// differences of 16-bit samples show
+					c[i] = 1
+				}
+			}
+			c[3] = 0xff - c[3]
+			if c == passPixel || c == clearPixel || c == tolerPixel || c == aaPixel {
+				continue
+			}
+			copy(p, c[:])
+		}
+	}
+}
+
+// fillPass sets all pixels of m to passPixel.
+func fillPass(m *image.NRGBA) {
+	r := m.Rect
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := m.Pix[m.PixOffset(r.Min.X, y):m.PixOffset(r.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			copy(row[i:], passPixel[:])
+		}
+	}
+}
+
+// resize makes m a zero-based w x h image. Its pixels are kept if
+// it has these bounds already, and otherwise reused if Pix is large
+// enough. Values of the pixels are undefined.
+func resize(m *image.NRGBA, w, h int) {
+	r := image.Rect(0, 0, w, h)
+	if m.Rect == r && (h == 0 || m.Stride >= 4*w && len(m.Pix) >= (h-1)*m.Stride+4*w) {
+		return
+	}
+	m.Rect, m.Stride = r, 4*w
+	if n := 4 * w * h; cap(m.Pix) >= n {
+		m.Pix = m.Pix[:n]
+	} else {
+		m.Pix = make([]uint8, n)
+	}
+}
+
+// rowImage returns a w x h image whose rows all share the same pixels,
+// so that differences can be written to it by compare, which is
+// sequential, and counted without being kept.
+func rowImage(w, h int) *image.NRGBA {
+	return &image.NRGBA{Pix: make([]uint8, 4*w), Rect: image.Rect(0, 0, w, h)}
+}
+
+// sameImage reports whether a and b, which must be of the same size,
+// are the same image value or images of the same standard type with
+// identical pixels, so that comparing them would find no differences.
+func sameImage(a, b image.Image) bool {
+	ta := reflect.TypeOf(a)
+	if ta != reflect.TypeOf(b) {
+		return false
+	}
+	if ta.Comparable() && a == b {
+		return true
+	}
+	pa, sa, bpp := pixLayout(a)
+	pb, sb, _ := pixLayout(b)
+	if pa == nil || pb == nil {
+		return false
+	}
+	n, h := a.Bounds().Dx()*bpp, a.Bounds().Dy()
+	if h == 0 || n == 0 || sa == sb && &pa[0] == &pb[0] {
+		return true
+	}
+	if sa == n && sb == n {
+		// a single bytes.Equal of contiguous pixels
+		return bytes.Equal(pa[:h*n], pb[:h*n])
+	}
+	for y := 0; y < h; y++ {
+		if !bytes.Equal(pa[y*sa:y*sa+n], pb[y*sb:y*sb+n]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isGray reports whether m is of a standard grayscale type,
+// whose pixels are opaque and have equal red, green and blue.
+func isGray(m image.Image) bool {
+	switch m.(type) {
+	case *image.Gray, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// pixLayout returns Pix of m starting at its top-left pixel, the stride
+// and the number of bytes per pixel, if m is of a standard type whose
+// colors only depend on Pix. Otherwise pix is nil.
+func pixLayout(m image.Image) (pix []uint8, stride, bpp int) {
+	switch m := m.(type) {
+	case *image.NRGBA:
+		return m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], m.Stride, 4
+	case *image.RGBA:
+		return m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], m.Stride, 4
+	case *image.Gray:
+		return m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], m.Stride, 1
+	case *image.Gray16:
+		return m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], m.Stride, 2
+	case *image.NRGBA64:
+		return m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], m.Stride, 8
+	case *image.RGBA64:
+		return m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], m.Stride, 8
+	}
+	return nil, 0, 0
+}
@@ -0,0 +1,225 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+)
+
+// generic hides the concrete type of an image,
+// so that readRow falls back to At.
+type generic struct {
+	image.Image
+}
+
+func randomImages(r image.Rectangle, rnd *rand.Rand) []image.Image {
+	nrgba := image.NewNRGBA(r)
+	rnd.Read(nrgba.Pix)
+	rgba := image.NewRGBA(r)
+	rnd.Read(rgba.Pix)
+	// keep rgba valid premultiplied colors
+	for i := 0; i < len(rgba.Pix); i += 4 {
+		for j := 0; j < 3; j++ {
+			if rgba.Pix[i+j] > rgba.Pix[i+3] {
+				rgba.Pix[i+j] = rgba.Pix[i+3]
+			}
+		}
+	}
+	gray := image.NewGray(r)
+	rnd.Read(gray.Pix)
+	gray16 := image.NewGray16(r)
+	rnd.Read(gray16.Pix)
+	rgba64 := image.NewRGBA64(r)
+	rnd.Read(rgba64.Pix)
+	nrgba64 := image.NewNRGBA64(r)
+	rnd.Read(nrgba64.Pix)
+	return []image.Image{nrgba, rgba, gray, gray16, rgba64, nrgba64}
+}
+
+func TestReadRow(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r := image.Rect(-3, 5, 20, 17)
+	sub := image.Rect(2, 7, 11, 16)
+	for _, m := range randomImages(r, rnd) {
+		ims := []image.Image{m, m.(interface {
+			SubImage(image.Rectangle) image.Image
+		}).SubImage(sub)}
+		for _, m := range ims {
+			b := m.Bounds()
+			fast, slow := make([]pixel, b.Dx()), make([]pixel, b.Dx())
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				readRow(fast, m, b.Min.X, y)
+				readRow(slow, generic{m}, b.Min.X, y)
+				for x := range fast {
+					if fast[x] != slow[x] {
+						t.Fatalf("%T %v: (%d, %d) = %v; want %v", m, b, b.Min.X+x, y, fast[x], slow[x])
+					}
+				}
+			}
+		}
+	}
+}
+
+func benchmarkReadRow(b *testing.B, wrap bool) {
+	m := image.Image(image.NewNRGBA(image.Rect(0, 0, 1000, 1)))
+	if wrap {
+		m = generic{m}
+	}
+	row := make([]pixel, 1000)
+	b.SetBytes(4 * 1000)
+	for i := 0; i < b.N; i++ {
+		readRow(row, m, 0, 0)
+	}
+}
+
+func BenchmarkReadRow(b *testing.B)        { benchmarkReadRow(b, false) }
+func BenchmarkReadRowGeneric(b *testing.B) { benchmarkReadRow(b, true) }
+
+func TestDiffPixels(t *testing.T) {
+	a, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []Differ{NewBinary(), NewDefaultPerceptual()} {
+		diff, n, err := d.Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := diff.(*image.NRGBA)
+		// the same diff written with Set
+		want := image.NewNRGBA(got.Bounds())
+		nfail := 0
+		for y := 0; y < got.Bounds().Dy(); y++ {
+			for x := 0; x < got.Bounds().Dx(); x++ {
+				c := color.RGBA{0, 0, 0, 0xff}
+				if got.NRGBAAt(x, y).R != 0 {
+					c.R = 0xff
+					nfail++
+				}
+				want.Set(x, y, c)
+			}
+		}
+		if nfail != n {
+			t.Errorf("%T: %d red pixels; want %d", d, nfail, n)
+		}
+		if !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("%T: diff differs from one written with Set", d)
+		}
+	}
+}
+
+func TestSameImage(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r := image.Rect(0, 0, 13, 7)
+	a := image.NewNRGBA(r)
+	rnd.Read(a.Pix)
+	// equal Pix data in a different struct
+	b := &image.NRGBA{Pix: append([]uint8(nil), a.Pix...), Stride: a.Stride, Rect: a.Rect}
+	// equal pixels with a different stride and origin
+	big := image.NewNRGBA(r.Add(image.Pt(3, 2)).Inset(-2))
+	draw.Draw(big, r.Add(image.Pt(3, 2)), a, image.ZP, draw.Src)
+	sub := big.SubImage(r.Add(image.Pt(3, 2)))
+	changed := &image.NRGBA{Pix: append([]uint8(nil), a.Pix...), Stride: a.Stride, Rect: a.Rect}
+	changed.Pix[len(changed.Pix)-1]++
+	rgba := image.NewRGBA(r)
+	copy(rgba.Pix, a.Pix)
+
+	tests := []struct {
+		a, b image.Image
+		same bool
+	}{
+		{a, a, true},
+		{a, b, true},
+		{a, sub, true},
+		{generic{a}, generic{a}, true},
+		{a, changed, false},
+		{a, rgba, false},
+		{generic{a}, generic{b}, false},
+	}
+	for i, test := range tests {
+		if same := sameImage(test.a, test.b); same != test.same {
+			t.Errorf("(%d) sameImage = %v; want %v", i, same, test.same)
+		}
+		if !test.same {
+			continue
+		}
+		for _, d := range []Differ{NewBinary(), NewDefaultPerceptual(), NewDefaultSSIM()} {
+			diff, n, err := d.Compare(test.a, test.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pass := image.NewNRGBA(image.Rect(0, 0, 13, 7))
+			fillPass(pass)
+			if n != 0 || !bytes.Equal(diff.(*image.NRGBA).Pix, pass.Pix) {
+				t.Errorf("(%d) %T: n = %d; want 0 and all pixels passing", i, d, n)
+			}
+		}
+	}
+}
+
+func TestDeltaColors(t *testing.T) {
+	r := image.Rect(0, 0, 32, 32)
+	tests := []struct {
+		a, b color.NRGBA
+		want [4]uint8
+		// whether perceptual sees the difference
+		perceptual bool
+	}{
+		{color.NRGBA{0x10, 0x80, 0xff, 0xff}, color.NRGBA{0x30, 0x70, 0xff, 0xff}, [4]uint8{0x20, 0x10, 0, 0xff}, true},
+		// only alpha differs
+		{color.NRGBA{0, 0, 0, 0xff}, color.NRGBA{0, 0, 0, 0x80}, [4]uint8{0, 0, 0, 0x80}, false},
+		// would look like tolerPixel
+		{color.NRGBA{0x40, 0x40, 0x40, 0xff}, color.NRGBA{0x80, 0x80, 0x80, 0xff}, failPixel, true},
+	}
+	for i, test := range tests {
+		a, b := image.NewNRGBA(r), image.NewNRGBA(r)
+		draw.Draw(a, r, image.NewUniform(color.Gray{0x80}), image.ZP, draw.Src)
+		draw.Draw(b, r, image.NewUniform(color.Gray{0x80}), image.ZP, draw.Src)
+		// a block large enough for perceptual to see
+		block := image.Rect(12, 12, 20, 20)
+		draw.Draw(a, block, image.NewUniform(test.a), image.ZP, draw.Src)
+		draw.Draw(b, block, image.NewUniform(test.b), image.ZP, draw.Src)
+		differs := [][2]Differ{{NewBinary(WithDeltaColors()), NewBinary()}}
+		if test.perceptual {
+			differs = append(differs, [2]Differ{NewDefaultPerceptual(WithDeltaColors()), NewDefaultPerceptual()})
+		}
+		for _, d := range differs {
+			diff, n, err := d[0].Compare(a, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the same pixels are counted
+			if _, want, _ := d[1].Compare(a, b); n != want || n == 0 {
+				t.Errorf("(%d) %T: n = %d; want %d, not 0", i, d[0], n, want)
+			}
+			m := diff.(*image.NRGBA)
+			if p := m.Pix[m.PixOffset(15, 15):][:4]; !bytes.Equal(p, test.want[:]) {
+				t.Errorf("(%d) %T: pixel = %v; want %v", i, d[0], p, test.want)
+			}
+			if p := m.Pix[m.PixOffset(0, 0):][:4]; !bytes.Equal(p, passPixel[:]) {
+				t.Errorf("(%d) %T: equal pixel = %v; want %v", i, d[0], p, passPixel)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import "image"
+
+// Prepared is a reference image whose LAB colors and Laplacian pyramid
+// are computed once, rather than by every Compare, for comparing it
+// with many candidate images with the perceptual algorithm. Most of
+// the work of a comparison, masking per pixel, depends on both images
+// and is still done for each candidate. Its Compare method is safe
+// for concurrent use.
+type Prepared struct {
+	d   *perceptual
+	ref image.Image
+}
+
+// PreparePerceptual prepares img for comparisons with the Differ of
+// NewDefaultPerceptual(opts...), see Prepared. It returns an error if
+// the options are invalid or img has more than MaxPixels pixels, unless
+// WithUnlimited is given. WithLowMemory and WithFloat32 are ignored,
+// since the pyramid of img is kept whole.
+func PreparePerceptual(img image.Image, opts ...Option) (*Prepared, error) {
+	d := NewDefaultPerceptual(opts...).(*perceptual)
+	if d.err != nil {
+		return nil, d.err
+	}
+	r := img.Bounds()
+	if err := d.opts.checkSize(r); err != nil {
+		return nil, err
+	}
+	ref := newImageScratch(r.Dx(), r.Dy(), d.lap.levels)
+	ref.labLap(d.opts.alphaView(img), d.lut, d.lum, d.lap.kernel, d.opts.workers())
+	d.ref = ref
+	return &Prepared{d: d, ref: img}, nil
+}
+
+// Bounds returns the bounds of the prepared image.
+func (p *Prepared) Bounds() image.Rectangle {
+	return p.ref.Bounds()
+}
+
+// Compare compares the prepared image, as image a, with candidate,
+// with the same results as the Differ's Compare. It returns ErrSize
+// if their width or height do not match.
+func (p *Prepared) Compare(candidate image.Image) (image.Image, int, error) {
+	return p.d.Compare(p.ref, candidate)
+}
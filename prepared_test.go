@@ -0,0 +1,172 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bytes"
+	"image"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestPrepared(t *testing.T) {
+	pairs := [][2]string{
+		{"aqsis_vase.png", "aqsis_vase_ref.png"},
+		{"bug1102605_ref.tif", "bug1102605.tif"},
+		{"fish1.png", "fish2.png"},
+	}
+	if testing.Short() {
+		// the largest pair, compared by TestPreparedConcurrent too
+		pairs = pairs[:2]
+	}
+	variants := []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"tiled", []Option{WithTiling(64)}},
+		{"shift", []Option{WithShiftTolerance(1)}},
+		{"heatmap", []Option{WithHeatmap()}},
+		// ignored, with the same results
+		{"lowmem", []Option{WithLowMemory()}},
+	}
+	for _, pair := range pairs {
+		a, err := readTestImage(pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := readTestImage(pair[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range variants {
+			want, wantN, err := NewDefaultPerceptual(v.opts...).Compare(a, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := PreparePerceptual(a, v.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// twice, reusing pooled buffers
+			for i := 0; i < 2; i++ {
+				got, n, err := p.Compare(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != wantN {
+					t.Errorf("%s, %s: n = %d; want %d", pair[0], v.name, n, wantN)
+				}
+				if !bytes.Equal(got.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+					t.Errorf("%s, %s: diff images differ", pair[0], v.name)
+				}
+			}
+			if _, n, err := p.Compare(a); err != nil || n != 0 {
+				t.Errorf("%s, %s: Compare of the prepared image = %d, %v; want 0", pair[0], v.name, n, err)
+			}
+		}
+	}
+}
+
+func TestPreparedConcurrent(t *testing.T) {
+	a, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := PreparePerceptual(a, WithMaxWorkers(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := []image.Image{a, b, a, b, b, b}
+	want := []int{0, 26060, 0, 26060, 26060, 26060}
+	var wg sync.WaitGroup
+	for i, c := range candidates {
+		wg.Add(1)
+		go func(i int, c image.Image) {
+			defer wg.Done()
+			if _, n, err := p.Compare(c); err != nil || n != want[i] {
+				t.Errorf("%d: Compare = %d, %v; want %d", i, n, err, want[i])
+			}
+		}(i, c)
+	}
+	wg.Wait()
+}
+
+func TestPreparedErrors(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	p, err := PreparePerceptual(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Bounds() != m.Rect {
+		t.Errorf("Bounds = %v; want %v", p.Bounds(), m.Rect)
+	}
+	if _, _, err := p.Compare(image.NewNRGBA(image.Rect(0, 0, 10, 11))); err != ErrSize {
+		t.Errorf("Compare of a larger image: err = %v; want ErrSize", err)
+	}
+	// offset bounds of the same size are fine
+	if _, n, err := p.Compare(image.NewNRGBA(image.Rect(5, 5, 15, 15))); err != nil || n != 0 {
+		t.Errorf("Compare of offset bounds = %d, %v; want 0", n, err)
+	}
+	if _, err := PreparePerceptual(m, WithPyramidLevels(1)); err == nil {
+		t.Error("PreparePerceptual with 1 pyramid level: no error")
+	}
+	// bounds of a uniform image are practically infinite
+	if _, err := PreparePerceptual(image.Black); err == nil {
+		t.Error("PreparePerceptual of too many pixels: no error")
+	}
+}
+
+// benchmarkPrepared compares a 512 x 512 reference with 10 candidates,
+// which differ from it in a few pixels each, prepared or not.
+func benchmarkPrepared(b *testing.B, prepared bool) {
+	r := image.Rect(0, 0, 512, 512)
+	ref := image.NewNRGBA(r)
+	rnd := rand.New(rand.NewSource(1))
+	rnd.Read(ref.Pix)
+	candidates := make([]image.Image, 10)
+	for i := range candidates {
+		m := image.NewNRGBA(r)
+		copy(m.Pix, ref.Pix)
+		for j := 0; j < 10; j++ {
+			m.Pix[rnd.Intn(len(m.Pix))] ^= 0x80
+		}
+		candidates[i] = m
+	}
+	d := NewDefaultPerceptual()
+	p, err := PreparePerceptual(ref)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, c := range candidates {
+			if prepared {
+				p.Compare(c)
+			} else {
+				d.Compare(ref, c)
+			}
+		}
+	}
+}
+
+func BenchmarkPrepared10(b *testing.B)   { benchmarkPrepared(b, true) }
+func BenchmarkUnprepared10(b *testing.B) { benchmarkPrepared(b, false) }
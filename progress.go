@@ -0,0 +1,64 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import "sync"
+
+// progress reports progress of a Compare call to the callback of
+// WithProgress, one call at a time. A nil *progress reports nothing,
+// so that comparisons without WithProgress only check for nil.
+type progress struct {
+	fn func(done, total int)
+	mu sync.Mutex
+	// units of work done, up to total
+	done, total int
+}
+
+// newProgress returns the progress of a Compare call of total units,
+// or nil without WithProgress.
+func (o options) newProgress(total int) *progress {
+	if o.progress == nil {
+		return nil
+	}
+	return &progress{fn: o.progress, total: total}
+}
+
+// add reports n more units done.
+func (p *progress) add(n int) {
+	if p == nil || n <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	if p.done > p.total {
+		p.done = p.total
+	}
+	p.fn(p.done, p.total)
+}
+
+// finish reports all units done, if they aren't yet, such as those of
+// phases which aren't reported unit by unit or of skipped work.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done < p.total || p.total == 0 {
+		p.done = p.total
+		p.fn(p.done, p.total)
+	}
+}
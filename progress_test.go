@@ -0,0 +1,132 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/draw"
+	"sync/atomic"
+	"testing"
+)
+
+// progressRecorder records calls of a WithProgress callback,
+// and whether any were concurrent.
+type progressRecorder struct {
+	calls      [][2]int
+	running    int32
+	concurrent bool
+}
+
+func (r *progressRecorder) report(done, total int) {
+	if atomic.AddInt32(&r.running, 1) != 1 {
+		r.concurrent = true
+	}
+	r.calls = append(r.calls, [2]int{done, total})
+	atomic.AddInt32(&r.running, -1)
+}
+
+// check reports whether calls have the given total, increasing done,
+// and the last one has all work done.
+func (r *progressRecorder) check(t *testing.T, name string, total int) {
+	t.Helper()
+	if r.concurrent {
+		t.Errorf("%s: concurrent calls", name)
+	}
+	if len(r.calls) == 0 {
+		t.Fatalf("%s: no calls", name)
+	}
+	for i, c := range r.calls {
+		if c[1] != total || c[0] <= 0 && total > 0 || i > 0 && c[0] <= r.calls[i-1][0] {
+			t.Fatalf("%s: call %d of %v; want increasing done of total %d", name, i, r.calls, total)
+		}
+	}
+	if last := r.calls[len(r.calls)-1]; last[0] != total {
+		t.Errorf("%s: last call %v; want all %d done", name, last, total)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	a, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a part with some differences, to keep the test fast
+	type subImager interface {
+		SubImage(image.Rectangle) image.Image
+	}
+	r := image.Rect(100, 80, 300, 230)
+	a, b = a.(subImager).SubImage(r), b.(subImager).SubImage(r)
+	h := r.Dy()
+	na, nb := image.NewNRGBA(a.Bounds()), image.NewNRGBA(b.Bounds())
+	draw.Draw(na, na.Rect, a, a.Bounds().Min, draw.Src)
+	draw.Draw(nb, nb.Rect, b, b.Bounds().Min, draw.Src)
+	levels := defaultLapFilter.levels - 1
+	tests := []struct {
+		name  string
+		new   func(...Option) Differ
+		a, b  image.Image
+		total int
+	}{
+		{"binary", func(o ...Option) Differ { return NewBinary(o...) }, a, b, h},
+		{"binary tolerance", func(o ...Option) Differ { return NewBinary(append(o, WithChannelTolerance(3, 3, 3, 0))...) }, a, b, h},
+		{"binary float", func(o ...Option) Differ { return NewBinary(o...) }, floatImage{na}, floatImage{nb}, h},
+		{"binary tiled", func(o ...Option) Differ { return NewBinary(o...) }, &tiled{na, image.Pt(50, 30)}, &tiled{nb, image.Pt(50, 30)}, h},
+		{"binary shift", func(o ...Option) Differ { return NewBinary(append(o, WithShiftTolerance(1))...) }, a, b, h},
+		{"binary same", func(o ...Option) Differ { return NewBinary(o...) }, a, a, h},
+		{"perceptual", func(o ...Option) Differ { return NewDefaultPerceptual(o...) }, a, b, h + 2*levels},
+		{"tiled", func(o ...Option) Differ { return NewDefaultPerceptual(append(o, WithTiling(64))...) }, a, b, h + 2*levels},
+		{"float32", func(o ...Option) Differ { return NewDefaultPerceptual(append(o, WithFloat32())...) }, a, b, h + 2*levels},
+		{"lowmem", func(o ...Option) Differ { return NewDefaultPerceptual(append(o, WithLowMemory())...) }, a, b, h},
+		{"shift", func(o ...Option) Differ { return NewDefaultPerceptual(append(o, WithShiftTolerance(1))...) }, a, b, h + 2*levels},
+		{"perceptual same", func(o ...Option) Differ { return NewDefaultPerceptual(o...) }, a, a, h + 2*levels},
+	}
+	for _, test := range tests {
+		var r progressRecorder
+		d := test.new(WithProgress(r.report))
+		_, want, err := test.new().Compare(test.a, test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, n, err := d.Compare(test.a, test.b)
+		if err != nil || n != want {
+			t.Fatalf("%s: n = %d, %v; want %d", test.name, n, err, want)
+		}
+		r.check(t, test.name, test.total)
+		// and without a difference image
+		r = progressRecorder{}
+		if _, err := CompareCount(d, test.a, test.b); err != nil {
+			t.Fatal(err)
+		}
+		r.check(t, test.name+" count", test.total)
+	}
+
+	// a prepared image only has the pyramid of the other one built
+	var rec progressRecorder
+	p, err := PreparePerceptual(a, WithProgress(rec.report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.calls) > 0 {
+		t.Errorf("PreparePerceptual reported %v", rec.calls)
+	}
+	if _, _, err := p.Compare(b); err != nil {
+		t.Fatal(err)
+	}
+	rec.check(t, "prepared", h+levels)
+}
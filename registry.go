@@ -0,0 +1,333 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Factory creates a Differ configured by string options,
+// see Register.
+type Factory func(opts map[string]string) (Differ, error)
+
+var registry = struct {
+	sync.RWMutex
+	m map[string]Factory
+}{m: make(map[string]Factory)}
+
+func init() {
+	Register("binary", BinaryFactory())
+	Register("perceptual", PerceptualFactory())
+}
+
+// Register makes a Differ available by name to New, e.g. for
+// programs which let users choose algorithms by name. It returns
+// an error if name is already registered. Register is safe for
+// concurrent use.
+//
+// The "binary" and "perceptual" algorithms are registered by this
+// package. Both take these options, all optional:
+//
+//	workers    max goroutines of a Compare call, see WithMaxWorkers
+//	shift      max offset of matching pixels, see WithShiftTolerance
+//	unlimited  true to lift MaxPixels, see WithUnlimited
+//	alpha      name of an AlphaMode, e.g. "ignore", see WithAlphaMode
+//	bg         rrggbb hex color, # optional, see WithBackground
+//	delta      true to draw differences of colors, see WithDeltaColors
+//	heatmap    true to draw magnitudes of differences, see WithHeatmap
+//	overlay    a or b, the BaseImage of WithOverlay
+//	dim        dim of WithOverlay, 0.3 by default; requires overlay
+//	maxdiff    different pixels to stop comparing above, see WithMaxDiff
+//
+// Binary also takes eps, see WithFloatEpsilon, tol, tolerances of
+// WithChannelTolerance as r,g,b,a, e.g. 3,3,3,0, fuzz, the percentage
+// of NewBinaryFuzz, e.g. 2%, the % being optional, linear, the gamma
+// of WithLinearLight or srgb, and gray, true to compare lumas, see
+// WithLuminanceOnly. Perceptual takes
+// gamma, lum, fov, cf and nocolor, the arguments of NewPerceptual,
+// cvd, the name of a ColorVision, e.g. "deuteranopia", levels,
+// see WithPyramidLevels, transfer, srgb to decode samples with
+// WithTransfer(SRGB), or gamma, the default, to decode them with gamma,
+// and csf, the name of a CSFModel, e.g. "mannos".
+func Register(name string, factory Factory) error {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.m[name]; ok {
+		return fmt.Errorf("imgdiff: algorithm %q already registered", name)
+	}
+	registry.m[name] = factory
+	return nil
+}
+
+// New creates a new Differ of the algorithm registered as name,
+// configured by opts, see Register.
+func New(name string, opts map[string]string) (Differ, error) {
+	registry.RLock()
+	f, ok := registry.m[name]
+	registry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("imgdiff: unknown algorithm %q", name)
+	}
+	return f(opts)
+}
+
+// Names returns the sorted names of registered algorithms.
+func Names() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	names := make([]string, 0, len(registry.m))
+	for name := range registry.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BinaryFactory returns the Factory of the "binary" algorithm, see
+// Register, which adds opts to the Options of its string options,
+// as PerceptualFactory does.
+func BinaryFactory(opts ...Option) Factory {
+	return func(m map[string]string) (Differ, error) {
+		return newBinaryFactory(m, opts)
+	}
+}
+
+func newBinaryFactory(opts map[string]string, extra []Option) (Differ, error) {
+	p := optionParser{alg: "binary", m: opts}
+	o := p.common()
+	o = append(o, WithFloatEpsilon(p.float("eps", 0)))
+	if s, ok := p.get("tol"); ok {
+		var t [4]uint8
+		if _, err := fmt.Sscanf(s, "%d,%d,%d,%d", &t[0], &t[1], &t[2], &t[3]); err != nil {
+			p.fail("tol", s)
+		}
+		o = append(o, WithChannelTolerance(t[0], t[1], t[2], t[3]))
+	}
+	var fuzz float64
+	if s, ok := p.get("fuzz"); ok {
+		v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil {
+			p.fail("fuzz", s)
+		}
+		fuzz = v
+	}
+	if p.bool("gray") {
+		o = append(o, WithLuminanceOnly())
+	}
+	if s, ok := p.get("linear"); ok {
+		var gamma float64
+		if s != "srgb" {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				p.fail("linear", s)
+			}
+			gamma = v
+		}
+		o = append(o, WithLinearLight(gamma))
+	}
+	if err := p.done(); err != nil {
+		return nil, err
+	}
+	return NewBinaryFuzz(fuzz, append(o, extra...)...), nil
+}
+
+// PerceptualFactory returns the Factory of the "perceptual" algorithm,
+// see Register, which adds opts to the Options of its string options,
+// e.g. for options which aren't strings, such as WithDebug or
+// WithProgress.
+func PerceptualFactory(opts ...Option) Factory {
+	return func(m map[string]string) (Differ, error) {
+		return newPerceptualFactory(m, opts)
+	}
+}
+
+func newPerceptualFactory(opts map[string]string, extra []Option) (Differ, error) {
+	p := optionParser{alg: "perceptual", m: opts}
+	o := p.common()
+	gamma := p.float("gamma", 2.2)
+	lum := p.float("lum", 100)
+	fov := p.float("fov", 45)
+	cf := p.float("cf", 1)
+	nocolor := p.bool("nocolor")
+	if s, ok := p.get("cvd"); ok {
+		v := NormalVision
+		for v <= Tritanopia && v.String() != s {
+			v++
+		}
+		if v > Tritanopia {
+			p.fail("cvd", s)
+		}
+		o = append(o, WithColorVision(v))
+	}
+	if _, ok := p.get("levels"); ok {
+		o = append(o, WithPyramidLevels(p.int("levels")))
+	}
+	if s, ok := p.get("csf"); ok {
+		m := Barten
+		for m <= MannosSakrison && m.String() != s {
+			m++
+		}
+		if m > MannosSakrison {
+			p.fail("csf", s)
+		}
+		o = append(o, WithCSF(m))
+	}
+	if s, ok := p.get("transfer"); ok {
+		switch s {
+		case "srgb":
+			o = append(o, WithTransfer(SRGB))
+		case "gamma":
+		default:
+			p.fail("transfer", s)
+		}
+	}
+	if err := p.done(); err != nil {
+		return nil, err
+	}
+	return NewPerceptualE(gamma, lum, fov, cf, nocolor, append(o, extra...)...)
+}
+
+// optionParser reads options of algorithm alg from m,
+// keeping the first error.
+type optionParser struct {
+	alg string
+	m   map[string]string
+	// keys of m which were read
+	read map[string]bool
+	err  error
+}
+
+// get returns option key, if set.
+func (p *optionParser) get(key string) (string, bool) {
+	s, ok := p.m[key]
+	if ok {
+		if p.read == nil {
+			p.read = make(map[string]bool)
+		}
+		p.read[key] = true
+	}
+	return s, ok
+}
+
+// fail records an invalid value s of option key.
+func (p *optionParser) fail(key, s string) {
+	if p.err == nil {
+		p.err = fmt.Errorf("imgdiff: invalid %s option %s=%q", p.alg, key, s)
+	}
+}
+
+func (p *optionParser) float(key string, def float64) float64 {
+	s, ok := p.get(key)
+	if !ok {
+		return def
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		p.fail(key, s)
+	}
+	return v
+}
+
+func (p *optionParser) int(key string) int {
+	s, ok := p.get(key)
+	if !ok {
+		return 0
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		p.fail(key, s)
+	}
+	return v
+}
+
+func (p *optionParser) bool(key string) bool {
+	s, ok := p.get(key)
+	if !ok {
+		return false
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		p.fail(key, s)
+	}
+	return v
+}
+
+// common returns the Options of keys all registered algorithms of
+// this package take.
+func (p *optionParser) common() []Option {
+	o := []Option{WithMaxWorkers(p.int("workers")), WithShiftTolerance(p.int("shift"))}
+	if p.bool("unlimited") {
+		o = append(o, WithUnlimited())
+	}
+	if p.bool("delta") {
+		o = append(o, WithDeltaColors())
+	}
+	if p.bool("heatmap") {
+		o = append(o, WithHeatmap())
+	}
+	if s, ok := p.get("overlay"); ok {
+		base := BaseA
+		for base <= BaseB && base.String() != s {
+			base++
+		}
+		if base > BaseB {
+			p.fail("overlay", s)
+		}
+		o = append(o, WithOverlay(base, p.float("dim", 0.3)))
+	}
+	if _, ok := p.get("maxdiff"); ok {
+		o = append(o, WithMaxDiff(p.int("maxdiff")))
+	}
+	if s, ok := p.get("alpha"); ok {
+		m := CompareAlpha
+		for m <= PremultiplyFirst && m.String() != s {
+			m++
+		}
+		if m > PremultiplyFirst {
+			p.fail("alpha", s)
+		}
+		o = append(o, WithAlphaMode(m))
+	}
+	if s, ok := p.get("bg"); ok {
+		var c [3]uint8
+		h := strings.TrimPrefix(s, "#")
+		if _, err := fmt.Sscanf(h, "%02x%02x%02x", &c[0], &c[1], &c[2]); err != nil || len(h) != 6 {
+			p.fail("bg", s)
+		}
+		o = append(o, WithBackground(color.RGBA{c[0], c[1], c[2], 0xff}))
+	}
+	return o
+}
+
+// done returns the first error, or one naming an unknown option
+// if not all of them were read.
+func (p *optionParser) done() error {
+	if p.err != nil || len(p.read) == len(p.m) {
+		return p.err
+	}
+	keys := make([]string, 0, len(p.m))
+	for k := range p.m {
+		if !p.read[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return fmt.Errorf("imgdiff: unknown %s option %q", p.alg, keys[0])
+}
@@ -0,0 +1,181 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	a := blocks(30, 20)
+	b := translate(a, 1, 0)
+	tests := []struct {
+		name string
+		opts map[string]string
+		want Differ
+	}{
+		{"binary", nil, NewBinary()},
+		{"binary", map[string]string{"eps": "0.1", "workers": "2"}, NewBinary(WithFloatEpsilon(0.1), WithMaxWorkers(2))},
+		{"binary", map[string]string{"shift": "1"}, NewBinary(WithShiftTolerance(1))},
+		{"binary", map[string]string{"tol": "3,3,3,0"}, NewBinary(WithChannelTolerance(3, 3, 3, 0))},
+		{"binary", map[string]string{"fuzz": "2%"}, NewBinaryFuzz(2)},
+		{"binary", map[string]string{"fuzz": "2"}, NewBinaryFuzz(2)},
+		{"perceptual", nil, NewDefaultPerceptual()},
+		{"perceptual", map[string]string{"gamma": "1.8", "lum": "80", "fov": "60", "cf": "0.5", "nocolor": "true"}, NewPerceptual(1.8, 80, 60, 0.5, true)},
+		{"perceptual", map[string]string{"cvd": "deuteranopia", "unlimited": "true"}, NewDefaultPerceptual(WithColorVision(Deuteranopia), WithUnlimited())},
+		{"binary", map[string]string{"alpha": "ignore"}, NewBinary(WithAlphaMode(IgnoreAlpha))},
+		{"binary", map[string]string{"delta": "true"}, NewBinary(WithDeltaColors())},
+		{"perceptual", map[string]string{"heatmap": "true"}, NewDefaultPerceptual(WithHeatmap())},
+		{"binary", map[string]string{"overlay": "b", "dim": "0.5"}, NewBinary(WithOverlay(BaseB, 0.5))},
+		{"perceptual", map[string]string{"maxdiff": "1000"}, NewDefaultPerceptual(WithMaxDiff(1000))},
+		{"binary", map[string]string{"linear": "srgb"}, NewBinary(WithLinearLight(0))},
+		{"binary", map[string]string{"gray": "true", "tol": "8,8,8,0"}, NewBinary(WithLuminanceOnly(), WithChannelTolerance(8, 8, 8, 0))},
+		{"binary", map[string]string{"linear": "2.2", "tol": "2,2,2,0"}, NewBinary(WithLinearLight(2.2), WithChannelTolerance(2, 2, 2, 0))},
+		{"perceptual", map[string]string{"alpha": "premultiply", "bg": "#ff0000"}, NewDefaultPerceptual(WithAlphaMode(PremultiplyFirst), WithBackground(color.RGBA{0xff, 0, 0, 0xff}))},
+		{"perceptual", map[string]string{"levels": "4"}, NewDefaultPerceptual(WithPyramidLevels(4))},
+		{"perceptual", map[string]string{"transfer": "srgb"}, NewDefaultPerceptual(WithTransfer(SRGB))},
+		{"perceptual", map[string]string{"csf": "mannos"}, NewDefaultPerceptual(WithCSF(MannosSakrison))},
+		{"perceptual", map[string]string{"transfer": "gamma", "gamma": "1.8"}, NewPerceptual(1.8, 100, 45, 1, false)},
+	}
+	for i, test := range tests {
+		d, err := New(test.name, test.opts)
+		if err != nil {
+			t.Errorf("(%d) New: %v", i, err)
+			continue
+		}
+		_, n, err := d.Compare(a, b)
+		_, want, _ := test.want.Compare(a, b)
+		if err != nil || n != want {
+			t.Errorf("(%d) n = %d, err = %v; want %d", i, n, err, want)
+		}
+	}
+
+	for i, test := range []struct {
+		name string
+		opts map[string]string
+	}{
+		{"nope", nil},
+		{"binary", map[string]string{"gamma": "2.2"}},
+		{"binary", map[string]string{"eps": "x"}},
+		{"binary", map[string]string{"tol": "3,3"}},
+		{"binary", map[string]string{"tol": "300,0,0,0"}},
+		{"binary", map[string]string{"fuzz": "2%%"}},
+		{"perceptual", map[string]string{"nocolor": "maybe"}},
+		{"perceptual", map[string]string{"cvd": "normal2"}},
+		{"perceptual", map[string]string{"workers": "1.5"}},
+		{"binary", map[string]string{"alpha": "drop"}},
+		{"perceptual", map[string]string{"delta": "yes"}},
+		{"binary", map[string]string{"heatmap": "viridis"}},
+		{"binary", map[string]string{"overlay": "c"}},
+		{"perceptual", map[string]string{"dim": "0.3"}},
+		{"binary", map[string]string{"maxdiff": "none"}},
+		{"binary", map[string]string{"linear": "rec709"}},
+		{"perceptual", map[string]string{"gray": "true"}},
+		{"perceptual", map[string]string{"linear": "srgb"}},
+		{"binary", map[string]string{"bg": "#fff"}},
+		{"perceptual", map[string]string{"bg": "white"}},
+		{"perceptual", map[string]string{"levels": "many"}},
+		{"binary", map[string]string{"levels": "4"}},
+		{"perceptual", map[string]string{"transfer": "rec709"}},
+		{"binary", map[string]string{"transfer": "srgb"}},
+		{"perceptual", map[string]string{"csf": "daly"}},
+		{"binary", map[string]string{"csf": "barten"}},
+		{"perceptual", map[string]string{"lum": "0"}},
+		{"perceptual", map[string]string{"fov": "180"}},
+		{"perceptual", map[string]string{"gamma": "-2.2"}},
+		{"perceptual", map[string]string{"cf": "NaN"}},
+		{"perceptual", map[string]string{"levels": "20"}},
+	} {
+		if _, err := New(test.name, test.opts); err == nil {
+			t.Errorf("(%d) New(%q, %v): no error", i, test.name, test.opts)
+		}
+	}
+}
+
+func TestPerceptualFactory(t *testing.T) {
+	var r debugRecorder
+	d, err := PerceptualFactory(WithDebug(&r))(map[string]string{"levels": "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := blocks(30, 20)
+	if _, _, err := d.Compare(a, translate(a, 1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.names) == 0 {
+		t.Error("no debug planes")
+	}
+	if _, err := PerceptualFactory()(map[string]string{"levels": "many"}); err == nil {
+		t.Error("levels=many: no error")
+	}
+}
+
+func TestBinaryFactory(t *testing.T) {
+	var calls int
+	d, err := BinaryFactory(WithProgress(func(done, total int) { calls++ }))(map[string]string{"tol": "1,1,1,0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := blocks(30, 20)
+	if _, _, err := d.Compare(a, translate(a, 1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 20 {
+		t.Errorf("%d progress calls; want one per row", calls)
+	}
+	if _, err := BinaryFactory()(map[string]string{"tol": "x"}); err == nil {
+		t.Error("tol=x: no error")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	if err := Register("binary", BinaryFactory()); err == nil {
+		t.Error("duplicate binary: no error")
+	}
+	factory := func(opts map[string]string) (Differ, error) {
+		return NewBinary(), nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := Register(fmt.Sprintf("test-register-%d", i), factory); err != nil {
+				t.Error(err)
+			}
+			if _, err := New("perceptual", nil); err != nil {
+				t.Error(err)
+			}
+			Names()
+		}(i)
+	}
+	wg.Wait()
+	if _, err := New("test-register-3", nil); err != nil {
+		t.Error(err)
+	}
+	names := Names()
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("Names = %v; want sorted", names)
+	}
+	for _, name := range []string{"binary", "perceptual", "test-register-0", "test-register-7"} {
+		if i := sort.SearchStrings(names, name); i == len(names) || names[i] != name {
+			t.Errorf("Names = %v; want %s", names, name)
+		}
+	}
+}
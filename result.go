@@ -0,0 +1,260 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"time"
+)
+
+// Result is the outcome of comparing two images with CompareResult.
+//
+// All coordinates of a Result are in the comparison frame: a zero-based
+// rectangle of the size of the inputs, where (0, 0) is the top-left pixel
+// of both images. A point p of the frame is OffsetA.Add(p) in the first
+// image and OffsetB.Add(p) in the second one, whatever their bounds are.
+type Result struct {
+	// Diff is the difference image. Its bounds are the comparison frame.
+	Diff image.Image
+	// N is the number of different pixels.
+	N int
+	// Total is the number of pixels of the comparison frame. For the
+	// Differs returned by NewAHash, NewDHash, NewPHash and NewBlockhash,
+	// whose N is the distance of the hashes, it is the number of bits
+	// of a hash.
+	Total int
+	// Percent is N as a percentage of Total, 0 if Total is 0.
+	Percent float64
+	// Score is the similarity of the images, 1 - N/Total, from 0 if
+	// all pixels differ to 1 if none does.
+	Score float64
+	// DiffBounds is the smallest rectangle containing all different
+	// pixels, or an empty rectangle if there are none.
+	DiffBounds image.Rectangle
+	// OffsetA and OffsetB are Bounds().Min of the compared images.
+	OffsetA, OffsetB image.Point
+	// Timings are wall times of the comparison phases. Differs not
+	// created by this package only have Compare, Bounds and Total set.
+	Timings PhaseTimings
+	// Stats are aggregate errors of the images, or nil if the Differ
+	// doesn't compute them. Only the Differs returned by NewMSE,
+	// NewGMSD, NewNormalized, NewAligned and NewGrid do.
+	Stats *ErrorStats
+
+	// differ which produced the result, see CompareIncremental
+	differ Differ
+}
+
+// ResultDiffer is a Differ returning a Result of its comparisons.
+// Differs of NewBinary, NewBinaryFuzz and NewPerceptual implement it.
+type ResultDiffer interface {
+	Differ
+	// CompareResult is Compare returning a Result, see the
+	// CompareResult function.
+	CompareResult(a, b image.Image) (*Result, error)
+}
+
+// CompareResult compares a and b with d, after translating both
+// to the zero-based comparison frame described in Result, with
+// CompareResult if d is a ResultDiffer.
+func CompareResult(d Differ, a, b image.Image) (*Result, error) {
+	if rd, ok := d.(ResultDiffer); ok {
+		return rd.CompareResult(a, b)
+	}
+	return compareResult(d, a, b)
+}
+
+// compareResult is CompareResult of Differs of this package.
+func compareResult(d Differ, a, b image.Image) (*Result, error) {
+	start := time.Now()
+	res := &Result{OffsetA: a.Bounds().Min, OffsetB: b.Bounds().Min, differ: d}
+	t := &res.Timings
+	var diff image.Image
+	var n int
+	var err error
+	if sd, ok := d.(statsDiffer); ok {
+		res.Stats = new(ErrorStats)
+		diff, n, err = sd.compareStats(normalize(a), normalize(b), t, res.Stats)
+	} else if td, ok := d.(timedDiffer); ok {
+		diff, n, err = td.compareTimed(normalize(a), normalize(b), t)
+	} else {
+		newPhases(algorithmName(d), a.Bounds(), t).run("compare", &t.Compare, func() {
+			diff, n, err = d.Compare(normalize(a), normalize(b))
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Diff, res.N = diff, n
+	res.finish(start)
+	return res, nil
+}
+
+// finish sets DiffBounds, Total, Percent and Score of res, and timings
+// of setting DiffBounds along with the total time since start.
+func (res *Result) finish(start time.Time) {
+	r := res.Diff.Bounds()
+	res.Total = r.Dx() * r.Dy()
+	if h, ok := res.differ.(*hashDiffer); ok {
+		res.Total = h.size * h.size
+	}
+	res.Percent, res.Score = 0, 1
+	if res.Total > 0 {
+		f := float64(res.N) / float64(res.Total)
+		res.Percent, res.Score = 100*f, 1-f
+	}
+	t := &res.Timings
+	if res.N > 0 {
+		newPhases(algorithmName(res.differ), r, t).run("bounds", &t.Bounds, func() {
+			res.DiffBounds = diffBounds(res.Diff, overlaid(res.differ))
+		})
+	}
+	t.Total = time.Since(start)
+}
+
+// diffBounds returns the bounding box of pixels marked in diff image m,
+// relative to m.Bounds().Min. See DiffMask for which pixels are marked,
+// or WithOverlay if overlay is set.
+func diffBounds(m image.Image, overlay bool) image.Rectangle {
+	b := m.Bounds()
+	nm, isNRGBA := m.(*image.NRGBA)
+	var r image.Rectangle
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			var hit bool
+			if isNRGBA {
+				p := nm.Pix[nm.PixOffset(b.Min.X+x, b.Min.Y+y):]
+				if overlay {
+					hit = isFailPixel(p)
+				} else {
+					hit = isMarked(p)
+				}
+			} else {
+				hit = marked(m.At(b.Min.X+x, b.Min.Y+y))
+			}
+			if hit {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
+
+// normalize returns m translated so that its bounds start at (0, 0).
+// Images of the standard Pix-backed types share Pix with m, so that
+// fast paths still apply, as do YCbCr images starting at multiples
+// of their chroma subsampling, which share their planes. TiledImages
+// are returned as is, the Differs handle their offsets while walking
+// tiles.
+func normalize(m image.Image) image.Image {
+	b := m.Bounds()
+	if b.Min == (image.Point{}) {
+		return m
+	}
+	r := b.Sub(b.Min)
+	switch m := m.(type) {
+	case *image.NRGBA:
+		return &image.NRGBA{Pix: m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.RGBA:
+		return &image.RGBA{Pix: m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.Gray:
+		return &image.Gray{Pix: m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.NRGBA64:
+		return &image.NRGBA64{Pix: m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.RGBA64:
+		return &image.RGBA64{Pix: m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.Gray16:
+		return &image.Gray16{Pix: m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.Alpha:
+		return &image.Alpha{Pix: m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.Alpha16:
+		return &image.Alpha16{Pix: m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.CMYK:
+		return &image.CMYK{Pix: m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.Paletted:
+		return &image.Paletted{Pix: m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], Stride: m.Stride, Rect: r, Palette: m.Palette}
+	case *image.YCbCr:
+		if chromaAligned(b.Min, m.SubsampleRatio) {
+			yi, ci := m.YOffset(b.Min.X, b.Min.Y), m.COffset(b.Min.X, b.Min.Y)
+			return &image.YCbCr{
+				Y:  m.Y[yi:],
+				Cb: m.Cb[ci:],
+				Cr: m.Cr[ci:],
+				// the planes keep their strides
+				YStride:        m.YStride,
+				CStride:        m.CStride,
+				SubsampleRatio: m.SubsampleRatio,
+				Rect:           r,
+			}
+		}
+	case TiledImage:
+		return m
+	case FloatImage:
+		return &translatedFloat{translated{m, b.Min}, m}
+	}
+	return &translated{m, b.Min}
+}
+
+// chromaAligned reports whether p, not negative, is at a multiple
+// of the size of chroma samples of ratio, so that chroma offsets
+// of pixels from p are those of pixels from (0, 0).
+func chromaAligned(p image.Point, ratio image.YCbCrSubsampleRatio) bool {
+	if p.X < 0 || p.Y < 0 {
+		return false
+	}
+	w, h := 1, 1
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		w = 2
+	case image.YCbCrSubsampleRatio420:
+		w, h = 2, 2
+	case image.YCbCrSubsampleRatio440:
+		h = 2
+	case image.YCbCrSubsampleRatio411:
+		w = 4
+	case image.YCbCrSubsampleRatio410:
+		w, h = 4, 2
+	}
+	return p.X%w == 0 && p.Y%h == 0
+}
+
+// translated is an image moved by -off.
+type translated struct {
+	m   image.Image
+	off image.Point
+}
+
+func (t *translated) ColorModel() color.Model {
+	return t.m.ColorModel()
+}
+
+func (t *translated) Bounds() image.Rectangle {
+	return t.m.Bounds().Sub(t.off)
+}
+
+func (t *translated) At(x, y int) color.Color {
+	return t.m.At(x+t.off.X, y+t.off.Y)
+}
+
+// translatedFloat is a FloatImage moved by -off.
+type translatedFloat struct {
+	translated
+	f FloatImage
+}
+
+func (t *translatedFloat) FloatAt(x, y int) (r, g, b, a float32) {
+	return t.f.FloatAt(x+t.off.X, y+t.off.Y)
+}
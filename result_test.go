@@ -0,0 +1,444 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// floatImage is a FloatImage of samples of an NRGBA image.
+type floatImage struct {
+	*image.NRGBA
+}
+
+func (m floatImage) FloatAt(x, y int) (r, g, b, a float32) {
+	c := m.NRGBAAt(x, y)
+	return float32(c.R) / 0xff, float32(c.G) / 0xff, float32(c.B) / 0xff, float32(c.A) / 0xff
+}
+
+// shifted returns a copy of m with bounds moved by off, of the same kind.
+func shifted(m *image.NRGBA, off image.Point, kind string) image.Image {
+	c := image.NewNRGBA(m.Bounds().Add(off))
+	draw.Draw(c, c.Bounds(), m, m.Bounds().Min, draw.Src)
+	switch kind {
+	case "generic":
+		return generic{c}
+	case "float":
+		return floatImage{c}
+	case "gray":
+		g := image.NewGray(c.Bounds())
+		draw.Draw(g, g.Rect, c, c.Rect.Min, draw.Src)
+		return g
+	case "sub":
+		// a sub-image of a larger canvas
+		big := image.NewNRGBA(c.Bounds().Inset(-7))
+		draw.Draw(big, c.Bounds(), c, c.Bounds().Min, draw.Src)
+		return big.SubImage(c.Bounds())
+	}
+	return c
+}
+
+func TestNormalize(t *testing.T) {
+	r := image.Rect(0, 0, 20, 12)
+	rnd := rand.New(rand.NewSource(1))
+	random := func(pix ...[]uint8) {
+		for _, p := range pix {
+			rnd.Read(p)
+		}
+	}
+	nrgba64, rgba64, gray16 := image.NewNRGBA64(r), image.NewRGBA64(r), image.NewGray16(r)
+	alpha, alpha16, cmyk := image.NewAlpha(r), image.NewAlpha16(r), image.NewCMYK(r)
+	paletted := image.NewPaletted(r, color.Palette{color.Black, color.White, color.Gray{0x80}})
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(rnd.Intn(3))
+	}
+	random(nrgba64.Pix, rgba64.Pix, gray16.Pix, alpha.Pix, alpha16.Pix, cmyk.Pix)
+	type normalizeTest struct {
+		name string
+		m    image.Image
+		sub  image.Rectangle
+		// whether the result is of the type of m
+		same bool
+	}
+	tests := []normalizeTest{
+		{"nrgba64", nrgba64, image.Rect(3, 5, 17, 9), true},
+		{"rgba64", rgba64, image.Rect(3, 5, 17, 9), true},
+		{"gray16", gray16, image.Rect(3, 5, 17, 9), true},
+		{"alpha", alpha, image.Rect(3, 5, 17, 9), true},
+		{"alpha16", alpha16, image.Rect(3, 5, 17, 9), true},
+		{"cmyk", cmyk, image.Rect(3, 5, 17, 9), true},
+		{"paletted", paletted, image.Rect(3, 5, 17, 9), true},
+	}
+	for _, ratio := range []image.YCbCrSubsampleRatio{
+		image.YCbCrSubsampleRatio444,
+		image.YCbCrSubsampleRatio422,
+		image.YCbCrSubsampleRatio420,
+		image.YCbCrSubsampleRatio440,
+		image.YCbCrSubsampleRatio411,
+		image.YCbCrSubsampleRatio410,
+	} {
+		m := image.NewYCbCr(r, ratio)
+		random(m.Y, m.Cb, m.Cr)
+		tests = append(tests,
+			normalizeTest{ratio.String(), m, image.Rect(4, 2, 17, 9), true},
+			// chroma samples aren't shared, unless there's one per pixel
+			normalizeTest{ratio.String() + " unaligned", m, image.Rect(3, 5, 17, 9), ratio == image.YCbCrSubsampleRatio444})
+	}
+	for _, test := range tests {
+		sub := test.m.(interface {
+			SubImage(image.Rectangle) image.Image
+		}).SubImage(test.sub)
+		n := normalize(sub)
+		if same := reflect.TypeOf(n) == reflect.TypeOf(sub); same != test.same {
+			t.Errorf("%s: normalized to %T", test.name, n)
+		}
+		if n.Bounds() != test.sub.Sub(test.sub.Min) {
+			t.Errorf("%s: bounds = %v", test.name, n.Bounds())
+			continue
+		}
+		for y := 0; y < test.sub.Dy(); y++ {
+			for x := 0; x < test.sub.Dx(); x++ {
+				if got, want := n.At(x, y), sub.At(test.sub.Min.X+x, test.sub.Min.Y+y); got != want {
+					t.Fatalf("%s: %d, %d = %v; want %v", test.name, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestCompareResultOffsets(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	a := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+	for i := range a.Pix {
+		a.Pix[i] = uint8(i / 7)
+	}
+	b := image.NewNRGBA(a.Bounds())
+	copy(b.Pix, a.Pix)
+	// a blob of different pixels
+	for y := 10; y < 14; y++ {
+		for x := 20; x < 25; x++ {
+			b.SetNRGBA(x, y, color.NRGBA{0xff, 0, 0, 0xff})
+		}
+	}
+	for _, d := range []Differ{NewBinary(), NewDefaultPerceptual(), NewDefaultSSIM()} {
+		for _, kind := range []string{"nrgba", "generic", "float", "sub"} {
+			want, err := CompareResult(d, shifted(a, image.ZP, kind), shifted(b, image.ZP, kind))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want.N == 0 || !want.DiffBounds.In(image.Rect(15, 5, 30, 19)) {
+				t.Fatalf("%T %s: N = %d, DiffBounds = %v", d, kind, want.N, want.DiffBounds)
+			}
+			for i := 0; i < 10; i++ {
+				offA := image.Pt(rnd.Intn(200)-100, rnd.Intn(200)-100)
+				offB := image.Pt(rnd.Intn(200)-100, rnd.Intn(200)-100)
+				res, err := CompareResult(d, shifted(a, offA, kind), shifted(b, offB, kind))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.N != want.N || res.DiffBounds != want.DiffBounds {
+					t.Errorf("%T %s %v %v: N = %d, DiffBounds = %v; want %d, %v",
+						d, kind, offA, offB, res.N, res.DiffBounds, want.N, want.DiffBounds)
+				}
+				if res.OffsetA != offA || res.OffsetB != offB {
+					t.Errorf("%T %s: offsets = %v, %v; want %v, %v", d, kind, res.OffsetA, res.OffsetB, offA, offB)
+				}
+				if res.Diff.Bounds() != a.Bounds() {
+					t.Errorf("%T %s: Diff.Bounds = %v", d, kind, res.Diff.Bounds())
+				}
+				if !bytes.Equal(res.Diff.(*image.NRGBA).Pix, want.Diff.(*image.NRGBA).Pix) {
+					t.Errorf("%T %s %v %v: diff images differ", d, kind, offA, offB)
+				}
+			}
+		}
+	}
+	res, err := CompareResult(NewBinary(), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.DiffBounds != image.Rect(20, 10, 25, 14) {
+		t.Errorf("binary: DiffBounds = %v; want %v", res.DiffBounds, image.Rect(20, 10, 25, 14))
+	}
+}
+
+func TestCompareResultEqual(t *testing.T) {
+	m := image.NewGray(image.Rect(3, 4, 10, 10))
+	res, err := CompareResult(NewBinary(), m, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.N != 0 || !res.DiffBounds.Empty() {
+		t.Errorf("N = %d, DiffBounds = %v; want 0, empty", res.N, res.DiffBounds)
+	}
+	if _, err := CompareResult(NewBinary(), m, image.NewGray(image.Rect(0, 0, 7, 7))); err != ErrSize {
+		t.Errorf("err = %v; want ErrSize", err)
+	}
+}
+
+func TestCompareResultScore(t *testing.T) {
+	a := image.NewGray(image.Rect(0, 0, 40, 30))
+	b := image.NewGray(a.Rect)
+	for x := 0; x < 12; x++ {
+		b.SetGray(x, 7, color.Gray{0xff})
+	}
+	for _, d := range []Differ{NewBinary(), NewBinaryFuzz(2), NewDefaultPerceptual()} {
+		if _, ok := d.(ResultDiffer); !ok {
+			t.Errorf("%T is not a ResultDiffer", d)
+		}
+		res, err := CompareResult(d, a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.N != 12 || res.Total != 1200 || res.Percent != 1 || res.Score != 0.99 {
+			t.Errorf("%T: N = %d, Total = %d, Percent = %g, Score = %g; want 12, 1200, 1, 0.99",
+				d, res.N, res.Total, res.Percent, res.Score)
+		}
+		if want := image.Rect(0, 7, 12, 8); res.DiffBounds != want {
+			t.Errorf("%T: DiffBounds = %v; want %v", d, res.DiffBounds, want)
+		}
+	}
+	res, err := CompareResult(NewBinary(), a, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Percent != 0 || res.Score != 1 {
+		t.Errorf("same images: Percent = %g, Score = %g; want 0, 1", res.Percent, res.Score)
+	}
+	// hash distances are out of the bits of a hash
+	res, err = CompareResult(NewAHash(0), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 64 || res.Score != 1-float64(res.N)/64 {
+		t.Errorf("ahash: N = %d, Total = %d, Score = %g", res.N, res.Total, res.Score)
+	}
+	res, err = CompareResult(NewBinary(), image.NewGray(image.Rectangle{}), image.NewGray(image.Rectangle{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 0 || res.Percent != 0 || res.Score != 1 {
+		t.Errorf("empty images: Total = %d, Percent = %g, Score = %g; want 0, 0, 1", res.Total, res.Percent, res.Score)
+	}
+}
+
+func TestCompareIncremental(t *testing.T) {
+	tests := []struct {
+		name string
+		d    Differ
+		kind string
+	}{
+		{"binary", NewBinary(), "nrgba"},
+		{"binary float", NewBinary(), "float"},
+		{"binary generic", NewBinary(), "generic"},
+		{"binary tolerance", NewBinary(WithChannelTolerance(0x80, 0x80, 0x80, 0x80)), "nrgba"},
+		{"binary alpha", NewBinary(WithAlphaMode(IgnoreAlpha)), "nrgba"},
+		{"binary aa", NewBinary(WithAntiAliasing()), "nrgba"},
+		{"binary delta", NewBinary(WithDeltaColors()), "generic"},
+		{"binary luma", NewBinary(WithLuminanceOnly(), WithChannelTolerance(8, 8, 8, 0)), "nrgba"},
+		{"perceptual", NewDefaultPerceptual(), "nrgba"},
+		{"perceptual sub", NewDefaultPerceptual(), "sub"},
+		{"perceptual float32", NewDefaultPerceptual(WithFloat32()), "nrgba"},
+		{"perceptual alpha", NewDefaultPerceptual(WithAlphaMode(PremultiplyFirst)), "nrgba"},
+		{"perceptual delta", NewDefaultPerceptual(WithDeltaColors()), "sub"},
+		{"binary heatmap", NewBinary(WithHeatmap()), "nrgba"},
+		{"perceptual heatmap", NewDefaultPerceptual(WithHeatmap()), "sub"},
+		{"perceptual overlay", NewDefaultPerceptual(WithOverlay(BaseB, 0.3)), "nrgba"},
+		{"perceptual gray", NewDefaultPerceptual(), "gray"},
+		{"perceptual gray float32", NewDefaultPerceptual(WithFloat32()), "gray"},
+		// pyramids of parts of the images
+		{"perceptual levels", NewDefaultPerceptual(WithPyramidLevels(3)), "sub"},
+		{"perceptual levels float32", NewDefaultPerceptual(WithPyramidLevels(4), WithFloat32()), "nrgba"},
+		// compared in full
+		{"binary shift", NewBinary(WithShiftTolerance(1)), "nrgba"},
+		{"perceptual shift", NewDefaultPerceptual(WithShiftTolerance(1)), "nrgba"},
+	}
+	for _, test := range tests {
+		rnd := rand.New(rand.NewSource(1))
+		r := image.Rect(0, 0, 97, 61)
+		a, b := image.NewNRGBA(r), image.NewNRGBA(r)
+		rnd.Read(a.Pix)
+		copy(b.Pix, a.Pix)
+		off := image.Pt(5, -3)
+		prev, err := CompareResult(test.d, shifted(a, off, test.kind), shifted(b, off, test.kind))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			var changed []image.Rectangle
+			for j := rnd.Intn(3); j >= 0; j-- {
+				x, y := rnd.Intn(110)-10, rnd.Intn(70)-5
+				c := image.Rect(x, y, x+1+rnd.Intn(20), y+1+rnd.Intn(20))
+				changed = append(changed, c)
+				// change a few pixels of either image
+				m := b
+				if rnd.Intn(2) == 0 {
+					m = a
+				}
+				c = c.Intersect(r)
+				for k := 0; k < 5 && !c.Empty(); k++ {
+					p := m.PixOffset(c.Min.X+rnd.Intn(c.Dx()), c.Min.Y+rnd.Intn(c.Dy()))
+					rnd.Read(m.Pix[p : p+4])
+				}
+			}
+			ma, mb := shifted(a, off, test.kind), shifted(b, off, test.kind)
+			got, err := CompareIncremental(prev, ma, mb, changed)
+			if err != nil {
+				t.Fatalf("%s: (%d) %v", test.name, i, err)
+			}
+			want, err := CompareResult(test.d, ma, mb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.N != want.N || got.DiffBounds != want.DiffBounds || got.Score != want.Score {
+				t.Errorf("%s: (%d) N = %d, DiffBounds = %v, Score = %g; want %d, %v, %g",
+					test.name, i, got.N, got.DiffBounds, got.Score, want.N, want.DiffBounds, want.Score)
+			}
+			if got.OffsetA != off || got.OffsetB != off {
+				t.Errorf("%s: (%d) offsets = %v, %v; want %v", test.name, i, got.OffsetA, got.OffsetB, off)
+			}
+			if !bytes.Equal(got.Diff.(*image.NRGBA).Pix, want.Diff.(*image.NRGBA).Pix) {
+				t.Errorf("%s: (%d) diff images differ, changed %v", test.name, i, changed)
+			}
+			prev = got
+		}
+	}
+}
+
+func TestCompareIncrementalFallback(t *testing.T) {
+	a := image.NewGray(image.Rect(0, 0, 10, 10))
+	prev, err := CompareResult(NewBinary(), a, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// different size: compared in full
+	b := image.NewGray(image.Rect(0, 0, 12, 10))
+	b.SetGray(11, 0, color.Gray{1})
+	res, err := CompareIncremental(prev, b, image.NewGray(b.Rect), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.N != 1 || res.Diff.Bounds() != image.Rect(0, 0, 12, 10) {
+		t.Errorf("N = %d, bounds = %v; want 1, %v", res.N, res.Diff.Bounds(), image.Rect(0, 0, 12, 10))
+	}
+	if _, err := CompareIncremental(&Result{Diff: prev.Diff}, a, a, nil); err == nil {
+		t.Error("result without a differ: no error")
+	}
+}
+
+// otherDiffer is a Differ not created by this package.
+type otherDiffer struct {
+	Differ
+}
+
+func TestResultTimings(t *testing.T) {
+	a, err := readTestImage("fish1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readTestImage("fish2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		d          Differ
+		perceptual bool
+	}{
+		{NewBinary(), false},
+		{otherDiffer{NewDefaultPerceptual()}, false},
+		{NewDefaultPerceptual(), true},
+		{NewDefaultPerceptual(WithLowMemory()), true},
+		{NewDefaultPerceptual(WithFloat32()), true},
+	}
+	for i, test := range tests {
+		res, err := CompareResult(test.d, a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tm := res.Timings
+		if tm.Compare <= 0 || tm.Bounds <= 0 || tm.Total <= 0 {
+			t.Errorf("(%d) %T: timings not set: %+v", i, test.d, tm)
+		}
+		if test.perceptual != (tm.Convert > 0 && tm.Pyramid > 0) {
+			t.Errorf("(%d) %T: convert and pyramid timings: %+v", i, test.d, tm)
+		}
+		// the rest is allocations, mostly
+		sum := tm.Convert + tm.Pyramid + tm.Compare + tm.Bounds
+		if sum > tm.Total || sum < tm.Total/2 {
+			t.Errorf("(%d) %T: sum of phases %v; total %v", i, test.d, sum, tm.Total)
+		}
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	const w, h = 200, 100
+	for i, d := range []Differ{NewDefaultPerceptual(), NewDefaultPerceptual(WithFloat32()), NewBinary()} {
+		tm := Benchmark(d, w, h, 3)
+		_, perceptual := d.(*perceptual)
+		if tm.Compare <= 0 || tm.Bounds <= 0 || tm.Total <= 0 || perceptual && (tm.Convert <= 0 || tm.Pyramid <= 0) {
+			t.Errorf("(%d) %T: timings not set: %v", i, d, tm)
+		}
+		sum := tm.Convert + tm.Pyramid + tm.Compare + tm.Bounds
+		if sum > tm.Total || sum < tm.Total/2 {
+			t.Errorf("(%d) %T: sum of phases %v; total %v", i, d, sum, tm.Total)
+		}
+		if pps, want := tm.PixelsPerSecond(w, h), w*h/tm.Total.Seconds(); pps != want {
+			t.Errorf("(%d) %T: PixelsPerSecond = %v; want %v", i, d, pps, want)
+		}
+	}
+	if tm := Benchmark(NewDefaultPerceptual(WithKernel([]float64{1, 2})), w, h, 1); tm != (PhaseTimings{}) {
+		t.Errorf("invalid kernel: %v; want zero timings", tm)
+	}
+}
+
+// bigImage is an image with large bounds and no pixels.
+type bigImage struct {
+	image.Image
+	r image.Rectangle
+}
+
+func (m bigImage) Bounds() image.Rectangle {
+	return m.r
+}
+
+func TestTooLarge(t *testing.T) {
+	// 20000 x 12501 is just above 250 megapixels
+	m := bigImage{image.NewGray(image.Rect(0, 0, 1, 1)), image.Rect(-5, 0, 19995, 12501)}
+	for _, d := range []Differ{NewBinary(), NewDefaultPerceptual(), NewDefaultSSIM()} {
+		_, _, err := d.Compare(m, m)
+		e, ok := err.(*TooLargeError)
+		if !ok {
+			t.Fatalf("%T: err = %v; want a *TooLargeError", d, err)
+		}
+		if e.Pixels != 20000*12501 || e.Limit != MaxPixels {
+			t.Errorf("%T: err = %+v", d, e)
+		}
+		if !errors.Is(err, ErrTooLarge) {
+			t.Errorf("%T: errors.Is(%v, ErrTooLarge) = false", d, err)
+		}
+	}
+	if err := newOptions([]Option{WithUnlimited()}).checkSize(m.r); err != nil {
+		t.Errorf("WithUnlimited: %v", err)
+	}
+	if err := newOptions(nil).checkSize(image.Rect(0, 0, 20000, 12500)); err != nil {
+		t.Errorf("exactly MaxPixels: %v", err)
+	}
+}
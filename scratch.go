@@ -0,0 +1,127 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import "image"
+
+// compareScratch holds buffers used by a single perceptual Compare
+// of w x h images. They are pooled by the differ and reused by
+// later calls with the same dimensions. All buffers are fully
+// overwritten by every Compare, so nothing leaks between calls.
+type compareScratch struct {
+	w, h int
+	a, b *imageScratch
+	// used instead of a and b with WithFloat32
+	a32, b32 *imageScratch32
+	// one for each band of rows compared concurrently
+	rows *rowScratches
+}
+
+// imageScratch holds LAB colors and the Laplacian pyramid of an image.
+type imageScratch struct {
+	// colors of the last image, in buf or empty if it's grayscale
+	lab labImage
+	// allocated by the first labLap of an image which isn't grayscale
+	buf labImage
+	// lap[0] is luminance
+	lap [][][]float64
+	// kept for later images of the same size, see fill and convert
+	conv     *convolution
+	convRows [][]float64
+	row      []pixel
+}
+
+// newImageScratch allocates all levels of the pyramid as a single
+// slice, and their rows as another one.
+func newImageScratch(w, h, levels int) *imageScratch {
+	s := &imageScratch{lap: make([][][]float64, levels)}
+	n, nrows := pyramidSize(w, h, levels)
+	plane := make([]float64, n)
+	rows := make([][]float64, nrows)
+	for l := range s.lap {
+		lw, lh := levelSize(w, l), levelSize(h, l)
+		s.lap[l], rows = rows[:lh:lh], rows[lh:]
+		for y := range s.lap[l] {
+			s.lap[l][y], plane = plane[:lw:lw], plane[lw:]
+		}
+	}
+	return s
+}
+
+// pyramidSize returns the number of samples and rows of a pyramid
+// of a w x h image.
+func pyramidSize(w, h, levels int) (n, rows int) {
+	for l := 0; l < levels; l++ {
+		n += levelSize(w, l) * levelSize(h, l)
+		rows += levelSize(h, l)
+	}
+	return n, rows
+}
+
+// labLap fills s with LAB colors and the pyramid of m made with kernel k,
+// using up to n goroutines.
+func (s *imageScratch) labLap(m image.Image, lut *gammaLUT, lum float64, k []float64, n int) {
+	s.convert(m, lut, lum)
+	s.fill(k, 0, n, nil)
+}
+
+// fill is fillPyramid of s.lap, reusing the convolution and row
+// buffers of earlier calls. Scratch belongs to a single differ,
+// so k is the same for every call. Levels built are reported to prog.
+func (s *imageScratch) fill(k []float64, tile, n int, prog *progress) {
+	h, w := len(s.lap[0]), len(s.lap[0][0])
+	c := s.conv
+	if c == nil || c.tile != tile {
+		c = newConvolution(k, w, h, tile)
+		s.conv, s.convRows = c, nil
+	}
+	n = bands(levelSize(h, 1), n)
+	if len(s.convRows) < n {
+		s.convRows = c.newRows(n)
+	}
+	c.fill(s.lap, s.convRows[:n], prog)
+}
+
+// convert fills s with LAB colors and luminance of m,
+// the first level of its pyramid.
+func (s *imageScratch) convert(m image.Image, lut *gammaLUT, lum float64) {
+	if s.buf.a == nil && !isGray(m) {
+		s.buf = newLabImage(len(s.lap[0]) * len(s.lap[0][0]))
+	}
+	if s.row == nil {
+		s.row = make([]pixel, len(s.lap[0][0]))
+	}
+	s.lab = labRowsBuf(s.lap[0], s.buf, m, lut, lum, 0, s.row)
+}
+
+// getScratch returns pooled buffers for comparing w x h images,
+// or new ones if there are none of the right size.
+func (d *perceptual) getScratch(w, h int) *compareScratch {
+	s, ok := d.scratch.Get().(*compareScratch)
+	if !ok || s.w != w || s.h != h {
+		s = &compareScratch{w: w, h: h, rows: new(rowScratches)}
+		switch {
+		case d.ref != nil:
+			// shared by all calls, and only read
+			s.a, s.b = d.ref, newImageScratch(w, h, d.lap.levels)
+		case d.opts.float32 && d.opts.shiftTolerance <= 0:
+			s.a32, s.b32 = newImageScratch32(w, h, d.lap.levels), newImageScratch32(w, h, d.lap.levels)
+		default:
+			s.a, s.b = newImageScratch(w, h, d.lap.levels), newImageScratch(w, h, d.lap.levels)
+		}
+	}
+	// values of rows only depend on d and w
+	return s
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"image"
+)
+
+// MaxShiftTolerance is the largest radius accepted by WithShiftTolerance.
+// Each different pixel is tried against up to (2n+1)² pixels, so
+// larger ones would take forever rather than tolerate more.
+const MaxShiftTolerance = 1024
+
+// validShiftTolerance returns an error if WithShiftTolerance
+// is larger than MaxShiftTolerance.
+func (o options) validShiftTolerance() error {
+	if o.shiftTolerance > MaxShiftTolerance {
+		return fmt.Errorf("imgdiff: shift tolerance %d is larger than %d", o.shiftTolerance, MaxShiftTolerance)
+	}
+	return nil
+}
+
+// tolerateShift unmarks pixels of rows [y0, y1) of diff which are marked
+// as different, but for which near reports that they match a pixel
+// within reach in the other image, and returns their number.
+func tolerateShift(diff *image.NRGBA, y0, y1 int, near func(x, y int) bool) int {
+	n := 0
+	for y := y0; y < y1; y++ {
+		out := diff.Pix[diff.PixOffset(0, y):]
+		for x := 0; x < diff.Rect.Dx(); x++ {
+			p := out[4*x : 4*x+4]
+			if p[0]|p[1]|p[2] == 0 && p[3] == 0xff {
+				continue
+			}
+			if isTolerPixel(p) {
+				// within WithChannelTolerance, not counted
+				continue
+			}
+			if near(x, y) {
+				copy(p, passPixel[:])
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// shiftRadius returns r, or the larger of w and h if r is larger:
+// windows of a w x h image don't grow beyond that.
+func shiftRadius(r, w, h int) int {
+	if m := max(w, h); r > m {
+		return m
+	}
+	return r
+}
+
+// shiftWindow returns bounds [x0, x1) and [y0, y1) of the pixels
+// within r pixels of x, y, clipped to a w x h image.
+func shiftWindow(x, y, r, w, h int) (x0, x1, y0, y1 int) {
+	r = shiftRadius(r, w, h)
+	x0, x1 = clampRows(x-r, x+r+1, w)
+	y0, y1 = clampRows(y-r, y+r+1, h)
+	return x0, x1, y0, y1
+}
+
+// matchesNear reports whether pixel x, y matches, according to match,
+// any pixel of the other image within r pixels of it, both ways:
+// match(x, y, qx, qy, true) compares pixel x, y of the first image
+// with pixel qx, qy of the second one, and with false the other way
+// around. The pixel itself is not tried again.
+func matchesNear(x, y, r, w, h int, match func(x, y, qx, qy int, fromA bool) bool) bool {
+	x0, x1, y0, y1 := shiftWindow(x, y, r, w, h)
+	for _, fromA := range []bool{true, false} {
+		found := false
+		for qy := y0; qy < y1 && !found; qy++ {
+			for qx := x0; qx < x1; qx++ {
+				if (qx != x || qy != y) && match(x, y, qx, qy, fromA) {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// rowWindow holds pixels of rows of an image within a sliding window
+// of 2r+1 rows, so that each row is read once while rows are visited
+// from top to bottom.
+type rowWindow struct {
+	m    image.Image
+	rows [][]pixel
+	// row held by rows[i], -1 if none
+	ys []int
+}
+
+func newRowWindow(m image.Image, r int) *rowWindow {
+	b := m.Bounds()
+	r = shiftRadius(r, b.Dx(), b.Dy())
+	w := &rowWindow{m: m, rows: make([][]pixel, 2*r+1), ys: make([]int, 2*r+1)}
+	for i := range w.rows {
+		w.rows[i] = make([]pixel, b.Dx())
+		w.ys[i] = -1
+	}
+	return w
+}
+
+// row returns pixels of row y of the image, counted from its top.
+func (w *rowWindow) row(y int) []pixel {
+	i := y % len(w.rows)
+	if w.ys[i] != y {
+		b := w.m.Bounds()
+		readRow(w.rows[i], w.m, b.Min.X, b.Min.Y+y)
+		w.ys[i] = y
+	}
+	return w.rows[i]
+}
@@ -0,0 +1,160 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+)
+
+// translate returns a copy of m with its content moved by dx, dy,
+// filling in uncovered pixels with the nearest ones of m.
+func translate(m image.Image, dx, dy int) *image.NRGBA {
+	r := m.Bounds()
+	t := image.NewNRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			sx, sy := x-dx, y-dy
+			if sx < r.Min.X {
+				sx = r.Min.X
+			} else if sx >= r.Max.X {
+				sx = r.Max.X - 1
+			}
+			if sy < r.Min.Y {
+				sy = r.Min.Y
+			} else if sy >= r.Max.Y {
+				sy = r.Max.Y - 1
+			}
+			t.Set(x, y, m.At(sx, sy))
+		}
+	}
+	return t
+}
+
+// blocks returns a w x h image of random colored blocks of 3 x 3 pixels.
+func blocks(w, h int) *image.NRGBA {
+	rnd := rand.New(rand.NewSource(1))
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y += 3 {
+		for x := 0; x < w; x += 3 {
+			c := color.NRGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 0xff}
+			draw.Draw(m, image.Rect(x, y, x+3, y+3), image.NewUniform(c), image.ZP, draw.Src)
+		}
+	}
+	return m
+}
+
+func TestShiftTolerance(t *testing.T) {
+	a := blocks(60, 45)
+	square := func(m *image.NRGBA) *image.NRGBA {
+		draw.Draw(m, image.Rect(20, 20, 28, 28), image.NewUniform(color.White), image.ZP, draw.Src)
+		return m
+	}
+	tests := []struct {
+		b      image.Image
+		radius int
+		// whether any pixels are different
+		diff bool
+	}{
+		{translate(a, 1, 0), 0, true},
+		{translate(a, 1, 0), 1, false},
+		{translate(a, -1, 1), 1, false},
+		{translate(a, 0, -2), 2, false},
+		{translate(a, 2, 0), 1, true},
+		{translate(a, 2, 2), 3, false},
+		// real changes are still found
+		{square(translate(a, 1, 0)), 1, true},
+		{square(translate(a, 0, 0)), 1, true},
+		// floats are compared with their tolerance
+		{floatImage{translate(a, 1, 1)}, 1, false},
+	}
+	for i, test := range tests {
+		b := test.b
+		var aa image.Image = a
+		if _, ok := b.(FloatImage); ok {
+			aa = floatImage{a}
+		}
+		for _, d := range []Differ{
+			NewBinary(WithShiftTolerance(test.radius)),
+			NewDefaultPerceptual(WithShiftTolerance(test.radius)),
+		} {
+			diff, n, err := d.Compare(aa, b)
+			if err != nil {
+				t.Fatalf("(%d) %T: %v", i, d, err)
+			}
+			if (n > 0) != test.diff {
+				t.Errorf("(%d) %T: n = %d; want different %v", i, d, n, test.diff)
+			}
+			marks := 0
+			for y := 0; y < 45; y++ {
+				for x := 0; x < 60; x++ {
+					if marked(diff.At(x, y)) {
+						marks++
+					}
+				}
+			}
+			if marks != n {
+				t.Errorf("(%d) %T: %d marked pixels; want n = %d", i, d, marks, n)
+			}
+		}
+	}
+}
+
+func TestShiftToleranceWorkers(t *testing.T) {
+	a := blocks(100, 130)
+	b := translate(a, 1, 1)
+	draw.Draw(b, image.Rect(30, 40, 50, 90), image.NewUniform(color.White), image.ZP, draw.Src)
+	for _, newDiffer := range []func(...Option) Differ{NewBinary, NewDefaultPerceptual} {
+		want, wantN, err := newDiffer(WithShiftTolerance(1), WithMaxWorkers(1)).Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, opt := range []Option{WithMaxWorkers(4), WithLowMemory(), WithFloat32()} {
+			got, n, err := newDiffer(WithShiftTolerance(1), opt).Compare(a, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != wantN || !bytes.Equal(got.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+				t.Errorf("n = %d; want %d with the same diff", n, wantN)
+			}
+		}
+	}
+}
+
+func TestShiftToleranceLimit(t *testing.T) {
+	a := blocks(9, 9)
+	b := translate(a, 3, 0)
+	for _, newDiffer := range []func(...Option) Differ{NewBinary, NewDefaultPerceptual} {
+		// windows are no larger than the images
+		_, n, err := newDiffer(WithShiftTolerance(MaxShiftTolerance)).Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, want, err := newDiffer(WithShiftTolerance(9)).Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("n = %d; want %d", n, want)
+		}
+		if _, _, err := newDiffer(WithShiftTolerance(1<<40)).Compare(a, b); err == nil {
+			t.Error("shift tolerance 1<<40: no error")
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// sideBySideLabelHeight is the height of the label strip above each
+// image of RenderSideBySide, in pixels.
+const sideBySideLabelHeight = 16
+
+var (
+	sideBySideBackground = color.NRGBA{0x80, 0x80, 0x80, 0xff}
+	sideBySideLabelColor = color.NRGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+// RenderSideBySide composes a, b and diff, e.g. the images passed to
+// Compare and its difference image, into a single image: in a row, or
+// in a column if the images are wider than tall, gap pixels apart.
+// Images of different sizes are aligned at their tops in a row, and
+// at their left sides in a column. With label set, each image has
+// a strip above it with its name, "A", "B" or "DIFF". The background
+// is a neutral gray, which transparent pixels show too.
+func RenderSideBySide(a, b, diff image.Image, gap int, label bool) image.Image {
+	ims := [3]image.Image{a, b, diff}
+	var sizes [3]image.Point
+	for i, m := range ims {
+		sizes[i] = m.Bounds().Size()
+	}
+	labelH := 0
+	if label {
+		labelH = sideBySideLabelHeight
+	}
+	cells, size := sideBySideLayout(sizes, gap, labelH)
+	dst := image.NewNRGBA(image.Rectangle{Max: size})
+	draw.Draw(dst, dst.Rect, image.NewUniform(sideBySideBackground), image.Point{}, draw.Src)
+	fd := &font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(sideBySideLabelColor),
+		Face: basicfont.Face7x13,
+	}
+	for i, m := range ims {
+		draw.Draw(dst, cells[i], m, m.Bounds().Min, draw.Over)
+		if label {
+			fd.Dot = fixed.P(cells[i].Min.X+2, cells[i].Min.Y-labelH+basicfont.Face7x13.Ascent+1)
+			fd.DrawString([...]string{"A", "B", "DIFF"}[i])
+		}
+	}
+	return dst
+}
+
+// sideBySideLayout returns the rectangles images of the given sizes
+// are drawn at by RenderSideBySide, each below a label strip of height
+// labelH, and the size of the whole image.
+func sideBySideLayout(sizes [3]image.Point, gap, labelH int) (cells [3]image.Rectangle, size image.Point) {
+	if gap < 0 {
+		gap = 0
+	}
+	var max image.Point
+	for _, s := range sizes {
+		if s.X > max.X {
+			max.X = s.X
+		}
+		if s.Y > max.Y {
+			max.Y = s.Y
+		}
+	}
+	column := max.X > max.Y
+	var p image.Point
+	for i, s := range sizes {
+		if i > 0 {
+			if column {
+				p.Y += gap
+			} else {
+				p.X += gap
+			}
+		}
+		min := p.Add(image.Pt(0, labelH))
+		cells[i] = image.Rectangle{min, min.Add(s)}
+		if column {
+			p.Y = cells[i].Max.Y
+		} else {
+			p.X = cells[i].Max.X
+		}
+	}
+	if column {
+		return cells, image.Pt(max.X, p.Y)
+	}
+	return cells, image.Pt(p.X, labelH+max.Y)
+}
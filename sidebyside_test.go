@@ -0,0 +1,91 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSideBySideLayout(t *testing.T) {
+	r := image.Rect
+	tests := []struct {
+		sizes      [3]image.Point
+		gap, label int
+		cells      [3]image.Rectangle
+		size       image.Point
+	}{
+		// tall images in a row
+		{[3]image.Point{{10, 20}, {10, 20}, {10, 20}}, 4, 0, [3]image.Rectangle{r(0, 0, 10, 20), r(14, 0, 24, 20), r(28, 0, 38, 20)}, image.Pt(38, 20)},
+		{[3]image.Point{{10, 20}, {10, 20}, {10, 20}}, 4, 16, [3]image.Rectangle{r(0, 16, 10, 36), r(14, 16, 24, 36), r(28, 16, 38, 36)}, image.Pt(38, 36)},
+		// square ones too
+		{[3]image.Point{{8, 8}, {8, 8}, {8, 8}}, 0, 0, [3]image.Rectangle{r(0, 0, 8, 8), r(8, 0, 16, 8), r(16, 0, 24, 8)}, image.Pt(24, 8)},
+		// wide ones in a column
+		{[3]image.Point{{30, 10}, {30, 10}, {30, 10}}, 2, 16, [3]image.Rectangle{r(0, 16, 30, 26), r(0, 44, 30, 54), r(0, 72, 30, 82)}, image.Pt(30, 82)},
+		// different aspect ratios, aligned at the top
+		{[3]image.Point{{10, 20}, {12, 6}, {10, 20}}, 1, 0, [3]image.Rectangle{r(0, 0, 10, 20), r(11, 0, 23, 6), r(24, 0, 34, 20)}, image.Pt(34, 20)},
+		// and at the left
+		{[3]image.Point{{40, 10}, {20, 30}, {40, 10}}, 1, 0, [3]image.Rectangle{r(0, 0, 40, 10), r(0, 11, 20, 41), r(0, 42, 40, 52)}, image.Pt(40, 52)},
+		// negative gaps are none
+		{[3]image.Point{{2, 4}, {2, 4}, {2, 4}}, -3, 0, [3]image.Rectangle{r(0, 0, 2, 4), r(2, 0, 4, 4), r(4, 0, 6, 4)}, image.Pt(6, 4)},
+	}
+	for i, test := range tests {
+		cells, size := sideBySideLayout(test.sizes, test.gap, test.label)
+		if cells != test.cells || size != test.size {
+			t.Errorf("%d: cells %v, size %v; want %v, %v", i, cells, size, test.cells, test.size)
+		}
+	}
+}
+
+func TestRenderSideBySide(t *testing.T) {
+	a := image.NewGray(image.Rect(5, 5, 15, 25))
+	b := image.NewNRGBA(image.Rect(0, 0, 12, 6))
+	for i := range b.Pix {
+		b.Pix[i] = 0xff
+	}
+	diff := image.NewNRGBA(image.Rect(0, 0, 10, 20))
+	m := RenderSideBySide(a, b, diff, 1, true).(*image.NRGBA)
+	if got, want := m.Bounds(), image.Rect(0, 0, 34, 36); got != want {
+		t.Fatalf("bounds %v; want %v", got, want)
+	}
+	gray := color.NRGBA{0x80, 0x80, 0x80, 0xff}
+	for _, test := range []struct {
+		x, y int
+		want color.NRGBA
+	}{
+		{0, 16, color.NRGBA{0, 0, 0, 0xff}},
+		{10, 20, gray}, // gap
+		{11, 16, color.NRGBA{0xff, 0xff, 0xff, 0xff}},
+		{11, 30, gray}, // below b
+		{24, 16, gray}, // transparent diff
+	} {
+		if c := m.NRGBAAt(test.x, test.y); c != test.want {
+			t.Errorf("pixel %d,%d = %v; want %v", test.x, test.y, c, test.want)
+		}
+	}
+	// labels are drawn in the strip above
+	light := 0
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 16; y++ {
+			if m.NRGBAAt(x, y).R > 0x80 {
+				light++
+			}
+		}
+	}
+	if light == 0 {
+		t.Error("no label above a")
+	}
+}
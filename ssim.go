@@ -0,0 +1,260 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"image"
+	"sync"
+)
+
+// DefaultSSIMThreshold is the default min local structural similarity
+// of pixels which are not counted as different, see WithSSIMThreshold.
+const DefaultSSIMThreshold = 0.95
+
+type ssim struct {
+	// width and height of the window
+	window int
+	// stabilizing constants, for the dynamic range of 1
+	c1, c2 float64
+	// invalid window size, returned by Compare
+	err  error
+	opts options
+}
+
+// NewSSIM creates a new Differ based on structural similarity (SSIM)
+// of luminance, as described by Wang et al. in "Image quality assessment:
+// from error visibility to structural similarity", IEEE TIP 2004.
+//
+// Local similarity of every pixel is computed over a windowSize x windowSize
+// window centered on it. Windows are clipped at image borders, so that
+// images of any size can be compared. k1 and k2 are the constants
+// stabilizing the division of the SSIM formula, 0.01 and 0.03 in the paper.
+// Pixels with similarity below WithSSIMThreshold are counted as different.
+//
+// In the difference image, pixels which are not different are black as
+// with the other algorithms, and different ones are red, the darker the
+// lower their similarity.
+//
+// Compare returns an error if windowSize is less than 1.
+func NewSSIM(windowSize int, k1, k2 float64, opts ...Option) Differ {
+	d := &ssim{
+		window: windowSize,
+		c1:     k1 * k1,
+		c2:     k2 * k2,
+		opts:   newOptions(opts),
+	}
+	if windowSize < 1 {
+		d.err = fmt.Errorf("imgdiff: invalid SSIM window size %d", windowSize)
+	}
+	return d
+}
+
+// NewDefaultSSIM returns the result of calling NewSSIM with:
+//
+//	windowSize = 8
+//	k1 = 0.01
+//	k2 = 0.03
+func NewDefaultSSIM(opts ...Option) Differ {
+	return NewSSIM(8, 0.01, 0.03, opts...)
+}
+
+// Compare compares a and b using structural similarity.
+func (d *ssim) Compare(a, b image.Image) (image.Image, int, error) {
+	return d.compareTimed(a, b, new(PhaseTimings))
+}
+
+// CompareInto is Compare writing the difference image to dst.
+func (d *ssim) CompareInto(dst *image.NRGBA, a, b image.Image) (int, error) {
+	return d.compareInto(dst, a, b, new(PhaseTimings))
+}
+
+func (d *ssim) compareTimed(a, b image.Image, t *PhaseTimings) (image.Image, int, error) {
+	diff := new(image.NRGBA)
+	n, err := d.compareInto(diff, a, b, t)
+	if err != nil {
+		return nil, -1, err
+	}
+	return diff, n, nil
+}
+
+func (d *ssim) compareInto(diff *image.NRGBA, a, b image.Image, t *PhaseTimings) (int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	if w != bb.Dx() || h != bb.Dy() {
+		return -1, ErrSize
+	}
+	if d.err != nil {
+		return -1, d.err
+	}
+	if err := d.opts.checkSize(ab); err != nil {
+		return -1, err
+	}
+	resize(diff, w, h)
+	if sameImage(a, b) {
+		fillPass(diff)
+		return 0, nil
+	}
+
+	p := newPhases("ssim", ab, t)
+	var la, lb []float64
+	p.run("convert", &t.Convert, func() {
+		parallel(d.opts.workers(), func(int) {
+			la = luma(a)
+		}, func(int) {
+			lb = luma(b)
+		})
+	})
+	var npix int
+	p.run("compare", &t.Compare, func() {
+		npix = forBands(d.opts.workers(), h, func(y0, y1 int) int {
+			return d.compareRows(diff, la, lb, y0, y1)
+		})
+	})
+	return npix, nil
+}
+
+// luma returns luminance of pixels of m, y*w+x indexed, in [0, 1].
+// Pixels are composited over black, as their premultiplied colors are.
+func luma(m image.Image) []float64 {
+	b := m.Bounds()
+	w := b.Dx()
+	l := make([]float64, w*b.Dy())
+	row := make([]pixel, w)
+	for y := 0; y < b.Dy(); y++ {
+		readRow(row, m, b.Min.X, b.Min.Y+y)
+		for x, p := range row {
+			l[y*w+x] = (0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])) / 0xffff
+		}
+	}
+	return l
+}
+
+// compareRows writes rows [y0, y1) of diff out of luminance la and lb
+// of the compared images and returns the number of different pixels.
+func (d *ssim) compareRows(diff *image.NRGBA, la, lb []float64, y0, y1 int) int {
+	w, h := diff.Rect.Dx(), diff.Rect.Dy()
+	s := newSSIMRows(w)
+	l, cs := make([]float64, w), make([]float64, w)
+	npix := 0
+	for y := y0; y < y1; y++ {
+		d.terms(s, la, lb, w, h, y, l, cs)
+		out := diff.Pix[diff.PixOffset(0, y):]
+		for x := range l {
+			c := passPixel
+			if v := l[x] * cs[x]; v < d.opts.ssimThreshold {
+				c = ssimPixel(v, d.opts.ssimThreshold)
+				npix++
+			}
+			copy(out[4*x:], c[:])
+		}
+	}
+	return npix
+}
+
+// ssimRows holds buffers for computing local SSIM a row at a time.
+// Sums over windows are made of sums of columns of the window rows,
+// which are summed along the row into prefix sums.
+type ssimRows struct {
+	// column sums of a, b, a*a, b*b and a*b, and their prefix sums
+	cols, sums [5][]float64
+}
+
+func newSSIMRows(w int) *ssimRows {
+	s := new(ssimRows)
+	for i := range s.cols {
+		s.cols[i] = make([]float64, w)
+		s.sums[i] = make([]float64, w+1)
+	}
+	return s
+}
+
+// terms sets l and cs to the luminance and contrast-structure terms
+// of local SSIM of pixels of row y of w x h luminance planes la and lb.
+// Local SSIM is their product.
+func (d *ssim) terms(s *ssimRows, la, lb []float64, w, h, y int, l, cs []float64) {
+	lo, hi := clampRows(y-d.window/2, y-d.window/2+d.window, h)
+	cols := s.cols
+	for i := range cols {
+		for x := range cols[i] {
+			cols[i][x] = 0
+		}
+	}
+	for wy := lo; wy < hi; wy++ {
+		ra, rb := la[wy*w:(wy+1)*w], lb[wy*w:(wy+1)*w]
+		for x, va := range ra {
+			vb := rb[x]
+			cols[0][x] += va
+			cols[1][x] += vb
+			cols[2][x] += va * va
+			cols[3][x] += vb * vb
+			cols[4][x] += va * vb
+		}
+	}
+	sums := s.sums
+	for i := range sums {
+		for x, v := range cols[i] {
+			sums[i][x+1] = sums[i][x] + v
+		}
+	}
+	for x := range l {
+		x0, x1 := clampRows(x-d.window/2, x-d.window/2+d.window, w)
+		n := float64((x1 - x0) * (hi - lo))
+		var m [5]float64
+		for i := range m {
+			m[i] = (sums[i][x1] - sums[i][x0]) / n
+		}
+		ma, mb := m[0], m[1]
+		va, vb, cov := m[2]-ma*ma, m[3]-mb*mb, m[4]-ma*mb
+		l[x] = (2*ma*mb + d.c1) / (ma*ma + mb*mb + d.c1)
+		cs[x] = (2*cov + d.c2) / (va + vb + d.c2)
+	}
+}
+
+// forBands splits h rows into bands, calls f with bounds [y0, y1) of each
+// one concurrently, using up to n goroutines, and returns the sum
+// of the results.
+func forBands(n, h int, f func(y0, y1 int) int) int {
+	n = bands(h, n)
+	res := make([]int, n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			res[i] = f(i*h/n, (i+1)*h/n)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	sum := 0
+	for _, v := range res {
+		sum += v
+	}
+	return sum
+}
+
+// ssimPixel returns the color of a different pixel of similarity s,
+// below threshold t: red, from the darkest at s <= 0 to almost
+// failPixel at s close to t.
+func ssimPixel(s, t float64) [4]uint8 {
+	if s < 0 {
+		s = 0
+	}
+	v := 0x40
+	if t > 0 {
+		v += int(0xbf * s / t)
+	}
+	return [4]uint8{uint8(v), 0, 0, 0xff}
+}
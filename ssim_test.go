@@ -0,0 +1,215 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// ssimRef computes local SSIM of every pixel of a and b directly.
+func ssimRef(a, b image.Image, window int, k1, k2 float64) [][]float64 {
+	r := a.Bounds()
+	w, h := r.Dx(), r.Dy()
+	la, lb := luma(a), luma(b)
+	s := make([][]float64, h)
+	for y := range s {
+		s[y] = make([]float64, w)
+		for x := range s[y] {
+			var ma, mb, n float64
+			for wy := y - window/2; wy < y-window/2+window; wy++ {
+				for wx := x - window/2; wx < x-window/2+window; wx++ {
+					if wx >= 0 && wx < w && wy >= 0 && wy < h {
+						ma += la[wy*w+wx]
+						mb += lb[wy*w+wx]
+						n++
+					}
+				}
+			}
+			ma, mb = ma/n, mb/n
+			var va, vb, cov float64
+			for wy := y - window/2; wy < y-window/2+window; wy++ {
+				for wx := x - window/2; wx < x-window/2+window; wx++ {
+					if wx >= 0 && wx < w && wy >= 0 && wy < h {
+						da, db := la[wy*w+wx]-ma, lb[wy*w+wx]-mb
+						va += da * da
+						vb += db * db
+						cov += da * db
+					}
+				}
+			}
+			va, vb, cov = va/n, vb/n, cov/n
+			c1, c2 := k1*k1, k2*k2
+			s[y][x] = (2*ma*mb + c1) * (2*cov + c2) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+		}
+	}
+	return s
+}
+
+func TestSSIM(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	tests := []struct {
+		r      image.Rectangle
+		window int
+	}{
+		{image.Rect(0, 0, 32, 16), 8},
+		// not multiples of the window size
+		{image.Rect(3, 5, 40, 18), 8},
+		{image.Rect(0, 0, 13, 7), 5},
+		{image.Rect(0, 0, 13, 7), 4},
+		// larger than the images
+		{image.Rect(0, 0, 13, 7), 20},
+		{image.Rect(0, 0, 1, 1), 8},
+		{image.Rect(0, 0, 9, 9), 1},
+	}
+	for i, test := range tests {
+		a := image.NewNRGBA(test.r)
+		for j := range a.Pix {
+			// smooth, so that similarity varies
+			a.Pix[j] = uint8(j/4%7*20 + j/4/test.r.Dx()*5)
+			if j%4 == 3 {
+				a.Pix[j] = 0xff
+			}
+		}
+		b := image.NewNRGBA(test.r)
+		copy(b.Pix, a.Pix)
+		for j := 0; j < len(b.Pix)/40+1; j++ {
+			b.Pix[rnd.Intn(len(b.Pix)/4)*4] = uint8(rnd.Intn(0x100))
+		}
+		d := NewSSIM(test.window, 0.01, 0.03, WithMaxWorkers(3))
+		diff, n, err := d.Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref := ssimRef(a, b, test.window, 0.01, 0.03)
+		m := diff.(*image.NRGBA)
+		want := 0
+		for y, row := range ref {
+			for x, s := range row {
+				c := m.NRGBAAt(x, y)
+				// values near the threshold may round either way
+				if s < DefaultSSIMThreshold-1e-9 && c == (color.NRGBA{0, 0, 0, 0xff}) ||
+					s > DefaultSSIMThreshold+1e-9 && c != (color.NRGBA{0, 0, 0, 0xff}) {
+					t.Errorf("(%d) pixel (%d, %d) = %v; ssim %v", i, x, y, c, s)
+				}
+				if s < DefaultSSIMThreshold {
+					want++
+				}
+			}
+		}
+		if n != want {
+			t.Errorf("(%d) n = %d; want %d", i, n, want)
+		}
+		if marked := countMarked(m, m.Rect); marked != n {
+			t.Errorf("(%d) %d marked pixels; n = %d", i, marked, n)
+		}
+	}
+}
+
+func TestSSIMColors(t *testing.T) {
+	// failing pixels are darker the lower their similarity
+	prev := failPixel
+	for _, s := range []float64{0.9, 0.5, 0.2, 0} {
+		c := ssimPixel(s, DefaultSSIMThreshold)
+		if c[0] >= prev[0] || c[0] == 0 || c[1]|c[2] != 0 || c[3] != 0xff {
+			t.Errorf("ssimPixel(%v) = %v; previous %v", s, c, prev)
+		}
+		prev = c
+	}
+	// negative similarity is as low as it gets
+	if c := ssimPixel(-0.5, DefaultSSIMThreshold); c != prev {
+		t.Errorf("ssimPixel(-0.5) = %v; want %v", c, prev)
+	}
+	if c := ssimPixel(-1, -0.5); c != [4]uint8{0x40, 0, 0, 0xff} {
+		t.Errorf("ssimPixel(-1, -0.5) = %v", c)
+	}
+}
+
+func TestSSIMErrors(t *testing.T) {
+	a := image.NewGray(image.Rect(0, 0, 10, 10))
+	if _, _, err := NewDefaultSSIM().Compare(a, image.NewGray(image.Rect(0, 0, 10, 11))); err != ErrSize {
+		t.Errorf("err = %v; want ErrSize", err)
+	}
+	if _, _, err := NewSSIM(0, 0.01, 0.03).Compare(a, a); err == nil {
+		t.Error("window size 0: no error")
+	}
+	// identical pixels of different types
+	b := image.NewRGBA(a.Rect)
+	for i := range b.Pix {
+		b.Pix[i] = 0xff
+	}
+	c := image.NewGray(a.Rect)
+	for i := range c.Pix {
+		c.Pix[i] = 0xff
+	}
+	if _, n, err := NewDefaultSSIM(WithSSIMThreshold(1)).Compare(b, c); err != nil || n != 0 {
+		t.Errorf("equal images: n = %d, %v; want 0", n, err)
+	}
+}
+
+func TestMSSSIM(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := func(r image.Rectangle) *image.NRGBA {
+		m := image.NewNRGBA(r)
+		rnd.Read(m.Pix)
+		return m
+	}
+	// a single scale is SSIM
+	a, b := random(image.Rect(0, 0, 37, 23)), random(image.Rect(0, 0, 37, 23))
+	want, wantN, err := NewDefaultSSIM().Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, n, err := NewMSSSIM(1).Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != wantN || !bytes.Equal(got.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+		t.Errorf("1 scale: n = %d; want %d, the same diff as SSIM", n, wantN)
+	}
+
+	// small images are compared at fewer scales:
+	// 9 rows can be downsampled twice, to 5 and 3 rows
+	a, b = random(image.Rect(0, 0, 40, 9)), random(image.Rect(0, 0, 40, 9))
+	want, wantN, err = NewMSSSIM(3).Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for scales := 4; scales <= 5; scales++ {
+		got, n, err := NewMSSSIM(scales).Compare(a, b)
+		if err != nil {
+			t.Fatalf("%d scales: %v", scales, err)
+		}
+		if n != wantN || !bytes.Equal(got.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+			t.Errorf("%d scales: n = %d; want %d, the same diff as 3 scales", scales, n, wantN)
+		}
+	}
+	if got, _, _ := NewMSSSIM(2).Compare(a, b); bytes.Equal(got.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+		t.Error("2 and 3 scales: the same diff")
+	}
+	one := random(image.Rect(0, 0, 1, 1))
+	if _, _, err := NewMSSSIM(5).Compare(one, random(one.Rect)); err != nil {
+		t.Errorf("1x1 images: %v", err)
+	}
+
+	for _, scales := range []int{0, 6} {
+		if _, _, err := NewMSSSIM(scales).Compare(a, b); err == nil {
+			t.Errorf("%d scales: no error", scales)
+		}
+	}
+}
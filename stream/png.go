@@ -0,0 +1,616 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stream
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+)
+
+// PNG color types.
+const (
+	ctGray      = 0
+	ctRGB       = 2
+	ctPaletted  = 3
+	ctGrayAlpha = 4
+	ctRGBA      = 6
+)
+
+// PNGReader decodes a non-interlaced PNG image one row at a time.
+// Decoded rows have the same types and colors as those of images
+// decoded by package image/png.
+type PNGReader struct {
+	c      *chunks
+	z      io.ReadCloser
+	bounds image.Rectangle
+	ctype  int
+	depth  int
+	bpp    int // bytes per pixel used by filters, at least 1
+	trns   []byte
+	pal    color.Palette
+	npal   int    // number of palette entries in the file
+	gray   []byte // unscaled gray samples of transparent gray images
+
+	cur, prev []byte // filter type byte followed by row data
+	y         int    // next row
+	row       image.Image
+}
+
+// NewPNGReader reads the PNG header from r, up to the first image data.
+// Rows are read from r by ReadRow.
+func NewPNGReader(r io.Reader) (*PNGReader, error) {
+	var sig [len(pngHeader)]byte
+	if _, err := io.ReadFull(r, sig[:]); err != nil || string(sig[:]) != pngHeader {
+		return nil, ErrFormat
+	}
+	d := &PNGReader{c: &chunks{r: r, crc: crc32.NewIEEE()}}
+	if err := d.c.next(); err != nil {
+		return nil, err
+	}
+	if d.c.typ != "IHDR" {
+		return nil, ErrFormat
+	}
+	if err := d.parseIHDR(); err != nil {
+		return nil, err
+	}
+	for {
+		if err := d.c.next(); err != nil {
+			return nil, err
+		}
+		var err error
+		switch d.c.typ {
+		case "PLTE":
+			err = d.parsePLTE()
+		case "tRNS":
+			err = d.parseTRNS()
+		case "IDAT":
+			return d, d.start()
+		case "IEND":
+			return nil, ErrFormat
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (d *PNGReader) parseIHDR() error {
+	var hdr [13]byte
+	if d.c.n != len(hdr) {
+		return ErrFormat
+	}
+	if _, err := io.ReadFull(d.c, hdr[:]); err != nil {
+		return err
+	}
+	w, h := binary.BigEndian.Uint32(hdr[0:]), binary.BigEndian.Uint32(hdr[4:])
+	if w == 0 || h == 0 || w > 1<<24 || h > 1<<31-1 {
+		return ErrFormat
+	}
+	d.bounds = image.Rect(0, 0, int(w), int(h))
+	d.depth, d.ctype = int(hdr[8]), int(hdr[9])
+	if hdr[10] != 0 || hdr[11] != 0 {
+		return ErrFormat
+	}
+	if hdr[12] != 0 {
+		return UnsupportedError("interlaced PNG")
+	}
+	var channels int
+	switch d.ctype {
+	case ctGray:
+		channels = 1
+	case ctRGB:
+		channels = 3
+	case ctPaletted:
+		channels = 1
+	case ctGrayAlpha:
+		channels = 2
+	case ctRGBA:
+		channels = 4
+	default:
+		return ErrFormat
+	}
+	switch d.depth {
+	case 1, 2, 4:
+		if d.ctype != ctGray && d.ctype != ctPaletted {
+			return ErrFormat
+		}
+	case 8:
+	case 16:
+		if d.ctype == ctPaletted {
+			return ErrFormat
+		}
+	default:
+		return ErrFormat
+	}
+	bits := channels * d.depth
+	d.bpp = (bits + 7) / 8
+	n := 1 + (int(w)*bits+7)/8
+	d.cur, d.prev = make([]byte, n), make([]byte, n)
+	return nil
+}
+
+func (d *PNGReader) parsePLTE() error {
+	if d.c.n%3 != 0 || d.c.n > 3*256 || d.c.n == 0 {
+		return ErrFormat
+	}
+	buf := make([]byte, d.c.n)
+	if _, err := io.ReadFull(d.c, buf); err != nil {
+		return err
+	}
+	if d.ctype != ctPaletted {
+		// a suggested palette of true color images
+		return nil
+	}
+	// out of range indices are opaque black, as in image/png
+	d.npal = len(buf) / 3
+	d.pal = make(color.Palette, 256)
+	for i := range d.pal {
+		d.pal[i] = color.RGBA{0, 0, 0, 0xff}
+	}
+	for i := 0; i < len(buf)/3; i++ {
+		d.pal[i] = color.RGBA{buf[3*i], buf[3*i+1], buf[3*i+2], 0xff}
+	}
+	return nil
+}
+
+func (d *PNGReader) parseTRNS() error {
+	buf := make([]byte, d.c.n)
+	if _, err := io.ReadFull(d.c, buf); err != nil {
+		return err
+	}
+	switch d.ctype {
+	case ctGray:
+		if len(buf) != 2 {
+			return ErrFormat
+		}
+	case ctRGB:
+		if len(buf) != 6 {
+			return ErrFormat
+		}
+	case ctPaletted:
+		if d.pal == nil || len(buf) > d.npal {
+			return ErrFormat
+		}
+		for i, a := range buf {
+			c := d.pal[i].(color.RGBA)
+			d.pal[i] = color.NRGBA{c.R, c.G, c.B, a}
+		}
+	default:
+		return ErrFormat
+	}
+	d.trns = buf
+	return nil
+}
+
+// start begins decoding of image data, the first IDAT chunk
+// of which has just been read, and allocates the row image.
+func (d *PNGReader) start() error {
+	if d.ctype == ctPaletted && d.pal == nil {
+		return ErrFormat
+	}
+	z, err := zlib.NewReader(idatReader{d.c})
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	d.z = z
+	r := image.Rect(0, 0, d.bounds.Dx(), 1)
+	switch {
+	case d.ctype == ctPaletted:
+		d.row = image.NewPaletted(r, d.pal)
+	case d.ctype == ctGray && d.trns == nil && d.depth <= 8:
+		d.row = image.NewGray(r)
+	case d.ctype == ctGray && d.trns == nil:
+		d.row = image.NewGray16(r)
+	case d.ctype == ctRGB && d.trns == nil && d.depth == 8:
+		d.row = image.NewRGBA(r)
+	case d.ctype == ctRGB && d.trns == nil:
+		d.row = image.NewRGBA64(r)
+	case d.ctype == ctGray && d.depth <= 8:
+		d.gray = make([]byte, d.bounds.Dx())
+		d.row = image.NewNRGBA(r)
+	case d.depth <= 8:
+		d.row = image.NewNRGBA(r)
+	default:
+		d.row = image.NewNRGBA64(r)
+	}
+	return nil
+}
+
+// Bounds returns the image bounds, which always start at (0, 0).
+func (d *PNGReader) Bounds() image.Rectangle {
+	return d.bounds
+}
+
+// ColorModel returns the color model of decoded rows.
+func (d *PNGReader) ColorModel() color.Model {
+	return d.row.ColorModel()
+}
+
+// ReadRow decodes the next row. The returned image is reused
+// by subsequent calls. It returns io.EOF after the last row.
+func (d *PNGReader) ReadRow() (image.Image, error) {
+	if d.y >= d.bounds.Max.Y {
+		return nil, io.EOF
+	}
+	if _, err := io.ReadFull(d.z, d.cur); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if err := unfilter(d.cur, d.prev, d.bpp); err != nil {
+		return nil, err
+	}
+	d.convert(d.cur[1:])
+	d.prev, d.cur = d.cur, d.prev
+	d.y++
+	return d.row, nil
+}
+
+// convert converts row samples into pixels of the row image,
+// moving it to the current row.
+func (d *PNGReader) convert(src []byte) {
+	w := d.bounds.Dx()
+	r := image.Rect(0, d.y, w, d.y+1)
+	switch m := d.row.(type) {
+	case *image.Paletted:
+		m.Rect = r
+		unpack(m.Pix, src, d.depth, 1)
+	case *image.Gray:
+		m.Rect = r
+		unpack(m.Pix, src, d.depth, 0xff/(1<<uint(d.depth)-1))
+	case *image.Gray16:
+		m.Rect = r
+		copy(m.Pix, src)
+	case *image.RGBA:
+		m.Rect = r
+		for x := 0; x < w; x++ {
+			copy(m.Pix[4*x:4*x+3], src[3*x:])
+			m.Pix[4*x+3] = 0xff
+		}
+	case *image.RGBA64:
+		m.Rect = r
+		for x := 0; x < w; x++ {
+			copy(m.Pix[8*x:8*x+6], src[6*x:])
+			m.Pix[8*x+6], m.Pix[8*x+7] = 0xff, 0xff
+		}
+	case *image.NRGBA:
+		m.Rect = r
+		switch d.ctype {
+		case ctGray:
+			unpack(d.gray, src, d.depth, 1)
+			scale := uint8(0xff / (1<<uint(d.depth) - 1))
+			for x, v := range d.gray {
+				a := uint8(0xff)
+				if v == d.trns[1] {
+					a = 0
+				}
+				v *= scale
+				m.Pix[4*x], m.Pix[4*x+1], m.Pix[4*x+2], m.Pix[4*x+3] = v, v, v, a
+			}
+		case ctRGB:
+			for x := 0; x < w; x++ {
+				p := src[3*x : 3*x+3]
+				a := uint8(0xff)
+				if p[0] == d.trns[1] && p[1] == d.trns[3] && p[2] == d.trns[5] {
+					a = 0
+				}
+				m.Pix[4*x], m.Pix[4*x+1], m.Pix[4*x+2], m.Pix[4*x+3] = p[0], p[1], p[2], a
+			}
+		case ctGrayAlpha:
+			for x := 0; x < w; x++ {
+				v, a := src[2*x], src[2*x+1]
+				m.Pix[4*x], m.Pix[4*x+1], m.Pix[4*x+2], m.Pix[4*x+3] = v, v, v, a
+			}
+		case ctRGBA:
+			copy(m.Pix, src)
+		}
+	case *image.NRGBA64:
+		m.Rect = r
+		switch d.ctype {
+		case ctGray:
+			for x := 0; x < w; x++ {
+				v0, v1 := src[2*x], src[2*x+1]
+				a := uint8(0xff)
+				if v0 == d.trns[0] && v1 == d.trns[1] {
+					a = 0
+				}
+				p := m.Pix[8*x : 8*x+8]
+				p[0], p[1], p[2], p[3], p[4], p[5], p[6], p[7] = v0, v1, v0, v1, v0, v1, a, a
+			}
+		case ctRGB:
+			for x := 0; x < w; x++ {
+				p := m.Pix[8*x : 8*x+8]
+				copy(p, src[6*x:6*x+6])
+				p[6], p[7] = 0xff, 0xff
+				if string(src[6*x:6*x+6]) == string(d.trns) {
+					p[6], p[7] = 0, 0
+				}
+			}
+		case ctGrayAlpha:
+			for x := 0; x < w; x++ {
+				p := m.Pix[8*x : 8*x+8]
+				v0, v1 := src[4*x], src[4*x+1]
+				p[0], p[1], p[2], p[3], p[4], p[5] = v0, v1, v0, v1, v0, v1
+				p[6], p[7] = src[4*x+2], src[4*x+3]
+			}
+		case ctRGBA:
+			copy(m.Pix, src)
+		}
+	}
+}
+
+// unpack unpacks len(dst) samples of depth bits from src,
+// multiplying them by scale.
+func unpack(dst, src []byte, depth int, scale uint8) {
+	if depth == 8 {
+		copy(dst, src)
+		return
+	}
+	perByte := 8 / depth
+	mask := byte(1<<uint(depth) - 1)
+	for x := range dst {
+		shift := uint(8 - depth*(x%perByte+1))
+		dst[x] = (src[x/perByte] >> shift & mask) * scale
+	}
+}
+
+// unfilter reverts the filter of cur, given the previous row prev.
+// Both start with the filter type byte.
+func unfilter(cur, prev []byte, bpp int) error {
+	c, p := cur[1:], prev[1:]
+	switch cur[0] {
+	case 0:
+	case 1: // sub
+		for i := bpp; i < len(c); i++ {
+			c[i] += c[i-bpp]
+		}
+	case 2: // up
+		for i := range c {
+			c[i] += p[i]
+		}
+	case 3: // average
+		for i := 0; i < bpp; i++ {
+			c[i] += p[i] / 2
+		}
+		for i := bpp; i < len(c); i++ {
+			c[i] += uint8((int(c[i-bpp]) + int(p[i])) / 2)
+		}
+	case 4: // Paeth
+		for i := 0; i < bpp; i++ {
+			c[i] += p[i]
+		}
+		for i := bpp; i < len(c); i++ {
+			c[i] += paeth(c[i-bpp], p[i], p[i-bpp])
+		}
+	default:
+		return ErrFormat
+	}
+	return nil
+}
+
+// paeth returns the Paeth predictor of left a, above b and upper left c.
+func paeth(a, b, c uint8) uint8 {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// chunks reads PNG chunks, verifying their checksums.
+// Data of the current chunk is read with Read.
+type chunks struct {
+	r   io.Reader
+	crc hash.Hash32
+	typ string // current chunk type
+	n   int    // unread bytes of the current chunk data
+}
+
+// next skips the rest of the current chunk, if any, and reads
+// the header of the following one.
+func (c *chunks) next() error {
+	var buf [8]byte
+	if c.typ != "" {
+		if _, err := io.CopyN(c.crc, c.r, int64(c.n)); err != nil {
+			return unexpected(err)
+		}
+		if _, err := io.ReadFull(c.r, buf[:4]); err != nil {
+			return unexpected(err)
+		}
+		if binary.BigEndian.Uint32(buf[:4]) != c.crc.Sum32() {
+			return ErrFormat
+		}
+	}
+	if _, err := io.ReadFull(c.r, buf[:]); err != nil {
+		return unexpected(err)
+	}
+	n := binary.BigEndian.Uint32(buf[:4])
+	if n > 1<<31-1 {
+		return ErrFormat
+	}
+	c.typ, c.n = string(buf[4:]), int(n)
+	c.crc.Reset()
+	c.crc.Write(buf[4:])
+	return nil
+}
+
+// Read reads data of the current chunk. It returns io.EOF at its end.
+func (c *chunks) Read(p []byte) (int, error) {
+	if c.n == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	c.n -= n
+	if err == io.EOF {
+		err = nil
+		if c.n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// idatReader reads data of consecutive IDAT chunks.
+type idatReader struct {
+	c *chunks
+}
+
+func (r idatReader) Read(p []byte) (int, error) {
+	for r.c.n == 0 {
+		if r.c.typ != "IDAT" {
+			return 0, io.EOF
+		}
+		if err := r.c.next(); err != nil {
+			return 0, err
+		}
+	}
+	if r.c.typ != "IDAT" {
+		return 0, io.EOF
+	}
+	return r.c.Read(p)
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// PNGWriter encodes an 8-bit non-premultiplied RGBA PNG image
+// one row at a time, such as a difference image written by
+// imgdiff.CompareStream. Close must be called after the last row.
+type PNGWriter struct {
+	w      io.Writer
+	width  int
+	height int
+	y      int           // next row
+	bw     *bufio.Writer // buffers zlib output into large IDAT chunks
+	z      *zlib.Writer
+	buf    []byte // filter type byte followed by row data
+	err    error  // sticky write error
+}
+
+// NewPNGWriter returns a writer of a width x height image to w.
+// The header is written along with the first row.
+func NewPNGWriter(w io.Writer, width, height int) *PNGWriter {
+	return &PNGWriter{w: w, width: width, height: height, buf: make([]byte, 1+4*width)}
+}
+
+// WriteRow encodes the next row of the image, the leftmost width
+// pixels of the topmost row of m.
+func (e *PNGWriter) WriteRow(m *image.NRGBA) error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.y >= e.height {
+		return fmt.Errorf("stream: row %d is out of image bounds", e.y)
+	}
+	if m.Rect.Dx() < e.width || m.Rect.Dy() < 1 {
+		return fmt.Errorf("stream: row %d is too short: %v", e.y, m.Rect)
+	}
+	if e.y == 0 {
+		e.writeHeader()
+	}
+	copy(e.buf[1:], m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):])
+	if e.err == nil {
+		_, e.err = e.z.Write(e.buf)
+	}
+	e.y++
+	return e.err
+}
+
+// Close finishes the image data and writes the trailing chunk.
+// It returns an error if fewer than height rows were written.
+func (e *PNGWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.y != e.height || e.y == 0 {
+		return fmt.Errorf("stream: wrote %d of %d rows", e.y, e.height)
+	}
+	if e.err = e.z.Close(); e.err != nil {
+		return e.err
+	}
+	if e.err = e.bw.Flush(); e.err != nil {
+		return e.err
+	}
+	e.err = writeChunk(e.w, "IEND", nil)
+	return e.err
+}
+
+func (e *PNGWriter) writeHeader() {
+	if _, e.err = io.WriteString(e.w, pngHeader); e.err != nil {
+		return
+	}
+	var hdr [13]byte
+	binary.BigEndian.PutUint32(hdr[0:], uint32(e.width))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(e.height))
+	hdr[8], hdr[9] = 8, ctRGBA
+	if e.err = writeChunk(e.w, "IHDR", hdr[:]); e.err != nil {
+		return
+	}
+	e.bw = bufio.NewWriterSize(idatWriter{e.w}, 1<<16)
+	e.z = zlib.NewWriter(e.bw)
+}
+
+// idatWriter writes data as IDAT chunks, one per call.
+type idatWriter struct {
+	w io.Writer
+}
+
+func (w idatWriter) Write(p []byte) (int, error) {
+	if err := writeChunk(w.w, "IDAT", p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func writeChunk(w io.Writer, typ string, data []byte) error {
+	buf := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], typ)
+	buf = append(buf, data...)
+	buf = buf[:len(buf)+4]
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], crc32.ChecksumIEEE(buf[4:len(buf)-4]))
+	_, err := w.Write(buf)
+	return err
+}
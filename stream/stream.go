@@ -0,0 +1,76 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stream provides row by row decoding of PNG and TIFF images,
+// and row by row encoding of PNG difference images, for use with
+// imgdiff.CompareStream.
+//
+// Decoding a huge image, such as a high resolution scan, at once may need
+// more memory than available. Readers of this package hold only a couple
+// of rows of a PNG image, or a single strip of a TIFF image, in memory
+// at a time, regardless of the image height.
+//
+// Interlaced PNGs cannot be decoded row by row and are not supported.
+// TIFFs are limited to the baseline subset supported by package tifftile.
+package stream
+
+import (
+	"bufio"
+	"errors"
+	"io"
+
+	"github.com/crhym3/imgdiff"
+)
+
+var (
+	// ErrFormat is returned when the input is not a valid image.
+	ErrFormat = errors.New("stream: invalid image")
+)
+
+// UnsupportedError is returned for images using features
+// this package does not implement.
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string {
+	return "stream: unsupported " + string(e)
+}
+
+const (
+	pngHeader    = "\x89PNG\r\n\x1a\n"
+	tiffHeaderLE = "II\x2a\x00"
+	tiffHeaderBE = "MM\x00\x2a"
+)
+
+// NewReader returns a reader of a PNG or TIFF image read from r,
+// detected by its signature. TIFF images are only supported if r
+// implements io.ReaderAt, such as *os.File, because their data can be
+// laid out in any order.
+func NewReader(r io.Reader) (imgdiff.RowReader, error) {
+	br := bufio.NewReader(r)
+	sig, err := br.Peek(len(pngHeader))
+	if err != nil && len(sig) < len(tiffHeaderLE) {
+		return nil, ErrFormat
+	}
+	switch s := string(sig); {
+	case s == pngHeader:
+		return NewPNGReader(br)
+	case s[:4] == tiffHeaderLE || s[:4] == tiffHeaderBE:
+		ra, ok := r.(io.ReaderAt)
+		if !ok {
+			return nil, UnsupportedError("TIFF without random access")
+		}
+		return NewTIFFReader(ra)
+	}
+	return nil, UnsupportedError("image format")
+}
@@ -0,0 +1,402 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stream
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/crhym3/imgdiff"
+	_ "golang.org/x/image/tiff"
+)
+
+func TestPNGReader(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	tests := []struct {
+		ctype, depth int
+		trns         bool
+	}{
+		{ctGray, 1, false},
+		{ctGray, 2, true},
+		{ctGray, 4, false},
+		{ctGray, 8, false},
+		{ctGray, 8, true},
+		{ctGray, 16, false},
+		{ctGray, 16, true},
+		{ctRGB, 8, false},
+		{ctRGB, 8, true},
+		{ctRGB, 16, false},
+		{ctRGB, 16, true},
+		{ctPaletted, 1, false},
+		{ctPaletted, 2, true},
+		{ctPaletted, 4, true},
+		{ctPaletted, 8, false},
+		{ctGrayAlpha, 8, false},
+		{ctGrayAlpha, 16, false},
+		{ctRGBA, 8, false},
+		{ctRGBA, 16, false},
+	}
+	for _, test := range tests {
+		name := fmt.Sprintf("color type %d, depth %d, tRNS %v", test.ctype, test.depth, test.trns)
+		data := encodePNG(rnd, 37, 21, test.ctype, test.depth, test.trns)
+		want, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		d, err := NewPNGReader(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if d.Bounds() != want.Bounds() {
+			t.Errorf("%s: bounds = %v; want %v", name, d.Bounds(), want.Bounds())
+			continue
+		}
+		for y := 0; y < d.Bounds().Dy(); y++ {
+			row, err := d.ReadRow()
+			if err != nil {
+				t.Errorf("%s: row %d: %v", name, y, err)
+				break
+			}
+			if a, b := fmt.Sprintf("%T", row), fmt.Sprintf("%T", want); a != b {
+				t.Errorf("%s: row type = %s; want %s", name, a, b)
+				break
+			}
+			if row.Bounds() != image.Rect(0, y, 37, y+1) {
+				t.Errorf("%s: row %d bounds = %v", name, y, row.Bounds())
+				break
+			}
+			for x := 0; x < 37; x++ {
+				if c, wc := row.At(x, y), want.At(x, y); c != wc {
+					t.Errorf("%s: (%d, %d) = %v; want %v", name, x, y, c, wc)
+				}
+			}
+		}
+		if _, err := d.ReadRow(); err != io.EOF {
+			t.Errorf("%s: ReadRow after the last row: %v; want io.EOF", name, err)
+		}
+	}
+}
+
+func TestPNGReaderErrors(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	data := encodePNG(rnd, 5, 5, ctRGB, 8, false)
+	for n := 0; n < len(data); n++ {
+		d, err := NewPNGReader(bytes.NewReader(data[:n]))
+		for y := 0; err == nil && y < 5; y++ {
+			_, err = d.ReadRow()
+		}
+		if err == nil {
+			// the trailing checksum and IEND may be missing
+			continue
+		}
+		if err != ErrFormat && err != io.ErrUnexpectedEOF && err != zlib.ErrChecksum {
+			t.Errorf("data[:%d]: err = %v", n, err)
+		}
+	}
+
+	interlaced := append([]byte(nil), data...)
+	interlaced[len(pngHeader)+8+12] = 1
+	binary.BigEndian.PutUint32(interlaced[len(pngHeader)+8+13:], crc(interlaced[len(pngHeader)+4:len(pngHeader)+8+13]))
+	if _, err := NewPNGReader(bytes.NewReader(interlaced)); err != UnsupportedError("interlaced PNG") {
+		t.Errorf("interlaced: err = %v", err)
+	}
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(pngHeader)+8] ^= 1
+	if _, err := NewPNGReader(bytes.NewReader(corrupt)); err != ErrFormat {
+		t.Errorf("corrupt IHDR: err = %v; want ErrFormat", err)
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	f, err := os.Open(filepath.Join("..", "testdata", "cam_mb.tif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := NewReader(f); err != nil {
+		t.Errorf("TIFF file: %v", err)
+	}
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hide ReadAt of bytes.Reader
+	r := struct{ io.Reader }{bytes.NewReader(data)}
+	if _, err := NewReader(r); err != UnsupportedError("TIFF without random access") {
+		t.Errorf("TIFF reader: err = %v", err)
+	}
+	if _, err := NewReader(bytes.NewReader([]byte("GIF89a"))); err == nil {
+		t.Errorf("GIF: no error")
+	}
+}
+
+func TestTIFFReaderTiled(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	src := image.NewGray(image.Rect(0, 0, 37, 21))
+	rnd.Read(src.Pix)
+	d, err := NewTIFFReader(bytes.NewReader(encodeTiledGray(src, 16, 8)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 21; y++ {
+		row, err := d.ReadRow()
+		if err != nil {
+			t.Fatalf("row %d: %v", y, err)
+		}
+		if row.Bounds() != image.Rect(0, y, 37, y+1) {
+			t.Errorf("row %d bounds = %v", y, row.Bounds())
+		}
+		for x := 0; x < 37; x++ {
+			if c, want := row.At(x, y), src.At(x, y); c != want {
+				t.Errorf("(%d, %d) = %v; want %v", x, y, c, want)
+			}
+		}
+	}
+	if _, err := d.ReadRow(); err != io.EOF {
+		t.Errorf("ReadRow after the last row: %v; want io.EOF", err)
+	}
+}
+
+func TestCompareStream(t *testing.T) {
+	tests := [][2]string{
+		{"fish1.png", "fish2.png"},
+		{"aqsis_vase.png", "aqsis_vase_ref.png"},
+		{"bug1102605.tif", "bug1102605_ref.tif"},
+		{"bug1471457.tif", "bug1471457_ref.tif"},
+		{"cam_mb.tif", "cam_mb_ref.tif"},
+	}
+	for _, test := range tests {
+		a, b := readTestImage(t, test[0]), readTestImage(t, test[1])
+		want, wantN, err := imgdiff.NewBinary().Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ra, fa := openTestImage(t, test[0])
+		defer fa.Close()
+		rb, fb := openTestImage(t, test[1])
+		defer fb.Close()
+		var buf bytes.Buffer
+		w := NewPNGWriter(&buf, ra.Bounds().Dx(), ra.Bounds().Dy())
+		n, err := imgdiff.CompareStream(ra, rb, w)
+		if err != nil {
+			t.Errorf("%s: %v", test[0], err)
+			continue
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("%s: Close: %v", test[0], err)
+			continue
+		}
+		if n != wantN {
+			t.Errorf("%s: n = %d; want %d", test[0], n, wantN)
+		}
+		diff, err := png.Decode(&buf)
+		if err != nil {
+			t.Errorf("%s: diff: %v", test[0], err)
+			continue
+		}
+		if !bytes.Equal(diff.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+			t.Errorf("%s: streamed diff image differs", test[0])
+		}
+	}
+}
+
+func TestCompareStreamMemory(t *testing.T) {
+	const w, h = 512, 4096
+	a, b := encodeStripes(w, h, -1), encodeStripes(w, h, 1000)
+	ra, err := NewPNGReader(bytes.NewReader(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb, err := NewPNGReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	n, err := imgdiff.CompareStream(ra, rb, nil)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != w {
+		t.Errorf("n = %d; want %d", n, w)
+	}
+	// a whole NRGBA image would take 8MB
+	if m := after.TotalAlloc - before.TotalAlloc; m > 1<<20 {
+		t.Errorf("allocated %d bytes", m)
+	}
+}
+
+// encodeStripes encodes a w x h gray image of horizontal stripes.
+// Pixels of the row odd, if any, are inverted.
+func encodeStripes(w, h, odd int) []byte {
+	var buf bytes.Buffer
+	e := NewPNGWriter(&buf, w, h)
+	row := image.NewNRGBA(image.Rect(0, 0, w, 1))
+	for y := 0; y < h; y++ {
+		v := uint8(y)
+		if y == odd {
+			v = ^v
+		}
+		for i := 0; i < len(row.Pix); i += 4 {
+			row.Pix[i], row.Pix[i+1], row.Pix[i+2], row.Pix[i+3] = v, v, v, 0xff
+		}
+		e.WriteRow(row)
+	}
+	e.Close()
+	return buf.Bytes()
+}
+
+// encodePNG encodes a random w x h non-interlaced PNG image
+// with random filter types.
+func encodePNG(rnd *rand.Rand, w, h, ctype, depth int, trns bool) []byte {
+	channels := map[int]int{ctGray: 1, ctRGB: 3, ctPaletted: 1, ctGrayAlpha: 2, ctRGBA: 4}[ctype]
+	var buf bytes.Buffer
+	buf.WriteString(pngHeader)
+	var hdr [13]byte
+	binary.BigEndian.PutUint32(hdr[0:], uint32(w))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(h))
+	hdr[8], hdr[9] = uint8(depth), uint8(ctype)
+	writeChunk(&buf, "IHDR", hdr[:])
+	if ctype == ctPaletted {
+		// some indices are out of the palette range
+		plte := make([]byte, 3*(1<<uint(depth)*3/4+1))
+		rnd.Read(plte)
+		writeChunk(&buf, "PLTE", plte)
+		if trns {
+			a := make([]byte, len(plte)/6+1)
+			rnd.Read(a)
+			writeChunk(&buf, "tRNS", a)
+		}
+	} else if trns {
+		// samples of a single bit are more likely to match
+		v := make([]byte, 2*channels)
+		for i := range v {
+			v[i] = uint8(rnd.Intn(2))
+		}
+		writeChunk(&buf, "tRNS", v)
+	}
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	row := make([]byte, 1+(w*channels*depth+7)/8)
+	for y := 0; y < h; y++ {
+		rnd.Read(row)
+		row[0] %= 5
+		if trns && depth >= 8 {
+			// unfiltered, so that some pixels are transparent
+			row[0] = 0
+			for i := 1; i < len(row); i++ {
+				row[i] &= 1
+			}
+		}
+		zw.Write(row)
+	}
+	zw.Close()
+	// split image data into a couple of IDAT chunks
+	data := z.Bytes()
+	writeChunk(&buf, "IDAT", data[:len(data)/3])
+	writeChunk(&buf, "IDAT", nil)
+	writeChunk(&buf, "IDAT", data[len(data)/3:])
+	writeChunk(&buf, "IEND", nil)
+	return buf.Bytes()
+}
+
+// encodeTiledGray encodes m as an uncompressed little-endian tiled TIFF
+// with tiles of tw x th.
+func encodeTiledGray(m *image.Gray, tw, th int) []byte {
+	b := m.Bounds()
+	cols, rows := (b.Dx()+tw-1)/tw, (b.Dy()+th-1)/th
+	var data bytes.Buffer
+	data.WriteString("II\x2a\x00\x08\x00\x00\x00")
+	// image directory of 8 entries, tile offsets and byte counts
+	const n = 8
+	tiles := data.Len() + 2 + 12*n + 4
+	pixels := tiles + 8*cols*rows
+	entry := func(tag, typ, count, value int) {
+		binary.Write(&data, binary.LittleEndian, []uint16{uint16(tag), uint16(typ)})
+		binary.Write(&data, binary.LittleEndian, []uint32{uint32(count), uint32(value)})
+	}
+	binary.Write(&data, binary.LittleEndian, uint16(n))
+	entry(256, 4, 1, b.Dx())                    // ImageWidth
+	entry(257, 4, 1, b.Dy())                    // ImageLength
+	entry(258, 3, 1, 8)                         // BitsPerSample
+	entry(262, 3, 1, 1)                         // PhotometricInterpretation
+	entry(322, 4, 1, tw)                        // TileWidth
+	entry(323, 4, 1, th)                        // TileLength
+	entry(324, 4, cols*rows, tiles)             // TileOffsets
+	entry(325, 4, cols*rows, tiles+4*cols*rows) // TileByteCounts
+	data.Write([]byte{0, 0, 0, 0})
+	for i := 0; i < cols*rows; i++ {
+		binary.Write(&data, binary.LittleEndian, uint32(pixels+i*tw*th))
+	}
+	for i := 0; i < cols*rows; i++ {
+		binary.Write(&data, binary.LittleEndian, uint32(tw*th))
+	}
+	for ty := 0; ty < rows; ty++ {
+		for tx := 0; tx < cols; tx++ {
+			for y := 0; y < th; y++ {
+				for x := 0; x < tw; x++ {
+					data.WriteByte(m.GrayAt(tx*tw+x, ty*th+y).Y)
+				}
+			}
+		}
+	}
+	return data.Bytes()
+}
+
+func crc(b []byte) uint32 {
+	var buf bytes.Buffer
+	writeChunk(&buf, string(b[:4]), b[4:])
+	return binary.BigEndian.Uint32(buf.Bytes()[buf.Len()-4:])
+}
+
+func readTestImage(t *testing.T, name string) image.Image {
+	f, err := os.Open(filepath.Join("..", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, _, err := image.Decode(f)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return m
+}
+
+func openTestImage(t *testing.T, name string) (imgdiff.RowReader, *os.File) {
+	f, err := os.Open(filepath.Join("..", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		t.Fatalf("%s: %v", name, err)
+	}
+	return r, f
+}
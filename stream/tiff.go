@@ -0,0 +1,159 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stream
+
+import (
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/crhym3/imgdiff/tifftile"
+)
+
+// TIFFReader decodes a TIFF image one row at a time.
+// Only the strip, or the row of tiles, holding the current row
+// is kept in memory.
+type TIFFReader struct {
+	m     *tifftile.Image
+	tiles []image.Rectangle
+	next  int           // index of the first tile of the next band
+	band  []image.Image // decoded tiles of the current band
+	y     int           // next row
+	row   image.Image   // assembled row of a tiled image
+}
+
+// NewTIFFReader reads the TIFF header and image directory from r.
+// See tifftile.OpenStrips for supported images.
+func NewTIFFReader(r io.ReaderAt) (*TIFFReader, error) {
+	m, err := tifftile.OpenStrips(r)
+	if err != nil {
+		return nil, err
+	}
+	return &TIFFReader{m: m, tiles: m.Tiles()}, nil
+}
+
+// Bounds returns the image bounds, which always start at (0, 0).
+func (d *TIFFReader) Bounds() image.Rectangle {
+	return d.m.Bounds()
+}
+
+// ColorModel returns the color model of decoded rows.
+func (d *TIFFReader) ColorModel() color.Model {
+	return d.m.ColorModel()
+}
+
+// ReadRow decodes the next row. The returned image is only valid
+// until the next call. It returns io.EOF after the last row.
+func (d *TIFFReader) ReadRow() (image.Image, error) {
+	b := d.m.Bounds()
+	if d.y >= b.Max.Y {
+		return nil, io.EOF
+	}
+	if len(d.band) == 0 || d.y >= d.band[0].Bounds().Max.Y {
+		if err := d.decodeBand(); err != nil {
+			return nil, err
+		}
+	}
+	r := image.Rect(b.Min.X, d.y, b.Max.X, d.y+1)
+	d.y++
+	if len(d.band) == 1 {
+		return d.band[0].(subImager).SubImage(r), nil
+	}
+	if d.row == nil {
+		d.row = newImage(d.band[0], image.Rect(0, 0, b.Dx(), 1))
+	}
+	dst, bpp := pix(d.row)
+	for _, t := range d.band {
+		tb := t.Bounds()
+		src, _ := pix(t.(subImager).SubImage(image.Rect(tb.Min.X, r.Min.Y, tb.Max.X, r.Max.Y)))
+		copy(dst[bpp*tb.Min.X:bpp*tb.Max.X], src)
+	}
+	setRect(d.row, r)
+	return d.row, nil
+}
+
+// decodeBand decodes all tiles of the next row of tiles.
+func (d *TIFFReader) decodeBand() error {
+	d.band = d.band[:0]
+	y := d.tiles[d.next].Min.Y
+	for ; d.next < len(d.tiles) && d.tiles[d.next].Min.Y == y; d.next++ {
+		t, err := d.m.Tile(d.next)
+		if err != nil {
+			return err
+		}
+		d.band = append(d.band, t)
+	}
+	return nil
+}
+
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+// newImage returns an image of the same type as m, with bounds r.
+// The type is one of those of tiles decoded by package tifftile.
+func newImage(m image.Image, r image.Rectangle) image.Image {
+	switch m.(type) {
+	case *image.Gray:
+		return image.NewGray(r)
+	case *image.Gray16:
+		return image.NewGray16(r)
+	case *image.RGBA:
+		return image.NewRGBA(r)
+	case *image.NRGBA:
+		return image.NewNRGBA(r)
+	case *image.RGBA64:
+		return image.NewRGBA64(r)
+	}
+	return image.NewNRGBA64(r)
+}
+
+// pix returns pixel data of m, starting at its top left pixel,
+// and the number of bytes per pixel.
+func pix(m image.Image) ([]uint8, int) {
+	switch m := m.(type) {
+	case *image.Gray:
+		return m.Pix, 1
+	case *image.Gray16:
+		return m.Pix, 2
+	case *image.RGBA:
+		return m.Pix, 4
+	case *image.NRGBA:
+		return m.Pix, 4
+	case *image.RGBA64:
+		return m.Pix, 8
+	case *image.NRGBA64:
+		return m.Pix, 8
+	}
+	return nil, 0
+}
+
+// setRect moves m, which is one of the types returned by newImage, to r.
+func setRect(m image.Image, r image.Rectangle) {
+	switch m := m.(type) {
+	case *image.Gray:
+		m.Rect = r
+	case *image.Gray16:
+		m.Rect = r
+	case *image.RGBA:
+		m.Rect = r
+	case *image.NRGBA:
+		m.Rect = r
+	case *image.RGBA64:
+		m.Rect = r
+	case *image.NRGBA64:
+		m.Rect = r
+	}
+}
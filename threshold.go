@@ -0,0 +1,104 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Threshold limits how many pixels may differ between two images,
+// as an absolute number of pixels, a percentage of all pixels, or both.
+//
+// With both limits set, a Threshold is exceeded only if both are.
+// This allows a handful of pixels to differ in small images, and
+// a small fraction of them in large ones. A negative limit is not set.
+// A Threshold with no limits is never exceeded.
+//
+// The zero value is exceeded by any difference.
+// *Threshold implements flag.Value.
+type Threshold struct {
+	// Pixels is the max number of different pixels.
+	Pixels float64
+	// Percent is the max percentage of different pixels, e.g. 0.5.
+	Percent float64
+}
+
+// ParseThreshold parses a threshold in the form of "N", "P%" or "N,P%",
+// e.g. "200", "0.5%" or "200,0.5%". An empty string is the zero Threshold.
+// Limits must be finite and not negative, and percentages at most 100.
+func ParseThreshold(s string) (Threshold, error) {
+	if s == "" {
+		return Threshold{}, nil
+	}
+	t := Threshold{Pixels: -1, Percent: -1}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		percent := strings.HasSuffix(part, "%")
+		v, err := strconv.ParseFloat(strings.TrimSuffix(part, "%"), 64)
+		if err != nil || v < 0 || math.IsNaN(v) || math.IsInf(v, 0) || percent && v > 100 {
+			return Threshold{}, fmt.Errorf("imgdiff: invalid threshold %q", s)
+		}
+		switch {
+		case percent && t.Percent < 0:
+			t.Percent = v
+		case !percent && t.Pixels < 0:
+			t.Pixels = v
+		default:
+			return Threshold{}, fmt.Errorf("imgdiff: repeated limit in threshold %q", s)
+		}
+	}
+	return t, nil
+}
+
+// Exceeded reports whether n different pixels out of total
+// are above the threshold.
+func (t Threshold) Exceeded(n, total int) bool {
+	if t.Pixels < 0 && t.Percent < 0 {
+		return false
+	}
+	if t.Pixels >= 0 && !(float64(n) > t.Pixels) {
+		return false
+	}
+	// n/total > p/100, avoiding rounding of the division
+	if t.Percent >= 0 && !(100*float64(n) > t.Percent*float64(total)) {
+		return false
+	}
+	return true
+}
+
+// String returns t in the form accepted by ParseThreshold.
+func (t Threshold) String() string {
+	var parts []string
+	if t.Pixels >= 0 {
+		parts = append(parts, strconv.FormatFloat(t.Pixels, 'g', -1, 64))
+	}
+	if t.Percent >= 0 {
+		parts = append(parts, strconv.FormatFloat(t.Percent, 'g', -1, 64)+"%")
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses s with ParseThreshold and replaces t with the result.
+func (t *Threshold) Set(s string) error {
+	v, err := ParseThreshold(s)
+	if err != nil {
+		return err
+	}
+	*t = v
+	return nil
+}
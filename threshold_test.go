@@ -0,0 +1,112 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"flag"
+	"testing"
+)
+
+var _ flag.Value = (*Threshold)(nil)
+
+func TestParseThreshold(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Threshold
+		str  string
+	}{
+		{"", Threshold{}, "0,0%"},
+		{"0", Threshold{0, -1}, "0"},
+		{"200", Threshold{200, -1}, "200"},
+		{"1.5", Threshold{1.5, -1}, "1.5"},
+		{"0.5%", Threshold{-1, 0.5}, "0.5%"},
+		{"200,0.5%", Threshold{200, 0.5}, "200,0.5%"},
+		{"0.5%,200", Threshold{200, 0.5}, "200,0.5%"},
+		{" 10 , 1% ", Threshold{10, 1}, "10,1%"},
+		{"100%", Threshold{-1, 100}, "100%"},
+	}
+	for i, test := range tests {
+		th, err := ParseThreshold(test.s)
+		if err != nil {
+			t.Errorf("(%d) ParseThreshold(%q): %v", i, test.s, err)
+			continue
+		}
+		if th != test.want {
+			t.Errorf("(%d) ParseThreshold(%q) = %+v; want %+v", i, test.s, th, test.want)
+		}
+		if s := th.String(); s != test.str {
+			t.Errorf("(%d) String() = %q; want %q", i, s, test.str)
+		}
+	}
+	for _, s := range []string{"x", "%", "-1", "-1%", "1,2", "1%,2%", "1,", ",1%", "1%%", "NaN", "NaN%", "Inf", "+Inf%", "-Inf", "100.5%", "1e400"} {
+		if th, err := ParseThreshold(s); err == nil {
+			t.Errorf("ParseThreshold(%q) = %+v; want error", s, th)
+		}
+	}
+}
+
+func TestThresholdExceeded(t *testing.T) {
+	tests := []struct {
+		t        string
+		n, total int
+		exceeded bool
+	}{
+		// zero value
+		{"", 0, 100, false},
+		{"", 1, 100, true},
+		{"", 0, 0, false},
+		// pixels only
+		{"0", 0, 100, false},
+		{"0", 1, 100, true},
+		{"5", 5, 100, false},
+		{"5", 6, 100, true},
+		{"5", 6, 6, true},
+		{"1.5", 1, 100, false},
+		{"1.5", 2, 100, true},
+		// percent only
+		{"0%", 0, 100, false},
+		{"0%", 1, 100, true},
+		{"0.5%", 5, 1000, false},
+		{"0.5%", 6, 1000, true},
+		{"0.5%", 1, 10000, false},
+		{"1%", 7, 700, false},
+		{"1%", 8, 700, true},
+		{"33%", 1, 3, true},
+		{"50%", 3, 4, true},
+		{"100%", 100, 100, false},
+		{"0%", 0, 0, false},
+		{"50%", 0, 0, false},
+		// both must be exceeded
+		{"200,0.5%", 200, 10000, false},
+		{"200,0.5%", 201, 10000, true},
+		{"200,0.5%", 201, 100000, false},
+		{"200,0.5%", 50, 1000, false},
+		{"200,0.5%", 501, 100000, true},
+		{"0,0%", 1, 100, true},
+		{"0,0%", 0, 0, false},
+	}
+	for i, test := range tests {
+		th, err := ParseThreshold(test.t)
+		if err != nil {
+			t.Fatalf("(%d) ParseThreshold(%q): %v", i, test.t, err)
+		}
+		if e := th.Exceeded(test.n, test.total); e != test.exceeded {
+			t.Errorf("(%d) -t %q, %d of %d: Exceeded = %v; want %v", i, test.t, test.n, test.total, e, test.exceeded)
+		}
+	}
+	if (Threshold{-1, -1}).Exceeded(100, 100) {
+		t.Error("Threshold with no limits exceeded")
+	}
+}
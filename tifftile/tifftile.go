@@ -0,0 +1,570 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tifftile provides lazy, tile by tile decoding of tiled TIFF images.
+//
+// Large TIFFs, such as geospatial rasters and scans, are often organized
+// in tiles which can be decoded independently. An Image decodes only
+// the tiles it is asked for, so that comparing two such images needs
+// only a couple of tiles in memory at a time.
+//
+// Supported are the baseline subset of tiled TIFFs: chunky (interleaved)
+// gray, gray+alpha, RGB and RGBA samples of 8 or 16 bits, uncompressed,
+// LZW or Deflate compressed, with an optional horizontal predictor.
+// Strip-organized TIFFs of the same subset can be opened with OpenStrips.
+// Everything else should be decoded with golang.org/x/image/tiff.
+package tifftile
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"golang.org/x/image/tiff/lzw"
+)
+
+var (
+	// ErrNotTiled is returned by Open for valid TIFFs which are not tiled.
+	ErrNotTiled = errors.New("tifftile: not a tiled TIFF")
+	// ErrFormat is returned by Open when the input is not a valid TIFF.
+	ErrFormat = errors.New("tifftile: invalid TIFF")
+)
+
+// UnsupportedError is returned by Open for tiled TIFFs using
+// features this package does not implement.
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string {
+	return "tifftile: unsupported " + string(e)
+}
+
+// TIFF tags used by this package.
+const (
+	tImageWidth      = 256
+	tImageLength     = 257
+	tBitsPerSample   = 258
+	tCompression     = 259
+	tPhotometric     = 262
+	tStripOffsets    = 273
+	tSamplesPerPixel = 277
+	tRowsPerStrip    = 278
+	tStripByteCounts = 279
+	tPlanarConfig    = 284
+	tPredictor       = 317
+	tTileWidth       = 322
+	tTileLength      = 323
+	tTileOffsets     = 324
+	tTileByteCounts  = 325
+	tExtraSamples    = 338
+	tSampleFormat    = 339
+)
+
+// TIFF field types used by this package.
+const (
+	dtByte  = 1
+	dtShort = 3
+	dtLong  = 4
+)
+
+// Compression schemes.
+const (
+	cNone       = 1
+	cLZW        = 5
+	cDeflate    = 8
+	cDeflateOld = 32946
+)
+
+// Photometric interpretations.
+const (
+	pWhiteIsZero = 0
+	pBlackIsZero = 1
+	pRGB         = 2
+)
+
+// Image is a lazily decoded tiled TIFF.
+// It is safe for concurrent use.
+type Image struct {
+	r  io.ReaderAt
+	bo binary.ByteOrder
+
+	bounds      image.Rectangle
+	tw, th      int // tile size
+	cols        int // tiles per row
+	bps         int // bits per sample
+	spp         int // samples per pixel
+	photometric int
+	compression int
+	predictor   int
+	alpha       int  // 0: none, 1: associated (premultiplied), 2: unassociated
+	strips      bool // tiles are full-width strips
+	offsets     []uint
+	counts      []uint
+
+	mu     sync.Mutex
+	cached int // index of the last decoded tile, -1 if none
+	tile   image.Image
+}
+
+// Open parses the TIFF header and the first image directory read from r.
+// It returns ErrNotTiled if the image is organized in strips.
+// No pixel data is read until Tile or At is called.
+func Open(r io.ReaderAt) (*Image, error) {
+	return open(r, false)
+}
+
+// OpenStrips is like Open but also accepts TIFFs organized in strips.
+// Each strip is exposed as a tile spanning the whole image width,
+// so that Tile decodes one strip at a time.
+func OpenStrips(r io.ReaderAt) (*Image, error) {
+	return open(r, true)
+}
+
+func open(r io.ReaderAt, strips bool) (*Image, error) {
+	var hdr [8]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return nil, ErrFormat
+	}
+	m := &Image{r: r, cached: -1}
+	switch string(hdr[:4]) {
+	case "II\x2a\x00":
+		m.bo = binary.LittleEndian
+	case "MM\x00\x2a":
+		m.bo = binary.BigEndian
+	default:
+		return nil, ErrFormat
+	}
+	ifd, err := m.readIFD(int64(m.bo.Uint32(hdr[4:])))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ifd[tTileOffsets]; !ok {
+		if _, ok := ifd[tStripOffsets]; !ok || !strips {
+			return nil, ErrNotTiled
+		}
+		m.strips = true
+	}
+	if err := m.parse(ifd); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ifdEntry is a raw image file directory entry.
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	value []byte // count values of typ
+}
+
+func (m *Image) readIFD(off int64) (map[uint16]ifdEntry, error) {
+	var nbuf [2]byte
+	if _, err := m.r.ReadAt(nbuf[:], off); err != nil {
+		return nil, ErrFormat
+	}
+	n := int(m.bo.Uint16(nbuf[:]))
+	buf := make([]byte, 12*n)
+	if _, err := m.r.ReadAt(buf, off+2); err != nil {
+		return nil, ErrFormat
+	}
+	ifd := make(map[uint16]ifdEntry, n)
+	for i := 0; i < n; i++ {
+		p := buf[12*i : 12*(i+1)]
+		e := ifdEntry{typ: m.bo.Uint16(p[2:]), count: m.bo.Uint32(p[4:])}
+		var size uint64
+		switch e.typ {
+		case dtByte:
+			size = 1
+		case dtShort:
+			size = 2
+		case dtLong:
+			size = 4
+		default:
+			continue // not needed by this package
+		}
+		size *= uint64(e.count)
+		if size <= 4 {
+			e.value = p[8 : 8+size]
+		} else {
+			if size > 1<<30 {
+				return nil, ErrFormat
+			}
+			e.value = make([]byte, size)
+			if _, err := m.r.ReadAt(e.value, int64(m.bo.Uint32(p[8:]))); err != nil {
+				return nil, ErrFormat
+			}
+		}
+		ifd[m.bo.Uint16(p)] = e
+	}
+	return ifd, nil
+}
+
+// uints decodes all values of an entry as unsigned integers.
+func (m *Image) uints(e ifdEntry) []uint {
+	v := make([]uint, e.count)
+	for i := range v {
+		switch e.typ {
+		case dtByte:
+			v[i] = uint(e.value[i])
+		case dtShort:
+			v[i] = uint(m.bo.Uint16(e.value[2*i:]))
+		case dtLong:
+			v[i] = uint(m.bo.Uint32(e.value[4*i:]))
+		}
+	}
+	return v
+}
+
+func (m *Image) parse(ifd map[uint16]ifdEntry) error {
+	// first value of a tag or def if the tag is missing
+	first := func(tag uint16, def uint) uint {
+		e, ok := ifd[tag]
+		if !ok || e.count == 0 {
+			return def
+		}
+		return m.uints(e)[0]
+	}
+
+	w, h := int(first(tImageWidth, 0)), int(first(tImageLength, 0))
+	offTag, countTag := uint16(tTileOffsets), uint16(tTileByteCounts)
+	if m.strips {
+		offTag, countTag = tStripOffsets, tStripByteCounts
+		// RowsPerStrip defaults to 2**32-1, i.e. a single strip
+		m.tw, m.th = w, h
+		if n := first(tRowsPerStrip, 0); n > 0 && n < uint(h) {
+			m.th = int(n)
+		}
+	} else {
+		m.tw, m.th = int(first(tTileWidth, 0)), int(first(tTileLength, 0))
+		if m.tw > 1<<16 || m.th > 1<<16 {
+			return ErrFormat
+		}
+	}
+	if w <= 0 || h <= 0 || m.tw <= 0 || m.th <= 0 || w > 1<<24 || h > 1<<24 {
+		return ErrFormat
+	}
+	m.bounds = image.Rect(0, 0, w, h)
+	m.cols = (w + m.tw - 1) / m.tw
+	ntiles := m.cols * ((h + m.th - 1) / m.th)
+
+	if e, ok := ifd[offTag]; ok {
+		m.offsets = m.uints(e)
+	}
+	if e, ok := ifd[countTag]; ok {
+		m.counts = m.uints(e)
+	}
+	if len(m.offsets) != ntiles || len(m.counts) != ntiles {
+		return ErrFormat
+	}
+
+	if first(tPlanarConfig, 1) != 1 {
+		return UnsupportedError("planar configuration")
+	}
+	if first(tSampleFormat, 1) != 1 {
+		return UnsupportedError("sample format")
+	}
+	m.spp = int(first(tSamplesPerPixel, 1))
+	m.bps = int(first(tBitsPerSample, 1))
+	if e, ok := ifd[tBitsPerSample]; ok {
+		for _, b := range m.uints(e) {
+			if int(b) != m.bps {
+				return UnsupportedError("mixed bits per sample")
+			}
+		}
+	}
+	if m.bps != 8 && m.bps != 16 {
+		return UnsupportedError(fmt.Sprintf("bits per sample: %d", m.bps))
+	}
+	m.photometric = int(first(tPhotometric, pBlackIsZero))
+	switch m.photometric {
+	case pWhiteIsZero, pBlackIsZero:
+		if m.spp != 1 && m.spp != 2 {
+			return UnsupportedError(fmt.Sprintf("gray samples per pixel: %d", m.spp))
+		}
+	case pRGB:
+		if m.spp != 3 && m.spp != 4 {
+			return UnsupportedError(fmt.Sprintf("RGB samples per pixel: %d", m.spp))
+		}
+	default:
+		return UnsupportedError(fmt.Sprintf("photometric interpretation: %d", m.photometric))
+	}
+	if m.spp == 2 || m.spp == 4 {
+		m.alpha = int(first(tExtraSamples, 2))
+		if m.alpha != 1 && m.alpha != 2 {
+			// unspecified extra sample: treat as unassociated alpha
+			m.alpha = 2
+		}
+	}
+	m.compression = int(first(tCompression, cNone))
+	switch m.compression {
+	case cNone, cLZW, cDeflate, cDeflateOld:
+	default:
+		return UnsupportedError(fmt.Sprintf("compression: %d", m.compression))
+	}
+	m.predictor = int(first(tPredictor, 1))
+	if m.predictor != 1 && m.predictor != 2 {
+		return UnsupportedError(fmt.Sprintf("predictor: %d", m.predictor))
+	}
+	return nil
+}
+
+// ColorModel returns the color model of decoded tiles.
+func (m *Image) ColorModel() color.Model {
+	switch {
+	case m.spp == 1 && m.bps == 8:
+		return color.GrayModel
+	case m.spp == 1:
+		return color.Gray16Model
+	case m.alpha == 1 && m.bps == 8:
+		return color.RGBAModel
+	case m.alpha == 1:
+		return color.RGBA64Model
+	case m.spp == 3 && m.bps == 8:
+		return color.RGBAModel
+	case m.spp == 3:
+		return color.RGBA64Model
+	case m.bps == 8:
+		return color.NRGBAModel
+	}
+	return color.NRGBA64Model
+}
+
+// Bounds returns the image bounds, which always start at (0, 0).
+func (m *Image) Bounds() image.Rectangle {
+	return m.bounds
+}
+
+// At returns the color of the pixel at (x, y), decoding its tile if needed.
+// The most recently decoded tile is cached.
+// It returns transparent black if the tile cannot be decoded.
+func (m *Image) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(m.bounds)) {
+		return color.Transparent
+	}
+	i := (y/m.th)*m.cols + x/m.tw
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cached != i {
+		t, err := m.decode(i)
+		if err != nil {
+			return color.Transparent
+		}
+		m.cached, m.tile = i, t
+	}
+	return m.tile.At(x, y)
+}
+
+// TileSize returns the size of a single tile.
+// Tiles at the right and bottom edges may be clipped by the image bounds.
+func (m *Image) TileSize() image.Point {
+	return image.Pt(m.tw, m.th)
+}
+
+// Tiles returns rectangles of all tiles, clipped to the image bounds,
+// in row-major order.
+func (m *Image) Tiles() []image.Rectangle {
+	r := make([]image.Rectangle, len(m.offsets))
+	for i := range r {
+		r[i] = m.tileRect(i)
+	}
+	return r
+}
+
+func (m *Image) tileRect(i int) image.Rectangle {
+	x, y := (i%m.cols)*m.tw, (i/m.cols)*m.th
+	return image.Rect(x, y, x+m.tw, y+m.th).Intersect(m.bounds)
+}
+
+// Tile decodes the i-th tile in row-major order.
+// The returned image bounds are those of Tiles()[i].
+// Decoded tiles are not cached.
+func (m *Image) Tile(i int) (image.Image, error) {
+	if i < 0 || i >= len(m.offsets) {
+		return nil, fmt.Errorf("tifftile: tile index %d out of range", i)
+	}
+	return m.decode(i)
+}
+
+func (m *Image) decode(i int) (image.Image, error) {
+	if m.counts[i] > 1<<30 {
+		return nil, ErrFormat
+	}
+	raw := make([]byte, m.counts[i])
+	if _, err := m.r.ReadAt(raw, int64(m.offsets[i])); err != nil && err != io.EOF {
+		return nil, err
+	}
+	// the last strip holds only the remaining rows,
+	// whereas tiles are always padded to full size
+	tr := m.tileRect(i)
+	rows := m.th
+	if m.strips {
+		rows = tr.Dy()
+	}
+	rowSize := m.tw * m.spp * m.bps / 8
+	size := rowSize * rows
+	var (
+		buf []byte
+		err error
+	)
+	switch m.compression {
+	case cNone:
+		buf = raw
+	case cLZW:
+		r := lzw.NewReader(bytes.NewReader(raw), lzw.MSB, 8)
+		buf, err = readAtMost(r, size)
+		r.Close()
+	case cDeflate, cDeflateOld:
+		var r io.ReadCloser
+		if r, err = zlib.NewReader(bytes.NewReader(raw)); err == nil {
+			buf, err = readAtMost(r, size)
+			r.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < size {
+		return nil, ErrFormat
+	}
+	if m.predictor == 2 {
+		m.unpredict(buf, rowSize, rows)
+	}
+	return m.tileImage(tr, buf, rowSize), nil
+}
+
+// readAtMost reads r to the end, or returns ErrFormat once it yields
+// more than size bytes, so that a small compressed tile can't inflate
+// without limit.
+func readAtMost(r io.Reader, size int) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, int64(size)+1))
+	if err == nil && len(buf) > size {
+		return nil, ErrFormat
+	}
+	return buf, err
+}
+
+// unpredict reverts horizontal differencing of the first n rows in buf.
+func (m *Image) unpredict(buf []byte, rowSize, n int) {
+	for y := 0; y < n; y++ {
+		row := buf[y*rowSize : (y+1)*rowSize]
+		if m.bps == 8 {
+			for i := m.spp; i < len(row); i++ {
+				row[i] += row[i-m.spp]
+			}
+			continue
+		}
+		for i := 2 * m.spp; i+1 < len(row); i += 2 {
+			v := m.bo.Uint16(row[i:]) + m.bo.Uint16(row[i-2*m.spp:])
+			m.bo.PutUint16(row[i:], v)
+		}
+	}
+}
+
+// tileImage converts decoded samples of a tile into an image with bounds r.
+func (m *Image) tileImage(r image.Rectangle, buf []byte, rowSize int) image.Image {
+	w, h := r.Dx(), r.Dy()
+	if m.spp == 1 {
+		if m.bps == 8 {
+			g := image.NewGray(r)
+			for y := 0; y < h; y++ {
+				row := g.Pix[y*g.Stride : y*g.Stride+w]
+				copy(row, buf[y*rowSize:])
+				if m.photometric == pWhiteIsZero {
+					for x := range row {
+						row[x] = 0xff - row[x]
+					}
+				}
+			}
+			return g
+		}
+		g := image.NewGray16(r)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				v := m.bo.Uint16(buf[y*rowSize+2*x:])
+				if m.photometric == pWhiteIsZero {
+					v = 0xffff - v
+				}
+				g.Pix[y*g.Stride+2*x] = uint8(v >> 8)
+				g.Pix[y*g.Stride+2*x+1] = uint8(v)
+			}
+		}
+		return g
+	}
+
+	// pixels are assembled from 16-bit samples, narrowed for 8-bit images
+	var (
+		pix    []uint8
+		stride int
+		out    image.Image
+	)
+	premul := m.alpha == 1 || m.spp == 3
+	switch {
+	case m.bps == 8 && premul:
+		t := image.NewRGBA(r)
+		pix, stride, out = t.Pix, t.Stride, t
+	case m.bps == 8:
+		t := image.NewNRGBA(r)
+		pix, stride, out = t.Pix, t.Stride, t
+	case premul:
+		t := image.NewRGBA64(r)
+		pix, stride, out = t.Pix, t.Stride, t
+	default:
+		t := image.NewNRGBA64(r)
+		pix, stride, out = t.Pix, t.Stride, t
+	}
+	var s [4]uint16
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			for c := 0; c < m.spp; c++ {
+				if m.bps == 8 {
+					s[c] = uint16(buf[y*rowSize+x*m.spp+c])
+				} else {
+					s[c] = m.bo.Uint16(buf[y*rowSize+2*(x*m.spp+c):])
+				}
+			}
+			var v [4]uint16
+			switch m.spp {
+			case 2:
+				g := s[0]
+				if m.photometric == pWhiteIsZero {
+					g = uint16(1<<uint(m.bps)-1) - g
+				}
+				v = [4]uint16{g, g, g, s[1]}
+			case 3:
+				v = [4]uint16{s[0], s[1], s[2], uint16(1<<uint(m.bps) - 1)}
+			case 4:
+				v = s
+			}
+			if m.bps == 8 {
+				o := y*stride + 4*x
+				for c := 0; c < 4; c++ {
+					pix[o+c] = uint8(v[c])
+				}
+				continue
+			}
+			o := y*stride + 8*x
+			for c := 0; c < 4; c++ {
+				pix[o+2*c] = uint8(v[c] >> 8)
+				pix[o+2*c+1] = uint8(v[c])
+			}
+		}
+	}
+	return out
+}
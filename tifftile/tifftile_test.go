@@ -0,0 +1,294 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tifftile
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+func TestTiles(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	src := image.NewNRGBA(image.Rect(0, 0, 37, 21))
+	rnd.Read(src.Pix)
+	gray := image.NewGray(src.Bounds())
+	rnd.Read(gray.Pix)
+	gray16 := image.NewGray16(src.Bounds())
+	rnd.Read(gray16.Pix)
+
+	tests := []struct {
+		name      string
+		m         image.Image
+		deflate   bool
+		predictor bool
+	}{
+		{"nrgba", src, false, false},
+		{"nrgba deflate", src, true, false},
+		{"nrgba predictor", src, true, true},
+		{"gray", gray, false, false},
+		{"gray predictor", gray, true, true},
+		{"gray16", gray16, false, false},
+		{"gray16 predictor", gray16, true, true},
+	}
+	for _, test := range tests {
+		data := encodeTiled(test.m, 16, 8, test.deflate, test.predictor)
+		m, err := Open(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if m.Bounds() != test.m.Bounds() {
+			t.Errorf("%s: bounds = %v; want %v", test.name, m.Bounds(), test.m.Bounds())
+			continue
+		}
+		tiles := m.Tiles()
+		if len(tiles) != 3*3 {
+			t.Errorf("%s: len(tiles) = %d; want 9", test.name, len(tiles))
+		}
+		for i, r := range tiles {
+			tile, err := m.Tile(i)
+			if err != nil {
+				t.Errorf("%s: tile %d: %v", test.name, i, err)
+				continue
+			}
+			if tile.Bounds() != r {
+				t.Errorf("%s: tile %d bounds = %v; want %v", test.name, i, tile.Bounds(), r)
+			}
+			if !sameColors(tile, test.m, r) {
+				t.Errorf("%s: tile %d pixels differ", test.name, i)
+			}
+		}
+		if !sameColors(m, test.m, m.Bounds()) {
+			t.Errorf("%s: At pixels differ", test.name)
+		}
+	}
+}
+
+func TestNotTiled(t *testing.T) {
+	f, err := os.Open(filepath.Join("..", "testdata", "bug1102605.tif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := Open(f); err != ErrNotTiled {
+		t.Errorf("err = %v; want ErrNotTiled", err)
+	}
+	if _, err := Open(bytes.NewReader([]byte("not a tiff"))); err != ErrFormat {
+		t.Errorf("err = %v; want ErrFormat", err)
+	}
+}
+
+func TestInflatedTile(t *testing.T) {
+	data := encodeTiled(image.NewGray(image.Rect(0, 0, 20, 10)), 16, 8, true, false)
+	// a tile which inflates to far more than its 16 x 8 bytes
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(make([]byte, 1<<20))
+	zw.Close()
+	m, err := Open(bytes.NewReader(append(data, z.Bytes()...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.offsets[0], m.counts[0] = uint(len(data)), uint(z.Len())
+	if _, err := m.Tile(0); err != ErrFormat {
+		t.Errorf("err = %v; want ErrFormat", err)
+	}
+}
+
+func TestOpenStrips(t *testing.T) {
+	f, err := os.Open(filepath.Join("..", "testdata", "bug1102605.tif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want, err := tiff.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := OpenStrips(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := m.Bounds()
+	if b != want.Bounds() {
+		t.Fatalf("bounds = %v; want %v", b, want.Bounds())
+	}
+	for i, r := range m.Tiles() {
+		if r.Min.X != 0 || r.Max.X != b.Max.X {
+			t.Errorf("strip %d = %v; want full width", i, r)
+		}
+		tile, err := m.Tile(i)
+		if err != nil {
+			t.Errorf("strip %d: %v", i, err)
+			continue
+		}
+		if !sameColors(tile, want, r) {
+			t.Errorf("strip %d pixels differ", i)
+		}
+	}
+
+	// tiled images are opened as usual
+	data := encodeTiled(image.NewGray(image.Rect(0, 0, 20, 10)), 16, 8, false, false)
+	if m, err := OpenStrips(bytes.NewReader(data)); err != nil || m.TileSize() != image.Pt(16, 8) {
+		t.Errorf("tiled: err = %v", err)
+	}
+}
+
+func sameColors(a, b image.Image, r image.Rectangle) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// encodeTiled writes m, which must be *image.NRGBA, *image.Gray or
+// *image.Gray16, as a little-endian tiled TIFF with tiles of tw x th.
+func encodeTiled(m image.Image, tw, th int, deflate, predictor bool) []byte {
+	var (
+		spp, bps int
+		photo    uint32 = pBlackIsZero
+		sample   func(x, y, c int) uint16
+	)
+	switch m := m.(type) {
+	case *image.NRGBA:
+		spp, bps, photo = 4, 8, pRGB
+		sample = func(x, y, c int) uint16 { return uint16(m.Pix[m.PixOffset(x, y)+c]) }
+	case *image.Gray:
+		spp, bps = 1, 8
+		sample = func(x, y, c int) uint16 { return uint16(m.GrayAt(x, y).Y) }
+	case *image.Gray16:
+		spp, bps = 1, 16
+		sample = func(x, y, c int) uint16 { return m.Gray16At(x, y).Y }
+	}
+	b := m.Bounds()
+	cols, rows := (b.Dx()+tw-1)/tw, (b.Dy()+th-1)/th
+	bo := binary.LittleEndian
+
+	var data bytes.Buffer
+	data.Write([]byte("II\x2a\x00\x00\x00\x00\x00"))
+	var offsets, counts []uint32
+	for ty := 0; ty < rows; ty++ {
+		for tx := 0; tx < cols; tx++ {
+			// tiles are always full size, padded with zeros
+			s := make([]uint16, tw*th*spp)
+			for y := 0; y < th; y++ {
+				for x := 0; x < tw; x++ {
+					px, py := tx*tw+x, ty*th+y
+					if px >= b.Dx() || py >= b.Dy() {
+						continue
+					}
+					for c := 0; c < spp; c++ {
+						s[(y*tw+x)*spp+c] = sample(px, py, c)
+					}
+				}
+			}
+			if predictor {
+				for y := 0; y < th; y++ {
+					row := s[y*tw*spp : (y+1)*tw*spp]
+					for i := len(row) - 1; i >= spp; i-- {
+						row[i] -= row[i-spp]
+					}
+				}
+			}
+			raw := make([]byte, len(s)*bps/8)
+			for i, v := range s {
+				if bps == 8 {
+					raw[i] = uint8(v)
+				} else {
+					bo.PutUint16(raw[2*i:], v)
+				}
+			}
+			if deflate {
+				var z bytes.Buffer
+				zw := zlib.NewWriter(&z)
+				zw.Write(raw)
+				zw.Close()
+				raw = z.Bytes()
+			}
+			offsets = append(offsets, uint32(data.Len()))
+			counts = append(counts, uint32(len(raw)))
+			data.Write(raw)
+		}
+	}
+
+	type entry struct {
+		tag    uint16
+		values []uint32
+	}
+	compression, pred := uint32(cNone), uint32(1)
+	if deflate {
+		compression = cDeflate
+	}
+	if predictor {
+		pred = 2
+	}
+	bpsv := make([]uint32, spp)
+	for i := range bpsv {
+		bpsv[i] = uint32(bps)
+	}
+	entries := []entry{
+		{tImageWidth, []uint32{uint32(b.Dx())}},
+		{tImageLength, []uint32{uint32(b.Dy())}},
+		{tBitsPerSample, bpsv},
+		{tCompression, []uint32{compression}},
+		{tPhotometric, []uint32{photo}},
+		{tSamplesPerPixel, []uint32{uint32(spp)}},
+		{tPredictor, []uint32{pred}},
+		{tTileWidth, []uint32{uint32(tw)}},
+		{tTileLength, []uint32{uint32(th)}},
+		{tTileOffsets, offsets},
+		{tTileByteCounts, counts},
+	}
+	if spp == 4 {
+		entries = append(entries, entry{tExtraSamples, []uint32{2}})
+	}
+
+	// all values are written as LONGs, out of line if they don't fit
+	ifdOff := data.Len()
+	bo.PutUint32(data.Bytes()[4:], uint32(ifdOff))
+	extra := ifdOff + 2 + 12*len(entries) + 4
+	var ifd, ext bytes.Buffer
+	var buf [4]byte
+	bo.PutUint16(buf[:], uint16(len(entries)))
+	ifd.Write(buf[:2])
+	for _, e := range entries {
+		binary.Write(&ifd, bo, []uint16{e.tag, dtLong})
+		binary.Write(&ifd, bo, uint32(len(e.values)))
+		if len(e.values) == 1 {
+			binary.Write(&ifd, bo, e.values[0])
+			continue
+		}
+		binary.Write(&ifd, bo, uint32(extra+ext.Len()))
+		binary.Write(&ext, bo, e.values)
+	}
+	ifd.Write([]byte{0, 0, 0, 0})
+	data.Write(ifd.Bytes())
+	data.Write(ext.Bytes())
+	return data.Bytes()
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+const (
+	// autoTileWidth is the image width above which Compare
+	// uses tiles of defaultTileSize, unless WithTiling is given.
+	// A single row of a float64 plane of such an image is 64KB.
+	autoTileWidth = 8192
+	// defaultTileSize is the width and height of tiles.
+	defaultTileSize = 256
+)
+
+// forTiles calls f(x0, x1, y) for rows y in [y0, y1) of a w pixels wide
+// image split into size x size tiles, one tile after another, each
+// within columns [x0, x1). Tile rows start at y0. If size is 0,
+// f is called once for each whole row.
+//
+// Pixels of the pyramids and of the difference image don't depend
+// on the order they are computed in, so traversing them in tiles
+// gives the same results, as long as the rows a tile depends on are
+// computed beforehand. Convolution reads up to the kernel radius
+// of columns on both sides of a tile, which are computed within
+// the tile's row buffer, see convolution.vertical.
+func forTiles(w, y0, y1, size int, f func(x0, x1, y int)) {
+	if size <= 0 {
+		for y := y0; y < y1; y++ {
+			f(0, w, y)
+		}
+		return
+	}
+	for ty := y0; ty < y1; ty += size {
+		ty1 := ty + size
+		if ty1 > y1 {
+			ty1 = y1
+		}
+		for x0 := 0; x0 < w; x0 += size {
+			x1 := x0 + size
+			if x1 > w {
+				x1 = w
+			}
+			for y := ty; y < ty1; y++ {
+				f(x0, x1, y)
+			}
+		}
+	}
+}
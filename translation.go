@@ -0,0 +1,273 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"math"
+	"math/cmplx"
+)
+
+// phaseMaxSize is the max width and height of luminance
+// phase correlated by DetectTranslation. Larger images are
+// downsampled to it, and the offset refined afterwards.
+const phaseMaxSize = 512
+
+// refineMaxSize is the max width and height of the part of the first
+// image, around the middle of the overlap, on which DetectTranslation
+// refines the offset of downsampled images at full resolution.
+const refineMaxSize = 1024
+
+// DetectTranslation returns the offset of the content of b relative to a,
+// as Align does, so that pixel x, y of a shows the same as pixel
+// x+dx, y+dy of b, e.g. for a screenshot of a scrolled page. Unlike Align,
+// the offset is not limited, other than that the images need to overlap
+// by at least half of them.
+//
+// The offset is the peak of the phase correlation of luminance of the
+// images. Confidence, from 0 to 1, is how much the peak stands out of
+// the rest of the correlation, times the normalized cross-correlation
+// of the images at the offset. It is 0 if either image is of uniform
+// luminance, and low if the images are mostly uniform, with too little
+// content to tell the offset, or if they aren't translated copies
+// of each other.
+//
+// Images larger than 512 pixels are correlated downsampled, and the
+// offset is refined on up to 1024 x 1024 pixels of them, so that no
+// full resolution planes of their luminance are held.
+func DetectTranslation(a, b image.Image) (dx, dy int, confidence float64) {
+	ab, bb := a.Bounds(), b.Bounds()
+	f := 1
+	for (max(ab.Dx(), ab.Dy(), bb.Dx(), bb.Dy())+f-1)/f > phaseMaxSize {
+		f *= 2
+	}
+	ca, cb := shrunkLuma(a, f), shrunkLuma(b, f)
+	w, h := pow2(ca.w, cb.w), pow2(ca.h, cb.h)
+	fa, fb := spectrum(ca, w, h), spectrum(cb, w, h)
+	if fa == nil || fb == nil {
+		return 0, 0, 0
+	}
+	// normalized cross-power spectrum; the small term keeps
+	// frequencies of near zero magnitude from turning into noise
+	var peak float64
+	for i := range fb {
+		fb[i] *= cmplx.Conj(fa[i])
+		peak = math.Max(peak, cmplx.Abs(fb[i]))
+	}
+	eps := peak * 1e-6
+	for i, c := range fb {
+		fb[i] = c / complex(cmplx.Abs(c)+eps, 0)
+	}
+	fft2(fb, w, h, true)
+	px, py, p1 := 0, 0, math.Inf(-1)
+	for i, c := range fb {
+		if v := real(c); v > p1 {
+			px, py, p1 = i%w, i/w, v
+		}
+	}
+	// highest correlation away from the peak
+	p2 := math.Inf(-1)
+	for i, c := range fb {
+		x, y := i%w-px, i/w-py
+		if x = wrap(x, w); x >= -1 && x <= 1 {
+			if y = wrap(y, h); y >= -1 && y <= 1 {
+				continue
+			}
+		}
+		p2 = math.Max(p2, real(c))
+	}
+	if p1 <= 0 {
+		return 0, 0, 0
+	}
+	dx, dy = f*wrap(px, w), f*wrap(py, h)
+	var s float64
+	if f == 1 {
+		s = ncc(ca, cb, dx, dy)
+	} else {
+		dx, dy, s = refineTranslation(a, b, dx, dy, f)
+	}
+	if s <= 0 {
+		return dx, dy, 0
+	}
+	return dx, dy, math.Max(0, (p1-p2)/p1) * s
+}
+
+// refineTranslation returns the offset within f pixels of dx, dy,
+// the offset of b relative to a found downsampled by f, at which
+// luminance of a part of a, and of the part of b it may be shifted
+// over, correlates the most, along with the correlation.
+func refineTranslation(a, b image.Image, dx, dy, f int) (int, int, float64) {
+	ab, bb := a.Bounds(), b.Bounds()
+	ov := overlap(ab.Dx(), ab.Dy(), bb.Dx(), bb.Dy(), dx, dy)
+	if ov.Empty() {
+		return dx, dy, 0
+	}
+	// middle of the overlap, and the part of b it covers, widened by f
+	size := image.Pt(min(ov.Dx(), refineMaxSize), min(ov.Dy(), refineMaxSize))
+	ra := image.Rectangle{Min: ov.Min.Add(ov.Size().Sub(size).Div(2))}
+	ra.Max = ra.Min.Add(size)
+	rb := ra.Add(image.Pt(dx, dy)).Inset(-f).Intersect(image.Rect(0, 0, bb.Dx(), bb.Dy()))
+	la := lumaLevel{luma(crop(a, ra.Add(ab.Min))), ra.Dx(), ra.Dy()}
+	lb := lumaLevel{luma(crop(b, rb.Add(bb.Min))), rb.Dx(), rb.Dy()}
+	// offsets of la and lb are those of a and b moved by this
+	d := ra.Min.Sub(rb.Min)
+	best, s := image.Pt(dx, dy), math.Inf(-1)
+	for oy := dy - f; oy <= dy+f; oy++ {
+		for ox := dx - f; ox <= dx+f; ox++ {
+			if v := ncc(la, lb, ox+d.X, oy+d.Y); v > s {
+				best, s = image.Pt(ox, oy), v
+			}
+		}
+	}
+	return best.X, best.Y, s
+}
+
+// shrunkLuma returns luminance of m, as luma does, downsampled by f,
+// with every pixel the mean of the up to f x f pixels of m it covers.
+// Rows of m are read one at a time, so that no plane of the size of m
+// is allocated.
+func shrunkLuma(m image.Image, f int) lumaLevel {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	sw, sh := (w+f-1)/f, (h+f-1)/f
+	l := make([]float64, sw*sh)
+	row := make([]pixel, w)
+	for y := 0; y < h; y++ {
+		readRow(row, m, b.Min.X, b.Min.Y+y)
+		out := l[y/f*sw:]
+		for x, p := range row {
+			out[x/f] += (0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])) / 0xffff
+		}
+	}
+	for y := 0; y < sh; y++ {
+		ny := min(f, h-y*f)
+		for x := 0; x < sw; x++ {
+			l[y*sw+x] /= float64(ny * min(f, w-x*f))
+		}
+	}
+	return lumaLevel{l, sw, sh}
+}
+
+// spectrum returns the 2D Fourier transform of l, Hann windowed
+// and zero padded to w x h, or nil if l is uniform.
+func spectrum(l lumaLevel, w, h int) []complex128 {
+	var mean float64
+	for _, v := range l.l {
+		mean += v
+	}
+	mean /= float64(len(l.l))
+	uniform := true
+	s := make([]complex128, w*h)
+	for y := 0; y < l.h; y++ {
+		wy := hann(y, l.h)
+		for x := 0; x < l.w; x++ {
+			v := l.l[y*l.w+x] - mean
+			if v != 0 {
+				uniform = false
+			}
+			s[y*w+x] = complex(v*wy*hann(x, l.w), 0)
+		}
+	}
+	if uniform {
+		return nil
+	}
+	fft2(s, w, h, false)
+	return s
+}
+
+// hann returns the Hann window of n samples at i.
+func hann(i, n int) float64 {
+	if n < 2 {
+		return 1
+	}
+	return 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+}
+
+// fft2 transforms w x h s in place, by rows and then by columns,
+// w and h being powers of 2. The inverse transform is scaled by 1/(w*h).
+func fft2(s []complex128, w, h int, inverse bool) {
+	for y := 0; y < h; y++ {
+		fft(s[y*w:(y+1)*w], inverse)
+	}
+	col := make([]complex128, h)
+	for x := 0; x < w; x++ {
+		for y := range col {
+			col[y] = s[y*w+x]
+		}
+		fft(col, inverse)
+		for y, c := range col {
+			s[y*w+x] = c
+		}
+	}
+	if inverse {
+		n := complex(float64(w*h), 0)
+		for i := range s {
+			s[i] /= n
+		}
+	}
+}
+
+// fft is an in place, iterative radix-2 fast Fourier transform
+// of s, of which the length is a power of 2. It is not scaled.
+func fft(s []complex128, inverse bool) {
+	n := len(s)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			s[i], s[j] = s[j], s[i]
+		}
+	}
+	sign := -1.0
+	if inverse {
+		sign = 1
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Rect(1, sign*2*math.Pi/float64(size))
+		for i := 0; i < n; i += size {
+			t := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u, v := s[i+k], s[i+k+size/2]*t
+				s[i+k], s[i+k+size/2] = u+v, u-v
+				t *= step
+			}
+		}
+	}
+}
+
+// pow2 returns the smallest power of 2 not less than any of n.
+func pow2(n ...int) int {
+	p := 1
+	for _, v := range n {
+		for p < v {
+			p <<= 1
+		}
+	}
+	return p
+}
+
+// wrap returns circular offset i of n as one between -n/2 and n/2.
+func wrap(i, n int) int {
+	i %= n
+	if i >= n/2 {
+		i -= n
+	} else if i < -n/2 {
+		i += n
+	}
+	return i
+}
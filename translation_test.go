@@ -0,0 +1,106 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+)
+
+func TestDetectTranslation(t *testing.T) {
+	tests := []struct {
+		a      image.Image
+		dx, dy int
+	}{
+		{blocks(120, 90), 0, 0},
+		{blocks(120, 90), 0, 24},
+		{blocks(120, 90), 0, -17},
+		{blocks(120, 90), 31, 0},
+		{blocks(120, 90), -9, 13},
+		{blocks(100, 300), 0, 120},
+		// downsampled, then refined
+		{blocks(1100, 700), 0, 24},
+		{blocks(700, 1100), -5, 301},
+		// refined on a part of the overlap
+		{blocks(1300, 1200), 7, -40},
+		// mostly white page of text lines
+		{page(200, 400), 0, 24},
+	}
+	for i, test := range tests {
+		b := translate(test.a, test.dx, test.dy)
+		dx, dy, conf := DetectTranslation(test.a, b)
+		if dx != test.dx || dy != test.dy || conf < 0.5 {
+			t.Errorf("(%d) DetectTranslation = %d, %d, %.2f; want %d, %d, >= 0.5", i, dx, dy, conf, test.dx, test.dy)
+		}
+		// the other way around
+		dx, dy, conf = DetectTranslation(b, test.a)
+		if dx != -test.dx || dy != -test.dy || conf < 0.5 {
+			t.Errorf("(%d) reverse DetectTranslation = %d, %d, %.2f; want %d, %d, >= 0.5", i, dx, dy, conf, -test.dx, -test.dy)
+		}
+	}
+}
+
+func TestDetectTranslationUniform(t *testing.T) {
+	white := image.NewGray(image.Rect(0, 0, 200, 150))
+	draw.Draw(white, white.Rect, image.NewUniform(color.White), image.ZP, draw.Src)
+	// a few specks on otherwise uniform images
+	specks := func(seed int64) *image.Gray {
+		m := image.NewGray(white.Rect)
+		copy(m.Pix, white.Pix)
+		rnd := rand.New(rand.NewSource(seed))
+		for i := 0; i < 3; i++ {
+			m.SetGray(rnd.Intn(200), rnd.Intn(150), color.Gray{0xf0})
+		}
+		return m
+	}
+	tests := []struct {
+		a, b image.Image
+	}{
+		{white, white},
+		{white, specks(1)},
+		{specks(1), specks(2)},
+		{blocks(120, 90), specks(3)},
+		// the only content moved by more than half the images
+		{square(200, 150, 20, 20, color.White, color.Black), square(200, 150, 120, 80, color.White, color.Black)},
+	}
+	for i, test := range tests {
+		dx, dy, conf := DetectTranslation(test.a, test.b)
+		if (dx != 0 || dy != 0) && conf >= 0.5 {
+			t.Errorf("(%d) DetectTranslation = %d, %d, %.2f; want low confidence", i, dx, dy, conf)
+		}
+	}
+}
+
+// page returns a w x h white image with rows of gray words of
+// random lengths, as a page of text.
+func page(w, h int) *image.NRGBA {
+	rnd := rand.New(rand.NewSource(1))
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(m, m.Rect, image.NewUniform(color.White), image.ZP, draw.Src)
+	for y := 10; y+8 < h; y += 14 {
+		for x := 8; x < w-8; {
+			n := 4 + rnd.Intn(30)
+			if x+n > w-8 {
+				break
+			}
+			draw.Draw(m, image.Rect(x, y, x+n, y+8), image.NewUniform(color.Gray{uint8(rnd.Intn(0x80))}), image.ZP, draw.Src)
+			x += n + 5
+		}
+	}
+	return m
+}